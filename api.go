@@ -0,0 +1,96 @@
+package gopherdb
+
+// KVStore, Transaction and Bucket are the interfaces of DB, Tx and Collection, for applications that wrap the
+// database, like with metrics or a cache of their own, or replace it with a fake in their tests. They hold the methods
+// most code needs to read and write keys, and they only grow in a backwards compatible way: code written against them
+// keeps compiling as the concrete types change. The transactions of ViewTransaction and UpdateTransaction are run like
+// the ones of View and Update.
+//
+//	func addUser(store gopherdb.KVStore, id []byte, user []byte) error {
+//		return store.UpdateTransaction(func(tx gopherdb.Transaction) error {
+//			users, err := tx.CreateBucket([]byte("users"))
+//			if err != nil {
+//				return err
+//			}
+//			return users.Put(id, user)
+//		})
+//	}
+
+// KVStore is the interface of a DB.
+type KVStore interface {
+	// Get returns a copy of the value of the key in the collection, or ErrKeyNotFound, see DB.Get.
+	Get(collection []byte, key []byte) ([]byte, error)
+	// Put sets the value of the key in the collection, creating it if needed, see DB.Put.
+	Put(collection []byte, key []byte, value []byte) error
+	// ViewTransaction runs fn in a read transaction, see DB.View.
+	ViewTransaction(fn func(tx Transaction) error) error
+	// UpdateTransaction runs fn in a write transaction, committed if fn returns nil, see DB.Update.
+	UpdateTransaction(fn func(tx Transaction) error) error
+}
+
+// Transaction is the interface of a Tx, as run by KVStore.
+type Transaction interface {
+	// ID returns the id of the transaction, see Tx.ID.
+	ID() uint64
+	// Bucket returns the collection, or nil if it doesn't exist.
+	Bucket(name []byte) (Bucket, error)
+	// CreateBucket returns the collection, creating it if it doesn't exist. It fails with ErrWriteInsideReadTx in
+	// read transactions.
+	CreateBucket(name []byte) (Bucket, error)
+	// DeleteCollection deletes the collection, see Tx.DeleteCollection.
+	DeleteCollection(name []byte, mode DeleteMode) error
+}
+
+// Bucket is the interface of a Collection.
+type Bucket interface {
+	// Get returns a copy of the value of the key, or ErrKeyNotFound if it doesn't exist.
+	Get(key []byte) ([]byte, error)
+	Put(key []byte, value []byte) error
+	Remove(key []byte) error
+	// Merge sets the key to what fn returns from its current value, see Collection.Merge.
+	Merge(key []byte, fn func(current []byte) ([]byte, error)) error
+	// Scan calls fn with the keys starting with the prefix and their values in order, see Collection.Scan.
+	Scan(prefix []byte, fn func(key, value []byte) error) error
+}
+
+var (
+	_ KVStore     = (*DB)(nil)
+	_ Transaction = (*Tx)(nil)
+	_ Bucket      = (*Collection)(nil)
+)
+
+// ViewTransaction runs fn in a read transaction like View, with the transaction as a Transaction.
+func (db *DB) ViewTransaction(fn func(tx Transaction) error) error {
+	return db.View(func(tx *Tx) error {
+		return fn(tx)
+	})
+}
+
+// UpdateTransaction runs fn in a write transaction like Update, with the transaction as a Transaction.
+func (db *DB) UpdateTransaction(fn func(tx Transaction) error) error {
+	return db.Update(func(tx *Tx) error {
+		return fn(tx)
+	})
+}
+
+// Bucket returns the collection like GetCollection, as a Bucket. It returns a nil Bucket, not a Bucket holding a nil
+// collection, if the collection doesn't exist.
+func (tx *Tx) Bucket(name []byte) (Bucket, error) {
+	c, err := tx.GetCollection(name)
+	if err != nil || c == nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// CreateBucket returns the collection, creating it if it doesn't exist, as a Bucket.
+func (tx *Tx) CreateBucket(name []byte) (Bucket, error) {
+	if !tx.write {
+		return nil, ErrWriteInsideReadTx
+	}
+	c, err := tx.getOrCreateCollection(name)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
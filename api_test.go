@@ -0,0 +1,129 @@
+package gopherdb
+
+import (
+	"errors"
+	"testing"
+)
+
+// fakeStore is a KVStore of a single transaction over maps, like the fakes applications write for their tests.
+type fakeStore map[string]fakeBucket
+
+type fakeBucket map[string][]byte
+
+func (s fakeStore) Get(collection []byte, key []byte) ([]byte, error) {
+	return s[string(collection)].Get(key)
+}
+
+func (s fakeStore) Put(collection []byte, key []byte, value []byte) error {
+	b, _ := s.CreateBucket(collection)
+	return b.Put(key, value)
+}
+
+func (s fakeStore) ViewTransaction(fn func(tx Transaction) error) error   { return fn(s) }
+func (s fakeStore) UpdateTransaction(fn func(tx Transaction) error) error { return fn(s) }
+func (s fakeStore) ID() uint64                                            { return 1 }
+
+func (s fakeStore) Bucket(name []byte) (Bucket, error) {
+	if b, ok := s[string(name)]; ok {
+		return b, nil
+	}
+	return nil, nil
+}
+
+func (s fakeStore) CreateBucket(name []byte) (Bucket, error) {
+	if _, ok := s[string(name)]; !ok {
+		s[string(name)] = fakeBucket{}
+	}
+	return s[string(name)], nil
+}
+
+func (s fakeStore) DeleteCollection(name []byte, mode DeleteMode) error {
+	delete(s, string(name))
+	return nil
+}
+
+func (b fakeBucket) Get(key []byte) ([]byte, error) {
+	value, ok := b[string(key)]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return value, nil
+}
+
+func (b fakeBucket) Put(key []byte, value []byte) error {
+	b[string(key)] = value
+	return nil
+}
+
+func (b fakeBucket) Remove(key []byte) error {
+	delete(b, string(key))
+	return nil
+}
+
+func (b fakeBucket) Merge(key []byte, fn func(current []byte) ([]byte, error)) error {
+	value, err := fn(b[string(key)])
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
+
+func (b fakeBucket) Scan(prefix []byte, fn func(key, value []byte) error) error {
+	return errors.New("not implemented")
+}
+
+// renameUser is application code written against the interfaces.
+func renameUser(store KVStore, id string, name string) error {
+	return store.UpdateTransaction(func(tx Transaction) error {
+		users, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		return users.Merge([]byte(id), func(current []byte) ([]byte, error) {
+			if current == nil {
+				return nil, ErrKeyNotFound
+			}
+			return []byte(name), nil
+		})
+	})
+}
+
+func TestInterfaces(t *testing.T) {
+	db := openTestDB(t, nil)
+	for _, store := range []KVStore{db, fakeStore{}} {
+		if err := store.Put([]byte("users"), []byte("1"), []byte("ada")); err != nil {
+			t.Fatal(err)
+		}
+		if err := renameUser(store, "1", "grace"); err != nil {
+			t.Fatalf("%T: %v", store, err)
+		}
+		if err := renameUser(store, "2", "alan"); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("%T: got %v renaming a missing user", store, err)
+		}
+		if value, err := store.Get([]byte("users"), []byte("1")); err != nil || string(value) != "grace" {
+			t.Fatalf("%T: got %q, %v", store, value, err)
+		}
+	}
+
+	err := db.ViewTransaction(func(tx Transaction) error {
+		if b, err := tx.Bucket([]byte("missing")); err != nil || b != nil {
+			t.Fatalf("got %v, %v for a missing collection", b, err)
+		}
+		if _, err := tx.CreateBucket([]byte("new")); !errors.Is(err, ErrWriteInsideReadTx) {
+			t.Fatalf("got %v creating a collection in a read transaction", err)
+		}
+		users, err := tx.Bucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		return users.Scan(nil, func(key, value []byte) error {
+			if string(key) != "1" || string(value) != "grace" {
+				t.Fatalf("scanned %s=%s", key, value)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
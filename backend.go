@@ -0,0 +1,144 @@
+package gopherdb
+
+import (
+	"errors"
+	"os"
+	"sync"
+)
+
+// Backend is the storage the pages of a database are kept in, for databases opened with OpenBackend: an encrypted
+// file, a remote block store, or a fake failing on purpose in tests. Pages are numbered from zero, and every page
+// read or written is a whole page of the page size of the options. The methods are called by one goroutine at a time
+// for writes, but ReadPage can be called by many read transactions at once, and while a page is written.
+type Backend interface {
+	// ReadPage reads the page into buf. A page past the end of the storage returns io.EOF, along with the part of the
+	// page before the end, if any.
+	ReadPage(pageNum uint64, buf []byte) error
+	// WritePage writes the page, growing the storage if it's past the end.
+	WritePage(pageNum uint64, data []byte) error
+	// Sync makes the pages written so far durable. Commits rely on it to write their meta page after their other
+	// pages, so a crash never leaves a meta page pointing to pages that weren't written.
+	Sync() error
+	// Size returns the size of the storage in bytes, zero for a new database.
+	Size() (int64, error)
+	// Close releases the storage, once the database is closed.
+	Close() error
+}
+
+var ErrBackendWAL = errors.New("the WAL is kept next to the file, so it can't be used with a backend")
+
+// fileBackend is the backend of the databases opened with Open, the pages of a file. With mmap set, pages are copied
+// from a mapping of the file instead of read with a syscall each, see Options.MMap.
+type fileBackend struct {
+	file *os.File
+	mmap bool
+	// mu guards mapped, the mapping of the file, and unmappable, set if the file can't be mapped. It's mapped on the
+	// first read, and mapped again when a read goes past its end once the file grew.
+	mu         sync.RWMutex
+	mapped     []byte
+	unmappable bool
+}
+
+func (b *fileBackend) ReadPage(pageNum uint64, buf []byte) error {
+	offset := int64(pageNum) * int64(len(buf))
+	if b.mmap && b.readMapped(offset, buf) {
+		return nil
+	}
+	_, err := b.file.ReadAt(buf, offset)
+	return err
+}
+
+// readMapped copies the page at the offset from the mapping, and reports whether it could, which it can't for the
+// pages past the end of the file, or when the file can't be mapped.
+func (b *fileBackend) readMapped(offset int64, buf []byte) bool {
+	end := offset + int64(len(buf))
+	b.mu.RLock()
+	if end <= int64(len(b.mapped)) {
+		copy(buf, b.mapped[offset:end])
+		b.mu.RUnlock()
+		return true
+	}
+	unmappable := b.unmappable
+	b.mu.RUnlock()
+	if unmappable {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if end > int64(len(b.mapped)) {
+		size, err := b.Size()
+		if err != nil || end > size {
+			return false
+		}
+		// Only the whole file is mapped, since reading the mapping past the end of the file faults
+		mapped, err := mmapFile(b.file, int(size))
+		if err != nil {
+			b.unmappable = true
+			return false
+		}
+		if b.mapped != nil {
+			_ = munmapFile(b.mapped)
+		}
+		b.mapped = mapped
+	}
+	copy(buf, b.mapped[offset:end])
+	return true
+}
+
+func (b *fileBackend) WritePage(pageNum uint64, data []byte) error {
+	_, err := b.file.WriteAt(data, int64(pageNum)*int64(len(data)))
+	return err
+}
+
+func (b *fileBackend) Sync() error {
+	return b.file.Sync()
+}
+
+func (b *fileBackend) Size() (int64, error) {
+	info, err := b.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (b *fileBackend) Close() error {
+	b.mu.Lock()
+	if b.mapped != nil {
+		_ = munmapFile(b.mapped)
+		b.mapped = nil
+	}
+	b.mu.Unlock()
+	return b.file.Close()
+}
+
+// OpenBackend opens a database kept in the backend, creating it if the backend is empty. Unlike Open, nothing is
+// locked and each call returns a handle of its own, so the backend must not be opened twice at once, and Options.WAL
+// fails with ErrBackendWAL. The backend is closed by Close, and when OpenBackend fails.
+func OpenBackend(backend Backend, options *Options) (*DB, error) {
+	// The options are copied, so DefaultOptions can be passed as it is
+	opts := *options
+	if opts.pageSize == 0 {
+		opts.pageSize = os.Getpagesize()
+	}
+	if opts.WAL {
+		_ = backend.Close()
+		return nil, ErrBackendWAL
+	}
+	dal := newEmptyDal(&opts)
+	dal.file = backend
+	size, err := backend.Size()
+	if err == nil && size > 0 {
+		err = dal.load(0)
+	} else if err == nil && opts.ReadOnly {
+		err = ErrNotDBFile
+	} else if err == nil {
+		err = dal.create()
+	}
+	if err != nil {
+		_ = dal.close()
+		return nil, err
+	}
+	return newDB(dal, &opts, &sharedFile{handles: 1})
+}
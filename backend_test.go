@@ -0,0 +1,143 @@
+package gopherdb
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+)
+
+// memBackend keeps the pages in memory. Writes fail with failWrites once it's set.
+type memBackend struct {
+	mu         sync.Mutex
+	data       []byte
+	syncs      int
+	closed     bool
+	failWrites error
+}
+
+func (b *memBackend) ReadPage(pageNum uint64, buf []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	offset := int(pageNum) * len(buf)
+	if offset >= len(b.data) {
+		return io.EOF
+	}
+	if copy(buf, b.data[offset:]) < len(buf) {
+		return io.EOF
+	}
+	return nil
+}
+
+func (b *memBackend) WritePage(pageNum uint64, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failWrites != nil {
+		return b.failWrites
+	}
+	offset := int(pageNum) * len(data)
+	for len(b.data) < offset+len(data) {
+		b.data = append(b.data, 0)
+	}
+	copy(b.data[offset:], data)
+	return nil
+}
+
+func (b *memBackend) Sync() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.syncs++
+	return nil
+}
+
+func (b *memBackend) Size() (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(len(b.data)), nil
+}
+
+func (b *memBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return nil
+}
+
+func openBackend(t *testing.T, backend Backend, options *Options) *DB {
+	t.Helper()
+	if options == nil {
+		options = testOptions()
+	}
+	db, err := OpenBackend(backend, options)
+	if err != nil {
+		t.Fatalf("OpenBackend: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestOpenBackend(t *testing.T) {
+	backend := &memBackend{}
+	db := openBackend(t, backend, nil)
+	for i := 0; i < 100; i++ {
+		putValue(t, db, "c", string(testKey(i)), "value")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !backend.closed || backend.syncs == 0 || len(backend.data)%testOptions().pageSize != 0 {
+		t.Errorf("after Close: closed %v, %d syncs and %d bytes", backend.closed, backend.syncs, len(backend.data))
+	}
+
+	// The pages are read back by the next open, which finds the file clean
+	backend.closed = false
+	db = openBackend(t, backend, nil)
+	if db.Recovery() != nil {
+		t.Errorf("Recovery of a backend closed cleanly: got %+v", db.Recovery())
+	}
+	for _, i := range []int{0, 50, 99} {
+		if got := getValue(t, db, "c", string(testKey(i))); got != "value" {
+			t.Errorf("value of key %d: got %q, want value", i, got)
+		}
+	}
+
+	// A commit whose writes fail leaves the last one readable
+	errBroken := errors.New("broken")
+	backend.mu.Lock()
+	backend.failWrites = errBroken
+	backend.mu.Unlock()
+	if err := db.Put([]byte("c"), []byte("k"), []byte("v")); !errors.Is(err, errBroken) {
+		t.Errorf("Put with failing writes: got %v, want the error of the backend", err)
+	}
+	backend.mu.Lock()
+	backend.failWrites = nil
+	backend.mu.Unlock()
+	if got := getValue(t, db, "c", string(testKey(0))); got != "value" {
+		t.Errorf("value after the failed commit: got %q, want value", got)
+	}
+	putValue(t, db, "c", "k", "v")
+	if got := getValue(t, db, "c", "k"); got != "v" {
+		t.Errorf("value after the failed commit: got %q, want v", got)
+	}
+}
+
+func TestOpenBackendFailures(t *testing.T) {
+	options := testOptions()
+	options.WAL = true
+	backend := &memBackend{}
+	if _, err := OpenBackend(backend, options); !errors.Is(err, ErrBackendWAL) || !backend.closed {
+		t.Errorf("OpenBackend in WAL mode: got %v and closed %v, want ErrBackendWAL and a closed backend", err, backend.closed)
+	}
+
+	options = testOptions()
+	options.ReadOnly = true
+	backend = &memBackend{}
+	if _, err := OpenBackend(backend, options); !errors.Is(err, ErrNotDBFile) || len(backend.data) != 0 {
+		t.Errorf("read-only OpenBackend of an empty backend: got %v and %d bytes, want ErrNotDBFile", err, len(backend.data))
+	}
+
+	backend = &memBackend{data: make([]byte, 4*testOptions().pageSize)}
+	if _, err := OpenBackend(backend, testOptions()); !errors.Is(err, ErrNotDBFile) || !backend.closed {
+		t.Errorf("OpenBackend of a backend that isn't a database: got %v and closed %v", err, backend.closed)
+	}
+}
@@ -0,0 +1,171 @@
+package gopherdb
+
+import (
+	"sync"
+	"time"
+)
+
+// background supervises the work the handles of a file run in background goroutines: the cleanups of sessions, the
+// garbage collections of blob stores and the catch-ups of standbys. The runs share Options.BackgroundWorkers slots,
+// skip their turn while the background is paused, and keep the counters reported by DB.BackgroundStats.
+type background struct {
+	now func() time.Time
+	// workers holds a token per run in progress, nil for no limit.
+	workers chan struct{}
+
+	mu sync.Mutex
+	// idle is signaled when running drops to zero, for PauseBackground.
+	idle    *sync.Cond
+	running int
+	paused  int
+	tasks   []*backgroundTask
+}
+
+// backgroundTask is a function periodic runs, with its counters.
+type backgroundTask struct {
+	name     string
+	interval time.Duration
+	fn       func() error
+	stats    BackgroundTaskStats
+}
+
+// BackgroundTaskStats are the counters of a task running in the background, see DB.BackgroundStats.
+type BackgroundTaskStats struct {
+	// Name tells what the task does and on what, like "sessions cleanup of sessions".
+	Name     string
+	Interval time.Duration
+	// Runs counts the runs, and Skipped the turns skipped while the background was paused.
+	Runs    uint64
+	Skipped uint64
+	// LastRun is when the last run started, LastDuration how long it took and LastErr what it returned.
+	LastRun      time.Time
+	LastDuration time.Duration
+	LastErr      error
+	// Running tells whether the task is running or waiting for a worker.
+	Running bool
+}
+
+func newBackground(workers int, now func() time.Time) *background {
+	b := &background{now: now}
+	b.idle = sync.NewCond(&b.mu)
+	if workers > 0 {
+		b.workers = make(chan struct{}, workers)
+	}
+	return b
+}
+
+func (b *background) add(task *backgroundTask) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	task.stats.Name, task.stats.Interval = task.name, task.interval
+	b.tasks = append(b.tasks, task)
+}
+
+func (b *background) remove(task *backgroundTask) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, t := range b.tasks {
+		if t == task {
+			b.tasks = append(b.tasks[:i], b.tasks[i+1:]...)
+			return
+		}
+	}
+}
+
+// run runs the task once, when the background isn't paused and a worker is free.
+func (b *background) run(task *backgroundTask) {
+	if !b.enter(task) {
+		return
+	}
+	defer b.leave(task)
+	if b.workers != nil {
+		b.workers <- struct{}{}
+		defer func() { <-b.workers }()
+	}
+
+	// PauseBackground waits for the runs waiting for a worker too, which skip their turn if it paused meanwhile
+	b.mu.Lock()
+	if b.paused > 0 {
+		task.stats.Skipped++
+		b.mu.Unlock()
+		return
+	}
+	start := b.now()
+	b.mu.Unlock()
+
+	began := time.Now()
+	err := task.fn()
+	duration := time.Since(began)
+
+	b.mu.Lock()
+	task.stats.Runs++
+	task.stats.LastRun, task.stats.LastDuration, task.stats.LastErr = start, duration, err
+	b.mu.Unlock()
+}
+
+func (b *background) enter(task *backgroundTask) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.paused > 0 {
+		task.stats.Skipped++
+		return false
+	}
+	b.running++
+	task.stats.Running = true
+	return true
+}
+
+func (b *background) leave(task *backgroundTask) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	task.stats.Running = false
+	b.running--
+	if b.running == 0 {
+		b.idle.Broadcast()
+	}
+}
+
+func (b *background) pause() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.paused++
+	for b.running > 0 {
+		b.idle.Wait()
+	}
+}
+
+func (b *background) resume() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.paused > 0 {
+		b.paused--
+	}
+}
+
+func (b *background) stats() []BackgroundTaskStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := make([]BackgroundTaskStats, len(b.tasks))
+	for i, task := range b.tasks {
+		stats[i] = task.stats
+	}
+	return stats
+}
+
+// PauseBackground makes the tasks running in the background for the file skip their turns until ResumeBackground is
+// called, and waits for the runs in progress to end, so the caller has the CPU and the disk to itself. Every handle of
+// the file shares the same background, and pauses nest: the tasks run again once every pause was resumed.
+func (db *DB) PauseBackground() {
+	db.background.pause()
+}
+
+// ResumeBackground ends a pause started by PauseBackground.
+func (db *DB) ResumeBackground() {
+	db.background.resume()
+}
+
+// BackgroundStats returns the counters of the tasks running in the background for the file, in the order they were
+// started.
+func (db *DB) BackgroundStats() []BackgroundTaskStats {
+	return db.background.stats()
+}
@@ -0,0 +1,106 @@
+package gopherdb
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it's true, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func taskStats(db *DB, name string) (BackgroundTaskStats, bool) {
+	for _, stats := range db.BackgroundStats() {
+		if stats.Name == name {
+			return stats, true
+		}
+	}
+	return BackgroundTaskStats{}, false
+}
+
+func TestBackgroundStats(t *testing.T) {
+	db := openTestDB(t, nil)
+	sessions := NewSessions(db, "sessions", time.Hour)
+	sessions.StartCleanup(time.Millisecond)
+	const name = "sessions cleanup of sessions"
+	waitFor(t, "a cleanup", func() bool {
+		stats, _ := taskStats(db, name)
+		return stats.Runs > 0
+	})
+	stats, _ := taskStats(db, name)
+	if stats.Interval != time.Millisecond || stats.LastRun.IsZero() || stats.LastErr != nil {
+		t.Fatalf("got %+v", stats)
+	}
+
+	sessions.StopCleanup()
+	if _, ok := taskStats(db, name); ok {
+		t.Fatal("a stopped task is still reported")
+	}
+}
+
+func TestPauseBackground(t *testing.T) {
+	db := openTestDB(t, nil)
+	var runs atomic.Int64
+	var p periodic
+	p.start(db, "count", time.Millisecond, func() error {
+		runs.Add(1)
+		return nil
+	})
+	defer p.halt()
+	waitFor(t, "a run", func() bool { return runs.Load() > 0 })
+
+	db.PauseBackground()
+	db.PauseBackground()
+	paused := runs.Load()
+	waitFor(t, "a skipped turn", func() bool {
+		stats, _ := taskStats(db, "count")
+		return stats.Skipped > 0
+	})
+	db.ResumeBackground()
+	time.Sleep(10 * time.Millisecond)
+	if got := runs.Load(); got != paused {
+		t.Fatalf("got %d runs while paused", got-paused)
+	}
+	db.ResumeBackground()
+	waitFor(t, "a run once resumed", func() bool { return runs.Load() > paused })
+}
+
+func TestBackgroundWorkers(t *testing.T) {
+	options := testOptions()
+	options.BackgroundWorkers = 1
+	db := openTestDB(t, options)
+	var running, most, runs atomic.Int64
+	fn := func() error {
+		n := running.Add(1)
+		for {
+			m := most.Load()
+			if n <= m || most.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		running.Add(-1)
+		runs.Add(1)
+		return nil
+	}
+	tasks := make([]periodic, 4)
+	for i := range tasks {
+		tasks[i].start(db, "task", time.Millisecond, fn)
+	}
+	waitFor(t, "runs of the tasks", func() bool { return runs.Load() >= 20 })
+	for i := range tasks {
+		tasks[i].halt()
+	}
+	if got := most.Load(); got != 1 {
+		t.Fatalf("got %d runs at the same time with a single worker", got)
+	}
+}
@@ -0,0 +1,125 @@
+package gopherdb
+
+import (
+	"errors"
+	"io"
+)
+
+var ErrBackupInsideWriteTx = errors.New("can't write a copy of the file inside a write transaction")
+var ErrBackupOfCheckpoint = errors.New("can't write a copy of the file from a checkpoint, whose freelist isn't kept")
+
+// WriteTo writes a copy of the file as the read transaction sees it to w, while write transactions go on committing:
+// the pages of its trees are held back until it ends, see snapshot.go. The copy is a database file of the same page
+// size, which Open reads like the original once w wrote it to a file, for backups of a database in use.
+//
+// The copy holds the trees of the commit the transaction reads and its freelist, in which the pages held back for
+// transactions of the process are free. Pages written with WritePage are copied as they are when WriteTo reads them,
+// since commits write them in place, and checkpoints are left out, since the commits since the transaction began can
+// have reused their pages: Open of the copy finds no checkpoint. Write transactions and checkpoint transactions can't
+// be copied.
+func (tx *Tx) WriteTo(w io.Writer) (int64, error) {
+	if tx.write {
+		return 0, ErrBackupInsideWriteTx
+	}
+	state := tx.fileState()
+	if state.free == nil {
+		return 0, ErrBackupOfCheckpoint
+	}
+	pages, maxPage, err := tx.backupPages(state)
+	if err != nil {
+		return 0, err
+	}
+
+	var written int64
+	for pageNum := pgnum(0); pageNum <= maxPage; pageNum++ {
+		data, ok := pages[pageNum]
+		if !ok {
+			p, err := tx.db.readPage(pageNum)
+			if err != nil {
+				return written, err
+			}
+			data = p.data
+		}
+		n, err := w.Write(data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// backupPages returns the pages the copy of the file in the state doesn't take from the file, written for the copy:
+// the meta pages, the freelist, the free pages, zeroed, and the tree of the checkpoints, emptied. It also returns the
+// last page of the copy, which can be past the one of the state if the freelist of the copy needs more pages.
+func (tx *Tx) backupPages(state fileState) (map[pgnum][]byte, pgnum, error) {
+	pageSize := tx.db.pageSize
+	pages := map[pgnum][]byte{}
+	fr := &freelist{
+		maxPage:       state.maxPage,
+		releasedPages: append([]pgnum{}, state.free...),
+		chain:         append([]pgnum{}, state.chain...),
+	}
+
+	// The root of the checkpoints collection becomes an empty leaf, and the other pages of its tree are free
+	checkpoints, err := tx.GetCollection(checkpointsCollection)
+	if err != nil {
+		return nil, 0, err
+	}
+	if checkpoints != nil {
+		used := map[pgnum]bool{}
+		err = tx.readNodePages(checkpoints.root, false, used)
+		if err != nil {
+			return nil, 0, err
+		}
+		for pageNum := range used {
+			if pageNum != checkpoints.root {
+				fr.releasedPages = append(fr.releasedPages, pageNum)
+			}
+		}
+		pages[checkpoints.root] = NewNodeForSerialization([]*Item{}, []pgnum{}).serialize(make([]byte, pageSize))
+	}
+
+	// The chain of the freelist takes free pages, or grows the file, until the free pages left fit in it, and gives
+	// its pages the free pages don't need back
+	for len(fr.chain) < chainLength(len(fr.releasedPages), pageSize) {
+		fr.chain = append(fr.chain, fr.getNextPage())
+	}
+	fr.sortReleased()
+	words := fr.freeWords(nil)
+	for len(fr.chain) > chainLength(words+1, pageSize) {
+		fr.releasePage(fr.chain[len(fr.chain)-1])
+		fr.chain = fr.chain[:len(fr.chain)-1]
+		words++
+	}
+	bufs := make([][]byte, 1+len(fr.chain))
+	for i := range bufs {
+		bufs[i] = make([]byte, pageSize)
+	}
+	err = fr.serialize(bufs, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	pages[state.freelistPage] = bufs[0]
+	for i, pageNum := range fr.chain {
+		pages[pageNum] = bufs[i+1]
+	}
+
+	zero := make([]byte, pageSize)
+	for _, pageNum := range fr.releasedPages {
+		pages[pageNum] = zero
+	}
+	if state.freelistSpare != 0 {
+		pages[state.freelistSpare] = zero
+	}
+
+	m := &meta{root: state.root, freelistPage: state.freelistPage, freelistSpare: state.freelistSpare, txid: state.txid, clean: true}
+	buf := make([]byte, pageSize)
+	m.serialize(buf)
+	pages[metaPageNum] = buf
+	// Files with a single meta page have their freelist on the second page
+	if state.freelistSpare != 0 {
+		pages[metaPageNumB] = buf
+	}
+	return pages, fr.maxPage, nil
+}
@@ -0,0 +1,138 @@
+package gopherdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeBackup writes the copy of the file seen by tx to path.
+func writeBackup(t *testing.T, tx *Tx, path string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n, err := tx.WriteTo(f)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if n%int64(tx.PageSize()) != 0 {
+		t.Fatalf("wrote %d bytes, not a number of pages", n)
+	}
+}
+
+func TestTxWriteToCopiesTheSnapshot(t *testing.T) {
+	wal := testOptions()
+	wal.WAL = true
+	journal := testOptions()
+	journal.JournalFreelist = true
+	checkpoints := testOptions()
+	checkpoints.Checkpoints = []CheckpointTier{{Every: time.Nanosecond, For: time.Hour}}
+	for name, options := range map[string]*Options{"default": testOptions(), "wal": wal, "journal": journal, "checkpoints": checkpoints} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			db := openTestPath(t, filepath.Join(dir, "test.db"), options)
+			value := bytes.Repeat([]byte("v"), 300)
+			mustUpdate(t, db, func(tx *Tx) error {
+				c := getOrCreate(t, tx, "c")
+				for i := 0; i < 300; i++ {
+					err := c.Put(testKey(i), value)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			// Removals leave free pages in the copy
+			mustUpdate(t, db, func(tx *Tx) error {
+				c := getOrCreate(t, tx, "c")
+				for i := 0; i < 300; i += 3 {
+					err := c.Remove(testKey(i))
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+
+			tx, err := db.ReadTx()
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for round := 0; round < 5; round++ {
+					err := db.Update(func(tx *Tx) error {
+						c, err := tx.GetCollection([]byte("c"))
+						if err != nil {
+							return err
+						}
+						for i := 0; i < 300; i++ {
+							err = c.Put(testKey(i), []byte(fmt.Sprintf("new %d", round)))
+							if err != nil {
+								return err
+							}
+						}
+						return nil
+					})
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+			path := filepath.Join(dir, "backup.db")
+			writeBackup(t, tx, path)
+			<-done
+			tx.Rollback()
+
+			checkFile(t, path, options)
+			backup := openTestPath(t, path, options)
+			for i := 0; i < 300; i++ {
+				want := string(value)
+				if i%3 == 0 {
+					want = ""
+				}
+				if got := getValue(t, backup, "c", string(testKey(i))); got != want {
+					t.Fatalf("key %d: got %q, want the value when the transaction began", i, got)
+				}
+			}
+			if got := backup.Checkpoints(); len(got) != 0 {
+				t.Fatalf("got checkpoints %v in the copy", got)
+			}
+			mustUpdate(t, backup, func(tx *Tx) error {
+				c := getOrCreate(t, tx, "c")
+				for i := 0; i < 300; i++ {
+					err := c.Put(testKey(i), []byte("newer"))
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			err = backup.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFile(t, path, options)
+		})
+	}
+}
+
+func TestTxWriteToFailsInsideWriteTx(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustUpdate(t, db, func(tx *Tx) error {
+		_, err := tx.WriteTo(&bytes.Buffer{})
+		if !errors.Is(err, ErrBackupInsideWriteTx) {
+			t.Fatalf("got %v, want ErrBackupInsideWriteTx", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,164 @@
+package gopherdb
+
+import (
+	"bytes"
+	"sort"
+)
+
+// KV is a key and its value.
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
+// Batch runs fn with the nodes read by the transaction kept in memory until fn returns, so many operations on the same
+// parts of the trees read and deserialize every node once instead of once per operation. Batches of a write
+// transaction should be kept to a reasonable size, since every node they read stays in memory. Batches can be nested,
+// and goroutines sharing a read transaction can run batches at the same time, which share the nodes until the last one
+// returns.
+func (tx *Tx) Batch(fn func() error) error {
+	tx.mu.Lock()
+	if tx.batches == 0 {
+		tx.batchNodes = map[pgnum]*Node{}
+	}
+	tx.batches++
+	tx.mu.Unlock()
+	defer func() {
+		tx.mu.Lock()
+		tx.batches--
+		if tx.batches == 0 {
+			tx.batchNodes = nil
+		}
+		tx.mu.Unlock()
+	}()
+	return fn()
+}
+
+// PutMany puts all the items into the collection in one batch, see Batch. The items are put in key order, and a key
+// appearing several times gets its last value. Consecutive keys mostly go to the same leaf, so the leaf is kept between
+// puts and the tree is only searched again once a key falls outside of it or the leaf has to be split.
+//
+// Triggers, change hooks and key transforms run for every item like with Put, in which case every item is put on its
+// own, in key order.
+func (c *Collection) PutMany(items []KV) error {
+	if !c.tx.write {
+		return ErrWriteInsideReadTx
+	}
+	sorted := append([]KV{}, items...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].Key, sorted[j].Key) < 0
+	})
+
+	plain := c.triggerName() == nil || !c.tx.db.triggers.needsValue(c.triggerName())
+	hint := &leafHint{}
+	return c.tx.Batch(func() error {
+		for i, kv := range sorted {
+			// Only the last of the equal keys is put, since the sort kept their order
+			if i+1 < len(sorted) && bytes.Equal(kv.Key, sorted[i+1].Key) {
+				continue
+			}
+			var err error
+			if plain {
+				err = c.addContext(c.putSorted(kv.Key, kv.Value, hint), "put", kv.Key)
+			} else {
+				err = c.Put(kv.Key, kv.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// leafHint is the leaf the last item of a PutMany went to, and the keys bounding it in its ancestors. A nil bound is
+// unbounded.
+type leafHint struct {
+	leaf  *Node
+	lower []byte
+	upper []byte
+}
+
+func (h *leafHint) covers(key []byte) bool {
+	return h.leaf != nil &&
+		(h.lower == nil || bytes.Compare(key, h.lower) > 0) &&
+		(h.upper == nil || bytes.Compare(key, h.upper) < 0)
+}
+
+// putSorted puts the key into the leaf of the hint if it belongs there, and otherwise like put, pointing the hint to the
+// leaf the key went to. The hint is dropped whenever nodes are split, since the leaf or its bounds may have changed.
+func (c *Collection) putSorted(key []byte, value []byte, hint *leafHint) error {
+	i, err := c.newItem(key, value)
+	if err != nil {
+		return err
+	}
+	if !hint.covers(key) {
+		err = c.put(i)
+		if err != nil {
+			return err
+		}
+		return c.updateHint(key, hint)
+	}
+
+	c.countWrite()
+	c.recordWrite(key)
+	leaf := hint.leaf
+	found, index := leaf.findKeyInNode(key)
+	if found {
+		if leaf.items[index].collection {
+			return ErrIncompatibleValue
+		}
+		err = c.freeItem(leaf.items[index])
+		if err != nil {
+			return err
+		}
+		leaf.items[index] = i
+	} else {
+		leaf.addItem(i, index)
+	}
+	c.tx.writeNode(leaf)
+	if !leaf.isOverPopulated() {
+		return nil
+	}
+
+	hint.leaf = nil
+	root, err := c.tx.getNode(c.root)
+	if err != nil {
+		return err
+	}
+	_, _, ancestorsIndexes, err := root.findKey(key, true)
+	if err != nil {
+		return err
+	}
+	return c.rebalance(ancestorsIndexes)
+}
+
+// updateHint points the hint to the leaf holding the key, or drops it if the key is in an internal node.
+func (c *Collection) updateHint(key []byte, hint *leafHint) error {
+	*hint = leafHint{}
+	root, err := c.tx.getNode(c.root)
+	if err != nil {
+		return err
+	}
+	_, node, ancestorsIndexes, err := root.findKey(key, true)
+	if err != nil || node == nil || !node.isLeaf() {
+		return err
+	}
+	ancestors, err := c.getNodes(ancestorsIndexes)
+	if err != nil {
+		return err
+	}
+
+	// The deeper the ancestor, the tighter its bounds
+	for j := 0; j < len(ancestors)-1; j++ {
+		parent, index := ancestors[j], ancestorsIndexes[j+1]
+		if index > 0 {
+			hint.lower = parent.items[index-1].key
+		}
+		if index < len(parent.items) {
+			hint.upper = parent.items[index].key
+		}
+	}
+	hint.leaf = node
+	return nil
+}
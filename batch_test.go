@@ -0,0 +1,117 @@
+package gopherdb
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestPutMany(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	db := openTestPath(t, path, options)
+	expected := map[string][]byte{}
+	for i := 0; i < 3000; i += 3 {
+		putValue(t, db, "c", string(testKey(i)), "before")
+		expected[string(testKey(i))] = []byte("before")
+	}
+
+	// Keys in random order, between and over the existing ones, with duplicates getting their last value
+	rng := rand.New(rand.NewSource(1))
+	var items []KV
+	for _, i := range rng.Perm(3000) {
+		items = append(items, KV{Key: testKey(i), Value: []byte("first")})
+		if i%10 == 0 {
+			items = append(items, KV{Key: testKey(i), Value: []byte("last")})
+		}
+	}
+	for _, item := range items {
+		expected[string(item.Key)] = item.Value
+	}
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		if err := c.PutMany(items); err != nil {
+			return err
+		}
+		if tx.batchNodes != nil {
+			t.Error("the batch of PutMany is still running")
+		}
+		return nil
+	})
+	mustView(t, db, func(tx *Tx) error {
+		checkTree(t, getOrCreate(t, tx, "c"), expected)
+		return nil
+	})
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	checkFile(t, path, options)
+}
+
+func TestPutManyRunsTriggersInKeyOrder(t *testing.T) {
+	db := openTestDB(t, nil)
+	var keys []string
+	db.BeforePut([]byte("c"), func(tx *Tx, key []byte, value []byte) ([]byte, []byte, error) {
+		keys = append(keys, string(key))
+		return key, append(value, '!'), nil
+	})
+	mustUpdate(t, db, func(tx *Tx) error {
+		return getOrCreate(t, tx, "c").PutMany([]KV{
+			{Key: []byte("b"), Value: []byte("1")},
+			{Key: []byte("a"), Value: []byte("2")},
+			{Key: []byte("b"), Value: []byte("3")},
+		})
+	})
+	if fmt.Sprint(keys) != "[a b]" {
+		t.Errorf("the trigger ran for %v, want [a b]", keys)
+	}
+	if value := getValue(t, db, "c", "b"); value != "3!" {
+		t.Errorf("got %q for b, want the last value through the trigger", value)
+	}
+
+	err := db.View(func(tx *Tx) error {
+		return getOrCreate(t, tx, "c").PutMany([]KV{{Key: []byte("k"), Value: nil}})
+	})
+	if !errors.Is(err, ErrWriteInsideReadTx) {
+		t.Errorf("PutMany in a read transaction: got %v, want ErrWriteInsideReadTx", err)
+	}
+}
+
+func TestBatchKeepsTheNodesRead(t *testing.T) {
+	db := openTestDB(t, nil)
+	putValue(t, db, "c", "k", "value")
+	mustView(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		return tx.Batch(func() error {
+			first, err := tx.getNode(c.root)
+			if err != nil {
+				return err
+			}
+			if err := tx.Batch(func() error { return nil }); err != nil {
+				return err
+			}
+			// The nested batch returning doesn't end the outer one
+			second, err := tx.getNode(c.root)
+			if err != nil {
+				return err
+			}
+			if first != second {
+				t.Error("the batch read the node again")
+			}
+			return nil
+		})
+	})
+	mustView(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		first, err := tx.getNode(c.root)
+		if err != nil {
+			return err
+		}
+		if second, err := tx.getNode(c.root); err != nil || first == second {
+			t.Error("the node was kept without a batch")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,194 @@
+package gopherdb
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
+// BlobStore is a content-addressed store built on top of two collections. Blobs are keyed by the SHA-256 of their
+// content, so storing the same content twice keeps a single copy and only bumps its reference count. Releasing the last
+// reference doesn't delete the blob right away; unreferenced blobs are removed by CollectGarbage, which can also run
+// periodically in the background with StartGC.
+type BlobStore struct {
+	db    *DB
+	blobs []byte
+	refs  []byte
+
+	gc periodic
+}
+
+// NewBlobStore returns a blob store keeping its data in the collections <name>.blobs and <name>.refs. The collections
+// are created on the first Put.
+func NewBlobStore(db *DB, name string) *BlobStore {
+	return &BlobStore{
+		db:    db,
+		blobs: []byte(name + ".blobs"),
+		refs:  []byte(name + ".refs"),
+	}
+}
+
+// collections returns the blobs and refs collections. If they don't exist and create is false, nil collections are
+// returned.
+func (s *BlobStore) collections(tx *Tx, create bool) (*Collection, *Collection, error) {
+	getCollection := tx.GetCollection
+	if create {
+		getCollection = tx.getOrCreateCollection
+	}
+	blobs, err := getCollection(s.blobs)
+	if err != nil {
+		return nil, nil, err
+	}
+	refs, err := getCollection(s.refs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return blobs, refs, nil
+}
+
+func refCount(item *Item) uint64 {
+	if item == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(item.value)
+}
+
+func putRefCount(refs *Collection, hash []byte, count uint64) error {
+	buf := make([]byte, counterSize)
+	binary.LittleEndian.PutUint64(buf, count)
+	return refs.Put(hash, buf)
+}
+
+// Put stores the data if it isn't stored already and adds a reference to it. The SHA-256 of the data is returned and
+// used as the blob key.
+func (s *BlobStore) Put(tx *Tx, data []byte) ([]byte, error) {
+	if !tx.write {
+		return nil, ErrWriteInsideReadTx
+	}
+	blobs, refs, err := s.collections(tx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	hash := sum[:]
+	item, err := refs.Find(hash)
+	if err != nil {
+		return nil, err
+	}
+	// A blob with a zero reference count is still stored until the garbage collection runs, so there's no need to
+	// write it again.
+	if item == nil {
+		err = blobs.Put(hash, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hash, putRefCount(refs, hash, refCount(item)+1)
+}
+
+// Get returns the content of the blob, or nil if there's no such blob.
+func (s *BlobStore) Get(tx *Tx, hash []byte) ([]byte, error) {
+	blobs, _, err := s.collections(tx, false)
+	if err != nil || blobs == nil {
+		return nil, err
+	}
+	item, err := blobs.Find(hash)
+	if err != nil || item == nil {
+		return nil, err
+	}
+	return item.value, nil
+}
+
+// RefCount returns the number of references to the blob.
+func (s *BlobStore) RefCount(tx *Tx, hash []byte) (uint64, error) {
+	_, refs, err := s.collections(tx, false)
+	if err != nil || refs == nil {
+		return 0, err
+	}
+	item, err := refs.Find(hash)
+	if err != nil {
+		return 0, err
+	}
+	return refCount(item), nil
+}
+
+// Release drops a reference to the blob. Once no references are left, the blob is deleted by the next garbage
+// collection.
+func (s *BlobStore) Release(tx *Tx, hash []byte) error {
+	if !tx.write {
+		return ErrWriteInsideReadTx
+	}
+	_, refs, err := s.collections(tx, false)
+	if err != nil {
+		return err
+	}
+	if refs == nil {
+		return ErrKeyNotFound
+	}
+	item, err := refs.Find(hash)
+	if err != nil {
+		return err
+	}
+	count := refCount(item)
+	if count == 0 {
+		return ErrKeyNotFound
+	}
+	return putRefCount(refs, hash, count-1)
+}
+
+// CollectGarbage deletes all the blobs without references inside a write transaction and returns how many blobs were
+// deleted.
+func (s *BlobStore) CollectGarbage() (int, error) {
+	tx, err := s.db.WriteTx()
+	if err != nil {
+		return 0, err
+	}
+	blobs, refs, err := s.collections(tx, false)
+	if err != nil || blobs == nil || refs == nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	var unreferenced [][]byte
+	err = tx.walk(refs.root, func(n *Node) error {
+		for _, item := range n.items {
+			if refCount(item) == 0 {
+				unreferenced = append(unreferenced, item.key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	for _, hash := range unreferenced {
+		err = blobs.Remove(hash)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		err = refs.Remove(hash)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	return len(unreferenced), tx.Commit()
+}
+
+// StartGC runs CollectGarbage every interval in a background goroutine until StopGC is called. Errors are ignored, the
+// garbage is collected again on the next run.
+func (s *BlobStore) StartGC(interval time.Duration) {
+	s.gc.start(s.db, "blob garbage collection of "+string(s.blobs), interval, func() error {
+		_, err := s.CollectGarbage()
+		return err
+	})
+}
+
+// StopGC stops the background garbage collection and waits for a running collection to finish.
+func (s *BlobStore) StopGC() {
+	s.gc.halt()
+}
@@ -0,0 +1,110 @@
+package gopherdb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBlobStoreDeduplicatesAndCollectsGarbage(t *testing.T) {
+	db := openTestDB(t, nil)
+	store := NewBlobStore(db, "files")
+	data := bytes.Repeat([]byte("blob"), 1000)
+	var hash []byte
+	mustUpdate(t, db, func(tx *Tx) error {
+		first, err := store.Put(tx, data)
+		if err != nil {
+			return err
+		}
+		hash, err = store.Put(tx, data)
+		if err != nil {
+			return err
+		}
+		if sum := sha256.Sum256(data); !bytes.Equal(first, sum[:]) || !bytes.Equal(hash, first) {
+			t.Errorf("Put returned %x and %x, want the SHA-256 of the data twice", first, hash)
+		}
+		_, err = store.Put(tx, []byte("other"))
+		return err
+	})
+
+	mustView(t, db, func(tx *Tx) error {
+		if count, err := store.RefCount(tx, hash); err != nil || count != 2 {
+			t.Errorf("RefCount: got %d, %v, want 2", count, err)
+		}
+		if got, err := store.Get(tx, hash); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("Get: got %d bytes, %v, want the %d bytes put", len(got), err, len(data))
+		}
+		if _, err := store.Put(tx, data); !errors.Is(err, ErrWriteInsideReadTx) {
+			t.Errorf("Put in a read transaction: got %v, want ErrWriteInsideReadTx", err)
+		}
+		return nil
+	})
+
+	mustUpdate(t, db, func(tx *Tx) error {
+		for i := 0; i < 2; i++ {
+			if err := store.Release(tx, hash); err != nil {
+				return err
+			}
+		}
+		if err := store.Release(tx, hash); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Release without references: got %v, want ErrKeyNotFound", err)
+		}
+		return nil
+	})
+	// Unreferenced blobs stay until the garbage collection runs
+	mustView(t, db, func(tx *Tx) error {
+		if got, err := store.Get(tx, hash); err != nil || got == nil {
+			t.Errorf("Get of an unreferenced blob before GC: got %v, %v, want the blob", got, err)
+		}
+		return nil
+	})
+	deleted, err := store.CollectGarbage()
+	if err != nil || deleted != 1 {
+		t.Errorf("CollectGarbage: got %d, %v, want 1 deleted blob", deleted, err)
+	}
+	mustView(t, db, func(tx *Tx) error {
+		if got, err := store.Get(tx, hash); err != nil || got != nil {
+			t.Errorf("Get after GC: got %v, %v, want nil", got, err)
+		}
+		sum := sha256.Sum256([]byte("other"))
+		if got, err := store.Get(tx, sum[:]); err != nil || string(got) != "other" {
+			t.Errorf("Get of the referenced blob after GC: got %q, %v", got, err)
+		}
+		return nil
+	})
+}
+
+func TestBlobStoreBackgroundGC(t *testing.T) {
+	db := openTestDB(t, nil)
+	store := NewBlobStore(db, "files")
+	var hash []byte
+	mustUpdate(t, db, func(tx *Tx) error {
+		var err error
+		hash, err = store.Put(tx, []byte("data"))
+		if err != nil {
+			return err
+		}
+		return store.Release(tx, hash)
+	})
+
+	store.StartGC(time.Millisecond)
+	defer store.StopGC()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var got []byte
+		mustView(t, db, func(tx *Tx) error {
+			var err error
+			got, err = store.Get(tx, hash)
+			return err
+		})
+		if got == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the background GC didn't delete the unreferenced blob")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
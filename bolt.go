@@ -0,0 +1,216 @@
+package gopherdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+)
+
+// The layout of bolt and bbolt files, which ImportBolt reads without depending on either: every page starts with a
+// header, and meta pages, the first two, point to the root bucket of the last two commits. A bucket is a B+tree whose
+// leaves hold its keys and the headers of its sub-buckets, flagged as such. Small buckets are inlined in the value of
+// their header, as a page of their own without a page number.
+const (
+	boltMagic          uint32 = 0xED0CDAED
+	boltVersion        uint32 = 2
+	boltPageHeaderSize        = 16
+	boltElementSize           = 16
+	boltBucketSize            = 16
+	// boltMetaSize is the size of the fields of the meta before its checksum, which covers them.
+	boltMetaSize = 56
+
+	boltBranchPage = 0x01
+	boltLeafPage   = 0x02
+	boltMetaPage   = 0x04
+	boltBucketLeaf = 0x01
+)
+
+// BoltBucketSeparator joins the names of nested bolt buckets into the names of the collections ImportBolt puts them in:
+// the bucket b nested in a goes to the collection a/b.
+const BoltBucketSeparator = "/"
+
+var ErrNotBoltFile = errors.New("the file is not a bolt database")
+
+// boltFile reads the pages of a bolt file. read holds the pages read so far: every page belongs to a single bucket,
+// so a page read twice means the file is corrupt, and walking it again could loop forever.
+type boltFile struct {
+	file     *os.File
+	pageSize int
+	read     map[uint64]bool
+}
+
+// readPage returns the page, along with its overflow pages.
+func (b *boltFile) readPage(id uint64) ([]byte, error) {
+	if b.read[id] || id < 2 {
+		return nil, fmt.Errorf("%w: bolt page %d is a meta page or part of another bucket", ErrNotBoltFile, id)
+	}
+	b.read[id] = true
+	buf := make([]byte, b.pageSize)
+	_, err := b.file.ReadAt(buf, int64(id)*int64(b.pageSize))
+	if err != nil {
+		return nil, fmt.Errorf("bolt page %d: %w", id, err)
+	}
+	overflow := binary.LittleEndian.Uint32(buf[12:])
+	if overflow == 0 {
+		return buf, nil
+	}
+	buf = make([]byte, (int(overflow)+1)*b.pageSize)
+	_, err = b.file.ReadAt(buf, int64(id)*int64(b.pageSize))
+	if err != nil {
+		return nil, fmt.Errorf("bolt page %d: %w", id, err)
+	}
+	return buf, nil
+}
+
+// readBoltMeta returns the root page of the root bucket of the last commit, and the page size, from whichever of the
+// two meta pages is valid and the latest. The second meta page is found with the page size of the first one, or with
+// the usual page size of 4096 bytes if the first one isn't valid, like bolt does with the page size of the OS.
+func readBoltMeta(file *os.File) (uint64, int, error) {
+	var root, txid uint64
+	pageSize := 4096
+	found := false
+	buf := make([]byte, boltPageHeaderSize+boltMetaSize+8)
+	for i := 0; i < 2; i++ {
+		_, err := file.ReadAt(buf, int64(i*pageSize))
+		if err != nil {
+			break
+		}
+		meta := buf[boltPageHeaderSize:]
+		if binary.LittleEndian.Uint16(buf[8:])&boltMetaPage == 0 || binary.LittleEndian.Uint32(meta) != boltMagic {
+			continue
+		}
+		if version := binary.LittleEndian.Uint32(meta[4:]); version != boltVersion {
+			return 0, 0, fmt.Errorf("%w: bolt version %d", ErrUnsupportedFormat, version)
+		}
+		sum := fnv.New64a()
+		_, _ = sum.Write(meta[:boltMetaSize])
+		size := int(binary.LittleEndian.Uint32(meta[8:]))
+		if sum.Sum64() != binary.LittleEndian.Uint64(meta[boltMetaSize:]) || size < len(buf) {
+			continue
+		}
+		if i == 0 {
+			pageSize = size
+		}
+		if metaTxID := binary.LittleEndian.Uint64(meta[48:]); !found || metaTxID > txid {
+			root, txid, found = binary.LittleEndian.Uint64(meta[16:]), metaTxID, true
+		}
+	}
+	if !found {
+		return 0, 0, ErrNotBoltFile
+	}
+	return root, pageSize, nil
+}
+
+// walkBucket calls fn for every key of the bucket and bucket for every sub-bucket, with its name and header, in key
+// order. The bucket is the value of its header: its root page, or its inline page if the root is zero.
+func (b *boltFile) walkBucket(value []byte, fn func(key, value []byte) error, bucket func(name, value []byte) error) error {
+	if len(value) < boltBucketSize {
+		return ErrNotBoltFile
+	}
+	if root := binary.LittleEndian.Uint64(value); root != 0 {
+		return b.walkPage(root, fn, bucket)
+	}
+	return b.walkElements(value[boltBucketSize:], fn, bucket)
+}
+
+func (b *boltFile) walkPage(id uint64, fn func(key, value []byte) error, bucket func(name, value []byte) error) error {
+	page, err := b.readPage(id)
+	if err != nil {
+		return err
+	}
+	return b.walkElements(page, fn, bucket)
+}
+
+// walkElements walks the elements of a branch or leaf page. The positions of the keys are relative to their element.
+func (b *boltFile) walkElements(page []byte, fn func(key, value []byte) error, bucket func(name, value []byte) error) error {
+	if len(page) < boltPageHeaderSize {
+		return ErrNotBoltFile
+	}
+	flags := binary.LittleEndian.Uint16(page[8:])
+	count := int(binary.LittleEndian.Uint16(page[10:]))
+	if boltPageHeaderSize+count*boltElementSize > len(page) {
+		return ErrNotBoltFile
+	}
+	for i := 0; i < count; i++ {
+		start := boltPageHeaderSize + i*boltElementSize
+		element := page[start : start+boltElementSize]
+		switch {
+		case flags&boltBranchPage != 0:
+			err := b.walkPage(binary.LittleEndian.Uint64(element[8:]), fn, bucket)
+			if err != nil {
+				return err
+			}
+		case flags&boltLeafPage != 0:
+			pos := start + int(binary.LittleEndian.Uint32(element[4:]))
+			keySize := int(binary.LittleEndian.Uint32(element[8:]))
+			valueSize := int(binary.LittleEndian.Uint32(element[12:]))
+			if pos+keySize+valueSize > len(page) {
+				return ErrNotBoltFile
+			}
+			key, value := page[pos:pos+keySize], page[pos+keySize:pos+keySize+valueSize]
+			visit := fn
+			if binary.LittleEndian.Uint32(element)&boltBucketLeaf != 0 {
+				visit = bucket
+			}
+			err := visit(key, value)
+			if err != nil {
+				return err
+			}
+		default:
+			return ErrNotBoltFile
+		}
+	}
+	return nil
+}
+
+// ImportBolt copies the buckets of the bolt or bbolt file at path into collections of the same names, which are created
+// as needed, with the keys of the buckets in key order. Nested buckets go to collections named after their path,
+// joined by BoltBucketSeparator, and their keys aren't copied to the collection of their parent. The keys are committed
+// importBatch at a time, like ImportJSON, so an import failing halfway leaves the batches before the failure
+// committed.
+//
+// The bolt file is only read, and must not be written while it's imported.
+func (db *DB) ImportBolt(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	root, pageSize, err := readBoltMeta(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	b := &boltFile{file: file, pageSize: pageSize, read: map[uint64]bool{}}
+	importer := newBatchImporter(db)
+
+	var walk func(name string, value []byte) error
+	walk = func(name string, value []byte) error {
+		collection := []byte(name)
+		err := importer.add(collection, nil, nil)
+		if err != nil {
+			return err
+		}
+		return b.walkBucket(value, func(key, value []byte) error {
+			return importer.add(collection, key, value)
+		}, func(sub, value []byte) error {
+			return walk(name+BoltBucketSeparator+string(sub), value)
+		})
+	}
+	rootBucket := binary.LittleEndian.AppendUint64(nil, root)
+	rootBucket = binary.LittleEndian.AppendUint64(rootBucket, 0)
+	err = b.walkBucket(rootBucket, func(key, value []byte) error {
+		return ErrNotBoltFile
+	}, func(name, value []byte) error {
+		return walk(string(name), value)
+	})
+	if errors.Is(err, io.EOF) {
+		err = ErrNotBoltFile
+	}
+	if err != nil {
+		return err
+	}
+	return importer.flush()
+}
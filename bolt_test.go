@@ -0,0 +1,193 @@
+package gopherdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// boltTestPageSize is the page size of the bolt files of the tests, small enough for a few keys to fill a page.
+const boltTestPageSize = 1024
+
+// boltElement is an element of a page of a test bolt file: a key and its value, or its bucket, or a child page of a
+// branch page.
+type boltElement struct {
+	key, value []byte
+	bucket     bool
+	child      uint64
+}
+
+// boltPage lays out a page the way bolt does: the header, the elements, and the keys and values, each element
+// pointing to its key relative to itself. Pages bigger than the page size get overflow pages, unless they're inline.
+func boltPage(id uint64, flags uint16, elements []boltElement, inline bool) []byte {
+	buf := make([]byte, boltPageHeaderSize+len(elements)*boltElementSize)
+	binary.LittleEndian.PutUint64(buf, id)
+	binary.LittleEndian.PutUint16(buf[8:], flags)
+	binary.LittleEndian.PutUint16(buf[10:], uint16(len(elements)))
+	for i, e := range elements {
+		start := boltPageHeaderSize + i*boltElementSize
+		element := buf[start:]
+		pos := uint32(len(buf) - start)
+		if flags == boltBranchPage {
+			binary.LittleEndian.PutUint32(element, pos)
+			binary.LittleEndian.PutUint32(element[4:], uint32(len(e.key)))
+			binary.LittleEndian.PutUint64(element[8:], e.child)
+			buf = append(buf, e.key...)
+			continue
+		}
+		if e.bucket {
+			binary.LittleEndian.PutUint32(element, boltBucketLeaf)
+		}
+		binary.LittleEndian.PutUint32(element[4:], pos)
+		binary.LittleEndian.PutUint32(element[8:], uint32(len(e.key)))
+		binary.LittleEndian.PutUint32(element[12:], uint32(len(e.value)))
+		buf = append(append(buf, e.key...), e.value...)
+	}
+	if inline {
+		return buf
+	}
+	pages := (len(buf) + boltTestPageSize - 1) / boltTestPageSize
+	binary.LittleEndian.PutUint32(buf[12:], uint32(pages-1))
+	return append(buf, make([]byte, pages*boltTestPageSize-len(buf))...)
+}
+
+// boltBucket returns the header of a bucket rooted at the page, or of an inline bucket holding the elements if root
+// is zero.
+func boltBucket(root uint64, elements []boltElement) []byte {
+	buf := binary.LittleEndian.AppendUint64(nil, root)
+	buf = binary.LittleEndian.AppendUint64(buf, 0)
+	if root == 0 {
+		buf = append(buf, boltPage(0, boltLeafPage, elements, true)...)
+	}
+	return buf
+}
+
+func boltMeta(id uint64, root uint64, txid uint64) []byte {
+	buf := make([]byte, boltTestPageSize)
+	binary.LittleEndian.PutUint64(buf, id)
+	binary.LittleEndian.PutUint16(buf[8:], boltMetaPage)
+	meta := buf[boltPageHeaderSize:]
+	binary.LittleEndian.PutUint32(meta, boltMagic)
+	binary.LittleEndian.PutUint32(meta[4:], boltVersion)
+	binary.LittleEndian.PutUint32(meta[8:], boltTestPageSize)
+	binary.LittleEndian.PutUint64(meta[16:], root)
+	binary.LittleEndian.PutUint64(meta[48:], txid)
+	sum := fnv.New64a()
+	sum.Write(meta[:boltMetaSize])
+	binary.LittleEndian.PutUint64(meta[boltMetaSize:], sum.Sum64())
+	return buf
+}
+
+// writeBoltFile writes a bolt file with:
+//   - users, a bucket of 40 keys spread over two leaves under a branch page, with an overflowing value
+//   - settings, an inline bucket of two keys, holding theme, an inline bucket of its own
+//   - empty, an inline bucket without keys
+//
+// The first meta page is of an older commit with no bucket at all.
+func writeBoltFile(t *testing.T) string {
+	t.Helper()
+	big := bytes.Repeat([]byte("b"), 1500)
+	var left, right []boltElement
+	for i := 0; i < 40; i++ {
+		e := boltElement{key: testKey(i), value: []byte("user")}
+		if i == 39 {
+			e.value = big
+		}
+		if i < 20 {
+			left = append(left, e)
+		} else {
+			right = append(right, e)
+		}
+	}
+	theme := boltBucket(0, []boltElement{{key: []byte("color"), value: []byte("dark")}})
+	settings := boltBucket(0, []boltElement{
+		{key: []byte("lang"), value: []byte("en")},
+		{key: []byte("theme"), value: theme, bucket: true},
+		{key: []byte("tz"), value: []byte("UTC")},
+	})
+
+	pages := [][]byte{
+		boltMeta(0, 3, 1),
+		boltMeta(1, 4, 2),
+		boltPage(2, 0x10, nil, false),
+		boltPage(3, boltLeafPage, nil, false),
+		boltPage(4, boltLeafPage, []boltElement{
+			{key: []byte("empty"), value: boltBucket(0, nil), bucket: true},
+			{key: []byte("settings"), value: settings, bucket: true},
+			{key: []byte("users"), value: boltBucket(5, nil), bucket: true},
+		}, false),
+		boltPage(5, boltBranchPage, []boltElement{{key: left[0].key, child: 6}, {key: right[0].key, child: 7}}, false),
+		boltPage(6, boltLeafPage, left, false),
+		boltPage(7, boltLeafPage, right, false),
+	}
+	path := filepath.Join(t.TempDir(), "bolt.db")
+	if err := os.WriteFile(path, bytes.Join(pages, nil), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestImportBolt(t *testing.T) {
+	db := openTestDB(t, nil)
+	if err := db.ImportBolt(writeBoltFile(t)); err != nil {
+		t.Fatalf("ImportBolt: %v", err)
+	}
+	mustView(t, db, func(tx *Tx) error {
+		users, err := readAll(tx, "users")
+		if err != nil {
+			return err
+		}
+		if len(users) != 40 || users[string(testKey(0))] != "user" || len(users[string(testKey(39))]) != 1500 {
+			t.Errorf("users has %d keys", len(users))
+		}
+		want := map[string]map[string]string{
+			"settings":       {"lang": "en", "tz": "UTC"},
+			"settings/theme": {"color": "dark"},
+			"empty":          {},
+		}
+		for name, entries := range want {
+			got, err := readAll(tx, name)
+			if err != nil {
+				return err
+			}
+			if got == nil || len(got) != len(entries) {
+				t.Errorf("%s has %v, want %v", name, got, entries)
+			}
+			for key, value := range entries {
+				if got[key] != value {
+					t.Errorf("%s/%s is %q, want %q", name, key, got[key], value)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func TestImportBoltRejectsOtherFiles(t *testing.T) {
+	db := openTestDB(t, nil)
+	path := filepath.Join(t.TempDir(), "test.db")
+	if err := os.WriteFile(path, make([]byte, 2*boltTestPageSize), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ImportBolt(path); !errors.Is(err, ErrNotBoltFile) {
+		t.Errorf("got %v, want ErrNotBoltFile", err)
+	}
+
+	// A branch page pointing to itself
+	pages := [][]byte{
+		boltMeta(0, 2, 1),
+		boltMeta(1, 2, 1),
+		boltPage(2, boltLeafPage, []boltElement{{key: []byte("loop"), value: boltBucket(3, nil), bucket: true}}, false),
+		boltPage(3, boltBranchPage, []boltElement{{key: []byte("a"), child: 3}}, false),
+	}
+	if err := os.WriteFile(path, bytes.Join(pages, nil), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ImportBolt(path); !errors.Is(err, ErrNotBoltFile) {
+		t.Errorf("got %v, want ErrNotBoltFile for a page of two buckets", err)
+	}
+}
@@ -0,0 +1,216 @@
+package gopherdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// CheckError is the error of DB.Check, with every violation it found. It wraps ErrCheckFailed.
+type CheckError struct {
+	Violations []error
+}
+
+func (e *CheckError) Error() string {
+	if len(e.Violations) == 1 {
+		return fmt.Sprintf("%s: %v", ErrCheckFailed, e.Violations[0])
+	}
+	return fmt.Sprintf("%s: %v, and %d more violations", ErrCheckFailed, e.Violations[0], len(e.Violations)-1)
+}
+
+func (e *CheckError) Unwrap() error {
+	return ErrCheckFailed
+}
+
+// Check checks the consistency of the last commit, like the Check of bolt, and returns a *CheckError with every
+// violation found, or nil if there's none. It reads every node and overflow page of every tree, bypassing the caches,
+// and checks that:
+//   - the keys of every node are in order, and between the keys of its parent around it
+//   - branches have a child more than their keys, and every leaf of a tree is at the same depth
+//   - every page a node or a value points to is inside the file, isn't a meta or freelist page, and isn't used twice
+//   - every node and overflow page reads back, with a valid checksum
+//   - every free page is inside the file, free once, and not used by the trees
+//
+// It runs in a read transaction, so it checks a database in use without holding up the writes, but reads the whole
+// file. Doctor runs similar checks on a file that isn't open, and reports them as findings.
+func (db *DB) Check() error {
+	tx, err := db.ReadTx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	c := newChecker(tx)
+	c.checkTree("the root tree", tx.root, true)
+	for i := 0; i < len(c.trees); i++ {
+		c.checkTree(c.trees[i].name, c.trees[i].root, false)
+	}
+	c.checkFreelist()
+	if len(c.violations) > 0 {
+		return &CheckError{Violations: c.violations}
+	}
+	return nil
+}
+
+// checker checks the trees and the freelist of the state of the file a transaction reads. used holds the pages of the
+// trees, with what uses them, and trees the trees of the collections found in the trees checked so far, checked after
+// them.
+type checker struct {
+	tx         *Tx
+	state      fileState
+	reserved   map[pgnum]bool
+	used       map[pgnum]string
+	trees      []checkedTree
+	violations []error
+}
+
+// checkedTree is the tree of a collection to check, named like in the violations.
+type checkedTree struct {
+	name string
+	root pgnum
+}
+
+func newChecker(tx *Tx) *checker {
+	state := tx.fileState()
+	c := &checker{tx: tx, state: state, reserved: map[pgnum]bool{metaPageNum: true}, used: map[pgnum]string{}}
+	for _, pageNum := range append([]pgnum{state.freelistPage, state.freelistSpare}, state.chain...) {
+		if pageNum != 0 {
+			c.reserved[pageNum] = true
+		}
+	}
+	if state.freelistSpare != 0 {
+		c.reserved[metaPageNumB] = true
+	}
+	return c
+}
+
+func (c *checker) addf(format string, args ...interface{}) {
+	c.violations = append(c.violations, fmt.Errorf(format, args...))
+}
+
+// claim reports whether the page, which what points to, can be a page of the trees, and records that what uses it.
+func (c *checker) claim(pageNum pgnum, what string) bool {
+	switch {
+	case pageNum > c.state.maxPage:
+		c.addf("%s points to page %d, past the last page %d", what, pageNum, c.state.maxPage)
+	case c.reserved[pageNum]:
+		c.addf("%s points to page %d, a meta or freelist page", what, pageNum)
+	case c.used[pageNum] != "":
+		c.addf("%s points to page %d, already used by %s", what, pageNum, c.used[pageNum])
+	default:
+		c.used[pageNum] = what
+		return true
+	}
+	return false
+}
+
+// checkTree checks the tree at root, the root tree if collections is set, and adds the collections its items hold to
+// the trees to check: every item of the root tree, and the nested collections of the others.
+func (c *checker) checkTree(tree string, root pgnum, collections bool) {
+	leafDepth := -1
+	// lo and hi are the items of the parent around the node, nil at the edges of the tree
+	var walk func(pageNum pgnum, lo *Item, hi *Item, depth int, what string)
+	walk = func(pageNum pgnum, lo *Item, hi *Item, depth int, what string) {
+		if !c.claim(pageNum, what) {
+			return
+		}
+		where := fmt.Sprintf("page %d of %s", pageNum, tree)
+		p, err := c.tx.db.readPage(pageNum)
+		node := NewEmptyNode()
+		if err == nil {
+			err = node.deserialize(p.data)
+		}
+		if err != nil {
+			c.addf("%s: %w", where, err)
+			return
+		}
+
+		for i, item := range node.items {
+			switch {
+			case i > 0 && bytes.Compare(node.items[i-1].key, item.key) >= 0:
+				c.addf("%s: key %s isn't after key %s", where, dumpKey(item.key), dumpKey(node.items[i-1].key))
+			case lo != nil && bytes.Compare(item.key, lo.key) <= 0:
+				c.addf("%s: key %s isn't after key %s of its parent", where, dumpKey(item.key), dumpKey(lo.key))
+			case hi != nil && bytes.Compare(item.key, hi.key) >= 0:
+				c.addf("%s: key %s isn't before key %s of its parent", where, dumpKey(item.key), dumpKey(hi.key))
+			}
+			if collections || item.collection {
+				collection := newEmptyCollection()
+				collection.deserialize(item)
+				name := fmt.Sprintf("collection %q", collection.name)
+				if !collections {
+					name = fmt.Sprintf("%s in %s", name, tree)
+				}
+				c.trees = append(c.trees, checkedTree{name: name, root: collection.root})
+			} else if item.overflow {
+				c.checkOverflow(where, item)
+			}
+		}
+
+		if node.isLeaf() {
+			if leafDepth == -1 {
+				leafDepth = depth
+			} else if depth != leafDepth {
+				c.addf("%s: leaf at depth %d, while the other leaves are at depth %d", where, depth, leafDepth)
+			}
+			return
+		}
+		if len(node.childNodes) != len(node.items)+1 {
+			c.addf("%s: branch with %d keys and %d children", where, len(node.items), len(node.childNodes))
+		}
+		for i, child := range node.childNodes {
+			childLo, childHi := lo, hi
+			if i > 0 && i <= len(node.items) {
+				childLo = node.items[i-1]
+			}
+			if i < len(node.items) {
+				childHi = node.items[i]
+			}
+			walk(child, childLo, childHi, depth+1, fmt.Sprintf("child %d of %s", i, where))
+		}
+	}
+	what := "the meta page"
+	if !collections {
+		what = fmt.Sprintf("the root of %s", tree)
+	}
+	walk(root, nil, nil, 0, what)
+}
+
+// checkOverflow checks the chain of overflow pages of the value of the item, in the node where.
+func (c *checker) checkOverflow(where string, item *Item) {
+	what := fmt.Sprintf("the value of key %s in %s", dumpKey(item.key), where)
+	if len(item.value) < overflowRefSize {
+		c.addf("%s: overflow reference of %d bytes", what, len(item.value))
+		return
+	}
+	for pageNum := deserializeOverflowRef(item.value).first; pageNum != 0; {
+		if !c.claim(pageNum, what) {
+			return
+		}
+		p, err := c.tx.db.readPage(pageNum)
+		if err != nil {
+			c.addf("%s: %w", what, err)
+			return
+		}
+		pageNum = pgnum(binary.LittleEndian.Uint64(p.data))
+	}
+}
+
+// checkFreelist checks the free pages against the pages of the trees. The states of checkpoints don't keep their
+// freelists, so there's nothing to check then.
+func (c *checker) checkFreelist() {
+	free := map[pgnum]bool{}
+	for _, pageNum := range c.state.free {
+		switch {
+		case pageNum > c.state.maxPage:
+			c.addf("free page %d is past the last page %d", pageNum, c.state.maxPage)
+		case c.reserved[pageNum]:
+			c.addf("free page %d is a meta or freelist page", pageNum)
+		case free[pageNum]:
+			c.addf("page %d is free twice", pageNum)
+		case c.used[pageNum] != "":
+			c.addf("free page %d is used by %s", pageNum, c.used[pageNum])
+		}
+		free[pageNum] = true
+	}
+}
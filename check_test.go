@@ -0,0 +1,102 @@
+package gopherdb
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// rewriteNode changes a committed node of the collection in place, as a bug overwriting it would, with a valid
+// checksum. The node is the root, or its child for a child index of 0 or more.
+func rewriteNode(t *testing.T, db *DB, collection string, child int, change func(n *Node)) pgnum {
+	t.Helper()
+	var node *Node
+	mustView(t, db, func(tx *Tx) error {
+		var err error
+		node, err = tx.getNode(getOrCreate(t, tx, collection).root)
+		if err == nil && child >= 0 {
+			node, err = tx.getNode(node.childNodes[child])
+		}
+		return err
+	})
+	change(node)
+	if _, err := db.writeNode(node); err != nil {
+		t.Fatalf("writeNode: %v", err)
+	}
+	return node.pageNum
+}
+
+// checkViolations returns the violations found by Check.
+func checkViolations(t *testing.T, db *DB) []error {
+	t.Helper()
+	err := db.Check()
+	if err == nil {
+		return nil
+	}
+	var checkErr *CheckError
+	if !errors.As(err, &checkErr) || !errors.Is(err, ErrCheckFailed) {
+		t.Fatalf("Check: %v", err)
+	}
+	return checkErr.Violations
+}
+
+func TestCheck(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 100; i++ {
+		putValue(t, db, "a", string(testKey(i)), "value")
+		putValue(t, db, "b", string(testKey(i)), "value")
+	}
+	putValue(t, db, "b", "big", strings.Repeat("v", 3000))
+	if violations := checkViolations(t, db); violations != nil {
+		t.Fatalf("Check of an intact file: %v", violations)
+	}
+
+	// Keys out of order in a leaf, and a leaf holding a key of its sibling
+	rewriteNode(t, db, "a", 0, func(n *Node) {
+		n.items[0], n.items[1] = n.items[1], n.items[0]
+	})
+	rewriteNode(t, db, "a", 2, func(n *Node) {
+		n.items[0] = newItem(testKey(0), []byte("value"))
+	})
+	// A branch pointing past the end of the file, and twice to the same leaf
+	rewriteNode(t, db, "b", -1, func(n *Node) {
+		n.childNodes[0] = n.childNodes[1]
+		n.childNodes[2] = 100000
+	})
+	violations := checkViolations(t, db)
+	for _, want := range []string{
+		`key "key000000" isn't after key "key000001"`,
+		`key "key000000" isn't after key "key000021" of its parent`,
+		"points to page 100000, past the last page",
+		"already used by child 0 of page",
+	} {
+		found := false
+		for _, violation := range violations {
+			found = found || strings.Contains(violation.Error(), want)
+		}
+		if !found {
+			t.Errorf("no violation %q in %v", want, violations)
+		}
+	}
+}
+
+func TestCheckFreelist(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 100; i++ {
+		putValue(t, db, "c", string(testKey(i)), "value")
+	}
+	var leaf pgnum
+	mustView(t, db, func(tx *Tx) error {
+		node, err := tx.getNode(getOrCreate(t, tx, "c").root)
+		leaf = node.childNodes[0]
+		return err
+	})
+	db.pinMu.Lock()
+	db.committed.free = append(db.committed.free, leaf, leaf)
+	db.pinMu.Unlock()
+	violations := checkViolations(t, db)
+	if len(violations) != 2 || !strings.Contains(violations[0].Error(), "is used by child 0") ||
+		!strings.Contains(violations[1].Error(), "is free twice") {
+		t.Fatalf("got %v", violations)
+	}
+}
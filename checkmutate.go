@@ -0,0 +1,152 @@
+package gopherdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var ErrConditionFailed = errors.New("condition of CheckAndMutate doesn't hold")
+
+// ConditionCheck is what a Condition checks about its key.
+type ConditionCheck int
+
+const (
+	// CheckExists holds if the key exists.
+	CheckExists ConditionCheck = iota
+	// CheckMissing holds if the key doesn't exist, or its collection doesn't.
+	CheckMissing
+	// CheckEquals holds if the key exists with the value of the condition.
+	CheckEquals
+	// CheckVersion holds if the version of the key is the one of the condition: the id of the transaction that last
+	// wrote it with metadata, see ItemMeta.UpdatedTxID, which every Op put sets. Keys without metadata, and missing
+	// keys, are at version 0.
+	CheckVersion
+)
+
+// Condition is a check of a key that must hold for CheckAndMutate to apply its operations.
+type Condition struct {
+	Collection []byte
+	Key        []byte
+	Check      ConditionCheck
+	// Value is the value of CheckEquals, and Version the version of CheckVersion.
+	Value   []byte
+	Version uint64
+}
+
+// Op is a write applied by CheckAndMutate: a put of the value, or the removal of the key if Delete is set.
+type Op struct {
+	Collection []byte
+	Key        []byte
+	Value      []byte
+	Delete     bool
+}
+
+// ConditionError tells which condition of CheckAndMutate didn't hold. It matches ErrConditionFailed with errors.Is.
+type ConditionError struct {
+	Index     int
+	Condition Condition
+}
+
+func (e *ConditionError) Error() string {
+	return fmt.Sprintf("%s: condition %d on key %q of collection %q", ErrConditionFailed, e.Index, e.Condition.Key, e.Condition.Collection)
+}
+
+func (e *ConditionError) Unwrap() error {
+	return ErrConditionFailed
+}
+
+// CheckAndMutate checks the conditions, in order, and applies the operations, in order, if they all hold, so a client
+// can make a set of writes depend on a set of keys in a single call. If a condition doesn't hold, it returns a
+// *ConditionError and writes nothing. An operation failing leaves the ones before it applied, so the transaction
+// should be rolled back then, which DB.CheckAndMutate does.
+//
+// Puts keep the metadata of the keys they overwrite, like their expiration, and set their version, see CheckVersion.
+// Removing a key that doesn't exist does nothing, and collections are created by the first put into them.
+func (tx *Tx) CheckAndMutate(conditions []Condition, ops []Op) error {
+	if !tx.write {
+		return ErrWriteInsideReadTx
+	}
+	for i, condition := range conditions {
+		holds, err := tx.checkCondition(condition)
+		if err != nil {
+			return err
+		}
+		if !holds {
+			return &ConditionError{Index: i, Condition: condition}
+		}
+	}
+
+	for _, op := range ops {
+		if op.Delete {
+			c, err := tx.GetCollection(op.Collection)
+			if err != nil {
+				return err
+			}
+			if c == nil {
+				continue
+			}
+			err = c.Remove(op.Key)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		c, err := tx.getOrCreateCollection(op.Collection)
+		if err != nil {
+			return err
+		}
+		_, meta, err := c.FindWithMeta(op.Key)
+		if err != nil {
+			return err
+		}
+		if meta == nil {
+			meta = &ItemMeta{}
+		}
+		err = c.PutWithMeta(op.Key, op.Value, *meta)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCondition reports whether the condition holds.
+func (tx *Tx) checkCondition(condition Condition) (bool, error) {
+	var item *Item
+	var meta *ItemMeta
+	c, err := tx.GetCollection(condition.Collection)
+	if err != nil {
+		return false, err
+	}
+	if c != nil {
+		item, meta, err = c.FindWithMeta(condition.Key)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	switch condition.Check {
+	case CheckExists:
+		return item != nil, nil
+	case CheckMissing:
+		return item == nil, nil
+	case CheckEquals:
+		return item != nil && bytes.Equal(item.value, condition.Value), nil
+	case CheckVersion:
+		var version uint64
+		if meta != nil {
+			version = meta.UpdatedTxID
+		}
+		return version == condition.Version, nil
+	}
+	return false, fmt.Errorf("unknown condition check %d", condition.Check)
+}
+
+// CheckAndMutate runs Tx.CheckAndMutate in a write transaction of its own, which is only committed if the conditions
+// hold and the operations succeed.
+func (db *DB) CheckAndMutate(conditions []Condition, ops []Op) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.CheckAndMutate(conditions, ops)
+	})
+}
@@ -0,0 +1,84 @@
+package gopherdb
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCheckAndMutate(t *testing.T) {
+	db := openTestDB(t, nil)
+	put := []Op{{Collection: []byte("accounts"), Key: []byte("alice"), Value: []byte("100")}}
+	err := db.CheckAndMutate([]Condition{{Collection: []byte("accounts"), Key: []byte("alice"), Check: CheckMissing}}, put)
+	if err != nil {
+		t.Fatalf("CheckAndMutate on a missing collection: %v", err)
+	}
+	var version uint64
+	mustView(t, db, func(tx *Tx) error {
+		_, meta, err := getOrCreate(t, tx, "accounts").FindWithMeta([]byte("alice"))
+		if err != nil || meta == nil {
+			t.Fatalf("got %v, %v, want the metadata of the put", meta, err)
+		}
+		version = meta.UpdatedTxID
+		return nil
+	})
+
+	// A transfer applies both writes only if both conditions hold
+	transfer := func(conditions []Condition) error {
+		return db.CheckAndMutate(conditions, []Op{
+			{Collection: []byte("accounts"), Key: []byte("alice"), Value: []byte("60")},
+			{Collection: []byte("accounts"), Key: []byte("bob"), Value: []byte("40")},
+			{Collection: []byte("pending"), Key: []byte("transfer"), Delete: true},
+		})
+	}
+	err = transfer([]Condition{
+		{Collection: []byte("accounts"), Key: []byte("alice"), Check: CheckVersion, Version: version},
+		{Collection: []byte("accounts"), Key: []byte("bob"), Check: CheckExists},
+	})
+	var conditionErr *ConditionError
+	if !errors.Is(err, ErrConditionFailed) || !errors.As(err, &conditionErr) || conditionErr.Index != 1 {
+		t.Fatalf("got %v, want the second condition to fail", err)
+	}
+	if got := getValue(t, db, "accounts", "alice"); got != "100" {
+		t.Fatalf("alice is %q after a failed condition", got)
+	}
+
+	err = transfer([]Condition{
+		{Collection: []byte("accounts"), Key: []byte("alice"), Check: CheckVersion, Version: version},
+		{Collection: []byte("accounts"), Key: []byte("alice"), Check: CheckEquals, Value: []byte("100")},
+		{Collection: []byte("accounts"), Key: []byte("bob"), Check: CheckVersion},
+	})
+	if err != nil {
+		t.Fatalf("CheckAndMutate: %v", err)
+	}
+	if alice, bob := getValue(t, db, "accounts", "alice"), getValue(t, db, "accounts", "bob"); alice != "60" || bob != "40" {
+		t.Fatalf("alice is %q and bob %q after the transfer", alice, bob)
+	}
+	// The put moved the version, so a client holding the old one loses the race
+	err = transfer([]Condition{{Collection: []byte("accounts"), Key: []byte("alice"), Check: CheckVersion, Version: version}})
+	if !errors.Is(err, ErrConditionFailed) {
+		t.Fatalf("got %v, want ErrConditionFailed for a stale version", err)
+	}
+}
+
+func TestCheckAndMutateKeepsMetadata(t *testing.T) {
+	db := openTestDB(t, nil)
+	expires := time.Unix(2000000000, 0)
+	mustUpdate(t, db, func(tx *Tx) error {
+		return getOrCreate(t, tx, "c").PutWithMeta([]byte("k"), []byte("v"), ItemMeta{ExpiresAt: expires, Flags: 7})
+	})
+	err := db.CheckAndMutate(nil, []Op{{Collection: []byte("c"), Key: []byte("k"), Value: []byte("v2")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustView(t, db, func(tx *Tx) error {
+		item, meta, err := getOrCreate(t, tx, "c").FindWithMeta([]byte("k"))
+		if err != nil {
+			return err
+		}
+		if string(item.value) != "v2" || !meta.ExpiresAt.Equal(expires) || meta.Flags != 7 || meta.UpdatedTxID != tx.ID() {
+			t.Fatalf("got %q with %+v, want the new value with the old metadata", item.value, meta)
+		}
+		return nil
+	})
+}
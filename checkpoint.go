@@ -0,0 +1,308 @@
+package gopherdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Checkpoints are the states of the file kept for reading later, with DB.CheckpointTx and DB.ReadTxAt. They're read
+// transactions that don't end: the pages they read are held back like the ones of a long read transaction, see
+// snapshot.go, until the checkpoint expires. Commits take them as Options.Checkpoints says, of the last commit when
+// they run, and record them in checkpointsCollection, so they survive the file being closed. The held pages are
+// written to the freelist as free, like every held page, so Open takes the pages the trees of the checkpoints use
+// back out of it, see loadCheckpoints. They aren't related to the checkpoints of the WAL.
+
+// checkpointsCollection is the collection the checkpoints are recorded in, by txid.
+var checkpointsCollection = []byte("__gopherdb_checkpoints")
+
+// checkpointRecordSize is the size of a serialized checkpoint: the time, then the root, the biggest page number, the
+// number of free pages and the freelist page of its state.
+const checkpointRecordSize = 8 + 4*pageNumSize
+
+// CheckpointTier is a tier of Options.Checkpoints: a checkpoint is taken every Every, and the first one of every Every
+// is kept For.
+type CheckpointTier struct {
+	Every time.Duration
+	For   time.Duration
+}
+
+// Checkpoint is a state of the file kept by Options.Checkpoints: the one of the commit TxID, the last one at Time.
+type Checkpoint struct {
+	TxID uint64
+	Time time.Time
+}
+
+// checkpoint is a checkpoint along with the state of the file it reads.
+type checkpoint struct {
+	Checkpoint
+	state fileState
+}
+
+// checkpointChanges are the checkpoints a commit takes and expires, which are registered once it's done.
+type checkpointChanges struct {
+	taken   *checkpoint
+	expired []uint64
+}
+
+var ErrNoCheckpoint = errors.New("no checkpoint is kept for that transaction or time")
+
+func serializeCheckpoint(c *checkpoint) []byte {
+	buf := make([]byte, 0, checkpointRecordSize)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(c.Time.UnixNano()))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(c.state.root))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(c.state.maxPage))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(c.state.freePages))
+	return binary.LittleEndian.AppendUint64(buf, uint64(c.state.freelistPage))
+}
+
+func deserializeCheckpoint(key []byte, value []byte) *checkpoint {
+	txid := binary.BigEndian.Uint64(key)
+	return &checkpoint{
+		Checkpoint: Checkpoint{TxID: txid, Time: time.Unix(0, int64(binary.LittleEndian.Uint64(value)))},
+		state: fileState{
+			txid:         txid,
+			root:         pgnum(binary.LittleEndian.Uint64(value[8:])),
+			maxPage:      pgnum(binary.LittleEndian.Uint64(value[16:])),
+			freePages:    int(binary.LittleEndian.Uint64(value[24:])),
+			freelistPage: pgnum(binary.LittleEndian.Uint64(value[32:])),
+		},
+	}
+}
+
+// keepCheckpoints returns the txids of the checkpoints the tiers keep at now: the first checkpoint of every Every of a
+// tier, up to For ago.
+func keepCheckpoints(tiers []CheckpointTier, checkpoints []*checkpoint, now time.Time) map[uint64]bool {
+	sorted := append([]*checkpoint{}, checkpoints...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].TxID < sorted[j].TxID
+	})
+	kept := map[uint64]bool{}
+	for _, tier := range tiers {
+		if tier.Every <= 0 {
+			continue
+		}
+		taken := map[time.Time]bool{}
+		for _, c := range sorted {
+			interval := c.Time.Truncate(tier.Every)
+			if now.Sub(c.Time) < tier.For && !taken[interval] {
+				kept[c.TxID] = true
+			}
+			taken[interval] = true
+		}
+	}
+	return kept
+}
+
+// checkpointDue reports whether the tiers take a checkpoint at now, after the last one taken at last: once the
+// shortest Every of the tiers starts again.
+func checkpointDue(tiers []CheckpointTier, last *checkpoint, now time.Time) bool {
+	var every time.Duration
+	for _, tier := range tiers {
+		if tier.Every > 0 && tier.For > 0 && (every == 0 || tier.Every < every) {
+			every = tier.Every
+		}
+	}
+	if every == 0 {
+		return false
+	}
+	return last == nil || !now.Truncate(every).Equal(last.Time.Truncate(every))
+}
+
+// updateCheckpoints records the checkpoint of the last commit if one is due, and removes the records of the
+// checkpoints that expired. It's called by Commit before the trees are written, and returns what to register once
+// the commit is done.
+func (tx *Tx) updateCheckpoints(now time.Time) (*checkpointChanges, error) {
+	d := tx.db
+	d.pinMu.Lock()
+	var last *checkpoint
+	checkpoints := make([]*checkpoint, 0, len(d.checkpoints)+1)
+	for _, c := range d.checkpoints {
+		checkpoints = append(checkpoints, c)
+		if last == nil || c.TxID > last.TxID {
+			last = c
+		}
+	}
+	d.pinMu.Unlock()
+
+	// There's nothing to keep before the first commit
+	changes := &checkpointChanges{}
+	if d.committed.txid > 0 && (last == nil || last.TxID != d.committed.txid) && checkpointDue(d.checkpointTiers, last, now) {
+		// The freelist of the commit isn't recorded with the checkpoint, so it isn't kept in memory either
+		state := d.committed
+		state.chain, state.free = nil, nil
+		changes.taken = &checkpoint{Checkpoint: Checkpoint{TxID: d.committed.txid, Time: now}, state: state}
+		checkpoints = append(checkpoints, changes.taken)
+	}
+	kept := keepCheckpoints(d.checkpointTiers, checkpoints, now)
+	for _, c := range checkpoints {
+		if !kept[c.TxID] && c != changes.taken {
+			changes.expired = append(changes.expired, c.TxID)
+		}
+	}
+	if changes.taken != nil && !kept[changes.taken.TxID] {
+		changes.taken = nil
+	}
+	if changes.taken == nil && len(changes.expired) == 0 {
+		return nil, nil
+	}
+
+	collection, err := tx.getOrCreateCollection(checkpointsCollection)
+	if err != nil {
+		return nil, err
+	}
+	if changes.taken != nil {
+		err = collection.Put(binary.BigEndian.AppendUint64(nil, changes.taken.TxID), serializeCheckpoint(changes.taken))
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, txid := range changes.expired {
+		err = collection.Remove(binary.BigEndian.AppendUint64(nil, txid))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+// registerCheckpoints registers the checkpoints a commit took and unregisters the ones it expired. It's called once
+// the commit is done, before publishState, which holds back the pages the commit freed from the checkpoint it took.
+func (d *dal) registerCheckpoints(changes *checkpointChanges) {
+	d.pinMu.Lock()
+	defer d.pinMu.Unlock()
+	if changes.taken != nil {
+		d.addCheckpoint(changes.taken)
+	}
+	for _, txid := range changes.expired {
+		delete(d.checkpoints, txid)
+		d.readers[txid]--
+		if d.readers[txid] <= 0 {
+			delete(d.readers, txid)
+		}
+	}
+}
+
+// addCheckpoint registers the checkpoint as a reader of its commit. It's called holding pinMu.
+func (d *dal) addCheckpoint(c *checkpoint) {
+	if d.checkpoints == nil {
+		d.checkpoints = map[uint64]*checkpoint{}
+	}
+	if d.readers == nil {
+		d.readers = map[uint64]int{}
+	}
+	d.checkpoints[c.TxID] = c
+	d.readers[c.TxID]++
+}
+
+// loadCheckpoints registers the checkpoints recorded in the file when it's opened. The pages their trees use are free
+// in the freelist of the file, so they're taken back out of it and held until the checkpoints expire.
+func (db *DB) loadCheckpoints() error {
+	tx := newTx(db, false, db.txid, db.root)
+	collection, err := tx.GetCollection(checkpointsCollection)
+	if err != nil || collection == nil {
+		return err
+	}
+	var checkpoints []*checkpoint
+	err = tx.rangeItems(collection.root, KeyRange{}, func(item *Item) (bool, error) {
+		item, err := collection.resolveItem(item)
+		if err != nil {
+			return false, err
+		}
+		if len(item.key) == txIDSize && len(item.value) == checkpointRecordSize {
+			checkpoints = append(checkpoints, deserializeCheckpoint(item.key, item.value))
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	used := map[pgnum]bool{}
+	if len(db.releasedPages) > 0 && !db.dal.readOnly {
+		for _, c := range checkpoints {
+			err = tx.readTreePages(c.state.root, used)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	db.pinMu.Lock()
+	defer db.pinMu.Unlock()
+	for _, c := range checkpoints {
+		db.addCheckpoint(c)
+	}
+	if db.freedBy == nil {
+		db.freedBy = map[pgnum]uint64{}
+	}
+	released := db.releasedPages[:0]
+	for _, pageNum := range db.releasedPages {
+		if !used[pageNum] {
+			released = append(released, pageNum)
+			continue
+		}
+		// Every checkpoint is of an earlier commit than the next one
+		db.freedBy[pageNum] = db.txid + 1
+		db.heldPages = append(db.heldPages, pageNum)
+	}
+	db.releasedPages = released
+	db.committed = db.committedState()
+	return nil
+}
+
+// Checkpoints returns the checkpoints kept, from the oldest to the latest.
+func (db *DB) Checkpoints() []Checkpoint {
+	db.pinMu.Lock()
+	defer db.pinMu.Unlock()
+	checkpoints := make([]Checkpoint, 0, len(db.checkpoints))
+	for _, c := range db.checkpoints {
+		checkpoints = append(checkpoints, c.Checkpoint)
+	}
+	sort.Slice(checkpoints, func(i, j int) bool {
+		return checkpoints[i].TxID < checkpoints[j].TxID
+	})
+	return checkpoints
+}
+
+// CheckpointTx begins a read transaction on the checkpoint of the commit txid, or fails with ErrNoCheckpoint if it
+// isn't kept. The checkpoint can expire while the transaction runs, which still reads it until it ends.
+func (db *DB) CheckpointTx(txid uint64) (*Tx, error) {
+	err := db.begin()
+	if err != nil {
+		return nil, err
+	}
+	db.snapshotMu.RLock()
+	db.pinMu.Lock()
+	c := db.checkpoints[txid]
+	if c != nil {
+		db.readers[txid]++
+	}
+	db.pinMu.Unlock()
+	if c == nil {
+		db.snapshotMu.RUnlock()
+		db.inFlight.Done()
+		return nil, ErrNoCheckpoint
+	}
+	state := c.state
+	tx := newTx(db, false, state.txid, state.root)
+	tx.snapshot = &state
+	return tx, nil
+}
+
+// ReadTxAt begins a read transaction on the file as it was at t, as far as the checkpoints tell: on the latest
+// checkpoint taken at t or before. It fails with ErrNoCheckpoint if there's none.
+func (db *DB) ReadTxAt(t time.Time) (*Tx, error) {
+	var txid uint64
+	found := false
+	for _, c := range db.Checkpoints() {
+		if c.Time.After(t) {
+			break
+		}
+		txid, found = c.TxID, true
+	}
+	if !found {
+		return nil, ErrNoCheckpoint
+	}
+	return db.CheckpointTx(txid)
+}
@@ -0,0 +1,201 @@
+package gopherdb
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// putAll puts the value in the keys of the collection c, in a single commit.
+func putAll(t *testing.T, db *DB, keys int, value string) {
+	t.Helper()
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i := 0; i < keys; i++ {
+			if err := c.Put(testKey(i), []byte(value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// checkCheckpoint fails unless every key of the collection c has the value in the checkpoint of the commit txid.
+func checkCheckpoint(t *testing.T, db *DB, txid uint64, keys int, value string) {
+	t.Helper()
+	tx, err := db.CheckpointTx(txid)
+	if err != nil {
+		t.Fatalf("CheckpointTx(%d): %v", txid, err)
+	}
+	defer tx.Rollback()
+	c, err := tx.GetCollection([]byte("c"))
+	if err != nil || c == nil {
+		t.Fatalf("GetCollection in the checkpoint %d: %v, %v", txid, c, err)
+	}
+	for i := 0; i < keys; i++ {
+		got, err := c.Get(testKey(i))
+		if err != nil || string(got) != value {
+			t.Fatalf("key %d in the checkpoint %d: got %q, %v, want %q", i, txid, got, err, value)
+		}
+	}
+}
+
+func TestCheckpoints(t *testing.T) {
+	const keys = 50
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	options.Checkpoints = []CheckpointTier{{Every: 50 * time.Millisecond, For: time.Hour}}
+	db := openTestPath(t, path, options)
+	before := time.Now()
+	// The first commit has nothing to keep, and the second one keeps the first
+	putAll(t, db, keys, "v1")
+	putAll(t, db, keys, "v2")
+	time.Sleep(60 * time.Millisecond)
+	putAll(t, db, keys, "v3")
+	checkpoints := db.Checkpoints()
+	if len(checkpoints) != 2 || checkpoints[0].TxID != 1 || checkpoints[1].TxID != 2 {
+		t.Fatalf("Checkpoints: got %+v, want the ones of commits 1 and 2", checkpoints)
+	}
+	second := checkpoints[1].Time
+
+	// The pages the checkpoints read aren't reused by the commits, which take more checkpoints as they go on
+	for round := 0; round < 20; round++ {
+		putAll(t, db, keys, fmt.Sprintf("round %d", round))
+	}
+	checkCheckpoint(t, db, 1, keys, "v1")
+	checkCheckpoint(t, db, 2, keys, "v2")
+	tx, err := db.ReadTxAt(second.Add(time.Millisecond))
+	if err != nil {
+		t.Fatalf("ReadTxAt: %v", err)
+	}
+	if tx.ID() != 2 {
+		t.Errorf("ReadTxAt just after the second checkpoint: got the commit %d, want 2", tx.ID())
+	}
+	tx.Rollback()
+	checkpoints = db.Checkpoints()
+	if _, err := db.ReadTxAt(before); !errors.Is(err, ErrNoCheckpoint) {
+		t.Errorf("ReadTxAt before the first checkpoint: got %v, want ErrNoCheckpoint", err)
+	}
+	if _, err := db.CheckpointTx(3); !errors.Is(err, ErrNoCheckpoint) {
+		t.Errorf("CheckpointTx of a commit without checkpoint: got %v, want ErrNoCheckpoint", err)
+	}
+	mustView(t, db, func(tx *Tx) error {
+		return tx.Export(func(collection []byte, key []byte, value []byte) error {
+			if string(collection) != "c" {
+				t.Fatalf("Export has the collection %q", collection)
+			}
+			return nil
+		})
+	})
+
+	// The checkpoints survive the file being closed, and their pages are still held back
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	db = openTestPath(t, path, options)
+	reopened := db.Checkpoints()
+	if len(reopened) != len(checkpoints) {
+		t.Fatalf("Checkpoints after reopening: got %+v, want %+v", reopened, checkpoints)
+	}
+	for i, c := range reopened {
+		if c.TxID != checkpoints[i].TxID || !c.Time.Equal(checkpoints[i].Time) {
+			t.Errorf("checkpoint %d after reopening: got %+v, want %+v", i, c, checkpoints[i])
+		}
+	}
+	for round := 0; round < 20; round++ {
+		putAll(t, db, keys, fmt.Sprintf("reopened %d", round))
+	}
+	checkCheckpoint(t, db, 1, keys, "v1")
+	checkCheckpoint(t, db, 2, keys, "v2")
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	checkFile(t, path, options)
+
+	// Without Options.Checkpoints, the next commit expires them
+	db = openTestPath(t, path, nil)
+	putAll(t, db, keys, "without")
+	if got := db.Checkpoints(); len(got) != 0 {
+		t.Errorf("Checkpoints once expired: got %+v", got)
+	}
+	if _, err := db.CheckpointTx(1); !errors.Is(err, ErrNoCheckpoint) {
+		t.Errorf("CheckpointTx of an expired checkpoint: got %v, want ErrNoCheckpoint", err)
+	}
+}
+
+func TestCheckpointTxOutlivesItsCheckpoint(t *testing.T) {
+	const keys = 50
+	options := testOptions()
+	options.Checkpoints = []CheckpointTier{{Every: time.Hour, For: time.Hour}}
+	db := openTestDB(t, options)
+	putAll(t, db, keys, "v1")
+	putAll(t, db, keys, "v2")
+	tx, err := db.CheckpointTx(1)
+	if err != nil {
+		t.Fatalf("CheckpointTx: %v", err)
+	}
+	defer tx.Rollback()
+
+	db.checkpointTiers = nil
+	for round := 0; round < 20; round++ {
+		putAll(t, db, keys, fmt.Sprintf("round %d", round))
+	}
+	if got := db.Checkpoints(); len(got) != 0 {
+		t.Fatalf("Checkpoints once expired: got %+v", got)
+	}
+	c, err := tx.GetCollection([]byte("c"))
+	if err != nil || c == nil {
+		t.Fatalf("GetCollection: %v, %v", c, err)
+	}
+	for i := 0; i < keys; i++ {
+		if got, err := c.Get(testKey(i)); err != nil || string(got) != "v1" {
+			t.Fatalf("key %d: got %q, %v, want v1", i, got, err)
+		}
+	}
+}
+
+func TestKeepCheckpoints(t *testing.T) {
+	tiers := []CheckpointTier{{Every: time.Minute, For: time.Hour}, {Every: time.Hour, For: 24 * time.Hour}}
+	now := time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC)
+	var checkpoints []*checkpoint
+	// Two checkpoints a minute for two days
+	for minutes := 2 * 24 * 60; minutes > 0; minutes-- {
+		for _, seconds := range []int{10, 40} {
+			at := now.Add(-time.Duration(minutes)*time.Minute + time.Duration(seconds)*time.Second)
+			checkpoints = append(checkpoints, &checkpoint{Checkpoint: Checkpoint{TxID: uint64(len(checkpoints) + 1), Time: at}})
+		}
+	}
+	kept := keepCheckpoints(tiers, checkpoints, now)
+
+	byAge := map[string]int{}
+	for _, c := range checkpoints {
+		if !kept[c.TxID] {
+			continue
+		}
+		age := now.Sub(c.Time)
+		switch {
+		case age < time.Hour:
+			byAge["last hour"]++
+			if c.Time.Second() != 10 {
+				t.Errorf("kept the checkpoint at %s, not the first of its minute", c.Time)
+			}
+		case age < 24*time.Hour:
+			byAge["last day"]++
+			if c.Time.Minute() != 0 || c.Time.Second() != 10 {
+				t.Errorf("kept the checkpoint at %s, not the first of its hour", c.Time)
+			}
+		default:
+			byAge["older"]++
+		}
+	}
+	// The hour the minute tier covers also has one checkpoint an hour, the one of its first minute
+	if byAge["last hour"] != 60 || byAge["last day"] != 23 || byAge["older"] != 0 {
+		t.Errorf("kept checkpoints: got %v, want 60 in the last hour, 23 in the last day and none older", byAge)
+	}
+
+	if !checkpointDue(tiers, checkpoints[len(checkpoints)-2], now) || checkpointDue(tiers, &checkpoint{Checkpoint: Checkpoint{Time: now.Add(-time.Second)}}, now.Add(-500*time.Millisecond)) {
+		t.Error("checkpointDue: a checkpoint is due once the shortest interval starts again, and only then")
+	}
+}
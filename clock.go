@@ -0,0 +1,41 @@
+package gopherdb
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// Clock tells the time, see Options.Clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// now returns the time of Options.Clock, or the system time without one.
+func (d *dal) now() time.Time {
+	if d.clock == nil {
+		return time.Now()
+	}
+	return d.clock.Now()
+}
+
+// readRandom fills buf with bytes from Options.Random, or from crypto/rand without one.
+func (d *dal) readRandom(buf []byte) error {
+	random := d.random
+	if random == nil {
+		random = rand.Reader
+	}
+	_, err := io.ReadFull(random, buf)
+	return err
+}
+
+// randomSeed returns a seed for math/rand read from Options.Random.
+func (d *dal) randomSeed() (int64, error) {
+	buf := make([]byte, 8)
+	err := d.readRandom(buf)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), nil
+}
@@ -0,0 +1,98 @@
+package gopherdb
+
+import (
+	"bytes"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is a clock moving only when the test advances it.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestClockExpiresSessions(t *testing.T) {
+	clock := &testClock{now: time.Unix(1000, 0)}
+	options := testOptions()
+	options.Clock = clock
+	db := openTestDB(t, options)
+	sessions := NewSessions(db, "sessions", time.Minute)
+	id := createSession(t, db, sessions, "data")
+
+	clock.advance(59 * time.Second)
+	if data := getSession(t, db, sessions, id); string(data) != "data" {
+		t.Fatalf("got %q before the TTL ran out", data)
+	}
+	clock.advance(time.Second)
+	if data := getSession(t, db, sessions, id); data != nil {
+		t.Fatalf("got %q once the TTL ran out", data)
+	}
+}
+
+// TestDeterministicFile checks that the same operations with the same clock and random bytes give the same file.
+func TestDeterministicFile(t *testing.T) {
+	build := func(path string) []byte {
+		clock := &testClock{now: time.Unix(1000, 0)}
+		options := testOptions()
+		options.Clock = clock
+		options.Random = rand.New(rand.NewSource(1))
+		options.StatsHistory = 10
+		options.Checkpoints = []CheckpointTier{{Every: time.Minute, For: time.Hour}}
+		db := openTestPath(t, path, options)
+		sessions := NewSessions(db, "sessions", time.Hour)
+		limiter := NewRateLimiter("limits")
+		locks := NewLocks("locks")
+		for i := 0; i < 50; i++ {
+			clock.advance(20 * time.Second)
+			mustUpdate(t, db, func(tx *Tx) error {
+				_, err := sessions.Create(tx, testKey(i))
+				if err != nil {
+					return err
+				}
+				_, err = limiter.TakeToken(tx, []byte("client"), 1, 10)
+				if err != nil {
+					return err
+				}
+				_, err = locks.Acquire(tx, []byte("leader"), []byte("worker"), time.Minute)
+				if err != nil {
+					return err
+				}
+				return getOrCreate(t, tx, "c").Put(testKey(i), []byte("value"))
+			})
+		}
+		var sampled [][]byte
+		mustView(t, db, func(tx *Tx) error {
+			var err error
+			sampled, err = getOrCreate(t, tx, "c").Sample(5)
+			return err
+		})
+		err := db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(bytes.Join(sampled, []byte(",")), readFile(t, path)...)
+	}
+
+	dir := t.TempDir()
+	first := build(filepath.Join(dir, "first.db"))
+	second := build(filepath.Join(dir, "second.db"))
+	if !bytes.Equal(first, second) {
+		t.Fatal("the same operations gave different files and samples")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	gopherdb "github.com/RohinJoshi1/GopherDB"
+)
+
+// command is a subcommand of the gopherdb binary.
+type command struct {
+	usage string
+	run   func(args []string, stdout io.Writer) error
+}
+
+var commands = map[string]command{
+	"compact": {
+		usage: "compact [--replace] <path> [<dst>]",
+		run:   runCompact,
+	},
+	"doctor": {
+		usage: "doctor [--format=text|json] <path>",
+		run:   runDoctor,
+	},
+	"export": {
+		usage: "export [--out=FILE] [--format=binary|jsonl] [--collection=NAME] <path>",
+		run:   runExport,
+	},
+	"import": {
+		usage: "import [--format=jsonl|bolt] <path> <file>",
+		run:   runImport,
+	},
+	"load": {
+		usage: "load --collection=NAME [--format=jsonl] [--key=FIELD] [--batch=1000] [--checkpoint=KEY] [--progress=1s] <path> <file>",
+		run:   runLoad,
+	},
+	"stats": {
+		usage: "stats [--format=text|json|prometheus] [--watch] [--interval=5s] [--history] [--since=24h] <path>",
+		run:   runStats,
+	},
+	"tree": {
+		usage: "tree [--format=text|dot] <path> [<collection>]",
+		run:   runTree,
+	},
+}
+
+var errUsage = errors.New("invalid usage")
+
+func printUsage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "usage: gopherdb <command> [arguments]")
+	fmt.Fprintln(w, "commands:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\n", commands[name].usage)
+	}
+}
+
+// runCommand runs the subcommand named by the first argument.
+func runCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n", args[0])
+		printUsage(stderr)
+		return 2
+	}
+
+	err := cmd.run(args[1:], stdout)
+	if errors.Is(err, errUsage) || errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintf(stderr, "usage: gopherdb %s\n", cmd.usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "gopherdb %s: %s\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// openExisting opens a database file for inspection, failing instead of creating it if it doesn't exist. The file is
+// opened read-only and without lock, so inspecting a database another process has open never writes to it, nor waits
+// for it.
+func openExisting(path string) (*gopherdb.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	options := *gopherdb.DefaultOptions
+	options.ReadOnly = true
+	options.NoLock = true
+	return gopherdb.Open(path, &options)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	gopherdb "github.com/RohinJoshi1/GopherDB"
+)
+
+// runCompact writes a compacted copy of a database file, see gopherdb.DB.Compact. With --replace, the copy replaces the
+// file once it's closed. The file is opened for writing then, so its lock keeps other processes from changing it
+// while it's copied.
+func runCompact(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("compact", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	replace := flags.Bool("replace", false, "replace the file with the compacted copy")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if (*replace && flags.NArg() != 1) || (!*replace && flags.NArg() != 2) {
+		return errUsage
+	}
+
+	path := flags.Arg(0)
+	dst := flags.Arg(1)
+	var db *gopherdb.DB
+	if *replace {
+		dst = path + ".compact"
+		_, err = os.Stat(path)
+		if err == nil {
+			db, err = gopherdb.Open(path, gopherdb.DefaultOptions)
+		}
+	} else {
+		db, err = openExisting(path)
+	}
+	if err != nil {
+		return err
+	}
+	before, err := fileSize(path)
+	if err != nil {
+		_ = db.Close()
+		return err
+	}
+	err = db.Compact(dst)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	after, err := fileSize(dst)
+	if err != nil {
+		return err
+	}
+	if *replace {
+		err = os.Rename(dst, path)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(stdout, "compacted %d bytes into %d bytes\n", before, after)
+	return nil
+}
+
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	gopherdb "github.com/RohinJoshi1/GopherDB"
+)
+
+// runDoctor prints the findings of gopherdb.Doctor, the most severe first. It fails when a finding is critical, so the
+// command can gate scripts.
+func runDoctor(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	format := flags.String("format", "text", "output format: text or json")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errUsage
+	}
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	options := *gopherdb.DefaultOptions
+	findings, err := gopherdb.Doctor(flags.Arg(0), &options)
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(findings)
+	} else {
+		writeFindingsText(stdout, findings)
+	}
+	if err != nil {
+		return err
+	}
+
+	critical := 0
+	for _, finding := range findings {
+		if finding.Severity == gopherdb.SeverityCritical {
+			critical++
+		}
+	}
+	if critical > 0 {
+		return fmt.Errorf("%d critical findings", critical)
+	}
+	return nil
+}
+
+func writeFindingsText(w io.Writer, findings []gopherdb.Finding) {
+	problems := 0
+	for _, finding := range findings {
+		if finding.Severity > gopherdb.SeverityInfo {
+			problems++
+		}
+		fmt.Fprintf(w, "%-8s  %-9s  %s\n", strings.ToUpper(finding.Severity.String()), finding.Check, finding.Message)
+		if finding.Action != "" {
+			fmt.Fprintf(w, "%-8s  %-9s  -> %s\n", "", "", finding.Action)
+		}
+	}
+	if problems == 0 {
+		fmt.Fprintln(w, "no problems found")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	gopherdb "github.com/RohinJoshi1/GopherDB"
+)
+
+// runExport writes the records of every collection as one globally ordered stream, see gopherdb.Tx.WriteExport, or as
+// JSON Lines, see gopherdb.Tx.ExportJSON.
+func runExport(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	out := flags.String("out", "", "file the export is written to instead of stdout")
+	format := flags.String("format", "binary", "output format: binary or jsonl")
+	collection := flags.String("collection", "", "collection exported alone, with --format=jsonl")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errUsage
+	}
+	if *format != "binary" && *format != "jsonl" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if *collection != "" && *format != "jsonl" {
+		return errUsage
+	}
+
+	db, err := openExisting(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	w := stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	return db.View(func(tx *gopherdb.Tx) error {
+		switch {
+		case *format == "binary":
+			return tx.WriteExport(w)
+		case *collection == "":
+			return tx.ExportJSON(w)
+		}
+		c, err := tx.GetCollection([]byte(*collection))
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			return fmt.Errorf("collection %q doesn't exist", *collection)
+		}
+		return c.ExportJSON(w)
+	})
+}
+
+// runImport puts the records of a JSON Lines export, or the buckets of a bolt file, into the database, creating it if
+// needed, see gopherdb.DB.ImportJSON and gopherdb.DB.ImportBolt.
+func runImport(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	format := flags.String("format", "jsonl", "input format: jsonl or bolt")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errUsage
+	}
+	if *format != "jsonl" && *format != "bolt" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	input, err := os.Open(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	db, err := gopherdb.Open(flags.Arg(0), gopherdb.DefaultOptions)
+	if err != nil {
+		return err
+	}
+	if *format == "bolt" {
+		err = db.ImportBolt(flags.Arg(1))
+	} else {
+		err = db.ImportJSON(input)
+	}
+	if err != nil {
+		_ = db.Close()
+		return err
+	}
+	return db.Close()
+}
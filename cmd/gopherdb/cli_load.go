@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	gopherdb "github.com/RohinJoshi1/GopherDB"
+)
+
+// runLoad streams the records of a JSON Lines file into a collection, a batch of records per transaction. Every record
+// is a JSON object stored as it is under the value of its key field. With a checkpoint key, every batch also stores
+// the number of lines loaded so far, so a load that was interrupted skips them when it's run again with the same key.
+func runLoad(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("load", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	collection := flags.String("collection", "", "collection the records are put in, created if needed")
+	format := flags.String("format", "jsonl", "input format: jsonl")
+	keyField := flags.String("key", "key", "field of the records holding their key")
+	batch := flags.Int("batch", 1000, "records per transaction")
+	checkpoint := flags.String("checkpoint", "", "key of the checkpoint the load resumes from")
+	progress := flags.Duration("progress", time.Second, "interval between progress lines, zero for none")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 2 || *collection == "" || *batch <= 0 {
+		return errUsage
+	}
+	if *format != "jsonl" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	input, err := os.Open(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	info, err := input.Stat()
+	if err != nil {
+		return err
+	}
+	db, err := gopherdb.Open(flags.Arg(0), gopherdb.DefaultOptions)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	l := &loader{db: db, collection: []byte(*collection), keyField: *keyField, checkpoint: []byte(*checkpoint),
+		reader: bufio.NewReader(input), total: info.Size(), start: time.Now()}
+	if *checkpoint != "" {
+		err = l.resume()
+		if err != nil {
+			return err
+		}
+	}
+	last := time.Now()
+	for {
+		done, err := l.loadBatch(*batch)
+		if err != nil {
+			return err
+		}
+		if done {
+			l.report(stdout)
+			return nil
+		}
+		if *progress > 0 && time.Since(last) >= *progress {
+			l.report(stdout)
+			last = time.Now()
+		}
+	}
+}
+
+// loader is the state of a load: the lines read from the input, and the ones loaded by the batches committed so far.
+type loader struct {
+	db         *gopherdb.DB
+	collection []byte
+	keyField   string
+	checkpoint []byte
+	reader     *bufio.Reader
+	// lines counts the lines read, read the bytes read, and total the size of the input. skipped is the number of
+	// lines a resumed load skipped, resumed the bytes they took, and records the records it put.
+	lines   int
+	read    int64
+	total   int64
+	skipped int
+	resumed int64
+	records int
+	start   time.Time
+}
+
+// resume skips the lines loaded by the earlier runs with the same checkpoint key.
+func (l *loader) resume() error {
+	var loaded uint64
+	err := l.db.View(func(tx *gopherdb.Tx) error {
+		var err error
+		loaded, err = tx.LoadCheckpoint(l.checkpoint)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for uint64(l.lines) < loaded {
+		_, err := l.readLine()
+		if err == io.EOF {
+			return fmt.Errorf("the checkpoint %q is at line %d, past the end of the input", l.checkpoint, loaded)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	l.skipped = int(loaded)
+	l.resumed = l.read
+	l.start = time.Now()
+	return nil
+}
+
+// readLine returns the next line of the input without its line break, or io.EOF once there's none left.
+func (l *loader) readLine() ([]byte, error) {
+	line, err := l.reader.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	l.lines++
+	l.read += int64(len(line))
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// loadBatch puts the records of the next lines, up to n of them, in a single transaction along with the checkpoint.
+// It reports whether the input is done.
+func (l *loader) loadBatch(n int) (bool, error) {
+	type record struct {
+		key   []byte
+		value []byte
+	}
+	var records []record
+	done := false
+	for len(records) < n {
+		line, err := l.readLine()
+		if err == io.EOF {
+			done = true
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		key, value, err := l.parse(line)
+		if err != nil {
+			return false, fmt.Errorf("line %d: %w", l.lines, err)
+		}
+		records = append(records, record{key, value})
+	}
+
+	err := l.db.Update(func(tx *gopherdb.Tx) error {
+		c, err := getOrCreateCollection(tx, l.collection)
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			err = c.Put(r.key, r.value)
+			if err != nil {
+				return fmt.Errorf("key %q: %w", r.key, err)
+			}
+		}
+		if len(l.checkpoint) == 0 {
+			return nil
+		}
+		return tx.SetLoadCheckpoint(l.checkpoint, uint64(l.lines))
+	})
+	if err != nil {
+		return false, err
+	}
+	l.records += len(records)
+	return done, nil
+}
+
+// parse returns the key and the value of a record: the value of its key field, as it is for strings and as JSON for
+// the other types, and the record itself, compacted.
+func (l *loader) parse(line []byte) ([]byte, []byte, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(line, &fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, ok := fields[l.keyField]
+	if !ok {
+		return nil, nil, fmt.Errorf("the record has no %q field", l.keyField)
+	}
+	var key []byte
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		key = []byte(s)
+	} else {
+		key = append([]byte{}, raw...)
+	}
+	var value bytes.Buffer
+	err = json.Compact(&value, line)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, value.Bytes(), nil
+}
+
+// report prints the progress of the load, with the time left estimated from the bytes loaded so far.
+func (l *loader) report(w io.Writer) {
+	elapsed := time.Since(l.start)
+	fmt.Fprintf(w, "%d records loaded", l.records)
+	if l.skipped > 0 {
+		fmt.Fprintf(w, " (%d lines skipped from the checkpoint)", l.skipped)
+	}
+	if l.total > 0 {
+		percent := float64(l.read) / float64(l.total) * 100
+		fmt.Fprintf(w, ", %.1f%% of the input", percent)
+		if loaded := l.read - l.resumed; l.read < l.total && loaded > 0 {
+			eta := time.Duration(float64(elapsed) * float64(l.total-l.read) / float64(loaded))
+			fmt.Fprintf(w, ", %s left", eta.Round(time.Second))
+		}
+	}
+	fmt.Fprintf(w, ", %s elapsed\n", elapsed.Round(time.Millisecond))
+}
+
+// getOrCreateCollection returns the collection, creating it if it doesn't exist.
+func getOrCreateCollection(tx *gopherdb.Tx, name []byte) (*gopherdb.Collection, error) {
+	c, err := tx.GetCollection(name)
+	if err != nil || c != nil {
+		return c, err
+	}
+	return tx.CreateCollection(name)
+}
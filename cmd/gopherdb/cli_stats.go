@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	gopherdb "github.com/RohinJoshi1/GopherDB"
+)
+
+func runStats(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	format := flags.String("format", "text", "output format: text, json or prometheus")
+	watch := flags.Bool("watch", false, "keep sampling the stats every interval")
+	interval := flags.Duration("interval", 5*time.Second, "sampling interval in watch mode")
+	history := flags.Bool("history", false, "print the stats history recorded by the commits instead")
+	since := flags.Duration("since", 24*time.Hour, "how far back the history goes")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errUsage
+	}
+	if *history {
+		return runStatsHistory(flags.Arg(0), *format, time.Now().Add(-*since), stdout)
+	}
+
+	var write func(io.Writer, *gopherdb.FileStats) error
+	switch *format {
+	case "text":
+		write = writeStatsText
+	case "json":
+		write = writeStatsJSON
+	case "prometheus":
+		write = writeStatsPrometheus
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	path := flags.Arg(0)
+	for {
+		stats, err := sampleFileStats(path)
+		if err != nil {
+			return err
+		}
+		err = write(stdout, stats)
+		if err != nil {
+			return err
+		}
+		if !*watch {
+			return nil
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// sampleFileStats opens the database, collects its stats and closes it again, so every sample in watch mode sees the
+// latest committed state of the file.
+func sampleFileStats(path string) (*gopherdb.FileStats, error) {
+	db, err := openExisting(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	tx, err := db.ReadTx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return tx.FileStats()
+}
+
+func writeStatsText(w io.Writer, stats *gopherdb.FileStats) error {
+	fmt.Fprintf(w, "sampled at:   %s\n", stats.SampledAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "file size:    %d bytes\n", stats.FileSize)
+	fmt.Fprintf(w, "page size:    %d bytes\n", stats.PageSize)
+	fmt.Fprintf(w, "pages:        %d (%d free)\n", stats.Pages, stats.FreePages)
+	fmt.Fprintf(w, "last tx id:   %d\n", stats.TxID)
+	fmt.Fprintf(w, "garbage:      %.1f%% of the node pages\n", stats.GarbageRatio*100)
+	fmt.Fprintf(w, "collections:  %d\n", len(stats.Collections))
+	for _, collection := range stats.Collections {
+		fmt.Fprintf(w, "  %s: %d keys, %d pages (%d garbage), %d overflow pages\n", collection.Name, collection.Keys,
+			collection.Pages, collection.GarbagePages, collection.OverflowPages)
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+func writeStatsJSON(w io.Writer, stats *gopherdb.FileStats) error {
+	return json.NewEncoder(w).Encode(stats)
+}
+
+func writeStatsPrometheus(w io.Writer, stats *gopherdb.FileStats) error {
+	gauge := func(name string, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+
+	gauge("gopherdb_file_size_bytes", "Size of the database file.")
+	fmt.Fprintf(w, "gopherdb_file_size_bytes %d\n", stats.FileSize)
+	gauge("gopherdb_page_size_bytes", "Size of a database page.")
+	fmt.Fprintf(w, "gopherdb_page_size_bytes %d\n", stats.PageSize)
+	gauge("gopherdb_pages", "Number of pages allocated in the file.")
+	fmt.Fprintf(w, "gopherdb_pages %d\n", stats.Pages)
+	gauge("gopherdb_free_pages", "Number of pages in the freelist.")
+	fmt.Fprintf(w, "gopherdb_free_pages %d\n", stats.FreePages)
+	gauge("gopherdb_last_txid", "Id of the last committed write transaction.")
+	fmt.Fprintf(w, "gopherdb_last_txid %d\n", stats.TxID)
+	gauge("gopherdb_garbage_ratio", "Share of the node pages compacting the collections would free.")
+	fmt.Fprintf(w, "gopherdb_garbage_ratio %g\n", stats.GarbageRatio)
+
+	gauge("gopherdb_collection_keys", "Number of keys in a collection.")
+	for _, collection := range stats.Collections {
+		fmt.Fprintf(w, "gopherdb_collection_keys{collection=%q} %d\n", collection.Name, collection.Keys)
+	}
+	gauge("gopherdb_collection_pages", "Number of node pages used by a collection.")
+	for _, collection := range stats.Collections {
+		fmt.Fprintf(w, "gopherdb_collection_pages{collection=%q} %d\n", collection.Name, collection.Pages)
+	}
+	gauge("gopherdb_collection_overflow_pages", "Number of overflow pages used by a collection.")
+	for _, collection := range stats.Collections {
+		fmt.Fprintf(w, "gopherdb_collection_overflow_pages{collection=%q} %d\n", collection.Name, collection.OverflowPages)
+	}
+	gauge("gopherdb_collection_garbage_pages", "Number of node pages compacting a collection would free.")
+	for _, collection := range stats.Collections {
+		fmt.Fprintf(w, "gopherdb_collection_garbage_pages{collection=%q} %d\n", collection.Name, collection.GarbagePages)
+	}
+	return nil
+}
+
+// runStatsHistory prints the records of the stats history committed after the given time, one commit per line.
+func runStatsHistory(path string, format string, after time.Time, stdout io.Writer) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("format %q isn't supported for the history", format)
+	}
+	db, err := openExisting(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.ReadTx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	records, err := tx.StatsHistory()
+	if err != nil {
+		return err
+	}
+	recent := []*gopherdb.StatsRecord{}
+	for _, record := range records {
+		if record.Time.After(after) {
+			recent = append(recent, record)
+		}
+	}
+
+	if format == "json" {
+		return json.NewEncoder(stdout).Encode(recent)
+	}
+	fmt.Fprintf(stdout, "%-25s %10s %10s %10s %8s %8s %12s %8s %8s %9s %6s\n", "time", "txid", "pages", "free",
+		"written", "freed", "latency", "splits", "merges", "rotations", "height")
+	for _, record := range recent {
+		latency := "-"
+		if record.CommitLatency > 0 {
+			latency = record.CommitLatency.String()
+		}
+		rebalance := record.Rebalance
+		height := int64(rebalance.RootSplits) - int64(rebalance.RootCollapses)
+		fmt.Fprintf(stdout, "%-25s %10d %10d %10d %8d %8d %12s %8d %8d %9d %+6d\n", record.Time.Format(time.RFC3339),
+			record.TxID, record.Pages, record.FreePages, record.DirtyPages, record.FreedPages, latency,
+			rebalance.Splits, rebalance.Merges, rebalance.Rotations, height)
+	}
+	return nil
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gopherdb "github.com/RohinJoshi1/GopherDB"
+)
+
+// createTestFile creates a database file with a collection of three keys, closed when it returns.
+func createTestFile(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := gopherdb.Open(path, gopherdb.DefaultOptions)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	err = db.Update(func(tx *gopherdb.Tx) error {
+		c, err := tx.CreateCollection([]byte("users"))
+		if err != nil {
+			return err
+		}
+		for _, key := range []string{"alice", "bob", "carol"} {
+			if err := c.Put([]byte(key), []byte("v")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return path
+}
+
+// run runs the command line and returns its exit code and output.
+func run(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := runCommand(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestStatsFormats(t *testing.T) {
+	path := createTestFile(t)
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, out, stderr := run(t, "stats", "--format=prometheus", path)
+	if code != 0 {
+		t.Fatalf("stats --format=prometheus: exit code %d: %s", code, stderr)
+	}
+	for _, line := range []string{
+		"# TYPE gopherdb_pages gauge",
+		`gopherdb_collection_keys{collection="users"} 3`,
+		`gopherdb_collection_garbage_pages{collection="users"} 0`,
+		"gopherdb_last_txid 1",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("prometheus output doesn't have %q:\n%s", line, out)
+		}
+	}
+
+	code, out, stderr = run(t, "stats", "--format=json", path)
+	if code != 0 {
+		t.Fatalf("stats --format=json: exit code %d: %s", code, stderr)
+	}
+	var stats gopherdb.FileStats
+	if err := json.Unmarshal([]byte(out), &stats); err != nil {
+		t.Fatalf("stats --format=json isn't JSON: %v\n%s", err, out)
+	}
+	if len(stats.Collections) != 1 || stats.Collections[0].Keys != 3 {
+		t.Errorf("stats --format=json: got %+v", stats)
+	}
+
+	code, out, _ = run(t, "stats", path)
+	if code != 0 || !strings.Contains(out, "users: 3 keys") {
+		t.Errorf("stats: exit code %d:\n%s", code, out)
+	}
+
+	// Sampling the stats never writes to the file
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after, before) {
+		t.Error("stats wrote to the file")
+	}
+}
+
+func TestStatsUsage(t *testing.T) {
+	if code, _, stderr := run(t, "stats"); code != 2 || !strings.Contains(stderr, "usage: gopherdb stats") {
+		t.Errorf("stats without a path: exit code %d: %s", code, stderr)
+	}
+	if code, _, _ := run(t, "stats", "--format=xml", createTestFile(t)); code != 1 {
+		t.Errorf("stats with an unknown format: exit code %d, want 1", code)
+	}
+	if code, _, _ := run(t, "stats", filepath.Join(t.TempDir(), "missing.db")); code != 1 {
+		t.Errorf("stats of a missing file: exit code %d, want 1", code)
+	}
+	if code, _, stderr := run(t, "unknown"); code != 2 || !strings.Contains(stderr, "unknown command") {
+		t.Errorf("unknown command: exit code %d: %s", code, stderr)
+	}
+}
+
+func TestStatsHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := *gopherdb.DefaultOptions
+	options.StatsHistory = 10
+	db, err := gopherdb.Open(path, &options)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for _, key := range []string{"alice", "bob", "carol"} {
+		err = db.Update(func(tx *gopherdb.Tx) error {
+			c, err := tx.GetCollection([]byte("users"))
+			if err == nil && c == nil {
+				c, err = tx.CreateCollection([]byte("users"))
+			}
+			if err != nil {
+				return err
+			}
+			return c.Put([]byte(key), []byte("v"))
+		})
+		if err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	code, out, stderr := run(t, "stats", "--history", "--format=json", path)
+	if code != 0 {
+		t.Fatalf("stats --history: exit code %d: %s", code, stderr)
+	}
+	var records []gopherdb.StatsRecord
+	if err := json.Unmarshal([]byte(out), &records); err != nil {
+		t.Fatalf("stats --history --format=json isn't JSON: %v\n%s", err, out)
+	}
+	if len(records) != 3 || records[0].TxID != 1 || records[2].TxID != 3 {
+		t.Errorf("stats --history: got %+v, want the records of txids 1 to 3", records)
+	}
+
+	code, out, _ = run(t, "stats", "--history", path)
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); code != 0 || len(lines) != 4 || !strings.HasPrefix(lines[0], "time") {
+		t.Errorf("stats --history: exit code %d:\n%s", code, out)
+	}
+	// Records older than --since are left out
+	code, out, _ = run(t, "stats", "--history", "--since=0s", "--format=json", path)
+	if code != 0 || strings.TrimSpace(out) != "[]" {
+		t.Errorf("stats --history --since=0s: exit code %d:\n%s", code, out)
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	path := createTestFile(t)
+	code, out, stderr := run(t, "doctor", path)
+	if code != 0 || !strings.HasSuffix(out, "no problems found\n") {
+		t.Errorf("doctor of a clean file: exit code %d: %s%s", code, out, stderr)
+	}
+
+	code, out, _ = run(t, "doctor", "--format=json", path)
+	var findings []struct{ Severity, Check, Message string }
+	if err := json.Unmarshal([]byte(out), &findings); code != 0 || err != nil || len(findings) == 0 || findings[0].Severity != "info" {
+		t.Errorf("doctor --format=json: exit code %d, %v:\n%s", code, err, out)
+	}
+
+	// A file cut short is critical, which fails the command
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data[:len(data)/2], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	code, out, stderr = run(t, "doctor", path)
+	if code != 1 || !strings.HasPrefix(out, "CRITICAL") || !strings.Contains(stderr, "critical findings") {
+		t.Errorf("doctor of a truncated file: exit code %d: %s%s", code, out, stderr)
+	}
+
+	if code, _, _ := run(t, "doctor", "--format=xml", path); code != 1 {
+		t.Errorf("doctor --format=xml: exit code %d, want 1", code)
+	}
+	if code, _, stderr := run(t, "doctor"); code != 2 || !strings.Contains(stderr, "usage: gopherdb doctor") {
+		t.Errorf("doctor without a path: exit code %d: %s", code, stderr)
+	}
+}
+
+// readCollection returns the keys and values of a collection of the file.
+func readCollection(t *testing.T, path string, name string) map[string]string {
+	t.Helper()
+	db, err := gopherdb.Open(path, gopherdb.DefaultOptions)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	entries := map[string]string{}
+	err = db.View(func(tx *gopherdb.Tx) error {
+		c, err := tx.GetCollection([]byte(name))
+		if err != nil || c == nil {
+			return err
+		}
+		cur := c.Cursor()
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			entries[string(k)] = string(v)
+		}
+		return cur.Err()
+	})
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+	return entries
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path, input := filepath.Join(dir, "test.db"), filepath.Join(dir, "users.jsonl")
+	lines := `{"id": "alice", "age": 31}
+{"id": 7, "name": "bob"}
+
+{"id": "carol", "tags": ["a", "b"]}
+`
+	if err := os.WriteFile(input, []byte(lines), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	code, out, stderr := run(t, "load", "--collection=users", "--key=id", "--batch=2", path, input)
+	if code != 0 {
+		t.Fatalf("load: exit code %d: %s", code, stderr)
+	}
+	if !strings.HasPrefix(out, "3 records loaded, 100.0% of the input") {
+		t.Errorf("load printed %q", out)
+	}
+	// String keys are stored as they are, other keys as JSON, and the records compacted
+	want := map[string]string{
+		"alice": `{"id":"alice","age":31}`,
+		"7":     `{"id":7,"name":"bob"}`,
+		"carol": `{"id":"carol","tags":["a","b"]}`,
+	}
+	entries := readCollection(t, path, "users")
+	for key, value := range want {
+		if entries[key] != value {
+			t.Errorf("%s is %q, want %q", key, entries[key], value)
+		}
+	}
+	if len(entries) != len(want) {
+		t.Errorf("the collection has %d keys, want %d", len(entries), len(want))
+	}
+
+	for _, args := range [][]string{
+		{"load", path, input},
+		{"load", "--collection=users", path},
+		{"load", "--collection=users", "--batch=0", path, input},
+	} {
+		if code, _, _ := run(t, args...); code != 2 {
+			t.Errorf("%v: exit code %d, want 2", args, code)
+		}
+	}
+	if code, _, _ := run(t, "load", "--collection=users", "--format=csv", path, input); code != 1 {
+		t.Errorf("load with an unknown format: exit code %d, want 1", code)
+	}
+	if code, _, stderr := run(t, "load", "--collection=users", path, input); code != 1 || !strings.Contains(stderr, `line 1: the record has no "key" field`) {
+		t.Errorf("load of records without the key field: exit code %d: %s", code, stderr)
+	}
+}
+
+func TestLoadResumesFromTheCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	path, input := filepath.Join(dir, "test.db"), filepath.Join(dir, "records.jsonl")
+	write := func(lines ...string) {
+		t.Helper()
+		if err := os.WriteFile(input, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The load stops at the broken fourth line, after the batch of the first two was committed
+	write(`{"key": "a"}`, `{"key": "b"}`, `{"key": "c"}`, `{"key": `, `{"key": "e"}`)
+	code, _, stderr := run(t, "load", "--collection=c", "--batch=2", "--checkpoint=import", path, input)
+	if code != 1 || !strings.Contains(stderr, "line 4") {
+		t.Fatalf("load of a broken line: exit code %d: %s", code, stderr)
+	}
+	if entries := readCollection(t, path, "c"); len(entries) != 2 {
+		t.Fatalf("the failed load left %d keys, want 2", len(entries))
+	}
+
+	// Once fixed, the load goes on from the third line, and running it again loads nothing
+	write(`{"key": "a", "run": 2}`, `{"key": "b", "run": 2}`, `{"key": "c"}`, `{"key": "d"}`, `{"key": "e"}`)
+	code, out, stderr := run(t, "load", "--collection=c", "--batch=2", "--checkpoint=import", path, input)
+	if code != 0 {
+		t.Fatalf("load: exit code %d: %s", code, stderr)
+	}
+	if !strings.HasPrefix(out, "3 records loaded (2 lines skipped from the checkpoint)") {
+		t.Errorf("the resumed load printed %q", out)
+	}
+	entries := readCollection(t, path, "c")
+	if len(entries) != 5 || entries["a"] != `{"key":"a"}` {
+		t.Errorf("the collection has %d keys and a=%q after resuming", len(entries), entries["a"])
+	}
+	code, out, _ = run(t, "load", "--collection=c", "--checkpoint=import", path, input)
+	if code != 0 || !strings.HasPrefix(out, "0 records loaded (5 lines skipped") {
+		t.Errorf("the finished load ran again: exit code %d: %q", code, out)
+	}
+	// Other checkpoint keys start over
+	code, out, _ = run(t, "load", "--collection=c", "--checkpoint=other", path, input)
+	if code != 0 || !strings.HasPrefix(out, "5 records loaded,") {
+		t.Errorf("a load with another checkpoint: exit code %d: %q", code, out)
+	}
+	if got := readCollection(t, path, "__gopherdb_load")["import"]; got != "5" {
+		t.Errorf("the checkpoint is %q, want 5", got)
+	}
+
+	db, err := gopherdb.Open(path, gopherdb.DefaultOptions)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	err = db.View(func(tx *gopherdb.Tx) error {
+		names, err := tx.ListCollections()
+		if err == nil && fmt.Sprintf("%s", names) != "[c]" {
+			t.Errorf("collections after the load: got %s, want [c] without the checkpoints", names)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	path := createTestFile(t)
+	dst := filepath.Join(filepath.Dir(path), "compacted.db")
+	code, out, stderr := run(t, "compact", path, dst)
+	if code != 0 {
+		t.Fatalf("compact: exit code %d: %s", code, stderr)
+	}
+	if !strings.HasPrefix(out, "compacted ") {
+		t.Errorf("compact printed %q", out)
+	}
+	if entries := readCollection(t, dst, "users"); len(entries) != 3 || entries["bob"] != "v" {
+		t.Errorf("the copy has %v", entries)
+	}
+	if code, _, _ := run(t, "compact", path, dst); code != 1 {
+		t.Errorf("compact to an existing file: exit code %d, want 1", code)
+	}
+
+	code, _, stderr = run(t, "compact", "--replace", path)
+	if code != 0 {
+		t.Fatalf("compact --replace: exit code %d: %s", code, stderr)
+	}
+	if entries := readCollection(t, path, "users"); len(entries) != 3 || entries["carol"] != "v" {
+		t.Errorf("the replaced file has %v", entries)
+	}
+	if _, err := os.Stat(path + ".compact"); !os.IsNotExist(err) {
+		t.Errorf("the copy is left next to the file: %v", err)
+	}
+
+	for _, args := range [][]string{
+		{"compact", path},
+		{"compact", "--replace", path, dst},
+	} {
+		if code, _, _ := run(t, args...); code != 2 {
+			t.Errorf("%v: exit code %d, want 2", args, code)
+		}
+	}
+	if code, _, _ := run(t, "compact", "--replace", filepath.Join(t.TempDir(), "missing.db")); code != 1 {
+		t.Errorf("compact --replace of a missing file: exit code %d, want 1", code)
+	}
+}
+
+func TestExportImportJSON(t *testing.T) {
+	path := createTestFile(t)
+	dir := filepath.Dir(path)
+	dump, copied := filepath.Join(dir, "users.jsonl"), filepath.Join(dir, "copy.db")
+	code, _, stderr := run(t, "export", "--format=jsonl", "--collection=users", "--out="+dump, path)
+	if code != 0 {
+		t.Fatalf("export --format=jsonl: exit code %d: %s", code, stderr)
+	}
+	code, _, stderr = run(t, "import", copied, dump)
+	if code != 0 {
+		t.Fatalf("import: exit code %d: %s", code, stderr)
+	}
+	if entries := readCollection(t, copied, "users"); len(entries) != 3 || entries["alice"] != "v" {
+		t.Errorf("the imported file has %v", entries)
+	}
+
+	code, out, _ := run(t, "export", "--format=jsonl", path)
+	if code != 0 || !strings.HasPrefix(out, `{"collection":"users","key":"alice","value":"v"}`+"\n") {
+		t.Errorf("export --format=jsonl: exit code %d: %q", code, out)
+	}
+	if code, _, _ := run(t, "export", "--collection=users", path); code != 2 {
+		t.Errorf("export --collection without --format=jsonl: exit code %d, want 2", code)
+	}
+	if code, _, _ := run(t, "export", "--format=jsonl", "--collection=missing", path); code != 1 {
+		t.Errorf("export of a missing collection: exit code %d, want 1", code)
+	}
+	if code, _, _ := run(t, "import", copied); code != 2 {
+		t.Errorf("import without a file: exit code %d, want 2", code)
+	}
+	if code, _, stderr := run(t, "import", "--format=bolt", copied, dump); code != 1 || !strings.Contains(stderr, "not a bolt database") {
+		t.Errorf("import of a JSON Lines file as bolt: exit code %d: %s", code, stderr)
+	}
+}
+
+func TestTree(t *testing.T) {
+	path := createTestFile(t)
+	code, out, stderr := run(t, "tree", path, "users")
+	if code != 0 {
+		t.Fatalf("tree: exit code %d: %s", code, stderr)
+	}
+	if !strings.HasPrefix(out, "page ") || !strings.Contains(out, `3 keys  ["alice" .. "carol"]`) {
+		t.Fatalf("got the tree:\n%s", out)
+	}
+	code, out, stderr = run(t, "tree", "--format=dot", path)
+	if code != 0 || !strings.HasPrefix(out, "digraph") || !strings.Contains(out, `\"users\"`) {
+		t.Fatalf("tree --format=dot of the root tree: exit code %d: %s%s", code, out, stderr)
+	}
+	if code, _, stderr := run(t, "tree", path, "missing"); code != 1 || !strings.Contains(stderr, "doesn't exist") {
+		t.Errorf("tree of a missing collection: exit code %d: %s", code, stderr)
+	}
+}
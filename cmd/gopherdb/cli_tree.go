@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+)
+
+// runTree prints the tree of a collection, or the root tree without one, as text or as a Graphviz graph, see
+// gopherdb.DB.DumpTree.
+func runTree(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("tree", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	format := flags.String("format", "text", "output format: text or dot")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 && flags.NArg() != 2 {
+		return errUsage
+	}
+	if *format != "text" && *format != "dot" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	db, err := openExisting(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var collection []byte
+	if flags.NArg() == 2 {
+		collection = []byte(flags.Arg(1))
+	}
+	if *format == "dot" {
+		return db.DumpTreeDot(collection, stdout)
+	}
+	return db.DumpTree(collection, stdout)
+}
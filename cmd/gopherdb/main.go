@@ -2,9 +2,16 @@ package main
 
 import (
 	"fmt"
+	"os"
+
+	gopherdb "github.com/RohinJoshi1/GopherDB"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
 	// options := &Options{
 	// 	pageSize:       os.Getpagesize(),
 	// 	MinFillPercent: 0.0125,
@@ -30,11 +37,14 @@ func main() {
 	// dal.writeFreelist()
 	// fmt.Printf("item = %+v\n", item)
 	// _ = dal.close()
-	db, _ := Open("Final", &Options{MinFillPercent: 0.5, MaxFillPercent: 1.0})
+	db, _ := gopherdb.Open("Final", &gopherdb.Options{MinFillPercent: 0.5, MaxFillPercent: 1.0})
 
-	tx := db.WriteTx()
+	tx, _ := db.WriteTx()
 	collectionName := "FinalCollection"
-	createdCollection, _ := tx.CreateCollection([]byte(collectionName))
+	createdCollection, _ := tx.GetCollection([]byte(collectionName))
+	if createdCollection == nil {
+		createdCollection, _ = tx.CreateCollection([]byte(collectionName))
+	}
 
 	newKey := []byte("key0")
 	newVal := []byte("value0")
@@ -43,15 +53,15 @@ func main() {
 	_ = tx.Commit()
 	_ = db.Close()
 
-	db, _ = Open("Final", &Options{MinFillPercent: 0.5, MaxFillPercent: 1.0})
-	tx = db.ReadTx()
+	db, _ = gopherdb.Open("Final", &gopherdb.Options{MinFillPercent: 0.5, MaxFillPercent: 1.0})
+	tx, _ = db.ReadTx()
 	createdCollection, _ = tx.GetCollection([]byte(collectionName))
 
-	item, _ := createdCollection.Find(newKey)
+	key, value := createdCollection.Cursor().Seek(newKey)
 
 	_ = tx.Commit()
 	_ = db.Close()
 
-	fmt.Printf("key is: %s, value is: %s\n", item.key, item.value)
+	fmt.Printf("key is: %s, value is: %s\n", key, value)
 
 }
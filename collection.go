@@ -1,15 +1,28 @@
-package main
+package gopherdb
 
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
 )
 
 type Collection struct {
 	name []byte
 	root pgnum
 	counter uint64
-	tx *tx
+	tx *Tx
+
+	// inlineValueThreshold overrides the database inline threshold for this collection when it isn't zero.
+	inlineValueThreshold int
+
+	// counters is nil for the root collection, which is internal and shouldn't show up in the access stats, and for
+	// nested collections.
+	counters *accessCounters
+
+	// parent is the collection a nested collection is an item of, nil for the root collection and the collections it
+	// holds, and children the nested collections opened through the handle, see nested.go.
+	parent   *Collection
+	children map[string]*Collection
 }
 
 func newCollection(name []byte, root pgnum) *Collection {
@@ -38,6 +51,8 @@ func (c *Collection) serialize() *Item{
 	leftPos+=pageNumSize
 	binary.LittleEndian.PutUint64(buffer[leftPos:], c.counter)
 	leftPos+=counterSize 
+	binary.LittleEndian.PutUint64(buffer[leftPos:], uint64(c.inlineValueThreshold))
+	leftPos+=counterSize
 	return newItem(c.name,buffer)
 }
 func (c *Collection) deserialize(item *Item){
@@ -48,30 +63,134 @@ func (c *Collection) deserialize(item *Item){
 		leftPos+=pageNumSize
 		c.counter = binary.LittleEndian.Uint64(item.value[leftPos:])
 		leftPos+=counterSize
+		// Collections written before the inline threshold existed don't have it
+		if len(item.value) >= leftPos+counterSize {
+			c.inlineValueThreshold = int(binary.LittleEndian.Uint64(item.value[leftPos:]))
+			leftPos+=counterSize
+		}
 	}
 }
 
-// Put adds a key to the tree. It finds the correct node and the insertion index and adds the item. When performing the
-// search, the ancestors are returned as well. This way we can iterate over them to check which nodes were modified and
-// rebalance by splitting them accordingly. If the root has too many items, then a new root of a new layer is
-// created and the created nodes from the split are added as children.
+// Put adds a key to the tree, or replaces its value if it already exists. Values above the inline threshold are stored
+// in overflow pages. The BeforePut triggers of the collection run first. Keys longer than DB.MaxKeySize fail with
+// ErrKeyTooLarge, and values longer than MaxValueSize with ErrValueTooLarge.
 func (c *Collection) Put(key []byte, value []byte) error {
 	if !c.tx.write{
-		return errWriteInsideReadTxErr
+		return ErrWriteInsideReadTx
+	}
+	return c.putValue(key, value, nil)
+}
+
+// putValue puts the key with the value behind an envelope holding the metadata, or without envelope if meta is nil.
+func (c *Collection) putValue(key []byte, value []byte, meta *ItemMeta) error {
+	// The root collection holds the collections themselves and has no triggers, like nested collections
+	if c.triggerName() == nil {
+		i, err := c.newItem(key, value)
+		if err != nil {
+			return err
+		}
+		return c.put(i)
+	}
+
+	triggers := c.tx.db.triggers
+	key, value, err := triggers.runBeforePut(c.tx, c.triggerName(), key, value)
+	if err != nil {
+		return err
+	}
+	var old *Item
+	if triggers.hasChangeHooks(c.triggerName()) {
+		// Change hooks tell removed keys apart by their nil value
+		if value == nil {
+			value = []byte{}
+		}
+		old, err = c.Find(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	storedKey, storedValue := c.storedItem(key, value)
+	if meta != nil {
+		storedValue = encodeEnvelope(meta, storedValue)
+	}
+	i, err := c.newItem(storedKey, storedValue)
+	if err != nil {
+		return err
+	}
+	i.envelope = meta != nil
+	err = c.put(i)
+	if err != nil || !triggers.hasChangeHooks(c.triggerName()) {
+		return err
+	}
+	var oldValue []byte
+	if old != nil {
+		oldValue = old.value
+	}
+	return triggers.runChangeHooks(c.tx, c.triggerName(), key, oldValue, value)
+}
+
+// PutFrom adds a key whose value is read from r, which must provide exactly size bytes. Values above the inline
+// threshold are streamed into overflow pages without being held in memory as a whole, unless the collection has
+// BeforePut triggers, views or a key transform, which need the whole value.
+func (c *Collection) PutFrom(key []byte, r io.Reader, size int64) error {
+	if !c.tx.write {
+		return ErrWriteInsideReadTx
+	}
+	if size < 0 {
+		return ErrValueTooLarge
+	}
+	err := c.tx.db.checkItemSize(key, uint64(size))
+	if err != nil {
+		return err
+	}
+	if c.tx.db.triggers.needsValue(c.triggerName()) {
+		// The value is read as it comes instead of allocated at the size r claims, which it may not provide
+		value, err := io.ReadAll(io.LimitReader(r, size))
+		if err != nil {
+			return err
+		}
+		if int64(len(value)) < size {
+			return io.ErrUnexpectedEOF
+		}
+		return c.Put(key, value)
+	}
+	if c.storesInline(key, int(size)) {
+		value := make([]byte, size)
+		_, err := io.ReadFull(r, value)
+		if err != nil {
+			return err
+		}
+		return c.put(newItem(key, value))
+	}
+
+	i, err := c.newOverflowItem(key, r, uint64(size))
+	if err != nil {
+		return err
 	}
-	i := newItem(key, value)
+	return c.put(i)
+}
+
+// put adds a key to the tree. It finds the correct node and the insertion index and adds the item. When performing the
+// search, the ancestors are returned as well. This way we can iterate over them to check which nodes were modified and
+// rebalance by splitting them accordingly. If the root has too many items, then a new root of a new layer is
+// created and the created nodes from the split are added as children.
+func (c *Collection) put(i *Item) error {
+	return c.addContext(c.insert(i), "put", i.key)
+}
+
+// insert adds the item to the tree, see put.
+func (c *Collection) insert(i *Item) error {
+	c.countWrite()
+	c.recordWrite(i.key)
+	key := i.key
 
 	// On first insertion the root node does not exist, so it should be created
 	var root *Node
 	var err error
 	if c.root == 0 {
-		// root, err = c.tx.writeNode(c.tx.newNode([]*Item{i}, []pgnum{}))
 		root = c.tx.writeNode(c.tx.newNode([]*Item{i}, []pgnum{}))
-		if err != nil {
-			return nil
-		}
 		c.root = root.pageNum
-		return nil
+		return c.save()
 	} else {
 		root, err = c.tx.getNode(c.root)
 		if err != nil {
@@ -87,6 +206,13 @@ func (c *Collection) Put(key []byte, value []byte) error {
 
 	// If key already exists
 	if nodeToInsertIn.items != nil && insertionIndex < len(nodeToInsertIn.items) && bytes.Equal(nodeToInsertIn.items[insertionIndex].key, key) {
+		if nodeToInsertIn.items[insertionIndex].collection != i.collection {
+			return ErrIncompatibleValue
+		}
+		err = c.freeItem(nodeToInsertIn.items[insertionIndex])
+		if err != nil {
+			return err
+		}
 		nodeToInsertIn.items[insertionIndex] = i
 	} else {
 		// Add item to the leaf node
@@ -94,6 +220,12 @@ func (c *Collection) Put(key []byte, value []byte) error {
 	}
 	nodeToInsertIn.writeNode(nodeToInsertIn)
 
+	return c.rebalance(ancestorsIndexes)
+}
+
+// rebalance splits the overpopulated nodes on the path of an insertion, from the node the item was added to up to the
+// root.
+func (c *Collection) rebalance(ancestorsIndexes []int) error {
 	ancestors, err := c.getNodes(ancestorsIndexes)
 	if err != nil {
 		return err
@@ -112,23 +244,138 @@ func (c *Collection) Put(key []byte, value []byte) error {
 	// Handle root
 	rootNode := ancestors[0]
 	if rootNode.isOverPopulated() {
-		newRoot := c.tx.newNode([]*Item{}, []pgnum{rootNode.pageNum})
-		newRoot.split(rootNode, 0)
+		return c.splitRoot(rootNode)
+	}
 
-		// commit newly created root
-		newRoot = c.tx.writeNode(newRoot)
-		if err != nil {
-			return err
-		}
+	return nil
+}
+
+// splitRoot splits an overpopulated root into two nodes under a new root, which adds a layer to the tree.
+func (c *Collection) splitRoot(rootNode *Node) error {
+	newRoot := c.tx.newNode([]*Item{}, []pgnum{rootNode.pageNum})
+	newRoot.split(rootNode, 0)
+	c.tx.rebalance.RootSplits++
 
-		c.root = newRoot.pageNum
+	// commit newly created root
+	newRoot = c.tx.writeNode(newRoot)
+	c.root = newRoot.pageNum
+	return c.save()
+}
+
+// save records the collection in the root collection, or in its parent for nested collections, which has to happen
+// whenever its root changes. The root of the root collection itself is kept by the transaction and written to the meta
+// page on Commit.
+func (c *Collection) save() error {
+	if c.name == nil {
+		c.tx.root = c.root
+		return nil
 	}
+	if c.parent != nil {
+		return c.parent.put(c.header())
+	}
+	return c.tx.getRootCollection().Put(c.name, c.serialize().value)
+}
 
-	return nil
+// Merge atomically replaces the value of the key with the one returned by fn, which receives the current value or nil
+// if the key doesn't exist. Returning a nil value removes the key. Write transactions are serialized, so no other write
+// can happen between reading the current value and writing the new one.
+func (c *Collection) Merge(key []byte, fn func(current []byte) ([]byte, error)) error {
+	if !c.tx.write {
+		return ErrWriteInsideReadTx
+	}
+	item, err := c.Find(key)
+	if err != nil {
+		return err
+	}
+	var current []byte
+	if item != nil {
+		current = item.value
+	}
+
+	value, err := fn(current)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		if item == nil {
+			return nil
+		}
+		return c.Remove(key)
+	}
+	return c.Put(key, value)
 }
 
 // Find Returns an item according based on the given key by performing a binary search.
 func (c *Collection) Find(key []byte) (*Item, error) {
+	item, err := c.findItem(c.storedKey(key))
+	if err != nil || item == nil {
+		return nil, c.addContext(err, "find", key)
+	}
+	item, err = c.resolveItem(item)
+	return item, c.addContext(err, "find", key)
+}
+
+// Get returns a copy of the value of the key, or ErrKeyNotFound if the key doesn't exist. Unlike the item returned by
+// Find, the copy stays valid and can be modified after the transaction ends.
+func (c *Collection) Get(key []byte) ([]byte, error) {
+	item, err := c.Find(key)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte{}, item.value...), nil
+}
+
+// NewValueReader returns a reader over the value of the key. Values stored in overflow pages are read one page at a
+// time, so big values can be consumed without loading them fully in memory. The reader must be consumed before the
+// transaction ends.
+func (c *Collection) NewValueReader(key []byte) (io.ReadCloser, error) {
+	// The value is behind the envelope of the original key, which is simpler to strip from the whole value
+	if transform := c.tx.db.triggers.keyTransform(c.triggerName()); transform != nil && transform.KeepOriginal {
+		item, err := c.Find(key)
+		if err != nil {
+			return nil, err
+		}
+		if item == nil {
+			return nil, ErrKeyNotFound
+		}
+		return io.NopCloser(bytes.NewReader(item.value)), nil
+	}
+	item, err := c.findItem(c.storedKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, ErrKeyNotFound
+	}
+	var r io.ReadCloser = io.NopCloser(bytes.NewReader(item.value))
+	if item.overflow {
+		r = newOverflowReader(c.tx, deserializeOverflowRef(item.value))
+	}
+	if item.envelope {
+		err = skipEnvelope(r)
+		if err != nil {
+			_ = r.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// findItem returns the item as it's stored in the tree, without resolving overflow values. Nested collections aren't
+// values, so they aren't found.
+func (c *Collection) findItem(key []byte) (*Item, error) {
+	item, err := c.findStored(key)
+	if item != nil && item.collection {
+		return nil, nil
+	}
+	return item, err
+}
+
+// findStored returns the item as it's stored in the tree, nested collections included.
+func (c *Collection) findStored(key []byte) (*Item, error) {
 	n, err := c.tx.getNode(c.root)
 	if err != nil {
 		return nil, err
@@ -138,6 +385,7 @@ func (c *Collection) Find(key []byte) (*Item, error) {
 	if err != nil {
 		return nil, err
 	}
+	c.countRead(index != -1)
 	if index == -1 {
 		return nil, nil
 	}
@@ -170,10 +418,42 @@ func (c *Collection) getNodes(indexes []int) ([]*Node, error) {
 	}
 	return nodes, nil
 }
+// Remove removes the key from the tree. The BeforeDelete triggers of the collection run first.
 func (c *Collection) Remove(key []byte) error {
 	if !c.tx.write{
-		return errWriteInsideReadTxErr
+		return ErrWriteInsideReadTx
 	}
+	if c.triggerName() != nil {
+		triggers := c.tx.db.triggers
+		key, err := triggers.runBeforeDelete(c.tx, c.name, key)
+		if err != nil {
+			return err
+		}
+		if triggers.hasChangeHooks(c.name) {
+			old, err := c.Find(key)
+			if err != nil || old == nil {
+				return err
+			}
+			err = c.remove(c.storedKey(key))
+			if err != nil {
+				return err
+			}
+			return triggers.runChangeHooks(c.tx, c.name, key, old.value, nil)
+		}
+		return c.remove(c.storedKey(key))
+	}
+	return c.remove(key)
+}
+
+func (c *Collection) remove(key []byte) error {
+	return c.addContext(c.removeKey(key, false), "remove", key)
+}
+
+// removeKey removes the key from the tree, see remove. collection tells whether the key is a nested collection, which
+// only DeleteCollection removes, or a value.
+func (c *Collection) removeKey(key []byte, collection bool) error {
+	c.countWrite()
+	c.recordWrite(key)
 	// Find the path to the node where the deletion should happen
 	rootNode, err := c.tx.getNode(c.root)
 	if err != nil {
@@ -188,6 +468,14 @@ func (c *Collection) Remove(key []byte) error {
 	if removeItemIndex == -1 {
 		return nil
 	}
+	if nodeToRemoveFrom.items[removeItemIndex].collection != collection {
+		return ErrIncompatibleValue
+	}
+
+	err = c.freeItem(nodeToRemoveFrom.items[removeItemIndex])
+	if err != nil {
+		return err
+	}
 
 	if nodeToRemoveFrom.isLeaf() {
 		nodeToRemoveFrom.removeItemFromLeaf(removeItemIndex)
@@ -205,10 +493,14 @@ func (c *Collection) Remove(key []byte) error {
 	}
 
 	// Rebalance the nodes all the way up. Start From one node before the last and go all the way up. Exclude root.
+	// Replacing an item with its predecessor and rotating items through a parent can make a node bigger, so
+	// overpopulated nodes are split like they are on insertion.
 	for i := len(ancestors) - 2; i >= 0; i-- {
 		pnode := ancestors[i]
 		node := ancestors[i+1]
-		if node.isUnderPopulated() {
+		if node.isOverPopulated() {
+			pnode.split(node, ancestorsIndexes[i+1])
+		} else if node.isUnderPopulated() {
 			err = pnode.rebalanceRemove(node, ancestorsIndexes[i+1])
 			if err != nil {
 				return err
@@ -217,9 +509,15 @@ func (c *Collection) Remove(key []byte) error {
 	}
 
 	rootNode = ancestors[0]
-	// If the root has no items after rebalancing, there's no need to save it because we ignore it.
+	if rootNode.isOverPopulated() {
+		return c.splitRoot(rootNode)
+	}
+	// If the root has no items after rebalancing, its only child becomes the new root and the old root is freed.
 	if len(rootNode.items) == 0 && len(rootNode.childNodes) > 0 {
-		c.root = ancestors[1].pageNum
+		c.root = rootNode.childNodes[0]
+		c.tx.deleteNode(rootNode)
+		c.tx.rebalance.RootCollapses++
+		return c.save()
 	}
 
 	return nil
@@ -0,0 +1,185 @@
+package gopherdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPutFromRejectsBadSizesBeforeReading(t *testing.T) {
+	db := openTestDB(t, nil)
+	db.BeforePut([]byte("c"), func(tx *Tx, key []byte, value []byte) ([]byte, []byte, error) {
+		return key, value, nil
+	})
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		if err := c.PutFrom([]byte("k"), strings.NewReader("v"), -1); !errors.Is(err, ErrValueTooLarge) {
+			t.Errorf("PutFrom with size -1: got %v, want ErrValueTooLarge", err)
+		}
+		if err := c.PutFrom([]byte("k"), strings.NewReader("v"), MaxValueSize+1); !errors.Is(err, ErrValueTooLarge) {
+			t.Errorf("PutFrom above MaxValueSize: got %v, want ErrValueTooLarge", err)
+		}
+		// A reader providing less than it claims fails without the value being allocated at the claimed size
+		if err := c.PutFrom([]byte("k"), strings.NewReader("v"), MaxValueSize); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("PutFrom of a short reader: got %v, want io.ErrUnexpectedEOF", err)
+		}
+		return nil
+	})
+}
+
+func TestPutFromWithTrigger(t *testing.T) {
+	db := openTestDB(t, nil)
+	db.BeforePut([]byte("c"), func(tx *Tx, key []byte, value []byte) ([]byte, []byte, error) {
+		return key, bytes.ToUpper(value), nil
+	})
+	value := strings.Repeat("v", 3000)
+	mustUpdate(t, db, func(tx *Tx) error {
+		return getOrCreate(t, tx, "c").PutFrom([]byte("k"), strings.NewReader(value), int64(len(value)))
+	})
+	mustView(t, db, func(tx *Tx) error {
+		got, err := getOrCreate(t, tx, "c").Get([]byte("k"))
+		if err != nil {
+			return err
+		}
+		if string(got) != strings.ToUpper(value) {
+			t.Errorf("got a value of %d bytes, want the %d bytes put by the trigger", len(got), len(value))
+		}
+		return nil
+	})
+}
+
+func TestRootChangesSurviveReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	db := openTestPath(t, path, options)
+	// Enough collections to split the root collection, each with enough keys to split its own root
+	mustUpdate(t, db, func(tx *Tx) error {
+		for i := 0; i < 60; i++ {
+			c := getOrCreate(t, tx, fmt.Sprintf("collection%03d", i))
+			for j := 0; j < 50; j++ {
+				if err := c.Put(testKey(j), testKey(i)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	db = openTestPath(t, path, options)
+	mustView(t, db, func(tx *Tx) error {
+		if height := treeHeight(t, tx, tx.getRootCollection().root); height < 2 {
+			t.Errorf("the root collection has a tree of height %d, want at least 2", height)
+		}
+		for i := 0; i < 60; i++ {
+			c, err := tx.GetCollection([]byte(fmt.Sprintf("collection%03d", i)))
+			if err != nil {
+				return err
+			}
+			if c == nil {
+				t.Fatalf("collection%03d is missing after reopening", i)
+			}
+			expected := map[string][]byte{}
+			for j := 0; j < 50; j++ {
+				expected[string(testKey(j))] = testKey(i)
+			}
+			if height := checkTree(t, c, expected); height < 2 {
+				t.Errorf("collection%03d has a tree of height %d, want at least 2", i, height)
+			}
+		}
+		return nil
+	})
+}
+
+func TestMerge(t *testing.T) {
+	db := openTestDB(t, nil)
+	appendValue := func(suffix string) func(current []byte) ([]byte, error) {
+		return func(current []byte) ([]byte, error) {
+			return append(append([]byte{}, current...), suffix...), nil
+		}
+	}
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		if err := c.Merge([]byte("k"), appendValue("a")); err != nil {
+			return err
+		}
+		return c.Merge([]byte("k"), appendValue("b"))
+	})
+	if value := getValue(t, db, "c", "k"); value != "ab" {
+		t.Errorf("after two merges: got %q, want ab", value)
+	}
+
+	failure := errors.New("failure")
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		err := c.Merge([]byte("k"), func(current []byte) ([]byte, error) {
+			return []byte("lost"), failure
+		})
+		if !errors.Is(err, failure) {
+			t.Errorf("Merge with a failing function: got %v, want its error", err)
+		}
+		// A nil value removes the key, and is a no-op for a missing key
+		if err := c.Merge([]byte("missing"), func([]byte) ([]byte, error) { return nil, nil }); err != nil {
+			return err
+		}
+		return c.Merge([]byte("k"), func([]byte) ([]byte, error) { return nil, nil })
+	})
+	if value := getValue(t, db, "c", "k"); value != "" {
+		t.Errorf("after merging a nil value: got %q, want the key removed", value)
+	}
+	mustView(t, db, func(tx *Tx) error {
+		if err := getOrCreate(t, tx, "c").Merge([]byte("k"), appendValue("a")); !errors.Is(err, ErrWriteInsideReadTx) {
+			t.Errorf("Merge in a read transaction: got %v, want ErrWriteInsideReadTx", err)
+		}
+		return nil
+	})
+}
+
+func TestGetReturnsACopy(t *testing.T) {
+	db := openTestDB(t, nil)
+	big := strings.Repeat("v", 3000)
+	putValue(t, db, "c", "small", "value")
+	putValue(t, db, "c", "big", big)
+	putValue(t, db, "c", "empty", "")
+
+	var values [][]byte
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		// The nodes written by the transaction are the ones Find reads from
+		if err := c.Put([]byte("small"), []byte("value")); err != nil {
+			return err
+		}
+		for _, key := range []string{"small", "big"} {
+			value, err := c.Get([]byte(key))
+			if err != nil {
+				return err
+			}
+			values = append(values, value)
+			// Modifying the copy leaves the node the value was read from untouched
+			value[0] = 'x'
+			if item, err := c.Find([]byte(key)); err != nil || item.value[0] != 'v' {
+				t.Errorf("modifying the value of %s returned by Get changed the value found by Find", key)
+			}
+		}
+		if value, err := c.Get([]byte("empty")); err != nil || len(value) != 0 {
+			t.Errorf("Get(empty): got %q, %v, want an empty value", value, err)
+		}
+		if value, err := c.Get([]byte("missing")); !errors.Is(err, ErrKeyNotFound) || value != nil {
+			t.Errorf("Get of a missing key: got %q, %v, want ErrKeyNotFound", value, err)
+		}
+		return nil
+	})
+
+	// The copies are still valid once the transaction ended and the pages were written again
+	putValue(t, db, "c", "small", "other")
+	putValue(t, db, "c", "big", strings.Repeat("o", 3000))
+	if string(values[0]) != "xalue" || string(values[1]) != "x"+big[1:] {
+		t.Errorf("the values returned by Get changed after the transaction ended")
+	}
+}
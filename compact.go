@@ -0,0 +1,215 @@
+package gopherdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Compact rewrites the tree of the collection into freshly packed nodes and frees the old ones, without touching the
+// rest of the file. Nodes are filled up to MaxFillPercent in key order, so a collection left sparse by removals ends up
+// in as few pages as it needs. Values in overflow pages stay where they are.
+//
+// The old pages are freed on Commit, so the file grows by the size of the new tree before they can be reused.
+func (c *Collection) Compact() error {
+	if !c.tx.write {
+		return ErrWriteInsideReadTx
+	}
+
+	var items []*Item
+	err := c.tx.rangeStored(c.root, KeyRange{}, func(item *Item) (bool, error) {
+		items = append(items, item)
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	err = c.tx.walk(c.root, func(n *Node) error {
+		c.tx.deleteNode(n)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	pages, separators := c.packLevel(items, nil)
+	for len(pages) > 1 {
+		pages, separators = c.packLevel(separators, pages)
+	}
+	c.root = pages[0]
+	return c.save()
+}
+
+// packLevel builds one level of the tree, from the leaves up. For the leaf level children is nil; for the levels above,
+// items are the separators between the children. Every node is filled until the next item would make it overpopulated,
+// and that item moves up a level as the separator between the node and the next one. It returns the pages of the level
+// and the separators for the level above.
+func (c *Collection) packLevel(items []*Item, children []pgnum) ([]pgnum, []*Item) {
+	var pages []pgnum
+	var separators []*Item
+
+	newNode := func(first int) *Node {
+		if children == nil {
+			return NewNodeForSerialization([]*Item{}, []pgnum{})
+		}
+		return NewNodeForSerialization([]*Item{}, []pgnum{children[first]})
+	}
+	flush := func(node *Node) {
+		node = c.tx.writeNode(c.tx.newNode(node.items, node.childNodes))
+		pages = append(pages, node.pageNum)
+	}
+
+	node := newNode(0)
+	for i, item := range items {
+		node.items = append(node.items, item)
+		if children != nil {
+			node.childNodes = append(node.childNodes, children[i+1])
+		}
+		// The last item always stays, so the level doesn't end with an empty node, as long as it fits in the page
+		last := i == len(items)-1 && node.nodeSize() <= c.tx.db.pageSize
+		if len(node.items) == 1 || !c.tx.db.isOverPopulated(node) || last {
+			continue
+		}
+
+		node.items = node.items[:len(node.items)-1]
+		if children != nil {
+			node.childNodes = node.childNodes[:len(node.childNodes)-1]
+		}
+		flush(node)
+		separators = append(separators, item)
+		node = newNode(i + 1)
+	}
+	flush(node)
+	return pages, separators
+}
+
+// Compact writes a copy of the database to a new file at path, with every tree packed into as few pages as it needs
+// and no free page, so the copy takes the space of the data and nothing more. It reads the last commit in a read
+// transaction, so write transactions keep running, and their changes aren't in the copy. Items are copied as they're
+// stored, so key transforms, envelopes and inline thresholds carry over, and values go back to overflow pages as
+// needed. Pages of the embedder and the checkpoints of Options.Checkpoints, which point to pages of this file, aren't
+// copied. The copy has the page size of the database, and Compact fails with os.ErrExist if path exists.
+//
+// Like Collection.Compact, every collection is rebuilt in memory and committed to the copy on its own. Replacing the
+// file with the copy has to wait for the file to be closed, see the compact command.
+func (db *DB) Compact(path string) error {
+	_, err := os.Stat(path)
+	if err == nil {
+		return fmt.Errorf("%s: %w", path, os.ErrExist)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	tx, err := db.ReadTx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	options := *DefaultOptions
+	options.pageSize = db.pageSize
+	options.MinFillPercent = db.minFillPercent
+	options.MaxFillPercent = db.maxFillPercent
+	options.InlineValueThreshold = db.inlineValueThreshold
+	dst, err := Open(path, &options)
+	if err != nil {
+		return err
+	}
+	err = tx.compactInto(dst)
+	if err == nil {
+		err = dst.Close()
+	} else {
+		_ = dst.Close()
+	}
+	if err != nil {
+		_ = os.Remove(path)
+	}
+	return err
+}
+
+// compactInto copies the collections of the transaction into dst, one write transaction per collection.
+func (tx *Tx) compactInto(dst *DB) error {
+	collections, err := tx.allCollections()
+	if err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		if bytes.Equal(collection.name, checkpointsCollection) {
+			continue
+		}
+		err = dst.Update(func(dtx *Tx) error {
+			return collection.copyInto(dtx)
+		})
+		if err != nil {
+			return fmt.Errorf("collection %q: %w", collection.name, err)
+		}
+	}
+	return nil
+}
+
+// copyInto creates the collection in the transaction of another file, with the items it stores packed like Compact
+// does.
+func (c *Collection) copyInto(dtx *Tx) error {
+	copied := c.copyHeader(dtx)
+	root, err := c.copyTree(copied)
+	if err != nil {
+		return err
+	}
+	copied.root = root
+	_, err = dtx._createCollection(copied)
+	return err
+}
+
+// copyHeader returns an empty collection of the transaction of another file, with the name and settings of c.
+func (c *Collection) copyHeader(dtx *Tx) *Collection {
+	copied := newEmptyCollection()
+	copied.name = c.name
+	copied.counter = c.counter
+	copied.inlineValueThreshold = c.inlineValueThreshold
+	copied.tx = dtx
+	return copied
+}
+
+// copyTree writes the items of c to packed nodes of the transaction of copied, copying the collections nested in c
+// along, and returns the root of the new tree.
+func (c *Collection) copyTree(copied *Collection) (pgnum, error) {
+	var items []*Item
+	err := c.tx.rangeStored(c.root, KeyRange{}, func(item *Item) (bool, error) {
+		if item.collection {
+			nested := c.nested(item)
+			nestedCopy := nested.copyHeader(copied.tx)
+			root, err := nested.copyTree(nestedCopy)
+			if err != nil {
+				return false, err
+			}
+			nestedCopy.root = root
+			items = append(items, nestedCopy.header())
+			return true, nil
+		}
+		if !item.overflow {
+			items = append(items, item)
+			return true, nil
+		}
+		value, err := c.tx.readOverflow(deserializeOverflowRef(item.value))
+		if err != nil {
+			return false, err
+		}
+		stored, err := copied.newItem(item.key, value)
+		if err != nil {
+			return false, err
+		}
+		stored.envelope = item.envelope
+		items = append(items, stored)
+		return true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	pages, separators := copied.packLevel(items, nil)
+	for len(pages) > 1 {
+		pages, separators = copied.packLevel(separators, pages)
+	}
+	return pages[0], nil
+}
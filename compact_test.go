@@ -0,0 +1,140 @@
+package gopherdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompactFreesMorePagesThanTheFreelistPageHolds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	db := openTestPath(t, path, options)
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i := 0; i < 3000; i++ {
+			if err := c.Put([]byte(fmt.Sprintf("key%05d", i)), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i := 0; i < 3000; i++ {
+			if i%10 != 0 {
+				if err := c.Remove([]byte(fmt.Sprintf("key%05d", i))); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	mustUpdate(t, db, func(tx *Tx) error { return getOrCreate(t, tx, "c").Compact() })
+	for i := 0; i < 3000; i += 10 {
+		if got := getValue(t, db, "c", fmt.Sprintf("key%05d", i)); got != "value" {
+			t.Fatalf("key%05d after Compact: got %q, want value", i, got)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	checkFile(t, path, options)
+}
+
+func TestDBCompactWritesAPackedCopy(t *testing.T) {
+	dir := t.TempDir()
+	options := testOptions()
+	options.Checkpoints = []CheckpointTier{{Every: time.Hour, For: time.Hour}}
+	db := openTestPath(t, filepath.Join(dir, "test.db"), options)
+	large := bytes.Repeat([]byte("x"), 3*options.pageSize)
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i := 0; i < 500; i++ {
+			if err := c.Put(testKey(i), []byte("value")); err != nil {
+				return err
+			}
+		}
+		if err := c.SetInlineThreshold(16); err != nil {
+			return err
+		}
+		if err := c.Put([]byte("large"), large); err != nil {
+			return err
+		}
+		return c.PutWithMeta([]byte("meta"), large, ItemMeta{Flags: 7})
+	})
+	putValue(t, db, "empty", "k", "v")
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i := 0; i < 500; i++ {
+			if i%10 != 0 {
+				if err := c.Remove(testKey(i)); err != nil {
+					return err
+				}
+			}
+		}
+		return getOrCreate(t, tx, "empty").Remove([]byte("k"))
+	})
+
+	// Writes keep running while the copy reads the last commit
+	path := filepath.Join(dir, "compacted.db")
+	err := db.Compact(path)
+	if err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if err := db.Compact(path); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("Compact to an existing file: got %v, want os.ErrExist", err)
+	}
+	putValue(t, db, "c", "late", "v")
+
+	checkFile(t, path, testOptions())
+	copied := openTestPath(t, path, testOptions())
+	var want, got []string
+	export := func(db *DB, records *[]string) {
+		mustView(t, db, func(tx *Tx) error {
+			return tx.Export(func(collection []byte, key []byte, value []byte) error {
+				if string(key) != "late" {
+					*records = append(*records, fmt.Sprintf("%s/%s=%x", collection, key, value))
+				}
+				return nil
+			})
+		})
+	}
+	export(db, &want)
+	export(copied, &got)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("the copy has other items than the database")
+	}
+	mustView(t, copied, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		if c.inlineValueThreshold != 16 {
+			t.Errorf("got threshold %d, want 16", c.inlineValueThreshold)
+		}
+		_, meta, err := c.FindWithMeta([]byte("meta"))
+		if err != nil || meta == nil || meta.Flags != 7 {
+			t.Errorf("FindWithMeta: got %+v, %v", meta, err)
+		}
+		if checkpoints, _ := tx.GetCollection(checkpointsCollection); checkpoints != nil {
+			t.Error("the checkpoints were copied")
+		}
+		return nil
+	})
+
+	stats := func(db *DB) *FileStats {
+		var stats *FileStats
+		mustView(t, db, func(tx *Tx) error {
+			var err error
+			stats, err = tx.FileStats()
+			return err
+		})
+		return stats
+	}
+	if before, after := stats(db), stats(copied); after.Pages >= before.Pages || after.GarbageRatio > 0.1 {
+		t.Fatalf("got %d pages with %.2f garbage, from %d pages", after.Pages, after.GarbageRatio, before.Pages)
+	}
+}
@@ -1,14 +1,118 @@
-package main
+package gopherdb
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 const (
 	magicNumberSize = 4
-	counterSize = 4
-	nodeHeaderSize = 3
+	counterSize = 8
+	// nodeHeaderSize is the size of the node flags, the items count and the checksum. Nodes written before checksums were
+	// added have no checksum, and a header of legacyNodeHeaderSize.
+	nodeHeaderSize       = legacyNodeHeaderSize + checksumSize
+	legacyNodeHeaderSize = 3
+	checksumSize         = 4
 
-	collectionSize = 16
+	collectionSize = 24
 	pageNumSize    = 8
+	txIDSize       = 8
+
+	metaSize = magicNumberSize + 2*pageNumSize + txIDSize
+
+	freelistJournalHeaderSize = 4
+
+	// cellHeaderSize is the smallest size of the item flags, key length and value length stored with every key-value
+	// pair; the lengths are uvarints, a single byte each below 128. offsetSize is the size of the offset pointing to the
+	// cell from the left side of the page.
+	cellHeaderSize = 3
+	offsetSize     = 2
+
+	// maxInlineValueSize is the biggest value stored inside a node cell. Bigger values go to overflow pages, which keeps
+	// the cells small enough for a node to hold several of them.
+	maxInlineValueSize = 255
+
+	// MaxValueSize is the size of the biggest value the database stores. Values are returned whole by Find, so they're
+	// kept below the size of a slice index on 32-bit platforms.
+	MaxValueSize = 1<<31 - 1
+
+	// formatVersion is the version of the file format written by this version, stored in the meta page. Version 2
+	// stores the key and value lengths of the cells as uvarints instead of single bytes, version 3 adds a checksum
+	// to the node header, version 4 stores the page size in the meta page, after the version, and version 5 has two
+	// meta pages with a checksum and a spare freelist page, and version 6 adds flags after the spare page, telling
+	// whether the file was closed cleanly, and version 7 stores the biggest page number and the number of free pages of
+	// the freelist page as uint64 instead of uint16, which limited files to 65535 pages, and version 8 continues the
+	// freelist page on a chain of pages when the free pages don't fit in it, and version 9 stores the runs of
+	// consecutive free pages of the freelist as their first page and length, and version 10 flags the items of the
+	// collections nested in other collections. Files of older versions are still read, and their nodes get the new
+	// format as they're rewritten, and their freelist by their next commit.
+	formatVersion     uint16 = 10
+	formatVersionSize        = 2
+	metaPageSizeSize         = 4
+	metaFlagsSize            = 1
+	// metaTrailerSize is the size of the fields of the meta page after the freelist journal.
+	metaTrailerSize = formatVersionSize + metaPageSizeSize + pageNumSize + metaFlagsSize + checksumSize
+
+	overflowRefSize        = 16
+	overflowPageHeaderSize = pageNumSize
+)
+
+// Node flags stored in the first byte of the node header.
+const (
+	nodeFlagLeaf byte = 1 << iota
+	nodeFlagVarintLengths
+	nodeFlagChecksum
+)
+
+// Meta flags stored after the spare freelist page.
+const (
+	// metaFlagClean is set by Close on the meta page it writes after the last commit, and cleared by commits.
+	metaFlagClean byte = 1 << iota
+)
+
+// Item flags stored in the cell header.
+const (
+	itemFlagOverflow byte = 1 << iota
+	itemFlagEnvelope
+	itemFlagCollection
 )
 
-var errWriteInsideReadTxErr = errors.New("can't perform a write operation inside a read transaction")
+var ErrWriteInsideReadTx = errors.New("can't perform a write operation inside a read transaction")
+var ErrInvalidInlineThreshold = fmt.Errorf("inline threshold must be between 0 and %d", maxInlineValueSize)
+var ErrOverflowChainTooShort = errors.New("overflow chain ended before the value was fully read")
+var ErrReaderClosed = errors.New("value reader is closed")
+var ErrKeyNotFound = errors.New("key not found")
+var ErrNotDBFile = errors.New("the file is not a db file")
+var ErrCorruptNode = errors.New("node page is corrupted")
+var ErrChecksumMismatch = errors.New("node page doesn't match its checksum")
+var ErrCorruptFreelist = errors.New("freelist page is corrupted")
+var ErrLeaseHeld = errors.New("lease is held by another owner")
+var ErrLeaseLost = errors.New("lease expired or was acquired by another owner")
+var ErrCorruptLease = errors.New("value isn't a valid lease")
+var ErrCollectionNotEmpty = errors.New("collection is not empty")
+var ErrCollectionNotFound = errors.New("collection doesn't exist")
+var ErrCollectionExists = errors.New("collection already exists")
+var ErrIncompatibleValue = errors.New("key holds a nested collection, not a value, or the other way around")
+var ErrInternalCollection = errors.New("collection is kept by the database for itself")
+var ErrKeyTransformMismatch = errors.New("collections have different key transforms")
+var ErrDatabaseClosed = errors.New("database is closed")
+var ErrCloseTimeout = errors.New("timed out waiting for transactions to end")
+var ErrCorruptEnvelope = errors.New("value doesn't start with a valid metadata envelope")
+var ErrCorruptSegment = errors.New("segment file is corrupted or doesn't follow the standby")
+var ErrCorruptKeyEnvelope = errors.New("value doesn't start with a valid original key envelope")
+var ErrPagePinned = errors.New("page is pinned by a page view")
+var ErrPageReserved = errors.New("page isn't one of the embedder: it's used by the database or free")
+var ErrPageOutOfRange = errors.New("page number is beyond the end of the file")
+var ErrPageTooLarge = errors.New("data is bigger than a page")
+var ErrCorruptExport = errors.New("export stream is corrupted")
+var ErrUnsupportedFormat = errors.New("the file was written by a newer version of the file format")
+var ErrPageSizeMismatch = errors.New("the file was written with another page size")
+var ErrFileTruncated = errors.New("the file is shorter than its meta page says")
+var ErrMetaChecksumMismatch = errors.New("meta page doesn't match its checksum")
+var ErrKeyTooLarge = errors.New("key is longer than the maximum key size")
+var ErrValueTooLarge = errors.New("value is longer than the maximum value size")
+var ErrConflict = errors.New("optimistic transaction conflicts with a transaction committed since it began")
+var ErrTxDone = errors.New("transaction is already committed or rolled back")
+var ErrDatabaseLocked = errors.New("database file is open in another process")
+var ErrVerifyFailed = errors.New("the file failed the checks of Options.VerifyOnOpen")
+var ErrCheckFailed = errors.New("the file failed the integrity check")
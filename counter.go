@@ -0,0 +1,101 @@
+package gopherdb
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// Counter is an integer counter spread across several shard keys of a collection. Every increment updates a single
+// shard, picked round robin, and reading the counter sums all of its shards.
+//
+// Write transactions run one at a time, and the shard keys share the counter name so they're usually in the same leaf,
+// so the shards don't let increments run concurrently or touch fewer pages: a counter with a single shard is as fast to
+// increment, and faster to read.
+//
+// Shard keys are the counter name, a zero byte and the big endian shard number. They go through the key transform of
+// the collection like any other key.
+type Counter struct {
+	collection []byte
+	name       []byte
+	shards     uint16
+
+	nextShard atomic.Uint32
+}
+
+// NewCounter returns a counter stored in the given collection, split into the given number of shards. The collection is
+// created on the first increment. Raising the number of shards of an existing counter is safe, but Read only sums the
+// shards below the number it's given, so lowering it leaves the increments of the shards above out of the counter.
+func NewCounter(collection string, name string, shards int) *Counter {
+	if shards < 1 {
+		shards = 1
+	}
+	if shards > 1<<16-1 {
+		shards = 1<<16 - 1
+	}
+	return &Counter{
+		collection: []byte(collection),
+		name:       []byte(name),
+		shards:     uint16(shards),
+	}
+}
+
+func (c *Counter) prefix() []byte {
+	return append(append([]byte{}, c.name...), 0)
+}
+
+func (c *Counter) shardKey(shard uint16) []byte {
+	return binary.BigEndian.AppendUint16(c.prefix(), shard)
+}
+
+func decodeCounterValue(value []byte) int64 {
+	return int64(binary.LittleEndian.Uint64(value))
+}
+
+func encodeCounterValue(value int64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(value))
+}
+
+// Incr adds delta to the counter.
+func (c *Counter) Incr(tx *Tx, delta int64) error {
+	if !tx.write {
+		return ErrWriteInsideReadTx
+	}
+	collection, err := tx.getOrCreateCollection(c.collection)
+	if err != nil {
+		return err
+	}
+
+	key := c.shardKey(uint16(c.nextShard.Add(1) % uint32(c.shards)))
+	return collection.Merge(key, func(current []byte) ([]byte, error) {
+		var value int64
+		if current != nil {
+			value = decodeCounterValue(current)
+		}
+		return encodeCounterValue(value + delta), nil
+	})
+}
+
+// Decr subtracts delta from the counter.
+func (c *Counter) Decr(tx *Tx, delta int64) error {
+	return c.Incr(tx, -delta)
+}
+
+// Read returns the value of the counter, which is the sum of all its shards.
+func (c *Counter) Read(tx *Tx) (int64, error) {
+	collection, err := tx.GetCollection(c.collection)
+	if err != nil || collection == nil {
+		return 0, err
+	}
+
+	var sum int64
+	for shard := uint16(0); shard < c.shards; shard++ {
+		item, err := collection.Find(c.shardKey(shard))
+		if err != nil {
+			return 0, err
+		}
+		if item != nil {
+			sum += decodeCounterValue(item.value)
+		}
+	}
+	return sum, nil
+}
@@ -0,0 +1,51 @@
+package gopherdb
+
+import "testing"
+
+func TestCounterSumsShards(t *testing.T) {
+	db := openTestDB(t, nil)
+	counter := NewCounter("counters", "hits", 4)
+	other := NewCounter("counters", "hits\x00", 1)
+	mustUpdate(t, db, func(tx *Tx) error {
+		for i := 0; i < 10; i++ {
+			if err := counter.Incr(tx, 3); err != nil {
+				return err
+			}
+		}
+		if err := counter.Decr(tx, 5); err != nil {
+			return err
+		}
+		return other.Incr(tx, 100)
+	})
+	mustView(t, db, func(tx *Tx) error {
+		if got, err := counter.Read(tx); err != nil || got != 25 {
+			t.Errorf("Read: got %d, %v, want 25", got, err)
+		}
+		if got, err := other.Read(tx); err != nil || got != 100 {
+			t.Errorf("Read of the counter sharing the prefix: got %d, %v, want 100", got, err)
+		}
+		return nil
+	})
+}
+
+func TestCounterWithKeyTransform(t *testing.T) {
+	for _, keepOriginal := range []bool{false, true} {
+		db := openTestDB(t, nil)
+		db.SetKeyTransform([]byte("counters"), &KeyTransform{Transform: HashKeys(16), KeepOriginal: keepOriginal})
+		counter := NewCounter("counters", "hits", 3)
+		mustUpdate(t, db, func(tx *Tx) error {
+			for i := 0; i < 7; i++ {
+				if err := counter.Incr(tx, 1); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		mustView(t, db, func(tx *Tx) error {
+			if got, err := counter.Read(tx); err != nil || got != 7 {
+				t.Errorf("KeepOriginal %v: Read got %d, %v, want 7", keepOriginal, got, err)
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package gopherdb
+
+import "bytes"
+
+// cursor iterates the items of a tree in key order. Nodes don't point to their parents, so the cursor keeps the path
+// from the root to the current item as a stack. Every frame of an internal node holds the index of the child the cursor
+// descended into, which is also the index of the item that comes right after that child. The frame on top of the stack
+// points to the current item.
+type cursor struct {
+	tx    *Tx
+	root  pgnum
+	stack []cursorFrame
+}
+
+type cursorFrame struct {
+	node  *Node
+	index int
+}
+
+func newCursor(tx *Tx, root pgnum) *cursor {
+	return &cursor{
+		tx:   tx,
+		root: root,
+	}
+}
+
+// seek positions the cursor at the first item whose key is equal to or bigger than the given key. A nil key positions
+// the cursor at the first item of the tree.
+func (c *cursor) seek(key []byte) error {
+	c.stack = c.stack[:0]
+	node, err := c.tx.getNode(c.root)
+	if err != nil {
+		return err
+	}
+
+	for {
+		found, index := node.findKeyInNode(key)
+		c.stack = append(c.stack, cursorFrame{node: node, index: index})
+		if found || node.isLeaf() {
+			break
+		}
+		node, err = c.tx.getNode(node.childNodes[index])
+		if err != nil {
+			return err
+		}
+	}
+	c.climb()
+	return nil
+}
+
+// next moves the cursor to the item that follows the current one.
+func (c *cursor) next() error {
+	if !c.valid() {
+		return nil
+	}
+	top := &c.stack[len(c.stack)-1]
+	top.index++
+	if top.node.isLeaf() {
+		c.climb()
+		return nil
+	}
+
+	// The next item is the leftmost item of the subtree to the right of the current item
+	node, err := c.tx.getNode(top.node.childNodes[top.index])
+	if err != nil {
+		return err
+	}
+	for {
+		c.stack = append(c.stack, cursorFrame{node: node, index: 0})
+		if node.isLeaf() {
+			break
+		}
+		node, err = c.tx.getNode(node.childNodes[0])
+		if err != nil {
+			return err
+		}
+	}
+	c.climb()
+	return nil
+}
+
+// climb pops the frames that have no items left, so the top of the stack points to an existing item again. If the
+// whole tree was traversed, the stack becomes empty.
+func (c *cursor) climb() {
+	for len(c.stack) > 0 {
+		top := c.stack[len(c.stack)-1]
+		if top.index < len(top.node.items) {
+			return
+		}
+		c.stack = c.stack[:len(c.stack)-1]
+	}
+}
+
+func (c *cursor) valid() bool {
+	return len(c.stack) > 0
+}
+
+// item returns the current item as it's stored in the tree, or nil if the cursor is exhausted.
+func (c *cursor) item() *Item {
+	if !c.valid() {
+		return nil
+	}
+	top := c.stack[len(c.stack)-1]
+	return top.node.items[top.index]
+}
+
+// KeyRange is a half open range of keys [Start, End). A nil Start has no lower bound and a nil End has no upper bound.
+type KeyRange struct {
+	Start []byte
+	End   []byte
+}
+
+// prefixRange returns the range of all the keys starting with the prefix.
+func prefixRange(prefix []byte) KeyRange {
+	r := KeyRange{Start: prefix}
+	// The end is the prefix with its last byte incremented, ignoring trailing 0xff bytes that can't be incremented. A
+	// prefix made only of 0xff bytes has no upper bound.
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			r.End = append(append([]byte{}, prefix[:i]...), prefix[i]+1)
+			break
+		}
+	}
+	return r
+}
+
+func (r KeyRange) contains(key []byte) bool {
+	if r.Start != nil && bytes.Compare(key, r.Start) < 0 {
+		return false
+	}
+	return r.End == nil || bytes.Compare(key, r.End) < 0
+}
+
+// rangeItems calls fn for every item of the tree in the range, in key order, until fn returns false or an error. It
+// skips the items of nested collections, which aren't keys of the collection.
+func (tx *Tx) rangeItems(root pgnum, r KeyRange, fn func(item *Item) (bool, error)) error {
+	return tx.rangeStored(root, r, func(item *Item) (bool, error) {
+		if item.collection {
+			return true, nil
+		}
+		return fn(item)
+	})
+}
+
+// rangeStored calls fn for every item of the tree in the range like rangeItems, the items of nested collections
+// included.
+func (tx *Tx) rangeStored(root pgnum, r KeyRange, fn func(item *Item) (bool, error)) error {
+	cur := newCursor(tx, root)
+	err := cur.seek(r.Start)
+	if err != nil {
+		return err
+	}
+	for ; cur.valid(); err = cur.next() {
+		if err != nil {
+			return err
+		}
+		item := cur.item()
+		if r.End != nil && bytes.Compare(item.key, r.End) >= 0 {
+			return nil
+		}
+		more, err := fn(item)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return err
+}
+
+// Cursor iterates the keys of a collection in key order. It reads through the transaction of the collection, so every
+// cursor of a transaction sees the same snapshot, and it must not be used once the transaction ended. Values stored in
+// overflow pages are read when the cursor reaches them.
+//
+// Positioning methods return the key and value the cursor lands on, or nils once it's exhausted or failed; Err tells
+// the two apart.
+//
+// In a write transaction, First and Seek start from the root the collection has when they're called, so they see the
+// writes made since the cursor was made, even ones that split or merged the root. Next goes on from the nodes the cursor
+// read, so after a write to the collection the cursor must be positioned again before Next is called.
+type Cursor struct {
+	collection *Collection
+	cur        *cursor
+	// bounds limits the keys the cursor lands on, see Range.
+	bounds KeyRange
+	err    error
+}
+
+// Cursor returns a cursor over the collection, positioned before the first key.
+func (c *Collection) Cursor() *Cursor {
+	return &Cursor{collection: c, cur: newCursor(c.tx, c.root)}
+}
+
+// Range returns a cursor over the keys of the collection in [start, end), positioned before start. A nil start has no
+// lower bound and a nil end has no upper bound. First moves to the first key of the range, Seek doesn't go below start,
+// and the cursor is exhausted once it reaches end, so it never reads past the nodes holding the range. It works in read
+// and write transactions alike.
+//
+//	cur := collection.Range([]byte("2024-01"), []byte("2024-02"))
+//	for k, v := cur.First(); k != nil; k, v = cur.Next() {
+//		...
+//	}
+func (c *Collection) Range(start []byte, end []byte) *Cursor {
+	return &Cursor{collection: c, cur: newCursor(c.tx, c.root), bounds: KeyRange{Start: start, End: end}}
+}
+
+// First moves the cursor to the first key.
+func (c *Cursor) First() ([]byte, []byte) {
+	return c.Seek(nil)
+}
+
+// Seek moves the cursor to the first key equal to or bigger than key.
+func (c *Cursor) Seek(key []byte) ([]byte, []byte) {
+	if c.err != nil {
+		return nil, nil
+	}
+	if c.bounds.Start != nil && bytes.Compare(key, c.bounds.Start) < 0 {
+		key = c.bounds.Start
+	}
+	// Writes since the cursor was made can have given the collection another root
+	c.cur.root = c.collection.root
+	c.err = c.cur.seek(key)
+	c.skipCollections()
+	return c.current()
+}
+
+// Next moves the cursor to the next key.
+func (c *Cursor) Next() ([]byte, []byte) {
+	if c.err != nil || !c.inBounds() {
+		return nil, nil
+	}
+	c.err = c.cur.next()
+	c.skipCollections()
+	return c.current()
+}
+
+// skipCollections moves the cursor past the items of nested collections, which aren't keys of the collection.
+func (c *Cursor) skipCollections() {
+	for c.err == nil && c.inBounds() && c.cur.item().collection {
+		c.err = c.cur.next()
+	}
+}
+
+// Err returns the error that stopped the cursor, if any.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// inBounds reports whether the cursor is on an item below the end of its range.
+func (c *Cursor) inBounds() bool {
+	return c.cur.valid() && (c.bounds.End == nil || bytes.Compare(c.cur.item().key, c.bounds.End) < 0)
+}
+
+func (c *Cursor) current() ([]byte, []byte) {
+	if c.err != nil || !c.inBounds() {
+		return nil, nil
+	}
+	item, err := c.collection.resolveItem(c.cur.item())
+	if err != nil {
+		c.err = err
+		return nil, nil
+	}
+	return item.key, item.value
+}
+
+// Scan calls fn for every key of the collection starting with the prefix, in key order, until fn returns an error,
+// which Scan returns. It seeks straight to the first key of the prefix and stops at the first key past it, so only the
+// nodes holding the prefix are read. A nil or empty prefix scans the whole collection.
+func (c *Collection) Scan(prefix []byte, fn func(key, value []byte) error) error {
+	return c.tx.rangeItems(c.root, prefixRange(prefix), func(item *Item) (bool, error) {
+		item, err := c.resolveItem(item)
+		if err != nil {
+			return false, err
+		}
+		return true, fn(item.key, item.value)
+	})
+}
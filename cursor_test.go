@@ -0,0 +1,221 @@
+package gopherdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCursor(t *testing.T) {
+	db := openTestDB(t, nil)
+	big := bytes.Repeat([]byte("v"), 2000)
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		// Even keys only, so every odd key falls between two keys
+		for i := 0; i < 1000; i += 2 {
+			value := testKey(i)
+			if i == 500 {
+				value = big
+			}
+			if err := c.Put(testKey(i), value); err != nil {
+				return err
+			}
+		}
+		getOrCreate(t, tx, "empty")
+		return nil
+	})
+
+	mustView(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		if height := treeHeight(t, tx, c.root); height < 3 {
+			t.Fatalf("tree height is %d, want at least 3", height)
+		}
+		cur := c.Cursor()
+		i := 0
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			want := testKey(i)
+			if i == 500 {
+				want = big
+			}
+			if string(k) != string(testKey(i)) || string(v) != string(want) {
+				t.Fatalf("key %d: got %s with %d bytes, want %s with %d bytes", i/2, k, len(v), testKey(i), len(want))
+			}
+			i += 2
+		}
+		if err := cur.Err(); err != nil || i != 1000 {
+			t.Errorf("the cursor stopped after %d keys with %v, want 500 keys", i/2, err)
+		}
+		if k, v := cur.Next(); k != nil || v != nil {
+			t.Errorf("Next after the last key returned %s", k)
+		}
+
+		for _, seek := range []int{0, 1, 333, 998} {
+			want := testKey(seek + seek%2)
+			if k, _ := cur.Seek(testKey(seek)); string(k) != string(want) {
+				t.Errorf("Seek(%s): got %s, want %s", testKey(seek), k, want)
+			}
+			if k, _ := cur.Next(); seek < 998 && string(k) != string(testKey(seek+seek%2+2)) {
+				t.Errorf("Next after Seek(%s): got %s, want %s", testKey(seek), k, testKey(seek+seek%2+2))
+			}
+		}
+		if k, _ := cur.Seek(testKey(999)); k != nil {
+			t.Errorf("Seek past the last key returned %s", k)
+		}
+
+		if k, _ := getOrCreate(t, tx, "empty").Cursor().First(); k != nil {
+			t.Errorf("First of an empty collection returned %s", k)
+		}
+		return nil
+	})
+}
+
+func TestScan(t *testing.T) {
+	db := openTestDB(t, nil)
+	keys := []string{"a", "ab", "abc", "abd", "b", "b\xff", "b\xff\xff", "c"}
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for _, key := range keys {
+			if err := c.Put([]byte(key), []byte("value of "+key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	mustView(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for prefix, want := range map[string]string{
+			"":      "[a ab abc abd b b\xff b\xff\xff c]",
+			"ab":    "[ab abc abd]",
+			"abc":   "[abc]",
+			"abz":   "[]",
+			"b\xff": "[b\xff b\xff\xff]",
+			"d":     "[]",
+		} {
+			var scanned []string
+			err := c.Scan([]byte(prefix), func(key, value []byte) error {
+				if string(value) != "value of "+string(key) {
+					t.Errorf("Scan(%q) returned %q for %q", prefix, value, key)
+				}
+				scanned = append(scanned, string(key))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if got := fmt.Sprint(scanned); got != want {
+				t.Errorf("Scan(%q): got %q, want %q", prefix, got, want)
+			}
+		}
+
+		errStop := errors.New("stop")
+		calls := 0
+		err := c.Scan(nil, func(key, value []byte) error {
+			calls++
+			return errStop
+		})
+		if !errors.Is(err, errStop) || calls != 1 {
+			t.Errorf("Scan stopped by an error: got %d calls and %v, want 1 call and the error", calls, err)
+		}
+		return nil
+	})
+}
+
+func TestRange(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i := 0; i < 500; i++ {
+			if err := c.Put(testKey(i), testKey(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	keys := func(cur *Cursor, first func() ([]byte, []byte)) string {
+		var keys []string
+		for k, v := first(); k != nil; k, v = cur.Next() {
+			if string(v) != string(k) {
+				t.Errorf("the cursor returned %s with %s", k, v)
+			}
+			keys = append(keys, string(k[len("key"):]))
+		}
+		if err := cur.Err(); err != nil {
+			t.Errorf("Err: %v", err)
+		}
+		return fmt.Sprint(keys)
+	}
+	check := func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		cur := c.Range(testKey(100), testKey(104))
+		if got := keys(cur, cur.First); got != "[000100 000101 000102 000103]" {
+			t.Errorf("First of [100, 104): got %s", got)
+		}
+		// Seek doesn't go below the start, and the end isn't reached again by Next once the cursor is past it
+		if got := keys(cur, func() ([]byte, []byte) { return cur.Seek(testKey(3)) }); got != "[000100 000101 000102 000103]" {
+			t.Errorf("Seek below the start of [100, 104): got %s", got)
+		}
+		if got := keys(cur, func() ([]byte, []byte) { return cur.Seek(testKey(102)) }); got != "[000102 000103]" {
+			t.Errorf("Seek(102) in [100, 104): got %s", got)
+		}
+		if k, _ := cur.Seek(testKey(104)); k != nil {
+			t.Errorf("Seek to the end of [100, 104) returned %s", k)
+		}
+
+		cur = c.Range(nil, testKey(2))
+		if got := keys(cur, cur.First); got != "[000000 000001]" {
+			t.Errorf("First of [nil, 2): got %s", got)
+		}
+		cur = c.Range(testKey(498), nil)
+		if got := keys(cur, cur.First); got != "[000498 000499]" {
+			t.Errorf("First of [498, nil): got %s", got)
+		}
+		cur = c.Range(testKey(7), testKey(7))
+		if got := keys(cur, cur.First); got != "[]" {
+			t.Errorf("First of the empty range [7, 7): got %s", got)
+		}
+		return nil
+	}
+	mustView(t, db, check)
+	mustUpdate(t, db, check)
+}
+
+func TestCursorSeesWritesThatSplitTheRoot(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		if err := c.Put(testKey(0), testKey(0)); err != nil {
+			return err
+		}
+		cur, ranged := c.Cursor(), c.Range(testKey(100), testKey(200))
+		if k, _ := cur.First(); !bytes.Equal(k, testKey(0)) {
+			t.Fatalf("First: got %q, want %q", k, testKey(0))
+		}
+		root := c.root
+		for i := 1; i < 1000; i++ {
+			if err := c.Put(testKey(i), testKey(i)); err != nil {
+				return err
+			}
+		}
+		if c.root == root {
+			t.Fatal("the writes didn't split the root")
+		}
+
+		// Both cursors were made before the writes, and position themselves on the tree as it is now
+		for _, test := range []struct {
+			cur  *Cursor
+			want int
+		}{{cur, 1000}, {ranged, 100}} {
+			n := 0
+			for k, _ := test.cur.First(); k != nil; k, _ = test.cur.Next() {
+				n++
+			}
+			if err := test.cur.Err(); err != nil || n != test.want {
+				t.Errorf("got %d keys and %v, want %d", n, err, test.want)
+			}
+		}
+		return nil
+	})
+}
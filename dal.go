@@ -1,18 +1,140 @@
-package main
+package gopherdb
 
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sync"
+	"time"
 )
 
 type pgnum uint64
 
+// Options are the options of Open. The page size and the format options are fixed by the file, and most others by the
+// handle until it's closed, except for the settings DB.SetOption changes, see Setting.
 type Options struct {
 	pageSize int
+	// inspect is set by Doctor, which opens the file to find what's wrong with it: the freelist isn't repaired after a
+	// crash, and the file isn't marked clean on Close.
+	inspect bool
 
 	MinFillPercent float32
 	MaxFillPercent float32
+
+	// InlineValueThreshold is the biggest value size (in bytes) that is stored inside the nodes. Bigger values are
+	// moved to a chain of overflow pages. Zero means the biggest value a node cell can hold. Collections can override it
+	// with Collection.SetInlineThreshold.
+	InlineValueThreshold int
+
+	// DiagnosticsDir is the directory where a redacted snapshot of the trees is written whenever a consistency
+	// violation is found. Empty means no file is written; the snapshot is still available from the *ViolationError.
+	DiagnosticsDir string
+
+	// CloseTimeout bounds how long Close waits for the transactions in flight to end. Zero means waiting as long as
+	// it takes.
+	CloseTimeout time.Duration
+
+	// StatsHistory is the number of commits kept in the stats history, see tx.StatsHistory. Every commit records a
+	// StatsRecord in a ring buffer of that many slots, which makes commits write a few more pages. Zero disables the
+	// history.
+	StatsHistory int
+
+	// ShipDir is a directory every commit ships a segment of the pages it wrote to, for a Standby to apply. Empty
+	// means no segment is shipped.
+	ShipDir string
+
+	// JournalFreelist makes commits journal the changes to the freelist in the meta page, which is written by every
+	// commit anyway, instead of writing the freelist page. The freelist page is only written when the journal no longer
+	// fits in the meta page. Files written with it can't be opened by versions that don't know the journal.
+	JournalFreelist bool
+
+	// IOThrottle slows down the page reads and writes, for testing how an application copes with slow storage. Nil
+	// means full speed.
+	IOThrottle *IOThrottle
+
+	// NoSync makes commits skip the syncs of the file, which otherwise happen twice per commit: once the pages are
+	// written, and once the meta page pointing to them is. Commits get much faster, and they still survive the process
+	// crashing since their writes are in the cache of the OS, but a crash of the OS or a power loss can lose any commit
+	// since the last sync, and leave a meta page pointing to pages that never reached the disk. It's meant for bulk
+	// loads that can be started over, followed by DB.Sync. Close syncs the file regardless.
+	NoSync bool
+
+	// WAL makes commits append the pages they write to a write-ahead log next to the file, named after it with a -wal
+	// suffix, and sync only the log, instead of writing the pages in place. Commits become one sequential write, and
+	// the pages are copied to the file by checkpoints: every WALCheckpointPages logged pages, on DB.CheckpointWAL, and
+	// on Close, which removes the log. Open replays a log left by a crash, in WAL mode or not, so copies of the file
+	// must be taken with the log, or after a checkpoint. Zero WALCheckpointPages means 1000.
+	WAL                bool
+	WALCheckpointPages int
+
+	// UpdateAttempts is the number of times DB.Update runs its function in all, as long as it fails with ErrConflict,
+	// see Tx.Attempt. Zero means once.
+	UpdateAttempts int
+
+	// ReadOnly opens an existing file without ever writing to it, and without requiring the permission to. It takes a
+	// shared lock of the file, which other read-only opens share, so the file can't be opened for writing by another
+	// process meanwhile, and waits for the process that has it open for writing like other opens do, see LockTimeout.
+	// The WAL is read but left as it is, the freelist isn't repaired after a crash, and write transactions fail to begin
+	// with ErrWriteInsideReadTx, like on the views of Open.
+	ReadOnly bool
+
+	// NoLock makes ReadOnly opens take no lock, for inspecting a file another process has open for writing. The
+	// snapshot is the one of the last commit when the file is opened: commits of that process after that aren't seen,
+	// and can reuse the pages of the snapshot, or checkpoint its WAL, so reads may fail with checksum errors while it
+	// writes. It's ignored without ReadOnly.
+	NoLock bool
+
+	// LockTimeout bounds how long Open waits for another process to close the file, whose lock conflicts with the one
+	// Open takes, before failing with ErrDatabaseLocked. Zero fails right away.
+	LockTimeout time.Duration
+
+	// VerifyOnOpen makes Open check the file before returning, so a corrupt file fails at startup with
+	// ErrVerifyFailed instead of in the middle of a request, see VerifyMode. The default, VerifyOff, checks only the
+	// meta and freelist pages Open reads anyway.
+	VerifyOnOpen VerifyMode
+
+	// Checkpoints makes commits keep states of the file to be read later with DB.ReadTxAt, as a list of tiers such as
+	// one checkpoint every minute for an hour, and one every hour for a day. The pages a checkpoint reads are only
+	// reused once it expires, so the file grows by the pages the commits made during the longest tier free. Nil keeps
+	// no checkpoint, and the ones kept by earlier opens expire with the next commit.
+	Checkpoints []CheckpointTier
+
+	// MMap makes reads copy the pages from a mapping of the file instead of reading them with a syscall each, which is
+	// faster for reads of pages the OS has cached. The file is mapped again as it grows. Platforms without mmap, and
+	// files that can't be mapped, read with pread as without it.
+	MMap bool
+
+	// NodeCacheSize keeps up to that many of the nodes read last in memory, decoded, so the nodes read by most
+	// transactions, like the upper levels of the trees, aren't read from the file and deserialized every time. Nodes
+	// leave the cache when their page is written. Zero caches nothing.
+	NodeCacheSize int
+
+	// Clock and Random are where the handle takes the time and random bytes from: the expiration times of sessions and
+	// leases, the times of rate limits, stats records and checkpoints, the ids of sessions and the seeds of Sample.
+	// Simulation tests setting both to deterministic sources get the same file, byte for byte, from the same
+	// operations. Nil takes the time from the system clock and the bytes from crypto/rand. Waits, like LockTimeout and
+	// IOThrottle, always take real time.
+	Clock  Clock
+	Random io.Reader
+
+	// BackgroundWorkers is how many of the tasks running in the background for the file, like Sessions.StartCleanup
+	// and BlobStore.StartGC, can run at the same time. The others wait for their turn, so the background never takes
+	// more than that many cores. Zero lets every task run when it's due. See DB.PauseBackground and
+	// DB.BackgroundStats.
+	BackgroundWorkers int
+
+	// SoftLimits are levels of the size of the file, the share of free pages and the number of write transactions
+	// waiting, at which OnSoftLimit is called, so the application can alert or shed load before running out of disk or
+	// time. It's called once when a metric reaches a level, and once when it goes back below it, from the goroutine
+	// whose commit or transaction crossed it, once it holds no lock of the file, so it can run transactions, which
+	// block the goroutine until it returns. Nil, or a nil OnSoftLimit, watches nothing.
+	SoftLimits  []SoftLimit
+	OnSoftLimit func(SoftLimitEvent)
+
+	// Logger receives the events of the file: opens and closes, commits, crash recoveries and failures, see Logger.
+	// A *slog.Logger can be passed as it is. Nil logs nothing.
+	Logger Logger
 }
 
 var DefaultOptions = &Options{
@@ -29,65 +151,142 @@ type dal struct {
 	pageSize       int
 	minFillPercent float32
 	maxFillPercent float32
-	file           *os.File
+	file           Backend
+
+	inlineValueThreshold int
+	diagnosticsDir       string
+	closeTimeout         time.Duration
+	statsHistory         int
+	// checkpointTiers is Options.Checkpoints. checkpoints holds the checkpoints kept, which are guarded by pinMu, see
+	// checkpoint.go.
+	checkpointTiers []CheckpointTier
+	checkpoints     map[uint64]*checkpoint
+	// lastStats is the stats record of the last commit, which gets its latency when the next commit records it.
+	lastStats *StatsRecord
+
+	shipDir         string
+	journalFreelist bool
+	// unshipped holds the pages written since the segment ending at shippedTxID was shipped.
+	unshipped   map[pgnum][]byte
+	shippedTxID uint64
+
+	// pins counts the page views of every pinned page, and readers the read transactions running by the commit they
+	// read, see snapshot.go. heldPages holds the pages freed by commits while pinned or readable by read transactions,
+	// which are released by the first commit after they're unpinned and those transactions ended, and freedBy the
+	// commit that freed each of them. Page views and read transactions don't outlive the process, so the freelist page
+	// counts the held pages as free, and heldWritten tells whether the freelist page written last has any.
+	pinMu       sync.Mutex
+	pins        map[pgnum]int
+	readers     map[uint64]int
+	heldPages   []pgnum
+	freedBy     map[pgnum]uint64
+	heldWritten bool
+	// committed is the state of the file read transactions begin on, and unpublished holds the pages the commit in
+	// progress released, see publishState. snapshotMu is held for reading by the read transactions, and for writing by
+	// Standby.apply, which writes pages they can read, once none runs. segmentsApplied counts the segments
+	// Standby.apply applied, which make the snapshots taken before them stale, see DB.Snapshot.
+	committed       fileState
+	unpublished     []pgnum
+	snapshotMu      sync.RWMutex
+	segmentsApplied uint64
+
+	throttle   *ioThrottle
+	noSync     bool
+	nodeCache  *nodeCache
+	rootCache  rootCache
+	clock      Clock
+	random     io.Reader
+	background *background
+	softLimits *softLimits
+	counters   dalCounters
+	logger     Logger
+
+	// updateAttempts is Options.UpdateAttempts.
+	updateAttempts int
+
+	// wal is the write-ahead log in WAL mode, see wal.go. walPages holds the pages logged since the last checkpoint,
+	// and walPending the pages written by the commit in progress, both guarded by walMu since read transactions read
+	// them while write transactions change them.
+	walMu              sync.RWMutex
+	walEnabled         bool
+	walCheckpointPages int
+	wal                *os.File
+	walFilePath        string
+	walPages           map[pgnum][]byte
+	walPending         map[pgnum][]byte
+	walSize            int64
+	walLogged          int
+
+	// recovery is what Open did to a file that wasn't closed cleanly, and freelistRepaired is set when it changed the
+	// freelist, or when the freelist page has the format of an older version, so the next commit writes it whole.
+	recovery         *Recovery
+	freelistRepaired bool
+	inspect          bool
+	readOnly         bool
 
 	*meta
 	*freelist
 }
 
 func newDal(path string, options *Options) (*dal, error) {
-	dal := &dal{
-		meta:           newEmptyMeta(),
-		pageSize:       options.pageSize,
-		minFillPercent: options.MinFillPercent,
-		maxFillPercent: options.MaxFillPercent,
-	}
+	dal := newEmptyDal(options)
 
 	// exist
 	if _, err := os.Stat(path); err == nil {
-		dal.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
-		if err != nil {
-			_ = dal.close()
-			return nil, err
+		var replayed int
+		var file *os.File
+		if dal.readOnly {
+			file, err = os.Open(path)
+			if err == nil {
+				dal.file = &fileBackend{file: file, mmap: options.MMap}
+				if !options.NoLock {
+					err = waitLock(file, false, options.LockTimeout)
+				}
+			}
+			if err == nil {
+				replayed, err = dal.loadWAL(path)
+			}
+		} else {
+			file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+			// The lock is taken before the WAL is touched, since the WAL of a file open in another process is still
+			// being written
+			if err == nil {
+				dal.file = &fileBackend{file: file, mmap: options.MMap}
+				err = waitLock(file, true, options.LockTimeout)
+			}
+			if err == nil {
+				replayed, err = dal.replayWAL(path)
+			}
 		}
-
-		meta, err := dal.readMeta()
 		if err != nil {
+			_ = dal.close()
 			return nil, err
 		}
-		dal.meta = meta
-
-		freelist, err := dal.readFreelist()
+		err = dal.load(replayed)
 		if err != nil {
+			_ = dal.close()
 			return nil, err
 		}
-		dal.freelist = freelist
 		// doesn't exist
-	} else if errors.Is(err, os.ErrNotExist) {
-		// init freelist
-		dal.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	} else if errors.Is(err, os.ErrNotExist) && !dal.readOnly {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
 		if err != nil {
-			_ = dal.close()
 			return nil, err
 		}
-
-		dal.freelist = newFreelist()
-		dal.freelistPage = dal.getNextPage()
-		_, err := dal.writeFreelist()
+		dal.file = &fileBackend{file: file, mmap: options.MMap}
+		err = waitLock(file, true, options.LockTimeout)
 		if err != nil {
+			_ = dal.close()
 			return nil, err
 		}
-
-		// init root
-		collectionsNode, err := dal.writeNode(NewNodeForSerialization([]*Item{}, []pgnum{}))
+		err = dal.create()
 		if err != nil {
+			_ = dal.close()
 			return nil, err
 		}
-		dal.root = collectionsNode.pageNum
-
-		// write meta page
-		_, err = dal.writeMeta(dal.meta)
+		err = dal.createWAL(path)
 		if err != nil {
+			_ = dal.close()
 			return nil, err
 		}
 	} else {
@@ -96,6 +295,134 @@ func newDal(path string, options *Options) (*dal, error) {
 	return dal, nil
 }
 
+// newEmptyDal returns a dal with the options, which has no storage yet.
+func newEmptyDal(options *Options) *dal {
+	dal := &dal{
+		meta:           newEmptyMeta(),
+		pageSize:       options.pageSize,
+		minFillPercent: options.MinFillPercent,
+		maxFillPercent: options.MaxFillPercent,
+
+		inlineValueThreshold: options.InlineValueThreshold,
+		diagnosticsDir:       options.DiagnosticsDir,
+		closeTimeout:         options.CloseTimeout,
+		statsHistory:         options.StatsHistory,
+		checkpointTiers:      options.Checkpoints,
+		shipDir:              options.ShipDir,
+		journalFreelist:      options.JournalFreelist,
+		throttle:             newIOThrottle(options.IOThrottle),
+		noSync:               options.NoSync,
+		updateAttempts:       options.UpdateAttempts,
+		nodeCache:            newNodeCache(options.NodeCacheSize),
+		clock:                options.Clock,
+		random:               options.Random,
+		walEnabled:           options.WAL,
+		walCheckpointPages:   options.WALCheckpointPages,
+		inspect:              options.inspect,
+		readOnly:             options.ReadOnly,
+	}
+	dal.background = newBackground(options.BackgroundWorkers, dal.now)
+	dal.softLimits = newSoftLimits(options.SoftLimits, options.OnSoftLimit)
+	dal.logger = newLogger(options.Logger)
+	if dal.readOnly {
+		dal.walEnabled = false
+		dal.journalFreelist = false
+		dal.shipDir = ""
+	}
+	if dal.walCheckpointPages <= 0 {
+		dal.walCheckpointPages = defaultWALCheckpointPages
+	}
+	return dal
+}
+
+// load reads the meta and the freelist of an existing file, once the commits of its WAL are replayed. A file that
+// isn't a database is closed again by the caller, instead of staying open for nothing.
+func (d *dal) load(replayed int) error {
+	meta, slotErrs, err := d.readMetaSlots()
+	if err != nil {
+		return err
+	}
+	d.meta = meta
+	err = d.checkFileSize()
+	if err != nil {
+		return err
+	}
+
+	freelist, err := d.loadFreelist()
+	if err != nil {
+		return err
+	}
+	d.freelist = freelist
+	// The freelist page of older versions is written in the current format by the next commit
+	if meta.version < 9 {
+		d.freelistRepaired = true
+	}
+	d.shippedTxID = meta.txid
+	if !meta.clean || replayed > 0 {
+		d.recovery = newRecovery(meta, slotErrs, replayed)
+	}
+	return nil
+}
+
+// create writes the pages of a new file to the empty storage.
+func (d *dal) create() error {
+	// Page 1 is the second meta page, followed by the freelist page and its spare
+	d.freelist = newFreelist()
+	d.getNextPage()
+	d.freelistPage = d.getNextPage()
+	d.freelistSpare = d.getNextPage()
+
+	// init root
+	collectionsNode, err := d.writeNode(NewNodeForSerialization([]*Item{}, []pgnum{}))
+	if err != nil {
+		return err
+	}
+	d.root = collectionsNode.pageNum
+
+	// The freelist is written once every page of the new file is allocated, so it covers the root as well
+	err = d.writeFreelist()
+	if err != nil {
+		return err
+	}
+	d.freelist.journaling = d.journalFreelist
+
+	// Both meta pages are written, so a crash during the first commit leaves a valid one
+	for range []pgnum{metaPageNum, metaPageNumB} {
+		_, err = d.writeMeta(d.meta)
+		if err != nil {
+			return err
+		}
+	}
+	return d.file.Sync()
+}
+
+// checkFileSize checks that the pages the meta page points to are inside the file.
+func (d *dal) checkFileSize() error {
+	size, err := d.file.Size()
+	if err != nil {
+		return err
+	}
+	pages := d.filePages(size)
+	if d.root >= pages || d.freelistPage >= pages || d.freelistSpare >= pages {
+		return ErrFileTruncated
+	}
+	return nil
+}
+
+// filePages returns the number of pages of a file of the given size, counting the pages of the WAL past its end, which
+// are only copied to the file by checkpoints, or never by a read-only open.
+func (d *dal) filePages(size int64) pgnum {
+	pages := pgnum(size / int64(d.pageSize))
+	d.walMu.RLock()
+	defer d.walMu.RUnlock()
+	for pageNum := range d.walPages {
+		if pageNum >= pages {
+			pages = pageNum + 1
+		}
+	}
+	return pages
+}
+
 // getSplitIndex should be called when performing rebalance after an item is removed. It checks if a node can spare an
 // element, and if it does then it returns the index when there the split should happen. Otherwise -1 is returned.
 func (d *dal) getSplitIndex(node *Node) int {
@@ -115,6 +442,49 @@ func (d *dal) getSplitIndex(node *Node) int {
 	return -1
 }
 
+// maxElementSize returns the size of the biggest element a node can hold. An overpopulated node of such elements can
+// always be split with items left on both sides of the middle one, since it has at least two elements more than
+// minThreshold requires.
+func (d *dal) maxElementSize() int {
+	return int(d.maxThreshold()-d.minThreshold()-pageNumSize) / 2
+}
+
+// elementSizeOf returns the size of the element of an item with the given key and value sizes, see elementSize.
+func elementSizeOf(keySize int, valueSize int) int {
+	return offsetSize + 1 + uvarintSize(uint64(keySize)) + keySize + uvarintSize(uint64(valueSize)) + valueSize + pageNumSize
+}
+
+// maxKeySize returns the size of the biggest key whose element fits in maxElementSize with its value in overflow
+// pages, which is as small as a value gets in a node.
+func (d *dal) maxKeySize() int {
+	size := d.maxElementSize() - elementSizeOf(0, overflowRefSize)
+	for size > 0 && elementSizeOf(size, overflowRefSize) > d.maxElementSize() {
+		size--
+	}
+	if size < 0 {
+		return 0
+	}
+	return size
+}
+
+// checkItemSize returns an error if the key or the value is bigger than the limits.
+func (d *dal) checkItemSize(key []byte, valueSize uint64) error {
+	if len(key) > d.maxKeySize() {
+		return ErrKeyTooLarge
+	}
+	if valueSize > MaxValueSize {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// MaxKeySize returns the size of the biggest key the database stores. It depends on the page size and the fill
+// percents, since a node must be able to hold a few keys to be split: for 4KB pages and the default options it's a
+// bit under 900 bytes.
+func (db *DB) MaxKeySize() int {
+	return db.maxKeySize()
+}
+
 func (d *dal) maxThreshold() float32 {
 	return d.maxFillPercent * float32(d.pageSize)
 }
@@ -131,7 +501,20 @@ func (d *dal) isUnderPopulated(node *Node) bool {
 	return float32(node.nodeSize()) < d.minThreshold()
 }
 
+// syncCommit syncs the file at the boundaries of a commit, unless Options.NoSync is set. In WAL mode the pages stay in
+// memory until commitPages logs them, so there's nothing to sync.
+func (d *dal) syncCommit() error {
+	if d.noSync || d.wal != nil {
+		return nil
+	}
+	return d.file.Sync()
+}
+
 func (d *dal) close() error {
+	if d.wal != nil {
+		_ = d.wal.Close()
+		d.wal = nil
+	}
 	if d.file != nil {
 		err := d.file.Close()
 		if err != nil {
@@ -152,18 +535,36 @@ func (d *dal) allocateEmptyPage() *page {
 func (d *dal) readPage(pageNum pgnum) (*page, error) {
 	p := d.allocateEmptyPage()
 
-	offset := int(pageNum) * d.pageSize
-	_, err := d.file.ReadAt(p.data, int64(offset))
+	d.throttle.wait(d.pageSize)
+	if data, ok := d.walPage(pageNum); ok {
+		copy(p.data, data)
+		return p, nil
+	}
+	err := d.file.ReadPage(uint64(pageNum), p.data)
 	if err != nil {
-		return nil, err
+		return nil, internalError(err, DBError{Page: uint64(pageNum)})
 	}
-	return p, err
+	d.counters.bytesRead.Add(uint64(len(p.data)))
+	return p, nil
 }
 
 func (d *dal) writePage(p *page) error {
-	offset := int64(p.num) * int64(d.pageSize)
-	_, err := d.file.WriteAt(p.data, offset)
-	return err
+	d.throttle.wait(len(p.data))
+	d.nodeCache.drop(p.num)
+	if d.wal != nil {
+		d.walMu.Lock()
+		d.walPending[p.num] = append([]byte{}, p.data...)
+		d.walMu.Unlock()
+		d.recordPage(p)
+		return nil
+	}
+	err := d.file.WritePage(uint64(p.num), p.data)
+	if err != nil {
+		return err
+	}
+	d.counters.bytesWritten.Add(uint64(len(p.data)))
+	d.recordPage(p)
+	return nil
 }
 
 func (d *dal) newNode(items []*Item, childNodes []pgnum) *Node {
@@ -175,13 +576,20 @@ func (d *dal) newNode(items []*Item, childNodes []pgnum) *Node {
 }
 
 func (d *dal) getNode(pageNum pgnum) (*Node, error) {
+	if node := d.nodeCache.get(pageNum); node != nil {
+		return node, nil
+	}
 	p, err := d.readPage(pageNum)
 	if err != nil {
 		return nil, err
 	}
 	node := NewEmptyNode()
-	node.deserialize(p.data)
+	err = node.deserialize(p.data)
+	if err != nil {
+		return nil, internalError(err, DBError{Page: uint64(pageNum)})
+	}
 	node.pageNum = pageNum
+	d.nodeCache.put(node)
 	return node, nil
 }
 
@@ -198,7 +606,7 @@ func (d *dal) writeNode(n *Node) (*Node, error) {
 
 	err := d.writePage(p)
 	if err != nil {
-		return nil, err
+		return nil, internalError(err, DBError{Page: uint64(p.num)})
 	}
 	return n, nil
 }
@@ -214,42 +622,274 @@ func (d *dal) readFreelist() (*freelist, error) {
 	}
 
 	freelist := newFreelist()
-	freelist.deserialize(p.data)
+	next, left, err := freelist.deserialize(p.data, d.meta.version)
+	if err != nil {
+		return nil, err
+	}
+	// The chain is read to its end, even past the last free page, so none of its pages is lost
+	for next != 0 {
+		// A chain going back to one of its pages would never end
+		for _, pageNum := range append(freelist.chain, d.freelistPage) {
+			if next == pageNum {
+				return nil, ErrCorruptFreelist
+			}
+		}
+		p, err = d.readPage(next)
+		if err != nil {
+			return nil, err
+		}
+		freelist.chain = append(freelist.chain, next)
+		next, left, err = freelist.deserializeChain(p.data, left, d.meta.version)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return freelist, nil
 }
 
-func (d *dal) writeFreelist() (*page, error) {
-	p := d.allocateEmptyPage()
-	p.num = d.freelistPage
-	d.freelist.serialize(p.data)
-
-	err := d.writePage(p)
+// loadFreelist reads the freelist page and replays the freelist journal of the meta page over it.
+func (d *dal) loadFreelist() (*freelist, error) {
+	freelist, err := d.readFreelist()
 	if err != nil {
 		return nil, err
 	}
-	d.freelistPage = p.num
-	return p, nil
+	freelist.journaling = d.journalFreelist
+	freelist.replay(d.freelistJournal)
+	return freelist, nil
+}
+
+// persistFreelist releases the pages freed by the commit txid, see releaseUnpinned, and makes the freelist part of the
+// next meta page. With JournalFreelist, the changes go to the journal of the meta page while it fits, and the freelist page
+// is only written to make room in the journal.
+func (d *dal) persistFreelist(txid uint64, freed []pgnum) error {
+	// Files with a single meta page have their freelist on page 1, which becomes the second meta page: the freelist
+	// moves to a new page, with a new spare, and has to be written there
+	upgrade := d.freelistSpare == 0 && d.freelistPage == metaPageNumB
+	if upgrade {
+		d.freelistPage = d.getNextPage()
+		d.freelistSpare = d.getNextPage()
+	}
+	// The journal gets an entry for every page released, at most the freed pages and the held ones. It can't tell the
+	// held pages apart from the free ones, so the freelist page is written whenever there are some.
+	journaled := len(d.journal) + len(freed) + len(d.heldPages)
+	held := len(d.heldPages) > 0 || d.heldWritten || d.anyHeld(freed, txid)
+	if !upgrade && !d.freelistRepaired && !held && d.journalFreelist && metaSize+freelistJournalHeaderSize+journaled*pageNumSize+metaTrailerSize <= d.pageSize {
+		d.releaseUnpinned(freed, txid)
+		d.freelistJournal = d.journal
+		return nil
+	}
+
+	// The chain of the freelist written by the last commit stays valid until the meta page of this one is written, so
+	// the new chain is taken before the freed pages are released, along with the old chain, and can't reuse them
+	oldChain := d.chain
+	d.chain = nil
+	grown := d.maxPage
+	free := len(d.releasedPages) + len(freed) + len(d.heldPages) + len(oldChain)
+	for length := chainLength(free, d.pageSize); len(d.chain) < length; length = chainLength(free, d.pageSize) {
+		if len(d.releasedPages) > 0 {
+			free--
+		}
+		d.chain = append(d.chain, d.getNextPage())
+	}
+	d.releaseUnpinned(append(append([]pgnum{}, freed...), oldChain...), txid)
+	// Held pages aren't released, and runs of free pages take fewer words than their pages, so the chain can be longer
+	// than the free pages need. A page dropped from the chain is released, so the chain must have room for it as well
+	d.sortReleased()
+	words := d.freeWords(d.heldPages)
+	for len(d.chain) > chainLength(words+1, d.pageSize) {
+		pageNum := d.chain[len(d.chain)-1]
+		d.chain = d.chain[:len(d.chain)-1]
+		// The pages the chain grew the file by were never written, and go back to the end of the file
+		if pageNum == d.maxPage && pageNum > grown {
+			d.maxPage--
+			continue
+		}
+		d.releasePage(pageNum)
+		words++
+	}
+	d.sortReleased()
+
+	err := d.writeFreelist()
+	if err != nil {
+		return err
+	}
+	d.journal = nil
+	d.freelistJournal = nil
+	d.freelistRepaired = false
+	return nil
+}
+
+// commitState is the state of the dal a commit changes before its meta page is durable, saved by Commit so a commit
+// that fails leaves the dal as the previous commit left it.
+type commitState struct {
+	meta             meta
+	freelist         *freelist
+	heldPages        []pgnum
+	freedBy          map[pgnum]uint64
+	heldWritten      bool
+	freelistRepaired bool
 }
 
+func (d *dal) saveCommitState() *commitState {
+	d.pinMu.Lock()
+	heldPages := append([]pgnum{}, d.heldPages...)
+	freedBy := make(map[pgnum]uint64, len(d.freedBy))
+	for pageNum, txid := range d.freedBy {
+		freedBy[pageNum] = txid
+	}
+	d.pinMu.Unlock()
+	return &commitState{meta: *d.meta, freelist: d.freelist.clone(), heldPages: heldPages, freedBy: freedBy,
+		heldWritten: d.heldWritten, freelistRepaired: d.freelistRepaired}
+}
+
+// restoreCommitState puts back the state saved before a commit, and drops the pages it left to log in WAL mode.
+func (d *dal) restoreCommitState(state *commitState) {
+	*d.meta = state.meta
+	d.freelist = state.freelist
+	d.pinMu.Lock()
+	d.heldPages = state.heldPages
+	d.freedBy = state.freedBy
+	d.unpublished = nil
+	d.pinMu.Unlock()
+	d.heldWritten = state.heldWritten
+	d.freelistRepaired = state.freelistRepaired
+	if d.wal != nil {
+		d.walMu.Lock()
+		d.walPending = map[pgnum][]byte{}
+		d.walMu.Unlock()
+	}
+}
+
+// writeFreelist writes the freelist to the spare freelist page, which becomes the freelist page, so the freelist page
+// of the last commit stays valid until the meta page pointing to the new one is written, and to the pages of its chain.
+// Files with a single meta page have no spare, and the freelist is written over the freelist page.
+func (d *dal) writeFreelist() error {
+	head := d.freelistPage
+	if d.freelistSpare != 0 {
+		head = d.freelistSpare
+	}
+	pages := make([]*page, 1+len(d.chain))
+	bufs := make([][]byte, len(pages))
+	for i := range pages {
+		pages[i] = d.allocateEmptyPage()
+		pages[i].num = head
+		if i > 0 {
+			pages[i].num = d.chain[i-1]
+		}
+		bufs[i] = pages[i].data
+	}
+	err := d.freelist.serialize(bufs, d.heldPages)
+	if err != nil {
+		return err
+	}
+	d.heldWritten = len(d.heldPages) > 0
+
+	for _, p := range pages {
+		err := d.writePage(p)
+		if err != nil {
+			return err
+		}
+	}
+	if d.freelistSpare != 0 {
+		d.freelistSpare = d.freelistPage
+	}
+	d.freelistPage = head
+	return nil
+}
+
+// writeMeta writes the meta to the meta page the last commit didn't write, or to the single meta page of files that
+// only have one.
 func (d *dal) writeMeta(meta *meta) (*page, error) {
 	p := d.allocateEmptyPage()
 	p.num = metaPageNum
+	if meta.freelistSpare != 0 && meta.slot == metaPageNum {
+		p.num = metaPageNumB
+	}
 	meta.serialize(p.data)
 
 	err := d.writePage(p)
 	if err != nil {
 		return nil, err
 	}
+	meta.slot = p.num
+	meta.version = formatVersion
 	return p, nil
 }
 
+// readMeta reads both meta pages and returns the meta of the latest commit, see readMetaPages.
 func (d *dal) readMeta() (*meta, error) {
-	p, err := d.readPage(metaPageNum)
-	if err != nil {
-		return nil, err
+	meta, _, err := d.readMetaSlots()
+	return meta, err
+}
+
+// readMetaSlots reads both meta pages like readMeta, along with the error of each meta page that isn't valid.
+func (d *dal) readMetaSlots() (*meta, [2]error, error) {
+	d.throttle.wait(2 * d.pageSize)
+	return readMetaPages(pageReader{d}, d.pageSize)
+}
+
+// readMetaPages reads both meta pages and returns the valid meta with the highest txid, along with the error of each
+// meta page that isn't valid. Meta pages of files with a single meta page are only valid as the first page, and only
+// if the second one isn't valid, since a torn write can make a meta page look like one of them. A file shorter than the
+// meta pages is read as if it was padded with zeros, so an empty or truncated file fails with ErrNotDBFile, and a file
+// of smaller pages with ErrPageSizeMismatch.
+func readMetaPages(file io.ReaderAt, pageSize int) (*meta, [2]error, error) {
+	var errs [2]error
+	var metas []*meta
+	for i, slot := range []pgnum{metaPageNum, metaPageNumB} {
+		buf := make([]byte, pageSize)
+		_, err := file.ReadAt(buf, int64(slot)*int64(pageSize))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, errs, err
+		}
+		m := newEmptyMeta()
+		err = m.deserialize(buf)
+		if err == nil && slot != metaPageNum && m.version < 5 {
+			err = ErrNotDBFile
+		}
+		// A newer version wrote the meta page, so the other one may hold an older commit
+		if errors.Is(err, ErrUnsupportedFormat) {
+			return nil, errs, err
+		}
+		errs[i] = err
+		if err == nil {
+			m.slot = slot
+			metas = append(metas, m)
+		}
 	}
 
-	meta := newEmptyMeta()
-	meta.deserialize(p.data)
-	return meta, nil
+	var newest *meta
+	for _, m := range metas {
+		if newest == nil || m.newer(newest) {
+			newest = m
+		}
+	}
+	if newest != nil {
+		return newest, errs, nil
+	}
+	for _, err := range errs {
+		if errors.Is(err, ErrPageSizeMismatch) {
+			return nil, errs, err
+		}
+	}
+	return nil, errs, errs[0]
+}
+
+// reservedPages returns the pages the database keeps for itself: the meta pages, the freelist pages and the chain of
+// the freelist.
+func (d *dal) reservedPages() []pgnum {
+	if d.freelistSpare == 0 {
+		return append([]pgnum{metaPageNum, d.freelistPage}, d.chain...)
+	}
+	return append([]pgnum{metaPageNum, metaPageNumB, d.freelistPage, d.freelistSpare}, d.chain...)
+}
+
+// isReserved reports whether the page is one of reservedPages.
+func (d *dal) isReserved(pageNum pgnum) bool {
+	for _, reserved := range d.reservedPages() {
+		if pageNum == reserved {
+			return true
+		}
+	}
+	return false
 }
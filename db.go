@@ -1,35 +1,476 @@
-package main
+// Package gopherdb is an embedded key-value store keeping its collections in B-trees inside a single file. Write
+// transactions are serialized, and read transactions read the last commit as it was when they began, running
+// concurrently with each other and with the write transaction. A read transaction can also be shared by several
+// goroutines, see Tx, and several writers can run at once with optimistic transactions, see OptimisticTx.
+//
+//	db, err := gopherdb.Open("data.db", gopherdb.DefaultOptions)
+//	tx, err := db.WriteTx()
+//	collection, err := tx.CreateCollection([]byte("users"))
+//	err = collection.Put([]byte("alice"), []byte("admin"))
+//	err = tx.Commit()
+//
+// The gopherdb command in cmd/gopherdb inspects and checks database files.
+package gopherdb
 
 import (
+	"errors"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type DB struct {
-	rwlock sync.RWMutex
+	rwlock      *sync.RWMutex
+	accessStats *accessStats
+	triggers    *triggers
+	optimistic  *optimisticState
+	watchers    *watchers
+	shared      *sharedFile
+	// readOnly is set on the extra handles of a file that was already open in the process, see Open, and on standbys
+	// until they're promoted, which can happen while transactions begin.
+	readOnly atomic.Bool
+
+	// closeMu guards closing and closed. Once closing is set, no transaction can begin, so Close only has to wait for
+	// the transactions in inFlight.
+	closeMu  sync.Mutex
+	closing  bool
+	closed   bool
+	inFlight sync.WaitGroup
+	// rebalanceTotals is shared by the handles of the file, like the access stats.
+	rebalanceTotals *rebalanceTotals
+	// quiesced is set while Quiesce holds the lock of write transactions, guarded by quiesceMu.
+	quiesceMu sync.Mutex
+	quiesced  bool
 	*dal
 }
 
+// sharedFile is the registry entry of an open database file, shared by all the handles of the file in the process.
+type sharedFile struct {
+	path    string
+	handles int
+	owner   *DB
+}
+
+// openFiles maps the absolute paths of the open database files to their registry entries.
+var openFiles = struct {
+	sync.Mutex
+	byPath map[string]*sharedFile
+}{byPath: map[string]*sharedFile{}}
+
+// registryPath returns the path a file is registered under, which is the same for every path pointing to the file.
+func registryPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved, nil
+	}
+	return abs, nil
+}
+
+// Open opens the database file, creating it if it doesn't exist. A file can be opened several times within a process:
+// the first handle owns the file, and the next ones are read-only views of it sharing the same file, pages and lock, so
+// their transactions see the commits of the owner. The options of the views are ignored, and write transactions of a
+// view fail to begin with ErrWriteInsideReadTx. The file is closed once every handle is closed.
+//
+// The file is locked while it's open, so Open fails with ErrDatabaseLocked if another process has it open, instead of
+// replaying and removing the WAL that process is still writing, once Options.LockTimeout runs out.
 func Open(path string, options *Options) (*DB, error) {
 	var err error
-	options.pageSize = os.Getpagesize()
-	dal, err := newDal(path, options)
+	key, err := registryPath(path)
+	if err != nil {
+		return nil, err
+	}
+	openFiles.Lock()
+	defer openFiles.Unlock()
+	if shared, ok := openFiles.byPath[key]; ok {
+		shared.handles++
+		owner := shared.owner
+		view := &DB{rwlock: owner.rwlock, accessStats: owner.accessStats, triggers: owner.triggers, optimistic: owner.optimistic, watchers: owner.watchers, shared: shared, rebalanceTotals: owner.rebalanceTotals, dal: owner.dal}
+		view.readOnly.Store(true)
+		return view, nil
+	}
+
+	// The options are copied, so DefaultOptions can be passed as it is
+	opts := *options
+	if opts.pageSize == 0 {
+		opts.pageSize = os.Getpagesize()
+	}
+	dal, err := newDal(path, &opts)
 	if err != nil {
 		return nil, err
 	}
-	return &DB{sync.RWMutex{}, dal}, nil
+	db, err := newDB(dal, &opts, &sharedFile{path: key, handles: 1})
+	if err != nil {
+		return nil, err
+	}
+	openFiles.byPath[key] = db.shared
+	return db, nil
 }
+
+// newDB returns the owner handle of the file of the dal, once the file is repaired and verified, see Open. It closes the
+// file if it fails.
+func newDB(dal *dal, opts *Options, shared *sharedFile) (*DB, error) {
+	db := &DB{rwlock: &sync.RWMutex{}, accessStats: newAccessStats(), triggers: newTriggers(), optimistic: newOptimisticState(), watchers: newWatchers(), shared: shared, rebalanceTotals: &rebalanceTotals{}, dal: dal}
+	shared.owner = db
+	db.readOnly.Store(opts.ReadOnly)
+	if dal.recovery != nil && !opts.inspect && !opts.ReadOnly {
+		db.repairFreelist()
+	}
+	dal.publishState()
+	if !opts.inspect {
+		err := db.loadCheckpoints()
+		if err == nil {
+			err = db.verify(opts.VerifyOnOpen)
+		}
+		if err != nil {
+			_ = dal.close()
+			return nil, err
+		}
+	}
+	dal.logRecovery(shared.path)
+	dal.logger.Info("gopherdb: opened the file", "path", shared.path, "txid", dal.txid, "page_size", dal.pageSize,
+		"read_only", opts.ReadOnly)
+	return db, nil
+}
+
+// Close closes the handle. New transactions are rejected with ErrDatabaseClosed right away, and Close waits for the
+// transactions in flight to end, for at most Options.CloseTimeout if it's set. When the timeout runs out, Close returns
+// ErrCloseTimeout and leaves the handle open, so the running transactions can still end and Close can be called again.
+// The file is synced and closed with the last handle of the process.
 func (db *DB) Close() error {
+	db.closeMu.Lock()
+	if db.closed {
+		db.closeMu.Unlock()
+		return nil
+	}
+	db.closing = true
+	db.closeMu.Unlock()
+
+	err := db.drain()
+	if err != nil {
+		return err
+	}
+	return db.release(true)
+}
+
+// drain waits for the transactions in flight to end.
+func (db *DB) drain() error {
+	done := make(chan struct{})
+	go func() {
+		db.inFlight.Wait()
+		close(done)
+	}()
+	if db.closeTimeout <= 0 {
+		<-done
+		return nil
+	}
+
+	timer := time.NewTimer(db.closeTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		return ErrCloseTimeout
+	}
+}
+
+// abandon closes the handle without waiting for its transactions or syncing the file, like a process dying in the
+// middle of them would. The model checker simulates crashes with it.
+func (db *DB) abandon() error {
+	db.closeMu.Lock()
+	if db.closed {
+		db.closeMu.Unlock()
+		return nil
+	}
+	db.closing = true
+	db.closeMu.Unlock()
+	return db.release(false)
+}
+
+// release unregisters the handle and closes the file if it was the last handle.
+func (db *DB) release(syncFile bool) error {
+	openFiles.Lock()
+	defer openFiles.Unlock()
+	db.closeMu.Lock()
+	defer db.closeMu.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	db.shared.handles--
+	if db.shared.handles > 0 {
+		return nil
+	}
+	delete(openFiles.byPath, db.shared.path)
+
+	// A file opened with Options.ReadOnly is closed as it is
+	if db.dal.readOnly {
+		syncFile = false
+	}
+	if syncFile && db.file != nil {
+		err := db.markClean(db.shared.owner.readOnly.Load())
+		if err != nil {
+			_ = db.close()
+			return err
+		}
+		err = db.closeWAL()
+		if err != nil {
+			_ = db.close()
+			return err
+		}
+		err = db.ship()
+		if err != nil {
+			_ = db.close()
+			return err
+		}
+	}
+	if syncFile && db.file != nil {
+		err := db.file.Sync()
+		if err != nil {
+			_ = db.close()
+			return err
+		}
+	}
+	db.logger.Info("gopherdb: closed the file", "path", db.shared.path, "txid", db.txid)
 	return db.close()
 }
 
-func (db *DB) ReadTx() *tx {
+// Sync syncs the file, making the commits so far durable. Commits sync the file themselves unless Options.NoSync is
+// set, so it's only needed with NoSync, for example at the end of a bulk load.
+func (db *DB) Sync() error {
+	err := db.begin()
+	if err != nil {
+		return err
+	}
 	db.rwlock.RLock()
-	return newTx(db, false)
+	defer db.endTx(false)
+	return db.file.Sync()
 }
 
-func (db *DB) WriteTx() *tx {
+// Quiesce waits for the write transaction running, then makes the file complete on its own, with the WAL copied to it
+// in WAL mode, and synced. Write transactions wait from then on until Resume, so the file doesn't change and a
+// snapshot of it taken by the filesystem or the volume is a file Open takes as it is, like after a crash. Read
+// transactions keep running. Quiesce waits while the handle is quiesced, and Close waits for Resume.
+func (db *DB) Quiesce() error {
+	if db.readOnly.Load() {
+		return ErrWriteInsideReadTx
+	}
+	err := db.begin()
+	if err != nil {
+		return err
+	}
 	db.rwlock.Lock()
-	return newTx(db, true)
+	err = db.checkpointWAL()
+	if err == nil {
+		err = db.file.Sync()
+	}
+	if err != nil {
+		db.endTx(true)
+		return err
+	}
+	db.quiesceMu.Lock()
+	db.quiesced = true
+	db.quiesceMu.Unlock()
+	return nil
 }
 
+// Resume lets write transactions run again after Quiesce. It does nothing if the handle isn't quiesced.
+func (db *DB) Resume() {
+	db.quiesceMu.Lock()
+	quiesced := db.quiesced
+	db.quiesced = false
+	db.quiesceMu.Unlock()
+	if quiesced {
+		db.endTx(true)
+	}
+}
+
+// ReadOnly reports whether the handle is read-only: a view of a file opened earlier in the process, a standby, or a
+// file opened with Options.ReadOnly.
+func (db *DB) ReadOnly() bool {
+	return db.readOnly.Load()
+}
+
+// begin registers a transaction about to begin, unless the handle is closing.
+func (db *DB) begin() error {
+	db.closeMu.Lock()
+	defer db.closeMu.Unlock()
+	if db.closing {
+		return ErrDatabaseClosed
+	}
+	db.inFlight.Add(1)
+	return nil
+}
+
+// ReadTx begins a read transaction on the last commit, which it sees as it was when it began while write transactions
+// run and commit, see snapshot.go. It doesn't wait for the write transaction running, and doesn't hold up the next
+// ones, so it can also be begun by a goroutine running a write transaction, whose changes it doesn't see. The pages
+// freed by the commits made while it runs are only reused once it ends, so a long read transaction makes the file grow
+// under a steady stream of writes.
+func (db *DB) ReadTx() (*Tx, error) {
+	err := db.begin()
+	if err != nil {
+		return nil, err
+	}
+	state := db.addReader()
+	tx := newTx(db, false, state.txid, state.root)
+	tx.snapshot = &state
+	return tx, nil
+}
+
+// WriteTx begins a write transaction. It fails with ErrWriteInsideReadTx on read-only handles, see DB.ReadOnly.
+func (db *DB) WriteTx() (*Tx, error) {
+	if db.readOnly.Load() {
+		return nil, ErrWriteInsideReadTx
+	}
+	err := db.begin()
+	if err != nil {
+		return nil, err
+	}
+	// Only the transactions that have to wait for the lock count in the queue of the soft limits
+	if !db.rwlock.TryLock() {
+		db.waitForWrite(true)
+		db.deliverSoftLimits()
+		db.rwlock.Lock()
+		db.waitForWrite(false)
+	}
+	tx := newTx(db, true, db.txid+1, db.root)
+	if db.optimistic.tracking() {
+		tx.writes = newWriteSet()
+	}
+	return tx, nil
+}
+
+// Update runs fn in a write transaction, which is committed if fn returns nil and rolled back if it returns an error
+// or panics. The error of fn or of Commit is returned, and a panic is raised again once the transaction is rolled
+// back, so the lock is never left held.
+//
+// A write transaction holds the write lock, so it doesn't conflict with other transactions, but fn can find that
+// something it depends on changed, like a value read in an earlier transaction, and return ErrConflict or an error
+// wrapping it. With Options.UpdateAttempts set, Update then runs fn again in a new transaction, up to that many times
+// in all, and fn can tell the attempts apart with Tx.Attempt. Transactions that conflict on their own, and are run
+// again until they don't, are the ones of DB.Optimistic and DB.Serializable.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	for retries := 0; ; retries++ {
+		tx, err := db.WriteTx()
+		if err != nil {
+			return err
+		}
+		tx.retries = retries
+		err = runManaged(tx, fn)
+		if !errors.Is(err, ErrConflict) || retries+1 >= db.updateAttempts {
+			return err
+		}
+	}
+}
+
+// Attempt returns the number of the attempt DB.Update is running the transaction for, starting at 1. It's 1 for the
+// transactions not run by Update.
+func (tx *Tx) Attempt() int {
+	return tx.retries + 1
+}
+
+// update runs fn in a write transaction like Update, once whatever Options.UpdateAttempts is. It's what the
+// transactions that retry on their own run each attempt in, like OptimisticTx.Commit.
+func (db *DB) update(fn func(tx *Tx) error) error {
+	tx, err := db.WriteTx()
+	if err != nil {
+		return err
+	}
+	return runManaged(tx, fn)
+}
+
+// View runs fn in a read transaction, which is ended when fn returns or panics. The error of fn is returned.
+func (db *DB) View(fn func(tx *Tx) error) error {
+	tx, err := db.ReadTx()
+	if err != nil {
+		return err
+	}
+	return runManaged(tx, fn)
+}
+
+// Get returns a copy of the value of the key in the collection, or ErrKeyNotFound if the key or the collection doesn't
+// exist. It reads the last commit in a read transaction of its own, so it doesn't wait for the write transaction
+// running.
+func (db *DB) Get(collection []byte, key []byte) ([]byte, error) {
+	var value []byte
+	err := db.View(func(tx *Tx) error {
+		c, err := tx.GetCollection(collection)
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			return ErrKeyNotFound
+		}
+		value, err = c.Get(key)
+		return err
+	})
+	return value, err
+}
+
+// Put sets the value of the key in the collection, which is created if it doesn't exist, in a write transaction of its
+// own. Many keys are better put in a single transaction, since every commit writes and syncs the file.
+func (db *DB) Put(collection []byte, key []byte, value []byte) error {
+	return db.Update(func(tx *Tx) error {
+		c, err := tx.getOrCreateCollection(collection)
+		if err != nil {
+			return err
+		}
+		return c.Put(key, value)
+	})
+}
+
+func runManaged(tx *Tx, fn func(tx *Tx) error) error {
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+	// Commit ends the transaction even when it fails
+	committed = true
+	return tx.Commit()
+}
+
+// DebugTx begins a read transaction on the last commit written to the file, for inspecting a database whose
+// transactions are stuck, like one held open by a wedged process. It's unsafe: it takes no lock and isn't counted by
+// Close, so it doesn't wait for a stuck write transaction, but it also doesn't stop a running commit from overwriting
+// the pages it reads. It may see a half written commit, fail to read nodes, or read a file closed under it. The dirty
+// nodes of transactions in the process aren't visible, only what's on disk.
+//
+// It works on closed and closing handles as long as the file is open. Commit and Rollback only end it.
+func (db *DB) DebugTx() (*Tx, error) {
+	meta, err := db.readMeta()
+	if err != nil {
+		return nil, err
+	}
+	tx := newTx(db, false, meta.txid, meta.root)
+	tx.debug = true
+	return tx, nil
+}
+
+// endRead ends a read transaction of the commit txid.
+func (db *DB) endRead(txid uint64) {
+	db.removeReader(txid)
+	db.inFlight.Done()
+}
+
+// endTx releases the lock of a write transaction, or of the operations waiting for it to end, and marks it as ended.
+func (db *DB) endTx(write bool) {
+	if write {
+		db.rwlock.Unlock()
+	} else {
+		db.rwlock.RUnlock()
+	}
+	db.inFlight.Done()
+}
@@ -0,0 +1,578 @@
+package gopherdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testOptions returns a copy of the default options with small pages, which give deep trees with few keys.
+func testOptions() *Options {
+	options := *DefaultOptions
+	options.pageSize = 512
+	return &options
+}
+
+// openTestDB opens a new database in a temporary directory, closed when the test ends.
+func openTestDB(t *testing.T, options *Options) *DB {
+	t.Helper()
+	return openTestPath(t, filepath.Join(t.TempDir(), "test.db"), options)
+}
+
+func openTestPath(t *testing.T, path string, options *Options) *DB {
+	t.Helper()
+	if options == nil {
+		options = testOptions()
+	}
+	db, err := Open(path, options)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+// mustUpdate runs fn in a write transaction and fails the test if it returns an error.
+func mustUpdate(t *testing.T, db *DB, fn func(tx *Tx) error) {
+	t.Helper()
+	if err := db.Update(fn); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+}
+
+// mustView runs fn in a read transaction and fails the test if it returns an error.
+func mustView(t *testing.T, db *DB, fn func(tx *Tx) error) {
+	t.Helper()
+	if err := db.View(fn); err != nil {
+		t.Fatalf("View: %v", err)
+	}
+}
+
+// getOrCreate returns the collection, creating it in the write transaction if it doesn't exist.
+func getOrCreate(t *testing.T, tx *Tx, name string) *Collection {
+	t.Helper()
+	collection, err := tx.GetCollection([]byte(name))
+	if err != nil {
+		t.Fatalf("GetCollection: %v", err)
+	}
+	if collection == nil {
+		collection, err = tx.CreateCollection([]byte(name))
+		if err != nil {
+			t.Fatalf("CreateCollection: %v", err)
+		}
+	}
+	return collection
+}
+
+func TestReadOnlyOpenNeverWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	options.WAL = true
+	db := openTestPath(t, path, options)
+	putValue(t, db, "c", "k", "v")
+	// The commit is only in the WAL, as after a crash
+	if err := db.abandon(); err != nil {
+		t.Fatalf("abandon: %v", err)
+	}
+	file, wal := readFile(t, path), readFile(t, walPath(path))
+
+	readOnly := testOptions()
+	readOnly.ReadOnly = true
+	db = openTestPath(t, path, readOnly)
+	if !db.ReadOnly() {
+		t.Error("ReadOnly: got false for a file opened with Options.ReadOnly")
+	}
+	if got := getValue(t, db, "c", "k"); got != "v" {
+		t.Errorf("value logged in the WAL: got %q, want v", got)
+	}
+	err := db.Update(func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil {
+			return err
+		}
+		return c.Put([]byte("k"), []byte("w"))
+	})
+	if !errors.Is(err, ErrWriteInsideReadTx) {
+		t.Errorf("Put: got %v, want ErrWriteInsideReadTx", err)
+	}
+	if err := db.CheckpointWAL(); !errors.Is(err, ErrWriteInsideReadTx) {
+		t.Errorf("CheckpointWAL: got %v, want ErrWriteInsideReadTx", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !bytes.Equal(readFile(t, path), file) {
+		t.Error("the file changed")
+	}
+	if !bytes.Equal(readFile(t, walPath(path)), wal) {
+		t.Error("the WAL changed")
+	}
+}
+
+func TestReadOnlyOpenWithoutLockOfALockedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPath(t, path, nil)
+	putValue(t, db, "c", "k", "v")
+
+	// Another process opens the file read-only, without the registry of this one
+	readOnly := testOptions()
+	readOnly.ReadOnly = true
+	readOnly.NoLock = true
+	d, err := newDal(path, readOnly)
+	if err != nil {
+		t.Fatalf("newDal read-only of a file open for writing: %v", err)
+	}
+	if err := d.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if got := getValue(t, db, "c", "k"); got != "v" {
+		t.Errorf("value: got %q, want v", got)
+	}
+}
+
+func TestReadOnlyOpenOfAMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	options.ReadOnly = true
+	if _, err := Open(path, options); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Open: got %v, want os.ErrNotExist", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat: got %v, want the file not to be created", err)
+	}
+}
+
+func TestReadOnlyOpenOfAFileWithoutWritePermission(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPath(t, path, nil)
+	putValue(t, db, "c", "k", "v")
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := os.Chmod(path, 0444); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+
+	options := testOptions()
+	options.ReadOnly = true
+	db = openTestPath(t, path, options)
+	if got := getValue(t, db, "c", "k"); got != "v" {
+		t.Errorf("value: got %q, want v", got)
+	}
+	if err := db.Put([]byte("c"), []byte("k"), []byte("w")); !errors.Is(err, ErrWriteInsideReadTx) {
+		t.Errorf("Put: got %v, want ErrWriteInsideReadTx", err)
+	}
+}
+
+func readFile(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	return data
+}
+
+func TestOpenUsesTheConfiguredPageSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	db := openTestPath(t, path, options)
+	if db.pageSize != options.pageSize {
+		t.Errorf("page size: got %d, want %d", db.pageSize, options.pageSize)
+	}
+	putValue(t, db, "c", "k", "v")
+	maxPage := db.maxPage
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if size := len(readFile(t, path)); size != (int(maxPage)+1)*options.pageSize {
+		t.Errorf("file size: got %d, want %d pages of %d bytes", size, maxPage+1, options.pageSize)
+	}
+	checkFile(t, path, options)
+}
+
+func TestOpenTwiceReturnsAReadOnlyView(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	owner := openTestPath(t, path, nil)
+	if err := os.Symlink(path, filepath.Join(dir, "link.db")); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	// The options of the view are ignored, and a symlink to the file opens the same file
+	view := openTestPath(t, filepath.Join(dir, "link.db"), DefaultOptions)
+	if owner.ReadOnly() || !view.ReadOnly() {
+		t.Errorf("ReadOnly: got %v for the owner and %v for the view, want false and true", owner.ReadOnly(), view.ReadOnly())
+	}
+
+	putValue(t, owner, "c", "k", "v")
+	if value := getValue(t, view, "c", "k"); value != "v" {
+		t.Errorf("the view reads %q, want the v committed by the owner", value)
+	}
+	err := view.Update(func(tx *Tx) error {
+		return getOrCreate(t, tx, "c").Put([]byte("k"), []byte("from the view"))
+	})
+	if !errors.Is(err, ErrWriteInsideReadTx) {
+		t.Errorf("Put through the view: got %v, want ErrWriteInsideReadTx", err)
+	}
+	if tx, err := view.WriteTx(); tx != nil || !errors.Is(err, ErrWriteInsideReadTx) {
+		t.Errorf("WriteTx of the view: got %v and %v, want ErrWriteInsideReadTx", tx, err)
+	}
+
+	// The file stays open until its last handle is closed
+	if err := owner.Close(); err != nil {
+		t.Fatalf("Close of the owner: %v", err)
+	}
+	if value := getValue(t, view, "c", "k"); value != "v" {
+		t.Errorf("the view reads %q after the owner closed, want v", value)
+	}
+	if err := view.Close(); err != nil {
+		t.Fatalf("Close of the view: %v", err)
+	}
+
+	db := openTestPath(t, path, nil)
+	if db.ReadOnly() {
+		t.Error("the file opened after every handle closed is read-only")
+	}
+	putValue(t, db, "c", "k", "new")
+}
+
+func TestCloseDrainsTransactions(t *testing.T) {
+	db := openTestDB(t, nil)
+	tx, err := db.ReadTx()
+	if err != nil {
+		t.Fatalf("ReadTx: %v", err)
+	}
+	closed := make(chan error)
+	go func() { closed <- db.Close() }()
+
+	// Once Close started, new transactions are rejected while the one in flight keeps running
+	for {
+		other, err := db.ReadTx()
+		if errors.Is(err, ErrDatabaseClosed) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadTx: %v", err)
+		}
+		other.Rollback()
+	}
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned %v before the transaction ended", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	tx.Rollback()
+	if err := <-closed; err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := db.Update(func(tx *Tx) error { return nil }); !errors.Is(err, ErrDatabaseClosed) {
+		t.Errorf("Update after Close: got %v, want ErrDatabaseClosed", err)
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	options := testOptions()
+	options.CloseTimeout = 10 * time.Millisecond
+	db := openTestDB(t, options)
+	tx, err := db.WriteTx()
+	if err != nil {
+		t.Fatalf("WriteTx: %v", err)
+	}
+	if err := getOrCreate(t, tx, "c").Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := db.Close(); !errors.Is(err, ErrCloseTimeout) {
+		t.Fatalf("Close with a transaction in flight: got %v, want ErrCloseTimeout", err)
+	}
+	// The handle is still open, so the transaction can end and Close can be called again
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit after the timeout: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close after the transaction ended: %v", err)
+	}
+}
+
+func TestDebugTxReadsWhileAWriteIsStuck(t *testing.T) {
+	db := openTestDB(t, nil)
+	putValue(t, db, "c", "k", "committed")
+
+	stuck, err := db.WriteTx()
+	if err != nil {
+		t.Fatalf("WriteTx: %v", err)
+	}
+	if err := getOrCreate(t, stuck, "c").Put([]byte("k"), []byte("not committed")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	closed := make(chan error)
+	go func() { closed <- db.Close() }()
+
+	// Neither the write lock nor the closing handle stop it, and it only sees what's on disk
+	for i := 0; i < 2; i++ {
+		tx, err := db.DebugTx()
+		if err != nil {
+			t.Fatalf("DebugTx: %v", err)
+		}
+		c := getOrCreate(t, tx, "c")
+		if value, err := c.Get([]byte("k")); err != nil || string(value) != "committed" {
+			t.Errorf("Get in the debug transaction: got %q, %v, want committed", value, err)
+		}
+		if err := c.Put([]byte("k"), []byte("debug")); !errors.Is(err, ErrWriteInsideReadTx) {
+			t.Errorf("Put in the debug transaction: got %v, want ErrWriteInsideReadTx", err)
+		}
+		// Ending it releases nothing, so the stuck transaction still holds the lock and Close still waits for it
+		if i == 0 {
+			tx.Rollback()
+		} else if err := tx.Commit(); err != nil {
+			t.Errorf("Commit of the debug transaction: %v", err)
+		}
+	}
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned %v before the stuck transaction ended", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	stuck.Rollback()
+	if err := <-closed; err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestUpdateAndViewEndTheirTransactions(t *testing.T) {
+	options := testOptions()
+	// A transaction left open must not hang the test in Close
+	options.CloseTimeout = time.Second
+	db := openTestDB(t, options)
+	errFailed := errors.New("failed")
+	// write fails the test if a transaction left open keeps the next write from taking the lock
+	write := func(value string) {
+		t.Helper()
+		done := make(chan error)
+		go func() {
+			done <- db.Update(func(tx *Tx) error {
+				c, err := tx.getOrCreateCollection([]byte("c"))
+				if err != nil {
+					return err
+				}
+				return c.Put([]byte("k"), []byte(value))
+			})
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Update: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("a transaction is still holding the lock")
+		}
+	}
+
+	// A failing Update rolls back
+	err := db.Update(func(tx *Tx) error {
+		if err := getOrCreate(t, tx, "c").Put([]byte("k"), []byte("rolled back")); err != nil {
+			return err
+		}
+		return errFailed
+	})
+	if !errors.Is(err, errFailed) {
+		t.Errorf("Update: got %v, want the error of fn", err)
+	}
+	if value := getValue(t, db, "c", "k"); value != "" {
+		t.Errorf("the failed Update wrote %q", value)
+	}
+
+	// A panic is raised again once the transaction is rolled back
+	func() {
+		defer func() {
+			if r := recover(); r != errFailed {
+				t.Errorf("recovered %v, want the panic of fn", r)
+			}
+		}()
+		_ = db.Update(func(tx *Tx) error {
+			if err := getOrCreate(t, tx, "c").Put([]byte("k"), []byte("panicked")); err != nil {
+				return err
+			}
+			panic(errFailed)
+		})
+	}()
+	write("after the panic of Update")
+	func() {
+		defer func() { recover() }()
+		_ = db.View(func(tx *Tx) error { panic(errFailed) })
+	}()
+	write("after the panic of View")
+
+	if err := db.View(func(tx *Tx) error { return errFailed }); !errors.Is(err, errFailed) {
+		t.Errorf("View: got %v, want the error of fn", err)
+	}
+	if value := getValue(t, db, "c", "k"); value != "after the panic of View" {
+		t.Errorf("got %q, want the value of the last write", value)
+	}
+}
+
+func TestUpdateRetriesOnConflict(t *testing.T) {
+	options := testOptions()
+	options.UpdateAttempts = 3
+	db := openTestDB(t, options)
+	var attempts []int
+	err := db.Update(func(tx *Tx) error {
+		attempts = append(attempts, tx.Attempt())
+		if err := getOrCreate(t, tx, "c").Put([]byte("k"), []byte(fmt.Sprint(tx.Attempt()))); err != nil {
+			return err
+		}
+		if tx.Attempt() < 2 {
+			return fmt.Errorf("stale read: %w", ErrConflict)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if fmt.Sprint(attempts) != "[1 2]" {
+		t.Errorf("attempts: got %v, want [1 2]", attempts)
+	}
+	if value := getValue(t, db, "c", "k"); value != "2" {
+		t.Errorf("got %q, want the value of the second attempt", value)
+	}
+
+	// The conflict of the last attempt is returned
+	attempts = nil
+	err = db.Update(func(tx *Tx) error {
+		attempts = append(attempts, tx.Attempt())
+		return ErrConflict
+	})
+	if !errors.Is(err, ErrConflict) || len(attempts) != 3 {
+		t.Errorf("Update: got %v after %d attempts, want ErrConflict after 3", err, len(attempts))
+	}
+
+	// Without UpdateAttempts, fn runs once
+	db = openTestDB(t, nil)
+	attempts = nil
+	err = db.Update(func(tx *Tx) error {
+		attempts = append(attempts, tx.Attempt())
+		return ErrConflict
+	})
+	if !errors.Is(err, ErrConflict) || len(attempts) != 1 {
+		t.Errorf("Update: got %v after %d attempts, want ErrConflict after 1", err, len(attempts))
+	}
+}
+
+func TestNoSyncCommitsAreKeptByClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	options.NoSync = true
+	db := openTestPath(t, path, options)
+	for i := 0; i < 50; i++ {
+		putValue(t, db, "c", string(testKey(i)), "value")
+	}
+	// Sync makes the commits durable in the middle of a bulk load, and runs alongside readers
+	tx, err := db.ReadTx()
+	if err != nil {
+		t.Fatalf("ReadTx: %v", err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Errorf("Sync: %v", err)
+	}
+	tx.Rollback()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := db.Sync(); !errors.Is(err, ErrDatabaseClosed) {
+		t.Errorf("Sync after Close: got %v, want ErrDatabaseClosed", err)
+	}
+	checkFile(t, path, options)
+
+	db = openTestPath(t, path, testOptions())
+	if value := getValue(t, db, "c", string(testKey(49))); value != "value" {
+		t.Errorf("the last commit without syncs: got %q after reopening", value)
+	}
+	if db.recovery != nil {
+		t.Errorf("the file wasn't closed cleanly: %+v", db.recovery)
+	}
+}
+
+func TestGetAndPutOfSingleKeys(t *testing.T) {
+	db := openTestDB(t, nil)
+	if _, err := db.Get([]byte("c"), []byte("k")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get in a missing collection: got %v, want ErrKeyNotFound", err)
+	}
+	if err := db.Put([]byte("c"), []byte("k"), []byte("v")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	value, err := db.Get([]byte("c"), []byte("k"))
+	if err != nil || string(value) != "v" {
+		t.Errorf("Get: got %q, %v, want v", value, err)
+	}
+	if _, err := db.Get([]byte("c"), []byte("other")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get of a missing key: got %v, want ErrKeyNotFound", err)
+	}
+
+	// Get reads the last commit without waiting for the write transaction running
+	tx, err := db.WriteTx()
+	if err != nil {
+		t.Fatalf("WriteTx: %v", err)
+	}
+	if err := getOrCreate(t, tx, "c").Put([]byte("k"), []byte("uncommitted")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	value, err = db.Get([]byte("c"), []byte("k"))
+	if err != nil || string(value) != "v" {
+		t.Errorf("Get during a write transaction: got %q, %v, want v", value, err)
+	}
+	tx.Rollback()
+}
+
+func TestQuiesceKeepsTheFileCompleteUntilResume(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	options := testOptions()
+	options.WAL = true
+	options.NoSync = true
+	db := openTestPath(t, path, options)
+	for i := 0; i < 20; i++ {
+		putValue(t, db, "c", string(testKey(i)), "v")
+	}
+
+	err := db.Quiesce()
+	if err != nil {
+		t.Fatalf("Quiesce: %v", err)
+	}
+	committed := make(chan struct{})
+	go func() {
+		putValue(t, db, "c", "late", "v")
+		close(committed)
+	}()
+	// Only the file is copied, since snapshots of the WAL aren't needed
+	snapshot := filepath.Join(dir, "snapshot.db")
+	err = os.WriteFile(snapshot, readFile(t, path), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := getValue(t, db, "c", string(testKey(0))); got != "v" {
+		t.Fatalf("read while quiesced: got %q", got)
+	}
+	select {
+	case <-committed:
+		t.Fatal("a write transaction committed while quiesced")
+	case <-time.After(20 * time.Millisecond):
+	}
+	db.Resume()
+	<-committed
+	db.Resume()
+
+	checkFile(t, snapshot, testOptions())
+	copied := openTestPath(t, snapshot, testOptions())
+	for i := 0; i < 20; i++ {
+		if got := getValue(t, copied, "c", string(testKey(i))); got != "v" {
+			t.Fatalf("key %d of the snapshot: got %q", i, got)
+		}
+	}
+	if got := getValue(t, db, "c", "late"); got != "v" {
+		t.Fatalf("the write after Resume: got %q", got)
+	}
+}
@@ -0,0 +1,133 @@
+package gopherdb
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats are the counters of the activity of the file since it was opened, along with its size as of the last commit,
+// see DB.Stats. The counters are shared by the handles of the file and kept in memory only.
+type Stats struct {
+	// ReadTxs and WriteTxs count the transactions begun, including the ones the database begins for itself, like
+	// the ones of DB.Snapshot. Commits counts the write transactions committed, and Rollbacks the ones rolled back,
+	// explicitly or by a commit that failed.
+	ReadTxs   uint64
+	WriteTxs  uint64
+	Commits   uint64
+	Rollbacks uint64
+	// PagesAllocated and PagesFreed count the pages the commits took from the freelist or from the end of the file, and
+	// the ones they gave back to the freelist.
+	PagesAllocated uint64
+	PagesFreed     uint64
+	// Rebalance counts the splits and merges of the nodes, see DB.RebalanceStats.
+	Rebalance RebalanceStats
+	// BytesRead and BytesWritten count the bytes of the pages read from the file and written to it, or to the WAL in
+	// WAL mode. The pages found in the node cache or in the WAL aren't read.
+	BytesRead    uint64
+	BytesWritten uint64
+	// CommitLatency is the distribution of how long the commits took.
+	CommitLatency LatencyHistogram
+	// FileSize is the size of the pages of the last commit in bytes, and FreePages the length of its freelist.
+	FileSize  int64
+	FreePages int
+}
+
+// commitLatencyBounds are the upper bounds of the buckets of Stats.CommitLatency, from commits of a page or two with
+// NoSync to commits of a bulk load on a slow disk.
+var commitLatencyBounds = []time.Duration{
+	100 * time.Microsecond, 250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// LatencyHistogram counts durations in buckets like the histograms of Prometheus: Counts[i] is the number of
+// durations up to Bounds[i], so the counts only grow with i, and Count is the number of durations, which Sum adds up.
+type LatencyHistogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+// latencyHistogram is a LatencyHistogram being filled, with the count of every bucket on its own.
+type latencyHistogram struct {
+	mu      sync.Mutex
+	buckets []uint64
+	count   uint64
+	sum     time.Duration
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(commitLatencyBounds))
+	}
+	for i, bound := range commitLatencyBounds {
+		if d <= bound {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += d
+}
+
+func (h *latencyHistogram) snapshot() LatencyHistogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	snapshot := LatencyHistogram{
+		Bounds: append([]time.Duration{}, commitLatencyBounds...),
+		Counts: make([]uint64, len(commitLatencyBounds)),
+		Count:  h.count,
+		Sum:    h.sum,
+	}
+	var cumulative uint64
+	for i := range snapshot.Counts {
+		if h.buckets != nil {
+			cumulative += h.buckets[i]
+		}
+		snapshot.Counts[i] = cumulative
+	}
+	return snapshot
+}
+
+// dalCounters are the counters of Stats kept as the file is used.
+type dalCounters struct {
+	readTxs        atomic.Uint64
+	writeTxs       atomic.Uint64
+	commits        atomic.Uint64
+	rollbacks      atomic.Uint64
+	pagesAllocated atomic.Uint64
+	pagesFreed     atomic.Uint64
+	bytesRead      atomic.Uint64
+	bytesWritten   atomic.Uint64
+	commitLatency  latencyHistogram
+}
+
+// Stats returns the counters of the file. It reads no page, so it can be called as often as needed, and it doesn't
+// wait for the transactions running, whose changes it counts once they're committed.
+func (db *DB) Stats() Stats {
+	c := &db.counters
+	stats := Stats{
+		ReadTxs:        c.readTxs.Load(),
+		WriteTxs:       c.writeTxs.Load(),
+		Commits:        c.commits.Load(),
+		Rollbacks:      c.rollbacks.Load(),
+		PagesAllocated: c.pagesAllocated.Load(),
+		PagesFreed:     c.pagesFreed.Load(),
+		Rebalance:      db.RebalanceStats(),
+		BytesRead:      c.bytesRead.Load(),
+		BytesWritten:   c.bytesWritten.Load(),
+		CommitLatency:  c.commitLatency.snapshot(),
+	}
+	db.pinMu.Lock()
+	state := db.committed
+	db.pinMu.Unlock()
+	stats.FileSize = (int64(state.maxPage) + 1) * int64(db.pageSize)
+	stats.FreePages = state.freePages
+	return stats
+}
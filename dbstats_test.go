@@ -0,0 +1,52 @@
+package gopherdb
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	db := openTestDB(t, nil)
+	before := db.Stats()
+	if before.FileSize == 0 || before.Commits != 0 {
+		t.Fatalf("got %+v for a new file", before)
+	}
+
+	for i := 0; i < 200; i++ {
+		putValue(t, db, "c", string(testKey(i)), "value")
+	}
+	err := db.Update(func(tx *Tx) error {
+		return errors.New("rolled back")
+	})
+	if err == nil {
+		t.Fatal("the failing update succeeded")
+	}
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i := 0; i < 150; i++ {
+			if err := c.Remove(testKey(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	getValue(t, db, "c", string(testKey(199)))
+
+	stats := db.Stats()
+	if stats.WriteTxs-before.WriteTxs != 202 || stats.Commits != 201 || stats.Rollbacks != 1 {
+		t.Fatalf("got %d write transactions, %d commits and %d rollbacks", stats.WriteTxs-before.WriteTxs, stats.Commits,
+			stats.Rollbacks)
+	}
+	if stats.ReadTxs <= before.ReadTxs {
+		t.Fatal("the read transaction wasn't counted")
+	}
+	if stats.PagesAllocated == 0 || stats.PagesFreed == 0 || stats.Rebalance.Splits == 0 || stats.Rebalance.Merges == 0 {
+		t.Fatalf("got %+v after splits and merges", stats)
+	}
+	if stats.BytesWritten < stats.PagesAllocated*512 || stats.BytesRead == 0 {
+		t.Fatalf("got %d bytes written for %d pages, and %d read", stats.BytesWritten, stats.PagesAllocated, stats.BytesRead)
+	}
+	if stats.FileSize <= before.FileSize || stats.FreePages == 0 {
+		t.Fatalf("the file is %d bytes with %d free pages", stats.FileSize, stats.FreePages)
+	}
+}
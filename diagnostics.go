@@ -0,0 +1,251 @@
+package gopherdb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// keyHashSize is the number of bytes of the SHA-256 of a key kept in snapshots. It's enough to tell keys apart and to
+// match them against a known key, without including the key itself.
+const keyHashSize = 8
+
+// TreeSnapshot is a structural snapshot of the database, meant to be attached to bug reports. It's redacted: it holds
+// page numbers, key counts and node sizes, but keys and collection names only appear as truncated hashes and values not
+// at all. Violation is the message of the violation the snapshot was taken for, included as it was reported.
+type TreeSnapshot struct {
+	TakenAt        time.Time            `json:"taken_at"`
+	Violation      string               `json:"violation,omitempty"`
+	PageSize       int                  `json:"page_size"`
+	Pages          uint64               `json:"pages"`
+	FreePages      int                  `json:"free_pages"`
+	FreelistPage   pgnum                `json:"freelist_page"`
+	TxID           uint64               `json:"txid"`
+	RootCollection CollectionSnapshot   `json:"root_collection"`
+	Collections    []CollectionSnapshot `json:"collections"`
+}
+
+// CollectionSnapshot is the structure of the tree of a single collection, in depth first order.
+type CollectionSnapshot struct {
+	NameHash string         `json:"name_hash,omitempty"`
+	Root     pgnum          `json:"root"`
+	Nodes    []NodeSnapshot `json:"nodes"`
+}
+
+// NodeSnapshot describes a single node. Nodes that couldn't be read have an Error and no other details.
+type NodeSnapshot struct {
+	Page         pgnum   `json:"page"`
+	Depth        int     `json:"depth"`
+	Leaf         bool    `json:"leaf"`
+	Keys         int     `json:"keys"`
+	Size         int     `json:"size"`
+	Children     []pgnum `json:"children,omitempty"`
+	FirstKeyHash string  `json:"first_key_hash,omitempty"`
+	LastKeyHash  string  `json:"last_key_hash,omitempty"`
+	Error        string  `json:"error,omitempty"`
+}
+
+func hashKey(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:keyHashSize])
+}
+
+// TreeSnapshot takes a snapshot of the structure of every tree as seen by the transaction. Unreadable nodes are
+// recorded with their error instead of failing the snapshot, since snapshots are mostly taken of broken trees.
+func (tx *Tx) TreeSnapshot() (*TreeSnapshot, error) {
+	state := tx.fileState()
+	snapshot := &TreeSnapshot{
+		TakenAt:        tx.db.now(),
+		PageSize:       tx.db.pageSize,
+		Pages:          uint64(state.maxPage) + 1,
+		FreePages:      state.freePages,
+		FreelistPage:   state.freelistPage,
+		TxID:           state.txid,
+		RootCollection: CollectionSnapshot{Root: tx.root},
+	}
+	tx.snapshotTree(&snapshot.RootCollection, tx.root, 0, map[pgnum]bool{})
+
+	collections, err := tx.allCollections()
+	if err != nil {
+		return snapshot, err
+	}
+	for _, collection := range collections {
+		collectionSnapshot := CollectionSnapshot{NameHash: hashKey(collection.name), Root: collection.root}
+		tx.snapshotTree(&collectionSnapshot, collection.root, 0, map[pgnum]bool{})
+		snapshot.Collections = append(snapshot.Collections, collectionSnapshot)
+	}
+	return snapshot, nil
+}
+
+// snapshotTree adds the nodes of the tree to the snapshot. Pages already visited aren't visited again, so a corrupted
+// tree pointing back to one of its own nodes doesn't loop forever.
+func (tx *Tx) snapshotTree(snapshot *CollectionSnapshot, pageNum pgnum, depth int, visited map[pgnum]bool) {
+	if visited[pageNum] {
+		snapshot.Nodes = append(snapshot.Nodes, NodeSnapshot{Page: pageNum, Depth: depth, Error: "page already visited"})
+		return
+	}
+	visited[pageNum] = true
+
+	node, err := tx.getNode(pageNum)
+	if err != nil {
+		snapshot.Nodes = append(snapshot.Nodes, NodeSnapshot{Page: pageNum, Depth: depth, Error: err.Error()})
+		return
+	}
+	nodeSnapshot := NodeSnapshot{
+		Page:     pageNum,
+		Depth:    depth,
+		Leaf:     node.isLeaf(),
+		Keys:     len(node.items),
+		Size:     node.nodeSize(),
+		Children: node.childNodes,
+	}
+	if len(node.items) > 0 {
+		nodeSnapshot.FirstKeyHash = hashKey(node.items[0].key)
+		nodeSnapshot.LastKeyHash = hashKey(node.items[len(node.items)-1].key)
+	}
+	snapshot.Nodes = append(snapshot.Nodes, nodeSnapshot)
+
+	for _, child := range node.childNodes {
+		tx.snapshotTree(snapshot, child, depth+1, visited)
+	}
+}
+
+// Write writes the snapshot as indented JSON.
+func (s *TreeSnapshot) Write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(s)
+}
+
+// writeFile writes the snapshot to a new diagnostics file in the directory and returns its path.
+func (s *TreeSnapshot) writeFile(dir string) (string, error) {
+	name := fmt.Sprintf("gopherdb-diagnostics-%s.json", s.TakenAt.Format("20060102-150405.000000000"))
+	path := filepath.Join(dir, name)
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	err = s.Write(file)
+	if err != nil {
+		_ = file.Close()
+		return "", err
+	}
+	return path, file.Close()
+}
+
+// ViolationError reports a consistency violation, with a snapshot of the trees taken when it was found. If the
+// database has a diagnostics directory, the snapshot was also written there.
+type ViolationError struct {
+	Err             error
+	Snapshot        *TreeSnapshot
+	DiagnosticsPath string
+}
+
+func (e *ViolationError) Error() string {
+	if e.DiagnosticsPath != "" {
+		return fmt.Sprintf("%s (diagnostics written to %s)", e.Err, e.DiagnosticsPath)
+	}
+	return e.Err.Error()
+}
+
+func (e *ViolationError) Unwrap() error {
+	return e.Err
+}
+
+// DBError is an error of the file, like a page that can't be read, written or decoded, with where it happened. The
+// errors of the caller, like ErrKeyNotFound, ErrWriteInsideReadTx or the errors of triggers, are returned as they are,
+// and the errors wrapped in a DBError still match errors.Is.
+type DBError struct {
+	// Op is the operation that failed, like put, find or commit, and Collection the collection it ran on. KeyHash is
+	// the truncated SHA-256 of the key it was given, like in tree snapshots, so logs don't hold the key itself.
+	Op         string
+	Collection string
+	KeyHash    string
+	// Page is the page that couldn't be read, written or decoded, or zero if the error isn't about a page.
+	Page uint64
+	Err  error
+}
+
+func (e *DBError) Error() string {
+	msg := "gopherdb"
+	if e.Op != "" {
+		msg += ": " + e.Op
+	}
+	if e.Collection != "" {
+		msg += fmt.Sprintf(" in collection %q", e.Collection)
+	}
+	if e.KeyHash != "" {
+		msg += " of key " + e.KeyHash
+	}
+	if e.Page != 0 {
+		msg += fmt.Sprintf(": page %d", e.Page)
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *DBError) Unwrap() error {
+	return e.Err
+}
+
+// internalError wraps an error of the file into a *DBError with the context, or adds the context to the *DBError it
+// already is, see addContext.
+func internalError(err error, context DBError) error {
+	if err == nil {
+		return nil
+	}
+	var dbErr *DBError
+	if !errors.As(err, &dbErr) {
+		context.Err = err
+		return &context
+	}
+	return addContext(err, context)
+}
+
+// addContext adds the context to the error if it's a *DBError, and returns the other errors as they are. The context
+// of the innermost operation is kept, since it's the one that failed.
+func addContext(err error, context DBError) error {
+	var dbErr *DBError
+	if !errors.As(err, &dbErr) {
+		return err
+	}
+	if dbErr.Op == "" {
+		dbErr.Op, dbErr.Collection, dbErr.KeyHash = context.Op, context.Collection, context.KeyHash
+	}
+	if dbErr.Page == 0 {
+		dbErr.Page = context.Page
+	}
+	return err
+}
+
+// addContext adds the operation on the collection to the error, see addContext. Errors of the root collection get the
+// context of the operation that looked up the collection instead.
+func (c *Collection) addContext(err error, op string, key []byte) error {
+	if err == nil || c.name == nil {
+		return err
+	}
+	context := DBError{Op: op, Collection: string(c.name)}
+	if key != nil {
+		context.KeyHash = hashKey(key)
+	}
+	return addContext(err, context)
+}
+
+// newViolation wraps a violation found inside the transaction into a *ViolationError. Failing to take or write the
+// snapshot doesn't hide the violation: a snapshot missing the collections is still kept, and the error just comes
+// without the file if it can't be written.
+func (tx *Tx) newViolation(violation error) *ViolationError {
+	snapshot, _ := tx.TreeSnapshot()
+	snapshot.Violation = violation.Error()
+	e := &ViolationError{Err: violation, Snapshot: snapshot}
+
+	if tx.db.diagnosticsDir != "" {
+		e.DiagnosticsPath, _ = snapshot.writeFile(tx.db.diagnosticsDir)
+	}
+	return e
+}
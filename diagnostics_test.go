@@ -0,0 +1,151 @@
+package gopherdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTreeSnapshotIsRedacted(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "secret-collection")
+		for i := 0; i < 200; i++ {
+			if err := c.Put(testKey(i), []byte("secret-value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	mustView(t, db, func(tx *Tx) error {
+		snapshot, err := tx.TreeSnapshot()
+		if err != nil {
+			return err
+		}
+		if len(snapshot.Collections) != 1 || snapshot.TxID != db.txid || snapshot.PageSize != db.pageSize {
+			t.Fatalf("TreeSnapshot: got %+v", snapshot)
+		}
+		collection := snapshot.Collections[0]
+		if collection.NameHash != hashKey([]byte("secret-collection")) || collection.Root != getOrCreate(t, tx, "secret-collection").root {
+			t.Errorf("collection snapshot: got hash %s and root %d", collection.NameHash, collection.Root)
+		}
+		keys := 0
+		for _, node := range collection.Nodes {
+			keys += node.Keys
+			if node.Depth == 0 && (node.Page != collection.Root || node.Leaf) {
+				t.Errorf("the first node %+v isn't the internal root node", node)
+			}
+		}
+		if keys != 200 || collection.Nodes[0].FirstKeyHash == "" {
+			t.Errorf("the nodes of the snapshot have %d keys, want 200", keys)
+		}
+
+		var buf bytes.Buffer
+		if err := snapshot.Write(&buf); err != nil {
+			return err
+		}
+		for _, secret := range []string{"secret-collection", "secret-value", "key000"} {
+			if strings.Contains(buf.String(), secret) {
+				t.Errorf("the written snapshot contains %q", secret)
+			}
+		}
+		return nil
+	})
+}
+
+func TestViolationWritesTheSnapshot(t *testing.T) {
+	for _, dir := range []string{"", t.TempDir()} {
+		options := testOptions()
+		options.DiagnosticsDir = dir
+		db := openTestDB(t, options)
+		putValue(t, db, "c", "k", "v")
+
+		broken := errors.New("broken tree")
+		var violation *ViolationError
+		mustView(t, db, func(tx *Tx) error {
+			violation = tx.newViolation(broken)
+			return nil
+		})
+		if !errors.Is(violation, broken) || violation.Snapshot.Violation != "broken tree" {
+			t.Errorf("violation: got %v with snapshot violation %q", violation, violation.Snapshot.Violation)
+		}
+		if dir == "" {
+			if violation.DiagnosticsPath != "" {
+				t.Errorf("a diagnostics file was written without a diagnostics directory: %s", violation.DiagnosticsPath)
+			}
+			continue
+		}
+		if !strings.Contains(violation.Error(), violation.DiagnosticsPath) {
+			t.Errorf("the error %q doesn't name the diagnostics file", violation.Error())
+		}
+		data, err := os.ReadFile(violation.DiagnosticsPath)
+		if err != nil {
+			t.Fatalf("reading the diagnostics file: %v", err)
+		}
+		var snapshot TreeSnapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			t.Fatalf("the diagnostics file isn't a snapshot: %v", err)
+		}
+		if snapshot.Violation != "broken tree" || len(snapshot.Collections) != 1 {
+			t.Errorf("diagnostics file: got %+v", snapshot)
+		}
+	}
+}
+
+func TestDBErrorHasTheContext(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPath(t, path, nil)
+	putValue(t, db, "users", "alice", "admin")
+	putValue(t, db, "groups", "admins", "alice")
+	var root pgnum
+	mustView(t, db, func(tx *Tx) error {
+		root = getOrCreate(t, tx, "users").root
+		return nil
+	})
+	// Errors of the caller aren't wrapped
+	mustView(t, db, func(tx *Tx) error {
+		if _, err := getOrCreate(t, tx, "users").Get([]byte("bob")); err != ErrKeyNotFound {
+			t.Errorf("Get of a missing key: got %v, want ErrKeyNotFound itself", err)
+		}
+		return nil
+	})
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	corruptPage(t, path, testOptions().pageSize, root, []byte("alice"))
+
+	db = openTestPath(t, path, nil)
+	check := func(err error, op string, key string) {
+		t.Helper()
+		var dbErr *DBError
+		if !errors.As(err, &dbErr) {
+			t.Fatalf("%s: got %v, want a *DBError", op, err)
+		}
+		want := DBError{Op: op, Collection: "users", KeyHash: hashKey([]byte(key)), Page: uint64(root), Err: dbErr.Err}
+		if *dbErr != want {
+			t.Errorf("%s: got %+v, want %+v", op, *dbErr, want)
+		}
+		if !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("%s: %v doesn't match ErrChecksumMismatch", op, err)
+		}
+		if msg := err.Error(); !strings.Contains(msg, op+` in collection "users" of key `) || !strings.Contains(msg, "page") {
+			t.Errorf("%s: got message %q", op, msg)
+		}
+	}
+	err := db.View(func(tx *Tx) error {
+		_, err := getOrCreate(t, tx, "users").Get([]byte("alice"))
+		return err
+	})
+	check(err, "find", "alice")
+	err = db.Update(func(tx *Tx) error {
+		return getOrCreate(t, tx, "users").Put([]byte("bob"), []byte("reader"))
+	})
+	check(err, "put", "bob")
+	if got := getValue(t, db, "groups", "admins"); got != "alice" {
+		t.Errorf("the other collection: got %q", got)
+	}
+}
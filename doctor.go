@@ -0,0 +1,466 @@
+package gopherdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Severity ranks the findings of Doctor.
+type Severity int
+
+const (
+	// SeverityInfo findings describe the file and need no action.
+	SeverityInfo Severity = iota
+	// SeverityWarning findings waste space or make trouble likely, but the data is intact.
+	SeverityWarning
+	// SeverityCritical findings are corruption: some data is unreadable or will be overwritten.
+	SeverityCritical
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityCritical:
+		return "critical"
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+// MarshalText encodes the severity as its name, so findings read well as JSON.
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Finding is a single result of Doctor. Check names the diagnostic that found it, Message tells what was found and
+// Action what to do about it, if anything.
+type Finding struct {
+	Severity Severity `json:"severity"`
+	Check    string   `json:"check"`
+	Message  string   `json:"message"`
+	Action   string   `json:"action,omitempty"`
+}
+
+// maxListedPages is the number of page numbers listed in a finding, so a badly broken file gives readable findings.
+const maxListedPages = 10
+
+// Doctor runs a battery of diagnostics on the database file and returns its findings, the most severe first:
+//   - lock: whether the file is open in this process or in another one
+//   - wal: whether a crash left commits in the WAL, which are replayed before the other checks unless the file is open
+//   - meta: whether the meta page is valid and points inside the file
+//   - file: whether the file size matches the page size and the freelist
+//   - checksums: whether every node of every tree reads back with a valid checksum
+//   - trees: whether every page is used once by the trees
+//   - freelist: whether the free pages are in range, free once and unused by the trees
+//   - orphans: pages that are neither used by the trees nor free
+//   - options: whether the options make sense for the file
+//
+// The file is opened with the options, which must have the page size the file was written with, and never written,
+// except for a WAL left by a crash, which is replayed into the file like Open does. A file that is open, whose WAL is
+// still being written, is opened with Options.ReadOnly and Options.NoLock instead.
+// The error is only set when the diagnostics couldn't run at all, such as when the file doesn't exist; a file that
+// can't be opened as a database is a critical finding.
+func Doctor(path string, options *Options) ([]Finding, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	pageSize := options.pageSize
+	if pageSize == 0 {
+		pageSize = os.Getpagesize()
+	}
+
+	d := &doctor{}
+	open := d.checkLock(path)
+	d.checkOptions(options, pageSize)
+	if !open {
+		d.checkWAL(path, pageSize)
+	}
+	if d.checkMeta(path, pageSize, info.Size()) {
+		d.checkFile(path, options, info.Size(), open)
+	}
+
+	sort.SliceStable(d.findings, func(i, j int) bool {
+		return d.findings[i].Severity > d.findings[j].Severity
+	})
+	return d.findings, nil
+}
+
+type doctor struct {
+	findings []Finding
+}
+
+func (d *doctor) add(severity Severity, check string, message string, action string) {
+	d.findings = append(d.findings, Finding{Severity: severity, Check: check, Message: message, Action: action})
+}
+
+// checkLock reports whether the file is open, in this process or in another one holding its lock, and returns whether
+// it is.
+func (d *doctor) checkLock(path string) bool {
+	key, err := registryPath(path)
+	if err != nil {
+		return false
+	}
+	openFiles.Lock()
+	shared, ok := openFiles.byPath[key]
+	handles := 0
+	if ok {
+		handles = shared.handles
+	}
+	openFiles.Unlock()
+
+	if handles > 0 {
+		d.add(SeverityInfo, "lock", fmt.Sprintf("the file is open in this process by %d handles", handles),
+			"the diagnostics see the last commit; transactions in flight aren't covered")
+		return true
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	if errors.Is(lockFile(file, true), ErrDatabaseLocked) {
+		d.add(SeverityWarning, "lock", "the file is open in another process",
+			"the diagnostics see the last commit when they began, and a commit in flight looks like corruption; stop the process before trusting the findings")
+		return true
+	}
+	return false
+}
+
+// checkWAL replays the WAL a crash left next to the file, like Open does, so the other checks see the file at its last
+// commit.
+func (d *doctor) checkWAL(path string, pageSize int) {
+	info, err := os.Stat(walPath(path))
+	if err != nil || info.Size() == 0 {
+		return
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		d.add(SeverityCritical, "wal", fmt.Sprintf("the WAL can't be replayed, since the file can't be written: %s", err), "")
+		return
+	}
+	defer file.Close()
+	err = lockFile(file, true)
+	if err != nil {
+		d.add(SeverityWarning, "wal", fmt.Sprintf("the WAL isn't replayed: %s", err), "")
+		return
+	}
+	replay := &dal{pageSize: pageSize, file: &fileBackend{file: file}}
+	commits, err := replay.replayWAL(path)
+	if err != nil {
+		d.add(SeverityCritical, "wal", fmt.Sprintf("the WAL can't be replayed: %s", err), "")
+		return
+	}
+	d.add(SeverityInfo, "wal", fmt.Sprintf("the WAL held %d commits not copied to the file yet, so the file wasn't closed cleanly", commits),
+		"they were copied to the file like Open does, and the checks below see them")
+}
+
+// checkOptions reports the options that can't work or defeat their purpose.
+func (d *doctor) checkOptions(options *Options, pageSize int) {
+	if options.MinFillPercent <= 0 || options.MaxFillPercent > 1 || options.MinFillPercent >= options.MaxFillPercent {
+		d.add(SeverityWarning, "options",
+			fmt.Sprintf("fill percents %.2f and %.2f don't leave room to rebalance", options.MinFillPercent, options.MaxFillPercent),
+			"keep MinFillPercent above 0 and below MaxFillPercent, and MaxFillPercent at most 1, like DefaultOptions")
+		// The size limits below don't mean anything with such thresholds
+		return
+	}
+
+	sizes := &dal{pageSize: pageSize, minFillPercent: options.MinFillPercent, maxFillPercent: options.MaxFillPercent}
+	if sizes.maxKeySize() < 64 {
+		d.add(SeverityWarning, "options", fmt.Sprintf("keys are limited to %d bytes with %d byte pages", sizes.maxKeySize(), pageSize),
+			"use bigger pages if keys can get longer, since longer keys fail with ErrKeyTooLarge")
+	}
+	if options.InlineValueThreshold > sizes.maxElementSize() {
+		d.add(SeverityInfo, "options",
+			fmt.Sprintf("InlineValueThreshold %d is above the %d bytes a cell can hold", options.InlineValueThreshold, sizes.maxElementSize()),
+			"values that don't fit a cell are moved to overflow pages anyway; zero means the same")
+	}
+	if options.StatsHistory < 0 {
+		d.add(SeverityWarning, "options", fmt.Sprintf("StatsHistory is negative (%d)", options.StatsHistory),
+			"set it to zero to disable the history")
+	}
+	if options.ShipDir != "" {
+		if info, err := os.Stat(options.ShipDir); err != nil || !info.IsDir() {
+			d.add(SeverityWarning, "options", fmt.Sprintf("ShipDir %s isn't a directory", options.ShipDir),
+				"create it, or commits can't ship their segments and the standby falls behind")
+		}
+	}
+}
+
+// checkMeta validates the meta page on its own, before the file is opened. It returns whether the file can be opened.
+func (d *doctor) checkMeta(path string, pageSize int, size int64) bool {
+	const action = "restore the file from a backup, or from a standby"
+	file, err := os.Open(path)
+	if err != nil {
+		d.add(SeverityCritical, "meta", fmt.Sprintf("the file can't be read: %s", err), "")
+		return false
+	}
+	defer file.Close()
+	// The meta pages are read like Open reads them
+	m, errs, err := readMetaPages(file, pageSize)
+	switch {
+	case errors.Is(err, ErrUnsupportedFormat):
+		d.add(SeverityCritical, "meta", "the file was written by a newer version", "open it with the version that wrote it")
+		return false
+	case errors.Is(err, ErrPageSizeMismatch):
+		d.add(SeverityCritical, "meta", err.Error(), "open it with the page size it was written with")
+		return false
+	case err != nil && size < int64(pageSize):
+		d.add(SeverityCritical, "meta", fmt.Sprintf("the file is %d bytes, shorter than the meta page", size), action)
+		return false
+	case errors.Is(err, ErrMetaChecksumMismatch):
+		d.add(SeverityCritical, "meta", "no meta page matches its checksum", action)
+		return false
+	case errors.Is(err, ErrNotDBFile):
+		d.add(SeverityCritical, "meta", "the meta page has no valid magic number", "check the path and the page size; "+action)
+		return false
+	case err != nil:
+		d.add(SeverityCritical, "meta", fmt.Sprintf("the meta pages can't be read: %s", err), action)
+		return false
+	}
+
+	if !m.clean {
+		d.add(SeverityInfo, "meta", fmt.Sprintf("the file wasn't closed cleanly after txid %d", m.txid),
+			"Open drops the free pages the freelist check below finds used, listed twice or reserved, and reports them in DB.Recovery")
+	}
+	if m.version < 5 {
+		d.add(SeverityInfo, "meta", fmt.Sprintf("the file has a single meta page, of format version %d", m.version),
+			"the next commit adds the second one, after which a crash during a commit can't leave the file unreadable")
+	}
+	for i, slotErr := range errs {
+		if errors.Is(slotErr, ErrMetaChecksumMismatch) {
+			d.add(SeverityWarning, "meta", fmt.Sprintf("meta page %d doesn't match its checksum, so the commit after txid %d was cut short", i, m.txid),
+				"the file is at the last commit before the crash; check that the writes the application expects are there")
+		}
+	}
+
+	pages := pgnum(size / int64(pageSize))
+	valid := true
+	refs := []struct {
+		name string
+		page pgnum
+	}{{"root", m.root}, {"freelist", m.freelistPage}}
+	if m.freelistSpare != 0 {
+		refs = append(refs, struct {
+			name string
+			page pgnum
+		}{"spare freelist", m.freelistSpare})
+	}
+	seen := map[pgnum]string{}
+	for _, ref := range refs {
+		// Files with a single meta page have their freelist on page 1
+		metaPage := ref.page == metaPageNum || m.freelistSpare != 0 && ref.page == metaPageNumB
+		if metaPage || ref.page >= pages {
+			d.add(SeverityCritical, "meta", fmt.Sprintf("the %s page %d is outside the %d pages of the file", ref.name, ref.page, pages), action)
+			valid = false
+		} else if other, ok := seen[ref.page]; ok {
+			d.add(SeverityCritical, "meta", fmt.Sprintf("the %s and the %s share page %d", other, ref.name, ref.page), action)
+			valid = false
+		}
+		seen[ref.page] = ref.name
+	}
+	// Zeros in the journal are allocations
+	for _, page := range m.freelistJournal {
+		if page >= pages {
+			d.add(SeverityCritical, "meta", fmt.Sprintf("the freelist journal releases page %d, outside the file", page), action)
+			valid = false
+			break
+		}
+	}
+	return valid
+}
+
+// checkFile opens the file and checks its pages, the freelist and the trees against each other.
+func (d *doctor) checkFile(path string, options *Options, size int64, open bool) {
+	opts := *options
+	opts.inspect = true
+	opts.ReadOnly = open
+	opts.NoLock = open
+	db, err := Open(path, &opts)
+	if err != nil {
+		d.add(SeverityCritical, "meta", fmt.Sprintf("the file can't be opened: %s", err), "restore the file from a backup, or from a standby")
+		return
+	}
+	defer db.Close()
+	// The trees are compared with the freelist, which commits change, so a file open in the process is checked between
+	// its write transactions
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+	tx, err := db.ReadTx()
+	if err != nil {
+		d.add(SeverityCritical, "meta", fmt.Sprintf("the file can't be read: %s", err), "")
+		return
+	}
+	defer tx.Rollback()
+
+	pageSize := int64(tx.db.pageSize)
+	filePages := tx.db.filePages(size)
+	if size%pageSize != 0 {
+		d.add(SeverityWarning, "file", fmt.Sprintf("the file size %d isn't a multiple of the %d byte pages", size, pageSize),
+			"check that the page size is the one the file was created with; otherwise the last write was cut short")
+	}
+	if tx.db.maxPage >= filePages {
+		d.add(SeverityCritical, "file", fmt.Sprintf("the freelist counts %d pages but the file holds %d", tx.db.maxPage+1, filePages),
+			"the file was truncated; restore it from a backup")
+	} else if tx.db.maxPage+1 < filePages {
+		d.add(SeverityInfo, "file", fmt.Sprintf("%d pages past the last allocated page are unused", filePages-tx.db.maxPage-1),
+			"they're left by commits that didn't finish, and are overwritten as the file grows")
+	}
+
+	used := d.checkTrees(tx)
+	free := d.checkFreelist(tx, used)
+	if used == nil {
+		d.add(SeverityInfo, "orphans", "skipped, since some trees couldn't be read", "")
+		return
+	}
+
+	var orphans []pgnum
+	for pageNum := pgnum(metaPageNum + 1); pageNum <= tx.db.maxPage && pageNum < filePages; pageNum++ {
+		if !used[pageNum] && !free[pageNum] && !tx.db.isReserved(pageNum) {
+			orphans = append(orphans, pageNum)
+		}
+	}
+	if len(orphans) > 0 {
+		d.add(SeverityWarning, "orphans", fmt.Sprintf("%d pages are neither used by the trees nor free: %s", len(orphans), listPages(orphans)),
+			"pages the application keeps with Tx.AllocatePage show up here; other ones leaked, and their space is lost until the file is rewritten")
+	}
+}
+
+// checkTrees walks the root collection and every collection, reading every node and overflow page, and returns the
+// pages they use. It returns nil if some page couldn't be read, since the pages below it are unknown.
+func (d *doctor) checkTrees(tx *Tx) map[pgnum]bool {
+	used := map[pgnum]bool{}
+	var broken, shared []pgnum
+	var nodes, overflowPages, legacy int
+	complete := true
+
+	claim := func(pageNum pgnum) bool {
+		if used[pageNum] || tx.db.isReserved(pageNum) || pageNum > tx.db.maxPage {
+			shared = append(shared, pageNum)
+			complete = false
+			return false
+		}
+		used[pageNum] = true
+		return true
+	}
+	var walk func(pageNum pgnum, collections bool)
+	walk = func(pageNum pgnum, collections bool) {
+		if !claim(pageNum) {
+			return
+		}
+		p, err := tx.db.readPage(pageNum)
+		node := NewEmptyNode()
+		if err == nil {
+			err = node.deserialize(p.data)
+		}
+		if err != nil {
+			broken = append(broken, pageNum)
+			complete = false
+			return
+		}
+		nodes++
+		if p.data[0]&nodeFlagChecksum == 0 {
+			legacy++
+		}
+
+		for _, item := range node.items {
+			if collections || item.collection {
+				collection := newEmptyCollection()
+				collection.deserialize(item)
+				walk(collection.root, false)
+				continue
+			}
+			if !item.overflow {
+				continue
+			}
+			for pageNum := deserializeOverflowRef(item.value).first; pageNum != 0; {
+				if !claim(pageNum) {
+					break
+				}
+				p, err := tx.db.readPage(pageNum)
+				if err != nil {
+					broken = append(broken, pageNum)
+					complete = false
+					break
+				}
+				overflowPages++
+				pageNum = pgnum(binary.LittleEndian.Uint64(p.data))
+			}
+		}
+		for _, child := range node.childNodes {
+			walk(child, collections)
+		}
+	}
+	walk(tx.db.root, true)
+
+	if len(broken) > 0 {
+		d.add(SeverityCritical, "checksums", fmt.Sprintf("%d pages fail their checksum or can't be read: %s", len(broken), listPages(broken)),
+			"the items below them are unreadable; restore the file from a backup, or export what's left with the export command")
+	}
+	if len(shared) > 0 {
+		d.add(SeverityCritical, "trees", fmt.Sprintf("%d pages are referenced twice or are out of range: %s", len(shared), listPages(shared)),
+			"a commit overwrote pages still in use; restore the file from a backup")
+	}
+	d.add(SeverityInfo, "checksums", fmt.Sprintf("read %d nodes and %d overflow pages", nodes, overflowPages), "")
+	if legacy > 0 {
+		d.add(SeverityInfo, "checksums", fmt.Sprintf("%d nodes were written before checksums and can't be verified", legacy),
+			"they get a checksum the next time they're written, for example by Collection.Compact")
+	}
+	if !complete {
+		return nil
+	}
+	return used
+}
+
+// checkFreelist checks the released pages and returns them.
+func (d *doctor) checkFreelist(tx *Tx, used map[pgnum]bool) map[pgnum]bool {
+	const action = "the pages would be handed out while in use; restore the file from a backup"
+	free := map[pgnum]bool{}
+	var outside, twice, inUse []pgnum
+	for _, pageNum := range tx.db.releasedPages {
+		switch {
+		case tx.db.isReserved(pageNum) || pageNum > tx.db.maxPage:
+			outside = append(outside, pageNum)
+		case free[pageNum]:
+			twice = append(twice, pageNum)
+		case used != nil && used[pageNum]:
+			inUse = append(inUse, pageNum)
+		}
+		free[pageNum] = true
+	}
+
+	if len(outside) > 0 {
+		d.add(SeverityCritical, "freelist", fmt.Sprintf("%d free pages are meta or freelist pages or past the last page: %s", len(outside), listPages(outside)), action)
+	}
+	if len(twice) > 0 {
+		d.add(SeverityCritical, "freelist", fmt.Sprintf("%d pages are free more than once: %s", len(twice), listPages(twice)), action)
+	}
+	if len(inUse) > 0 {
+		d.add(SeverityCritical, "freelist", fmt.Sprintf("%d free pages are used by the trees: %s", len(inUse), listPages(inUse)), action)
+	}
+	if len(tx.db.chain) > 0 {
+		d.add(SeverityInfo, "freelist", fmt.Sprintf("the %d free pages take the freelist page and %d more", len(tx.db.releasedPages), len(tx.db.chain)),
+			"commits write all of them; reuse the free pages by writing more, or use bigger pages")
+	}
+	return free
+}
+
+// listPages formats the page numbers for a finding, listing the first maxListedPages of them.
+func listPages(pages []pgnum) string {
+	s := ""
+	for i, pageNum := range pages {
+		if i == maxListedPages {
+			return s + fmt.Sprintf(" and %d more", len(pages)-maxListedPages)
+		}
+		if i > 0 {
+			s += ", "
+		}
+		s += fmt.Sprint(pageNum)
+	}
+	return s
+}
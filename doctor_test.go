@@ -0,0 +1,66 @@
+package gopherdb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func hasFinding(findings []Finding, check string, severity Severity) bool {
+	for _, finding := range findings {
+		if finding.Check == check && finding.Severity == severity {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDoctorFindsCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	db := openTestPath(t, path, options)
+	for i := 0; i < 100; i++ {
+		putValue(t, db, "c", string(testKey(i)), "value")
+	}
+	var leaf pgnum
+	mustView(t, db, func(tx *Tx) error {
+		root, err := tx.getNode(getOrCreate(t, tx, "c").root)
+		leaf = root.childNodes[0]
+		return err
+	})
+	// A page taken from the freelist by a commit without being used by any tree
+	orphan := db.getNextPage()
+	putValue(t, db, "c", "z", "value")
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	findings, err := Doctor(path, options)
+	if err != nil {
+		t.Fatalf("Doctor: %v", err)
+	}
+	if !hasFinding(findings, "orphans", SeverityWarning) || hasFinding(findings, "checksums", SeverityCritical) {
+		t.Errorf("Doctor of a file with an orphan page %d: got %v", orphan, findings)
+	}
+
+	data := readFile(t, path)
+	page := data[int(leaf)*options.pageSize : int(leaf+1)*options.pageSize]
+	page[bytes.Index(page, []byte("value"))] ^= 1
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	findings, err = Doctor(path, options)
+	if err != nil {
+		t.Fatalf("Doctor: %v", err)
+	}
+	if !hasFinding(findings, "checksums", SeverityCritical) {
+		t.Errorf("Doctor of a file with a corrupted leaf: got %v", findings)
+	}
+	// The most severe findings come first
+	for i := 1; i < len(findings); i++ {
+		if findings[i].Severity > findings[i-1].Severity {
+			t.Errorf("the %s finding comes after the less severe %s finding", findings[i].Severity, findings[i-1].Severity)
+		}
+	}
+}
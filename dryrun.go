@@ -0,0 +1,45 @@
+package gopherdb
+
+// DryRunReport is what a dry run transaction would have written on Commit.
+type DryRunReport struct {
+	// DirtyPages is the number of node pages the commit would write, and FreedPages the number of pages it would free.
+	DirtyPages int
+	FreedPages int
+	// AllocatedPages is the number of pages the transaction took from the freelist or the end of the file.
+	AllocatedPages int
+	// BytesWritten is the size of the pages the commit would write, including the freelist and meta pages and the pages
+	// written with WritePage.
+	BytesWritten int
+	// Pages is the number of pages of the file after the commit.
+	Pages uint64
+}
+
+// DryRun turns the write transaction into a dry run, for validating imports and migrations before running them for
+// real. Everything works as usual until Commit, which checks what a real commit checks, fills the report and then
+// rolls the transaction back. Commit returns the error a real commit would have failed with, or nil.
+//
+// Put and Remove triggers and change hooks still run during the transaction, and the writes they make are discarded
+// with the rest.
+func (tx *Tx) DryRun() *DryRunReport {
+	tx.dryRun = &DryRunReport{}
+	return tx.dryRun
+}
+
+// commitDryRun ends a dry run transaction.
+func (tx *Tx) commitDryRun() error {
+	report := tx.dryRun
+	err := tx.copyOnWrite()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	report.DirtyPages = len(tx.dirtyNodes)
+	report.FreedPages = len(tx.pagesToDelete)
+	report.AllocatedPages = len(tx.allocatedPageNums)
+	chain := chainLength(len(tx.db.releasedPages)+len(tx.pagesToDelete)+len(tx.db.heldPages), tx.db.pageSize)
+	report.BytesWritten = (len(tx.dirtyNodes) + len(tx.pageWrites) + 2 + chain) * tx.db.pageSize
+	report.Pages = uint64(tx.db.maxPage) + 1
+
+	tx.Rollback()
+	return nil
+}
@@ -0,0 +1,60 @@
+package gopherdb
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestDryRunDiscardsTheCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	db := openTestPath(t, path, options)
+	putValue(t, db, "c", "existing", "value")
+	before := readFile(t, path)
+	txid, pages := db.txid, uint64(db.maxPage)+1
+
+	tx, err := db.WriteTx()
+	if err != nil {
+		t.Fatalf("WriteTx: %v", err)
+	}
+	report := tx.DryRun()
+	c := getOrCreate(t, tx, "c")
+	for i := 0; i < 200; i++ {
+		if err := c.Put(testKey(i), testKey(i)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if err := c.Remove([]byte("existing")); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit of the dry run: %v", err)
+	}
+
+	if report.DirtyPages < 2 || report.AllocatedPages < report.DirtyPages || report.FreedPages == 0 {
+		t.Errorf("the report doesn't account for the writes: %+v", report)
+	}
+	if report.BytesWritten < (report.DirtyPages+2)*db.pageSize || report.Pages <= pages {
+		t.Errorf("the report doesn't account for the pages: %+v, with %d pages before", report, pages)
+	}
+
+	// Nothing reached the file, and the lock was released
+	if !bytes.Equal(readFile(t, path), before) {
+		t.Error("the dry run changed the file")
+	}
+	if db.txid != txid {
+		t.Errorf("after the dry run, the last txid is %d, want %d", db.txid, txid)
+	}
+	if value := getValue(t, db, "c", "existing"); value != "value" {
+		t.Errorf("the key removed by the dry run has %q", value)
+	}
+	if value := getValue(t, db, "c", string(testKey(0))); value != "" {
+		t.Errorf("the key put by the dry run has %q", value)
+	}
+	putValue(t, db, "c", "after", "value")
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	checkFile(t, path, options)
+}
@@ -0,0 +1,110 @@
+package gopherdb
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// envelopeHeaderSize is the size of the fields of an envelope this version writes: the created and updated transaction
+// ids, the expiration, the flags and the codec.
+const envelopeHeaderSize = 2*txIDSize + 8 + 4 + 1
+
+// ItemMeta is the metadata stored in the envelope of an item, ahead of its value. It gives features like TTLs, change
+// data capture and versioning a place to keep their bits next to the value, without changing the value itself.
+type ItemMeta struct {
+	// CreatedTxID is the id of the transaction that first put the key with an envelope, and UpdatedTxID the id of the
+	// one that last put it. Both are set by PutWithMeta.
+	CreatedTxID uint64
+	UpdatedTxID uint64
+	// ExpiresAt is when the item expires, or the zero time if it doesn't. Expired items aren't removed or hidden; it's
+	// up to the feature setting it to act on it.
+	ExpiresAt time.Time
+	// Flags and Codec are free for the application, for example to mark tombstones or to tell which codec encoded the
+	// value.
+	Flags uint32
+	Codec byte
+}
+
+// Expired reports whether the item has an expiration and it passed.
+func (m *ItemMeta) Expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt)
+}
+
+// encodeEnvelope returns the value behind an envelope holding the metadata. The envelope starts with the size of its
+// fields, so fields added later can be skipped by readers that don't know them.
+func encodeEnvelope(meta *ItemMeta, value []byte) []byte {
+	buf := make([]byte, 0, 1+envelopeHeaderSize+len(value))
+	buf = append(buf, envelopeHeaderSize)
+	buf = binary.LittleEndian.AppendUint64(buf, meta.CreatedTxID)
+	buf = binary.LittleEndian.AppendUint64(buf, meta.UpdatedTxID)
+	var expires uint64
+	if !meta.ExpiresAt.IsZero() {
+		expires = uint64(meta.ExpiresAt.UnixNano())
+	}
+	buf = binary.LittleEndian.AppendUint64(buf, expires)
+	buf = binary.LittleEndian.AppendUint32(buf, meta.Flags)
+	buf = append(buf, meta.Codec)
+	return append(buf, value...)
+}
+
+// decodeEnvelope returns the metadata of an envelope and the value behind it.
+func decodeEnvelope(buf []byte) (*ItemMeta, []byte, error) {
+	if len(buf) < 1 || int(buf[0]) < envelopeHeaderSize || len(buf) < 1+int(buf[0]) {
+		return nil, nil, ErrCorruptEnvelope
+	}
+	header := buf[1:]
+	meta := &ItemMeta{
+		CreatedTxID: binary.LittleEndian.Uint64(header),
+		UpdatedTxID: binary.LittleEndian.Uint64(header[8:]),
+		Flags:       binary.LittleEndian.Uint32(header[24:]),
+		Codec:       header[28],
+	}
+	if expires := binary.LittleEndian.Uint64(header[16:]); expires != 0 {
+		meta.ExpiresAt = time.Unix(0, int64(expires))
+	}
+	return meta, buf[1+int(buf[0]):], nil
+}
+
+// skipEnvelope reads the envelope off the reader, leaving it at the start of the value.
+func skipEnvelope(r io.Reader) error {
+	size := make([]byte, 1)
+	_, err := io.ReadFull(r, size)
+	if err != nil {
+		return ErrCorruptEnvelope
+	}
+	_, err = io.CopyN(io.Discard, r, int64(size[0]))
+	if err != nil {
+		return ErrCorruptEnvelope
+	}
+	return nil
+}
+
+// PutWithMeta puts the key like Put, with the value behind an envelope holding the metadata. UpdatedTxID is set to the
+// id of the transaction, and CreatedTxID is kept from the envelope the key already has, or set to the id of the
+// transaction too. The other fields are stored as given. A later Put of the key without metadata drops the envelope.
+func (c *Collection) PutWithMeta(key []byte, value []byte, meta ItemMeta) error {
+	if !c.tx.write {
+		return ErrWriteInsideReadTx
+	}
+	_, current, err := c.FindWithMeta(key)
+	if err != nil {
+		return err
+	}
+	meta.CreatedTxID = c.tx.id
+	if current != nil {
+		meta.CreatedTxID = current.CreatedTxID
+	}
+	meta.UpdatedTxID = c.tx.id
+	return c.putValue(key, value, &meta)
+}
+
+// FindWithMeta returns the item of the key like Find, and the metadata of its envelope. The metadata is nil if the item
+// was put without one.
+func (c *Collection) FindWithMeta(key []byte) (*Item, *ItemMeta, error) {
+	item, err := c.findItem(c.storedKey(key))
+	if err != nil || item == nil {
+		return nil, nil, err
+	}
+	return c.resolveItemMeta(item)
+}
@@ -0,0 +1,52 @@
+package gopherdb_test
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	gopherdb "github.com/RohinJoshi1/GopherDB"
+)
+
+func Example() {
+	dir, err := os.MkdirTemp("", "gopherdb")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := gopherdb.Open(filepath.Join(dir, "data.db"), gopherdb.DefaultOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *gopherdb.Tx) error {
+		users, err := tx.CreateCollection([]byte("users"))
+		if err != nil {
+			return err
+		}
+		return users.Put([]byte("alice"), []byte("admin"))
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = db.View(func(tx *gopherdb.Tx) error {
+		users, err := tx.GetCollection([]byte("users"))
+		if err != nil {
+			return err
+		}
+		role, err := users.Get([]byte("alice"))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("alice is %s\n", role)
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Output: alice is admin
+}
@@ -0,0 +1,130 @@
+package gopherdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// exportMagic starts every export stream written by WriteExport.
+const exportMagic uint32 = 0x47445845
+
+// ExportKey returns the key of a record in the single key space of an export, for downstream systems that want one
+// key per record, like SSTable builders. The collection is escaped and terminated so the byte order of the returned
+// keys is the order of the records: by collection, then by key.
+func ExportKey(collection []byte, key []byte) []byte {
+	buf := make([]byte, 0, len(collection)+2+len(key))
+	for _, b := range collection {
+		buf = append(buf, b)
+		if b == 0 {
+			buf = append(buf, 0xff)
+		}
+	}
+	buf = append(buf, 0, 1)
+	return append(buf, key...)
+}
+
+// Export calls fn for every key of every collection, ordered by collection name and then by key, which makes one
+// globally ordered stream of records. The keys and values are the ones Find and Scan return, so the keys of collections
+// whose key transform keeps the original key are the original keys, but the order is still the one of the keys stored
+// in the trees, the transformed keys. Collections whose transform doesn't keep the original key can only export the
+// transformed keys. The checkpoints of Options.Checkpoints aren't exported. The slices are only valid until fn
+// returns.
+func (tx *Tx) Export(fn func(collection []byte, key []byte, value []byte) error) error {
+	collections, err := tx.allCollections()
+	if err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		// The checkpoints point to pages of this file, which mean nothing in the file the export is read into
+		if bytes.Equal(collection.name, checkpointsCollection) {
+			continue
+		}
+		err = tx.rangeItems(collection.root, KeyRange{}, func(item *Item) (bool, error) {
+			resolved, err := collection.resolveItem(item)
+			if err != nil {
+				return false, err
+			}
+			return true, fn(collection.name, resolved.key, resolved.value)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteExport writes the export of the database to w as a stream of records, see Export. The stream starts with a
+// magic number, and every record is the collection name, the key and the value, each prefixed by its length as a
+// uvarint. ReadExport reads it back.
+func (tx *Tx) WriteExport(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	header := binary.LittleEndian.AppendUint32(nil, exportMagic)
+	_, err := bw.Write(header)
+	if err != nil {
+		return err
+	}
+
+	var buf []byte
+	err = tx.Export(func(collection []byte, key []byte, value []byte) error {
+		buf = buf[:0]
+		for _, field := range [][]byte{collection, key, value} {
+			buf = binary.AppendUvarint(buf, uint64(len(field)))
+			buf = append(buf, field...)
+		}
+		_, err := bw.Write(buf)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ReadExport reads a stream written by WriteExport, calling fn for every record in order. The slices are only valid
+// until fn returns. Fields longer than MaxValueSize, or longer than what's left of the stream, fail with
+// ErrCorruptExport.
+func ReadExport(r io.Reader, fn func(collection []byte, key []byte, value []byte) error) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, magicNumberSize)
+	_, err := io.ReadFull(br, header)
+	if err != nil || binary.LittleEndian.Uint32(header) != exportMagic {
+		return ErrCorruptExport
+	}
+
+	var fields [3][]byte
+	for {
+		for i := range fields {
+			length, err := binary.ReadUvarint(br)
+			if i == 0 && errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return ErrCorruptExport
+			}
+			if length > MaxValueSize {
+				return ErrCorruptExport
+			}
+			if uint64(cap(fields[i])) >= length {
+				fields[i] = fields[i][:length]
+				_, err = io.ReadFull(br, fields[i])
+			} else {
+				// The field is read as it comes instead of allocated at the length the stream claims, which it may not
+				// provide
+				fields[i], err = io.ReadAll(io.LimitReader(br, int64(length)))
+				if err == nil && uint64(len(fields[i])) < length {
+					err = io.ErrUnexpectedEOF
+				}
+			}
+			if err != nil {
+				return ErrCorruptExport
+			}
+		}
+		err = fn(fields[0], fields[1], fields[2])
+		if err != nil {
+			return err
+		}
+	}
+}
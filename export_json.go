@@ -0,0 +1,239 @@
+package gopherdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf8"
+)
+
+// The JSON export is a stream of JSON Lines, one record per key:
+//
+//	{"collection":"users","key":"alice","value":"admin"}
+//	{"collection":"users","key":"bob","value_base64":"AAEC"}
+//
+// The collection, the key and the value are JSON strings when they're valid UTF-8, and base64 strings (standard
+// encoding, padded) under the name with a _base64 suffix otherwise. Records only hold what Find returns, so the
+// metadata of PutWithMeta and the options of the collections aren't part of it, see Schema for the latter. The format
+// doesn't depend on the file format, so it's a way to move data between versions of it.
+
+// importBatch is the number of records ImportJSON and ImportBolt commit per transaction.
+const importBatch = 1000
+
+var ErrCorruptJSONExport = errors.New("JSON export record is malformed")
+
+// jsonRecord is a line of the JSON export.
+type jsonRecord struct {
+	Collection       *string `json:"collection,omitempty"`
+	CollectionBase64 *string `json:"collection_base64,omitempty"`
+	Key              *string `json:"key,omitempty"`
+	KeyBase64        *string `json:"key_base64,omitempty"`
+	Value            *string `json:"value,omitempty"`
+	ValueBase64      *string `json:"value_base64,omitempty"`
+}
+
+// encodeJSONField returns the field as a JSON string if it's valid UTF-8, and as base64 otherwise.
+func encodeJSONField(b []byte) (text *string, encoded *string) {
+	s := string(b)
+	if utf8.Valid(b) {
+		return &s, nil
+	}
+	s = base64.StdEncoding.EncodeToString(b)
+	return nil, &s
+}
+
+// decodeJSONField returns the field of a record from whichever of its forms is set. Exactly one must be.
+func decodeJSONField(text *string, encoded *string) ([]byte, error) {
+	switch {
+	case text != nil && encoded == nil:
+		return []byte(*text), nil
+	case text == nil && encoded != nil:
+		return base64.StdEncoding.DecodeString(*encoded)
+	}
+	return nil, ErrCorruptJSONExport
+}
+
+// jsonWriter writes the records of a JSON export.
+type jsonWriter struct {
+	bw      *bufio.Writer
+	encoder *json.Encoder
+}
+
+func newJSONWriter(w io.Writer) *jsonWriter {
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+	encoder.SetEscapeHTML(false)
+	return &jsonWriter{bw: bw, encoder: encoder}
+}
+
+func (jw *jsonWriter) write(collection []byte, key []byte, value []byte) error {
+	record := jsonRecord{}
+	record.Collection, record.CollectionBase64 = encodeJSONField(collection)
+	record.Key, record.KeyBase64 = encodeJSONField(key)
+	record.Value, record.ValueBase64 = encodeJSONField(value)
+	return jw.encoder.Encode(&record)
+}
+
+// ExportJSON writes every key of the collection to w as JSON Lines, in key order, see the format above.
+func (c *Collection) ExportJSON(w io.Writer) error {
+	jw := newJSONWriter(w)
+	err := c.tx.rangeItems(c.root, KeyRange{}, func(item *Item) (bool, error) {
+		resolved, err := c.resolveItem(item)
+		if err != nil {
+			return false, err
+		}
+		return true, jw.write(c.name, resolved.key, resolved.value)
+	})
+	if err != nil {
+		return err
+	}
+	return jw.bw.Flush()
+}
+
+// ExportJSON writes every key of every collection to w as JSON Lines, in the order of Export, which ImportJSON reads
+// back.
+func (tx *Tx) ExportJSON(w io.Writer) error {
+	jw := newJSONWriter(w)
+	err := tx.Export(jw.write)
+	if err != nil {
+		return err
+	}
+	return jw.bw.Flush()
+}
+
+// batchImporter puts records into a database, importBatch per write transaction.
+type batchImporter struct {
+	db    *DB
+	batch []KV
+	// collections holds the collection of every record of the batch.
+	collections [][]byte
+}
+
+func newBatchImporter(db *DB) *batchImporter {
+	return &batchImporter{db: db}
+}
+
+// add puts the key into the collection, creating it if needed, with the next batch. A nil key only creates the
+// collection.
+func (bi *batchImporter) add(collection []byte, key []byte, value []byte) error {
+	bi.collections = append(bi.collections, collection)
+	bi.batch = append(bi.batch, KV{Key: key, Value: value})
+	if len(bi.batch) < importBatch {
+		return nil
+	}
+	return bi.flush()
+}
+
+// flush commits the records added since the last batch.
+func (bi *batchImporter) flush() error {
+	if len(bi.batch) == 0 {
+		return nil
+	}
+	err := bi.db.Update(func(tx *Tx) error {
+		for i, kv := range bi.batch {
+			c, err := tx.getOrCreateCollection(bi.collections[i])
+			if err != nil {
+				return err
+			}
+			if kv.Key == nil {
+				continue
+			}
+			err = c.Put(kv.Key, kv.Value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	bi.batch = bi.batch[:0]
+	bi.collections = bi.collections[:0]
+	return err
+}
+
+// ImportJSON puts the records of a JSON export read from r into their collections, which are created as needed. Keys
+// that already exist are overwritten. The records are committed importBatch at a time, so a file can be imported
+// whatever its size, but an import failing halfway leaves the batches before the failure committed. Malformed lines
+// fail with ErrCorruptJSONExport along with their line number, and empty lines are skipped.
+func (db *DB) ImportJSON(r io.Reader) error {
+	br := bufio.NewReader(r)
+	importer := newBatchImporter(db)
+	for line := 1; ; line++ {
+		text, err := br.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(text) == 0 {
+			break
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		text = bytes.TrimSpace(text)
+		if len(text) == 0 {
+			continue
+		}
+		var parsed jsonRecord
+		err = json.Unmarshal(text, &parsed)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, ErrCorruptJSONExport)
+		}
+		var collection, key, value []byte
+		for _, field := range []struct {
+			dst           *[]byte
+			text, encoded *string
+		}{
+			{&collection, parsed.Collection, parsed.CollectionBase64},
+			{&key, parsed.Key, parsed.KeyBase64},
+			{&value, parsed.Value, parsed.ValueBase64},
+		} {
+			*field.dst, err = decodeJSONField(field.text, field.encoded)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", line, ErrCorruptJSONExport)
+			}
+		}
+		// Empty keys are keys, not collections to create
+		if key == nil {
+			key = []byte{}
+		}
+		err = importer.add(collection, key, value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return importer.flush()
+}
+
+// loadCollection is the internal collection the load checkpoints are kept in, by checkpoint key, as decimal text.
+var loadCollection = []byte("__gopherdb_load")
+
+// LoadCheckpoint returns the position recorded under the key by SetLoadCheckpoint, or 0 if there's none, for loads
+// that go on where they stopped when they're run again, like the load command of cmd/gopherdb.
+func (tx *Tx) LoadCheckpoint(key []byte) (uint64, error) {
+	collection, err := tx.GetCollection(loadCollection)
+	if err != nil || collection == nil {
+		return 0, err
+	}
+	value, err := collection.Get(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(value), 10, 64)
+}
+
+// SetLoadCheckpoint records the position of the load under the key, in the transaction writing what was loaded up to
+// it, so the checkpoint and the data commit together.
+func (tx *Tx) SetLoadCheckpoint(key []byte, position uint64) error {
+	if !tx.write {
+		return ErrWriteInsideReadTx
+	}
+	collection, err := tx.getOrCreateCollection(loadCollection)
+	if err != nil {
+		return err
+	}
+	return collection.Put(key, []byte(strconv.FormatUint(position, 10)))
+}
@@ -0,0 +1,154 @@
+package gopherdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestExportRoundTripWithKeyTransform(t *testing.T) {
+	db := openTestDB(t, nil)
+	db.SetKeyTransform([]byte("kept"), &KeyTransform{Transform: HashKeys(8), KeepOriginal: true})
+	mustUpdate(t, db, func(tx *Tx) error {
+		for _, name := range []string{"kept", "plain"} {
+			c := getOrCreate(t, tx, name)
+			for _, key := range []string{"a", "b", "c"} {
+				if err := c.Put([]byte(key), []byte(name+"-"+key)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	var stream bytes.Buffer
+	mustView(t, db, func(tx *Tx) error { return tx.WriteExport(&stream) })
+
+	got := map[string]string{}
+	err := ReadExport(&stream, func(collection []byte, key []byte, value []byte) error {
+		got[string(collection)+"/"+string(key)] = string(value)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadExport: %v", err)
+	}
+	for _, name := range []string{"kept", "plain"} {
+		for _, key := range []string{"a", "b", "c"} {
+			if value := got[name+"/"+key]; value != name+"-"+key {
+				t.Errorf("record %s/%s: got %q, want %q", name, key, value, name+"-"+key)
+			}
+		}
+	}
+	if len(got) != 6 {
+		t.Errorf("got %d records, want 6: %v", len(got), got)
+	}
+}
+
+func TestReadExportRejectsHugeLengths(t *testing.T) {
+	for _, length := range []uint64{MaxValueSize + 1, MaxValueSize, 1 << 20} {
+		stream := binary.LittleEndian.AppendUint32(nil, exportMagic)
+		stream = binary.AppendUvarint(stream, length)
+		stream = append(stream, "short"...)
+		err := ReadExport(bytes.NewReader(stream), func([]byte, []byte, []byte) error {
+			t.Fatal("fn called for a truncated record")
+			return nil
+		})
+		if !errors.Is(err, ErrCorruptExport) {
+			t.Errorf("length %d: got %v, want ErrCorruptExport", length, err)
+		}
+	}
+}
+
+func TestJSONExportRoundTrip(t *testing.T) {
+	src := openTestDB(t, nil)
+	binaryKey, binaryValue := []byte{0xff, 0x00, 0x01}, []byte{0xfe, 'x'}
+	mustUpdate(t, src, func(tx *Tx) error {
+		users := getOrCreate(t, tx, "users")
+		for i := 0; i < 2*importBatch+10; i++ {
+			if err := users.Put(testKey(i), []byte(fmt.Sprintf(`{"n": %d} <&>`, i))); err != nil {
+				return err
+			}
+		}
+		return getOrCreate(t, tx, "raw").Put(binaryKey, binaryValue)
+	})
+
+	var stream bytes.Buffer
+	mustView(t, src, func(tx *Tx) error { return tx.ExportJSON(&stream) })
+	if !bytes.Contains(stream.Bytes(), []byte(`{"collection":"raw","key_base64":"/wAB","value_base64":"/ng="}`)) {
+		t.Fatalf("the binary record isn't base64 in %q", stream.String()[:200])
+	}
+
+	dst := openTestDB(t, nil)
+	if err := dst.ImportJSON(&stream); err != nil {
+		t.Fatalf("ImportJSON: %v", err)
+	}
+	var want, got bytes.Buffer
+	mustView(t, src, func(tx *Tx) error { return tx.WriteExport(&want) })
+	mustView(t, dst, func(tx *Tx) error { return tx.WriteExport(&got) })
+	if !bytes.Equal(want.Bytes(), got.Bytes()) {
+		t.Fatal("the imported database doesn't export like the original")
+	}
+
+	var one bytes.Buffer
+	mustView(t, src, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("raw"))
+		if err != nil {
+			return err
+		}
+		return c.ExportJSON(&one)
+	})
+	if lines := bytes.Count(one.Bytes(), []byte("\n")); lines != 1 {
+		t.Fatalf("the export of raw has %d lines, want 1", lines)
+	}
+}
+
+func TestImportJSONRejectsMalformedLines(t *testing.T) {
+	db := openTestDB(t, nil)
+	for _, line := range []string{
+		`not json`,
+		`{"collection":"c","key":"k"}`,
+		`{"collection":"c","key":"k","key_base64":"aw==","value":"v"}`,
+		`{"collection":"c","key_base64":"!!","value":"v"}`,
+	} {
+		err := db.ImportJSON(bytes.NewBufferString("{\"collection\":\"c\",\"key\":\"a\",\"value\":\"v\"}\n\n" + line + "\n"))
+		if !errors.Is(err, ErrCorruptJSONExport) || !strings.HasPrefix(err.Error(), "line 3: ") {
+			t.Errorf("%s: got %v, want ErrCorruptJSONExport on line 3", line, err)
+		}
+	}
+}
+
+func TestLoadCheckpointsAreInternal(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustView(t, db, func(tx *Tx) error {
+		position, err := tx.LoadCheckpoint([]byte("import"))
+		if err != nil || position != 0 {
+			t.Errorf("LoadCheckpoint without checkpoint: got %d, %v, want 0", position, err)
+		}
+		return nil
+	})
+	mustUpdate(t, db, func(tx *Tx) error {
+		return tx.SetLoadCheckpoint([]byte("import"), 1500)
+	})
+	mustView(t, db, func(tx *Tx) error {
+		position, err := tx.LoadCheckpoint([]byte("import"))
+		if err != nil || position != 1500 {
+			t.Errorf("LoadCheckpoint: got %d, %v, want 1500", position, err)
+		}
+		names, err := tx.ListCollections()
+		if err != nil || len(names) != 0 {
+			t.Errorf("ListCollections: got %q, %v, want no collection", names, err)
+		}
+		return nil
+	})
+	for _, name := range []string{"__gopherdb_load", "__gopherdb_checkpoints", "__gopherdb_later"} {
+		if !isInternalCollection([]byte(name)) {
+			t.Errorf("%s isn't internal", name)
+		}
+	}
+	if isInternalCollection([]byte("gopherdb_users")) {
+		t.Error("gopherdb_users is internal")
+	}
+}
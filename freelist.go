@@ -1,18 +1,47 @@
-package main
+package gopherdb
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
 
-// metaPage is the maximum pgnum that is used by the db for its own purposes. For now, only page 0 is used as the
-// header page. It means all other page numbers can be used.
+// metaPage is the page the page numbers of a new freelist start after. The first pages a new file takes are the second
+// meta page and the freelist pages, see newDal.
 const metaPage = 0
 
-// freelist manages the manages free and used pages.
+const (
+	// freelistHeaderSize is the size of the biggest page number, the number of free pages and the first page of the
+	// chain in front of the free pages of the freelist page. Freelist pages of format version 7 have no chain, and
+	// the ones before version 7 store the first two as uint16, in legacyFreelistHeaderSize.
+	freelistHeaderSize         = 3 * pageNumSize
+	version7FreelistHeaderSize = 2 * pageNumSize
+	legacyFreelistHeaderSize   = 4
+	// freelistChainHeaderSize is the size of the next page of the chain in front of the free pages of a chain page.
+	freelistChainHeaderSize = pageNumSize
+	// freelistRunFlag flags the first page of a run of consecutive free pages, followed by the number of pages of the
+	// run, in the freelist pages of format version 9. Page numbers never get to the top bit.
+	freelistRunFlag = uint64(1) << 63
+)
+
+// freelist manages the free and used pages.
 type freelist struct {
 	// maxPage holds the latest page num allocated. releasedPages holds all the ids that were released during
 	// delete. New page ids are first given from the releasedPageIDs to avoid growing the file. If it's empty, then
 	// maxPage is incremented and a new page is created thus increasing the file size.
 	maxPage       pgnum
 	releasedPages []pgnum
+
+	// journal holds the changes made since the freelist page was last written, when journaling is set: 0 for every
+	// page allocation and the page number for every released page. Allocations take the pages in a fixed order, so
+	// replaying the journal over the freelist page gives back the same freelist.
+	journal    []pgnum
+	journaling bool
+
+	// chain holds the pages the freelist page continues on, in order, when the free pages don't fit in it.
+	chain []pgnum
+	// run holds the first page of a run whose number of pages is on the next page of the chain, while it's read.
+	run pgnum
 }
 
 func newFreelist() *freelist {
@@ -22,7 +51,21 @@ func newFreelist() *freelist {
 	}
 }
 
+// clone returns a copy of the freelist that doesn't share its lists.
+func (fr *freelist) clone() *freelist {
+	return &freelist{
+		maxPage:       fr.maxPage,
+		releasedPages: append([]pgnum{}, fr.releasedPages...),
+		journal:       append([]pgnum(nil), fr.journal...),
+		journaling:    fr.journaling,
+		chain:         append([]pgnum(nil), fr.chain...),
+	}
+}
+
 func (fr *freelist) getNextPage() pgnum {
+	if fr.journaling {
+		fr.journal = append(fr.journal, 0)
+	}
 	if len(fr.releasedPages) != 0 {
 		// Take the last element and remove it from the list
 		pageID := fr.releasedPages[len(fr.releasedPages)-1]
@@ -34,38 +77,203 @@ func (fr *freelist) getNextPage() pgnum {
 }
 
 func (fr *freelist) releasePage(page pgnum) {
+	if fr.journaling {
+		fr.journal = append(fr.journal, page)
+	}
 	fr.releasedPages = append(fr.releasedPages, page)
 }
 
-func (fr *freelist) serialize(buf []byte) []byte {
-	pos := 0
+// replay applies the journal of the meta page over the freelist read from the freelist page. The journal is kept, so
+// the next changes are journaled after it.
+func (fr *freelist) replay(journal []pgnum) {
+	journaling := fr.journaling
+	fr.journaling = false
+	for _, page := range journal {
+		if page == 0 {
+			fr.getNextPage()
+		} else {
+			fr.releasePage(page)
+		}
+	}
+	fr.journaling = journaling
+	fr.journal = append([]pgnum{}, journal...)
+}
+
+// sortReleased sorts the free pages, so the pages freed together end up in runs the freelist page stores as one. The
+// sorted pages are a new list, since snapshots and checkpoints filter the old one in place.
+func (fr *freelist) sortReleased() {
+	sorted := append([]pgnum{}, fr.releasedPages...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	fr.releasedPages = sorted
+}
+
+// encodeFree returns the words the free pages are written as, in their order: a run of consecutive pages as its first
+// page with freelistRunFlag and its number of pages, and any other page as itself. A run takes two words, so the free
+// pages never take more words than there are pages.
+func encodeFree(pages []pgnum) []uint64 {
+	words := make([]uint64, 0, len(pages))
+	for i := 0; i < len(pages); {
+		n := 1
+		for i+n < len(pages) && pages[i+n] == pages[i]+pgnum(n) {
+			n++
+		}
+		if n == 1 {
+			words = append(words, uint64(pages[i]))
+		} else {
+			words = append(words, uint64(pages[i])|freelistRunFlag, uint64(n))
+		}
+		i += n
+	}
+	return words
+}
 
-	binary.LittleEndian.PutUint16(buf[pos:], uint16(fr.maxPage))
-	pos += 2
+// freeWords returns the number of words the free pages and the held ones take in the freelist pages, see encodeFree.
+func (fr *freelist) freeWords(held []pgnum) int {
+	return len(encodeFree(append(append([]pgnum{}, fr.releasedPages...), held...)))
+}
 
-	// released pages count
-	binary.LittleEndian.PutUint16(buf[pos:], uint16(len(fr.releasedPages)))
-	pos += 2
+// chainLength returns the number of pages the freelist page continues on to hold the given number of words of free
+// pages, see encodeFree. The number of free pages is always enough.
+func chainLength(free int, pageSize int) int {
+	extra := free - (pageSize-freelistHeaderSize)/pageNumSize
+	if extra <= 0 {
+		return 0
+	}
+	perPage := (pageSize - freelistChainHeaderSize) / pageNumSize
+	return (extra + perPage - 1) / perPage
+}
+
+// serialize writes the freelist to the buffers of the freelist page and of the pages of its chain, which must have
+// room for all the free pages, see chainLength, and fails otherwise rather than writing a freelist that can't be read
+// back. The held pages are written as free pages after the others, see dal.heldPages: they're only held while the
+// process has views of them. Reading the pages back gives the free pages in the same order, which replaying the journal
+// relies on.
+func (fr *freelist) serialize(pages [][]byte, held []pgnum) error {
+	next := func(i int) uint64 {
+		if i < len(fr.chain) {
+			return uint64(fr.chain[i])
+		}
+		return 0
+	}
 
-	for _, page := range fr.releasedPages {
-		binary.LittleEndian.PutUint64(buf[pos:], uint64(page))
-		pos += pageNumSize
+	free := encodeFree(append(append([]pgnum{}, fr.releasedPages...), held...))
+	head := pages[0]
+	binary.LittleEndian.PutUint64(head, uint64(fr.maxPage))
+	// words of the free pages count
+	binary.LittleEndian.PutUint64(head[pageNumSize:], uint64(len(free)))
+	binary.LittleEndian.PutUint64(head[2*pageNumSize:], next(0))
 
+	for i, buf := range pages {
+		pos := freelistHeaderSize
+		if i > 0 {
+			binary.LittleEndian.PutUint64(buf, next(i))
+			pos = freelistChainHeaderSize
+		}
+		for ; len(free) > 0 && pos+pageNumSize <= len(buf); pos += pageNumSize {
+			binary.LittleEndian.PutUint64(buf[pos:], free[0])
+			free = free[1:]
+		}
 	}
-	return buf
+	if len(free) > 0 {
+		return fmt.Errorf("%w: %d words of free pages don't fit in the %d pages of the freelist", ErrCorruptFreelist,
+			len(free), len(pages))
+	}
+	return nil
 }
 
-func (fr *freelist) deserialize(buf []byte) {
+// deserialize reads a freelist page written with the given format version. It returns the first page of the chain and
+// the number of words of free pages left to read from it, see deserializeChain. Before version 9, every word is a free
+// page.
+func (fr *freelist) deserialize(buf []byte, version uint16) (pgnum, uint64, error) {
 	pos := 0
-	fr.maxPage = pgnum(binary.LittleEndian.Uint16(buf[pos:]))
-	pos += 2
+	var count uint64
+	var next pgnum
+	switch {
+	case version < 7:
+		if len(buf) < legacyFreelistHeaderSize {
+			return 0, 0, ErrCorruptFreelist
+		}
+		fr.maxPage = pgnum(binary.LittleEndian.Uint16(buf))
+		count = uint64(binary.LittleEndian.Uint16(buf[2:]))
+		pos = legacyFreelistHeaderSize
+	case version < 8:
+		if len(buf) < version7FreelistHeaderSize {
+			return 0, 0, ErrCorruptFreelist
+		}
+		fr.maxPage = pgnum(binary.LittleEndian.Uint64(buf))
+		count = binary.LittleEndian.Uint64(buf[pageNumSize:])
+		pos = version7FreelistHeaderSize
+	default:
+		if len(buf) < freelistHeaderSize {
+			return 0, 0, ErrCorruptFreelist
+		}
+		fr.maxPage = pgnum(binary.LittleEndian.Uint64(buf))
+		count = binary.LittleEndian.Uint64(buf[pageNumSize:])
+		next = pgnum(binary.LittleEndian.Uint64(buf[2*pageNumSize:]))
+		pos = freelistHeaderSize
+	}
 
-	// released pages count
-	releasedPagesCount := int(binary.LittleEndian.Uint16(buf[pos:]))
-	pos += 2
+	left, err := fr.readFree(buf[pos:], count, version >= 9)
+	if err != nil {
+		return 0, 0, err
+	}
+	// Only version 8 continues on other pages
+	if left > 0 && next == 0 {
+		return 0, 0, ErrCorruptFreelist
+	}
+	return next, left, nil
+}
+
+// deserializeChain reads a page of the chain of a freelist written with the given format version, given the number of
+// words of free pages left to read. It returns the next page of the chain and the number of words left to read from
+// it.
+func (fr *freelist) deserializeChain(buf []byte, left uint64, version uint16) (pgnum, uint64, error) {
+	if len(buf) < freelistChainHeaderSize {
+		return 0, 0, ErrCorruptFreelist
+	}
+	next := pgnum(binary.LittleEndian.Uint64(buf))
+	left, err := fr.readFree(buf[freelistChainHeaderSize:], left, version >= 9)
+	if err != nil {
+		return 0, 0, err
+	}
+	if left > 0 && next == 0 {
+		return 0, 0, ErrCorruptFreelist
+	}
+	return next, left, nil
+}
 
-	for i := 0; i < releasedPagesCount; i++ {
-		fr.releasedPages = append(fr.releasedPages, pgnum(binary.LittleEndian.Uint64(buf[pos:])))
-		pos += pageNumSize
+// readFree appends the free pages of the words of the buffer, up to count, and returns the number of words that didn't
+// fit in it. With runs, the words are the ones of encodeFree, and runs can't go past the biggest page number.
+func (fr *freelist) readFree(buf []byte, count uint64, runs bool) (uint64, error) {
+	n := uint64(len(buf) / pageNumSize)
+	if count < n {
+		n = count
+	}
+	for i := uint64(0); i < n; i++ {
+		word := binary.LittleEndian.Uint64(buf[i*pageNumSize:])
+		switch {
+		case !runs:
+			fr.releasedPages = append(fr.releasedPages, pgnum(word))
+		case fr.run != 0:
+			if word < 2 || word-1 > uint64(fr.maxPage-fr.run) {
+				return 0, ErrCorruptFreelist
+			}
+			for page := fr.run; page < fr.run+pgnum(word); page++ {
+				fr.releasedPages = append(fr.releasedPages, page)
+			}
+			fr.run = 0
+		case word&freelistRunFlag != 0:
+			fr.run = pgnum(word &^ freelistRunFlag)
+			if fr.run == 0 || fr.run > fr.maxPage {
+				return 0, ErrCorruptFreelist
+			}
+		default:
+			fr.releasedPages = append(fr.releasedPages, pgnum(word))
+		}
+	}
+	// A run needs its number of pages
+	if count == n && fr.run != 0 {
+		return 0, ErrCorruptFreelist
 	}
+	return count - n, nil
 }
@@ -0,0 +1,400 @@
+package gopherdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFreelistRoundTripBeyondUint16(t *testing.T) {
+	fr := newFreelist()
+	fr.maxPage = 1<<20 + 3
+	fr.releasedPages = []pgnum{70000, 3, 1 << 20}
+	buf := make([]byte, 512)
+	if err := fr.serialize([][]byte{buf}, nil); err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+
+	got := newFreelist()
+	if _, left, err := got.deserialize(buf, formatVersion); err != nil || left != 0 {
+		t.Fatalf("deserialize: %d left, %v", left, err)
+	}
+	if got.maxPage != fr.maxPage || fmt.Sprint(got.releasedPages) != fmt.Sprint(fr.releasedPages) {
+		t.Errorf("got max page %d and %v, want %d and %v", got.maxPage, got.releasedPages, fr.maxPage, fr.releasedPages)
+	}
+}
+
+func TestFreelistDeserializeRejectsCountsBeyondThePage(t *testing.T) {
+	buf := make([]byte, 64)
+	binary.LittleEndian.PutUint64(buf[pageNumSize:], 7)
+	if _, _, err := newFreelist().deserialize(buf, formatVersion); err != ErrCorruptFreelist {
+		t.Errorf("deserialize: got %v, want ErrCorruptFreelist", err)
+	}
+}
+
+func TestFreelistStoresRunsOfFreePages(t *testing.T) {
+	fr := newFreelist()
+	fr.maxPage = 10000
+	perPage := (512 - freelistHeaderSize) / pageNumSize
+	// The last word of the freelist page starts a run, whose number of pages is on the chain
+	for i := 0; i < perPage-1; i++ {
+		fr.releasedPages = append(fr.releasedPages, pgnum(10+2*i))
+	}
+	for page := pgnum(5000); page < 5100; page++ {
+		fr.releasedPages = append(fr.releasedPages, page)
+	}
+	fr.releasedPages = append(fr.releasedPages, 7, 8, 3)
+	fr.chain = []pgnum{9000}
+	if words := fr.freeWords(nil); words != perPage+4 {
+		t.Fatalf("words of %d free pages: got %d, want %d", len(fr.releasedPages), words, perPage+4)
+	}
+	if length := chainLength(fr.freeWords(nil), 512); length != 1 {
+		t.Fatalf("chain of %d words: got %d pages, want 1", fr.freeWords(nil), length)
+	}
+	bufs := [][]byte{make([]byte, 512), make([]byte, 512)}
+	if err := fr.serialize(bufs, []pgnum{9500}); err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+
+	got := newFreelist()
+	next, left, err := got.deserialize(bufs[0], formatVersion)
+	if err != nil || next != 9000 || left != 5 {
+		t.Fatalf("deserialize: next %d, %d left, %v", next, left, err)
+	}
+	if next, left, err = got.deserializeChain(bufs[1], left, formatVersion); err != nil || next != 0 || left != 0 {
+		t.Fatalf("deserializeChain: next %d, %d left, %v", next, left, err)
+	}
+	want := append(append([]pgnum{}, fr.releasedPages...), 9500)
+	if fmt.Sprint(got.releasedPages) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got.releasedPages, want)
+	}
+}
+
+func TestFreelistDeserializeRejectsRunsBeyondTheMaxPage(t *testing.T) {
+	for _, run := range [][]uint64{{5 | freelistRunFlag, 10}, {5 | freelistRunFlag, 1}, {20 | freelistRunFlag, 2}, {5 | freelistRunFlag}} {
+		fr := &freelist{maxPage: 12, releasedPages: []pgnum{}}
+		buf := make([]byte, 64)
+		binary.LittleEndian.PutUint64(buf, uint64(fr.maxPage))
+		binary.LittleEndian.PutUint64(buf[pageNumSize:], uint64(len(run)))
+		for i, word := range run {
+			binary.LittleEndian.PutUint64(buf[freelistHeaderSize+i*pageNumSize:], word)
+		}
+		if _, _, err := fr.deserialize(buf, formatVersion); err != ErrCorruptFreelist {
+			t.Errorf("deserialize of the run %v: got %v, want ErrCorruptFreelist", run, err)
+		}
+	}
+}
+
+func TestFreelistPageKeepsRunsAcrossReopens(t *testing.T) {
+	for _, journal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("JournalFreelist=%v", journal), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			options := testOptions()
+			options.JournalFreelist = journal
+			db := openTestPath(t, path, options)
+			value := string(make([]byte, 100))
+			mustUpdate(t, db, func(tx *Tx) error {
+				c := getOrCreate(t, tx, "a")
+				for i := 0; i < 2000; i++ {
+					if err := c.Put([]byte(fmt.Sprintf("key%05d", i)), []byte(value)); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+
+			// The pages of the collection were taken one after the other, so they're freed as a few runs
+			mustUpdate(t, db, func(tx *Tx) error { return tx.DeleteCollection([]byte("a"), DeleteCascade) })
+			if words := db.freeWords(db.heldPages); words*10 > len(db.releasedPages) {
+				t.Errorf("%d free pages take %d words", len(db.releasedPages), words)
+			}
+			if len(db.chain) != 0 {
+				t.Errorf("%d free pages in runs: got a chain of %d pages", len(db.releasedPages), len(db.chain))
+			}
+			putValue(t, db, "b", "key", "value")
+			maxPage, free := db.maxPage, fmt.Sprint(db.releasedPages)
+			if err := db.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			checkFile(t, path, options)
+
+			// Replaying the journal over the runs takes the same pages
+			db = openTestPath(t, path, options)
+			if db.maxPage != maxPage || fmt.Sprint(db.releasedPages) != free {
+				t.Errorf("after reopening, max page %d and free pages %v, want %d and %s", db.maxPage, db.releasedPages, maxPage, free)
+			}
+		})
+	}
+}
+
+// downgradeToVersion6 rewrites the meta pages and freelist pages of the closed file in the format of version 6.
+func downgradeToVersion6(t *testing.T, path string, pageSize int) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer file.Close()
+	downgraded := map[pgnum]bool{}
+	for _, slot := range []pgnum{metaPageNum, metaPageNumB} {
+		buf := make([]byte, pageSize)
+		if _, err := file.ReadAt(buf, int64(slot)*int64(pageSize)); err != nil {
+			t.Fatalf("ReadAt: %v", err)
+		}
+		m := newEmptyMeta()
+		if err := m.deserialize(buf); err != nil {
+			continue
+		}
+		pos := magicNumberSize + 3*pageNumSize + freelistJournalHeaderSize + len(m.freelistJournal)*pageNumSize
+		binary.LittleEndian.PutUint16(buf[pos:], 6)
+		end := len(buf) - checksumSize
+		binary.LittleEndian.PutUint32(buf[end:], crc32.Checksum(buf[:end], castagnoli))
+		if _, err := file.WriteAt(buf, int64(slot)*int64(pageSize)); err != nil {
+			t.Fatalf("WriteAt: %v", err)
+		}
+
+		if downgraded[m.freelistPage] {
+			continue
+		}
+		downgraded[m.freelistPage] = true
+		freelistBuf := make([]byte, pageSize)
+		if _, err := file.ReadAt(freelistBuf, int64(m.freelistPage)*int64(pageSize)); err != nil {
+			t.Fatalf("ReadAt: %v", err)
+		}
+		fr := newFreelist()
+		if _, left, err := fr.deserialize(freelistBuf, formatVersion); err != nil || left != 0 {
+			t.Fatalf("deserialize: %d left, %v", left, err)
+		}
+		legacy := make([]byte, pageSize)
+		binary.LittleEndian.PutUint16(legacy, uint16(fr.maxPage))
+		binary.LittleEndian.PutUint16(legacy[2:], uint16(len(fr.releasedPages)))
+		for i, page := range fr.releasedPages {
+			binary.LittleEndian.PutUint64(legacy[legacyFreelistHeaderSize+i*pageNumSize:], uint64(page))
+		}
+		if _, err := file.WriteAt(legacy, int64(m.freelistPage)*int64(pageSize)); err != nil {
+			t.Fatalf("WriteAt: %v", err)
+		}
+	}
+}
+
+func TestVersion6FreelistIsMigrated(t *testing.T) {
+	for _, journal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("JournalFreelist=%v", journal), func(t *testing.T) {
+			testVersion6FreelistIsMigrated(t, journal)
+		})
+	}
+}
+
+func testVersion6FreelistIsMigrated(t *testing.T, journal bool) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	options.JournalFreelist = journal
+	db := openTestPath(t, path, options)
+	for i := 0; i < 100; i++ {
+		putValue(t, db, "c", fmt.Sprintf("key%03d", i), "value")
+	}
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i := 0; i < 100; i += 3 {
+			if err := c.Remove([]byte(fmt.Sprintf("key%03d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	maxPage, free := db.maxPage, fmt.Sprint(sortedPages(db.releasedPages))
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	downgradeToVersion6(t, path, options.pageSize)
+
+	db = openTestPath(t, path, options)
+	if db.meta.version != 6 {
+		t.Fatalf("version of the downgraded file: got %d, want 6", db.meta.version)
+	}
+	if db.maxPage != maxPage || fmt.Sprint(sortedPages(db.releasedPages)) != free {
+		t.Errorf("freelist of version 6: got %d and %v, want %d and %s", db.maxPage, sortedPages(db.releasedPages), maxPage, free)
+	}
+	putValue(t, db, "c", "key001", "migrated")
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	checkFile(t, path, options)
+
+	db = openTestPath(t, path, options)
+	if db.meta.version != formatVersion {
+		t.Errorf("version after a commit: got %d, want %d", db.meta.version, formatVersion)
+	}
+	if got := getValue(t, db, "c", "key001"); got != "migrated" {
+		t.Errorf("key001: got %q, want migrated", got)
+	}
+	if got := getValue(t, db, "c", "key002"); got != "value" {
+		t.Errorf("key002: got %q, want value", got)
+	}
+}
+
+func TestFreelistChainAcrossCommits(t *testing.T) {
+	for _, journal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("JournalFreelist=%v", journal), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			options := testOptions()
+			options.JournalFreelist = journal
+			db := openTestPath(t, path, options)
+			value := string(make([]byte, 100))
+			// The collections are written together, so their pages alternate and the free pages of one don't make runs
+			mustUpdate(t, db, func(tx *Tx) error {
+				for i := 0; i < 2000; i++ {
+					for _, name := range []string{"a", "b"} {
+						if err := getOrCreate(t, tx, name).Put([]byte(fmt.Sprintf("key%05d", i)), []byte(value)); err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			})
+
+			// Hundreds of pages freed at once don't fit in the freelist page
+			mustUpdate(t, db, func(tx *Tx) error { return tx.DeleteCollection([]byte("a"), DeleteCascade) })
+			if len(db.chain) == 0 {
+				t.Fatalf("%d free pages with %d byte pages: got no chain", len(db.releasedPages), options.pageSize)
+			}
+			free := len(db.releasedPages)
+			if err := db.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			checkFile(t, path, options)
+
+			db = openTestPath(t, path, options)
+			if len(db.releasedPages) != free {
+				t.Errorf("free pages after reopening: got %d, want %d", len(db.releasedPages), free)
+			}
+			// Writing takes the free pages back, and the chain shrinks with them
+			maxPage := db.maxPage
+			mustUpdate(t, db, func(tx *Tx) error {
+				c := getOrCreate(t, tx, "c")
+				for i := 0; i < 2000; i++ {
+					if err := c.Put([]byte(fmt.Sprintf("key%05d", i)), []byte(value)); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if db.maxPage > maxPage+pgnum(free)/10 {
+				t.Errorf("the file grew from %d to %d pages with %d free pages", maxPage, db.maxPage, free)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			checkFile(t, path, options)
+		})
+	}
+}
+
+func TestJournalFreelistSkipsTheFreelistPage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	options.JournalFreelist = true
+	db := openTestPath(t, path, options)
+	for i := 0; i < 20; i++ {
+		putValue(t, db, "c", string(testKey(i)), "value")
+	}
+	freelistPage := func() []byte {
+		data := readFile(t, path)
+		offset := int(db.freelistPage) * db.pageSize
+		return data[offset : offset+db.pageSize]
+	}
+
+	// Small commits only journal their changes in the meta page
+	before := freelistPage()
+	for i := 0; i < 3; i++ {
+		putValue(t, db, "c", string(testKey(i)), "changed")
+	}
+	if len(db.freelistJournal) == 0 {
+		t.Fatal("the meta page has no journal")
+	}
+	if !bytes.Equal(freelistPage(), before) {
+		t.Error("a commit fitting in the journal wrote the freelist page")
+	}
+
+	// Reopening replays the journal, which gives back the same freelist
+	free := sortedPages(append([]pgnum{}, db.releasedPages...))
+	maxPage := db.maxPage
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	checkFile(t, path, options)
+	db = openTestPath(t, path, options)
+	if db.maxPage != maxPage || fmt.Sprint(sortedPages(db.releasedPages)) != fmt.Sprint(free) {
+		t.Errorf("after reopening, max page %d and free pages %v, want %d and %v", db.maxPage, db.releasedPages, maxPage, free)
+	}
+
+	// Once the journal doesn't fit anymore, the freelist page is written and the journal starts over
+	for i := 0; len(db.freelistJournal) > 0 && i < 1000; i++ {
+		putValue(t, db, "c", string(testKey(i%20)), fmt.Sprint(i))
+	}
+	if len(db.freelistJournal) > 0 {
+		t.Fatalf("the journal has %d entries after 1000 commits", len(db.freelistJournal))
+	}
+	if bytes.Equal(freelistPage(), before) {
+		t.Error("the freelist page wasn't written when the journal got full")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	checkFile(t, path, options)
+}
+
+func TestFreelistSerializeFailsWhenTheChainIsTooShort(t *testing.T) {
+	fr := newFreelist()
+	perPage := (512 - freelistHeaderSize) / pageNumSize
+	for i := 0; i <= perPage; i++ {
+		fr.releasedPages = append(fr.releasedPages, pgnum(10+2*i))
+	}
+	if err := fr.serialize([][]byte{make([]byte, 512)}, nil); !errors.Is(err, ErrCorruptFreelist) {
+		t.Errorf("serialize of %d free pages to a single page: got %v, want ErrCorruptFreelist", perPage+1, err)
+	}
+}
+
+// The chain gives back the pages the free pages don't need, which adds them to the free pages: around the capacity of
+// the freelist page, the chain must keep room for the page it gives back.
+func TestFreelistChainAtTheCapacityOfTheFreelistPage(t *testing.T) {
+	options := testOptions()
+	perPage := (options.pageSize - freelistHeaderSize) / pageNumSize
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPath(t, path, options)
+	value := string(make([]byte, 100))
+	mustUpdate(t, db, func(tx *Tx) error {
+		for i := 0; i < 600; i++ {
+			for _, name := range []string{"a", "c"} {
+				if err := getOrCreate(t, tx, name).Put([]byte(fmt.Sprintf("key%05d", i)), []byte(value)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	mustUpdate(t, db, func(tx *Tx) error { return tx.DeleteCollection([]byte("a"), DeleteCascade) })
+
+	// Taking the free pages back a few at a time walks the words of free pages down past the capacity
+	crossed := false
+	for i := 0; db.freeWords(db.heldPages) > perPage-10; i++ {
+		mustUpdate(t, db, func(tx *Tx) error {
+			return getOrCreate(t, tx, "b").Put([]byte(fmt.Sprintf("key%05d", i)), []byte(value))
+		})
+		words := db.freeWords(db.heldPages)
+		crossed = crossed || words == perPage || words == perPage+1
+		if err := db.Close(); err != nil {
+			t.Fatalf("Close with %d free pages: %v", len(db.releasedPages), err)
+		}
+		db = openTestPath(t, path, options)
+	}
+	if !crossed {
+		t.Errorf("the free pages never were at the capacity of %d of the freelist page", perPage)
+	}
+	checkFile(t, path, options)
+}
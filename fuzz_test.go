@@ -0,0 +1,277 @@
+package gopherdb
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// Fuzz targets for the on-disk format handlers, run with go test -fuzz=FuzzDeserialize and so on. Without -fuzz, go
+// test runs them over their seed corpus.
+
+// fuzzPageSize is the page size used by the node targets, independent of the page size of the machine so crashes
+// reproduce everywhere.
+const fuzzPageSize = 4096
+
+// fuzzKeySpace bounds the keys used by FuzzTxOps, so operations often hit existing keys.
+const fuzzKeySpace = 64
+
+// nodeSeeds are the seed inputs of FuzzNodeSerialize, see fuzzNode.
+var nodeSeeds = [][]byte{
+	{0},
+	{0, 3, 'a', 'b', 'c', 2, 'v', '1', 1, 'd', 0},
+	{1, 1, 'a', 1, 'x', 1, 'b', 1, 'y', 1, 'c', 1, 'z'},
+	{2, 1, 'k', 16, 1, 0, 0, 0, 0, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0},
+}
+
+// FuzzNodeSerialize builds a node out of the input, serializes it and checks that deserializing the page returns the
+// same node.
+func FuzzNodeSerialize(f *testing.F) {
+	for _, seed := range nodeSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		node := fuzzNode(data)
+		if node == nil || node.nodeSize() > fuzzPageSize {
+			return
+		}
+
+		decoded := NewEmptyNode()
+		err := decoded.deserialize(node.serialize(make([]byte, fuzzPageSize)))
+		if err != nil {
+			t.Fatalf("re-serialized node can't be deserialized: %s", err)
+		}
+		assertNodesEqual(t, node, decoded)
+	})
+}
+
+// FuzzDeserialize feeds the input to the node, meta and freelist deserializers, which must reject malformed pages with
+// an error instead of panicking. Nodes that deserialize successfully must survive another serialization round trip.
+func FuzzDeserialize(f *testing.F) {
+	for _, seed := range nodeSeeds {
+		f.Add(fuzzNode(seed).serialize(make([]byte, fuzzPageSize)))
+	}
+	meta := make([]byte, fuzzPageSize)
+	newEmptyMeta().serialize(meta)
+	f.Add(meta)
+	freelistPage := make([]byte, fuzzPageSize)
+	(&freelist{maxPage: 9, releasedPages: []pgnum{3, 5, 8}}).serialize([][]byte{freelistPage}, nil)
+	f.Add(freelistPage)
+	f.Add([]byte{1, 1})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Truncated pages exercise the bounds checks at the end of the buffer
+		_ = NewEmptyNode().deserialize(data)
+		_ = newEmptyMeta().deserialize(data)
+		for _, version := range []uint16{6, 7, formatVersion} {
+			_, left, err := newFreelist().deserialize(data, version)
+			if err == nil && left > 0 {
+				_, _, _ = newFreelist().deserializeChain(data, left, version)
+			}
+		}
+
+		page := make([]byte, fuzzPageSize)
+		copy(page, data)
+		node := NewEmptyNode()
+		if node.deserialize(page) != nil {
+			return
+		}
+		// Several offsets can point to the same cell, so a valid page may decode into a node that doesn't fit a page
+		if node.nodeSize() > fuzzPageSize {
+			return
+		}
+
+		decoded := NewEmptyNode()
+		err := decoded.deserialize(node.serialize(make([]byte, fuzzPageSize)))
+		if err != nil {
+			t.Fatalf("serialized node can't be deserialized: %s", err)
+		}
+		assertNodesEqual(t, node, decoded)
+	})
+}
+
+// FuzzTxOps interprets the input as a sequence of Put, Remove, Find and Commit operations on a collection, mirrors them
+// in a map and checks the collection against the map after every Find and after reopening the database.
+func FuzzTxOps(f *testing.F) {
+	f.Add([]byte{0, 1, 0, 2, 2, 1, 2, 3})
+	f.Add([]byte{0, 1, 3, 0, 1, 1, 2, 1, 0, 1, 2, 1})
+	f.Add([]byte{0, 0x85, 0, 0x86, 3, 0, 2, 0x85, 1, 0x86, 2, 0x86})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		path := filepath.Join(t.TempDir(), "fuzz.db")
+		options := *DefaultOptions
+		options.pageSize = fuzzPageSize
+		db, err := Open(path, &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx, err := db.WriteTx()
+		if err != nil {
+			t.Fatal(err)
+		}
+		collection, err := tx.CreateCollection([]byte("fuzz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		model := map[string][]byte{}
+		for len(data) >= 2 {
+			op, arg := data[0]%4, data[1]
+			data = data[2:]
+			key := []byte(fmt.Sprintf("key%02d", int(arg)%fuzzKeySpace))
+
+			switch op {
+			case 0:
+				value := fuzzValue(key, arg)
+				err = collection.Put(key, value)
+				model[string(key)] = value
+			case 1:
+				err = collection.Remove(key)
+				delete(model, string(key))
+			case 2:
+				assertFound(t, collection, key, model)
+			case 3:
+				err = tx.Commit()
+				if err != nil {
+					break
+				}
+				tx, err = db.WriteTx()
+				if err != nil {
+					break
+				}
+				collection, err = tx.GetCollection([]byte("fuzz"))
+			}
+			if err != nil {
+				t.Fatalf("operation %d on %s failed: %s", op, key, err)
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = Open(path, &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		tx, err = db.ReadTx()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		collection, err = tx.GetCollection([]byte("fuzz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < fuzzKeySpace; i++ {
+			assertFound(t, collection, []byte(fmt.Sprintf("key%02d", i)), model)
+		}
+	})
+}
+
+// fuzzNode decodes a node from the input. The first byte selects a leaf (even) or an internal node (odd) and whether
+// 16 byte values are flagged as overflow references (bit 1). The rest is a sequence of length prefixed keys and values.
+// Keys are sorted and deduplicated, as they are in real nodes.
+func fuzzNode(data []byte) *Node {
+	if len(data) == 0 {
+		return nil
+	}
+	leaf := data[0]&1 == 0
+	overflow := data[0]&2 != 0
+	data = data[1:]
+
+	readField := func() []byte {
+		if len(data) == 0 {
+			return []byte{}
+		}
+		length := int(data[0])
+		data = data[1:]
+		if length > len(data) {
+			length = len(data)
+		}
+		field := data[:length]
+		data = data[length:]
+		return field
+	}
+
+	items := map[string]*Item{}
+	for len(data) > 0 {
+		item := newItem(readField(), readField())
+		item.overflow = overflow && len(item.value) == overflowRefSize
+		items[string(item.key)] = item
+	}
+
+	node := NewEmptyNode()
+	for _, item := range items {
+		node.items = append(node.items, item)
+	}
+	sort.Slice(node.items, func(i, j int) bool {
+		return bytes.Compare(node.items[i].key, node.items[j].key) < 0
+	})
+	if !leaf {
+		for i := 0; i <= len(node.items); i++ {
+			node.childNodes = append(node.childNodes, pgnum(i+1))
+		}
+	}
+	return node
+}
+
+func assertNodesEqual(t *testing.T, expected *Node, actual *Node) {
+	t.Helper()
+	if len(expected.items) != len(actual.items) {
+		t.Fatalf("expected %d items, got %d", len(expected.items), len(actual.items))
+	}
+	for i := range expected.items {
+		e, a := expected.items[i], actual.items[i]
+		if !bytes.Equal(e.key, a.key) || !bytes.Equal(e.value, a.value) || e.overflow != a.overflow {
+			t.Fatalf("item %d: expected %q=%q (overflow %t), got %q=%q (overflow %t)", i, e.key, e.value,
+				e.overflow, a.key, a.value, a.overflow)
+		}
+	}
+	if len(expected.childNodes) != len(actual.childNodes) {
+		t.Fatalf("expected %d children, got %d", len(expected.childNodes), len(actual.childNodes))
+	}
+	for i := range expected.childNodes {
+		if expected.childNodes[i] != actual.childNodes[i] {
+			t.Fatalf("child %d: expected page %d, got %d", i, expected.childNodes[i], actual.childNodes[i])
+		}
+	}
+}
+
+// fuzzValue returns a value for the key. Arguments with the high bit set produce values big enough to be stored in
+// overflow pages.
+func fuzzValue(key []byte, arg byte) []byte {
+	size := int(arg % 32)
+	if arg&0x80 != 0 {
+		size = maxInlineValueSize + int(arg)*8
+	}
+	return bytes.Repeat(key[len(key)-1:], size)
+}
+
+func assertFound(t *testing.T, collection *Collection, key []byte, model map[string][]byte) {
+	t.Helper()
+	item, err := collection.Find(key)
+	if err != nil {
+		t.Fatalf("find %s failed: %s", key, err)
+	}
+	expected, ok := model[string(key)]
+	if !ok {
+		if item != nil {
+			t.Fatalf("removed key %s was found", key)
+		}
+		return
+	}
+	if item == nil {
+		t.Fatalf("key %s wasn't found", key)
+	}
+	if !bytes.Equal(item.value, expected) {
+		t.Fatalf("key %s: expected a value of %d bytes, got %d bytes", key, len(expected), len(item.value))
+	}
+}
@@ -1,3 +1,3 @@
-module godb
+module github.com/RohinJoshi1/GopherDB
 
 go 1.19
@@ -0,0 +1,157 @@
+package gopherdb
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// The middleware here is the plain func(http.Handler) http.Handler of net/http, which the routers built on it (chi,
+// gorilla/mux and the like) take as it is.
+
+type sessionContextKey struct{}
+
+// HTTPSession is the session of a request served by SessionMiddleware. It's empty if the request came without a live
+// session, until Save creates one.
+type HTTPSession struct {
+	sessions *Sessions
+	cookie   string
+	secure   bool
+	id       string
+	data     []byte
+}
+
+// SessionMiddleware returns middleware loading the session named by the cookie of every request, which the handlers
+// get with RequestSession. A live session is touched by every request, so it expires once it wasn't used for the TTL
+// of the sessions.
+func SessionMiddleware(sessions *Sessions, cookie string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session := &HTTPSession{sessions: sessions, cookie: cookie, secure: r.TLS != nil}
+			c, err := r.Cookie(cookie)
+			if err == nil && c.Value != "" {
+				err = sessions.db.Update(func(tx *Tx) error {
+					err := sessions.Touch(tx, c.Value)
+					if err != nil {
+						return err
+					}
+					session.data, err = sessions.Get(tx, c.Value)
+					return err
+				})
+				switch {
+				case err == nil:
+					session.id = c.Value
+					session.setCookie(w)
+				case errors.Is(err, ErrKeyNotFound):
+				default:
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, session)))
+		})
+	}
+}
+
+// RequestSession returns the session of a request served by SessionMiddleware, or nil for the other requests.
+func RequestSession(r *http.Request) *HTTPSession {
+	session, _ := r.Context().Value(sessionContextKey{}).(*HTTPSession)
+	return session
+}
+
+// ID returns the id of the session, or "" if there's none.
+func (s *HTTPSession) ID() string {
+	return s.id
+}
+
+// Data returns the data of the session, or nil if there's none.
+func (s *HTTPSession) Data() []byte {
+	return s.data
+}
+
+// Save replaces the data of the session, creating it if there's none, and sets its cookie. Like every header, the
+// cookie has to be set before the handler writes its response.
+func (s *HTTPSession) Save(w http.ResponseWriter, data []byte) error {
+	err := s.sessions.db.Update(func(tx *Tx) error {
+		if s.id != "" {
+			err := s.sessions.Update(tx, s.id, data)
+			if !errors.Is(err, ErrKeyNotFound) {
+				return err
+			}
+		}
+		id, err := s.sessions.Create(tx, data)
+		s.id = id
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.data = data
+	s.setCookie(w)
+	return nil
+}
+
+// Destroy deletes the session and its cookie.
+func (s *HTTPSession) Destroy(w http.ResponseWriter) error {
+	if s.id == "" {
+		return nil
+	}
+	err := s.sessions.db.Update(func(tx *Tx) error {
+		return s.sessions.Destroy(tx, s.id)
+	})
+	if err != nil {
+		return err
+	}
+	s.id, s.data = "", nil
+	http.SetCookie(w, &http.Cookie{Name: s.cookie, Path: "/", MaxAge: -1, HttpOnly: true, Secure: s.secure,
+		SameSite: http.SameSiteLaxMode})
+	return nil
+}
+
+// setCookie sets the cookie of the session, expiring along with it.
+func (s *HTTPSession) setCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: s.cookie, Value: s.id, Path: "/", MaxAge: int(s.sessions.ttl.Seconds()),
+		HttpOnly: true, Secure: s.secure, SameSite: http.SameSiteLaxMode})
+}
+
+// RateLimitMiddleware returns middleware taking a token from the token bucket of every request, see
+// RateLimiter.TakeToken, and answering 429 Too Many Requests when there's none left. The bucket of a request is the
+// one of its key, or of the host of its remote address if key is nil.
+func RateLimitMiddleware(db *DB, limiter *RateLimiter, rate float64, burst int, key func(*http.Request) string) func(http.Handler) http.Handler {
+	if key == nil {
+		key = remoteHost
+	}
+	retryAfter := strconv.Itoa(int(math.Max(1, math.Ceil(1/rate))))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			allowed := false
+			err := db.Update(func(tx *Tx) error {
+				var err error
+				allowed, err = limiter.TakeToken(tx, []byte(key(r)), rate, burst)
+				return err
+			})
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if !allowed {
+				w.Header().Set("Retry-After", retryAfter)
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// remoteHost returns the host of the remote address of the request, or the address itself if it has no port.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,135 @@
+package gopherdb
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSessionMiddleware(t *testing.T) {
+	db := openTestDB(t, nil)
+	sessions := NewSessions(db, "sessions", time.Hour)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		err := RequestSession(r).Save(w, []byte(r.URL.Query().Get("user")))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		err := RequestSession(r).Destroy(w)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s", RequestSession(r).Data())
+	})
+	server := httptest.NewServer(SessionMiddleware(sessions, "session")(mux))
+	defer server.Close()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+	get := func(path string) string {
+		t.Helper()
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: %s", path, resp.Status)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	if got := get("/"); got != "" {
+		t.Fatalf("got %q before logging in", got)
+	}
+	get("/login?user=alice")
+	if got := get("/"); got != "alice" {
+		t.Fatalf("got %q after logging in, want alice", got)
+	}
+	get("/login?user=bob")
+	if got := get("/"); got != "bob" {
+		t.Fatalf("got %q after saving again, want bob", got)
+	}
+	get("/logout")
+	if got := get("/"); got != "" {
+		t.Fatalf("got %q after logging out", got)
+	}
+
+	// A session that's gone is ignored, and saving creates a new one
+	get("/login?user=carol")
+	mustUpdate(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("sessions"))
+		if err != nil {
+			return err
+		}
+		return c.Remove([]byte(cookieValue(t, jar, server.URL, "session")))
+	})
+	if got := get("/"); got != "" {
+		t.Fatalf("got %q from a removed session", got)
+	}
+	get("/login?user=dave")
+	if got := get("/"); got != "dave" {
+		t.Fatalf("got %q after logging in again, want dave", got)
+	}
+}
+
+func cookieValue(t *testing.T, jar http.CookieJar, rawURL string, name string) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range jar.Cookies(req.URL) {
+		if c.Name == name {
+			return c.Value
+		}
+	}
+	t.Fatalf("no %s cookie", name)
+	return ""
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	db := openTestDB(t, nil)
+	limiter := NewRateLimiter("limits")
+	handler := RateLimitMiddleware(db, limiter, 0.5, 2, func(r *http.Request) string {
+		return r.Header.Get("X-Client")
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Client", client)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	for i := 0; i < 2; i++ {
+		if w := serve("a"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: got %d within the burst", i, w.Code)
+		}
+	}
+	w := serve("a")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d past the burst, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Fatalf("got Retry-After %q, want 2", got)
+	}
+	if w := serve("b"); w.Code != http.StatusOK {
+		t.Fatalf("got %d for another key", w.Code)
+	}
+}
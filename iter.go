@@ -0,0 +1,35 @@
+//go:build go1.23
+
+package gopherdb
+
+import "iter"
+
+// All returns an iterator over the keys of the cursor and their values, in key order, from the first key of its range,
+// for range loops:
+//
+//	cur := collection.Range([]byte("2024-01"), []byte("2024-02"))
+//	for k, v := range cur.All() {
+//		...
+//	}
+//	if err := cur.Err(); err != nil {
+//		...
+//	}
+//
+// Breaking out of the loop stops the iteration where it is. An error reading the tree ends it too, and is returned
+// by Err. The slices are only valid until the next iteration.
+func (c *Cursor) All() iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if !yield(k, v) {
+				return
+			}
+		}
+	}
+}
+
+// All returns an iterator over every key of the collection and its value, in key order, see Cursor.All. An error
+// reading the tree ends the iteration without telling, so loops that must tell a read error from the end of the keys
+// iterate with the cursor of Cursor or Range and check its Err.
+func (c *Collection) All() iter.Seq2[[]byte, []byte] {
+	return c.Cursor().All()
+}
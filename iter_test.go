@@ -0,0 +1,49 @@
+//go:build go1.23
+
+package gopherdb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestIterators(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 100; i++ {
+		putValue(t, db, "c", string(testKey(i)), "value")
+	}
+	mustView(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		i := 0
+		for k, v := range c.All() {
+			if !bytes.Equal(k, testKey(i)) || string(v) != "value" {
+				t.Fatalf("got %s=%s at %d", k, v, i)
+			}
+			i++
+		}
+		if i != 100 {
+			t.Fatalf("iterated over %d keys, want 100", i)
+		}
+
+		// Ranges stop at their end, and breaking out stops the iteration
+		cur := c.Range(testKey(10), testKey(20))
+		var keys [][]byte
+		for k := range cur.All() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		if len(keys) != 10 || !bytes.Equal(keys[0], testKey(10)) || cur.Err() != nil {
+			t.Fatalf("got %d keys from %s, %v", len(keys), keys[0], cur.Err())
+		}
+		keys = keys[:0]
+		for k := range c.All() {
+			if len(keys) == 3 {
+				break
+			}
+			keys = append(keys, k)
+		}
+		if len(keys) != 3 {
+			t.Fatalf("got %d keys before breaking", len(keys))
+		}
+		return nil
+	})
+}
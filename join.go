@@ -0,0 +1,143 @@
+package gopherdb
+
+import "bytes"
+
+// JoinKind selects the keys a merge join returns.
+type JoinKind int
+
+const (
+	// InnerJoin returns the keys present in every input.
+	InnerJoin JoinKind = iota
+	// OuterJoin returns the keys present in any input.
+	OuterJoin
+)
+
+// Cursors returns a cursor over each of the collections, all reading the same snapshot through the transaction. A
+// collection that doesn't exist gets a nil cursor, which MergeJoin treats as empty.
+func (tx *Tx) Cursors(names ...[]byte) ([]*Cursor, error) {
+	cursors := make([]*Cursor, len(names))
+	for i, name := range names {
+		collection, err := tx.GetCollection(name)
+		if err != nil {
+			return nil, err
+		}
+		if collection != nil {
+			cursors[i] = collection.Cursor()
+		}
+	}
+	return cursors, nil
+}
+
+// joinInput is the current position of one input of a merge join. A nil key means the input is exhausted.
+type joinInput struct {
+	cursor *Cursor
+	key    []byte
+	value  []byte
+}
+
+// MergeJoin walks the cursors in key order from their first key, and calls fn for every key of the join with the
+// values of each input, nil for the inputs that don't have the key. Inputs must be cursors of collections using the same
+// key order. fn returning false or an error stops the join.
+//
+// An inner join seeks the inputs that fall behind directly to the biggest current key, so joining a small collection
+// with a big one only reads the parts of the big one that can match.
+func MergeJoin(kind JoinKind, cursors []*Cursor, fn func(key []byte, values [][]byte) (bool, error)) error {
+	inputs := make([]joinInput, len(cursors))
+	for i, cursor := range cursors {
+		inputs[i].cursor = cursor
+		if cursor != nil {
+			inputs[i].key, inputs[i].value = cursor.First()
+		}
+	}
+
+	values := make([][]byte, len(inputs))
+	matched := make([]bool, len(inputs))
+	for {
+		err := joinErr(inputs)
+		if err != nil {
+			return err
+		}
+
+		var key []byte
+		if kind == InnerJoin {
+			var ok bool
+			key, ok = alignInputs(inputs)
+			if !ok {
+				return joinErr(inputs)
+			}
+		} else {
+			key = smallestKey(inputs)
+			if key == nil {
+				return nil
+			}
+		}
+
+		for i := range inputs {
+			values[i] = nil
+			matched[i] = inputs[i].key != nil && bytes.Equal(inputs[i].key, key)
+			if matched[i] {
+				// Empty values must not look like missing ones
+				values[i] = inputs[i].value
+				if values[i] == nil {
+					values[i] = []byte{}
+				}
+			}
+		}
+		more, err := fn(key, values)
+		if err != nil || !more {
+			return err
+		}
+		for i := range inputs {
+			if matched[i] {
+				inputs[i].key, inputs[i].value = inputs[i].cursor.Next()
+			}
+		}
+	}
+}
+
+func joinErr(inputs []joinInput) error {
+	for _, input := range inputs {
+		if input.cursor != nil && input.cursor.Err() != nil {
+			return input.cursor.Err()
+		}
+	}
+	return nil
+}
+
+// smallestKey returns the smallest current key of the inputs, or nil if they're all exhausted.
+func smallestKey(inputs []joinInput) []byte {
+	var smallest []byte
+	for _, input := range inputs {
+		if input.key != nil && (smallest == nil || bytes.Compare(input.key, smallest) < 0) {
+			smallest = input.key
+		}
+	}
+	return smallest
+}
+
+// alignInputs seeks the inputs until they're all on the same key, and returns it. It returns false as soon as an input
+// is exhausted, since no other key can be in every input.
+func alignInputs(inputs []joinInput) ([]byte, bool) {
+	for {
+		var biggest []byte
+		for _, input := range inputs {
+			if input.key == nil {
+				return nil, false
+			}
+			if biggest == nil || bytes.Compare(input.key, biggest) > 0 {
+				biggest = input.key
+			}
+		}
+
+		aligned := true
+		for i := range inputs {
+			if !bytes.Equal(inputs[i].key, biggest) {
+				aligned = false
+				inputs[i].key, inputs[i].value = inputs[i].cursor.Seek(biggest)
+			}
+		}
+		if aligned {
+			return biggest, true
+		}
+	}
+}
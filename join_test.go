@@ -0,0 +1,125 @@
+package gopherdb
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// joinRows runs the merge join and returns every key and its values, with "-" for the inputs that don't have the key.
+func joinRows(t *testing.T, tx *Tx, kind JoinKind, names ...string) []string {
+	t.Helper()
+	var collections [][]byte
+	for _, name := range names {
+		collections = append(collections, []byte(name))
+	}
+	cursors, err := tx.Cursors(collections...)
+	if err != nil {
+		t.Fatalf("Cursors: %v", err)
+	}
+	var rows []string
+	err = MergeJoin(kind, cursors, func(key []byte, values [][]byte) (bool, error) {
+		row := string(key)
+		for _, value := range values {
+			if value == nil {
+				row += " -"
+			} else {
+				row += fmt.Sprintf(" %q", value)
+			}
+		}
+		rows = append(rows, row)
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("MergeJoin: %v", err)
+	}
+	return rows
+}
+
+func checkRows(t *testing.T, rows []string, expected ...string) {
+	t.Helper()
+	if fmt.Sprint(rows) != fmt.Sprint(expected) {
+		t.Errorf("the join returned %q, want %q", rows, expected)
+	}
+}
+
+func TestMergeJoin(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustUpdate(t, db, func(tx *Tx) error {
+		users := getOrCreate(t, tx, "users")
+		for _, name := range []string{"alice", "bob", "carol", "dave"} {
+			if err := users.Put([]byte(name), []byte(name+"@example.com")); err != nil {
+				return err
+			}
+		}
+		admins := getOrCreate(t, tx, "admins")
+		for _, name := range []string{"bob", "dave", "erin"} {
+			if err := admins.Put([]byte(name), nil); err != nil {
+				return err
+			}
+		}
+		getOrCreate(t, tx, "empty")
+		return nil
+	})
+
+	mustView(t, db, func(tx *Tx) error {
+		checkRows(t, joinRows(t, tx, InnerJoin, "users", "admins"),
+			`bob "bob@example.com" ""`, `dave "dave@example.com" ""`)
+		checkRows(t, joinRows(t, tx, OuterJoin, "users", "admins"),
+			`alice "alice@example.com" -`, `bob "bob@example.com" ""`, `carol "carol@example.com" -`,
+			`dave "dave@example.com" ""`, `erin - ""`)
+
+		// Collections that are empty or don't exist have no keys to join
+		checkRows(t, joinRows(t, tx, InnerJoin, "admins", "empty"))
+		checkRows(t, joinRows(t, tx, InnerJoin, "admins", "missing"))
+		checkRows(t, joinRows(t, tx, OuterJoin, "admins", "missing"), `bob "" -`, `dave "" -`, `erin "" -`)
+		return nil
+	})
+}
+
+func TestMergeJoinStops(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustUpdate(t, db, func(tx *Tx) error {
+		for _, name := range []string{"a", "b"} {
+			c := getOrCreate(t, tx, name)
+			for i := 0; i < 10; i++ {
+				if err := c.Put(testKey(i), nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	errStop := errors.New("stop")
+	mustView(t, db, func(tx *Tx) error {
+		for _, kind := range []JoinKind{InnerJoin, OuterJoin} {
+			cursors, err := tx.Cursors([]byte("a"), []byte("b"))
+			if err != nil {
+				return err
+			}
+			calls := 0
+			err = MergeJoin(kind, cursors, func(key []byte, values [][]byte) (bool, error) {
+				calls++
+				return calls < 3, nil
+			})
+			if err != nil || calls != 3 {
+				t.Errorf("join %d stopped with false: got %d calls and %v, want 3 calls", kind, calls, err)
+			}
+
+			cursors, err = tx.Cursors([]byte("a"), []byte("b"))
+			if err != nil {
+				return err
+			}
+			calls = 0
+			err = MergeJoin(kind, cursors, func(key []byte, values [][]byte) (bool, error) {
+				calls++
+				return true, errStop
+			})
+			if !errors.Is(err, errStop) || calls != 1 {
+				t.Errorf("join %d stopped with an error: got %d calls and %v, want 1 call and the error", kind, calls, err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,105 @@
+package gopherdb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// KeyTransform maps the keys of a collection to the keys stored in its tree, for example to keep the keys out of the
+// file with an HMAC, or to give them a fixed width with a hash. It applies to Put, PutFrom, Merge, Find, NewValueReader
+// and Remove, which keep taking the original keys, and to the keys seen by triggers and change hooks, which get the
+// original keys too.
+//
+// The tree is ordered by the stored keys, so cursors, scans and queries iterate and seek stored keys. With KeepOriginal,
+// the original key is kept in front of the value, and cursors and scans return it instead of the stored key.
+type KeyTransform struct {
+	// Transform returns the stored key of a key. It must always return the same stored key for a key, and different
+	// keys should get different stored keys, since keys sharing a stored key overwrite each other.
+	Transform func(key []byte) []byte
+	// KeepOriginal stores the original key in an envelope in front of the value, so it can be recovered.
+	KeepOriginal bool
+}
+
+// HMACKeys returns a transform replacing every key with its HMAC-SHA256 under the secret. Without the secret, the
+// stored keys tell nothing about the original keys, but the same key can still be found.
+func HMACKeys(secret []byte) func(key []byte) []byte {
+	return func(key []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(key)
+		return mac.Sum(nil)
+	}
+}
+
+// HashKeys returns a transform replacing every key with the first size bytes of its SHA-256, for size up to 32. Short
+// hashes save space but make collisions between keys more likely.
+func HashKeys(size int) func(key []byte) []byte {
+	return func(key []byte) []byte {
+		sum := sha256.Sum256(key)
+		return sum[:size]
+	}
+}
+
+// SetKeyTransform sets the key transform of the collection, or removes it if transform is nil. Like triggers, it isn't
+// stored in the file: it has to be set every time the database is opened, before the collection is used, and must not
+// change once keys were written with it.
+func (db *DB) SetKeyTransform(collection []byte, transform *KeyTransform) {
+	db.triggers.mu.Lock()
+	defer db.triggers.mu.Unlock()
+	if transform == nil {
+		delete(db.triggers.keyTransforms, string(collection))
+		return
+	}
+	db.triggers.keyTransforms[string(collection)] = transform
+}
+
+func (t *triggers) keyTransform(collection []byte) *KeyTransform {
+	if collection == nil {
+		return nil
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.keyTransforms[string(collection)]
+}
+
+// storedKey returns the key stored in the tree for the key.
+func (c *Collection) storedKey(key []byte) []byte {
+	transform := c.tx.db.triggers.keyTransform(c.triggerName())
+	if transform == nil {
+		return key
+	}
+	return transform.Transform(key)
+}
+
+// storedItem returns the stored key and value of a key and value, wrapping the value in an envelope holding the
+// original key if the transform keeps it.
+func (c *Collection) storedItem(key []byte, value []byte) ([]byte, []byte) {
+	transform := c.tx.db.triggers.keyTransform(c.triggerName())
+	if transform == nil {
+		return key, value
+	}
+	if !transform.KeepOriginal {
+		return transform.Transform(key), value
+	}
+
+	envelope := make([]byte, 0, binary.MaxVarintLen64+len(key)+len(value))
+	envelope = binary.AppendUvarint(envelope, uint64(len(key)))
+	envelope = append(envelope, key...)
+	return transform.Transform(key), append(envelope, value...)
+}
+
+// originalItem returns a resolved item with its original key and value, unwrapping the envelope if the transform of
+// the collection keeps the original keys.
+func (c *Collection) originalItem(item *Item) (*Item, error) {
+	transform := c.tx.db.triggers.keyTransform(c.triggerName())
+	if transform == nil || !transform.KeepOriginal {
+		return item, nil
+	}
+
+	length, n := binary.Uvarint(item.value)
+	if n <= 0 || uint64(len(item.value)-n) < length {
+		return nil, ErrCorruptKeyEnvelope
+	}
+	key := item.value[n : n+int(length)]
+	return newItem(key, item.value[n+int(length):]), nil
+}
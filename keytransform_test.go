@@ -0,0 +1,121 @@
+package gopherdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// storedKeys returns the keys stored in the tree of the collection, in key order.
+func storedKeys(t *testing.T, c *Collection) [][]byte {
+	t.Helper()
+	var keys [][]byte
+	err := c.tx.rangeItems(c.root, KeyRange{}, func(item *Item) (bool, error) {
+		keys = append(keys, append([]byte{}, item.key...))
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("rangeItems: %v", err)
+	}
+	return keys
+}
+
+func TestHMACKeysKeepingTheOriginals(t *testing.T) {
+	db := openTestDB(t, nil)
+	transform := HMACKeys([]byte("secret"))
+	db.SetKeyTransform([]byte("c"), &KeyTransform{Transform: transform, KeepOriginal: true})
+	var triggered []string
+	db.BeforePut([]byte("c"), func(tx *Tx, key []byte, value []byte) ([]byte, []byte, error) {
+		triggered = append(triggered, string(key))
+		return key, value, nil
+	})
+
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for _, key := range []string{"alice", "bob", "carol"} {
+			if err := c.Put([]byte(key), []byte(key+"@example.com")); err != nil {
+				return err
+			}
+		}
+		if err := c.Remove([]byte("bob")); err != nil {
+			return err
+		}
+		return c.Merge([]byte("carol"), func(current []byte) ([]byte, error) {
+			return append(current, " (merged)"...), nil
+		})
+	})
+	if fmt.Sprint(triggered) != "[alice bob carol carol]" {
+		t.Errorf("the triggers saw %v, want the original keys", triggered)
+	}
+
+	mustView(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		if value, err := c.Get([]byte("carol")); err != nil || string(value) != "carol@example.com (merged)" {
+			t.Errorf("Get(carol): got %q, %v", value, err)
+		}
+		if _, err := c.Get([]byte("bob")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Get of the removed key: got %v, want ErrKeyNotFound", err)
+		}
+
+		// The file only has the HMACs, and scans return the original keys in the order of the HMACs
+		want := [][]byte{transform([]byte("alice")), transform([]byte("carol"))}
+		sort.Slice(want, func(i, j int) bool { return bytes.Compare(want[i], want[j]) < 0 })
+		stored := storedKeys(t, c)
+		if fmt.Sprintf("%x", stored) != fmt.Sprintf("%x", want) {
+			t.Errorf("stored keys: got %x, want %x", stored, want)
+		}
+		var scanned []string
+		err := c.Scan(nil, func(key, value []byte) error {
+			if !bytes.HasPrefix(value, key) {
+				t.Errorf("Scan returned %q with %q", key, value)
+			}
+			scanned = append(scanned, string(key))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.Strings(scanned)
+		if fmt.Sprint(scanned) != "[alice carol]" {
+			t.Errorf("Scan returned %v, want the original keys", scanned)
+		}
+		return nil
+	})
+}
+
+func TestHashKeysWithoutTheOriginals(t *testing.T) {
+	db := openTestDB(t, nil)
+	db.SetKeyTransform([]byte("c"), &KeyTransform{Transform: HashKeys(8)})
+	putValue(t, db, "c", "a key longer than the hash", "value")
+	if value := getValue(t, db, "c", "a key longer than the hash"); value != "value" {
+		t.Errorf("Get: got %q, want value", value)
+	}
+	mustView(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		// Scans return the stored keys, and the values as they were put
+		return c.Scan(nil, func(key, value []byte) error {
+			if len(key) != 8 || string(value) != "value" {
+				t.Errorf("Scan returned %x with %q, want a key of 8 bytes", key, value)
+			}
+			return nil
+		})
+	})
+
+	// Keeping the originals once keys were written without them finds values without an envelope
+	db.SetKeyTransform([]byte("c"), &KeyTransform{Transform: HashKeys(8), KeepOriginal: true})
+	mustView(t, db, func(tx *Tx) error {
+		err := getOrCreate(t, tx, "c").Scan(nil, func(key, value []byte) error { return nil })
+		if !errors.Is(err, ErrCorruptKeyEnvelope) {
+			t.Errorf("Scan of values without an envelope: got %v, want ErrCorruptKeyEnvelope", err)
+		}
+		return nil
+	})
+
+	// Without the transform, the collection is read as it's stored
+	db.SetKeyTransform([]byte("c"), nil)
+	if value := getValue(t, db, "c", "a key longer than the hash"); value != "" {
+		t.Errorf("Get without the transform: got %q", value)
+	}
+}
@@ -0,0 +1,160 @@
+package gopherdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Locks keeps named leases in a collection. A lease is held by an owner until it's released or its TTL runs out, after
+// which anyone can acquire it. Since the leases live in the database, every worker sharing it sees the same holders,
+// which is enough for leader election.
+//
+// Every acquisition gets a fencing token, the id of the write transaction that acquired the lease. Tokens only grow, so
+// a resource protected by the lease can reject writes carrying a token older than the latest one it has seen, even if
+// they come from a previous holder that didn't notice its lease expired.
+type Locks struct {
+	collection []byte
+}
+
+// Lease is a lease held by an owner.
+type Lease struct {
+	Name    []byte
+	Owner   []byte
+	Token   uint64
+	Expires time.Time
+}
+
+func (l *Lease) expired(now time.Time) bool {
+	return !now.Before(l.Expires)
+}
+
+// NewLocks returns a lock helper keeping its leases in the given collection. The collection is created on the first
+// acquisition.
+func NewLocks(collection string) *Locks {
+	return &Locks{collection: []byte(collection)}
+}
+
+func serializeLease(lease *Lease) []byte {
+	buf := make([]byte, 0, txIDSize+8+len(lease.Owner))
+	buf = binary.LittleEndian.AppendUint64(buf, lease.Token)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(lease.Expires.UnixNano()))
+	return append(buf, lease.Owner...)
+}
+
+// deserializeLease reads the lease of the name, failing with ErrCorruptLease if the value is too short to be one.
+func deserializeLease(name []byte, value []byte) (*Lease, error) {
+	if len(value) < txIDSize+8 {
+		return nil, fmt.Errorf("%w: %q", ErrCorruptLease, name)
+	}
+	return &Lease{
+		Name:    name,
+		Token:   binary.LittleEndian.Uint64(value),
+		Expires: time.Unix(0, int64(binary.LittleEndian.Uint64(value[txIDSize:]))),
+		Owner:   value[txIDSize+8:],
+	}, nil
+}
+
+// Holder returns the current lease of the name, or nil if nobody holds it.
+func (l *Locks) Holder(tx *Tx, name []byte) (*Lease, error) {
+	collection, err := tx.GetCollection(l.collection)
+	if err != nil || collection == nil {
+		return nil, err
+	}
+	item, err := collection.Find(name)
+	if err != nil || item == nil {
+		return nil, err
+	}
+	lease, err := deserializeLease(name, item.value)
+	if err != nil {
+		return nil, err
+	}
+	if lease.expired(tx.db.now()) {
+		return nil, nil
+	}
+	return lease, nil
+}
+
+// Acquire acquires the lease for the owner for the duration of the TTL. If the owner already holds the lease, it's
+// extended and keeps its token. If another owner holds it, ErrLeaseHeld is returned.
+func (l *Locks) Acquire(tx *Tx, name []byte, owner []byte, ttl time.Duration) (*Lease, error) {
+	if !tx.write {
+		return nil, ErrWriteInsideReadTx
+	}
+	collection, err := tx.getOrCreateCollection(l.collection)
+	if err != nil {
+		return nil, err
+	}
+
+	now := tx.db.now()
+	lease := &Lease{Name: name, Owner: owner, Token: tx.ID(), Expires: now.Add(ttl)}
+	item, err := collection.Find(name)
+	if err != nil {
+		return nil, err
+	}
+	if item != nil {
+		current, err := deserializeLease(name, item.value)
+		if err != nil {
+			return nil, err
+		}
+		if !current.expired(now) {
+			if !bytes.Equal(current.Owner, owner) {
+				return nil, ErrLeaseHeld
+			}
+			lease.Token = current.Token
+		}
+	}
+	return lease, collection.Put(name, serializeLease(lease))
+}
+
+// Renew extends the lease by the TTL from now. ErrLeaseLost is returned if the lease expired or was acquired by
+// someone else in the meantime.
+func (l *Locks) Renew(tx *Tx, lease *Lease, ttl time.Duration) (*Lease, error) {
+	if !tx.write {
+		return nil, ErrWriteInsideReadTx
+	}
+	current, err := l.Holder(tx, lease.Name)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil || current.Token != lease.Token {
+		return nil, ErrLeaseLost
+	}
+
+	collection, err := tx.GetCollection(l.collection)
+	if err != nil {
+		return nil, err
+	}
+	renewed := &Lease{Name: lease.Name, Owner: lease.Owner, Token: lease.Token, Expires: tx.db.now().Add(ttl)}
+	return renewed, collection.Put(lease.Name, serializeLease(renewed))
+}
+
+// Release gives up the lease. Releasing a lease that was already lost is a no-op.
+func (l *Locks) Release(tx *Tx, lease *Lease) error {
+	if !tx.write {
+		return ErrWriteInsideReadTx
+	}
+	current, err := l.Holder(tx, lease.Name)
+	if err != nil || current == nil || current.Token != lease.Token {
+		return err
+	}
+	collection, err := tx.GetCollection(l.collection)
+	if err != nil {
+		return err
+	}
+	return collection.Remove(lease.Name)
+}
+
+// CheckToken verifies the fencing token against the current holder of the lease, and returns ErrLeaseLost if the
+// token doesn't belong to it.
+func (l *Locks) CheckToken(tx *Tx, name []byte, token uint64) error {
+	current, err := l.Holder(tx, name)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Token != token {
+		return ErrLeaseLost
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package gopherdb
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func acquire(t *testing.T, db *DB, locks *Locks, owner string, ttl time.Duration) (*Lease, error) {
+	t.Helper()
+	var lease *Lease
+	err := db.Update(func(tx *Tx) error {
+		var err error
+		lease, err = locks.Acquire(tx, []byte("leader"), []byte(owner), ttl)
+		return err
+	})
+	return lease, err
+}
+
+func TestLeaseIsHeldUntilReleased(t *testing.T) {
+	db := openTestDB(t, nil)
+	locks := NewLocks("locks")
+	first, err := acquire(t, db, locks, "a", time.Hour)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if _, err := acquire(t, db, locks, "b", time.Hour); !errors.Is(err, ErrLeaseHeld) {
+		t.Errorf("Acquire of a held lease: got %v, want ErrLeaseHeld", err)
+	}
+	// The holder acquiring again extends the lease and keeps its token
+	again, err := acquire(t, db, locks, "a", 2*time.Hour)
+	if err != nil {
+		t.Fatalf("Acquire by the holder: %v", err)
+	}
+	if again.Token != first.Token || !again.Expires.After(first.Expires) {
+		t.Errorf("Acquire by the holder: got token %d expiring at %v, want token %d expiring later than %v",
+			again.Token, again.Expires, first.Token, first.Expires)
+	}
+
+	mustView(t, db, func(tx *Tx) error {
+		holder, err := locks.Holder(tx, []byte("leader"))
+		if err != nil || holder == nil || string(holder.Owner) != "a" {
+			t.Errorf("Holder: got %+v, %v, want a", holder, err)
+		}
+		if err := locks.CheckToken(tx, []byte("leader"), first.Token); err != nil {
+			t.Errorf("CheckToken of the holder: %v", err)
+		}
+		if _, err := locks.Acquire(tx, []byte("leader"), []byte("a"), time.Hour); !errors.Is(err, ErrWriteInsideReadTx) {
+			t.Errorf("Acquire in a read transaction: got %v, want ErrWriteInsideReadTx", err)
+		}
+		return nil
+	})
+
+	mustUpdate(t, db, func(tx *Tx) error {
+		return locks.Release(tx, again)
+	})
+	mustView(t, db, func(tx *Tx) error {
+		if holder, err := locks.Holder(tx, []byte("leader")); err != nil || holder != nil {
+			t.Errorf("Holder after Release: got %+v, %v, want nil", holder, err)
+		}
+		return nil
+	})
+	if _, err := acquire(t, db, locks, "b", time.Hour); err != nil {
+		t.Errorf("Acquire after Release: %v", err)
+	}
+}
+
+func TestExpiredLeaseFencesTheOldHolder(t *testing.T) {
+	db := openTestDB(t, nil)
+	locks := NewLocks("locks")
+	old, err := acquire(t, db, locks, "a", time.Millisecond)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	current, err := acquire(t, db, locks, "b", time.Hour)
+	if err != nil {
+		t.Fatalf("Acquire of an expired lease: %v", err)
+	}
+	if current.Token <= old.Token {
+		t.Errorf("token of the new holder is %d, want more than the %d of the old one", current.Token, old.Token)
+	}
+
+	mustUpdate(t, db, func(tx *Tx) error {
+		if err := locks.CheckToken(tx, []byte("leader"), old.Token); !errors.Is(err, ErrLeaseLost) {
+			t.Errorf("CheckToken of the old holder: got %v, want ErrLeaseLost", err)
+		}
+		if _, err := locks.Renew(tx, old, time.Hour); !errors.Is(err, ErrLeaseLost) {
+			t.Errorf("Renew of the old holder: got %v, want ErrLeaseLost", err)
+		}
+		// Releasing a lost lease leaves the new holder alone
+		if err := locks.Release(tx, old); err != nil {
+			return err
+		}
+		renewed, err := locks.Renew(tx, current, 2*time.Hour)
+		if err != nil {
+			return err
+		}
+		if renewed.Token != current.Token || !renewed.Expires.After(current.Expires) {
+			t.Errorf("Renew: got token %d expiring at %v", renewed.Token, renewed.Expires)
+		}
+		return nil
+	})
+	mustView(t, db, func(tx *Tx) error {
+		return locks.CheckToken(tx, []byte("leader"), current.Token)
+	})
+}
+
+func TestTruncatedLeaseIsCorrupt(t *testing.T) {
+	db := openTestDB(t, nil)
+	locks := NewLocks("locks")
+	putValue(t, db, "locks", "leader", "short")
+
+	if _, err := acquire(t, db, locks, "a", time.Hour); !errors.Is(err, ErrCorruptLease) {
+		t.Errorf("Acquire: got %v, want ErrCorruptLease", err)
+	}
+	mustView(t, db, func(tx *Tx) error {
+		if _, err := locks.Holder(tx, []byte("leader")); !errors.Is(err, ErrCorruptLease) {
+			t.Errorf("Holder: got %v, want ErrCorruptLease", err)
+		}
+		if err := locks.CheckToken(tx, []byte("leader"), 1); !errors.Is(err, ErrCorruptLease) {
+			t.Errorf("CheckToken: got %v, want ErrCorruptLease", err)
+		}
+		return nil
+	})
+	err := db.Update(func(tx *Tx) error {
+		_, err := locks.Renew(tx, &Lease{Name: []byte("leader")}, time.Hour)
+		return err
+	})
+	if !errors.Is(err, ErrCorruptLease) {
+		t.Errorf("Renew: got %v, want ErrCorruptLease", err)
+	}
+}
@@ -0,0 +1,62 @@
+package gopherdb
+
+import "os"
+
+// Limits are the size limits of the items of a database, which depend on its page size and fill percents. They let an
+// application check its keys and values against them before it writes any.
+type Limits struct {
+	// PageSize is the size of the pages of the file.
+	PageSize int
+	// MaxKeySize is the size of the biggest key, see DB.MaxKeySize.
+	MaxKeySize int
+	// MaxValueSize is the size of the biggest value, see the constant.
+	MaxValueSize int
+
+	// sizes holds the page size and the fill percents the limits are computed from.
+	sizes *dal
+}
+
+// LimitsOf returns the limits of a database opened with the options, with the page size of the OS unless the file was
+// written with another one.
+func LimitsOf(options *Options) Limits {
+	pageSize := options.pageSize
+	if pageSize == 0 {
+		pageSize = os.Getpagesize()
+	}
+	return newLimits(&dal{pageSize: pageSize, minFillPercent: options.MinFillPercent, maxFillPercent: options.MaxFillPercent})
+}
+
+// Limits returns the limits of the database.
+func (db *DB) Limits() Limits {
+	return newLimits(db.dal)
+}
+
+func newLimits(d *dal) Limits {
+	return Limits{PageSize: d.pageSize, MaxKeySize: d.maxKeySize(), MaxValueSize: MaxValueSize, sizes: d}
+}
+
+// MaxInlineValueSize returns the size of the biggest value stored inside the node of a key of keySize bytes, up to
+// MaxKeySize. Bigger values go to overflow pages, which take a page read more each and at least a page each. It's
+// lowered by the inline thresholds of the options and the collections, see Options.InlineValueThreshold.
+func (l Limits) MaxInlineValueSize(keySize int) int {
+	size := maxInlineValueSize
+	for size > 0 && elementSizeOf(keySize, size) > l.sizes.maxElementSize() {
+		size--
+	}
+	return size
+}
+
+// MaxKeysPerPage estimates how many items with keys of keySize bytes and values of valueSize bytes a node holds before
+// it's split. Nodes are split in two halves, so they hold between half of it and all of it once the tree is bigger
+// than a node. Values bigger than MaxInlineValueSize count as the reference to their overflow pages.
+func (l Limits) MaxKeysPerPage(keySize int, valueSize int) int {
+	if valueSize > l.MaxInlineValueSize(keySize) {
+		valueSize = overflowRefSize
+	}
+	free := int(l.sizes.maxThreshold()) - nodeHeaderSize - pageNumSize
+	keys := free / elementSizeOf(keySize, valueSize)
+	if keys < 1 {
+		return 1
+	}
+	return keys
+}
@@ -0,0 +1,66 @@
+package gopherdb
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestLimitsMatchTheStoredItems(t *testing.T) {
+	db := openTestDB(t, nil)
+	limits := db.Limits()
+	if limits.PageSize != 512 || limits.MaxKeySize != db.MaxKeySize() {
+		t.Errorf("Limits: got a page size of %d and %d byte keys, want 512 and %d", limits.PageSize, limits.MaxKeySize, db.MaxKeySize())
+	}
+	if of := LimitsOf(testOptions()); of.PageSize != limits.PageSize || of.MaxKeySize != limits.MaxKeySize {
+		t.Errorf("LimitsOf: got a page size of %d and %d byte keys, want the ones of the database", of.PageSize, of.MaxKeySize)
+	}
+
+	// The biggest inline value stays in the node, and a byte more goes to an overflow page
+	inline := limits.MaxInlineValueSize(1)
+	var overflow []bool
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for _, size := range []int{inline, inline + 1} {
+			if err := c.Put([]byte("k"), bytes.Repeat([]byte("v"), size)); err != nil {
+				return err
+			}
+			item, err := c.findItem([]byte("k"))
+			if err != nil {
+				return err
+			}
+			overflow = append(overflow, item.overflow)
+		}
+		return nil
+	})
+	if overflow[0] || !overflow[1] {
+		t.Errorf("values of %d and %d bytes in overflow pages: got %v, want [false true]", inline, inline+1, overflow)
+	}
+
+	// A leaf holds MaxKeysPerPage items, and is split by one more
+	for _, valueSize := range []int{8, inline + 1} {
+		keys := limits.MaxKeysPerPage(6, valueSize)
+		collection := fmt.Sprintf("values of %d bytes", valueSize)
+		value := bytes.Repeat([]byte("v"), valueSize)
+		var leaves []bool
+		mustUpdate(t, db, func(tx *Tx) error {
+			c := getOrCreate(t, tx, collection)
+			for i := 0; i <= keys; i++ {
+				if err := c.Put([]byte(fmt.Sprintf("%06d", i)), value); err != nil {
+					return err
+				}
+				if i >= keys-1 {
+					root, err := tx.getNode(c.root)
+					if err != nil {
+						return err
+					}
+					leaves = append(leaves, root.isLeaf())
+				}
+			}
+			return nil
+		})
+		if !leaves[0] || leaves[1] {
+			t.Errorf("%s: the root is a leaf after %d and %d keys: got %v, want [true false]", collection, keys, keys+1, leaves)
+		}
+	}
+}
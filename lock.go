@@ -0,0 +1,24 @@
+package gopherdb
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// lockRetryInterval is how often Open tries to take the lock of the file again while it waits, see
+// Options.LockTimeout.
+const lockRetryInterval = 10 * time.Millisecond
+
+// waitLock takes the lock of the file like lockFile, trying again until the timeout runs out while another process
+// holds a conflicting one.
+func waitLock(file *os.File, exclusive bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := lockFile(file, exclusive)
+		if !errors.Is(err, ErrDatabaseLocked) || !time.Now().Before(deadline) {
+			return err
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
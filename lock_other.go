@@ -0,0 +1,11 @@
+//go:build !unix && !windows
+
+package gopherdb
+
+import "os"
+
+// lockFile does nothing on the platforms without file locks, where processes opening the same file must be kept apart
+// by other means.
+func lockFile(file *os.File, exclusive bool) error {
+	return nil
+}
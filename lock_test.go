@@ -0,0 +1,196 @@
+//go:build unix || windows
+
+package gopherdb
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOpenLockedByAnotherProcessKeepsTheWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	options.WAL = true
+	db := openTestPath(t, path, options)
+	putValue(t, db, "c", "k", "v")
+
+	before, err := os.Stat(walPath(path))
+	if err != nil {
+		t.Fatalf("Stat of the WAL: %v", err)
+	}
+	// Another process opens the file without the registry of this one, and without WAL mode, which would replay and
+	// remove the WAL
+	other := testOptions()
+	_, err = newDal(path, other)
+	if !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("newDal of a locked file: got %v, want ErrDatabaseLocked", err)
+	}
+	after, err := os.Stat(walPath(path))
+	if err != nil {
+		t.Fatalf("Stat of the WAL after the failed open: %v", err)
+	}
+	if after.Size() != before.Size() || before.Size() == 0 {
+		t.Errorf("WAL size: got %d, want %d", after.Size(), before.Size())
+	}
+	if got := getValue(t, db, "c", "k"); got != "v" {
+		t.Errorf("value after the failed open: got %q, want v", got)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	reopened := openTestPath(t, path, other)
+	if got := getValue(t, reopened, "c", "k"); got != "v" {
+		t.Errorf("value after reopening: got %q, want v", got)
+	}
+}
+
+func TestDoctorLeavesTheWALOfAnOpenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	options.WAL = true
+	db := openTestPath(t, path, options)
+	putValue(t, db, "c", "k", "v")
+	if err := db.abandon(); err != nil {
+		t.Fatalf("abandon: %v", err)
+	}
+	wal := readFile(t, walPath(path))
+
+	// Another process has the file open
+	other, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := lockFile(other, true); err != nil {
+		t.Fatalf("lockFile: %v", err)
+	}
+	findings, err := Doctor(path, options)
+	if err != nil {
+		t.Fatalf("Doctor: %v", err)
+	}
+	if !hasFinding(findings, "lock", SeverityWarning) {
+		t.Errorf("Doctor of a file locked by another process: no lock warning in %v", findings)
+	}
+	for _, finding := range findings {
+		if finding.Severity == SeverityCritical {
+			t.Errorf("Doctor of a file locked by another process: %s: %s", finding.Check, finding.Message)
+		}
+	}
+	if !bytes.Equal(readFile(t, walPath(path)), wal) {
+		t.Error("Doctor changed the WAL of a file open in another process")
+	}
+	_ = other.Close()
+
+	findings, err = Doctor(path, options)
+	if err != nil {
+		t.Fatalf("Doctor: %v", err)
+	}
+	if hasFinding(findings, "lock", SeverityWarning) || !hasFinding(findings, "wal", SeverityInfo) {
+		t.Errorf("Doctor of a closed file with a WAL: got %v, want the WAL replayed", findings)
+	}
+}
+
+func TestOpenWaitsForTheLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPath(t, path, nil)
+	putValue(t, db, "c", "k", "v")
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// Another process has the file open, and closes it after a while
+	other, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer other.Close()
+	if err := lockFile(other, true); err != nil {
+		t.Fatalf("lockFile: %v", err)
+	}
+
+	options := testOptions()
+	options.LockTimeout = 50 * time.Millisecond
+	start := time.Now()
+	if _, err := Open(path, options); !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("Open of a locked file: got %v, want ErrDatabaseLocked", err)
+	}
+	if waited := time.Since(start); waited < options.LockTimeout {
+		t.Errorf("Open gave up after %s, before the %s timeout", waited, options.LockTimeout)
+	}
+
+	time.AfterFunc(50*time.Millisecond, func() { _ = other.Close() })
+	options.LockTimeout = 5 * time.Second
+	reopened := openTestPath(t, path, options)
+	if got := getValue(t, reopened, "c", "k"); got != "v" {
+		t.Errorf("value once the lock was released: got %q, want v", got)
+	}
+}
+
+func TestReadOnlyOpenWaitsForTheLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPath(t, path, nil)
+	putValue(t, db, "c", "k", "v")
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// Another process has the file open for writing, and closes it after a while
+	other, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer other.Close()
+	if err := lockFile(other, true); err != nil {
+		t.Fatalf("lockFile: %v", err)
+	}
+
+	options := testOptions()
+	options.ReadOnly = true
+	options.LockTimeout = 5 * time.Second
+	time.AfterFunc(50*time.Millisecond, func() { _ = other.Close() })
+	start := time.Now()
+	reopened := openTestPath(t, path, options)
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("the read-only open took the lock after %s, while the other process held it", waited)
+	}
+	if got := getValue(t, reopened, "c", "k"); got != "v" {
+		t.Errorf("value once the lock was released: got %q, want v", got)
+	}
+}
+
+func TestReadOnlyOpensShareTheLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPath(t, path, nil)
+	putValue(t, db, "c", "k", "v")
+
+	// Other processes open the file, without the registry of this one
+	readOnly := testOptions()
+	readOnly.ReadOnly = true
+	readOnly.LockTimeout = 50 * time.Millisecond
+	start := time.Now()
+	if _, err := newDal(path, readOnly); !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("read-only open of a file open for writing: got %v, want ErrDatabaseLocked", err)
+	}
+	if waited := time.Since(start); waited < readOnly.LockTimeout {
+		t.Errorf("the read-only open gave up after %s, before the %s timeout", waited, readOnly.LockTimeout)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	first, err := newDal(path, readOnly)
+	if err != nil {
+		t.Fatalf("read-only open: %v", err)
+	}
+	defer first.close()
+	second, err := newDal(path, readOnly)
+	if err != nil {
+		t.Fatalf("read-only open of a file open read-only: %v", err)
+	}
+	defer second.close()
+	if _, err := newDal(path, testOptions()); !errors.Is(err, ErrDatabaseLocked) {
+		t.Errorf("open of a file open read-only: got %v, want ErrDatabaseLocked", err)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package gopherdb
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile takes a lock on the file, held until it's closed, or fails with ErrDatabaseLocked if another process holds a
+// lock conflicting with it. An exclusive lock conflicts with every lock, and a shared lock only with exclusive ones.
+func lockFile(file *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrDatabaseLocked
+	}
+	return err
+}
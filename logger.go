@@ -0,0 +1,46 @@
+package gopherdb
+
+// Logger receives the events of a database, see Options.Logger. Its methods are the ones of *slog.Logger, which can be
+// passed as it is, and the arguments are alternating keys and values like with slog:
+//
+//	options.Logger = slog.Default()
+//
+// Debug gets the events of every commit, Info the opens and closes of the file, Warn what the database repaired or
+// couldn't do but could carry on without, like a crash recovery or a segment that couldn't be shipped, and Error the
+// commits that failed. The methods are called by the goroutine the event happened in, which may hold locks of the
+// file, so they must not begin transactions.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// nopLogger is the logger of a database without Options.Logger.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+func newLogger(logger Logger) Logger {
+	if logger == nil {
+		return nopLogger{}
+	}
+	return logger
+}
+
+// logRecovery logs what Open did to a file that wasn't closed cleanly.
+func (d *dal) logRecovery(path string) {
+	r := d.recovery
+	if r == nil {
+		return
+	}
+	args := []any{"path", path, "txid", r.TxID, "wal_commits", r.WALCommits, "torn_meta_page", r.TornMetaPage,
+		"dropped_free_pages", len(r.DroppedFreePages)}
+	if r.Err != nil {
+		args = append(args, "err", r.Err)
+	}
+	d.logger.Warn("gopherdb: recovered the file after a crash", args...)
+}
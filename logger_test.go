@@ -0,0 +1,97 @@
+package gopherdb
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testLogger records the events logged, as their level, message and arguments.
+type testLogger struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *testLogger) log(level string, msg string, args []any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, fmt.Sprint(level, " ", msg, " ", args))
+}
+
+func (l *testLogger) Debug(msg string, args ...any) { l.log("DEBUG", msg, args) }
+func (l *testLogger) Info(msg string, args ...any)  { l.log("INFO", msg, args) }
+func (l *testLogger) Warn(msg string, args ...any)  { l.log("WARN", msg, args) }
+func (l *testLogger) Error(msg string, args ...any) { l.log("ERROR", msg, args) }
+
+// find returns the events starting with the prefix.
+func (l *testLogger) find(prefix string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var found []string
+	for _, event := range l.events {
+		if strings.HasPrefix(event, prefix) {
+			found = append(found, event)
+		}
+	}
+	return found
+}
+
+func TestLogger(t *testing.T) {
+	logger := &testLogger{}
+	options := testOptions()
+	options.Logger = logger
+	backend := &memBackend{}
+	db := openBackend(t, backend, options)
+	if len(logger.find("INFO gopherdb: opened the file")) != 1 {
+		t.Fatalf("the open wasn't logged: %q", logger.events)
+	}
+
+	for i := 0; i < 50; i++ {
+		putValue(t, db, "c", string(testKey(i)), "value")
+	}
+	commits := logger.find("DEBUG gopherdb: commit")
+	if len(commits) != 50 || !strings.Contains(commits[49], fmt.Sprint("txid ", db.txid)) {
+		t.Fatalf("got %d commits logged, the last one %q", len(commits), commits[len(commits)-1])
+	}
+
+	errBroken := errors.New("broken")
+	backend.mu.Lock()
+	backend.failWrites = errBroken
+	backend.mu.Unlock()
+	if err := db.Put([]byte("c"), []byte("k"), []byte("v")); !errors.Is(err, errBroken) {
+		t.Fatalf("got %v, want the error of the backend", err)
+	}
+	backend.mu.Lock()
+	backend.failWrites = nil
+	backend.mu.Unlock()
+	if failed := logger.find("ERROR gopherdb: commit failed"); len(failed) != 1 || !strings.Contains(failed[0], "broken") {
+		t.Fatalf("got the failures %q", failed)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(logger.find("INFO gopherdb: closed the file")) != 1 {
+		t.Fatalf("the close wasn't logged: %q", logger.events)
+	}
+}
+
+func TestLoggerRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPath(t, path, nil)
+	putValue(t, db, "c", "k", "v")
+	if err := db.abandon(); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := &testLogger{}
+	options := testOptions()
+	options.Logger = logger
+	openTestPath(t, path, options)
+	if recovered := logger.find("WARN gopherdb: recovered the file"); len(recovered) != 1 {
+		t.Fatalf("the recovery wasn't logged: %q", logger.events)
+	}
+}
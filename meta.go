@@ -1,10 +1,18 @@
-package main
+package gopherdb
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
 
+// Commits alternate between the two meta pages, so a crash while one is written leaves the other one, the meta page of
+// the previous commit. Files of format versions before 5 have a single meta page, and become files with two meta pages
+// on their first commit.
 const (
-	metaPageNum        = 0
-	magicNumber uint32 = 0x12345
+	metaPageNum         = 0
+	metaPageNumB        = 1
+	magicNumber  uint32 = 0x12345
 )
 
 // meta is the meta page of the db
@@ -15,6 +23,26 @@ type meta struct {
 	// and the root page are located, a search inside a collection can be made.
 	root         pgnum
 	freelistPage pgnum
+
+	// txid is the id of the last committed write transaction. Ids only grow, so they can order commits.
+	txid uint64
+
+	// freelistJournal holds the changes to the freelist since the freelist page was written, see freelist.journal.
+	// It's empty unless Options.JournalFreelist is set.
+	freelistJournal []pgnum
+
+	// freelistSpare is the page the freelist is written to next, which then becomes the freelist page, so the freelist
+	// page of the previous commit is left as it is. It's zero in files with a single meta page.
+	freelistSpare pgnum
+
+	// clean is set on the meta page Close writes, and tells Open that the file was closed cleanly. Meta pages before
+	// version 6 don't have it, and are taken as clean.
+	clean bool
+
+	// slot is the meta page the meta was read from or last written to, and version the format version it was read
+	// with. They aren't stored.
+	slot    pgnum
+	version uint16
 }
 
 func newEmptyMeta() *meta {
@@ -30,15 +58,49 @@ func (m *meta) serialize(buf []byte) {
 
 	binary.LittleEndian.PutUint64(buf[pos:], uint64(m.freelistPage))
 	pos += pageNumSize
+
+	binary.LittleEndian.PutUint64(buf[pos:], m.txid)
+	pos += txIDSize
+
+	binary.LittleEndian.PutUint32(buf[pos:], uint32(len(m.freelistJournal)))
+	pos += freelistJournalHeaderSize
+	for _, page := range m.freelistJournal {
+		binary.LittleEndian.PutUint64(buf[pos:], uint64(page))
+		pos += pageNumSize
+	}
+
+	binary.LittleEndian.PutUint16(buf[pos:], formatVersion)
+	pos += formatVersionSize
+
+	// The meta page takes a whole page, so its size is the page size
+	binary.LittleEndian.PutUint32(buf[pos:], uint32(len(buf)))
+	pos += metaPageSizeSize
+
+	binary.LittleEndian.PutUint64(buf[pos:], uint64(m.freelistSpare))
+	pos += pageNumSize
+
+	var flags byte
+	if m.clean {
+		flags |= metaFlagClean
+	}
+	buf[pos] = flags
+
+	// The checksum is at the end of the page and covers the rest of it, so it's found even if a torn write garbled
+	// the fields
+	end := len(buf) - checksumSize
+	binary.LittleEndian.PutUint32(buf[end:], crc32.Checksum(buf[:end], castagnoli))
 }
 
-func (m *meta) deserialize(buf []byte) {
+func (m *meta) deserialize(buf []byte) error {
 	pos := 0
+	if len(buf) < metaSize {
+		return ErrNotDBFile
+	}
 	_magicNumber := binary.LittleEndian.Uint32(buf[pos:])
 	pos += magicNumberSize
 
 	if _magicNumber != magicNumber {
-		panic("The file is not db file")
+		return ErrNotDBFile
 	}
 
 	m.root = pgnum(binary.LittleEndian.Uint64(buf[pos:]))
@@ -46,4 +108,90 @@ func (m *meta) deserialize(buf []byte) {
 
 	m.freelistPage = pgnum(binary.LittleEndian.Uint64(buf[pos:]))
 	pos += pageNumSize
+
+	m.txid = binary.LittleEndian.Uint64(buf[pos:])
+	pos += txIDSize
+
+	// Meta pages written before the journal existed have zeros there, which is an empty journal
+	if len(buf) < pos+freelistJournalHeaderSize {
+		return nil
+	}
+	count := int(binary.LittleEndian.Uint32(buf[pos:]))
+	pos += freelistJournalHeaderSize
+	if count > (len(buf)-pos)/pageNumSize {
+		return ErrNotDBFile
+	}
+	m.freelistJournal = make([]pgnum, count)
+	for i := range m.freelistJournal {
+		m.freelistJournal[i] = pgnum(binary.LittleEndian.Uint64(buf[pos:]))
+		pos += pageNumSize
+	}
+
+	// Meta pages of version 1 have zeros there
+	if len(buf) < pos+formatVersionSize {
+		return nil
+	}
+	version := binary.LittleEndian.Uint16(buf[pos:])
+	pos += formatVersionSize
+	if version >= 5 && !metaChecksumValid(buf) {
+		// The checksum is taken over the whole page, so it can't match with the wrong page size
+		if len(buf) >= pos+metaPageSizeSize && int(binary.LittleEndian.Uint32(buf[pos:])) != len(buf) {
+			return fmt.Errorf("%w: the file has %d byte pages, not %d", ErrPageSizeMismatch, binary.LittleEndian.Uint32(buf[pos:]), len(buf))
+		}
+		return ErrMetaChecksumMismatch
+	}
+	if version > formatVersion {
+		return ErrUnsupportedFormat
+	}
+	m.version = version
+	m.clean = version < 6
+
+	// Meta pages before version 4 don't have the page size
+	if version < 4 || len(buf) < pos+metaPageSizeSize {
+		return nil
+	}
+	if pageSize := binary.LittleEndian.Uint32(buf[pos:]); int(pageSize) != len(buf) {
+		return fmt.Errorf("%w: the file has %d byte pages, not %d", ErrPageSizeMismatch, pageSize, len(buf))
+	}
+	pos += metaPageSizeSize
+
+	// Meta pages before version 5 have no spare freelist page
+	if version < 5 {
+		return nil
+	}
+	if len(buf) < pos+pageNumSize+checksumSize {
+		return ErrNotDBFile
+	}
+	m.freelistSpare = pgnum(binary.LittleEndian.Uint64(buf[pos:]))
+	pos += pageNumSize
+
+	if version < 6 {
+		return nil
+	}
+	if len(buf) < pos+metaFlagsSize+checksumSize {
+		return ErrNotDBFile
+	}
+	m.clean = buf[pos]&metaFlagClean != 0
+	return nil
+}
+
+// newer reports whether the meta is of a later commit than the other one, meta pages with a checksum being later than
+// the ones without. Close writes the meta page of the last commit again with the clean flag, which makes it later.
+func (m *meta) newer(other *meta) bool {
+	if (m.version >= 5) != (other.version >= 5) {
+		return m.version >= 5
+	}
+	if m.txid == other.txid {
+		return m.clean && !other.clean
+	}
+	return m.txid > other.txid
+}
+
+// metaChecksumValid reports whether the meta page ends with the checksum of the rest of it.
+func metaChecksumValid(buf []byte) bool {
+	if len(buf) < metaSize+checksumSize {
+		return false
+	}
+	end := len(buf) - checksumSize
+	return binary.LittleEndian.Uint32(buf[end:]) == crc32.Checksum(buf[:end], castagnoli)
 }
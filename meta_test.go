@@ -0,0 +1,80 @@
+package gopherdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openFails fails the test unless opening the file fails with want and leaves the file as it was.
+func openFails(t *testing.T, path string, options *Options, want error) {
+	t.Helper()
+	before := readFile(t, path)
+	db, err := Open(path, options)
+	if err == nil {
+		_ = db.Close()
+	}
+	if !errors.Is(err, want) {
+		t.Errorf("Open: got %v, want %v", err, want)
+	}
+	if !bytes.Equal(readFile(t, path), before) {
+		t.Error("the failed Open changed the file")
+	}
+}
+
+func TestOpenRejectsFilesThatArentDatabases(t *testing.T) {
+	dir := t.TempDir()
+	random := make([]byte, 8192)
+	rand.New(rand.NewSource(1)).Read(random)
+	for name, data := range map[string][]byte{
+		"empty":  {},
+		"short":  []byte("hello"),
+		"random": random,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		t.Run(name, func(t *testing.T) {
+			openFails(t, path, testOptions(), ErrNotDBFile)
+		})
+	}
+}
+
+func TestOpenRejectsMismatchedFormats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	db := openTestPath(t, path, options)
+	putValue(t, db, "c", "k", "value")
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Opened with other pages, the meta page is read at the wrong size
+	bigger := testOptions()
+	bigger.pageSize = 4096
+	openFails(t, path, bigger, ErrPageSizeMismatch)
+
+	// A file of a newer version, with both meta pages otherwise valid
+	data := readFile(t, path)
+	for _, slot := range []pgnum{metaPageNum, metaPageNumB} {
+		buf := data[int(slot)*options.pageSize : int(slot+1)*options.pageSize]
+		m := newEmptyMeta()
+		if err := m.deserialize(buf); err != nil {
+			t.Fatalf("meta page %d: %v", slot, err)
+		}
+		pos := magicNumberSize + 3*pageNumSize + freelistJournalHeaderSize + len(m.freelistJournal)*pageNumSize
+		binary.LittleEndian.PutUint16(buf[pos:], formatVersion+1)
+		end := len(buf) - checksumSize
+		binary.LittleEndian.PutUint32(buf[end:], crc32.Checksum(buf[:end], castagnoli))
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	openFails(t, path, options, ErrUnsupportedFormat)
+}
@@ -0,0 +1,93 @@
+package gopherdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// The metrics are written in the text exposition format of Prometheus, which every scraper understands, so monitoring
+// an embedded database takes no client library: rates like commits per second come from the counters, the hit rate of
+// the node cache from its hits and misses, and percentiles of the commit latency from its histogram.
+
+// MetricsHandler returns a handler serving the metrics of the database, see DB.WriteMetrics, to be scraped by
+// Prometheus, usually as /metrics:
+//
+//	http.Handle("/metrics", gopherdb.MetricsHandler(db))
+func MetricsHandler(db *DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = db.WriteMetrics(w)
+	})
+}
+
+// WriteMetrics writes the counters of DB.Stats, DB.NodeCacheStats and DB.AccessStats to w in the text format of
+// Prometheus. It reads no page, so it can be scraped as often as needed.
+func (db *DB) WriteMetrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	metric := func(name string, kind string, help string) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	stats := db.Stats()
+
+	metric("gopherdb_transactions_total", "counter", "Transactions begun.")
+	fmt.Fprintf(bw, "gopherdb_transactions_total{type=\"read\"} %d\n", stats.ReadTxs)
+	fmt.Fprintf(bw, "gopherdb_transactions_total{type=\"write\"} %d\n", stats.WriteTxs)
+	metric("gopherdb_commits_total", "counter", "Write transactions committed.")
+	fmt.Fprintf(bw, "gopherdb_commits_total %d\n", stats.Commits)
+	metric("gopherdb_rollbacks_total", "counter", "Write transactions rolled back.")
+	fmt.Fprintf(bw, "gopherdb_rollbacks_total %d\n", stats.Rollbacks)
+
+	latency := stats.CommitLatency
+	metric("gopherdb_commit_duration_seconds", "histogram", "Time taken by the commits.")
+	for i, bound := range latency.Bounds {
+		fmt.Fprintf(bw, "gopherdb_commit_duration_seconds_bucket{le=\"%g\"} %d\n", bound.Seconds(), latency.Counts[i])
+	}
+	fmt.Fprintf(bw, "gopherdb_commit_duration_seconds_bucket{le=\"+Inf\"} %d\n", latency.Count)
+	fmt.Fprintf(bw, "gopherdb_commit_duration_seconds_sum %g\n", latency.Sum.Seconds())
+	fmt.Fprintf(bw, "gopherdb_commit_duration_seconds_count %d\n", latency.Count)
+
+	metric("gopherdb_pages_allocated_total", "counter", "Pages allocated by the commits.")
+	fmt.Fprintf(bw, "gopherdb_pages_allocated_total %d\n", stats.PagesAllocated)
+	metric("gopherdb_pages_freed_total", "counter", "Pages freed by the commits.")
+	fmt.Fprintf(bw, "gopherdb_pages_freed_total %d\n", stats.PagesFreed)
+	metric("gopherdb_rebalance_total", "counter", "Rebalancing operations of the trees.")
+	fmt.Fprintf(bw, "gopherdb_rebalance_total{op=\"split\"} %d\n", stats.Rebalance.Splits)
+	fmt.Fprintf(bw, "gopherdb_rebalance_total{op=\"merge\"} %d\n", stats.Rebalance.Merges)
+	fmt.Fprintf(bw, "gopherdb_rebalance_total{op=\"rotation\"} %d\n", stats.Rebalance.Rotations)
+	metric("gopherdb_read_bytes_total", "counter", "Bytes of the pages read from the file.")
+	fmt.Fprintf(bw, "gopherdb_read_bytes_total %d\n", stats.BytesRead)
+	metric("gopherdb_written_bytes_total", "counter", "Bytes of the pages written to the file or the WAL.")
+	fmt.Fprintf(bw, "gopherdb_written_bytes_total %d\n", stats.BytesWritten)
+
+	cache := db.NodeCacheStats()
+	metric("gopherdb_node_cache_hits_total", "counter", "Reads of nodes found in the node cache.")
+	fmt.Fprintf(bw, "gopherdb_node_cache_hits_total %d\n", cache.Hits)
+	metric("gopherdb_node_cache_misses_total", "counter", "Reads of nodes missing from the node cache.")
+	fmt.Fprintf(bw, "gopherdb_node_cache_misses_total %d\n", cache.Misses)
+	metric("gopherdb_node_cache_nodes", "gauge", "Nodes in the node cache.")
+	fmt.Fprintf(bw, "gopherdb_node_cache_nodes %d\n", cache.Nodes)
+
+	metric("gopherdb_file_size_bytes", "gauge", "Size of the pages of the last commit.")
+	fmt.Fprintf(bw, "gopherdb_file_size_bytes %d\n", stats.FileSize)
+	metric("gopherdb_free_pages", "gauge", "Number of pages in the freelist.")
+	fmt.Fprintf(bw, "gopherdb_free_pages %d\n", stats.FreePages)
+
+	access := db.AccessStats()
+	names := make([]string, 0, len(access))
+	for name := range access {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metric("gopherdb_collection_reads_total", "counter", "Finds in a collection.")
+	for _, name := range names {
+		fmt.Fprintf(bw, "gopherdb_collection_reads_total{collection=%q} %d\n", name, access[name].Reads)
+	}
+	metric("gopherdb_collection_writes_total", "counter", "Puts and removes in a collection.")
+	for _, name := range names {
+		fmt.Fprintf(bw, "gopherdb_collection_writes_total{collection=%q} %d\n", name, access[name].Writes)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,59 @@
+package gopherdb
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	options := testOptions()
+	options.NodeCacheSize = 16
+	db := openTestDB(t, options)
+	for i := 0; i < 10; i++ {
+		putValue(t, db, "users", string(testKey(i)), "value")
+	}
+	getValue(t, db, "users", string(testKey(0)))
+
+	server := httptest.NewServer(MetricsHandler(db))
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("got the content type %q", contentType)
+	}
+	out := string(body)
+	for _, line := range []string{
+		"# TYPE gopherdb_commits_total counter",
+		"gopherdb_commits_total 10",
+		"gopherdb_rollbacks_total 0",
+		`gopherdb_commit_duration_seconds_bucket{le="+Inf"} 10`,
+		"gopherdb_commit_duration_seconds_count 10",
+		"# TYPE gopherdb_commit_duration_seconds histogram",
+		"# TYPE gopherdb_node_cache_hits_total counter",
+		"# TYPE gopherdb_file_size_bytes gauge",
+		`gopherdb_collection_writes_total{collection="users"} 10`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("the metrics don't have %q:\n%s", line, out)
+		}
+	}
+
+	// The buckets of the histogram are cumulative
+	stats := db.Stats()
+	last := uint64(0)
+	for i, count := range stats.CommitLatency.Counts {
+		if count < last || count > stats.CommitLatency.Count {
+			t.Fatalf("bucket %d counts %d after %d, of %d", i, count, last, stats.CommitLatency.Count)
+		}
+		last = count
+	}
+}
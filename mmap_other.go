@@ -0,0 +1,19 @@
+//go:build !unix
+
+package gopherdb
+
+import (
+	"errors"
+	"os"
+)
+
+// errMMapUnsupported is returned by mmapFile on the platforms it isn't implemented on, where reads use pread.
+var errMMapUnsupported = errors.New("mmap is not supported on this platform")
+
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return nil, errMMapUnsupported
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
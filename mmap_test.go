@@ -0,0 +1,82 @@
+//go:build unix
+
+package gopherdb
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestMMapReads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	options.MMap = true
+	db := openTestPath(t, path, options)
+	backend := db.file.(*fileBackend)
+
+	// Readers copy from the mapping while the commits grow the file
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for reader := 0; reader < 4; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				tx, err := db.ReadTx()
+				if err != nil {
+					t.Errorf("ReadTx: %v", err)
+					return
+				}
+				if c, err := tx.GetCollection([]byte("c")); err != nil {
+					t.Errorf("GetCollection: %v", err)
+				} else if c != nil {
+					if _, err := c.Find(testKey(0)); err != nil {
+						t.Errorf("Find: %v", err)
+					}
+				}
+				tx.Rollback()
+			}
+		}()
+	}
+	for round := 0; round < 20; round++ {
+		mustUpdate(t, db, func(tx *Tx) error {
+			c := getOrCreate(t, tx, "c")
+			for i := round * 20; i < (round+1)*20; i++ {
+				if err := c.Put(testKey(i), []byte(fmt.Sprintf("value %d", i))); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if got := getValue(t, db, "c", string(testKey(round*20))); got != fmt.Sprintf("value %d", round*20) {
+			t.Fatalf("value of the last commit: got %q", got)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	size, err := backend.Size()
+	if err != nil {
+		t.Fatalf("Size: %v", err)
+	}
+	backend.mu.RLock()
+	mapped := len(backend.mapped)
+	backend.mu.RUnlock()
+	if mapped == 0 || int64(mapped) > size {
+		t.Errorf("mapped %d bytes of a %d byte file", mapped, size)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if backend.mapped != nil {
+		t.Error("the mapping is left after Close")
+	}
+	checkFile(t, path, options)
+}
@@ -0,0 +1,392 @@
+package gopherdb
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// The model checker runs random sequences of operations against a database and mirrors them in an in-memory model,
+// which is a map per collection. After every step the database must match the model exactly: every collection is
+// scanned in key order, which checks the tree ordering as well as the values, and the key of the step is looked up.
+//
+// Besides Put and Remove, the operations include Commit, Rollback, a clean reopen and a simulated crash, where the open
+// write transaction is abandoned and the file is closed without committing. After a crash or a reopen the database
+// must hold exactly the last committed state.
+//
+// TestModelCheck runs a few fixed seeds. A failure reports the seed and the last operations, and can be replayed or
+// extended from the command line:
+//
+//	go test -run TestModelCheck -modelcheck.seed=N -modelcheck.runs=100 -modelcheck.diagnostics=DIR
+
+var (
+	modelCheckSeed        = flag.Int64("modelcheck.seed", 1, "seed of the first model checker run")
+	modelCheckRuns        = flag.Int("modelcheck.runs", 4, "number of model checker runs, each with the next seed")
+	modelCheckSteps       = flag.Int("modelcheck.steps", 1000, "operations per model checker run")
+	modelCheckDiagnostics = flag.String("modelcheck.diagnostics", "", "directory where a snapshot of the trees is written when a model checker run fails")
+)
+
+func TestModelCheck(t *testing.T) {
+	for _, journalFreelist := range []bool{false, true} {
+		t.Run(fmt.Sprintf("JournalFreelist=%v", journalFreelist), func(t *testing.T) {
+			options := *DefaultOptions
+			options.DiagnosticsDir = *modelCheckDiagnostics
+			options.JournalFreelist = journalFreelist
+			for i := 0; i < *modelCheckRuns; i++ {
+				err := runModelCheck(modelCheckConfig{
+					Path:    filepath.Join(t.TempDir(), "model.db"),
+					Seed:    *modelCheckSeed + int64(i),
+					Steps:   *modelCheckSteps,
+					Options: options,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// modelCheckConfig configures a model checker run.
+type modelCheckConfig struct {
+	// Path is the database file the run uses. The file is removed before the run starts.
+	Path string
+	Seed int64
+	// Steps is the number of operations to run.
+	Steps int
+	// Keys is the size of the key space of every collection. Small key spaces hit existing keys more often.
+	Keys        int
+	Collections int
+	// PageSize is the page size of the database. Small pages produce deep trees with few keys, which exercises splits,
+	// merges and rotations at every level.
+	PageSize int
+	// Options are the options the database is opened with. Set Options.DiagnosticsDir to get a snapshot of the trees
+	// written there when the run fails.
+	Options Options
+}
+
+// modelCheckError reports the step where the database diverged from the model, with the operations that led to it
+// so the failure can be replayed with the same seed.
+type modelCheckError struct {
+	Seed    int64
+	Step    int
+	History []string
+	Err     error
+}
+
+func (e *modelCheckError) Error() string {
+	return fmt.Sprintf("model check with seed %d failed at step %d: %s\nlast operations:\n  %s", e.Seed, e.Step, e.Err,
+		strings.Join(e.History, "\n  "))
+}
+
+func (e *modelCheckError) Unwrap() error {
+	return e.Err
+}
+
+// modelCheckPageSize is the default page size of model checker runs.
+const modelCheckPageSize = 512
+
+// modelHistorySize is the number of operations kept for failure reports.
+const modelHistorySize = 20
+
+type modelOp int
+
+const (
+	modelPut modelOp = iota
+	modelPutBig
+	modelRemove
+	modelCommit
+	modelRollback
+	modelReopen
+	modelCrash
+)
+
+// modelOpWeights sets how often every operation is picked, in the order of the modelOp constants.
+var modelOpWeights = []int{40, 5, 30, 10, 6, 3, 3}
+
+type modelChecker struct {
+	config  modelCheckConfig
+	rand    *rand.Rand
+	history []string
+
+	db          *DB
+	tx          *Tx
+	collections [][]byte
+
+	committed map[string]map[string][]byte
+	pending   map[string]map[string][]byte
+}
+
+// runModelCheck runs the model checker and returns a *modelCheckError if the database diverged from the model.
+func runModelCheck(config modelCheckConfig) error {
+	if config.Keys <= 0 {
+		config.Keys = 200
+	}
+	if config.Collections <= 0 {
+		config.Collections = 2
+	}
+	if config.PageSize <= 0 {
+		config.PageSize = modelCheckPageSize
+	}
+	if config.Options.MaxFillPercent == 0 {
+		config.Options = *DefaultOptions
+	}
+	config.Options.pageSize = config.PageSize
+
+	m := &modelChecker{
+		config:    config,
+		rand:      rand.New(rand.NewSource(config.Seed)),
+		committed: map[string]map[string][]byte{},
+	}
+	err := m.run()
+	// The run always ends with a write transaction open, and after a failure it may be in any state
+	if m.db != nil {
+		_ = m.crash()
+	}
+	return err
+}
+
+func (m *modelChecker) fail(step int, err error) error {
+	return &modelCheckError{Seed: m.config.Seed, Step: step, History: m.history, Err: err}
+}
+
+func (m *modelChecker) record(op string) {
+	m.history = append(m.history, op)
+	if len(m.history) > modelHistorySize {
+		m.history = m.history[1:]
+	}
+}
+
+func (m *modelChecker) run() error {
+	err := os.Remove(m.config.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = m.open()
+	if err != nil {
+		return m.fail(0, err)
+	}
+
+	for i := 0; i < m.config.Collections; i++ {
+		name := []byte(fmt.Sprintf("collection%d", i))
+		_, err = m.tx.CreateCollection(name)
+		if err != nil {
+			return m.fail(0, err)
+		}
+		m.collections = append(m.collections, name)
+		m.pending[string(name)] = map[string][]byte{}
+	}
+	err = m.commit()
+	if err != nil {
+		return m.fail(0, err)
+	}
+
+	for step := 1; step <= m.config.Steps; step++ {
+		key := []byte(fmt.Sprintf("key%06d", m.rand.Intn(m.config.Keys)))
+		err = m.step(key)
+		if err == nil {
+			err = m.verify(key)
+		}
+		if err != nil {
+			// The database is closed when reopening it failed, in which case there's no tree to take a snapshot of
+			if m.db != nil {
+				err = m.tx.newViolation(err)
+			}
+			return m.fail(step, err)
+		}
+	}
+	return nil
+}
+
+func (m *modelChecker) open() error {
+	options := m.config.Options
+	db, err := Open(m.config.Path, &options)
+	if err != nil {
+		return err
+	}
+	m.db = db
+	return m.begin()
+}
+
+func (m *modelChecker) close() error {
+	db := m.db
+	m.db = nil
+	return db.Close()
+}
+
+// crash closes the database without ending the open write transaction.
+func (m *modelChecker) crash() error {
+	db := m.db
+	m.db = nil
+	return db.abandon()
+}
+
+// begin starts a write transaction, with a pending model that starts as a copy of the committed one.
+func (m *modelChecker) begin() error {
+	tx, err := m.db.WriteTx()
+	if err != nil {
+		return err
+	}
+	m.tx = tx
+	m.pending = make(map[string]map[string][]byte, len(m.committed))
+	for name, items := range m.committed {
+		m.pending[name] = make(map[string][]byte, len(items))
+		for key, value := range items {
+			m.pending[name][key] = value
+		}
+	}
+	return nil
+}
+
+func (m *modelChecker) commit() error {
+	err := m.tx.Commit()
+	if err != nil {
+		return err
+	}
+	m.committed = m.pending
+	return m.begin()
+}
+
+func (m *modelChecker) pickOp() modelOp {
+	total := 0
+	for _, weight := range modelOpWeights {
+		total += weight
+	}
+	n := m.rand.Intn(total)
+	for op, weight := range modelOpWeights {
+		if n < weight {
+			return modelOp(op)
+		}
+		n -= weight
+	}
+	return modelPut
+}
+
+func (m *modelChecker) step(key []byte) error {
+	name := m.collections[m.rand.Intn(len(m.collections))]
+
+	switch op := m.pickOp(); op {
+	case modelPut, modelPutBig:
+		size := m.rand.Intn(64)
+		if op == modelPutBig {
+			size = maxInlineValueSize + 1 + m.rand.Intn(3*m.db.pageSize)
+		}
+		value := make([]byte, size)
+		m.rand.Read(value)
+		m.record(fmt.Sprintf("put %s/%s (%d bytes)", name, key, size))
+
+		collection, err := m.tx.GetCollection(name)
+		if err != nil {
+			return err
+		}
+		err = collection.Put(key, value)
+		if err != nil {
+			return err
+		}
+		m.pending[string(name)][string(key)] = value
+	case modelRemove:
+		m.record(fmt.Sprintf("remove %s/%s", name, key))
+		collection, err := m.tx.GetCollection(name)
+		if err != nil {
+			return err
+		}
+		err = collection.Remove(key)
+		if err != nil {
+			return err
+		}
+		delete(m.pending[string(name)], string(key))
+	case modelCommit:
+		m.record("commit")
+		return m.commit()
+	case modelRollback:
+		m.record("rollback")
+		m.tx.Rollback()
+		return m.begin()
+	case modelReopen:
+		m.record("reopen")
+		m.tx.Rollback()
+		err := m.close()
+		if err != nil {
+			return err
+		}
+		return m.open()
+	case modelCrash:
+		// The transaction is abandoned with its lock held, like a process that died in the middle of it
+		m.record("crash")
+		err := m.crash()
+		if err != nil {
+			return err
+		}
+		return m.open()
+	}
+	return nil
+}
+
+// verify checks the state seen by the open write transaction against the pending model. Every collection is scanned
+// in key order and compared to the sorted model, and the key used by the last step is looked up in every collection.
+func (m *modelChecker) verify(key []byte) error {
+	for _, name := range m.collections {
+		expected := m.pending[string(name)]
+		collection, err := m.tx.GetCollection(name)
+		if err != nil {
+			return err
+		}
+		if collection == nil {
+			return fmt.Errorf("collection %s is missing", name)
+		}
+
+		item, err := collection.Find(key)
+		if err != nil {
+			return fmt.Errorf("find %s/%s: %w", name, key, err)
+		}
+		err = checkModelItem(name, key, item, expected)
+		if err != nil {
+			return err
+		}
+
+		keys := make([]string, 0, len(expected))
+		for key := range expected {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		scanned := 0
+		err = m.tx.rangeItems(collection.root, KeyRange{}, func(item *Item) (bool, error) {
+			if scanned >= len(keys) || string(item.key) != keys[scanned] {
+				return false, fmt.Errorf("scan of %s returned %s at position %d", name, item.key, scanned)
+			}
+			item, err := collection.resolveItem(item)
+			if err != nil {
+				return false, err
+			}
+			scanned++
+			return true, checkModelItem(name, item.key, item, expected)
+		})
+		if err != nil {
+			return err
+		}
+		if scanned != len(keys) {
+			return fmt.Errorf("scan of %s returned %d keys, expected %d", name, scanned, len(keys))
+		}
+	}
+	return nil
+}
+
+func checkModelItem(collection []byte, key []byte, item *Item, expected map[string][]byte) error {
+	value, ok := expected[string(key)]
+	if !ok && item != nil {
+		return fmt.Errorf("%s/%s should not exist", collection, key)
+	}
+	if ok && item == nil {
+		return fmt.Errorf("%s/%s is missing", collection, key)
+	}
+	if ok && !bytes.Equal(item.value, value) {
+		return fmt.Errorf("%s/%s has a value of %d bytes, expected %d bytes", collection, key, len(item.value), len(value))
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package gopherdb
+
+import "fmt"
+
+// Collections nest: a collection can hold collections of its own next to its keys, for hierarchical namespaces like the
+// settings of every user, without prefixing keys. A nested collection is an item of its parent flagged as a collection,
+// whose value is the header the root collection keeps for the collections it holds, see Collection.serialize. Its name
+// is a key of the parent, which can't hold a value under the same key: Put and Remove fail with ErrIncompatibleValue
+// on it, and Find, cursors and scans skip it.
+//
+// Triggers, key transforms, views and access stats are registered by the names of the collections of the root
+// collection, so nested collections have none. Exports cover the keys of those collections only, while MoveShards,
+// DB.Compact and Check cover the nested collections too.
+
+// triggerName returns the name the triggers, key transforms and views of the collection are registered under, nil for
+// the root collection and nested collections, which have none.
+func (c *Collection) triggerName() []byte {
+	if c.parent != nil {
+		return nil
+	}
+	return c.name
+}
+
+// header returns the item of a nested collection in its parent.
+func (c *Collection) header() *Item {
+	item := c.serialize()
+	item.collection = true
+	return item
+}
+
+// nested returns the handle of the collection nested in c the item is the header of, sharing the one opened already
+// through c if any, so every handle of a collection shares its root like the ones of Tx.GetCollection do.
+func (c *Collection) nested(item *Item) *Collection {
+	c.tx.mu.Lock()
+	defer c.tx.mu.Unlock()
+	if opened, ok := c.children[string(item.key)]; ok {
+		return opened
+	}
+	collection := newEmptyCollection()
+	collection.deserialize(item)
+	collection.name = append([]byte{}, collection.name...)
+	collection.tx = c.tx
+	collection.parent = c
+	if c.children == nil {
+		c.children = map[string]*Collection{}
+	}
+	c.children[string(collection.name)] = collection
+	return collection
+}
+
+// GetCollection returns the collection nested in c under the name, or nil if there's none.
+func (c *Collection) GetCollection(name []byte) (*Collection, error) {
+	item, err := c.findStored(name)
+	if err != nil {
+		return nil, c.addContext(err, "open collection", name)
+	}
+	if item == nil || !item.collection {
+		return nil, nil
+	}
+	return c.nested(item), nil
+}
+
+// CreateCollection creates a collection nested in c under the name. It fails with ErrCollectionExists if there's one
+// already, and with ErrIncompatibleValue if c holds a value under the name. Names of nested collections are keys of
+// c, so they're at most DB.MaxKeySize bytes, a bit less than that for the biggest page sizes.
+func (c *Collection) CreateCollection(name []byte) (*Collection, error) {
+	if !c.tx.write {
+		return nil, ErrWriteInsideReadTx
+	}
+	item, err := c.findStored(name)
+	if err != nil {
+		return nil, c.addContext(err, "create collection", name)
+	}
+	if item != nil && item.collection {
+		return nil, fmt.Errorf("%w: %q", ErrCollectionExists, name)
+	}
+	if item != nil {
+		return nil, ErrIncompatibleValue
+	}
+	if len(name) > c.tx.db.maxKeySize() || elementSizeOf(len(name), collectionSize) > c.tx.db.maxElementSize() {
+		return nil, ErrKeyTooLarge
+	}
+
+	collection := newEmptyCollection()
+	collection.name = append([]byte{}, name...)
+	collection.root = c.tx.writeNode(c.tx.newNode([]*Item{}, []pgnum{})).pageNum
+	collection.tx = c.tx
+	collection.parent = c
+	err = collection.save()
+	if err != nil {
+		return nil, c.addContext(err, "create collection", name)
+	}
+	return c.nested(collection.header()), nil
+}
+
+// DeleteCollection deletes the collection nested in c under the name, with the collections nested in it, like
+// Tx.DeleteCollection. Deleting a collection that doesn't exist is a no-op, and handles of the collection must not be
+// used afterwards.
+func (c *Collection) DeleteCollection(name []byte, mode DeleteMode) error {
+	if !c.tx.write {
+		return ErrWriteInsideReadTx
+	}
+	collection, err := c.GetCollection(name)
+	if err != nil || collection == nil {
+		return err
+	}
+	root, err := c.tx.getNode(collection.root)
+	if err != nil {
+		return err
+	}
+	if mode == DeleteIfEmpty && len(root.items) > 0 {
+		return ErrCollectionNotEmpty
+	}
+	err = c.tx.freeTree(collection.root)
+	if err != nil {
+		return err
+	}
+
+	c.tx.mu.Lock()
+	delete(c.children, string(name))
+	c.tx.mu.Unlock()
+	return c.addContext(c.removeKey(name, true), "delete collection", name)
+}
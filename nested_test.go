@@ -0,0 +1,190 @@
+package gopherdb
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// nestedCollection returns the collection at the path of names from the collection of the transaction, creating it if
+// needed in write transactions.
+func nestedCollection(t *testing.T, tx *Tx, collection string, path ...string) *Collection {
+	t.Helper()
+	c := getOrCreate(t, tx, collection)
+	for _, name := range path {
+		nested, err := c.GetCollection([]byte(name))
+		if err == nil && nested == nil && tx.write {
+			nested, err = c.CreateCollection([]byte(name))
+		}
+		if err != nil || nested == nil {
+			t.Fatalf("collection %q: %v", name, err)
+		}
+		c = nested
+	}
+	return c
+}
+
+func TestNestedCollections(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPath(t, path, nil)
+	mustUpdate(t, db, func(tx *Tx) error {
+		users := getOrCreate(t, tx, "users")
+		if err := users.Put([]byte("count"), []byte("2")); err != nil {
+			return err
+		}
+		for _, user := range []string{"alice", "bob"} {
+			settings := nestedCollection(t, tx, "users", user, "settings")
+			if err := settings.Put([]byte("theme"), []byte(user+"-dark")); err != nil {
+				return err
+			}
+		}
+		if same := nestedCollection(t, tx, "users", "alice"); same != nestedCollection(t, tx, "users", "alice") {
+			t.Errorf("GetCollection returned another handle of the collection")
+		}
+
+		if _, err := users.CreateCollection([]byte("alice")); !errors.Is(err, ErrCollectionExists) {
+			t.Errorf("CreateCollection of an existing collection: got %v, want ErrCollectionExists", err)
+		}
+		if _, err := users.CreateCollection([]byte("count")); !errors.Is(err, ErrIncompatibleValue) {
+			t.Errorf("CreateCollection over a value: got %v, want ErrIncompatibleValue", err)
+		}
+		if err := users.Put([]byte("alice"), []byte("v")); !errors.Is(err, ErrIncompatibleValue) {
+			t.Errorf("Put over a collection: got %v, want ErrIncompatibleValue", err)
+		}
+		if err := users.Remove([]byte("alice")); !errors.Is(err, ErrIncompatibleValue) {
+			t.Errorf("Remove of a collection: got %v, want ErrIncompatibleValue", err)
+		}
+		if nested, err := users.GetCollection([]byte("count")); err != nil || nested != nil {
+			t.Errorf("GetCollection of a value: got %v, %v, want nil", nested, err)
+		}
+		return nil
+	})
+
+	// Committed nested collections are moved by copy on write like the others
+	mustUpdate(t, db, func(tx *Tx) error {
+		return nestedCollection(t, tx, "users", "bob", "settings").Put([]byte("lang"), []byte("en"))
+	})
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	db = openTestPath(t, path, nil)
+	mustView(t, db, func(tx *Tx) error {
+		users := getOrCreate(t, tx, "users")
+		if item, err := users.Find([]byte("alice")); err != nil || item != nil {
+			t.Errorf("Find of a collection: got %v, %v, want nil", item, err)
+		}
+		var keys []string
+		err := users.Scan(nil, func(key, value []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		cur := users.Cursor()
+		for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+			keys = append(keys, string(k))
+		}
+		if fmt.Sprint(keys) != "[count count]" {
+			t.Errorf("keys of the parent: got %v, want the value only", keys)
+		}
+
+		for key, want := range map[string]string{"alice/theme": "alice-dark", "bob/theme": "bob-dark", "bob/lang": "en"} {
+			user, name := filepath.Split(key)
+			item, err := nestedCollection(t, tx, "users", filepath.Clean(user), "settings").Find([]byte(name))
+			if err != nil {
+				return err
+			}
+			if item == nil || string(item.value) != want {
+				t.Errorf("%s: got %v, want %q", key, item, want)
+			}
+		}
+		return nil
+	})
+	if violations := checkViolations(t, db); violations != nil {
+		t.Fatalf("Check: %v", violations)
+	}
+}
+
+func TestDeleteNestedCollection(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustUpdate(t, db, func(tx *Tx) error {
+		events := nestedCollection(t, tx, "logs", "2024", "events")
+		for i := 0; i < 500; i++ {
+			if err := events.Put(testKey(i), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	freePages := func() int {
+		var free int
+		mustView(t, db, func(tx *Tx) error {
+			stats, err := tx.FileStats()
+			if err == nil {
+				free = stats.FreePages
+			}
+			return err
+		})
+		return free
+	}
+	before := freePages()
+
+	mustUpdate(t, db, func(tx *Tx) error {
+		logs := getOrCreate(t, tx, "logs")
+		if err := logs.DeleteCollection([]byte("2024"), DeleteIfEmpty); !errors.Is(err, ErrCollectionNotEmpty) {
+			t.Errorf("DeleteIfEmpty of a collection holding one: got %v, want ErrCollectionNotEmpty", err)
+		}
+		return logs.DeleteCollection([]byte("2024"), DeleteCascade)
+	})
+	mustView(t, db, func(tx *Tx) error {
+		nested, err := getOrCreate(t, tx, "logs").GetCollection([]byte("2024"))
+		if err != nil || nested != nil {
+			t.Errorf("GetCollection after DeleteCollection: got %v, %v, want nil", nested, err)
+		}
+		return nil
+	})
+	if after := freePages(); after <= before+10 {
+		t.Errorf("free pages: %d before the delete, %d after, want the pages of the nested trees", before, after)
+	}
+	if violations := checkViolations(t, db); violations != nil {
+		t.Fatalf("Check: %v", violations)
+	}
+}
+
+func TestDBCompactCopiesNestedCollections(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestPath(t, filepath.Join(dir, "test.db"), nil)
+	mustUpdate(t, db, func(tx *Tx) error {
+		for i := 0; i < 50; i++ {
+			nested := nestedCollection(t, tx, "c", fmt.Sprintf("nested%02d", i), "leaf")
+			if err := nested.Put(testKey(i), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	path := filepath.Join(dir, "compacted.db")
+	if err := db.Compact(path); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	copied := openTestPath(t, path, nil)
+	mustView(t, copied, func(tx *Tx) error {
+		for i := 0; i < 50; i++ {
+			item, err := nestedCollection(t, tx, "c", fmt.Sprintf("nested%02d", i), "leaf").Find(testKey(i))
+			if err != nil {
+				return err
+			}
+			if item == nil || string(item.value) != "value" {
+				t.Errorf("nested%02d: got %v, want value", i, item)
+			}
+		}
+		return nil
+	})
+	if violations := checkViolations(t, copied); violations != nil {
+		t.Fatalf("Check: %v", violations)
+	}
+}
@@ -1,17 +1,29 @@
-package main
+package gopherdb
 
 import (
 	"bytes"
 	"encoding/binary"
+	"hash/crc32"
 )
 
+// castagnoli is the table of the CRC-32C checksums of the node pages.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 type Item struct {
 	key   []byte
 	value []byte
+
+	// overflow is set when value holds a reference to a chain of overflow pages rather than the value itself.
+	overflow bool
+	// envelope is set when the value starts with an envelope holding the metadata of the item, see ItemMeta.
+	envelope bool
+	// collection is set when the item is a collection nested in the collection of the tree, whose value is the header
+	// of the collection, see nested.go.
+	collection bool
 }
 
 type Node struct {
-	*tx
+	tx *Tx
 
 	pageNum    pgnum
 	items      []*Item
@@ -37,6 +49,17 @@ func newItem(key []byte, value []byte) *Item {
 	}
 }
 
+// Key returns a copy of the key of the item.
+func (i *Item) Key() []byte {
+	return append([]byte{}, i.key...)
+}
+
+// Value returns a copy of the value of the item. Items returned by Find have their full value, even if it's stored in
+// overflow pages.
+func (i *Item) Value() []byte {
+	return append([]byte{}, i.value...)
+}
+
 func isLast(index int, parentNode *Node) bool {
 	return index == len(parentNode.items)
 }
@@ -50,7 +73,7 @@ func (n *Node) isLeaf() bool {
 }
 
 func (n *Node) writeNode(node *Node) *Node {
-	node, _ = n.tx.db.writeNode(node)
+	node = n.tx.writeNode(node)
 	return node
 }
 
@@ -61,7 +84,7 @@ func (n *Node) writeNodes(nodes ...*Node) {
 }
 
 func (n *Node) getNode(pageNum pgnum) (*Node, error) {
-	return n.tx.db.getNode(pageNum)
+	return n.tx.getNode(pageNum)
 }
 
 // isOverPopulated checks if the node size is bigger than the size of a page.
@@ -82,22 +105,25 @@ func (n *Node) isUnderPopulated() bool {
 
 func (n *Node) serialize(buf []byte) []byte {
 	leftPos := 0
-	rightPos := len(buf) - 1
+	rightPos := len(buf)
 
-	// Add page header: isLeaf, key-value pairs count, node num
-	// isLeaf
+	// Add page header: node flags, key-value pairs count, checksum
+	// flags
 	isLeaf := n.isLeaf()
-	var bitSetVar uint64
+	nodeFlags := nodeFlagVarintLengths | nodeFlagChecksum
 	if isLeaf {
-		bitSetVar = 1
+		nodeFlags |= nodeFlagLeaf
 	}
-	buf[leftPos] = byte(bitSetVar)
+	buf[leftPos] = nodeFlags
 	leftPos += 1
 
 	// key-value pairs count
 	binary.LittleEndian.PutUint16(buf[leftPos:], uint16(len(n.items)))
 	leftPos += 2
 
+	// the checksum is written last, once the rest of the page is
+	leftPos += checksumSize
+
 	//slotted pages for storing data in the page. It means the actual keys and values (the cells) are appended
 	// to right of the page whereas offsets have a fixed size and are appended from the left.
 
@@ -111,25 +137,31 @@ func (n *Node) serialize(buf []byte) []byte {
 			leftPos += pageNumSize
 		}
 
-		klen := len(item.key)
-		vlen := len(item.value)
-
 		// write offset
-		offset := rightPos - klen - vlen - 2
+		offset := rightPos - cellSize(item)
 		binary.LittleEndian.PutUint16(buf[leftPos:], uint16(offset))
 		leftPos += 2
+		rightPos = offset
 
-		rightPos -= vlen
-		copy(buf[rightPos:], item.value)
-
-		rightPos -= 1
-		buf[rightPos] = byte(vlen)
+		// The cell is the item flags, then the key and the value, each behind its length as a uvarint
+		var flags byte
+		if item.overflow {
+			flags |= itemFlagOverflow
+		}
+		if item.envelope {
+			flags |= itemFlagEnvelope
+		}
+		if item.collection {
+			flags |= itemFlagCollection
+		}
+		buf[offset] = flags
+		offset += 1
 
-		rightPos -= klen
-		copy(buf[rightPos:], item.key)
+		offset += binary.PutUvarint(buf[offset:], uint64(len(item.key)))
+		offset += copy(buf[offset:], item.key)
 
-		rightPos -= 1
-		buf[rightPos] = byte(klen)
+		offset += binary.PutUvarint(buf[offset:], uint64(len(item.value)))
+		copy(buf[offset:], item.value)
 	}
 
 	if !isLeaf {
@@ -139,21 +171,53 @@ func (n *Node) serialize(buf []byte) []byte {
 		binary.LittleEndian.PutUint64(buf[leftPos:], uint64(lastChildNode))
 	}
 
+	binary.LittleEndian.PutUint32(buf[legacyNodeHeaderSize:], nodeChecksum(buf))
 	return buf
 }
 
-func (n *Node) deserialize(buf []byte) {
+// nodeChecksum returns the CRC-32C of a node page, leaving out the checksum itself.
+func nodeChecksum(buf []byte) uint32 {
+	crc := crc32.Update(0, castagnoli, buf[:legacyNodeHeaderSize])
+	return crc32.Update(crc, castagnoli, buf[legacyNodeHeaderSize+checksumSize:])
+}
+
+// deserialize reads the node from a page. Every offset and length is checked against the page bounds, so a corrupted
+// page results in ErrCorruptNode instead of a panic or garbage items.
+func (n *Node) deserialize(buf []byte) error {
 	leftPos := 0
 
 	// Read header
-	isLeaf := uint16(buf[0])
+	if len(buf) < legacyNodeHeaderSize {
+		return ErrCorruptNode
+	}
+	nodeFlags := buf[0]
+	if nodeFlags&^(nodeFlagLeaf|nodeFlagVarintLengths|nodeFlagChecksum) != 0 {
+		return ErrCorruptNode
+	}
+	isLeaf := nodeFlags & nodeFlagLeaf
+	// Nodes written before the lengths were uvarints have single byte lengths
+	varintLengths := nodeFlags&nodeFlagVarintLengths != 0
 
 	itemsCount := int(binary.LittleEndian.Uint16(buf[1:3]))
 	leftPos += 3
 
+	// Nodes written before checksums were added have none
+	if nodeFlags&nodeFlagChecksum != 0 {
+		if len(buf) < nodeHeaderSize {
+			return ErrCorruptNode
+		}
+		if binary.LittleEndian.Uint32(buf[leftPos:]) != nodeChecksum(buf) {
+			return ErrChecksumMismatch
+		}
+		leftPos += checksumSize
+	}
+
 	// Read body
 	for i := 0; i < itemsCount; i++ {
 		if isLeaf == 0 { // False
+			if leftPos+pageNumSize > len(buf) {
+				return ErrCorruptNode
+			}
 			pageNum := binary.LittleEndian.Uint64(buf[leftPos:])
 			leftPos += pageNumSize
 
@@ -161,28 +225,81 @@ func (n *Node) deserialize(buf []byte) {
 		}
 
 		// Read offset
-		offset := binary.LittleEndian.Uint16(buf[leftPos:])
+		if leftPos+offsetSize > len(buf) {
+			return ErrCorruptNode
+		}
+		offset := int(binary.LittleEndian.Uint16(buf[leftPos:]))
 		leftPos += 2
 
-		klen := uint16(buf[int(offset)])
-		offset += 1
-
-		key := buf[offset : offset+klen]
-		offset += klen
-
-		vlen := uint16(buf[int(offset)])
+		if offset+cellHeaderSize > len(buf) {
+			return ErrCorruptNode
+		}
+		flags := buf[offset]
 		offset += 1
 
-		value := buf[offset : offset+vlen]
-		offset += vlen
-		n.items = append(n.items, newItem(key, value))
+		key, offset, ok := readCellField(buf, offset, varintLengths)
+		if !ok {
+			return ErrCorruptNode
+		}
+		value, _, ok := readCellField(buf, offset, varintLengths)
+		if !ok {
+			return ErrCorruptNode
+		}
+		vlen := len(value)
+		item := newItem(key, value)
+		item.overflow = flags&itemFlagOverflow != 0
+		item.envelope = flags&itemFlagEnvelope != 0
+		item.collection = flags&itemFlagCollection != 0
+		if item.overflow && vlen != overflowRefSize {
+			return ErrCorruptNode
+		}
+		n.items = append(n.items, item)
 	}
 
 	if isLeaf == 0 { // False
 		// Read the last child node
+		if leftPos+pageNumSize > len(buf) {
+			return ErrCorruptNode
+		}
 		pageNum := pgnum(binary.LittleEndian.Uint64(buf[leftPos:]))
 		n.childNodes = append(n.childNodes, pageNum)
 	}
+	return nil
+}
+
+// readCellField reads the key or the value of a cell at the offset, and returns it with the offset following it. The
+// length in front of it is a uvarint, or a single byte in nodes written before uvarints were used.
+func readCellField(buf []byte, offset int, varintLengths bool) ([]byte, int, bool) {
+	if offset >= len(buf) {
+		return nil, 0, false
+	}
+	length := uint64(buf[offset])
+	n := 1
+	if varintLengths {
+		length, n = binary.Uvarint(buf[offset:])
+		if n <= 0 {
+			return nil, 0, false
+		}
+	}
+	offset += n
+	if length > uint64(len(buf)-offset) {
+		return nil, 0, false
+	}
+	return buf[offset : offset+int(length)], offset + int(length), true
+}
+
+// cellSize returns the size of the cell of an item: the flags, and the key and the value with their lengths.
+func cellSize(item *Item) int {
+	return 1 + uvarintSize(uint64(len(item.key))) + len(item.key) + uvarintSize(uint64(len(item.value))) + len(item.value)
+}
+
+func uvarintSize(x uint64) int {
+	size := 1
+	for x >= 0x80 {
+		x >>= 7
+		size++
+	}
+	return size
 }
 
 // elementSize returns the size of a key-value-childNode triplet at a given index.
@@ -190,8 +307,8 @@ func (n *Node) deserialize(buf []byte) {
 // It's assumed i <= len(n.items)
 func (n *Node) elementSize(i int) int {
 	size := 0
-	size += len(n.items[i].key)
-	size += len(n.items[i].value)
+	size += offsetSize
+	size += cellSize(n.items[i])
 	size += pageNumSize // 8 is the pgnum size
 	return size
 }
@@ -282,15 +399,22 @@ func (n *Node) split(nodeToSplit *Node, nodeToSplitIndex int) {
 	// The first index where min amount of bytes to populate a page is achieved. Then add 1 so it will be split one
 	// index after.
 	splitIndex := nodeToSplit.tx.db.getSplitIndex(nodeToSplit)
+	n.tx.rebalance.Splits++
 
+	// The middle item moves up whole, value included. Items live in the internal nodes as well as in the leaves, so
+	// the keys of internal nodes are real keys rather than separators, and can't be shortened to the prefix that tells
+	// the children apart (suffix truncation) without moving every item down to the leaves first.
 	middleItem := nodeToSplit.items[splitIndex]
 	var newNode *Node
 
+	// The new node gets copies of the upper halves, otherwise appending to the split node would overwrite them
+	items := append([]*Item{}, nodeToSplit.items[splitIndex+1:]...)
 	if nodeToSplit.isLeaf() {
-		newNode = n.writeNode(n.tx.db.newNode(nodeToSplit.items[splitIndex+1:], []pgnum{}))
+		newNode = n.writeNode(n.tx.newNode(items, []pgnum{}))
 		nodeToSplit.items = nodeToSplit.items[:splitIndex]
 	} else {
-		newNode = n.writeNode(n.tx.db.newNode(nodeToSplit.items[splitIndex+1:], nodeToSplit.childNodes[splitIndex+1:]))
+		childNodes := append([]pgnum{}, nodeToSplit.childNodes[splitIndex+1:]...)
+		newNode = n.writeNode(n.tx.newNode(items, childNodes))
 		nodeToSplit.items = nodeToSplit.items[:splitIndex]
 		nodeToSplit.childNodes = nodeToSplit.childNodes[:splitIndex+1]
 	}
@@ -327,7 +451,7 @@ func (n *Node) removeItemFromInternal(index int) ([]int, error) {
 	}
 	//Go right
 	for !lNode.isLeaf() {
-		rIndex := len(n.childNodes) - 1
+		rIndex := len(lNode.childNodes) - 1
 		lNode, err = lNode.getNode(lNode.childNodes[rIndex])
 		if err != nil {
 			return nil, err
@@ -377,19 +501,15 @@ func rotateLeft(leftNode *Node, rightNode *Node, parentNode *Node, rightNodeInde
 	}
 }
 
-//Merge: receive node and index, transfer node to left child with it's KV pairs and child pointers and delete node
+//Merge: receive node, its left sibling and its index, transfer node to left sibling with it's KV pairs and child pointers and delete node
 //Needs to be accompanied by rebalance later
 
-func (n *Node) merge(bNode *Node, bNodeIndex int) error {
+func (n *Node) merge(aNode *Node, bNode *Node, bNodeIndex int) error {
 	// 	               p                                     p
 	//                    3,5                                    5
 	//	      /        |       \       ------>         /          \
 	//          a          b        c                     a            c
 	//         1,2         4        6,7                 1,2,3,4         6,7
-	aNode, err := n.getNode(n.childNodes[bNodeIndex-1])
-	if err != nil {
-		return err
-	}
 	// Take the item from the parent, remove it and add it to the unbalanced node
 	pNodeItem := n.items[bNodeIndex-1]
 	n.items = append(n.items[:bNodeIndex-1], n.items[bNodeIndex:]...)
@@ -402,42 +522,58 @@ func (n *Node) merge(bNode *Node, bNodeIndex int) error {
 	}
 
 	n.writeNodes(aNode, n)
-	n.tx.db.deleteNode(bNode.pageNum)
+	n.tx.deleteNode(bNode)
+	n.tx.rebalance.Merges++
 	return nil
 }
 
-// 3 Cases: Left rotate, right rotate , merge
+// rebalanceRemove rebalances an underpopulated child of the node with its siblings, which are read together, see
+// getSiblings. It rotates an item from the sibling that can spare one, the bigger one if both can, and otherwise merges
+// the child into a sibling it fits in with, the left one first.
 func (n *Node) rebalanceRemove(unabalancedNode *Node, unbalancedNodeIndex int) error {
 	parent := n
-	//I can right rotate
+	var leftPage, rightPage pgnum
 	if unbalancedNodeIndex != 0 {
-		leftNode, err := n.getNode(parent.childNodes[unbalancedNodeIndex-1])
-		if err != nil {
-			return err
-		}
-		if leftNode.canSpareAnElement() {
-			rotateRight(leftNode, unabalancedNode, parent, unbalancedNodeIndex)
-			n.writeNodes(leftNode, parent, unabalancedNode)
-			return nil
-		}
+		leftPage = parent.childNodes[unbalancedNodeIndex-1]
 	}
 	if unbalancedNodeIndex != len(parent.childNodes)-1 {
-		rightNode, err := n.getNode(parent.childNodes[unbalancedNodeIndex+1])
-		if err != nil {
-			return err
-		}
-		if rightNode.canSpareAnElement() {
-			rotateLeft(unabalancedNode, rightNode, parent, unbalancedNodeIndex)
-			n.writeNodes(unabalancedNode, parent, rightNode)
-			return nil
-		}
+		rightPage = parent.childNodes[unbalancedNodeIndex+1]
 	}
-	if unbalancedNodeIndex == 0 {
-		rightNode, err := n.getNode(parent.childNodes[unbalancedNodeIndex+1])
-		if err != nil {
-			return err
-		}
-		return parent.merge(rightNode, unbalancedNodeIndex+1)
+	leftNode, rightNode, err := n.tx.getSiblings(leftPage, rightPage)
+	if err != nil {
+		return err
+	}
+
+	leftCanSpare := leftNode != nil && leftNode.canSpareAnElement()
+	rightCanSpare := rightNode != nil && rightNode.canSpareAnElement()
+	if leftCanSpare && (!rightCanSpare || leftNode.nodeSize() >= rightNode.nodeSize()) {
+		rotateRight(leftNode, unabalancedNode, parent, unbalancedNodeIndex)
+		n.writeNodes(leftNode, parent, unabalancedNode)
+		n.tx.rebalance.Rotations++
+		return nil
+	}
+	if rightCanSpare {
+		rotateLeft(unabalancedNode, rightNode, parent, unbalancedNodeIndex)
+		n.writeNodes(unabalancedNode, parent, rightNode)
+		n.tx.rebalance.Rotations++
+		return nil
+	}
+
+	if leftNode != nil && parent.canMerge(leftNode, unabalancedNode, unbalancedNodeIndex-1) {
+		return parent.merge(leftNode, unabalancedNode, unbalancedNodeIndex)
 	}
-	return parent.merge(unabalancedNode, unbalancedNodeIndex)
+	if rightNode != nil && parent.canMerge(unabalancedNode, rightNode, unbalancedNodeIndex) {
+		return parent.merge(unabalancedNode, rightNode, unbalancedNodeIndex+1)
+	}
+	n.tx.db.logger.Debug("gopherdb: node left underpopulated, its siblings are too big to merge with",
+		"page", unabalancedNode.pageNum, "size", unabalancedNode.nodeSize())
+	return nil
+}
+
+// canMerge reports whether two siblings and the parent item between them fit in a single node. Siblings that can't
+// spare an element can still be too big to merge when items have different sizes, in which case the underpopulated
+// node is left as it is.
+func (n *Node) canMerge(leftNode *Node, rightNode *Node, separatorIndex int) bool {
+	size := leftNode.nodeSize() + rightNode.nodeSize() - nodeHeaderSize - pageNumSize + n.elementSize(separatorIndex)
+	return float32(size) <= n.tx.db.maxThreshold()
 }
@@ -0,0 +1,493 @@
+package gopherdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKey(i int) []byte {
+	return []byte(fmt.Sprintf("key%06d", i))
+}
+
+// checkTree fails the test if a node of the collection is bigger than a page or the keys of the collection aren't the
+// expected ones in key order. It returns the height of the tree.
+func checkTree(t *testing.T, c *Collection, expected map[string][]byte) int {
+	t.Helper()
+	err := c.tx.walk(c.root, func(n *Node) error {
+		if n.nodeSize() > c.tx.db.pageSize {
+			t.Errorf("node %d is %d bytes, bigger than a page", n.pageNum, n.nodeSize())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+
+	var previous []byte
+	scanned := 0
+	err = c.Scan(nil, func(key, value []byte) error {
+		if previous != nil && string(key) <= string(previous) {
+			t.Errorf("scan returned %s after %s", key, previous)
+		}
+		previous = append(previous[:0], key...)
+		want, ok := expected[string(key)]
+		if !ok {
+			t.Errorf("scan returned %s, which shouldn't exist", key)
+		} else if string(value) != string(want) {
+			t.Errorf("%s has a value of %d bytes, want %d bytes", key, len(value), len(want))
+		}
+		scanned++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if scanned != len(expected) {
+		t.Errorf("scan returned %d keys, want %d", scanned, len(expected))
+	}
+	return treeHeight(t, c.tx, c.root)
+}
+
+// treeHeight returns the number of levels of the tree starting at root.
+func treeHeight(t *testing.T, tx *Tx, root pgnum) int {
+	t.Helper()
+	for height := 1; ; height++ {
+		node, err := tx.getNode(root)
+		if err != nil {
+			t.Fatalf("getNode: %v", err)
+		}
+		if node.isLeaf() {
+			return height
+		}
+		root = node.childNodes[0]
+	}
+}
+
+func TestPutBuildsDeepTrees(t *testing.T) {
+	db := openTestDB(t, nil)
+	expected := map[string][]byte{}
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		// Every key lands in the middle of the key space so far, which splits nodes at every level
+		for i := 0; i < 3000; i++ {
+			key := testKey((i * 7919) % 3000)
+			if err := c.Put(key, key); err != nil {
+				return err
+			}
+			expected[string(key)] = key
+		}
+		if height := checkTree(t, c, expected); height < 3 {
+			t.Errorf("tree height is %d, want at least 3", height)
+		}
+		return nil
+	})
+	mustView(t, db, func(tx *Tx) error {
+		checkTree(t, getOrCreate(t, tx, "c"), expected)
+		return nil
+	})
+}
+
+func TestRemoveFromInternalNodes(t *testing.T) {
+	db := openTestDB(t, nil)
+	expected := map[string][]byte{}
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i := 0; i < 3000; i++ {
+			if err := c.Put(testKey(i), testKey(i)); err != nil {
+				return err
+			}
+			expected[string(testKey(i))] = testKey(i)
+		}
+		return nil
+	})
+
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		if height := treeHeight(t, tx, c.root); height < 3 {
+			t.Fatalf("tree height is %d, want at least 3", height)
+		}
+		// The items of the root have their predecessors two levels down or more
+		for {
+			root, err := tx.getNode(c.root)
+			if err != nil {
+				return err
+			}
+			if root.isLeaf() {
+				break
+			}
+			key := root.items[0].key
+			if err := c.Remove(key); err != nil {
+				return err
+			}
+			delete(expected, string(key))
+			if item, err := c.Find(key); err != nil || item != nil {
+				t.Fatalf("Find of the removed key %s: got %v, %v", key, item, err)
+			}
+		}
+		checkTree(t, c, expected)
+		return nil
+	})
+}
+
+func TestRemoveEverythingCollapsesTheRoot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	db := openTestPath(t, path, options)
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i := 0; i < 1000; i++ {
+			if err := c.Put(testKey(i), testKey(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i := 0; i < 1000; i++ {
+			if err := c.Remove(testKey(i)); err != nil {
+				return err
+			}
+		}
+		if height := checkTree(t, c, nil); height != 1 {
+			t.Errorf("tree height after removing every key is %d, want 1", height)
+		}
+		return nil
+	})
+
+	// The freed pages are reused by the next writes without any of them being used twice
+	expected := map[string][]byte{}
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i := 0; i < 100; i++ {
+			if err := c.Put(testKey(i), []byte("again")); err != nil {
+				return err
+			}
+			expected[string(testKey(i))] = []byte("again")
+		}
+		return nil
+	})
+	mustView(t, db, func(tx *Tx) error {
+		checkTree(t, getOrCreate(t, tx, "c"), expected)
+		return nil
+	})
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	checkFile(t, path, options)
+}
+
+func TestRebalanceReadsSiblingsTogether(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPath(t, path, nil)
+	for i := 0; i < 100; i++ {
+		putValue(t, db, "c", string(testKey(i)), "value")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	options := testOptions()
+	options.IOThrottle = &IOThrottle{Latency: FixedLatency(50 * time.Millisecond)}
+	db = openTestPath(t, path, options)
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		root, err := tx.getNode(c.root)
+		if err != nil {
+			return err
+		}
+		if len(root.childNodes) < 3 {
+			t.Fatalf("the root has %d children, want at least 3", len(root.childNodes))
+		}
+		start := time.Now()
+		left, right, err := tx.getSiblings(root.childNodes[0], root.childNodes[2])
+		if err != nil {
+			return err
+		}
+		if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+			t.Errorf("reading both siblings took %v, want a single read of 50ms", elapsed)
+		}
+		if left.pageNum != root.childNodes[0] || right.pageNum != root.childNodes[2] || right.tx != tx || !tx.readPages[right.pageNum] {
+			t.Fatalf("got the pages %d and %d, want %d and %d read by the transaction", left.pageNum, right.pageNum,
+				root.childNodes[0], root.childNodes[2])
+		}
+
+		// A missing sibling, at either end of the parent, isn't read
+		left, right, err = tx.getSiblings(0, root.childNodes[1])
+		if err != nil || left != nil || right == nil {
+			t.Fatalf("got %v, %v, %v for a single sibling", left, right, err)
+		}
+		return nil
+	})
+}
+
+func TestSplitCopiesTheUpperHalf(t *testing.T) {
+	db := openTestDB(t, nil)
+	tx, err := db.WriteTx()
+	if err != nil {
+		t.Fatalf("WriteTx: %v", err)
+	}
+	defer tx.Rollback()
+
+	var items []*Item
+	var childNodes []pgnum
+	for i := 0; i < 30; i++ {
+		items = append(items, newItem(testKey(i*2), []byte("value")))
+		childNodes = append(childNodes, pgnum(1000+i))
+	}
+	childNodes = append(childNodes, 1030)
+	for _, internal := range []bool{false, true} {
+		// The slices have spare capacity, so appending to the lower half after the split reuses their backing arrays
+		node := tx.writeNode(tx.newNode(append(make([]*Item, 0, 64), items...), nil))
+		if internal {
+			node.childNodes = append(make([]pgnum, 0, 64), childNodes...)
+		}
+		if !node.isOverPopulated() {
+			t.Fatalf("node of %d bytes isn't overpopulated", node.nodeSize())
+		}
+		parent := tx.writeNode(tx.newNode(nil, []pgnum{node.pageNum}))
+		parent.split(node, 0)
+
+		upper, err := tx.getNode(parent.childNodes[1])
+		if err != nil {
+			t.Fatalf("getNode: %v", err)
+		}
+		keys := fmt.Sprint(upper.items)
+		children := fmt.Sprint(upper.childNodes)
+		// The first append takes the slot of the middle item, which moved to the parent, and the second one the slot of
+		// the first item of the upper half
+		for i := 0; i < 2; i++ {
+			key := append(append([]byte{}, node.items[len(node.items)-1].key...), 'x')
+			node.addItem(newItem(key, []byte("value")), len(node.items))
+		}
+		if internal {
+			node.childNodes = append(node.childNodes, 2000)
+		}
+		if fmt.Sprint(upper.items) != keys || fmt.Sprint(upper.childNodes) != children {
+			t.Errorf("internal=%v: adding to the lower half after a split changed the upper half", internal)
+		}
+	}
+}
+
+func TestRemoveKeepsNodesWithinAPage(t *testing.T) {
+	db := openTestDB(t, nil)
+	rng := rand.New(rand.NewSource(2))
+	// Keys of very different sizes make siblings that can't spare an item too big to merge, and rotations that move a
+	// big item into a parent full of small ones
+	keys := make([][]byte, 400)
+	for i := range keys {
+		keys[i] = append(testKey(i), bytes.Repeat([]byte("k"), rng.Intn(db.MaxKeySize()-len(testKey(i))))...)
+	}
+	expected := map[string][]byte{}
+	for round := 0; round < 100; round++ {
+		mustUpdate(t, db, func(tx *Tx) error {
+			c := getOrCreate(t, tx, "c")
+			for i := 0; i < 100; i++ {
+				key := keys[rng.Intn(len(keys))]
+				if rng.Intn(2) == 0 {
+					delete(expected, string(key))
+					if err := c.Remove(key); err != nil {
+						return err
+					}
+					continue
+				}
+				value := bytes.Repeat([]byte("v"), rng.Intn(maxInlineValueSize))
+				expected[string(key)] = value
+				if err := c.Put(key, value); err != nil {
+					return err
+				}
+			}
+			checkTree(t, c, expected)
+			return nil
+		})
+	}
+}
+
+func TestInternalNodesHoldWholeItems(t *testing.T) {
+	db := openTestDB(t, nil)
+	long := func(i int) []byte {
+		return append(bytes.Repeat([]byte("a long shared prefix/"), 3), testKey(i)...)
+	}
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i := 0; i < 300; i++ {
+			if err := c.Put(long(i), testKey(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	mustView(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		internal := 0
+		err := tx.walk(c.root, func(n *Node) error {
+			if n.isLeaf() {
+				return nil
+			}
+			// Split moves the middle item up whole, so the keys of internal nodes are keys of the collection with
+			// their values, not separators that could be truncated
+			for _, item := range n.items {
+				internal++
+				value, err := c.Get(item.key)
+				if err != nil || string(item.value) != string(value) || len(item.key) != len(long(0)) {
+					t.Errorf("the internal item %q with %q isn't an item of the collection: %q, %v", item.key, item.value, value, err)
+				}
+			}
+			return nil
+		})
+		if internal == 0 {
+			t.Error("the tree has no internal nodes")
+		}
+		return err
+	})
+}
+
+func TestItemAccessorsReturnCopies(t *testing.T) {
+	db := openTestDB(t, nil)
+	big := bytes.Repeat([]byte("v"), 3000)
+	putValue(t, db, "c", "small", "value")
+	putValue(t, db, "c", "big", string(big))
+
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		// The nodes written by the transaction are the ones Find reads from
+		if err := c.Put([]byte("small"), []byte("value")); err != nil {
+			return err
+		}
+		item, err := c.Find([]byte("small"))
+		if err != nil {
+			return err
+		}
+		key, value := item.Key(), item.Value()
+		key[0], value[0] = 'x', 'x'
+		if item, err := c.Find([]byte("small")); err != nil || string(item.Key()) != "small" || string(item.Value()) != "value" {
+			t.Errorf("modifying the key and value returned by the item changed the item in the tree")
+		}
+
+		// Values stored in overflow pages are returned whole
+		item, err = c.Find([]byte("big"))
+		if err != nil {
+			return err
+		}
+		if string(item.Key()) != "big" || !bytes.Equal(item.Value(), big) {
+			t.Errorf("the item of a value in overflow pages has %q and %d bytes", item.Key(), len(item.Value()))
+		}
+		return nil
+	})
+}
+
+func TestKeysAndValuesLongerThan255Bytes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := *DefaultOptions
+	db := openTestPath(t, path, &options)
+	expected := map[string][]byte{}
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i, size := range []int{127, 128, 255, 256, 300, db.MaxKeySize()} {
+			key := append(testKey(i), bytes.Repeat([]byte("k"), size-len(testKey(i)))...)
+			value := bytes.Repeat([]byte{byte('a' + i)}, 200*(i+1))
+			if err := c.Put(key, value); err != nil {
+				return err
+			}
+			expected[string(key)] = value
+		}
+		tooLong := bytes.Repeat([]byte("k"), db.MaxKeySize()+1)
+		if err := c.Put(tooLong, nil); !errors.Is(err, ErrKeyTooLarge) {
+			t.Errorf("Put of a key longer than MaxKeySize: got %v, want ErrKeyTooLarge", err)
+		}
+		return nil
+	})
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	checkFile(t, path, &options)
+
+	db = openTestPath(t, path, &options)
+	mustView(t, db, func(tx *Tx) error {
+		checkTree(t, getOrCreate(t, tx, "c"), expected)
+		return nil
+	})
+}
+
+func TestNodesWithSingleByteLengths(t *testing.T) {
+	// A leaf written before the lengths were uvarints: no flag but the leaf one, no checksum, and cells of the item
+	// flags, the key length, the key, the value length and the value
+	buf := make([]byte, 512)
+	buf[0] = nodeFlagLeaf
+	binary.LittleEndian.PutUint16(buf[1:], 2)
+	offset := len(buf)
+	for i, cell := range [][2]string{{"a", "first"}, {"b", strings.Repeat("v", 200)}} {
+		key, value := cell[0], cell[1]
+		offset -= 3 + len(key) + len(value)
+		binary.LittleEndian.PutUint16(buf[legacyNodeHeaderSize+i*offsetSize:], uint16(offset))
+		buf[offset+1] = byte(len(key))
+		copy(buf[offset+2:], key)
+		buf[offset+2+len(key)] = byte(len(value))
+		copy(buf[offset+3+len(key):], value)
+	}
+
+	node := NewEmptyNode()
+	if err := node.deserialize(buf); err != nil {
+		t.Fatalf("deserialize: %v", err)
+	}
+	if len(node.items) != 2 || string(node.items[0].key) != "a" || string(node.items[0].value) != "first" ||
+		string(node.items[1].key) != "b" || len(node.items[1].value) != 200 {
+		t.Fatalf("deserialize: got %v", node.items)
+	}
+
+	// Written again, the node gets the current cells
+	rewritten := node.serialize(make([]byte, 512))
+	if rewritten[0]&nodeFlagVarintLengths == 0 {
+		t.Error("the rewritten node doesn't have uvarint lengths")
+	}
+	decoded := NewEmptyNode()
+	if err := decoded.deserialize(rewritten); err != nil {
+		t.Fatalf("deserialize of the rewritten node: %v", err)
+	}
+	assertNodesEqual(t, node, decoded)
+}
+
+func TestCorruptedNodesFailTheirChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	db := openTestPath(t, path, options)
+	putValue(t, db, "c", "k", "value")
+	var leaf pgnum
+	mustView(t, db, func(tx *Tx) error {
+		leaf = getOrCreate(t, tx, "c").root
+		return nil
+	})
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// A single bit flipped in the value, which deserializes into a plausible node without the checksum
+	data := readFile(t, path)
+	page := data[int(leaf)*options.pageSize : int(leaf+1)*options.pageSize]
+	at := bytes.Index(page, []byte("value"))
+	if at < 0 {
+		t.Fatal("the value isn't in the leaf")
+	}
+	page[at] ^= 1
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	db = openTestPath(t, path, options)
+	err := db.View(func(tx *Tx) error {
+		_, err := getOrCreate(t, tx, "c").Get([]byte("k"))
+		return err
+	})
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Get from the corrupted leaf: got %v, want ErrChecksumMismatch", err)
+	}
+}
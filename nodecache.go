@@ -0,0 +1,130 @@
+package gopherdb
+
+import (
+	"container/list"
+	"sync"
+)
+
+// nodeCache keeps the nodes read last, decoded, so the upper levels of the trees, which every lookup reads, aren't read
+// and deserialized again by every transaction. A page only changes when it's written, so writePage drops it from the
+// cache, and a cached node is always the content of its page. Transactions change the nodes they get in place, so
+// every node goes in and out of the cache as a copy. Items are never changed once in a node, so the copies share them.
+type nodeCache struct {
+	mu       sync.Mutex
+	capacity int
+	nodes    map[pgnum]*list.Element
+	// lru holds the cached nodes, the one used last first.
+	lru    list.List
+	hits   uint64
+	misses uint64
+}
+
+// NodeCacheStats are the counters of the node cache, see Options.NodeCacheSize.
+type NodeCacheStats struct {
+	// Nodes is the number of nodes cached.
+	Nodes int
+	// Hits and Misses count the reads of nodes found in the cache and the ones read from the file.
+	Hits   uint64
+	Misses uint64
+}
+
+// newNodeCache returns a cache of up to capacity nodes. A cache of zero nodes caches nothing until it's resized, see
+// SettingNodeCacheSize.
+func newNodeCache(capacity int) *nodeCache {
+	if capacity < 0 {
+		capacity = 0
+	}
+	return &nodeCache{capacity: capacity, nodes: map[pgnum]*list.Element{}}
+}
+
+// copyNode returns a copy of the node the caller can change without changing n.
+func copyNode(n *Node) *Node {
+	return &Node{
+		pageNum:    n.pageNum,
+		items:      append([]*Item{}, n.items...),
+		childNodes: append([]pgnum{}, n.childNodes...),
+	}
+}
+
+// get returns a copy of the cached node of the page, or nil if it isn't cached.
+func (c *nodeCache) get(pageNum pgnum) *Node {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.capacity == 0 {
+		return nil
+	}
+	element, ok := c.nodes[pageNum]
+	if !ok {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	c.lru.MoveToFront(element)
+	return copyNode(element.Value.(*Node))
+}
+
+// put caches a copy of the node, evicting the node used least recently if the cache is full.
+func (c *nodeCache) put(n *Node) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.capacity == 0 {
+		return
+	}
+	if element, ok := c.nodes[n.pageNum]; ok {
+		element.Value = copyNode(n)
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.nodes[n.pageNum] = c.lru.PushFront(copyNode(n))
+	c.evict()
+}
+
+// evict removes the nodes used least recently until the cache holds no more than its capacity. It's called holding mu.
+func (c *nodeCache) evict() {
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.nodes, oldest.Value.(*Node).pageNum)
+	}
+}
+
+// resize changes the capacity of the cache, evicting the nodes that no longer fit.
+func (c *nodeCache) resize(capacity int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.capacity = capacity
+	c.evict()
+}
+
+// drop removes the node of the page from the cache, once the page is written.
+func (c *nodeCache) drop(pageNum pgnum) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.nodes[pageNum]; ok {
+		c.lru.Remove(element)
+		delete(c.nodes, pageNum)
+	}
+}
+
+func (c *nodeCache) stats() NodeCacheStats {
+	if c == nil {
+		return NodeCacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return NodeCacheStats{Nodes: c.lru.Len(), Hits: c.hits, Misses: c.misses}
+}
+
+// NodeCacheStats returns the counters of the node cache, all zero without one.
+func (db *DB) NodeCacheStats() NodeCacheStats {
+	return db.nodeCache.stats()
+}
@@ -0,0 +1,93 @@
+package gopherdb
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestNodeCacheHits(t *testing.T) {
+	options := testOptions()
+	options.NodeCacheSize = 1000
+	db := openTestDB(t, options)
+	for i := 0; i < 200; i++ {
+		putValue(t, db, "c", string(testKey(i)), "v")
+	}
+
+	// The commits drop the pages they write, so the first lookups read the tree again
+	for i := 0; i < 200; i++ {
+		getValue(t, db, "c", string(testKey(i)))
+	}
+	before := db.NodeCacheStats()
+	for i := 0; i < 200; i++ {
+		if got := getValue(t, db, "c", string(testKey(i))); got != "v" {
+			t.Fatalf("key %d: got %q", i, got)
+		}
+	}
+	after := db.NodeCacheStats()
+	if after.Hits <= before.Hits || after.Misses != before.Misses {
+		t.Fatalf("lookups of a cached tree: got %+v, then %+v", before, after)
+	}
+	if after.Nodes == 0 || after.Nodes > options.NodeCacheSize {
+		t.Fatalf("got %d nodes cached", after.Nodes)
+	}
+
+	if stats := openTestDB(t, nil).NodeCacheStats(); stats != (NodeCacheStats{}) {
+		t.Fatalf("got %+v without a cache", stats)
+	}
+}
+
+func TestNodeCacheDropsWrittenPages(t *testing.T) {
+	options := testOptions()
+	options.NodeCacheSize = 8
+	db := openTestDB(t, options)
+	for i := 0; i < 100; i++ {
+		putValue(t, db, "c", string(testKey(i)), "old")
+	}
+
+	// The snapshot holds back the pages the commits free, which are reused once it ends
+	tx, err := db.ReadTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			putValue(t, db, "c", string(testKey(i)), "new")
+		}
+	}
+	c, err := tx.GetCollection([]byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		value, err := c.Get(testKey(i))
+		if err != nil || string(value) != "old" {
+			t.Fatalf("key %d in the snapshot: got %q, %v", i, value, err)
+		}
+	}
+	tx.Rollback()
+
+	for i := 0; i < 100; i++ {
+		putValue(t, db, "c", string(testKey(i)), "newer")
+	}
+	for i := 0; i < 100; i++ {
+		if got := getValue(t, db, "c", string(testKey(i))); got != "newer" {
+			t.Fatalf("key %d: got %q", i, got)
+		}
+	}
+}
+
+func TestNodeCacheModelCheck(t *testing.T) {
+	options := *DefaultOptions
+	options.NodeCacheSize = 16
+	for i := 0; i < *modelCheckRuns; i++ {
+		err := runModelCheck(modelCheckConfig{
+			Path:    filepath.Join(t.TempDir(), "model.db"),
+			Seed:    *modelCheckSeed + int64(i),
+			Steps:   *modelCheckSteps,
+			Options: options,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
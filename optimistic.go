@@ -0,0 +1,521 @@
+package gopherdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// OptimisticTx is a write transaction that holds no lock while it runs, so several of them can run at once, along with
+// a regular write transaction. Its reads are made by short read transactions and recorded, and its writes are kept in
+// memory until Commit, which applies them in a write transaction if none of the keys and prefixes it read were written
+// by a transaction committed since it began, and fails with ErrConflict otherwise. It suits workloads where writers
+// rarely touch the same keys; on ErrConflict the whole transaction should be run again.
+//
+// Reads see the writes of the transaction, and otherwise the file as it is when they're made, so two reads of a key
+// can differ; Commit rejects the transaction in that case since the key was written after it began. Committed
+// transactions are serializable, but the code running one can see such reads before Commit rejects it. Transactions
+// begun with SerializableTx are also checked on every read and fail with ErrConflict as soon as they read something
+// written since they began, so they only ever see the file as it was then, and they fail on Commit if a key they wrote
+// was written since too. An OptimisticTx must be used by one goroutine at a time.
+type OptimisticTx struct {
+	db    *DB
+	start uint64
+	done  bool
+	// serializable is set on the transactions of SerializableTx.
+	serializable bool
+	// retries is the number of times DB.Optimistic or DB.Serializable ran the function before.
+	retries int
+
+	// collections holds the collections the transaction used, keys the stored keys it read and prefixes the stored
+	// prefixes it scanned, by collection.
+	collections map[string]bool
+	keys        map[string]map[string]bool
+	prefixes    map[string][][]byte
+	// writes holds the latest write of every key, by collection and stored key, and order the keys in the order they
+	// were first written, so they're applied in that order.
+	writes map[string]map[string]*optimisticWrite
+	order  []*optimisticWrite
+}
+
+type optimisticWrite struct {
+	collection []byte
+	key        []byte
+	storedKey  []byte
+	value      []byte
+	remove     bool
+}
+
+// writeSet holds what a write transaction changed, for the optimistic transactions running when it committed: the
+// stored keys it wrote by collection, and the collections it created or deleted. Collections are keyed by their path,
+// see collectionPath, so the keys of a nested collection never count as keys of a collection of the same name.
+type writeSet struct {
+	txid        uint64
+	keys        map[string]map[string]bool
+	collections map[string]bool
+}
+
+func newWriteSet() *writeSet {
+	return &writeSet{keys: map[string]map[string]bool{}, collections: map[string]bool{}}
+}
+
+// collectionPath returns the key of a collection in write sets, given its name and the names of the collections it's
+// nested in, outermost first. Every name is preceded by its length, so no two paths give the same key.
+func collectionPath(names ...[]byte) string {
+	var path []byte
+	for _, name := range names {
+		path = binary.AppendUvarint(path, uint64(len(name)))
+		path = append(path, name...)
+	}
+	return string(path)
+}
+
+// path returns the key of the collection in write sets, see collectionPath.
+func (c *Collection) path() string {
+	var names [][]byte
+	for collection := c; collection != nil; collection = collection.parent {
+		names = append([][]byte{collection.name}, names...)
+	}
+	return collectionPath(names...)
+}
+
+// optimisticState keeps the write sets of the commits optimistic transactions still have to be validated against. It's
+// shared by the handles of the file.
+type optimisticState struct {
+	mu sync.Mutex
+	// active counts the running optimistic transactions by the txid they began at, and log holds the write sets of
+	// the commits since the oldest of them began, oldest first.
+	active map[uint64]int
+	log    []*writeSet
+}
+
+func newOptimisticState() *optimisticState {
+	return &optimisticState{active: map[uint64]int{}}
+}
+
+// tracking reports whether write transactions have to record their write sets. It's called when they begin, holding
+// the write lock, while optimistic transactions register holding the read lock, so a write transaction that doesn't
+// record its writes committed before every running optimistic transaction began.
+func (s *optimisticState) tracking() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.active) > 0
+}
+
+func (s *optimisticState) register(start uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active[start]++
+}
+
+// unregister forgets an optimistic transaction, and drops the write sets no running one has to be validated against.
+func (s *optimisticState) unregister(start uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active[start]--
+	if s.active[start] == 0 {
+		delete(s.active, start)
+	}
+	if len(s.active) == 0 {
+		s.log = nil
+		return
+	}
+	oldest := start
+	for txid := range s.active {
+		if txid < oldest {
+			oldest = txid
+		}
+	}
+	i := 0
+	for i < len(s.log) && s.log[i].txid <= oldest {
+		i++
+	}
+	s.log = s.log[i:]
+}
+
+func (s *optimisticState) publish(writes *writeSet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.active) > 0 {
+		s.log = append(s.log, writes)
+	}
+}
+
+// conflicts reports whether a transaction committed after the optimistic transaction began wrote something it read,
+// or something it wrote for the transactions of SerializableTx.
+func (s *optimisticState) conflicts(o *OptimisticTx) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, writes := range s.log {
+		if writes.txid <= o.start {
+			continue
+		}
+		// The transaction only uses collections of the root collection
+		for collection := range o.collections {
+			if writes.collections[collectionPath([]byte(collection))] {
+				return true
+			}
+		}
+		for collection, keys := range o.keys {
+			written := writes.keys[collectionPath([]byte(collection))]
+			for key := range keys {
+				if written[key] {
+					return true
+				}
+			}
+		}
+		for collection, prefixes := range o.prefixes {
+			for key := range writes.keys[collectionPath([]byte(collection))] {
+				for _, prefix := range prefixes {
+					if bytes.HasPrefix([]byte(key), prefix) {
+						return true
+					}
+				}
+			}
+		}
+		if !o.serializable {
+			continue
+		}
+		for collection, keys := range o.writes {
+			written := writes.keys[collectionPath([]byte(collection))]
+			for key := range keys {
+				if written[key] {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// recordWrite adds a stored key to the write set of the transaction, if it records one.
+func (c *Collection) recordWrite(key []byte) {
+	if c.tx.writes == nil || c.name == nil {
+		return
+	}
+	path := c.path()
+	keys := c.tx.writes.keys[path]
+	if keys == nil {
+		keys = map[string]bool{}
+		c.tx.writes.keys[path] = keys
+	}
+	keys[string(key)] = true
+}
+
+// recordCollection adds a created or deleted collection to the write set of the transaction, if it records one.
+func (tx *Tx) recordCollection(name []byte) {
+	if tx.writes != nil {
+		tx.writes.collections[collectionPath(name)] = true
+	}
+}
+
+// OptimisticTx begins an optimistic transaction. It waits for a running write transaction to end, but doesn't block
+// the next ones. On read-only views, Commit fails with ErrWriteInsideReadTx if the transaction wrote anything.
+func (db *DB) OptimisticTx() (*OptimisticTx, error) {
+	return db.beginOptimistic(false)
+}
+
+// SerializableTx begins an optimistic transaction that also fails on reads of keys written since it began and on
+// writes of keys written since, see OptimisticTx. It's meant for code that must never act on an inconsistent view,
+// like moving a balance between accounts, at the cost of more conflicts.
+func (db *DB) SerializableTx() (*OptimisticTx, error) {
+	return db.beginOptimistic(true)
+}
+
+func (db *DB) beginOptimistic(serializable bool) (*OptimisticTx, error) {
+	err := db.begin()
+	if err != nil {
+		return nil, err
+	}
+	// The write transaction running only records its write set if an optimistic transaction ran when it began
+	db.rwlock.RLock()
+	defer db.endTx(false)
+	o := &OptimisticTx{
+		db:           db,
+		start:        db.txid,
+		serializable: serializable,
+		collections:  map[string]bool{},
+		keys:         map[string]map[string]bool{},
+		prefixes:     map[string][][]byte{},
+		writes:       map[string]map[string]*optimisticWrite{},
+	}
+	db.optimistic.register(o.start)
+	return o, nil
+}
+
+// Optimistic runs fn in an optimistic transaction and commits it, running fn again in a new transaction as long as
+// Commit fails with ErrConflict, up to attempts times in all, see OptimisticTx.Attempt. The transaction is rolled back
+// if fn returns an error or panics. The error of fn or of the last Commit is returned.
+func (db *DB) Optimistic(attempts int, fn func(o *OptimisticTx) error) error {
+	return db.retryOptimistic(false, attempts, fn)
+}
+
+// Serializable runs fn like Optimistic, in transactions of SerializableTx. A read failing with ErrConflict should be
+// returned by fn, to run it again.
+func (db *DB) Serializable(attempts int, fn func(o *OptimisticTx) error) error {
+	return db.retryOptimistic(true, attempts, fn)
+}
+
+func (db *DB) retryOptimistic(serializable bool, attempts int, fn func(o *OptimisticTx) error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		err = db.runOptimistic(serializable, i, fn)
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+func (db *DB) runOptimistic(serializable bool, retries int, fn func(o *OptimisticTx) error) error {
+	o, err := db.beginOptimistic(serializable)
+	if err != nil {
+		return err
+	}
+	o.retries = retries
+	defer o.Rollback()
+	err = fn(o)
+	if err != nil {
+		return err
+	}
+	return o.Commit()
+}
+
+// storedKey returns the key stored in the tree of the collection for a key.
+func (o *OptimisticTx) storedKey(collection []byte, key []byte) []byte {
+	transform := o.db.triggers.keyTransform(collection)
+	if transform == nil {
+		return key
+	}
+	return transform.Transform(key)
+}
+
+// Get returns a copy of the value of the key in the collection, or ErrKeyNotFound if the key or the collection doesn't
+// exist.
+func (o *OptimisticTx) Get(collection []byte, key []byte) ([]byte, error) {
+	if o.done {
+		return nil, ErrTxDone
+	}
+	storedKey := o.storedKey(collection, key)
+	o.collections[string(collection)] = true
+	if write := o.writes[string(collection)][string(storedKey)]; write != nil {
+		if write.remove {
+			return nil, ErrKeyNotFound
+		}
+		return append([]byte{}, write.value...), nil
+	}
+
+	keys := o.keys[string(collection)]
+	if keys == nil {
+		keys = map[string]bool{}
+		o.keys[string(collection)] = keys
+	}
+	keys[string(storedKey)] = true
+
+	var value []byte
+	err := o.db.View(func(tx *Tx) error {
+		// No commit happens during the read, so a key that wasn't written since the transaction began can't be now
+		if o.serializable && o.db.optimistic.conflicts(o) {
+			return ErrConflict
+		}
+		c, err := tx.GetCollection(collection)
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			return ErrKeyNotFound
+		}
+		value, err = c.Get(key)
+		return err
+	})
+	return value, err
+}
+
+// Scan calls fn with every key of the collection whose stored key starts with the prefix, in stored key order, like
+// Collection.Scan, with the writes of the transaction applied. The keys and values are only valid until fn returns.
+// fn runs in a read transaction, so it can Put and Remove with o but mustn't read with it or begin another
+// transaction of the file, which could wait for a write transaction waiting for the read transaction to end.
+func (o *OptimisticTx) Scan(collection []byte, prefix []byte, fn func(key, value []byte) error) error {
+	if o.done {
+		return ErrTxDone
+	}
+	o.collections[string(collection)] = true
+	o.prefixes[string(collection)] = append(o.prefixes[string(collection)], append([]byte{}, prefix...))
+
+	var pending []*optimisticWrite
+	for _, write := range o.writes[string(collection)] {
+		if bytes.HasPrefix(write.storedKey, prefix) {
+			pending = append(pending, write)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return bytes.Compare(pending[i].storedKey, pending[j].storedKey) < 0
+	})
+	// A scan returns the stored keys, unless the transform keeps the original keys
+	keyOf := func(write *optimisticWrite) []byte {
+		if transform := o.db.triggers.keyTransform(collection); transform != nil && !transform.KeepOriginal {
+			return write.storedKey
+		}
+		return write.key
+	}
+	// flush passes the writes ahead of the stored key, or up to and including it when through is set, to fn. All of
+	// them are passed when key is nil.
+	flush := func(key []byte, through bool) error {
+		for len(pending) > 0 {
+			if key != nil {
+				cmp := bytes.Compare(pending[0].storedKey, key)
+				if cmp > 0 || cmp == 0 && !through {
+					break
+				}
+			}
+			write := pending[0]
+			pending = pending[1:]
+			if write.remove {
+				continue
+			}
+			err := fn(keyOf(write), write.value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return o.db.View(func(tx *Tx) error {
+		if o.serializable && o.db.optimistic.conflicts(o) {
+			return ErrConflict
+		}
+		c, err := tx.GetCollection(collection)
+		if err != nil {
+			return err
+		}
+		if c != nil {
+			err = tx.rangeItems(c.root, prefixRange(prefix), func(item *Item) (bool, error) {
+				err := flush(item.key, false)
+				if err != nil {
+					return false, err
+				}
+				// A key written by the transaction is passed with its new value, or skipped if it was removed
+				if len(pending) > 0 && bytes.Equal(pending[0].storedKey, item.key) {
+					return true, flush(item.key, true)
+				}
+				resolved, err := c.resolveItem(item)
+				if err != nil {
+					return false, err
+				}
+				return true, fn(resolved.key, resolved.value)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return flush(nil, true)
+	})
+}
+
+// Put sets the value of the key in the collection on Commit, which creates the collection if it doesn't exist.
+func (o *OptimisticTx) Put(collection []byte, key []byte, value []byte) error {
+	return o.write(collection, key, append([]byte{}, value...), false)
+}
+
+// Remove removes the key from the collection on Commit. Removing a key that doesn't exist is a no-op.
+func (o *OptimisticTx) Remove(collection []byte, key []byte) error {
+	return o.write(collection, key, nil, true)
+}
+
+func (o *OptimisticTx) write(collection []byte, key []byte, value []byte, remove bool) error {
+	if o.done {
+		return ErrTxDone
+	}
+	err := o.db.checkItemSize(key, uint64(len(value)))
+	if err != nil {
+		return err
+	}
+	o.collections[string(collection)] = true
+	storedKey := o.storedKey(collection, key)
+	writes := o.writes[string(collection)]
+	if writes == nil {
+		writes = map[string]*optimisticWrite{}
+		o.writes[string(collection)] = writes
+	}
+	if write := writes[string(storedKey)]; write != nil {
+		write.key, write.value, write.remove = append([]byte{}, key...), value, remove
+		return nil
+	}
+	write := &optimisticWrite{
+		collection: append([]byte{}, collection...),
+		key:        append([]byte{}, key...),
+		storedKey:  append([]byte{}, storedKey...),
+		value:      value,
+		remove:     remove,
+	}
+	writes[string(storedKey)] = write
+	o.order = append(o.order, write)
+	return nil
+}
+
+// Commit validates the transaction and applies its writes in a write transaction, running the triggers and change
+// hooks of the collections. It fails with ErrConflict, writing nothing, if a transaction committed since it began
+// wrote a key it read, a key under a prefix it scanned, or created or deleted a collection it used. The transaction
+// is ended even if Commit fails.
+func (o *OptimisticTx) Commit() error {
+	if o.done {
+		return ErrTxDone
+	}
+	defer o.Rollback()
+	// A transaction that only read needs no write transaction, but the reads must still hold together
+	if len(o.order) == 0 {
+		if o.db.optimistic.conflicts(o) {
+			return ErrConflict
+		}
+		return nil
+	}
+	// A conflict found here is final for this attempt, so the write transaction never runs fn again
+	return o.db.update(func(tx *Tx) error {
+		if o.db.optimistic.conflicts(o) {
+			return ErrConflict
+		}
+		for _, write := range o.order {
+			if write.remove {
+				c, err := tx.GetCollection(write.collection)
+				if err != nil {
+					return err
+				}
+				if c == nil {
+					continue
+				}
+				err = c.Remove(write.key)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			c, err := tx.getOrCreateCollection(write.collection)
+			if err != nil {
+				return err
+			}
+			err = c.Put(write.key, write.value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Rollback ends the transaction, dropping its writes. It's a no-op once the transaction is ended.
+func (o *OptimisticTx) Rollback() {
+	if o.done {
+		return
+	}
+	o.done = true
+	o.db.optimistic.unregister(o.start)
+}
+
+// Attempt returns the number of the attempt DB.Optimistic or DB.Serializable is running the transaction for, starting
+// at 1. It's 1 for the transactions they don't run.
+func (o *OptimisticTx) Attempt() int {
+	return o.retries + 1
+}
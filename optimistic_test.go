@@ -0,0 +1,274 @@
+package gopherdb
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func putValue(t *testing.T, db *DB, collection string, key string, value string) {
+	t.Helper()
+	mustUpdate(t, db, func(tx *Tx) error {
+		return getOrCreate(t, tx, collection).Put([]byte(key), []byte(value))
+	})
+}
+
+func getValue(t *testing.T, db *DB, collection string, key string) string {
+	t.Helper()
+	var value []byte
+	mustView(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte(collection))
+		if err != nil || c == nil {
+			return err
+		}
+		value, err = c.Get([]byte(key))
+		if errors.Is(err, ErrKeyNotFound) {
+			return nil
+		}
+		return err
+	})
+	return string(value)
+}
+
+func TestOptimisticConflictOnReadKey(t *testing.T) {
+	db := openTestDB(t, nil)
+	putValue(t, db, "c", "k", "1")
+
+	o, err := db.OptimisticTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Get([]byte("c"), []byte("k")); err != nil {
+		t.Fatal(err)
+	}
+	putValue(t, db, "c", "k", "2")
+	if err := o.Put([]byte("c"), []byte("other"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Commit(); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Commit: got %v, want ErrConflict", err)
+	}
+	if got := getValue(t, db, "c", "other"); got != "" {
+		t.Errorf("the conflicting transaction wrote %q", got)
+	}
+	if err := o.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Errorf("second Commit: got %v, want ErrTxDone", err)
+	}
+}
+
+func TestOptimisticDisjointWritersCommit(t *testing.T) {
+	db := openTestDB(t, nil)
+	putValue(t, db, "c", "a", "0")
+	putValue(t, db, "c", "b", "0")
+
+	first, _ := db.OptimisticTx()
+	second, _ := db.OptimisticTx()
+	for _, write := range []struct {
+		o   *OptimisticTx
+		key string
+	}{{first, "a"}, {second, "b"}} {
+		if _, err := write.o.Get([]byte("c"), []byte(write.key)); err != nil {
+			t.Fatal(err)
+		}
+		if err := write.o.Put([]byte("c"), []byte(write.key), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := first.Commit(); err != nil {
+		t.Fatalf("first Commit: %v", err)
+	}
+	if err := second.Commit(); err != nil {
+		t.Fatalf("second Commit: %v", err)
+	}
+	if getValue(t, db, "c", "a") != "1" || getValue(t, db, "c", "b") != "1" {
+		t.Error("the writes of both transactions should be committed")
+	}
+}
+
+func TestOptimisticScanSeesOwnWrites(t *testing.T) {
+	db := openTestDB(t, nil)
+	for _, key := range []string{"p1", "p2", "p3", "q1"} {
+		putValue(t, db, "c", key, "old")
+	}
+	o, _ := db.OptimisticTx()
+	defer o.Rollback()
+	_ = o.Put([]byte("c"), []byte("p0"), []byte("new"))
+	_ = o.Put([]byte("c"), []byte("p2"), []byte("new"))
+	_ = o.Remove([]byte("c"), []byte("p3"))
+	var got []string
+	err := o.Scan([]byte("c"), []byte("p"), func(key, value []byte) error {
+		got = append(got, string(key)+"="+string(value))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[p0=new p1=old p2=new]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("Scan: got %v, want %s", got, want)
+	}
+}
+
+func TestOptimisticScanConflictsWithWriteUnderPrefix(t *testing.T) {
+	db := openTestDB(t, nil)
+	putValue(t, db, "c", "p1", "old")
+	o, _ := db.OptimisticTx()
+	_ = o.Scan([]byte("c"), []byte("p"), func(key, value []byte) error { return nil })
+	_ = o.Put([]byte("c"), []byte("sum"), []byte("1"))
+	putValue(t, db, "c", "p2", "new")
+	if err := o.Commit(); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Commit: got %v, want ErrConflict", err)
+	}
+}
+
+func TestOptimisticIgnoresWritesToNestedCollectionsOfTheSameName(t *testing.T) {
+	db := openTestDB(t, nil)
+	putValue(t, db, "x", "k", "1")
+	mustUpdate(t, db, func(tx *Tx) error {
+		_, err := getOrCreate(t, tx, "a").CreateCollection([]byte("x"))
+		return err
+	})
+
+	o, _ := db.OptimisticTx()
+	if _, err := o.Get([]byte("x"), []byte("k")); err != nil {
+		t.Fatal(err)
+	}
+	// The key k of the collection x nested in a isn't the key k of x
+	mustUpdate(t, db, func(tx *Tx) error {
+		nested, err := getOrCreate(t, tx, "a").GetCollection([]byte("x"))
+		if err != nil {
+			return err
+		}
+		return nested.Put([]byte("k"), []byte("nested"))
+	})
+	_ = o.Put([]byte("x"), []byte("k"), []byte("2"))
+	if err := o.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if got := getValue(t, db, "x", "k"); got != "2" {
+		t.Errorf("got %q, want the value of the optimistic transaction", got)
+	}
+}
+
+func TestOptimisticRetriesWithAttemptNumbers(t *testing.T) {
+	db := openTestDB(t, nil)
+	putValue(t, db, "c", "k", "0")
+	var attempts []int
+	err := db.Optimistic(3, func(o *OptimisticTx) error {
+		attempts = append(attempts, o.Attempt())
+		if _, err := o.Get([]byte("c"), []byte("k")); err != nil {
+			return err
+		}
+		if o.Attempt() == 1 {
+			// Another writer gets in between the read and the commit
+			putValue(t, db, "c", "k", "other")
+		}
+		return o.Put([]byte("c"), []byte("k"), []byte(fmt.Sprint(o.Attempt())))
+	})
+	if err != nil {
+		t.Fatalf("Optimistic: %v", err)
+	}
+	if fmt.Sprint(attempts) != "[1 2]" {
+		t.Errorf("attempts: got %v, want [1 2]", attempts)
+	}
+	if got := getValue(t, db, "c", "k"); got != "2" {
+		t.Errorf("k: got %q, want the write of the second attempt", got)
+	}
+}
+
+func TestOptimisticGivesUpAfterAttempts(t *testing.T) {
+	db := openTestDB(t, nil)
+	putValue(t, db, "c", "k", "0")
+	runs := 0
+	err := db.Optimistic(4, func(o *OptimisticTx) error {
+		runs++
+		if _, err := o.Get([]byte("c"), []byte("k")); err != nil {
+			return err
+		}
+		putValue(t, db, "c", "k", fmt.Sprint(runs))
+		return o.Put([]byte("c"), []byte("k"), []byte("mine"))
+	})
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("Optimistic: got %v, want ErrConflict", err)
+	}
+	if runs != 4 {
+		t.Errorf("fn ran %d times, want 4", runs)
+	}
+}
+
+func TestOptimisticDoesntRetryOtherErrors(t *testing.T) {
+	db := openTestDB(t, nil)
+	failure := errors.New("failure")
+	runs := 0
+	err := db.Optimistic(5, func(o *OptimisticTx) error {
+		runs++
+		return failure
+	})
+	if !errors.Is(err, failure) || runs != 1 {
+		t.Errorf("got %v after %d runs, want the error of fn after one run", err, runs)
+	}
+}
+
+func TestOptimisticConcurrentIncrements(t *testing.T) {
+	db := openTestDB(t, nil)
+	putValue(t, db, "c", "counter", "0")
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				err := db.Optimistic(1000, func(o *OptimisticTx) error {
+					value, err := o.Get([]byte("c"), []byte("counter"))
+					if err != nil {
+						return err
+					}
+					var n int
+					fmt.Sscan(string(value), &n)
+					return o.Put([]byte("c"), []byte("counter"), []byte(fmt.Sprint(n+1)))
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got := getValue(t, db, "c", "counter"); got != "40" {
+		t.Errorf("counter: got %s, want 40", got)
+	}
+}
+
+func TestSerializableReadConflict(t *testing.T) {
+	db := openTestDB(t, nil)
+	putValue(t, db, "c", "a", "1")
+	putValue(t, db, "c", "b", "1")
+	s, _ := db.SerializableTx()
+	defer s.Rollback()
+	if _, err := s.Get([]byte("c"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	putValue(t, db, "c", "b", "2")
+	if _, err := s.Get([]byte("c"), []byte("b")); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Get of a key written since the transaction began: got %v, want ErrConflict", err)
+	}
+}
+
+func TestSerializableWriteWriteConflict(t *testing.T) {
+	db := openTestDB(t, nil)
+	putValue(t, db, "c", "k", "0")
+	s, _ := db.SerializableTx()
+	o, _ := db.OptimisticTx()
+	_ = s.Put([]byte("c"), []byte("k"), []byte("s"))
+	_ = o.Put([]byte("c"), []byte("k"), []byte("o"))
+	putValue(t, db, "c", "k", "other")
+	if err := s.Commit(); !errors.Is(err, ErrConflict) {
+		t.Errorf("serializable blind write: got %v, want ErrConflict", err)
+	}
+	// Optimistic transactions only check what they read
+	if err := o.Commit(); err != nil {
+		t.Errorf("optimistic blind write: %v", err)
+	}
+}
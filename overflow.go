@@ -0,0 +1,318 @@
+package gopherdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Values that are bigger than the inline threshold of their collection aren't stored inside the node. Instead, they are
+// split across a chain of overflow pages and the node only holds a fixed size reference to the head of the chain. This
+// keeps nodes small, so lookups and key scans in blob-heavy collections touch fewer pages.
+//
+// Every overflow page starts with the page number of the next page in the chain (0 for the last page), followed by the
+// value bytes. The reference kept in the node holds the first page number and the total length of the value.
+
+type overflowRef struct {
+	first  pgnum
+	length uint64
+}
+
+func (r overflowRef) serialize() []byte {
+	buf := make([]byte, overflowRefSize)
+	binary.LittleEndian.PutUint64(buf, uint64(r.first))
+	binary.LittleEndian.PutUint64(buf[pageNumSize:], r.length)
+	return buf
+}
+
+func deserializeOverflowRef(buf []byte) overflowRef {
+	return overflowRef{
+		first:  pgnum(binary.LittleEndian.Uint64(buf)),
+		length: binary.LittleEndian.Uint64(buf[pageNumSize:]),
+	}
+}
+
+// overflowPageCapacity is the amount of value bytes a single overflow page can hold.
+func (tx *Tx) overflowPageCapacity() int {
+	return tx.db.pageSize - overflowPageHeaderSize
+}
+
+// allocatePage returns an empty page with a fresh page number. The page number is released on Rollback.
+func (tx *Tx) allocatePage() *page {
+	p := tx.db.allocateEmptyPage()
+	p.num = tx.db.getNextPage()
+	tx.allocatedPageNums = append(tx.allocatedPageNums, p.num)
+	return p
+}
+
+// writeOverflow reads length bytes from r into a newly allocated chain of overflow pages and returns a reference to it.
+// The pages are filled and written one at a time, so the value is never held in memory as a whole. Writing them before
+// Commit is safe since nothing references the freshly allocated pages until the item is added to the tree.
+func (tx *Tx) writeOverflow(r io.Reader, length uint64) (overflowRef, error) {
+	capacity := uint64(tx.overflowPageCapacity())
+	written := make([]pgnum, 0, (length+capacity-1)/capacity)
+
+	p := tx.allocatePage()
+	ref := overflowRef{first: p.num, length: length}
+	remaining := length
+	for {
+		chunk := remaining
+		if chunk > capacity {
+			chunk = capacity
+		}
+		_, err := io.ReadFull(r, p.data[overflowPageHeaderSize:overflowPageHeaderSize+chunk])
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			// The pages won't be referenced by the tree, so give them back even if the transaction commits
+			tx.pagesToDelete = append(tx.pagesToDelete, append(written, p.num)...)
+			return overflowRef{}, err
+		}
+		remaining -= chunk
+
+		var next *page
+		if remaining > 0 {
+			next = tx.allocatePage()
+			binary.LittleEndian.PutUint64(p.data, uint64(next.num))
+		}
+
+		err = tx.db.writePage(p)
+		if err != nil {
+			tx.pagesToDelete = append(tx.pagesToDelete, append(written, p.num)...)
+			return overflowRef{}, err
+		}
+		written = append(written, p.num)
+
+		if next == nil {
+			return ref, nil
+		}
+		p = next
+	}
+}
+
+// overflowReader reads a value from its chain of overflow pages, loading a single page at a time.
+type overflowReader struct {
+	tx        *Tx
+	next      pgnum
+	remaining uint64
+	buf       []byte
+	closed    bool
+}
+
+func newOverflowReader(tx *Tx, ref overflowRef) *overflowReader {
+	return &overflowReader{
+		tx:        tx,
+		next:      ref.first,
+		remaining: ref.length,
+	}
+}
+
+func (r *overflowReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, ErrReaderClosed
+	}
+	if len(r.buf) == 0 {
+		if r.remaining == 0 {
+			return 0, io.EOF
+		}
+		if r.next == 0 {
+			return 0, ErrOverflowChainTooShort
+		}
+		page, err := r.tx.db.readPage(r.next)
+		if err != nil {
+			return 0, err
+		}
+
+		chunk := page.data[overflowPageHeaderSize:]
+		if uint64(len(chunk)) > r.remaining {
+			chunk = chunk[:r.remaining]
+		}
+		r.remaining -= uint64(len(chunk))
+		r.next = pgnum(binary.LittleEndian.Uint64(page.data))
+		r.buf = chunk
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *overflowReader) Close() error {
+	r.closed = true
+	r.buf = nil
+	return nil
+}
+
+// readOverflow reassembles a value from its chain of overflow pages.
+func (tx *Tx) readOverflow(ref overflowRef) ([]byte, error) {
+	value := make([]byte, ref.length)
+	_, err := io.ReadFull(newOverflowReader(tx, ref), value)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// freeOverflow marks all the pages of the chain for deletion. The pages are released once the transaction commits.
+func (tx *Tx) freeOverflow(ref overflowRef) error {
+	pageNum := ref.first
+	for pageNum != 0 {
+		p, err := tx.db.readPage(pageNum)
+		if err != nil {
+			return err
+		}
+		tx.pagesToDelete = append(tx.pagesToDelete, pageNum)
+		pageNum = pgnum(binary.LittleEndian.Uint64(p.data))
+	}
+	return nil
+}
+
+// inlineThreshold returns the biggest value size that is stored inline in the nodes of the collection. The collection
+// threshold takes precedence over the database one. The root collection always keeps its records inline, since the
+// stats, the page walks and Doctor read them straight from its nodes.
+func (c *Collection) inlineThreshold() int {
+	if c.name == nil {
+		return maxInlineValueSize
+	}
+	threshold := c.tx.db.inlineValueThreshold
+	if c.inlineValueThreshold != 0 {
+		threshold = c.inlineValueThreshold
+	}
+	if threshold <= 0 || threshold > maxInlineValueSize {
+		threshold = maxInlineValueSize
+	}
+	return threshold
+}
+
+// newItem creates the item that is stored in the tree for the given key and value. Values above the inline threshold
+// are moved to overflow pages, and so are smaller values that would make the item too big for the nodes.
+func (c *Collection) newItem(key []byte, value []byte) (*Item, error) {
+	err := c.tx.db.checkItemSize(key, uint64(len(value)))
+	if err != nil {
+		return nil, err
+	}
+	if c.storesInline(key, len(value)) {
+		return newItem(key, value), nil
+	}
+	return c.newOverflowItem(key, bytes.NewReader(value), uint64(len(value)))
+}
+
+// storesInline reports whether a value of the given size is stored inside the node cell of the key.
+func (c *Collection) storesInline(key []byte, size int) bool {
+	return size <= c.inlineThreshold() && elementSizeOf(len(key), size) <= c.tx.db.maxElementSize()
+}
+
+func (c *Collection) newOverflowItem(key []byte, r io.Reader, length uint64) (*Item, error) {
+	err := c.tx.db.checkItemSize(key, length)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := c.tx.writeOverflow(r, length)
+	if err != nil {
+		return nil, err
+	}
+	item := newItem(key, ref.serialize())
+	item.overflow = true
+	return item, nil
+}
+
+// resolveItem returns the item with its full value, reading it from the overflow pages if needed. The value is
+// unwrapped from its envelopes, and the key is the original key if the key transform of the collection keeps it.
+func (c *Collection) resolveItem(item *Item) (*Item, error) {
+	item, _, err := c.resolveItemMeta(item)
+	return item, err
+}
+
+// resolveItemMeta resolves the item like resolveItem, and also returns the metadata of its envelope if it has one.
+func (c *Collection) resolveItemMeta(item *Item) (*Item, *ItemMeta, error) {
+	if item.overflow {
+		value, err := c.tx.readOverflow(deserializeOverflowRef(item.value))
+		if err != nil {
+			return nil, nil, err
+		}
+		resolved := newItem(item.key, value)
+		resolved.envelope = item.envelope
+		item = resolved
+	}
+
+	var meta *ItemMeta
+	if item.envelope {
+		var value []byte
+		var err error
+		meta, value, err = decodeEnvelope(item.value)
+		if err != nil {
+			return nil, nil, err
+		}
+		item = newItem(item.key, value)
+	}
+	item, err := c.originalItem(item)
+	if err != nil {
+		return nil, nil, err
+	}
+	return item, meta, nil
+}
+
+// freeItem releases the overflow pages of an item that is overwritten or removed from the tree.
+func (c *Collection) freeItem(item *Item) error {
+	if !item.overflow {
+		return nil
+	}
+	return c.tx.freeOverflow(deserializeOverflowRef(item.value))
+}
+
+// SetInlineThreshold sets the biggest value size (in bytes) that is stored inline in the collection nodes. Bigger values
+// are stored in overflow pages. Zero falls back to Options.InlineValueThreshold. The threshold is persisted with the
+// collection and applies to values written from now on; existing values are left where they are.
+func (c *Collection) SetInlineThreshold(threshold int) error {
+	if !c.tx.write {
+		return ErrWriteInsideReadTx
+	}
+	if threshold < 0 || threshold > maxInlineValueSize {
+		return ErrInvalidInlineThreshold
+	}
+	c.inlineValueThreshold = threshold
+	return c.save()
+}
+
+// ValuePlacementStats describes how the values of a collection are stored.
+type ValuePlacementStats struct {
+	InlineValues   uint64
+	OverflowValues uint64
+	InlineBytes    uint64
+	OverflowBytes  uint64
+}
+
+// OverflowRatio returns the fraction of the values that are stored in overflow pages.
+func (s *ValuePlacementStats) OverflowRatio() float64 {
+	total := s.InlineValues + s.OverflowValues
+	if total == 0 {
+		return 0
+	}
+	return float64(s.OverflowValues) / float64(total)
+}
+
+// ValuePlacement walks the collection and reports how many of its values are stored inline and how many in overflow
+// pages.
+func (c *Collection) ValuePlacement() (*ValuePlacementStats, error) {
+	stats := &ValuePlacementStats{}
+	err := c.tx.walk(c.root, func(n *Node) error {
+		for _, item := range n.items {
+			if item.collection {
+				continue
+			}
+			if item.overflow {
+				stats.OverflowValues++
+				stats.OverflowBytes += deserializeOverflowRef(item.value).length
+			} else {
+				stats.InlineValues++
+				stats.InlineBytes += uint64(len(item.value))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,175 @@
+package gopherdb
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// placement returns how the values of the collection are stored.
+func placement(t *testing.T, db *DB, name string) ValuePlacementStats {
+	t.Helper()
+	var stats *ValuePlacementStats
+	mustView(t, db, func(tx *Tx) error {
+		var err error
+		stats, err = getOrCreate(t, tx, name).ValuePlacement()
+		return err
+	})
+	return *stats
+}
+
+func TestInlineValueThreshold(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	options.InlineValueThreshold = 16
+	db := openTestPath(t, path, options)
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		if err := c.Put([]byte("inline"), bytes.Repeat([]byte("v"), 16)); err != nil {
+			return err
+		}
+		return c.Put([]byte("overflow"), bytes.Repeat([]byte("v"), 17))
+	})
+	want := ValuePlacementStats{InlineValues: 1, OverflowValues: 1, InlineBytes: 16, OverflowBytes: 17}
+	if got := placement(t, db, "c"); got != want {
+		t.Errorf("ValuePlacement: got %+v, want %+v", got, want)
+	}
+	if value := getValue(t, db, "c", "overflow"); value != string(bytes.Repeat([]byte("v"), 17)) {
+		t.Errorf("overflow value: got %q", value)
+	}
+
+	// Values that don't fit a node cell go to overflow pages whatever the threshold
+	big := bytes.Repeat([]byte("b"), 3*options.pageSize)
+	putValue(t, db, "c", "big", string(big))
+	if value := getValue(t, db, "c", "big"); value != string(big) {
+		t.Errorf("big value: got %d bytes, want %d", len(value), len(big))
+	}
+	// Overwriting and removing overflow values frees their pages
+	putValue(t, db, "c", "big", "small")
+	mustUpdate(t, db, func(tx *Tx) error {
+		return getOrCreate(t, tx, "c").Remove([]byte("overflow"))
+	})
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// Doctor reads the collection records straight from the root collection, which keeps them inline whatever the
+	// threshold
+	checkFile(t, path, options)
+}
+
+func TestSetInlineThreshold(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPath(t, path, nil)
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		if err := c.SetInlineThreshold(maxInlineValueSize + 1); !errors.Is(err, ErrInvalidInlineThreshold) {
+			t.Errorf("SetInlineThreshold above the maximum: got %v, want ErrInvalidInlineThreshold", err)
+		}
+		if err := c.SetInlineThreshold(-1); !errors.Is(err, ErrInvalidInlineThreshold) {
+			t.Errorf("SetInlineThreshold(-1): got %v, want ErrInvalidInlineThreshold", err)
+		}
+		return c.SetInlineThreshold(4)
+	})
+	mustView(t, db, func(tx *Tx) error {
+		if err := getOrCreate(t, tx, "c").SetInlineThreshold(8); !errors.Is(err, ErrWriteInsideReadTx) {
+			t.Errorf("SetInlineThreshold in a read transaction: got %v, want ErrWriteInsideReadTx", err)
+		}
+		return nil
+	})
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// The threshold is persisted with the collection, and only applies to it
+	db = openTestPath(t, path, nil)
+	putValue(t, db, "c", "k", "12345")
+	putValue(t, db, "other", "k", "12345")
+	if got := placement(t, db, "c"); got.OverflowValues != 1 {
+		t.Errorf("ValuePlacement of the collection with a threshold of 4: got %+v, want one overflow value", got)
+	}
+	if got := placement(t, db, "other"); got.InlineValues != 1 {
+		t.Errorf("ValuePlacement of the collection without a threshold: got %+v, want one inline value", got)
+	}
+}
+
+func TestOverflowRatio(t *testing.T) {
+	stats := ValuePlacementStats{InlineValues: 3, OverflowValues: 1}
+	if ratio := stats.OverflowRatio(); ratio != 0.25 {
+		t.Errorf("OverflowRatio: got %v, want 0.25", ratio)
+	}
+	if ratio := (&ValuePlacementStats{}).OverflowRatio(); ratio != 0 {
+		t.Errorf("OverflowRatio of an empty collection: got %v, want 0", ratio)
+	}
+}
+
+func TestPutFromAndNewValueReaderStreamValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	db := openTestPath(t, path, options)
+	value := make([]byte, 20*options.pageSize+123)
+	for i := range value {
+		value[i] = byte(i % 251)
+	}
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		if err := c.PutFrom([]byte("big"), bytes.NewReader(value), int64(len(value))); err != nil {
+			return err
+		}
+		if err := c.PutFrom([]byte("small"), strings.NewReader("small"), 5); err != nil {
+			return err
+		}
+		// A reader that ends early fails the put, and its pages are given back
+		err := c.PutFrom([]byte("short"), bytes.NewReader(value[:3*options.pageSize]), int64(len(value)))
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("PutFrom of a short reader: got %v, want io.ErrUnexpectedEOF", err)
+		}
+		return nil
+	})
+
+	mustView(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for key, want := range map[string][]byte{"big": value, "small": []byte("small")} {
+			r, err := c.NewValueReader([]byte(key))
+			if err != nil {
+				return err
+			}
+			// Reads smaller than a page go through the page buffer of the reader
+			got, err := io.ReadAll(iotest.OneByteReader(r))
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: read %d bytes that don't match the %d bytes put", key, len(got), len(want))
+			}
+			if err := r.Close(); err != nil {
+				return err
+			}
+		}
+		if _, err := c.NewValueReader([]byte("short")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("NewValueReader of the failed put: got %v, want ErrKeyNotFound", err)
+		}
+		return nil
+	})
+
+	mustView(t, db, func(tx *Tx) error {
+		r, err := getOrCreate(t, tx, "c").NewValueReader([]byte("big"))
+		if err != nil {
+			return err
+		}
+		if err := r.Close(); err != nil {
+			return err
+		}
+		if _, err := r.Read(make([]byte, 1)); !errors.Is(err, ErrReaderClosed) {
+			t.Errorf("Read after Close: got %v, want ErrReaderClosed", err)
+		}
+		return nil
+	})
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	checkFile(t, path, options)
+}
@@ -0,0 +1,310 @@
+package gopherdb
+
+import "encoding/binary"
+
+// The page API gives embedders direct access to the pages of the pager, to build their own structures next to the
+// collections, like secondary indexes. Pages are taken with AllocatePage, written with WritePage and given back with
+// FreePage, all within write transactions, and are only known to the embedder: it must keep the numbers of its pages
+// somewhere, typically in a collection, since a page that's neither free nor used by a tree is leaked otherwise.
+//
+// The pages of the trees, the meta page and the freelist page can be viewed but not written or freed, which could
+// corrupt the trees, and WritePage and FreePage check for it.
+
+// PageView is a copy of a page, taken by ViewPage. The page stays pinned until Unpin: no transaction can write it with
+// WritePage or free it, and a page of a tree freed while pinned isn't reused until it's unpinned, or until the file is
+// opened again, since views don't outlive the process. Pinning doesn't stop the trees from rewriting their own pages
+// on Commit, so the view of a tree page is the page as it was when viewed.
+type PageView struct {
+	num  pgnum
+	data []byte
+	d    *dal
+}
+
+// Num returns the number of the page.
+func (v *PageView) Num() uint64 {
+	return uint64(v.num)
+}
+
+// Data returns the content of the page. It must not be modified.
+func (v *PageView) Data() []byte {
+	return v.data
+}
+
+// Unpin unpins the page. Calling it again does nothing.
+func (v *PageView) Unpin() {
+	if v.d == nil {
+		return
+	}
+	v.d.unpin(v.num)
+	v.d = nil
+}
+
+// PageSize returns the size of the pages of the file.
+func (tx *Tx) PageSize() int {
+	return tx.db.pageSize
+}
+
+// ViewPage returns a pinned view of the page, as seen by the transaction.
+func (tx *Tx) ViewPage(num uint64) (*PageView, error) {
+	pageNum := pgnum(num)
+	if pageNum > tx.fileState().maxPage {
+		return nil, ErrPageOutOfRange
+	}
+	data, ok := tx.pageWrites[pageNum]
+	if !ok {
+		p, err := tx.db.readPage(pageNum)
+		if err != nil {
+			return nil, err
+		}
+		data = p.data
+	}
+	tx.db.pin(pageNum)
+	return &PageView{num: pageNum, data: append([]byte{}, data...), d: tx.db.dal}, nil
+}
+
+// AllocatePage takes a page from the freelist or the end of the file for the embedder. The page is given back if the
+// transaction is rolled back.
+func (tx *Tx) AllocatePage() (uint64, error) {
+	if !tx.write {
+		return 0, ErrWriteInsideReadTx
+	}
+	pageNum := tx.db.getNextPage()
+	tx.allocatedPageNums = append(tx.allocatedPageNums, pageNum)
+	if tx.userPages == nil {
+		tx.userPages = map[pgnum]bool{}
+	}
+	tx.userPages[pageNum] = true
+	return uint64(pageNum), nil
+}
+
+// WritePage writes the data to the page on Commit, padded with zeros to the page size. The page must be one of the
+// embedder, taken with AllocatePage in this or an earlier transaction and not freed. Pages of the embedder are written
+// in place, so read transactions running during the commit can read them half written.
+func (tx *Tx) WritePage(num uint64, data []byte) error {
+	if !tx.write {
+		return ErrWriteInsideReadTx
+	}
+	if len(data) > tx.db.pageSize {
+		return ErrPageTooLarge
+	}
+	pageNum := pgnum(num)
+	err := tx.checkUserPage(pageNum)
+	if err != nil {
+		return err
+	}
+	if tx.pageWrites == nil {
+		tx.pageWrites = map[pgnum][]byte{}
+	}
+	tx.pageWrites[pageNum] = append([]byte{}, data...)
+	return nil
+}
+
+// FreePage gives a page of the embedder back to the freelist on Commit.
+func (tx *Tx) FreePage(num uint64) error {
+	if !tx.write {
+		return ErrWriteInsideReadTx
+	}
+	pageNum := pgnum(num)
+	err := tx.checkUserPage(pageNum)
+	if err != nil {
+		return err
+	}
+	delete(tx.pageWrites, pageNum)
+	delete(tx.userPages, pageNum)
+	tx.pagesToDelete = append(tx.pagesToDelete, pageNum)
+	return nil
+}
+
+// checkUserPage returns an error if the page can't belong to the embedder. Pages taken by the transaction itself are
+// the embedder's if they came from AllocatePage. Other pages were taken by earlier transactions, so they're the
+// embedder's if the committed trees don't use them and they aren't free.
+func (tx *Tx) checkUserPage(pageNum pgnum) error {
+	if tx.db.pinned(pageNum) {
+		return ErrPagePinned
+	}
+	if tx.userPages[pageNum] {
+		return nil
+	}
+	if tx.db.isReserved(pageNum) || pageNum > tx.db.maxPage {
+		return ErrPageReserved
+	}
+	for _, pages := range [][]pgnum{tx.allocatedPageNums, tx.pagesToDelete} {
+		for _, other := range pages {
+			if other == pageNum {
+				return ErrPageReserved
+			}
+		}
+	}
+	// The free pages only change on Commit, or to go to allocatedPageNums
+	if tx.freePages == nil {
+		tx.freePages = make(map[pgnum]bool, len(tx.db.releasedPages)+len(tx.db.heldPages))
+		for _, pages := range [][]pgnum{tx.db.releasedPages, tx.db.heldPages} {
+			for _, free := range pages {
+				tx.freePages[free] = true
+			}
+		}
+	}
+	if tx.freePages[pageNum] {
+		return ErrPageReserved
+	}
+
+	if tx.committedPages == nil {
+		pages, err := tx.readCommittedPages()
+		if err != nil {
+			return err
+		}
+		tx.committedPages = pages
+	}
+	if tx.committedPages[pageNum] {
+		return ErrPageReserved
+	}
+	return nil
+}
+
+// readCommittedPages returns the pages used by the committed trees: their nodes and overflow pages. Nodes are read
+// from the file, since the dirty nodes of the transaction are only written on Commit, and the pages the transaction
+// takes for the trees are in allocatedPageNums.
+func (tx *Tx) readCommittedPages() (map[pgnum]bool, error) {
+	pages := map[pgnum]bool{}
+	if tx.db.root == 0 {
+		return pages, nil
+	}
+	return pages, tx.readTreePages(tx.db.root, pages)
+}
+
+// readTreePages adds the pages used by the trees of the root collection at root to pages. The subtrees of pages
+// already in it are skipped, so the trees of several commits, which share most of their pages, are read once.
+func (tx *Tx) readTreePages(root pgnum, pages map[pgnum]bool) error {
+	return tx.readNodePages(root, true, pages)
+}
+
+// readNodePages adds the pages of the subtree at pageNum to pages, along with the pages of the trees of its collections
+// if it's part of the tree of the root collection.
+func (tx *Tx) readNodePages(pageNum pgnum, collections bool, pages map[pgnum]bool) error {
+	var walk func(pageNum pgnum, collections bool) error
+	walk = func(pageNum pgnum, collections bool) error {
+		if pages[pageNum] {
+			return nil
+		}
+		node, err := tx.db.getNode(pageNum)
+		if err != nil {
+			return err
+		}
+		pages[pageNum] = true
+		for _, item := range node.items {
+			if collections {
+				collection := newEmptyCollection()
+				collection.deserialize(item)
+				err = walk(collection.root, false)
+			} else if item.overflow {
+				err = tx.readOverflowPages(deserializeOverflowRef(item.value), pages)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for _, child := range node.childNodes {
+			err = walk(child, collections)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(pageNum, collections)
+}
+
+func (tx *Tx) readOverflowPages(ref overflowRef, pages map[pgnum]bool) error {
+	pageNum := ref.first
+	for pageNum != 0 {
+		p, err := tx.db.readPage(pageNum)
+		if err != nil {
+			return err
+		}
+		pages[pageNum] = true
+		pageNum = pgnum(binary.LittleEndian.Uint64(p.data))
+	}
+	return nil
+}
+
+// writeUserPages writes the pages written with WritePage.
+func (tx *Tx) writeUserPages() error {
+	for pageNum, data := range tx.pageWrites {
+		p := tx.db.allocateEmptyPage()
+		p.num = pageNum
+		copy(p.data, data)
+		err := tx.db.writePage(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dal) pin(pageNum pgnum) {
+	d.pinMu.Lock()
+	defer d.pinMu.Unlock()
+	if d.pins == nil {
+		d.pins = map[pgnum]int{}
+	}
+	d.pins[pageNum]++
+}
+
+func (d *dal) unpin(pageNum pgnum) {
+	d.pinMu.Lock()
+	defer d.pinMu.Unlock()
+	d.pins[pageNum]--
+	if d.pins[pageNum] <= 0 {
+		delete(d.pins, pageNum)
+	}
+}
+
+// anyHeld reports whether releaseUnpinned would hold back any of the pages freed by the commit txid.
+func (d *dal) anyHeld(pages []pgnum, txid uint64) bool {
+	d.pinMu.Lock()
+	defer d.pinMu.Unlock()
+	if len(pages) > 0 && d.readsBefore(txid) {
+		return true
+	}
+	for _, pageNum := range pages {
+		if d.pins[pageNum] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *dal) pinned(pageNum pgnum) bool {
+	d.pinMu.Lock()
+	defer d.pinMu.Unlock()
+	return d.pins[pageNum] > 0
+}
+
+// releaseUnpinned releases the pages freed by the commit txid into the freelist, holding back the pinned ones and the
+// ones read transactions of earlier commits can read, and releases the pages held back by earlier commits that no
+// longer need to be. The pages of the commit it releases are kept in unpublished, see publishState.
+func (d *dal) releaseUnpinned(pages []pgnum, txid uint64) {
+	d.pinMu.Lock()
+	defer d.pinMu.Unlock()
+	if d.freedBy == nil {
+		d.freedBy = map[pgnum]uint64{}
+	}
+	for _, pageNum := range pages {
+		d.freedBy[pageNum] = txid
+	}
+	var held []pgnum
+	for _, list := range [][]pgnum{d.heldPages, pages} {
+		for _, pageNum := range list {
+			if d.pins[pageNum] > 0 || d.readsBefore(d.freedBy[pageNum]) {
+				held = append(held, pageNum)
+				continue
+			}
+			if d.freedBy[pageNum] == txid {
+				d.unpublished = append(d.unpublished, pageNum)
+			}
+			delete(d.freedBy, pageNum)
+			d.deleteNode(pageNum)
+		}
+	}
+	d.heldPages = held
+}
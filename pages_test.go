@@ -0,0 +1,119 @@
+package gopherdb
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestPagesHeldByViewsAreFreeAfterReopening(t *testing.T) {
+	for _, journal := range []bool{false, true} {
+		for _, crash := range []bool{false, true} {
+			t.Run(fmt.Sprintf("JournalFreelist=%v,crash=%v", journal, crash), func(t *testing.T) {
+				path := filepath.Join(t.TempDir(), "test.db")
+				options := testOptions()
+				options.JournalFreelist = journal
+				db := openTestPath(t, path, options)
+				putValue(t, db, "c", "k", "v1")
+
+				var view *PageView
+				mustView(t, db, func(tx *Tx) error {
+					c := getOrCreate(t, tx, "c")
+					var err error
+					view, err = tx.ViewPage(uint64(c.root))
+					return err
+				})
+				// The commit frees the viewed leaf, which is held instead of released
+				putValue(t, db, "c", "k", "v2")
+				if len(db.heldPages) != 1 || db.heldPages[0] != view.num {
+					t.Fatalf("held pages: got %v, want [%d]", db.heldPages, view.num)
+				}
+				for _, pageNum := range db.releasedPages {
+					if pageNum == view.num {
+						t.Fatalf("the viewed page %d is free", view.num)
+					}
+				}
+
+				// The view dies with the handle, without being unpinned
+				if crash {
+					if err := db.abandon(); err != nil {
+						t.Fatalf("abandon: %v", err)
+					}
+				} else if err := db.Close(); err != nil {
+					t.Fatalf("Close: %v", err)
+				}
+				checkFile(t, path, options)
+				db = openTestPath(t, path, options)
+				free := false
+				for _, pageNum := range db.releasedPages {
+					free = free || pageNum == view.num
+				}
+				if !free {
+					t.Errorf("the page held by the view isn't free after reopening: %v", db.releasedPages)
+				}
+				if got := getValue(t, db, "c", "k"); got != "v2" {
+					t.Errorf("k: got %q, want v2", got)
+				}
+			})
+		}
+	}
+}
+
+func TestUnpinnedPagesAreReleased(t *testing.T) {
+	db := openTestDB(t, nil)
+	putValue(t, db, "c", "k", "v1")
+	var view *PageView
+	mustView(t, db, func(tx *Tx) error {
+		var err error
+		view, err = tx.ViewPage(uint64(getOrCreate(t, tx, "c").root))
+		return err
+	})
+	putValue(t, db, "c", "k", "v2")
+	view.Unpin()
+	putValue(t, db, "c", "k", "v3")
+	if len(db.heldPages) != 0 || db.heldWritten {
+		t.Errorf("after unpinning: held pages %v, written %v", db.heldPages, db.heldWritten)
+	}
+	free := false
+	for _, pageNum := range db.releasedPages {
+		free = free || pageNum == view.num
+	}
+	if !free {
+		t.Errorf("the unpinned page %d isn't free: %v", view.num, db.releasedPages)
+	}
+}
+
+func TestUserPagesMustNotBeFree(t *testing.T) {
+	db := openTestDB(t, nil)
+	var num uint64
+	mustUpdate(t, db, func(tx *Tx) error {
+		var err error
+		num, err = tx.AllocatePage()
+		if err != nil {
+			return err
+		}
+		return tx.WritePage(num, []byte("data"))
+	})
+	mustUpdate(t, db, func(tx *Tx) error {
+		return tx.FreePage(num)
+	})
+
+	mustUpdate(t, db, func(tx *Tx) error {
+		if err := tx.WritePage(num, []byte("data")); !errors.Is(err, ErrPageReserved) {
+			t.Errorf("WritePage of a free page: got %v, want ErrPageReserved", err)
+		}
+		if err := tx.FreePage(num); !errors.Is(err, ErrPageReserved) {
+			t.Errorf("FreePage of a free page: got %v, want ErrPageReserved", err)
+		}
+		// Taken again, the page is the embedder's
+		again, err := tx.AllocatePage()
+		if err != nil {
+			return err
+		}
+		if again != num {
+			t.Fatalf("AllocatePage: got page %d, want the free page %d", again, num)
+		}
+		return tx.WritePage(again, []byte("again"))
+	})
+}
@@ -0,0 +1,56 @@
+package gopherdb
+
+import (
+	"sync"
+	"time"
+)
+
+// periodic runs a function every interval in a background goroutine, until it's stopped. The runs go through the
+// background of the file, see background.go. The zero value is ready to use.
+type periodic struct {
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// start starts running fn as the task of the given name. Starting an already running periodic does nothing.
+func (p *periodic) start(db *DB, name string, interval time.Duration, fn func() error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	p.stop, p.done = stop, done
+	b := db.background
+	task := &backgroundTask{name: name, interval: interval, fn: fn}
+	b.add(task)
+	go func() {
+		defer close(done)
+		defer b.remove(task)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				b.run(task)
+			}
+		}
+	}()
+}
+
+// halt stops the background goroutine and waits for a running fn to return.
+func (p *periodic) halt() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.stop, p.done = nil, nil
+}
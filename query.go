@@ -0,0 +1,415 @@
+package gopherdb
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// planProbeLimit caps the number of entries the planner counts when estimating how many rows an access path returns.
+// Estimates above it are reported as planProbeLimit, which is enough to tell a selective path from a broad one.
+const planProbeLimit = 1000
+
+// Index is a user-maintained secondary index over a collection. The index is stored in its own collection and maps
+// every term extracted from an item to the item's primary key. The extract function returns the terms of an item; it's
+// used by Update to maintain the entries and by the planner to check predicates that aren't used for the lookup.
+//
+// Index keys are made of the escaped term, a terminator and the primary key, so several items can share a term while
+// the keys keep the order of the terms.
+type Index struct {
+	name    []byte
+	extract func(key, value []byte) [][]byte
+}
+
+// NewIndex returns an index stored in the given collection name.
+func NewIndex(name string, extract func(key, value []byte) [][]byte) *Index {
+	return &Index{
+		name:    []byte(name),
+		extract: extract,
+	}
+}
+
+// encodeIndexTerm escapes the zero bytes of the term and appends a terminator. Escaping keeps the encoded terms in the
+// same order as the terms themselves, even when a term is the prefix of another.
+func encodeIndexTerm(term []byte) []byte {
+	encoded := make([]byte, 0, len(term)+2)
+	for _, b := range term {
+		if b == 0 {
+			encoded = append(encoded, 0, 0xff)
+			continue
+		}
+		encoded = append(encoded, b)
+	}
+	return append(encoded, 0, 1)
+}
+
+func encodeIndexKey(term []byte, primaryKey []byte) []byte {
+	return append(encodeIndexTerm(term), primaryKey...)
+}
+
+func (idx *Index) collection(tx *Tx, create bool) (*Collection, error) {
+	if create {
+		return tx.getOrCreateCollection(idx.name)
+	}
+	return tx.GetCollection(idx.name)
+}
+
+// Add adds an index entry mapping the term to the primary key.
+func (idx *Index) Add(tx *Tx, term []byte, primaryKey []byte) error {
+	if !tx.write {
+		return ErrWriteInsideReadTx
+	}
+	collection, err := idx.collection(tx, true)
+	if err != nil {
+		return err
+	}
+	return collection.Put(encodeIndexKey(term, primaryKey), primaryKey)
+}
+
+// Remove removes the index entry mapping the term to the primary key.
+func (idx *Index) Remove(tx *Tx, term []byte, primaryKey []byte) error {
+	if !tx.write {
+		return ErrWriteInsideReadTx
+	}
+	collection, err := idx.collection(tx, false)
+	if err != nil || collection == nil {
+		return err
+	}
+	return collection.Remove(encodeIndexKey(term, primaryKey))
+}
+
+// Update replaces the index entries of an item whose value changed from oldValue to newValue. A nil oldValue means the
+// item was created and a nil newValue means it was removed.
+func (idx *Index) Update(tx *Tx, key []byte, oldValue []byte, newValue []byte) error {
+	if oldValue != nil {
+		for _, term := range idx.extract(key, oldValue) {
+			err := idx.Remove(tx, term, key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if newValue != nil {
+		for _, term := range idx.extract(key, newValue) {
+			err := idx.Add(tx, term, key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// matches checks if any of the item terms is inside the range.
+func (idx *Index) matches(key []byte, value []byte, r KeyRange) bool {
+	for _, term := range idx.extract(key, value) {
+		if r.contains(term) {
+			return true
+		}
+	}
+	return false
+}
+
+// AccessMethod is the way a query reads its candidate rows.
+type AccessMethod int
+
+const (
+	// FullScan reads the whole collection.
+	FullScan AccessMethod = iota
+	// PrimaryRangeScan reads a range of the collection keys.
+	PrimaryRangeScan
+	// IndexScan reads a range of an index and looks up the matching items in the collection.
+	IndexScan
+)
+
+func (m AccessMethod) String() string {
+	switch m {
+	case PrimaryRangeScan:
+		return "PRIMARY RANGE SCAN"
+	case IndexScan:
+		return "INDEX SCAN"
+	default:
+		return "FULL SCAN"
+	}
+}
+
+type predicate struct {
+	index *Index
+	r     KeyRange
+}
+
+func (p predicate) String() string {
+	name := "primary key"
+	if p.index != nil {
+		name = string(p.index.name)
+	}
+	return fmt.Sprintf("%s in %s", name, formatRange(p.r))
+}
+
+func formatRange(r KeyRange) string {
+	start, end := "-inf", "+inf"
+	if r.Start != nil {
+		start = fmt.Sprintf("%q", r.Start)
+	}
+	if r.End != nil {
+		end = fmt.Sprintf("%q", r.End)
+	}
+	return fmt.Sprintf("[%s, %s)", start, end)
+}
+
+// Query describes a read over a collection with any number of range predicates on the primary key or on indexes. The
+// planner picks the predicate with the fewest estimated rows as the access path and checks the others on every
+// candidate row.
+type Query struct {
+	c          *Collection
+	predicates []predicate
+	filters    []func(key, value []byte) bool
+	limit      int
+}
+
+// Query starts a query over the collection.
+func (c *Collection) Query() *Query {
+	return &Query{c: c}
+}
+
+// Where restricts the query to the items whose index terms are inside the range. A nil index restricts the primary
+// key instead.
+func (q *Query) Where(index *Index, r KeyRange) *Query {
+	q.predicates = append(q.predicates, predicate{index: index, r: r})
+	return q
+}
+
+// Filter restricts the query to the items the function accepts. Filters are never used as an access path.
+func (q *Query) Filter(fn func(key, value []byte) bool) *Query {
+	q.filters = append(q.filters, fn)
+	return q
+}
+
+// Limit stops the query after n items. Zero means no limit.
+func (q *Query) Limit(n int) *Query {
+	q.limit = n
+	return q
+}
+
+// PlanCandidate is an access path the planner considered, with its estimated number of rows.
+type PlanCandidate struct {
+	Access        AccessMethod
+	Index         string
+	Range         KeyRange
+	EstimatedRows int
+}
+
+func (c PlanCandidate) String() string {
+	estimate := fmt.Sprintf("%d", c.EstimatedRows)
+	if c.EstimatedRows >= planProbeLimit {
+		estimate += "+"
+	}
+	switch c.Access {
+	case IndexScan:
+		return fmt.Sprintf("%s %s %s (est. rows %s)", c.Access, c.Index, formatRange(c.Range), estimate)
+	case PrimaryRangeScan:
+		return fmt.Sprintf("%s %s (est. rows %s)", c.Access, formatRange(c.Range), estimate)
+	default:
+		return fmt.Sprintf("%s (est. rows %s)", c.Access, estimate)
+	}
+}
+
+// QueryPlan is the plan chosen for a query, as returned by Explain.
+type QueryPlan struct {
+	PlanCandidate
+
+	// Residual holds the predicates checked on every row read through the access path.
+	Residual   []string
+	Filters    int
+	Limit      int
+	Considered []PlanCandidate
+
+	chosen   int
+	index    *Index
+	residual []predicate
+}
+
+func (p *QueryPlan) String() string {
+	var sb strings.Builder
+	sb.WriteString(p.PlanCandidate.String())
+	for _, residual := range p.Residual {
+		fmt.Fprintf(&sb, "\n  residual: %s", residual)
+	}
+	if p.Filters > 0 {
+		fmt.Fprintf(&sb, "\n  filters: %d", p.Filters)
+	}
+	if p.Limit > 0 {
+		fmt.Fprintf(&sb, "\n  limit: %d", p.Limit)
+	}
+	for i, candidate := range p.Considered {
+		if i != p.chosen {
+			fmt.Fprintf(&sb, "\n  rejected: %s", candidate)
+		}
+	}
+	return sb.String()
+}
+
+// estimate counts the rows of the range, stopping at planProbeLimit.
+func estimate(tx *Tx, root pgnum, r KeyRange) (int, error) {
+	count := 0
+	err := tx.rangeItems(root, r, func(*Item) (bool, error) {
+		count++
+		return count < planProbeLimit, nil
+	})
+	return count, err
+}
+
+func indexRange(r KeyRange) KeyRange {
+	var encoded KeyRange
+	if r.Start != nil {
+		encoded.Start = encodeIndexTerm(r.Start)
+	}
+	if r.End != nil {
+		encoded.End = encodeIndexTerm(r.End)
+	}
+	return encoded
+}
+
+// Explain returns the plan the query runs with.
+func (q *Query) Explain() (*QueryPlan, error) {
+	tx := q.c.tx
+
+	// All the primary key predicates are merged into a single range
+	primary := KeyRange{}
+	hasPrimary := false
+	var indexPredicates []predicate
+	for _, p := range q.predicates {
+		if p.index != nil {
+			indexPredicates = append(indexPredicates, p)
+			continue
+		}
+		hasPrimary = true
+		if p.r.Start != nil && (primary.Start == nil || bytes.Compare(p.r.Start, primary.Start) > 0) {
+			primary.Start = p.r.Start
+		}
+		if p.r.End != nil && (primary.End == nil || bytes.Compare(p.r.End, primary.End) < 0) {
+			primary.End = p.r.End
+		}
+	}
+
+	plan := &QueryPlan{Filters: len(q.filters), Limit: q.limit}
+	rows, err := estimate(tx, q.c.root, primary)
+	if err != nil {
+		return nil, err
+	}
+	access := FullScan
+	if hasPrimary {
+		access = PrimaryRangeScan
+	}
+	plan.Considered = append(plan.Considered, PlanCandidate{Access: access, Range: primary, EstimatedRows: rows})
+
+	for _, p := range indexPredicates {
+		rows := 0
+		collection, err := p.index.collection(tx, false)
+		if err != nil {
+			return nil, err
+		}
+		if collection != nil {
+			rows, err = estimate(tx, collection.root, indexRange(p.r))
+			if err != nil {
+				return nil, err
+			}
+		}
+		plan.Considered = append(plan.Considered, PlanCandidate{
+			Access:        IndexScan,
+			Index:         string(p.index.name),
+			Range:         p.r,
+			EstimatedRows: rows,
+		})
+	}
+
+	// Prefer the primary path on ties, since it doesn't need a lookup per row
+	for i, candidate := range plan.Considered {
+		if candidate.EstimatedRows < plan.Considered[plan.chosen].EstimatedRows {
+			plan.chosen = i
+		}
+	}
+	plan.PlanCandidate = plan.Considered[plan.chosen]
+	if plan.chosen != 0 {
+		plan.index = indexPredicates[plan.chosen-1].index
+	}
+
+	if plan.chosen != 0 && hasPrimary {
+		plan.residual = append(plan.residual, predicate{r: primary})
+	}
+	for i, p := range indexPredicates {
+		if i+1 != plan.chosen {
+			plan.residual = append(plan.residual, p)
+		}
+	}
+	for _, p := range plan.residual {
+		plan.Residual = append(plan.Residual, p.String())
+	}
+	return plan, nil
+}
+
+// Run executes the query and calls fn for every matching item, in the order of the access path. Returning an error
+// from fn stops the query and the error is returned.
+func (q *Query) Run(fn func(key, value []byte) error) error {
+	plan, err := q.Explain()
+	if err != nil {
+		return err
+	}
+
+	returned := 0
+	emit := func(key []byte, value []byte) (bool, error) {
+		for _, p := range plan.residual {
+			if p.index == nil && !p.r.contains(key) {
+				return true, nil
+			}
+			if p.index != nil && !p.index.matches(key, value, p.r) {
+				return true, nil
+			}
+		}
+		for _, filter := range q.filters {
+			if !filter(key, value) {
+				return true, nil
+			}
+		}
+		err := fn(key, value)
+		if err != nil {
+			return false, err
+		}
+		returned++
+		return q.limit == 0 || returned < q.limit, nil
+	}
+
+	if plan.Access != IndexScan {
+		return q.c.tx.rangeItems(q.c.root, plan.Range, func(item *Item) (bool, error) {
+			item, err := q.c.resolveItem(item)
+			if err != nil {
+				return false, err
+			}
+			return emit(item.key, item.value)
+		})
+	}
+
+	collection, err := plan.index.collection(q.c.tx, false)
+	if err != nil || collection == nil {
+		return err
+	}
+
+	// An item is found once for every term it has in the range
+	seen := map[string]struct{}{}
+	return q.c.tx.rangeItems(collection.root, indexRange(plan.Range), func(entry *Item) (bool, error) {
+		if _, ok := seen[string(entry.value)]; ok {
+			return true, nil
+		}
+		seen[string(entry.value)] = struct{}{}
+
+		item, err := q.c.Find(entry.value)
+		if err != nil {
+			return false, err
+		}
+		// The index is maintained by the user, so it may point to items that don't exist anymore
+		if item == nil {
+			return true, nil
+		}
+		return emit(item.key, item.value)
+	})
+}
@@ -0,0 +1,137 @@
+package gopherdb
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// cityIndex indexes users by the city stored in their value.
+var cityIndex = NewIndex("users.by_city", func(key, value []byte) [][]byte {
+	return [][]byte{value}
+})
+
+func putUsers(t *testing.T, db *DB) {
+	t.Helper()
+	mustUpdate(t, db, func(tx *Tx) error {
+		users := getOrCreate(t, tx, "users")
+		for i := 0; i < 200; i++ {
+			city := []byte("berlin")
+			if i%20 == 0 {
+				city = []byte("paris")
+			}
+			key := []byte(fmt.Sprintf("user%03d", i))
+			if err := users.Put(key, city); err != nil {
+				return err
+			}
+			if err := cityIndex.Update(tx, key, nil, city); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func runQuery(t *testing.T, q *Query) []string {
+	t.Helper()
+	var keys []string
+	if err := q.Run(func(key, value []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	return keys
+}
+
+func TestQueryPicksTheMostSelectivePath(t *testing.T) {
+	db := openTestDB(t, nil)
+	putUsers(t, db)
+	paris := KeyRange{Start: []byte("paris"), End: []byte("paris\x00")}
+	mustView(t, db, func(tx *Tx) error {
+		users := getOrCreate(t, tx, "users")
+
+		plan, err := users.Query().Where(cityIndex, paris).Explain()
+		if err != nil {
+			return err
+		}
+		if plan.Access != IndexScan || plan.EstimatedRows != 10 || len(plan.Considered) != 2 {
+			t.Errorf("plan of the city query:\n%s", plan)
+		}
+		keys := runQuery(t, users.Query().Where(cityIndex, paris))
+		if len(keys) != 10 || keys[0] != "user000" || keys[9] != "user180" {
+			t.Errorf("users in paris: got %v", keys)
+		}
+
+		// The primary range is narrower than the index one here, and the index predicate becomes a residual check
+		primary := KeyRange{Start: []byte("user000"), End: []byte("user005")}
+		plan, err = users.Query().Where(cityIndex, paris).Where(nil, primary).Explain()
+		if err != nil {
+			return err
+		}
+		if plan.Access != PrimaryRangeScan || plan.EstimatedRows != 5 || len(plan.Residual) != 1 {
+			t.Errorf("plan of the city and primary key query:\n%s", plan)
+		}
+		if keys := runQuery(t, users.Query().Where(cityIndex, paris).Where(nil, primary)); fmt.Sprint(keys) != "[user000]" {
+			t.Errorf("users in paris below user005: got %v", keys)
+		}
+
+		plan, err = users.Query().Explain()
+		if err != nil {
+			return err
+		}
+		if plan.Access != FullScan || plan.EstimatedRows != 200 {
+			t.Errorf("plan without predicates:\n%s", plan)
+		}
+		return nil
+	})
+}
+
+func TestQueryFiltersAndLimit(t *testing.T) {
+	db := openTestDB(t, nil)
+	putUsers(t, db)
+	mustView(t, db, func(tx *Tx) error {
+		q := getOrCreate(t, tx, "users").Query().Filter(func(key, value []byte) bool {
+			return bytes.HasSuffix(key, []byte("7"))
+		}).Limit(3)
+		if keys := runQuery(t, q); fmt.Sprint(keys) != "[user007 user017 user027]" {
+			t.Errorf("filtered and limited query: got %v", keys)
+		}
+		return nil
+	})
+}
+
+func TestQuerySkipsStaleIndexEntries(t *testing.T) {
+	db := openTestDB(t, nil)
+	putUsers(t, db)
+	// The index is maintained by the user, who forgets to update it here
+	mustUpdate(t, db, func(tx *Tx) error {
+		return getOrCreate(t, tx, "users").Remove([]byte("user000"))
+	})
+	mustUpdate(t, db, func(tx *Tx) error {
+		users := getOrCreate(t, tx, "users")
+		if err := users.Put([]byte("user020"), []byte("berlin")); err != nil {
+			return err
+		}
+		return cityIndex.Update(tx, []byte("user020"), []byte("paris"), []byte("berlin"))
+	})
+	mustView(t, db, func(tx *Tx) error {
+		keys := runQuery(t, getOrCreate(t, tx, "users").Query().Where(cityIndex, KeyRange{Start: []byte("paris"), End: []byte("paris\x00")}))
+		if len(keys) != 8 || keys[0] != "user040" {
+			t.Errorf("users in paris after removing user000 and moving user020: got %v", keys)
+		}
+		return nil
+	})
+}
+
+func TestIndexTermsKeepTheirOrder(t *testing.T) {
+	terms := [][]byte{[]byte("a"), []byte("a\x00"), []byte("a\x00b"), []byte("ab"), []byte("b")}
+	keys := make([][]byte, len(terms))
+	for i, term := range terms {
+		keys[i] = encodeIndexKey(term, []byte("pk"))
+	}
+	if !sort.SliceIsSorted(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 }) {
+		t.Errorf("encoded index keys aren't in the order of their terms: %q", keys)
+	}
+}
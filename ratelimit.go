@@ -0,0 +1,98 @@
+package gopherdb
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// RateLimiter persists rate limiting state in a collection, one key per limited entity. Every check is a Merge of the
+// entity state, so concurrent callers never lose updates and the limits hold across restarts.
+//
+// The state of a key is a float64 amount (tokens left for token buckets, the current level for leaky buckets) followed
+// by the unix nanoseconds of the last update.
+type RateLimiter struct {
+	collection []byte
+}
+
+// NewRateLimiter returns a rate limiter keeping its state in the given collection. The collection is created on the
+// first check.
+func NewRateLimiter(collection string) *RateLimiter {
+	return &RateLimiter{collection: []byte(collection)}
+}
+
+type bucketState struct {
+	amount  float64
+	updated time.Time
+}
+
+func decodeBucketState(value []byte) bucketState {
+	return bucketState{
+		amount:  math.Float64frombits(binary.LittleEndian.Uint64(value)),
+		updated: time.Unix(0, int64(binary.LittleEndian.Uint64(value[8:]))),
+	}
+}
+
+func (s bucketState) encode() []byte {
+	buf := make([]byte, 0, 16)
+	buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(s.amount))
+	return binary.LittleEndian.AppendUint64(buf, uint64(s.updated.UnixNano()))
+}
+
+// take merges the bucket state of the key with step, which returns the new state and whether the request is allowed.
+func (l *RateLimiter) take(tx *Tx, key []byte, step func(state *bucketState, exists bool, now time.Time) bool) (bool, error) {
+	if !tx.write {
+		return false, ErrWriteInsideReadTx
+	}
+	collection, err := tx.getOrCreateCollection(l.collection)
+	if err != nil {
+		return false, err
+	}
+
+	allowed := false
+	err = collection.Merge(key, func(current []byte) ([]byte, error) {
+		now := tx.db.now()
+		state := bucketState{}
+		if current != nil {
+			state = decodeBucketState(current)
+		}
+		allowed = step(&state, current != nil, now)
+		state.updated = now
+		return state.encode(), nil
+	})
+	return allowed, err
+}
+
+// TakeToken takes a token from the token bucket of the key and reports whether one was available. The bucket holds up
+// to burst tokens and is refilled at rate tokens per second. A new bucket starts full.
+func (l *RateLimiter) TakeToken(tx *Tx, key []byte, rate float64, burst int) (bool, error) {
+	return l.take(tx, key, func(state *bucketState, exists bool, now time.Time) bool {
+		if !exists {
+			state.amount = float64(burst)
+		} else {
+			elapsed := now.Sub(state.updated).Seconds()
+			state.amount = math.Min(float64(burst), state.amount+elapsed*rate)
+		}
+		if state.amount < 1 {
+			return false
+		}
+		state.amount--
+		return true
+	})
+}
+
+// TakeLeaky adds a request to the leaky bucket of the key and reports whether it fit. The bucket holds up to capacity
+// requests and drains at rate requests per second. A new bucket starts empty.
+func (l *RateLimiter) TakeLeaky(tx *Tx, key []byte, rate float64, capacity int) (bool, error) {
+	return l.take(tx, key, func(state *bucketState, exists bool, now time.Time) bool {
+		if exists {
+			elapsed := now.Sub(state.updated).Seconds()
+			state.amount = math.Max(0, state.amount-elapsed*rate)
+		}
+		if state.amount+1 > float64(capacity) {
+			return false
+		}
+		state.amount++
+		return true
+	})
+}
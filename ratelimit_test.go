@@ -0,0 +1,82 @@
+package gopherdb
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// takeAll runs n checks of the key and returns how many were allowed.
+func takeAll(t *testing.T, db *DB, n int, take func(tx *Tx) (bool, error)) int {
+	t.Helper()
+	allowed := 0
+	for i := 0; i < n; i++ {
+		mustUpdate(t, db, func(tx *Tx) error {
+			ok, err := take(tx)
+			if ok {
+				allowed++
+			}
+			return err
+		})
+	}
+	return allowed
+}
+
+func TestTokenBucket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPath(t, path, nil)
+	limiter := NewRateLimiter("limits")
+	slow := func(key string) func(tx *Tx) (bool, error) {
+		return func(tx *Tx) (bool, error) {
+			return limiter.TakeToken(tx, []byte(key), 0.001, 3)
+		}
+	}
+	if allowed := takeAll(t, db, 5, slow("a")); allowed != 3 {
+		t.Errorf("a new bucket of 3 tokens allowed %d of 5 requests", allowed)
+	}
+	if allowed := takeAll(t, db, 1, slow("b")); allowed != 1 {
+		t.Error("the bucket of another key is empty")
+	}
+
+	// The state is persisted, so the bucket is still empty after reopening
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	db = openTestPath(t, path, nil)
+	if allowed := takeAll(t, db, 1, slow("a")); allowed != 0 {
+		t.Error("the empty bucket was refilled by reopening")
+	}
+
+	fast := func(tx *Tx) (bool, error) {
+		return limiter.TakeToken(tx, []byte("a"), 1000, 3)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if allowed := takeAll(t, db, 3, fast); allowed != 3 {
+		t.Errorf("the refilled bucket allowed %d of 3 requests", allowed)
+	}
+}
+
+func TestLeakyBucket(t *testing.T) {
+	db := openTestDB(t, nil)
+	limiter := NewRateLimiter("limits")
+	slow := func(tx *Tx) (bool, error) {
+		return limiter.TakeLeaky(tx, []byte("a"), 0.001, 2)
+	}
+	if allowed := takeAll(t, db, 4, slow); allowed != 2 {
+		t.Errorf("a leaky bucket of capacity 2 allowed %d of 4 requests", allowed)
+	}
+	time.Sleep(10 * time.Millisecond)
+	fast := func(tx *Tx) (bool, error) {
+		return limiter.TakeLeaky(tx, []byte("a"), 1000, 2)
+	}
+	if allowed := takeAll(t, db, 2, fast); allowed != 2 {
+		t.Errorf("the drained bucket allowed %d of 2 requests", allowed)
+	}
+	mustView(t, db, func(tx *Tx) error {
+		if _, err := limiter.TakeLeaky(tx, []byte("a"), 1, 1); !errors.Is(err, ErrWriteInsideReadTx) {
+			t.Errorf("TakeLeaky in a read transaction: got %v, want ErrWriteInsideReadTx", err)
+		}
+		return nil
+	})
+}
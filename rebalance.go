@@ -0,0 +1,46 @@
+package gopherdb
+
+import "sync"
+
+// RebalanceStats counts the rebalancing operations of the trees, to correlate latency spikes with rebalancing storms
+// and to tune the fill percents.
+type RebalanceStats struct {
+	// Splits counts the nodes split because a put or a remove made them overpopulated, and Merges the nodes merged
+	// into a sibling because a remove made them underpopulated. Rotations counts the items moved between siblings
+	// through their parent instead of merging them.
+	Splits    uint64
+	Merges    uint64
+	Rotations uint64
+	// RootSplits counts the root splits, which add a level to a tree, and RootCollapses the roots replaced by their
+	// only child, which remove one.
+	RootSplits    uint64
+	RootCollapses uint64
+}
+
+func (s *RebalanceStats) add(other RebalanceStats) {
+	s.Splits += other.Splits
+	s.Merges += other.Merges
+	s.Rotations += other.Rotations
+	s.RootSplits += other.RootSplits
+	s.RootCollapses += other.RootCollapses
+}
+
+// rebalanceTotals sums the rebalancing operations of the commits of a database.
+type rebalanceTotals struct {
+	mu    sync.Mutex
+	stats RebalanceStats
+}
+
+// RebalanceStats returns the rebalancing operations of the transactions committed since the database was opened. The
+// counters are kept in memory only, see Options.StatsHistory for a record of every commit.
+func (db *DB) RebalanceStats() RebalanceStats {
+	db.rebalanceTotals.mu.Lock()
+	defer db.rebalanceTotals.mu.Unlock()
+	return db.rebalanceTotals.stats
+}
+
+// RebalanceStats returns the rebalancing operations of the transaction so far, or of the whole transaction once it
+// committed.
+func (tx *Tx) RebalanceStats() RebalanceStats {
+	return tx.rebalance
+}
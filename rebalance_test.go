@@ -0,0 +1,93 @@
+package gopherdb
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestRebalanceStats(t *testing.T) {
+	options := testOptions()
+	options.StatsHistory = 10
+	db := openTestDB(t, options)
+
+	var grown RebalanceStats
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i := 0; i < 1000; i++ {
+			if err := c.Put(testKey(i), testKey(i)); err != nil {
+				return err
+			}
+		}
+		grown = tx.RebalanceStats()
+		// Every root split added a level to the tree, which started as a single leaf
+		if height := treeHeight(t, tx, c.root); grown.RootSplits != uint64(height-1) {
+			t.Errorf("%d root splits for a tree of height %d", grown.RootSplits, height)
+		}
+		return nil
+	})
+	if grown.Splits <= grown.RootSplits || grown.Merges != 0 || grown.RootCollapses != 0 {
+		t.Errorf("putting keys: got %+v", grown)
+	}
+
+	// A transaction rolled back isn't counted by the database
+	tx, err := db.WriteTx()
+	if err != nil {
+		t.Fatalf("WriteTx: %v", err)
+	}
+	for i := 1000; i < 2000; i++ {
+		if err := getOrCreate(t, tx, "c").Put(testKey(i), testKey(i)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	tx.Rollback()
+	if got := db.RebalanceStats(); got != grown {
+		t.Errorf("after a rollback, the database counted %+v, want %+v", got, grown)
+	}
+
+	// Keys of random sizes are removed with merges and rotations, until the tree is a single leaf again
+	var shrunk RebalanceStats
+	rng := rand.New(rand.NewSource(1))
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "d")
+		for i := 0; i < 400; i++ {
+			key := append(testKey(i), bytes.Repeat([]byte("k"), rng.Intn(db.MaxKeySize()-len(testKey(i))))...)
+			if err := c.Put(key, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "d")
+		height := treeHeight(t, tx, c.root)
+		keys := storedKeys(t, c)
+		for _, i := range rng.Perm(len(keys)) {
+			if err := c.Remove(keys[i]); err != nil {
+				return err
+			}
+		}
+		shrunk = tx.RebalanceStats()
+		// Removals can split nodes too, when an item is replaced by a longer one from further down
+		if shrunk.RootCollapses-shrunk.RootSplits != uint64(height-1) {
+			t.Errorf("%d root collapses and %d root splits for a tree of height %d", shrunk.RootCollapses, shrunk.RootSplits, height)
+		}
+		return nil
+	})
+	if shrunk.Merges == 0 || shrunk.Rotations == 0 {
+		t.Errorf("removing keys: got %+v", shrunk)
+	}
+
+	// The database sums the commits, and the stats history has the counters of each one
+	var total RebalanceStats
+	records := statsHistory(t, db)
+	for _, record := range records {
+		total.add(record.Rebalance)
+	}
+	if got := db.RebalanceStats(); got != total {
+		t.Errorf("the database counted %+v, want the sum of the commits %+v", got, total)
+	}
+	if last := records[len(records)-1].Rebalance; last != shrunk {
+		t.Errorf("the history recorded %+v for the last commit, want %+v", last, shrunk)
+	}
+}
@@ -0,0 +1,88 @@
+package gopherdb
+
+import "errors"
+
+// Recovery describes what Open did to a file that wasn't closed cleanly, which is the case when the process died or
+// the file was copied while it was open. Commits are atomic, so the file is at the last commit whose meta page is on
+// disk; what's left to check is the freelist, whose pages a bug or a torn write could have given to the trees too.
+type Recovery struct {
+	// TxID is the id of the commit the file is at.
+	TxID uint64
+	// WALCommits is the number of commits replayed from the WAL, see Options.WAL.
+	WALCommits int
+	// TornMetaPage is set when a meta page didn't match its checksum: writing it was cut short, and the file is at the
+	// commit of the other meta page.
+	TornMetaPage bool
+	// DroppedFreePages are the pages taken out of the freelist because the trees use them, they were listed twice, or
+	// they're reserved or beyond the last page of the file. The freelist is written whole by the next commit.
+	DroppedFreePages []uint64
+	// Err is the error that stopped the trees from being walked, in which case the freelist is left as it is. Doctor
+	// tells more about the damage.
+	Err error
+}
+
+func newRecovery(m *meta, slotErrs [2]error, walCommits int) *Recovery {
+	recovery := &Recovery{TxID: m.txid, WALCommits: walCommits}
+	for _, err := range slotErrs {
+		if errors.Is(err, ErrMetaChecksumMismatch) {
+			recovery.TornMetaPage = true
+		}
+	}
+	return recovery
+}
+
+// Recovery returns what Open did to the file because it wasn't closed cleanly, or nil if it was.
+func (db *DB) Recovery() *Recovery {
+	return db.recovery
+}
+
+// repairFreelist drops the pages of the freelist that can't be free, so they're never handed out again.
+func (db *DB) repairFreelist() {
+	tx := newTx(db, false, db.txid, db.root)
+	used, err := tx.readCommittedPages()
+	if err != nil {
+		db.recovery.Err = err
+		return
+	}
+
+	seen := map[pgnum]bool{}
+	kept := make([]pgnum, 0, len(db.releasedPages))
+	for _, page := range db.releasedPages {
+		if page > db.maxPage || db.isReserved(page) || used[page] || seen[page] {
+			db.recovery.DroppedFreePages = append(db.recovery.DroppedFreePages, uint64(page))
+			continue
+		}
+		seen[page] = true
+		kept = append(kept, page)
+	}
+	if len(db.recovery.DroppedFreePages) > 0 {
+		db.releasedPages = kept
+		db.freelistRepaired = true
+	}
+}
+
+// markClean writes the meta page of the last commit again with the clean flag, once the last handle of the file is
+// closed, along with the freelist if Open repaired it and no commit wrote it since. It goes to the other meta page like
+// a commit, so a crash while it's written leaves the meta page of the commit. Read-only handles and Doctor leave the
+// file as it is.
+func (d *dal) markClean(readOnly bool) error {
+	if readOnly || d.inspect || d.meta.clean {
+		return nil
+	}
+	if d.freelistRepaired {
+		err := d.persistFreelist(d.txid, nil)
+		if err != nil {
+			return err
+		}
+		err = d.syncCommit()
+		if err != nil {
+			return err
+		}
+	}
+	d.meta.clean = true
+	_, err := d.writeMeta(d.meta)
+	if err != nil {
+		return err
+	}
+	return d.commitPages()
+}
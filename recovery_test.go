@@ -0,0 +1,137 @@
+package gopherdb
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// crashCopy copies the file of the open database to a new path, which is what the file looks like if the process dies
+// right after the last commit.
+func crashCopy(t *testing.T, db *DB) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "crashed.db")
+	if err := os.WriteFile(path, readFile(t, db.file.(*fileBackend).file.Name()), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func TestRecoveryAfterACrash(t *testing.T) {
+	options := testOptions()
+	db := openTestDB(t, options)
+	for i := 0; i < 20; i++ {
+		putValue(t, db, "c", string(testKey(i)), "value")
+	}
+	txid := db.txid
+	path := crashCopy(t, db)
+
+	crashed := openTestPath(t, path, options)
+	recovery := crashed.Recovery()
+	if recovery == nil || recovery.TxID != txid || recovery.TornMetaPage || len(recovery.DroppedFreePages) != 0 ||
+		recovery.Err != nil {
+		t.Fatalf("Recovery: got %+v, want the file at txid %d with nothing repaired", recovery, txid)
+	}
+	if value := getValue(t, crashed, "c", string(testKey(19))); value != "value" {
+		t.Errorf("the last commit: got %q", value)
+	}
+
+	// Closing marks the file clean again
+	if err := crashed.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	checkFile(t, path, options)
+	if reopened := openTestPath(t, path, options); reopened.Recovery() != nil {
+		t.Errorf("Recovery after a clean close: got %+v", reopened.Recovery())
+	}
+}
+
+func TestRecoveryOfATornMetaPage(t *testing.T) {
+	options := testOptions()
+	db := openTestDB(t, options)
+	putValue(t, db, "c", "k", "first")
+	putValue(t, db, "c", "k", "second")
+	txid := db.txid
+	path := crashCopy(t, db)
+
+	// The last commit went to the meta page its txid selects, and a torn write garbled it
+	data := readFile(t, path)
+	slot := metaPageNum
+	if txid%2 == 1 {
+		slot = metaPageNumB
+	}
+	m := newEmptyMeta()
+	if err := m.deserialize(data[int(slot)*options.pageSize : int(slot+1)*options.pageSize]); err != nil || m.txid != txid {
+		t.Fatalf("meta page %d has txid %d, %v, want the last commit %d", slot, m.txid, err, txid)
+	}
+	data[int(slot)*options.pageSize+magicNumberSize] ^= 0xff
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	crashed := openTestPath(t, path, options)
+	if recovery := crashed.Recovery(); recovery == nil || !recovery.TornMetaPage || recovery.TxID != txid-1 {
+		t.Fatalf("Recovery: got %+v, want the file at txid %d with a torn meta page", recovery, txid-1)
+	}
+	if value := getValue(t, crashed, "c", "k"); value != "first" {
+		t.Errorf("the file is at the commit before the torn one, got %q", value)
+	}
+	putValue(t, crashed, "c", "k", "third")
+	if err := crashed.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	checkFile(t, path, options)
+}
+
+func TestRecoveryRepairsTheFreelist(t *testing.T) {
+	options := testOptions()
+	db := openTestDB(t, options)
+	for i := 0; i < 50; i++ {
+		putValue(t, db, "c", string(testKey(i)), "value")
+	}
+	var used pgnum
+	mustView(t, db, func(tx *Tx) error {
+		used = getOrCreate(t, tx, "c").root
+		return nil
+	})
+	path := crashCopy(t, db)
+
+	// The freelist lists a page of a tree, twice, and a page past the end of the file
+	data := readFile(t, path)
+	fr := newFreelist()
+	page := data[int(db.freelistPage)*options.pageSize : int(db.freelistPage+1)*options.pageSize]
+	if _, left, err := fr.deserialize(page, formatVersion); err != nil || left != 0 {
+		t.Fatalf("deserialize: %d left, %v", left, err)
+	}
+	fr.releasedPages = append(fr.releasedPages, used, used, fr.maxPage+10)
+	fr.serialize([][]byte{page}, nil)
+	if count := binary.LittleEndian.Uint64(page[pageNumSize:]); count != uint64(len(fr.releasedPages)) {
+		t.Fatalf("the freelist counts %d pages, want %d", count, len(fr.releasedPages))
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	crashed := openTestPath(t, path, options)
+	recovery := crashed.Recovery()
+	if recovery == nil || len(recovery.DroppedFreePages) != 3 {
+		t.Fatalf("Recovery: got %+v, want 3 dropped free pages", recovery)
+	}
+	for _, free := range crashed.releasedPages {
+		if free == used || free > crashed.maxPage {
+			t.Errorf("page %d is still free", free)
+		}
+	}
+	// Writing can't overwrite the tree with the pages that were wrongly free
+	for i := 0; i < 50; i++ {
+		putValue(t, crashed, "c", string(testKey(i)), "after the crash")
+	}
+	if value := getValue(t, crashed, "c", string(testKey(0))); value != "after the crash" {
+		t.Errorf("got %q, want the value written after the crash", value)
+	}
+	if err := crashed.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	checkFile(t, path, options)
+}
@@ -0,0 +1,351 @@
+package gopherdb
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+var ErrUnknownShard = errors.New("no database for the shard")
+
+// Ring is a consistent hash ring mapping keys to shards, for applications spreading their keys over several databases.
+// Every shard owns replicas points of the ring, and a key belongs to the shard of the first point at or after its
+// hash, so adding or removing a shard only moves the keys of the points it gains or loses. The shards are names, so a
+// ring routes keys to databases of other processes as well as to the ones open in the process, which MoveShards moves
+// keys between. A Ring isn't changed once made: With and Without return new rings.
+type Ring struct {
+	replicas int
+	points   []ringPoint
+}
+
+type ringPoint struct {
+	hash  uint64
+	shard string
+}
+
+// NewRing returns a ring of the shards, with replicas points per shard. More points spread the keys more evenly, at
+// the cost of a bigger ring; a hundred or so is usual. Zero or fewer means one.
+func NewRing(replicas int, shards ...string) *Ring {
+	if replicas < 1 {
+		replicas = 1
+	}
+	r := &Ring{replicas: replicas}
+	for _, shard := range shards {
+		r.points = append(r.points, shardPoints(shard, replicas)...)
+	}
+	r.sort()
+	return r
+}
+
+// ringHash hashes keys and points onto the ring. FNV alone barely changes the upper bits between similar inputs, like
+// the names of the points of a shard, so they're mixed in with the finalizer of MurmurHash3.
+func ringHash(b []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(b)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func shardPoints(shard string, replicas int) []ringPoint {
+	points := make([]ringPoint, replicas)
+	for i := range points {
+		points[i] = ringPoint{hash: ringHash([]byte(shard + "#" + strconv.Itoa(i))), shard: shard}
+	}
+	return points
+}
+
+// sort orders the points by hash, and the points of the same hash by shard, so rings of the same shards are the same
+// whatever the order the shards were given in.
+func (r *Ring) sort() {
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].shard < r.points[j].shard
+	})
+}
+
+// Shards returns the shards of the ring, sorted.
+func (r *Ring) Shards() []string {
+	seen := map[string]bool{}
+	var shards []string
+	for _, point := range r.points {
+		if !seen[point.shard] {
+			seen[point.shard] = true
+			shards = append(shards, point.shard)
+		}
+	}
+	sort.Strings(shards)
+	return shards
+}
+
+// With returns a ring with the shard added. It returns the ring itself if it already has the shard.
+func (r *Ring) With(shard string) *Ring {
+	for _, point := range r.points {
+		if point.shard == shard {
+			return r
+		}
+	}
+	ring := &Ring{replicas: r.replicas, points: append(append([]ringPoint{}, r.points...), shardPoints(shard, r.replicas)...)}
+	ring.sort()
+	return ring
+}
+
+// Without returns a ring without the shard.
+func (r *Ring) Without(shard string) *Ring {
+	ring := &Ring{replicas: r.replicas}
+	for _, point := range r.points {
+		if point.shard != shard {
+			ring.points = append(ring.points, point)
+		}
+	}
+	return ring
+}
+
+// Locate returns the shard the key belongs to, or an empty string if the ring has no shard.
+func (r *Ring) Locate(key []byte) string {
+	return r.owner(ringHash(key))
+}
+
+func (r *Ring) owner(hash uint64) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
+
+// ShardMove is a part of the ring whose keys move from a shard to another: the keys whose hash is after Start and up to
+// End, wrapping around the ring if End isn't after Start, see Contains.
+type ShardMove struct {
+	From  string
+	To    string
+	Start uint64
+	End   uint64
+}
+
+// Contains reports whether the key is in the part of the ring of the move.
+func (m ShardMove) Contains(key []byte) bool {
+	hash := ringHash(key)
+	if m.Start < m.End {
+		return hash > m.Start && hash <= m.End
+	}
+	return hash > m.Start || hash <= m.End
+}
+
+// PlanMoves returns the moves that take the keys from where the ring puts them to where the other ring does, ordered
+// around the ring. There's nothing to move if either ring has no shard.
+func (r *Ring) PlanMoves(to *Ring) []ShardMove {
+	if len(r.points) == 0 || len(to.points) == 0 {
+		return nil
+	}
+	// The owners of both rings only change at the points of either ring, so every part between two points moves
+	// whole, or not at all
+	hashes := make([]uint64, 0, len(r.points)+len(to.points))
+	for _, point := range append(append([]ringPoint{}, r.points...), to.points...) {
+		hashes = append(hashes, point.hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+
+	var moves []ShardMove
+	prev := hashes[len(hashes)-1]
+	for i, hash := range hashes {
+		if i > 0 && hash == hashes[i-1] {
+			continue
+		}
+		from, dest := r.owner(hash), to.owner(hash)
+		if from != dest {
+			if last := len(moves) - 1; last >= 0 && moves[last].End == prev && moves[last].From == from && moves[last].To == dest {
+				moves[last].End = hash
+			} else {
+				moves = append(moves, ShardMove{From: from, To: dest, Start: prev, End: hash})
+			}
+		}
+		prev = hash
+	}
+	return moves
+}
+
+// MoveShards moves the keys of the moves, found by PlanMoves, between the databases of their shards. It isn't atomic:
+// the keys are moved importBatch at a time, and a write transaction puts every batch into the database it moves to,
+// then once that's committed, another one removes it from the database it moves from. A move failing halfway leaves the
+// batches before the failure moved and the keys of the last batch in both databases, so it must be run again, which
+// finishes it, before the keys are routed with the new ring alone.
+//
+// The keys of every collection move, nested collections included, which are created as needed with the default
+// options. The keys are the ones Find returns, so the metadata of PutWithMeta isn't moved.
+//
+// The keys of the moves must not be written meanwhile, which usually means routing them with both rings until the
+// moves are done: reads go to either shard, and writes wait.
+func MoveShards(moves []ShardMove, shards map[string]*DB) error {
+	bySource := map[string][]ShardMove{}
+	var sources []string
+	for _, move := range moves {
+		if shards[move.From] == nil || shards[move.To] == nil {
+			return fmt.Errorf("%w: move from %q to %q", ErrUnknownShard, move.From, move.To)
+		}
+		if bySource[move.From] == nil {
+			sources = append(sources, move.From)
+		}
+		bySource[move.From] = append(bySource[move.From], move)
+	}
+	for _, source := range sources {
+		err := moveShard(shards[source], bySource[source], shards)
+		if err != nil {
+			return fmt.Errorf("shard %s: %w", source, err)
+		}
+	}
+	return nil
+}
+
+// moveShard moves the keys of the moves out of the source, collection by collection.
+func moveShard(source *DB, moves []ShardMove, shards map[string]*DB) error {
+	var paths [][][]byte
+	var walk func(c *Collection, path [][]byte) error
+	walk = func(c *Collection, path [][]byte) error {
+		paths = append(paths, path)
+		return c.tx.rangeStored(c.root, KeyRange{}, func(item *Item) (bool, error) {
+			if !item.collection {
+				return true, nil
+			}
+			nested := c.nested(item)
+			err := walk(nested, append(append([][]byte{}, path...), nested.name))
+			return err == nil, err
+		})
+	}
+	err := source.View(func(tx *Tx) error {
+		collections, err := tx.allCollections()
+		if err != nil {
+			return err
+		}
+		for _, collection := range collections {
+			if isInternalCollection(collection.name) {
+				continue
+			}
+			err = walk(collection, [][]byte{collection.name})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		for start := []byte(nil); ; {
+			batch, err := nextMoveBatch(source, path, start, moves)
+			if err != nil {
+				return err
+			}
+			if len(batch) == 0 {
+				break
+			}
+			for dest, kvs := range batch {
+				err = shards[dest].Update(func(tx *Tx) error {
+					c, err := movedCollection(tx, path, true)
+					if err != nil {
+						return err
+					}
+					for _, kv := range kvs {
+						err = c.Put(kv.Key, kv.Value)
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			err = source.Update(func(tx *Tx) error {
+				c, err := movedCollection(tx, path, false)
+				if err != nil || c == nil {
+					return err
+				}
+				for _, kvs := range batch {
+					for _, kv := range kvs {
+						err = c.Remove(kv.Key)
+						if err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			// The keys of the batch are gone, so the next one starts where it stopped
+			for _, kvs := range batch {
+				if last := kvs[len(kvs)-1].Key; start == nil || string(last) > string(start) {
+					start = last
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// movedCollection returns the collection at the path, the names of a collection of the root collection and of the
+// collections nested in it down to the collection. With create, the collections missing are created, and otherwise
+// it returns nil if there's one missing.
+func movedCollection(tx *Tx, path [][]byte, create bool) (*Collection, error) {
+	var c *Collection
+	var err error
+	if create {
+		c, err = tx.getOrCreateCollection(path[0])
+	} else {
+		c, err = tx.GetCollection(path[0])
+	}
+	for _, name := range path[1:] {
+		if err != nil || c == nil {
+			return nil, err
+		}
+		parent := c
+		c, err = parent.GetCollection(name)
+		if err == nil && c == nil && create {
+			c, err = parent.CreateCollection(name)
+		}
+	}
+	return c, err
+}
+
+// nextMoveBatch returns up to importBatch keys of the collection at the path from start on that move, by the shard
+// they move to, see movedCollection.
+func nextMoveBatch(source *DB, path [][]byte, start []byte, moves []ShardMove) (map[string][]KV, error) {
+	batch := map[string][]KV{}
+	err := source.View(func(tx *Tx) error {
+		c, err := movedCollection(tx, path, false)
+		if err != nil || c == nil {
+			return err
+		}
+		cur := c.Cursor()
+		found := 0
+		for k, v := cur.Seek(start); k != nil && found < importBatch; k, v = cur.Next() {
+			for _, move := range moves {
+				if move.Contains(k) {
+					batch[move.To] = append(batch[move.To], KV{Key: append([]byte{}, k...), Value: append([]byte{}, v...)})
+					found++
+					break
+				}
+			}
+		}
+		return cur.Err()
+	})
+	if err != nil || len(batch) == 0 {
+		return nil, err
+	}
+	return batch, nil
+}
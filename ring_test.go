@@ -0,0 +1,176 @@
+package gopherdb
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	ring := NewRing(100, "a", "b", "c")
+	if shards := ring.Shards(); len(shards) != 3 || shards[0] != "a" || shards[2] != "c" {
+		t.Fatalf("got shards %v", shards)
+	}
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		counts[ring.Locate(testKey(i))]++
+	}
+	for _, shard := range ring.Shards() {
+		if counts[shard] < 500 {
+			t.Errorf("shard %s got %d keys of 3000", shard, counts[shard])
+		}
+	}
+	if NewRing(100, "c", "a", "b").Locate([]byte("k")) != ring.Locate([]byte("k")) {
+		t.Error("the order of the shards changed the ring")
+	}
+	if shard := NewRing(100).Locate([]byte("k")); shard != "" {
+		t.Errorf("an empty ring located a key in %q", shard)
+	}
+
+	// Adding a shard only moves keys to it, and the plan covers exactly the keys that move
+	grown := ring.With("d")
+	moves := ring.PlanMoves(grown)
+	if len(moves) == 0 {
+		t.Fatal("no move to the new shard")
+	}
+	for i := 0; i < 3000; i++ {
+		key := testKey(i)
+		from, to := ring.Locate(key), grown.Locate(key)
+		if from != to && to != "d" {
+			t.Fatalf("key %s moved from %s to %s", key, from, to)
+		}
+		var planned []ShardMove
+		for _, move := range moves {
+			if move.Contains(key) {
+				planned = append(planned, move)
+			}
+		}
+		if from == to && len(planned) != 0 || from != to && (len(planned) != 1 || planned[0].From != from || planned[0].To != to) {
+			t.Fatalf("key %s moves from %s to %s, planned %+v", key, from, to, planned)
+		}
+	}
+	if back := grown.Without("d"); back.Locate([]byte("k")) != ring.Locate([]byte("k")) || len(back.PlanMoves(ring)) != 0 {
+		t.Error("removing the shard again didn't give back the ring")
+	}
+}
+
+func TestMoveShards(t *testing.T) {
+	ring := NewRing(50, "a", "b")
+	shards := map[string]*DB{"a": openTestDB(t, nil), "b": openTestDB(t, nil), "c": openTestDB(t, nil)}
+	for _, collection := range []string{"users", "orders"} {
+		mustUpdate(t, shards["a"], func(tx *Tx) error {
+			getOrCreate(t, tx, collection)
+			return nil
+		})
+		mustUpdate(t, shards["b"], func(tx *Tx) error {
+			getOrCreate(t, tx, collection)
+			return nil
+		})
+		for i := 0; i < 300; i++ {
+			key := string(testKey(i))
+			putValue(t, shards[ring.Locate(testKey(i))], collection, key, collection+" "+key)
+		}
+	}
+
+	grown := ring.With("c")
+	if err := MoveShards(ring.PlanMoves(grown), shards); err != nil {
+		t.Fatalf("MoveShards: %v", err)
+	}
+	for _, collection := range []string{"users", "orders"} {
+		for i := 0; i < 300; i++ {
+			key := string(testKey(i))
+			if got := getValue(t, shards[grown.Locate(testKey(i))], collection, key); got != collection+" "+key {
+				t.Fatalf("key %s of %s is %q on its new shard", key, collection, got)
+			}
+		}
+		total := 0
+		for _, db := range shards {
+			mustView(t, db, func(tx *Tx) error {
+				keys, err := readAll(tx, collection)
+				total += len(keys)
+				return err
+			})
+		}
+		if total != 300 {
+			t.Fatalf("the shards hold %d keys of %s, want 300", total, collection)
+		}
+	}
+
+	if err := MoveShards([]ShardMove{{From: "a", To: "z"}}, shards); !errors.Is(err, ErrUnknownShard) {
+		t.Fatalf("got %v, want ErrUnknownShard", err)
+	}
+}
+
+func TestMoveShardsMovesNestedCollections(t *testing.T) {
+	ring := NewRing(50, "a")
+	shards := map[string]*DB{"a": openTestDB(t, nil), "b": openTestDB(t, nil)}
+	// nestedIn returns the collection settings/theme nested in users, creating it as needed
+	nestedIn := func(tx *Tx) *Collection {
+		c := getOrCreate(t, tx, "users")
+		for _, name := range []string{"settings", "theme"} {
+			nested, err := c.GetCollection([]byte(name))
+			if err == nil && nested == nil {
+				nested, err = c.CreateCollection([]byte(name))
+			}
+			if err != nil {
+				t.Fatalf("collection %s: %v", name, err)
+			}
+			c = nested
+		}
+		return c
+	}
+	mustUpdate(t, shards["a"], func(tx *Tx) error {
+		for i := 0; i < 300; i++ {
+			if err := getOrCreate(t, tx, "users").Put(testKey(i), []byte("user")); err != nil {
+				return err
+			}
+			if err := nestedIn(tx).Put(testKey(i), []byte("theme")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	grown := ring.With("b")
+	if err := MoveShards(ring.PlanMoves(grown), shards); err != nil {
+		t.Fatalf("MoveShards: %v", err)
+	}
+	moved := 0
+	for i := 0; i < 300; i++ {
+		key := testKey(i)
+		shard := grown.Locate(key)
+		if shard == "b" {
+			moved++
+		}
+		for name, db := range shards {
+			var value []byte
+			mustView(t, db, func(tx *Tx) error {
+				users, err := tx.GetCollection([]byte("users"))
+				if err != nil || users == nil {
+					return err
+				}
+				settings, err := users.GetCollection([]byte("settings"))
+				if err != nil || settings == nil {
+					return err
+				}
+				theme, err := settings.GetCollection([]byte("theme"))
+				if err != nil || theme == nil {
+					return err
+				}
+				value, err = theme.Get(key)
+				if errors.Is(err, ErrKeyNotFound) {
+					return nil
+				}
+				return err
+			})
+			if want := name == shard; (value != nil) != want {
+				t.Fatalf("nested key %s on shard %s: got %q, want it only on shard %s", key, name, value, shard)
+			}
+		}
+		if got := getValue(t, shards[shard], "users", string(key)); got != "user" {
+			t.Fatalf("key %s is %q on its new shard", key, got)
+		}
+	}
+	if moved == 0 {
+		t.Fatal("no key moved to the new shard")
+	}
+}
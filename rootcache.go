@@ -0,0 +1,89 @@
+package gopherdb
+
+import "sync"
+
+// rootCacheSize is the number of nodes of the root tree the root cache keeps, enough for the whole tree of a few
+// hundred collections, and for the upper levels of bigger ones.
+const rootCacheSize = 64
+
+// rootCache keeps the nodes of the root tree read by GetCollection, so looking up a collection reads and decodes no
+// page in the common case of a handful of collections, whatever Options.NodeCacheSize is. It holds the nodes of a
+// single commit, its txid: commits never write the pages of the committed trees, see copyOnWrite, so a node of the
+// tree of a commit is valid for every transaction reading that commit, and only for them. The first lookup of a later
+// commit empties the cache, and the lookups of earlier commits, like the ones of long read transactions, don't use it.
+type rootCache struct {
+	mu    sync.Mutex
+	txid  uint64
+	nodes map[pgnum]*Node
+}
+
+// get returns a copy of the node of the page of the commit txid, or nil if it isn't cached.
+func (c *rootCache) get(txid uint64, pageNum pgnum) *Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.txid != txid {
+		return nil
+	}
+	node, ok := c.nodes[pageNum]
+	if !ok {
+		return nil
+	}
+	return copyNode(node)
+}
+
+// put caches a copy of the node of the commit txid, unless the cache holds the nodes of a later commit or is full.
+func (c *rootCache) put(txid uint64, n *Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if txid < c.txid {
+		return
+	}
+	if txid > c.txid || c.nodes == nil {
+		c.txid = txid
+		c.nodes = map[pgnum]*Node{}
+	}
+	if len(c.nodes) < rootCacheSize {
+		c.nodes[n.pageNum] = copyNode(n)
+	}
+}
+
+// getRootNode returns the node of a page of the root tree like getNode, from the root cache if it holds it. The
+// transactions of DebugTx hold no lock, so the commit they read can change under them, and they don't use the cache.
+func (tx *Tx) getRootNode(pageNum pgnum) (*Node, error) {
+	if tx.debug || tx.hasNode(pageNum) {
+		return tx.getNode(pageNum)
+	}
+	txid := tx.fileState().txid
+	if node := tx.db.rootCache.get(txid, pageNum); node != nil {
+		if tx.write {
+			if tx.readPages == nil {
+				tx.readPages = map[pgnum]bool{}
+			}
+			tx.readPages[pageNum] = true
+		}
+		tx.adoptNode(node)
+		return node, nil
+	}
+	node, err := tx.getNode(pageNum)
+	if err != nil {
+		return nil, err
+	}
+	tx.db.rootCache.put(txid, node)
+	return node, nil
+}
+
+// findCollectionItem returns the item of the collection in the root tree, or nil if there's no such collection.
+func (tx *Tx) findCollectionItem(name []byte) (*Item, error) {
+	node, err := tx.getRootNode(tx.root)
+	for err == nil {
+		found, index := node.findKeyInNode(name)
+		if found {
+			return node.items[index], nil
+		}
+		if node.isLeaf() {
+			return nil, nil
+		}
+		node, err = tx.getRootNode(node.childNodes[index])
+	}
+	return nil, err
+}
@@ -0,0 +1,71 @@
+package gopherdb
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRootCache(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustUpdate(t, db, func(tx *Tx) error {
+		for i := 0; i < 100; i++ {
+			getOrCreate(t, tx, fmt.Sprintf("collection %03d", i))
+		}
+		return nil
+	})
+	lookup := func(tx *Tx, i int) {
+		t.Helper()
+		name := fmt.Sprintf("collection %03d", i)
+		c, err := tx.GetCollection([]byte(name))
+		if err != nil || c == nil || string(c.name) != name {
+			t.Fatalf("GetCollection(%s): got %v, %v", name, c, err)
+		}
+	}
+
+	// Once a transaction looked the collections up, the next ones read no page to find them
+	mustView(t, db, func(tx *Tx) error {
+		for i := 0; i < 100; i++ {
+			lookup(tx, i)
+		}
+		return nil
+	})
+	read := db.Stats().BytesRead
+	mustView(t, db, func(tx *Tx) error {
+		for i := 0; i < 100; i++ {
+			lookup(tx, i)
+		}
+		return nil
+	})
+	if got := db.Stats().BytesRead - read; got != 0 {
+		t.Fatalf("looking the collections up again read %d bytes", got)
+	}
+
+	// A read transaction of an earlier commit keeps finding its own collections after the cache moves on
+	old, err := db.ReadTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Rollback()
+	mustUpdate(t, db, func(tx *Tx) error {
+		if err := tx.DeleteCollection([]byte("collection 050"), DeleteCascade); err != nil {
+			return err
+		}
+		lookup(tx, 51)
+		getOrCreate(t, tx, "new")
+		return nil
+	})
+	mustView(t, db, func(tx *Tx) error {
+		if c, err := tx.GetCollection([]byte("collection 050")); err != nil || c != nil {
+			t.Fatalf("the deleted collection is still found: %v, %v", c, err)
+		}
+		if c, err := tx.GetCollection([]byte("new")); err != nil || c == nil {
+			t.Fatalf("the new collection isn't found: %v, %v", c, err)
+		}
+		lookup(tx, 49)
+		return nil
+	})
+	lookup(old, 50)
+	if c, err := old.GetCollection([]byte("new")); err != nil || c != nil {
+		t.Fatalf("the read transaction found a collection created after it began: %v, %v", c, err)
+	}
+}
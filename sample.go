@@ -0,0 +1,160 @@
+package gopherdb
+
+import "math/rand"
+
+// sampleAttemptsPerKey bounds the descents of Sample to this many times the number of keys asked for, since descents
+// landing on a key that was already sampled are retried.
+const sampleAttemptsPerKey = 8
+
+// Sample returns up to n distinct keys of the collection, picked approximately uniformly at random. It's meant for query
+// statistics and test datasets, and reads a few nodes per key instead of the whole collection.
+//
+// Every key is found by a random descent from the root. At every node, each item of the node and each child subtree is
+// picked with a weight proportional to its number of keys, so a key deep in a big subtree is as likely as a key stored
+// in the root. Subtree sizes aren't stored, so the size of a child subtree is estimated from the number of items in the
+// child and the average size of the subtrees one level below it, measured along the leftmost path of the tree.
+func (c *Collection) Sample(n int) ([][]byte, error) {
+	seed, err := c.tx.db.randomSeed()
+	if err != nil {
+		return nil, err
+	}
+	return c.sample(n, rand.New(rand.NewSource(seed)))
+}
+
+type sampler struct {
+	c   *Collection
+	rng *rand.Rand
+	// levelSizes holds the estimated number of keys of a subtree rooted at each level, the root being level 0.
+	levelSizes []float64
+	// nodes caches the nodes read by the previous descents.
+	nodes map[pgnum]*Node
+}
+
+func (c *Collection) sample(n int, rng *rand.Rand) ([][]byte, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	s := &sampler{c: c, rng: rng, nodes: map[pgnum]*Node{}}
+	err := s.measureLevels()
+	if err != nil {
+		return nil, err
+	}
+
+	// Collections not much bigger than the sample are returned whole, there's nothing to gain from descents
+	if s.levelSizes[0] <= float64(n) {
+		var keys [][]byte
+		err = c.tx.rangeItems(c.root, KeyRange{}, func(item *Item) (bool, error) {
+			keys = append(keys, append([]byte{}, item.key...))
+			return len(keys) < n, nil
+		})
+		return keys, err
+	}
+
+	seen := map[string]bool{}
+	var keys [][]byte
+	for attempt := 0; attempt < n*sampleAttemptsPerKey && len(keys) < n; attempt++ {
+		key, err := s.descend()
+		if err != nil {
+			return nil, err
+		}
+		if key == nil || seen[string(key)] {
+			continue
+		}
+		seen[string(key)] = true
+		keys = append(keys, append([]byte{}, key...))
+	}
+	return keys, nil
+}
+
+func (s *sampler) getNode(pageNum pgnum) (*Node, error) {
+	if node, ok := s.nodes[pageNum]; ok {
+		return node, nil
+	}
+	node, err := s.c.tx.getNode(pageNum)
+	if err != nil {
+		return nil, err
+	}
+	s.nodes[pageNum] = node
+	return node, nil
+}
+
+// measureLevels estimates the subtree size of every level from the number of items of the nodes on the leftmost path.
+// All the leaves of the tree are on the same level, so the path gives the height of the tree.
+func (s *sampler) measureLevels() error {
+	var counts []int
+	node, err := s.getNode(s.c.root)
+	if err != nil {
+		return err
+	}
+	for {
+		counts = append(counts, len(node.items))
+		if node.isLeaf() {
+			break
+		}
+		node, err = s.getNode(node.childNodes[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	s.levelSizes = make([]float64, len(counts))
+	for level := len(counts) - 1; level >= 0; level-- {
+		s.levelSizes[level] = float64(counts[level])
+		if level < len(counts)-1 {
+			s.levelSizes[level] += float64(counts[level]+1) * s.levelSizes[level+1]
+		}
+	}
+	return nil
+}
+
+// subtreeSize estimates the number of keys of the subtree rooted at the node, which is at the given level.
+func (s *sampler) subtreeSize(node *Node, level int) float64 {
+	size := float64(len(node.items))
+	if !node.isLeaf() && level+1 < len(s.levelSizes) {
+		size += float64(len(node.childNodes)) * s.levelSizes[level+1]
+	}
+	return size
+}
+
+// descend walks down from the root and returns the key it lands on, or nil if it lands on an empty leaf.
+func (s *sampler) descend() ([]byte, error) {
+	node, err := s.getNode(s.c.root)
+	if err != nil {
+		return nil, err
+	}
+	for level := 0; ; level++ {
+		if node.isLeaf() {
+			if len(node.items) == 0 {
+				return nil, nil
+			}
+			return node.items[s.rng.Intn(len(node.items))].key, nil
+		}
+
+		children := make([]*Node, len(node.childNodes))
+		weights := make([]float64, len(node.childNodes))
+		total := float64(len(node.items))
+		for i, pageNum := range node.childNodes {
+			children[i], err = s.getNode(pageNum)
+			if err != nil {
+				return nil, err
+			}
+			weights[i] = s.subtreeSize(children[i], level+1)
+			total += weights[i]
+		}
+
+		pick := s.rng.Float64() * total
+		if pick < float64(len(node.items)) {
+			return node.items[int(pick)].key, nil
+		}
+		pick -= float64(len(node.items))
+		next := children[len(children)-1]
+		for i, weight := range weights {
+			if pick < weight {
+				next = children[i]
+				break
+			}
+			pick -= weight
+		}
+		node = next
+	}
+}
@@ -0,0 +1,117 @@
+package gopherdb
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestSampleSmallCollections(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i := 0; i < 5; i++ {
+			if err := c.Put(testKey(i), nil); err != nil {
+				return err
+			}
+		}
+		getOrCreate(t, tx, "empty")
+		return nil
+	})
+	mustView(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		if keys, err := c.Sample(0); err != nil || keys != nil {
+			t.Errorf("Sample(0): got %q, %v", keys, err)
+		}
+		// Asking for at least every key returns them all
+		keys, err := c.Sample(10)
+		if err != nil {
+			return err
+		}
+		if fmt.Sprintf("%s", keys) != "[key000000 key000001 key000002 key000003 key000004]" {
+			t.Errorf("Sample(10) of 5 keys: got %s", keys)
+		}
+		if keys, err := getOrCreate(t, tx, "empty").Sample(10); err != nil || len(keys) != 0 {
+			t.Errorf("Sample of an empty collection: got %q, %v", keys, err)
+		}
+		return nil
+	})
+}
+
+func TestSampleIsUniform(t *testing.T) {
+	db := openTestDB(t, nil)
+	// Sequential puts split nodes in half, and the random puts in the upper half of the key space fill its nodes, so
+	// the lower half has twice as many nodes per key as the upper half
+	const keys = 6000
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i := 0; i < keys; i += 2 {
+			if err := c.Put(testKey(i), nil); err != nil {
+				return err
+			}
+		}
+		for _, i := range rand.New(rand.NewSource(1)).Perm(keys / 4) {
+			if err := c.Put(testKey(keys/2+i*2+1), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	mustView(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		if height := treeHeight(t, tx, c.root); height < 3 {
+			t.Fatalf("tree height is %d, want at least 3", height)
+		}
+		internal := map[string]bool{}
+		err := tx.walk(c.root, func(n *Node) error {
+			for _, item := range n.items {
+				if !n.isLeaf() {
+					internal[string(item.key)] = true
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		rng := rand.New(rand.NewSource(1))
+		const runs, n = 100, 50
+		lower, internals := 0, 0
+		for run := 0; run < runs; run++ {
+			sample, err := c.sample(n, rng)
+			if err != nil {
+				return err
+			}
+			if len(sample) != n {
+				t.Fatalf("sample has %d keys, want %d", len(sample), n)
+			}
+			seen := map[string]bool{}
+			for _, key := range sample {
+				i, err := strconv.Atoi(string(key[len("key"):]))
+				if err != nil || i >= keys || (i < keys/2 && i%2 != 0) || seen[string(key)] {
+					t.Fatalf("sample returned %s, which isn't a distinct key of the collection", key)
+				}
+				seen[string(key)] = true
+				if i < keys/2 {
+					lower++
+				}
+				if internal[string(key)] {
+					internals++
+				}
+			}
+		}
+
+		// The lower half holds a third of the keys, and the internal nodes a few of them
+		if share := float64(lower) / (runs * n); share < 0.28 || share > 0.39 {
+			t.Errorf("the lower half of the key space got %.1f%% of the samples, want about 33%%", share*100)
+		}
+		want := float64(len(internal)) / (keys * 3 / 4)
+		if share := float64(internals) / (runs * n); share > 2*want+0.01 {
+			t.Errorf("keys of internal nodes got %.1f%% of the samples, want about %.1f%%", share*100, want*100)
+		}
+		return nil
+	})
+}
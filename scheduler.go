@@ -0,0 +1,250 @@
+package gopherdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// cronCollection is the collection a Scheduler keeps the next run of its jobs in, as unix nanoseconds by job name.
+var cronCollection = []byte("__gopherdb_cron")
+
+var (
+	ErrJobExists   = errors.New("a job with this name is already scheduled")
+	ErrJobNotFound = errors.New("no job with this name is scheduled")
+)
+
+// Scheduler runs maintenance jobs on the data, like recomputing aggregates stored in the database, every interval.
+// Every run of a job is a write transaction of its own, and the next run of every job is kept in the file, so jobs keep
+// their schedule when the file is reopened: a job that was due while the file was closed runs at the first check.
+//
+// The jobs are run by RunDue, which can also check them periodically in the background with Start.
+type Scheduler struct {
+	db *DB
+
+	mu   sync.Mutex
+	jobs []*cronJob
+
+	ticker periodic
+}
+
+// cronJob is a job of a Scheduler. running is set while it runs, so the runs of a job never overlap.
+type cronJob struct {
+	name     string
+	interval time.Duration
+	jitter   time.Duration
+	fn       func(tx *Tx) error
+	running  bool
+}
+
+// NewScheduler returns a scheduler without jobs running them on the database.
+func NewScheduler(db *DB) *Scheduler {
+	return &Scheduler{db: db}
+}
+
+// Schedule adds a job running fn every interval, plus a random delay of up to jitter, so jobs of the same interval
+// don't all run at once. If the job has no next run in the file yet, its first run is due after an interval too.
+//
+// fn runs in a write transaction, which is committed along with the next run of the job if it returns nil, and rolled
+// back otherwise. A failed run doesn't retry before the next interval either.
+func (s *Scheduler) Schedule(name string, interval, jitter time.Duration, fn func(tx *Tx) error) error {
+	if interval <= 0 || jitter < 0 {
+		return fmt.Errorf("job %s: invalid interval %v or jitter %v", name, interval, jitter)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.find(name) != nil {
+		return fmt.Errorf("job %s: %w", name, ErrJobExists)
+	}
+	job := &cronJob{name: name, interval: interval, jitter: jitter, fn: fn}
+	err := s.db.Update(func(tx *Tx) error {
+		collection, err := tx.getOrCreateCollection(cronCollection)
+		if err != nil {
+			return err
+		}
+		item, err := collection.Find([]byte(name))
+		if err != nil || item != nil {
+			return err
+		}
+		return s.setNextRun(collection, job)
+	})
+	if err != nil {
+		return err
+	}
+	s.jobs = append(s.jobs, job)
+	return nil
+}
+
+// Unschedule removes the job, along with its next run. A run in progress isn't interrupted.
+func (s *Scheduler) Unschedule(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job := s.find(name)
+	if job == nil {
+		return fmt.Errorf("job %s: %w", name, ErrJobNotFound)
+	}
+	err := s.db.Update(func(tx *Tx) error {
+		collection, err := tx.GetCollection(cronCollection)
+		if err != nil || collection == nil {
+			return err
+		}
+		return collection.Remove([]byte(name))
+	})
+	if err != nil {
+		return err
+	}
+	for i, j := range s.jobs {
+		if j == job {
+			s.jobs = append(s.jobs[:i], s.jobs[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// find returns the job of the given name, or nil. It's called holding mu.
+func (s *Scheduler) find(name string) *cronJob {
+	for _, job := range s.jobs {
+		if job.name == name {
+			return job
+		}
+	}
+	return nil
+}
+
+// NextRun returns when the job is due next.
+func (s *Scheduler) NextRun(name string) (time.Time, error) {
+	var next time.Time
+	err := s.db.View(func(tx *Tx) error {
+		var err error
+		var found bool
+		next, found, err = s.nextRun(tx, name)
+		if err == nil && !found {
+			err = fmt.Errorf("job %s: %w", name, ErrJobNotFound)
+		}
+		return err
+	})
+	return next, err
+}
+
+func (s *Scheduler) nextRun(tx *Tx, name string) (time.Time, bool, error) {
+	collection, err := tx.GetCollection(cronCollection)
+	if err != nil || collection == nil {
+		return time.Time{}, false, err
+	}
+	item, err := collection.Find([]byte(name))
+	if err != nil || item == nil {
+		return time.Time{}, false, err
+	}
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(item.value))), true, nil
+}
+
+// setNextRun puts the next run of the job, an interval and a jitter from now.
+func (s *Scheduler) setNextRun(collection *Collection, job *cronJob) error {
+	delay := job.interval
+	if job.jitter > 0 {
+		buf := make([]byte, 8)
+		err := s.db.readRandom(buf)
+		if err != nil {
+			return err
+		}
+		delay += time.Duration(binary.LittleEndian.Uint64(buf) % uint64(job.jitter+1))
+	}
+	next := s.db.now().Add(delay)
+	return collection.Put([]byte(job.name), binary.LittleEndian.AppendUint64(nil, uint64(next.UnixNano())))
+}
+
+// RunDue runs the jobs that are due, in the order they were scheduled, and returns how many ran. Jobs still running
+// from another call are skipped. A job failing doesn't stop the others, and the error of the first one is returned.
+func (s *Scheduler) RunDue() (int, error) {
+	s.mu.Lock()
+	jobs := append([]*cronJob{}, s.jobs...)
+	s.mu.Unlock()
+
+	ran := 0
+	var firstErr error
+	for _, job := range jobs {
+		if !s.claim(job) {
+			continue
+		}
+		done, err := s.runIfDue(job)
+		s.release(job)
+		if done {
+			ran++
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("job %s: %w", job.name, err)
+		}
+	}
+	return ran, firstErr
+}
+
+func (s *Scheduler) claim(job *cronJob) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job.running {
+		return false
+	}
+	job.running = true
+	return true
+}
+
+func (s *Scheduler) release(job *cronJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.running = false
+}
+
+// runIfDue runs the job if it's due, and reports whether it ran, even if it failed.
+func (s *Scheduler) runIfDue(job *cronJob) (bool, error) {
+	ran := false
+	var runErr error
+	err := s.db.Update(func(tx *Tx) error {
+		next, found, err := s.nextRun(tx, job.name)
+		if err != nil || (found && s.db.now().Before(next)) {
+			return err
+		}
+		ran = true
+		runErr = job.fn(tx)
+		if runErr != nil {
+			return runErr
+		}
+		collection, err := tx.getOrCreateCollection(cronCollection)
+		if err != nil {
+			return err
+		}
+		return s.setNextRun(collection, job)
+	})
+	if runErr == nil {
+		return ran, err
+	}
+
+	// The run was rolled back, so the next one is put in a transaction of its own
+	err = s.db.Update(func(tx *Tx) error {
+		collection, err := tx.getOrCreateCollection(cronCollection)
+		if err != nil {
+			return err
+		}
+		return s.setNextRun(collection, job)
+	})
+	if err != nil {
+		return true, err
+	}
+	return true, runErr
+}
+
+// Start runs RunDue every resolution in a background goroutine until Stop is called. The resolution bounds how late
+// jobs run after they're due.
+func (s *Scheduler) Start(resolution time.Duration) {
+	s.ticker.start(s.db, "scheduler", resolution, func() error {
+		_, err := s.RunDue()
+		return err
+	})
+}
+
+// Stop stops the background checks and waits for the jobs running from them to finish.
+func (s *Scheduler) Stop() {
+	s.ticker.halt()
+}
@@ -0,0 +1,160 @@
+package gopherdb
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func runDue(t *testing.T, s *Scheduler) int {
+	t.Helper()
+	ran, err := s.RunDue()
+	if err != nil {
+		t.Fatalf("RunDue: %v", err)
+	}
+	return ran
+}
+
+func TestScheduler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	clock := &testClock{now: time.Unix(1000, 0)}
+	options := testOptions()
+	options.Clock = clock
+	db := openTestPath(t, path, options)
+
+	// The job keeps a running count of its runs in the database
+	count := func(tx *Tx) error {
+		c, err := tx.getOrCreateCollection([]byte("aggregates"))
+		if err != nil {
+			return err
+		}
+		n := 0
+		item, err := c.Find([]byte("runs"))
+		if err != nil {
+			return err
+		}
+		if item != nil {
+			n, _ = strconv.Atoi(string(item.value))
+		}
+		return c.Put([]byte("runs"), []byte(strconv.Itoa(n+1)))
+	}
+	scheduler := NewScheduler(db)
+	if err := scheduler.Schedule("count", time.Minute, 10*time.Second, count); err != nil {
+		t.Fatalf("Schedule: %v", err)
+	}
+	if err := scheduler.Schedule("count", time.Minute, 0, count); !errors.Is(err, ErrJobExists) {
+		t.Fatalf("got %v, want ErrJobExists for a second job of the same name", err)
+	}
+	next, err := scheduler.NextRun("count")
+	if err != nil || next.Before(time.Unix(1060, 0)) || next.After(time.Unix(1070, 0)) {
+		t.Fatalf("got the next run at %v, %v, want an interval and a jitter away", next, err)
+	}
+
+	if ran := runDue(t, scheduler); ran != 0 {
+		t.Fatalf("%d jobs ran before they were due", ran)
+	}
+	clock.advance(70 * time.Second)
+	if ran := runDue(t, scheduler); ran != 1 {
+		t.Fatalf("%d jobs ran once due, want 1", ran)
+	}
+	if ran := runDue(t, scheduler); ran != 0 {
+		t.Fatalf("the job ran again before its next run")
+	}
+	if got := getValue(t, db, "aggregates", "runs"); got != "1" {
+		t.Fatalf("the job ran %s times", got)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The job is due while the file is closed, and runs once it's reopened
+	clock.advance(time.Hour)
+	db = openTestPath(t, path, options)
+	scheduler = NewScheduler(db)
+	if err := scheduler.Schedule("count", time.Minute, 10*time.Second, count); err != nil {
+		t.Fatal(err)
+	}
+	if ran := runDue(t, scheduler); ran != 1 {
+		t.Fatalf("%d jobs ran after reopening, want 1", ran)
+	}
+	if got := getValue(t, db, "aggregates", "runs"); got != "2" {
+		t.Fatalf("the job ran %s times", got)
+	}
+
+	if err := scheduler.Unschedule("count"); err != nil {
+		t.Fatalf("Unschedule: %v", err)
+	}
+	if _, err := scheduler.NextRun("count"); !errors.Is(err, ErrJobNotFound) {
+		t.Fatalf("got %v, want ErrJobNotFound for an unscheduled job", err)
+	}
+}
+
+func TestSchedulerFailedRun(t *testing.T) {
+	clock := &testClock{now: time.Unix(1000, 0)}
+	options := testOptions()
+	options.Clock = clock
+	db := openTestDB(t, options)
+	scheduler := NewScheduler(db)
+	failure := errors.New("failure")
+	err := scheduler.Schedule("fail", time.Minute, 0, func(tx *Tx) error {
+		if err := getOrCreate(t, tx, "c").Put([]byte("k"), []byte("v")); err != nil {
+			return err
+		}
+		return failure
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The run is rolled back, and waits for the next interval
+	clock.advance(time.Minute)
+	ran, err := scheduler.RunDue()
+	if ran != 1 || !errors.Is(err, failure) {
+		t.Fatalf("got %d runs, %v, want the failure of the run", ran, err)
+	}
+	if next, err := scheduler.NextRun("fail"); err != nil || !next.Equal(time.Unix(1120, 0)) {
+		t.Fatalf("got the next run at %v, %v, want an interval after the failure", next, err)
+	}
+	mustView(t, db, func(tx *Tx) error {
+		c, err := tx.GetCollection([]byte("c"))
+		if err != nil || c != nil {
+			t.Fatalf("got %v, %v, want the writes of the failed run rolled back", c, err)
+		}
+		return nil
+	})
+}
+
+func TestSchedulerSkipsRunningJobs(t *testing.T) {
+	clock := &testClock{now: time.Unix(1000, 0)}
+	options := testOptions()
+	options.Clock = clock
+	db := openTestDB(t, options)
+	scheduler := NewScheduler(db)
+	runs := map[string]int{}
+	for _, name := range []string{"first", "second"} {
+		name := name
+		err := scheduler.Schedule(name, time.Minute, 0, func(tx *Tx) error {
+			runs[name]++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The second job is still running from another check, which is left to run it
+	clock.advance(time.Minute)
+	second := scheduler.jobs[1]
+	if !scheduler.claim(second) {
+		t.Fatal("couldn't claim a job that isn't running")
+	}
+	if ran := runDue(t, scheduler); ran != 1 || runs["first"] != 1 || runs["second"] != 0 {
+		t.Fatalf("%d jobs ran (%v), want the one that isn't running", ran, runs)
+	}
+	scheduler.release(second)
+	if ran := runDue(t, scheduler); ran != 1 || runs["second"] != 1 {
+		t.Fatalf("%d jobs ran (%v), want the one that was running", ran, runs)
+	}
+}
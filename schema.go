@@ -0,0 +1,166 @@
+package gopherdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// schemaVersion is the version of the schema documents written by WriteSchema. Version 2 adds the nested collections,
+// which older versions would drop.
+const schemaVersion = 2
+
+var ErrSchemaNotEmpty = errors.New("can't apply a schema to a database that already has collections")
+var ErrUnsupportedSchema = errors.New("the schema was written by a newer version")
+
+// Schema is the logical layout of a database: its collections and their options, without their keys. It's written as
+// JSON by WriteSchema and applied to an empty database by ApplySchema, so new files can be set up the same way before
+// their data is loaded.
+type Schema struct {
+	Version int `json:"version"`
+	// PageSize is the page size of the database the schema was taken from. ApplySchema fails with ErrPageSizeMismatch
+	// on a database of another page size, since the options of the collections depend on it.
+	PageSize    int                `json:"page_size"`
+	Collections []CollectionSchema `json:"collections"`
+}
+
+// CollectionSchema describes a collection of a Schema. The indexes of NewIndex are collections like the others, so they
+// show up in the schema under their own names.
+type CollectionSchema struct {
+	Name string `json:"name"`
+	// InlineValueThreshold is the threshold of Collection.SetInlineThreshold, zero if the collection uses the one of
+	// the options.
+	InlineValueThreshold int `json:"inline_value_threshold,omitempty"`
+	// Collections are the collections nested in the collection, sorted by name, see Collection.CreateCollection.
+	Collections []CollectionSchema `json:"collections,omitempty"`
+}
+
+// internalPrefix starts the names of the collections the database keeps for itself.
+var internalPrefix = []byte("__gopherdb_")
+
+// isInternalCollection reports whether the collection is kept by the database for itself, like the checkpoints of
+// Options.Checkpoints, which belong to the file rather than to its schema. Every name starting with internalPrefix is
+// reserved, including the ones of collections later versions may add.
+func isInternalCollection(name []byte) bool {
+	return bytes.HasPrefix(name, internalPrefix)
+}
+
+// Schema returns the schema of the database as the transaction sees it, with the collections sorted by name, and the
+// collections nested in them. Collection names must be valid UTF-8 to be written as JSON.
+func (tx *Tx) Schema() (*Schema, error) {
+	collections, err := tx.allCollections()
+	if err != nil {
+		return nil, err
+	}
+	schema := &Schema{Version: schemaVersion, PageSize: tx.db.pageSize, Collections: []CollectionSchema{}}
+	for _, collection := range collections {
+		if isInternalCollection(collection.name) {
+			continue
+		}
+		spec, err := collection.schema()
+		if err != nil {
+			return nil, err
+		}
+		schema.Collections = append(schema.Collections, spec)
+	}
+	return schema, nil
+}
+
+// schema returns the schema of the collection, with the collections nested in it.
+func (c *Collection) schema() (CollectionSchema, error) {
+	if !utf8.Valid(c.name) {
+		return CollectionSchema{}, fmt.Errorf("collection %q: name isn't valid UTF-8", c.name)
+	}
+	spec := CollectionSchema{Name: string(c.name), InlineValueThreshold: c.inlineValueThreshold}
+	err := c.tx.rangeStored(c.root, KeyRange{}, func(item *Item) (bool, error) {
+		if !item.collection {
+			return true, nil
+		}
+		nested, err := c.nested(item).schema()
+		if err != nil {
+			return false, err
+		}
+		spec.Collections = append(spec.Collections, nested)
+		return true, nil
+	})
+	if err != nil {
+		return CollectionSchema{}, fmt.Errorf("collection %q: %w", c.name, err)
+	}
+	return spec, nil
+}
+
+// WriteSchema writes the schema of the database to w as indented JSON, see Schema.
+func (tx *Tx) WriteSchema(w io.Writer) error {
+	schema, err := tx.Schema()
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(schema)
+}
+
+// ReadSchema reads a schema written by WriteSchema. Schemas of a newer version fail with ErrUnsupportedSchema.
+func ReadSchema(r io.Reader) (*Schema, error) {
+	schema := &Schema{}
+	err := json.NewDecoder(r).Decode(schema)
+	if err != nil {
+		return nil, err
+	}
+	if schema.Version > schemaVersion {
+		return nil, ErrUnsupportedSchema
+	}
+	return schema, nil
+}
+
+// ApplySchema creates the collections of the schema, with their options, in a database that has none yet. It fails
+// with ErrSchemaNotEmpty if the database already has a collection, other than the ones the database keeps for itself,
+// and with ErrPageSizeMismatch if the schema was taken from a database of another page size. Nothing is created if it
+// fails, as long as the transaction is rolled back.
+func (tx *Tx) ApplySchema(schema *Schema) error {
+	if !tx.write {
+		return ErrWriteInsideReadTx
+	}
+	if schema.Version > schemaVersion {
+		return ErrUnsupportedSchema
+	}
+	if schema.PageSize != 0 && schema.PageSize != tx.db.pageSize {
+		return ErrPageSizeMismatch
+	}
+	collections, err := tx.allCollections()
+	if err != nil {
+		return err
+	}
+	for _, collection := range collections {
+		if !isInternalCollection(collection.name) {
+			return ErrSchemaNotEmpty
+		}
+	}
+
+	return applyCollections(schema.Collections, tx.CreateCollection)
+}
+
+// applyCollections creates the collections of the specs with create, and the collections nested in them.
+func applyCollections(specs []CollectionSchema, create func(name []byte) (*Collection, error)) error {
+	seen := map[string]bool{}
+	for _, spec := range specs {
+		if seen[spec.Name] {
+			return fmt.Errorf("collection %q is in the schema twice", spec.Name)
+		}
+		seen[spec.Name] = true
+		collection, err := create([]byte(spec.Name))
+		if err == nil && spec.InlineValueThreshold != 0 {
+			err = collection.SetInlineThreshold(spec.InlineValueThreshold)
+		}
+		if err == nil {
+			err = applyCollections(spec.Collections, collection.CreateCollection)
+		}
+		if err != nil {
+			return fmt.Errorf("collection %q: %w", spec.Name, err)
+		}
+	}
+	return nil
+}
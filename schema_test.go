@@ -0,0 +1,100 @@
+package gopherdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSchemaRoundTrip(t *testing.T) {
+	options := testOptions()
+	options.Checkpoints = []CheckpointTier{{Every: time.Nanosecond, For: time.Hour}}
+	src := openTestDB(t, options)
+	mustUpdate(t, src, func(tx *Tx) error {
+		getOrCreate(t, tx, "users")
+		if err := nestedCollection(t, tx, "users", "alice", "settings").SetInlineThreshold(32); err != nil {
+			return err
+		}
+		nestedCollection(t, tx, "users", "carol")
+		return getOrCreate(t, tx, "blobs").SetInlineThreshold(64)
+	})
+	putValue(t, src, "users", "bob", "admin")
+
+	var buf bytes.Buffer
+	mustView(t, src, func(tx *Tx) error {
+		return tx.WriteSchema(&buf)
+	})
+	schema, err := ReadSchema(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CollectionSchema{{Name: "blobs", InlineValueThreshold: 64}, {Name: "users", Collections: []CollectionSchema{
+		{Name: "alice", Collections: []CollectionSchema{{Name: "settings", InlineValueThreshold: 32}}},
+		{Name: "carol"},
+	}}}
+	if !reflect.DeepEqual(schema.Collections, want) {
+		t.Fatalf("got collections %+v, want %+v without the checkpoints", schema.Collections, want)
+	}
+
+	dst := openTestDB(t, options)
+	mustUpdate(t, dst, func(tx *Tx) error {
+		return tx.ApplySchema(schema)
+	})
+	mustView(t, dst, func(tx *Tx) error {
+		blobs, err := tx.GetCollection([]byte("blobs"))
+		if err != nil {
+			return err
+		}
+		if blobs == nil || blobs.inlineValueThreshold != 64 {
+			t.Fatalf("got collection %v, want blobs with its inline threshold", blobs)
+		}
+		users, err := tx.GetCollection([]byte("users"))
+		if err != nil {
+			return err
+		}
+		if users == nil {
+			t.Fatal("users wasn't created")
+		}
+		if _, err := users.Get([]byte("bob")); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("got %v, want ErrKeyNotFound: the schema has no keys", err)
+		}
+		if settings := nestedCollection(t, tx, "users", "alice", "settings"); settings.inlineValueThreshold != 32 {
+			t.Fatalf("got nested collection %v, want settings with its inline threshold", settings)
+		}
+		return nil
+	})
+	mustView(t, dst, func(tx *Tx) error {
+		got, err := tx.Schema()
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(got.Collections, want) {
+			t.Fatalf("schema of the applied schema: got %+v, want %+v", got.Collections, want)
+		}
+		return nil
+	})
+
+	err = dst.Update(func(tx *Tx) error {
+		return tx.ApplySchema(schema)
+	})
+	if !errors.Is(err, ErrSchemaNotEmpty) {
+		t.Fatalf("got %v, want ErrSchemaNotEmpty", err)
+	}
+}
+
+func TestApplySchemaChecksPageSize(t *testing.T) {
+	db := openTestDB(t, nil)
+	err := db.Update(func(tx *Tx) error {
+		return tx.ApplySchema(&Schema{Version: schemaVersion, PageSize: 4096, Collections: []CollectionSchema{{Name: "c"}}})
+	})
+	if !errors.Is(err, ErrPageSizeMismatch) {
+		t.Fatalf("got %v, want ErrPageSizeMismatch", err)
+	}
+	_, err = ReadSchema(bytes.NewBufferString(fmt.Sprintf(`{"version": %d}`, schemaVersion+1)))
+	if !errors.Is(err, ErrUnsupportedSchema) {
+		t.Fatalf("got %v, want ErrUnsupportedSchema", err)
+	}
+}
@@ -0,0 +1,189 @@
+package gopherdb
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+)
+
+// sessionIDSize is the number of random bytes in a session id. The id itself is hex encoded.
+const sessionIDSize = 16
+
+// Sessions is a session store with sliding expiration. Every session expires once it wasn't touched for the TTL of the
+// store. Expired sessions are never returned, and are deleted by Cleanup, which can also run periodically in the
+// background with StartCleanup.
+//
+// A session value starts with its expiration time as unix nanoseconds, followed by the session data. Values too short to
+// hold the expiration time are taken as expired sessions, which are never returned and are deleted by Cleanup.
+type Sessions struct {
+	db         *DB
+	collection []byte
+	ttl        time.Duration
+
+	cleanup periodic
+}
+
+// NewSessions returns a session store keeping its sessions in the given collection. The collection is created when the
+// first session is created.
+func NewSessions(db *DB, collection string, ttl time.Duration) *Sessions {
+	return &Sessions{
+		db:         db,
+		collection: []byte(collection),
+		ttl:        ttl,
+	}
+}
+
+func (s *Sessions) newSessionID() (string, error) {
+	buf := make([]byte, sessionIDSize)
+	err := s.db.readRandom(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func (s *Sessions) encode(data []byte, now time.Time) []byte {
+	buf := make([]byte, 0, 8+len(data))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(now.Add(s.ttl).UnixNano()))
+	return append(buf, data...)
+}
+
+func sessionExpired(value []byte, now time.Time) bool {
+	return len(value) < 8 || now.UnixNano() >= int64(binary.LittleEndian.Uint64(value))
+}
+
+// find returns the session collection and the value of a live session, or a nil value if there's no such session.
+func (s *Sessions) find(tx *Tx, id string) (*Collection, []byte, error) {
+	collection, err := tx.GetCollection(s.collection)
+	if err != nil || collection == nil {
+		return nil, nil, err
+	}
+	item, err := collection.Find([]byte(id))
+	if err != nil || item == nil || sessionExpired(item.value, s.db.now()) {
+		return collection, nil, err
+	}
+	return collection, item.value, nil
+}
+
+// Create creates a session holding the data and returns its id.
+func (s *Sessions) Create(tx *Tx, data []byte) (string, error) {
+	if !tx.write {
+		return "", ErrWriteInsideReadTx
+	}
+	collection, err := tx.getOrCreateCollection(s.collection)
+	if err != nil {
+		return "", err
+	}
+	id, err := s.newSessionID()
+	if err != nil {
+		return "", err
+	}
+	return id, collection.Put([]byte(id), s.encode(data, s.db.now()))
+}
+
+// Get returns the data of the session, or nil if the session doesn't exist or expired. Get doesn't extend the session,
+// call Touch for that.
+func (s *Sessions) Get(tx *Tx, id string) ([]byte, error) {
+	_, value, err := s.find(tx, id)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return value[8:], nil
+}
+
+// Touch extends the session by the TTL from now. ErrKeyNotFound is returned if the session doesn't exist or expired.
+func (s *Sessions) Touch(tx *Tx, id string) error {
+	if !tx.write {
+		return ErrWriteInsideReadTx
+	}
+	collection, value, err := s.find(tx, id)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return ErrKeyNotFound
+	}
+	return collection.Put([]byte(id), s.encode(value[8:], s.db.now()))
+}
+
+// Update replaces the data of the session and extends it by the TTL from now. ErrKeyNotFound is returned if the session
+// doesn't exist or expired.
+func (s *Sessions) Update(tx *Tx, id string, data []byte) error {
+	if !tx.write {
+		return ErrWriteInsideReadTx
+	}
+	collection, value, err := s.find(tx, id)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return ErrKeyNotFound
+	}
+	return collection.Put([]byte(id), s.encode(data, s.db.now()))
+}
+
+// Destroy deletes the session.
+func (s *Sessions) Destroy(tx *Tx, id string) error {
+	if !tx.write {
+		return ErrWriteInsideReadTx
+	}
+	collection, err := tx.GetCollection(s.collection)
+	if err != nil || collection == nil {
+		return err
+	}
+	return collection.Remove([]byte(id))
+}
+
+// Cleanup deletes all the expired sessions inside a write transaction and returns how many sessions were deleted.
+func (s *Sessions) Cleanup() (int, error) {
+	tx, err := s.db.WriteTx()
+	if err != nil {
+		return 0, err
+	}
+	collection, err := tx.GetCollection(s.collection)
+	if err != nil || collection == nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	now := s.db.now()
+	var expired [][]byte
+	err = tx.walk(collection.root, func(n *Node) error {
+		for _, item := range n.items {
+			item, err := collection.resolveItem(item)
+			if err != nil {
+				return err
+			}
+			if sessionExpired(item.value, now) {
+				expired = append(expired, item.key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	for _, id := range expired {
+		err = collection.Remove(id)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	return len(expired), tx.Commit()
+}
+
+// StartCleanup runs Cleanup every interval in a background goroutine until StopCleanup is called.
+func (s *Sessions) StartCleanup(interval time.Duration) {
+	s.cleanup.start(s.db, "sessions cleanup of "+string(s.collection), interval, func() error {
+		_, err := s.Cleanup()
+		return err
+	})
+}
+
+// StopCleanup stops the background cleanup and waits for a running cleanup to finish.
+func (s *Sessions) StopCleanup() {
+	s.cleanup.halt()
+}
@@ -0,0 +1,137 @@
+package gopherdb
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func createSession(t *testing.T, db *DB, sessions *Sessions, data string) string {
+	t.Helper()
+	var id string
+	mustUpdate(t, db, func(tx *Tx) error {
+		var err error
+		id, err = sessions.Create(tx, []byte(data))
+		return err
+	})
+	return id
+}
+
+func getSession(t *testing.T, db *DB, sessions *Sessions, id string) []byte {
+	t.Helper()
+	var data []byte
+	mustView(t, db, func(tx *Tx) error {
+		var err error
+		data, err = sessions.Get(tx, id)
+		return err
+	})
+	return data
+}
+
+func TestSessionsSlideOnTouch(t *testing.T) {
+	db := openTestDB(t, nil)
+	sessions := NewSessions(db, "sessions", 300*time.Millisecond)
+	id := createSession(t, db, sessions, "cart")
+	if other := createSession(t, db, sessions, "cart"); other == id || len(id) != 2*sessionIDSize {
+		t.Errorf("session ids %q and %q, want two different ids of %d hex digits", id, other, 2*sessionIDSize)
+	}
+	if data := getSession(t, db, sessions, id); string(data) != "cart" {
+		t.Errorf("Get: got %q, want cart", data)
+	}
+
+	// The session is touched before it expires, and lives past the TTL from its creation
+	time.Sleep(200 * time.Millisecond)
+	mustUpdate(t, db, func(tx *Tx) error {
+		return sessions.Update(tx, id, []byte("cart with items"))
+	})
+	time.Sleep(200 * time.Millisecond)
+	mustUpdate(t, db, func(tx *Tx) error {
+		return sessions.Touch(tx, id)
+	})
+	if data := getSession(t, db, sessions, id); string(data) != "cart with items" {
+		t.Errorf("Get after Update and Touch: got %q, want cart with items", data)
+	}
+
+	mustUpdate(t, db, func(tx *Tx) error {
+		return sessions.Destroy(tx, id)
+	})
+	if data := getSession(t, db, sessions, id); data != nil {
+		t.Errorf("Get after Destroy: got %q, want nil", data)
+	}
+}
+
+func TestExpiredSessionsAreGoneAndCleanedUp(t *testing.T) {
+	db := openTestDB(t, nil)
+	// Sessions of a store with a negative TTL are expired as soon as they're created
+	expired := NewSessions(db, "sessions", -time.Second)
+	live := NewSessions(db, "sessions", time.Hour)
+	old := createSession(t, db, expired, "old")
+	createSession(t, db, expired, "older")
+	current := createSession(t, db, live, "current")
+
+	if data := getSession(t, db, live, old); data != nil {
+		t.Errorf("Get of an expired session: got %q, want nil", data)
+	}
+	mustUpdate(t, db, func(tx *Tx) error {
+		if err := live.Touch(tx, old); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Touch of an expired session: got %v, want ErrKeyNotFound", err)
+		}
+		if err := live.Update(tx, old, []byte("new")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Update of an expired session: got %v, want ErrKeyNotFound", err)
+		}
+		return nil
+	})
+
+	deleted, err := live.Cleanup()
+	if err != nil || deleted != 2 {
+		t.Errorf("Cleanup: got %d, %v, want 2 deleted sessions", deleted, err)
+	}
+	if data := getSession(t, db, live, current); string(data) != "current" {
+		t.Errorf("Get of the live session after Cleanup: got %q, want current", data)
+	}
+
+	createSession(t, db, expired, "expired")
+	live.StartCleanup(time.Millisecond)
+	defer live.StopCleanup()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var items int
+		mustView(t, db, func(tx *Tx) error {
+			return getOrCreate(t, tx, "sessions").Scan(nil, func(key, value []byte) error {
+				items++
+				return nil
+			})
+		})
+		if items == 1 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the background cleanup didn't delete the expired session")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMalformedSessionsAreExpired(t *testing.T) {
+	db := openTestDB(t, nil)
+	sessions := NewSessions(db, "sessions", time.Hour)
+	current := createSession(t, db, sessions, "current")
+	putValue(t, db, "sessions", "short", "abc")
+
+	if data := getSession(t, db, sessions, "short"); data != nil {
+		t.Errorf("Get of a malformed session: got %q, want nil", data)
+	}
+	mustUpdate(t, db, func(tx *Tx) error {
+		if err := sessions.Touch(tx, "short"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Touch of a malformed session: got %v, want ErrKeyNotFound", err)
+		}
+		return nil
+	})
+	deleted, err := sessions.Cleanup()
+	if err != nil || deleted != 1 {
+		t.Errorf("Cleanup: got %d, %v, want the malformed session deleted", deleted, err)
+	}
+	if data := getSession(t, db, sessions, current); string(data) != "current" {
+		t.Errorf("Get of the live session after Cleanup: got %q, want current", data)
+	}
+}
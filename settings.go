@@ -0,0 +1,108 @@
+package gopherdb
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidSetting = errors.New("invalid setting")
+
+// Setting is an option that can be changed while the file is open, with DB.SetOption, to tune a database without
+// closing it. The other fields of Options are fixed until the file is closed: the page size and the format options,
+// like JournalFreelist and WAL, because the file is written with them, and the rest because Open sets things up with
+// them, like the lock of the file or the checkpoints kept.
+type Setting int
+
+const (
+	// SettingMinFillPercent and SettingMaxFillPercent are Options.MinFillPercent and Options.MaxFillPercent, as a
+	// float32. Nodes are rebalanced with the new values as they're written, not all at once. The gap between them
+	// bounds the size of the items a node holds, see DB.MaxKeySize, so it can't narrow: the items already in the file
+	// must still fit in the nodes they're split into.
+	SettingMinFillPercent Setting = iota
+	SettingMaxFillPercent
+	// SettingNodeCacheSize is Options.NodeCacheSize, as an int. Shrinking the cache evicts the nodes used least
+	// recently, and zero empties it.
+	SettingNodeCacheSize
+	// SettingNoSync is Options.NoSync, as a bool. Turning it off doesn't sync the commits made with it, see DB.Sync.
+	SettingNoSync
+)
+
+func (s Setting) String() string {
+	switch s {
+	case SettingMinFillPercent:
+		return "MinFillPercent"
+	case SettingMaxFillPercent:
+		return "MaxFillPercent"
+	case SettingNodeCacheSize:
+		return "NodeCacheSize"
+	case SettingNoSync:
+		return "NoSync"
+	}
+	return fmt.Sprintf("Setting(%d)", int(s))
+}
+
+// SetOption changes a setting of the file, which every handle of the file then uses, once the write transaction running
+// ends. The value must have the type the setting documents, and a value that isn't valid fails with ErrInvalidSetting,
+// leaving the setting as it was. Read-only handles can't change settings.
+func (db *DB) SetOption(setting Setting, value interface{}) error {
+	if db.readOnly.Load() {
+		return ErrWriteInsideReadTx
+	}
+	err := db.begin()
+	if err != nil {
+		return err
+	}
+	db.rwlock.Lock()
+	defer db.endTx(true)
+
+	switch setting {
+	case SettingMinFillPercent, SettingMaxFillPercent:
+		percent, ok := value.(float32)
+		if !ok {
+			return settingTypeError(setting, value, "a float32")
+		}
+		return db.setFillPercents(setting, percent)
+	case SettingNodeCacheSize:
+		size, ok := value.(int)
+		if !ok {
+			return settingTypeError(setting, value, "an int")
+		}
+		if size < 0 {
+			return fmt.Errorf("%w: %v can't be negative", ErrInvalidSetting, setting)
+		}
+		db.nodeCache.resize(size)
+		return nil
+	case SettingNoSync:
+		noSync, ok := value.(bool)
+		if !ok {
+			return settingTypeError(setting, value, "a bool")
+		}
+		db.noSync = noSync
+		return nil
+	}
+	return fmt.Errorf("%w: %v", ErrInvalidSetting, setting)
+}
+
+func settingTypeError(setting Setting, value interface{}, want string) error {
+	return fmt.Errorf("%w: %v takes %s, not %T", ErrInvalidSetting, setting, want, value)
+}
+
+// setFillPercents changes one of the fill percents, if they still leave room to rebalance and don't lower the size of
+// the biggest item.
+func (db *DB) setFillPercents(setting Setting, percent float32) error {
+	sizes := &dal{pageSize: db.pageSize, minFillPercent: db.minFillPercent, maxFillPercent: db.maxFillPercent}
+	if setting == SettingMinFillPercent {
+		sizes.minFillPercent = percent
+	} else {
+		sizes.maxFillPercent = percent
+	}
+	if sizes.minFillPercent <= 0 || sizes.maxFillPercent > 1 || sizes.minFillPercent >= sizes.maxFillPercent {
+		return fmt.Errorf("%w: fill percents %.2f and %.2f don't leave room to rebalance", ErrInvalidSetting,
+			sizes.minFillPercent, sizes.maxFillPercent)
+	}
+	if sizes.maxElementSize() < db.maxElementSize() {
+		return fmt.Errorf("%w: %v of %.2f lowers the size of the biggest item", ErrInvalidSetting, setting, percent)
+	}
+	db.minFillPercent, db.maxFillPercent = sizes.minFillPercent, sizes.maxFillPercent
+	return nil
+}
@@ -0,0 +1,93 @@
+package gopherdb
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSetOption(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 200; i++ {
+		putValue(t, db, "c", string(testKey(i)), "value")
+	}
+	if stats := db.NodeCacheStats(); stats != (NodeCacheStats{}) {
+		t.Fatalf("got %+v without a cache", stats)
+	}
+
+	// The cache starts caching once it's given room, and shrinks back
+	if err := db.SetOption(SettingNodeCacheSize, 8); err != nil {
+		t.Fatalf("SetOption: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		getValue(t, db, "c", string(testKey(i)))
+	}
+	if stats := db.NodeCacheStats(); stats.Nodes == 0 || stats.Nodes > 8 || stats.Hits == 0 {
+		t.Fatalf("got %+v with a cache of 8 nodes", stats)
+	}
+	if err := db.SetOption(SettingNodeCacheSize, 0); err != nil {
+		t.Fatal(err)
+	}
+	if stats := db.NodeCacheStats(); stats.Nodes != 0 {
+		t.Fatalf("the emptied cache holds %d nodes", stats.Nodes)
+	}
+
+	if err := db.SetOption(SettingNoSync, true); err != nil || !db.noSync {
+		t.Fatalf("got %v, NoSync %v", err, db.noSync)
+	}
+	putValue(t, db, "c", "k", "v")
+
+	// Widening the fill percents lets nodes hold more, and splits happen later
+	maxKey := db.MaxKeySize()
+	if err := db.SetOption(SettingMaxFillPercent, float32(1)); err != nil {
+		t.Fatalf("SetOption: %v", err)
+	}
+	if db.MaxKeySize() <= maxKey {
+		t.Fatalf("MaxKeySize is %d after widening the fill percents, was %d", db.MaxKeySize(), maxKey)
+	}
+	for i := 200; i < 400; i++ {
+		putValue(t, db, "c", string(testKey(i)), "value")
+	}
+	mustView(t, db, func(tx *Tx) error {
+		keys, err := readAll(tx, "c")
+		if err == nil && len(keys) != 401 {
+			t.Fatalf("the collection holds %d keys, want 401", len(keys))
+		}
+		return err
+	})
+}
+
+func TestSetOptionValidation(t *testing.T) {
+	db := openTestDB(t, nil)
+	for _, c := range []struct {
+		setting Setting
+		value   interface{}
+	}{
+		{SettingNodeCacheSize, "8"},
+		{SettingNodeCacheSize, -1},
+		{SettingNoSync, 1},
+		{SettingMaxFillPercent, 0.9},
+		{SettingMaxFillPercent, float32(1.5)},
+		{SettingMinFillPercent, float32(0)},
+		// Narrowing the gap between the fill percents would leave items too big for their nodes
+		{SettingMinFillPercent, float32(0.6)},
+		{SettingMaxFillPercent, float32(0.9)},
+		{Setting(99), true},
+	} {
+		if err := db.SetOption(c.setting, c.value); !errors.Is(err, ErrInvalidSetting) {
+			t.Errorf("SetOption(%v, %#v): got %v, want ErrInvalidSetting", c.setting, c.value, err)
+		}
+	}
+	if db.minFillPercent != DefaultOptions.MinFillPercent || db.maxFillPercent != DefaultOptions.MaxFillPercent {
+		t.Fatalf("the fill percents changed to %v and %v", db.minFillPercent, db.maxFillPercent)
+	}
+
+	// Views of the file can't change its settings
+	view, err := Open(db.shared.path, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer view.Close()
+	if err := view.SetOption(SettingNoSync, true); !errors.Is(err, ErrWriteInsideReadTx) {
+		t.Fatalf("got %v from a view, want ErrWriteInsideReadTx", err)
+	}
+}
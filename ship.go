@@ -0,0 +1,252 @@
+package gopherdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	segmentMagic      uint32 = 0x53454721
+	segmentHeaderSize        = magicNumberSize + 2*txIDSize + 4 + 4
+	segmentExtension         = ".seg"
+)
+
+// Segments are shipped to Options.ShipDir by the commits of the primary, and applied by a Standby. A segment holds the
+// pages written by the commits after its from txid, up to and including its to txid, as they were when the last of
+// them committed. Applying it to a file at the from txid brings the file to the to txid, meta page included.
+//
+// A commit failing to ship its segment doesn't fail, since it's already done: its pages are shipped with the segment
+// of the next commit, or by Close, which returns the error if it fails again.
+
+func segmentName(from uint64, to uint64) string {
+	return fmt.Sprintf("%020d-%020d%s", from, to, segmentExtension)
+}
+
+// recordPage keeps a copy of a page written to the file, to ship it with the next segment.
+func (d *dal) recordPage(p *page) {
+	if d.shipDir == "" {
+		return
+	}
+	if d.unshipped == nil {
+		d.unshipped = map[pgnum][]byte{}
+	}
+	d.unshipped[p.num] = append([]byte{}, p.data...)
+}
+
+// ship writes the pages written since the last shipped segment into a new segment. The segment is written to a
+// temporary file and renamed, so a standby never sees it half written.
+func (d *dal) ship() error {
+	if d.shipDir == "" || d.txid == d.shippedTxID {
+		return nil
+	}
+
+	pageNums := make([]pgnum, 0, len(d.unshipped))
+	for pageNum := range d.unshipped {
+		pageNums = append(pageNums, pageNum)
+	}
+	sort.Slice(pageNums, func(i, j int) bool { return pageNums[i] < pageNums[j] })
+
+	buf := make([]byte, 0, segmentHeaderSize+len(pageNums)*(pageNumSize+d.pageSize))
+	buf = binary.LittleEndian.AppendUint32(buf, segmentMagic)
+	buf = binary.LittleEndian.AppendUint64(buf, d.shippedTxID)
+	buf = binary.LittleEndian.AppendUint64(buf, d.txid)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(d.pageSize))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(pageNums)))
+	for _, pageNum := range pageNums {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(pageNum))
+		buf = append(buf, d.unshipped[pageNum]...)
+	}
+
+	name := segmentName(d.shippedTxID, d.txid)
+	tmp, err := os.CreateTemp(d.shipDir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(d.shipDir, name))
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	d.shippedTxID = d.txid
+	d.unshipped = nil
+	return nil
+}
+
+// Standby is a read-only copy of a database kept up to date from the segments shipped by the primary, see
+// Options.ShipDir. It can be promoted to read-write when the primary is lost.
+type Standby struct {
+	db      *DB
+	dir     string
+	applier periodic
+
+	mu  sync.Mutex
+	err error
+}
+
+// OpenStandby opens the database file as a standby applying the segments found in dir every interval. The file must be
+// a copy of the primary taken at a txid some segment starts from, or not exist if the primary shipped its segments
+// from its creation, in which case it's created like the primary was, with the same page size. Write transactions of
+// the standby fail with ErrWriteInsideReadTx until it's promoted, and read transactions see every segment applied so
+// far.
+//
+// Segments already applied can be deleted, which is the case of the ones ending at or before the txid of the last
+// read transaction of the standby.
+func OpenStandby(path string, dir string, interval time.Duration, options *Options) (*Standby, error) {
+	db, err := Open(path, options)
+	if err != nil {
+		return nil, err
+	}
+	db.readOnly.Store(true)
+	s := &Standby{db: db, dir: dir}
+	s.catchUp()
+	s.applier.start(db, "standby catch-up from "+dir, interval, func() error {
+		s.catchUp()
+		return s.Err()
+	})
+	return s, nil
+}
+
+// DB returns the database of the standby, for reading it.
+func (s *Standby) DB() *DB {
+	return s.db
+}
+
+// Err returns the error that stopped the last attempt to apply segments, or nil if it succeeded. Failed attempts are
+// retried every interval.
+func (s *Standby) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Promote stops applying segments, applies the ones that arrived since the last attempt and makes the database
+// read-write. The segments must not be shipped anymore: commits of the promoted database and of the old primary
+// diverge.
+func (s *Standby) Promote() (*DB, error) {
+	s.applier.halt()
+	s.catchUp()
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	s.db.readOnly.Store(false)
+	return s.db, nil
+}
+
+// Close stops applying segments and closes the database.
+func (s *Standby) Close() error {
+	s.applier.halt()
+	return s.db.Close()
+}
+
+// catchUp applies the segments following each other from the txid of the file, until there's none left.
+func (s *Standby) catchUp() {
+	err := s.applyAll()
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+func (s *Standby) applyAll() error {
+	for {
+		path, err := s.nextSegment()
+		if err != nil || path == "" {
+			return err
+		}
+		err = s.apply(path)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// nextSegment returns the path of the segment starting at the txid of the file, or an empty path if there's none. If
+// several segments start there, the one going the furthest is picked.
+func (s *Standby) nextSegment() (string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return "", err
+	}
+	var path string
+	var furthest uint64
+	for _, entry := range entries {
+		var from, to uint64
+		n, _ := fmt.Sscanf(entry.Name(), "%020d-%020d"+segmentExtension, &from, &to)
+		if n != 2 || entry.Name() != segmentName(from, to) {
+			continue
+		}
+		if from == s.db.txid && to > from && (path == "" || to > furthest) {
+			path, furthest = filepath.Join(s.dir, entry.Name()), to
+		}
+	}
+	return path, nil
+}
+
+// apply writes the pages of the segment to the file and reloads the meta and freelist pages. It holds the lock of
+// write transactions and waits for the read transactions to end, since the pages of the segment can be pages they
+// read, so no transaction sees a segment half applied. It doesn't keep read transactions from beginning while it waits,
+// since they can be begun by other read transactions, which would never end, so it takes the lock once none runs.
+func (s *Standby) apply(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) < segmentHeaderSize || binary.LittleEndian.Uint32(data) != segmentMagic {
+		return ErrCorruptSegment
+	}
+	from := binary.LittleEndian.Uint64(data[magicNumberSize:])
+	pageSize := int(binary.LittleEndian.Uint32(data[magicNumberSize+2*txIDSize:]))
+	count := int(binary.LittleEndian.Uint32(data[magicNumberSize+2*txIDSize+4:]))
+	if from != s.db.txid || pageSize != s.db.pageSize || len(data) != segmentHeaderSize+count*(pageNumSize+pageSize) {
+		return ErrCorruptSegment
+	}
+
+	s.db.rwlock.Lock()
+	defer s.db.rwlock.Unlock()
+	for !s.db.snapshotMu.TryLock() {
+		time.Sleep(lockRetryInterval)
+	}
+	defer s.db.snapshotMu.Unlock()
+	s.db.segmentsApplied++
+	body := data[segmentHeaderSize:]
+	for i := 0; i < count; i++ {
+		entry := body[i*(pageNumSize+pageSize):]
+		p := &page{num: pgnum(binary.LittleEndian.Uint64(entry)), data: entry[pageNumSize : pageNumSize+pageSize]}
+		err = s.db.writePage(p)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.db.commitPages()
+	if err != nil {
+		return err
+	}
+
+	meta, err := s.db.readMeta()
+	if err != nil {
+		return err
+	}
+	// The freelist is read from the page of the new meta
+	s.db.meta = meta
+	freelist, err := s.db.loadFreelist()
+	if err != nil {
+		return err
+	}
+	s.db.freelist = freelist
+	s.db.publishState()
+	return nil
+}
@@ -0,0 +1,82 @@
+package gopherdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStandbyAppliesSegmentsAndPromotes(t *testing.T) {
+	dir := t.TempDir()
+	options := testOptions()
+	options.ShipDir = filepath.Join(dir, "segments")
+	if err := os.Mkdir(options.ShipDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	primary := openTestPath(t, filepath.Join(dir, "primary.db"), options)
+	for i := 0; i < 20; i++ {
+		mustUpdate(t, primary, func(tx *Tx) error {
+			return getOrCreate(t, tx, "c").Put([]byte(fmt.Sprintf("key%02d", i)), []byte("value"))
+		})
+	}
+
+	standby, err := OpenStandby(filepath.Join(dir, "standby.db"), options.ShipDir, time.Hour, testOptions())
+	if err != nil {
+		t.Fatalf("OpenStandby: %v", err)
+	}
+	defer standby.Close()
+	if err := standby.Err(); err != nil {
+		t.Fatalf("applying the segments: %v", err)
+	}
+	mustView(t, standby.DB(), func(tx *Tx) error {
+		value, err := getOrCreate(t, tx, "c").Get([]byte("key19"))
+		if err != nil || string(value) != "value" {
+			t.Errorf("key19 of the standby: %q, %v", value, err)
+		}
+		return nil
+	})
+	err = standby.DB().Update(func(tx *Tx) error {
+		return getOrCreate(t, tx, "c").Put([]byte("key"), []byte("value"))
+	})
+	if !errors.Is(err, ErrWriteInsideReadTx) {
+		t.Fatalf("write on the standby: got %v, want ErrWriteInsideReadTx", err)
+	}
+
+	// Transactions begin while the standby is promoted
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			// Until the standby is promoted, write transactions fail to begin
+			tx, err := standby.DB().WriteTx()
+			if errors.Is(err, ErrWriteInsideReadTx) {
+				continue
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			tx.Rollback()
+		}
+	}()
+	db, err := standby.Promote()
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("Promote: %v", err)
+	}
+	mustUpdate(t, db, func(tx *Tx) error {
+		return getOrCreate(t, tx, "c").Put([]byte("key20"), []byte("value"))
+	})
+}
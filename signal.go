@@ -0,0 +1,48 @@
+package gopherdb
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// CloseOnSignal closes the database when the process receives one of the signals, and then exits. Close waits for the
+// transactions in flight, so an interrupt in the middle of a commit doesn't leave a half written file behind. The exit
+// status is 128 plus the signal number, like a shell reports a process killed by the signal.
+//
+// Only the first signal is handled: a second one while Close is waiting gets the default behavior, which usually kills
+// the process right away. The returned function stops listening for the signals.
+//
+//	stop := db.CloseOnSignal(os.Interrupt, syscall.SIGTERM)
+//	defer stop()
+func (db *DB) CloseOnSignal(signals ...os.Signal) (stop func()) {
+	received := make(chan os.Signal, 1)
+	stopped := make(chan struct{})
+	signal.Notify(received, signals...)
+
+	go func() {
+		select {
+		case sig := <-received:
+			signal.Stop(received)
+			_ = db.Close()
+			os.Exit(exitStatus(sig))
+		case <-stopped:
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(received)
+			close(stopped)
+		})
+	}
+}
+
+func exitStatus(sig os.Signal) int {
+	if number, ok := sig.(syscall.Signal); ok {
+		return 128 + int(number)
+	}
+	return 1
+}
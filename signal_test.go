@@ -0,0 +1,89 @@
+//go:build unix
+
+package gopherdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// signalTestPath is set in the process started by TestCloseOnSignal, which runs closeOnSignalProcess instead.
+const signalTestPath = "GOPHERDB_SIGNAL_TEST_PATH"
+
+func TestCloseOnSignal(t *testing.T) {
+	if path := os.Getenv(signalTestPath); path != "" {
+		closeOnSignalProcess(path)
+		return
+	}
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCloseOnSignal$")
+	cmd.Env = append(os.Environ(), signalTestPath+"="+path)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "ready\n" {
+		_ = cmd.Process.Kill()
+		t.Fatalf("the process said %q, %v", line, err)
+	}
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 128+int(syscall.SIGTERM) {
+		t.Fatalf("the process ended with %v, want exit status %d", err, 128+int(syscall.SIGTERM))
+	}
+
+	// The commit in flight when the signal came was waited for, and the file was closed cleanly
+	db := openTestPath(t, path, nil)
+	if db.recovery != nil {
+		t.Errorf("the file wasn't closed cleanly: %+v", db.recovery)
+	}
+	if value := getValue(t, db, "c", "in flight"); value != "committed" {
+		t.Errorf("the value of the transaction in flight: got %q, want committed", value)
+	}
+}
+
+// closeOnSignalProcess reports that it's ready with a write transaction in flight, which commits a moment later.
+func closeOnSignalProcess(path string) {
+	db, err := Open(path, testOptions())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	tx, err := db.WriteTx()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	db.CloseOnSignal(syscall.SIGTERM)
+	fmt.Println("ready")
+
+	time.Sleep(100 * time.Millisecond)
+	c, err := tx.CreateCollection([]byte("c"))
+	if err == nil {
+		err = c.Put([]byte("in flight"), []byte("committed"))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	select {}
+}
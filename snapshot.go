@@ -0,0 +1,206 @@
+package gopherdb
+
+import (
+	"errors"
+	"sync"
+)
+
+// Read transactions read a snapshot of the file: the trees of the last commit when they began, which stay as they are
+// while write transactions run and commit. Commits never write the pages of the committed trees, see copyOnWrite, so
+// all a snapshot needs is that the pages its trees use aren't reused while it's read. A page freed by a commit is part
+// of the trees of the commits before it only, so it's held back while read transactions of those commits run, and
+// released by the first commit after they end, see releaseUnpinned. Read transactions of the last commit hold back
+// nothing, so a steady stream of short readers doesn't keep the file from reusing its pages.
+
+// fileState is the state of the file after a commit, which read transactions see while later commits change it.
+type fileState struct {
+	txid         uint64
+	root         pgnum
+	maxPage      pgnum
+	freePages    int
+	freelistPage pgnum
+
+	// freelistSpare, chain and free are the rest of the freelist of the commit, which Tx.WriteTo writes to the copy:
+	// free holds the free pages, along with the held ones, which are free once the file is copied. free is nil for the
+	// states of checkpoints, whose freelists aren't kept.
+	freelistSpare pgnum
+	chain         []pgnum
+	free          []pgnum
+}
+
+// fileState returns the state of the file as seen by the transaction: the one it began on for read transactions, and
+// the current one for the others.
+func (tx *Tx) fileState() fileState {
+	if tx.snapshot != nil {
+		return *tx.snapshot
+	}
+	return tx.db.currentState()
+}
+
+func (d *dal) currentState() fileState {
+	return fileState{txid: d.txid, root: d.root, maxPage: d.maxPage, freePages: len(d.releasedPages), freelistPage: d.freelistPage}
+}
+
+// committedState returns the current state of the file along with its freelist, once a commit is done. The pages it
+// holds are copied, since the next commits change them in place.
+func (d *dal) committedState() fileState {
+	state := d.currentState()
+	state.freelistSpare = d.freelistSpare
+	state.chain = append([]pgnum{}, d.chain...)
+	state.free = make([]pgnum, 0, len(d.releasedPages)+len(d.heldPages))
+	state.free = append(append(state.free, d.releasedPages...), d.heldPages...)
+	return state
+}
+
+// addReader registers a read transaction beginning on the last commit, and returns the state of the file it reads.
+// The pages freed by later commits are held back until removeReader.
+func (d *dal) addReader() fileState {
+	d.snapshotMu.RLock()
+	d.pinMu.Lock()
+	defer d.pinMu.Unlock()
+	if d.readers == nil {
+		d.readers = map[uint64]int{}
+	}
+	d.readers[d.committed.txid]++
+	return d.committed
+}
+
+// removeReader unregisters a read transaction of the commit txid.
+func (d *dal) removeReader(txid uint64) {
+	d.pinMu.Lock()
+	d.readers[txid]--
+	if d.readers[txid] <= 0 {
+		delete(d.readers, txid)
+	}
+	d.pinMu.Unlock()
+	d.snapshotMu.RUnlock()
+}
+
+// readsBefore reports whether a read transaction of a commit before txid is running. It's called holding pinMu.
+func (d *dal) readsBefore(txid uint64) bool {
+	for reading := range d.readers {
+		if reading < txid {
+			return true
+		}
+	}
+	return false
+}
+
+// publishState makes the current state of the file the one read transactions begin on. It's called once a commit is
+// done, and when the file is opened or changed by a standby.
+//
+// The pages a commit releases are released before its meta page is written, since they go to its freelist, so read
+// transactions beginning in between read the previous commit, whose trees can use them. Nothing takes pages from the
+// freelist until the next commit, so they're taken back out of it here and held back while such transactions run.
+func (d *dal) publishState() {
+	d.pinMu.Lock()
+	defer d.pinMu.Unlock()
+	if len(d.unpublished) > 0 && d.readsBefore(d.txid) {
+		held := make(map[pgnum]bool, len(d.unpublished))
+		for _, pageNum := range d.unpublished {
+			held[pageNum] = true
+			d.freedBy[pageNum] = d.txid
+		}
+		released := d.releasedPages[:0]
+		for _, pageNum := range d.releasedPages {
+			if !held[pageNum] {
+				released = append(released, pageNum)
+			}
+		}
+		d.releasedPages = released
+		d.heldPages = append(d.heldPages, d.unpublished...)
+	}
+	d.unpublished = nil
+	d.committed = d.committedState()
+}
+
+var ErrSnapshotReleased = errors.New("snapshot is released")
+var ErrSnapshotStale = errors.New("the standby applied segments since the snapshot was taken")
+
+// Snapshot is a view of the file pinned to a commit, which read transactions can be begun on for as long as it's held,
+// whatever commits in between, for passes over the data that should see a single commit, like analytics or backups
+// with Tx.WriteTo. Like a read transaction, it holds back the pages freed by later commits until it's released, so a
+// snapshot held for long makes the file grow under a steady stream of writes. Unlike one, it only holds the lock of
+// standbys while its transactions run, so segments keep being applied in between, which makes it stale on standbys.
+//
+// Close waits for the snapshots of the handle to be released, like it waits for its transactions.
+type Snapshot struct {
+	db      *DB
+	state   fileState
+	applied uint64
+
+	mu       sync.Mutex
+	released bool
+}
+
+// Snapshot pins the last commit, which the transactions of the returned snapshot read until it's released.
+func (db *DB) Snapshot() (*Snapshot, error) {
+	err := db.begin()
+	if err != nil {
+		return nil, err
+	}
+	state := db.addReader()
+	s := &Snapshot{db: db, state: state, applied: db.segmentsApplied}
+	db.snapshotMu.RUnlock()
+	return s, nil
+}
+
+// TxID returns the id of the commit the snapshot is pinned to.
+func (s *Snapshot) TxID() uint64 {
+	return s.state.txid
+}
+
+// Tx begins a read transaction on the commit of the snapshot, which keeps reading it until it ends even if the snapshot
+// is released in the meantime. It fails with ErrSnapshotReleased once the snapshot is released, and with
+// ErrSnapshotStale on standbys that applied a segment since the snapshot was taken.
+func (s *Snapshot) Tx() (*Tx, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.released {
+		return nil, ErrSnapshotReleased
+	}
+	err := s.db.begin()
+	if err != nil {
+		return nil, err
+	}
+	s.db.snapshotMu.RLock()
+	if s.db.segmentsApplied != s.applied {
+		s.db.snapshotMu.RUnlock()
+		s.db.inFlight.Done()
+		return nil, ErrSnapshotStale
+	}
+	s.db.pinMu.Lock()
+	s.db.readers[s.state.txid]++
+	s.db.pinMu.Unlock()
+	state := s.state
+	tx := newTx(s.db, false, state.txid, state.root)
+	tx.snapshot = &state
+	return tx, nil
+}
+
+// View runs fn in a read transaction on the commit of the snapshot, see DB.View.
+func (s *Snapshot) View(fn func(tx *Tx) error) error {
+	tx, err := s.Tx()
+	if err != nil {
+		return err
+	}
+	return runManaged(tx, fn)
+}
+
+// Release unpins the commit of the snapshot, whose held pages are released by the first commit after its transactions
+// end. Releasing a snapshot again does nothing.
+func (s *Snapshot) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	s.db.pinMu.Lock()
+	s.db.readers[s.state.txid]--
+	if s.db.readers[s.state.txid] <= 0 {
+		delete(s.db.readers, s.state.txid)
+	}
+	s.db.pinMu.Unlock()
+	s.db.inFlight.Done()
+}
@@ -0,0 +1,563 @@
+package gopherdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// readAll returns the keys and values of the collection as seen by the transaction.
+func readAll(tx *Tx, collection string) (map[string]string, error) {
+	c, err := tx.GetCollection([]byte(collection))
+	if err != nil || c == nil {
+		return nil, err
+	}
+	entries := map[string]string{}
+	cur := c.Cursor()
+	for k, v := cur.First(); k != nil; k, v = cur.Next() {
+		entries[string(k)] = string(v)
+	}
+	return entries, cur.Err()
+}
+
+// rewrite puts every key of the collection again with a value of the round, so the commit frees all of its leaves.
+func rewrite(t *testing.T, db *DB, keys int, round int) {
+	t.Helper()
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i := 0; i < keys; i++ {
+			if err := c.Put(testKey(i), []byte(fmt.Sprintf("round %d", round))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// checkRound fails if the transaction doesn't see the values of the round put by rewrite.
+func checkRound(t *testing.T, tx *Tx, keys int, round int) {
+	t.Helper()
+	entries, err := readAll(tx, "c")
+	if err != nil {
+		t.Fatalf("reading the snapshot: %v", err)
+	}
+	want := fmt.Sprintf("round %d", round)
+	for i := 0; i < keys; i++ {
+		if value := entries[string(testKey(i))]; value != want {
+			t.Fatalf("%s is %q, want %q", testKey(i), value, want)
+		}
+	}
+	if len(entries) != keys {
+		t.Fatalf("the snapshot has %d keys, want %d", len(entries), keys)
+	}
+}
+
+func TestReadTxDoesNotWaitForWrites(t *testing.T) {
+	db := openTestDB(t, nil)
+	putValue(t, db, "c", "k", "old")
+	tx, err := db.ReadTx()
+	if err != nil {
+		t.Fatalf("ReadTx: %v", err)
+	}
+	defer tx.Rollback()
+	id := tx.ID()
+
+	// Neither the write transaction nor the read transaction begun while it runs waits for the other
+	committed := make(chan error, 1)
+	go func() {
+		committed <- db.Update(func(w *Tx) error {
+			if err := getOrCreate(t, w, "c").Put([]byte("k"), []byte("new")); err != nil {
+				return err
+			}
+			during, err := db.ReadTx()
+			if err != nil {
+				return err
+			}
+			defer during.Rollback()
+			entries, err := readAll(during, "c")
+			if err != nil {
+				return err
+			}
+			if entries["k"] != "old" || during.ID() != id {
+				return fmt.Errorf("a read transaction of the running write transaction sees k=%q at txid %d", entries["k"], during.ID())
+			}
+			return nil
+		})
+	}()
+	select {
+	case err := <-committed:
+		if err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the write transaction waited for the read transaction")
+	}
+
+	// The read transaction still sees the commit it began on
+	entries, err := readAll(tx, "c")
+	if err != nil {
+		t.Fatalf("reading the snapshot: %v", err)
+	}
+	if entries["k"] != "old" {
+		t.Errorf("the read transaction sees k=%q after the commit, want %q", entries["k"], "old")
+	}
+	stats, err := tx.FileStats()
+	if err != nil {
+		t.Fatalf("FileStats: %v", err)
+	}
+	if tx.ID() != id || stats.TxID != id {
+		t.Errorf("the read transaction has the id %d and the stats %d, want %d", tx.ID(), stats.TxID, id)
+	}
+	if value := getValue(t, db, "c", "k"); value != "new" {
+		t.Errorf("a new read transaction sees k=%q, want %q", value, "new")
+	}
+}
+
+func TestReadTxSnapshotsUnderConcurrentWrites(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("WAL=%v", wal), func(t *testing.T) {
+			options := testOptions()
+			options.WAL = wal
+			options.WALCheckpointPages = 50
+			options.JournalFreelist = true
+			db := openTestDB(t, options)
+
+			// Transfers between the accounts keep their total, and every commit records its id, so a read
+			// transaction seeing anything but a single commit finds out
+			const accounts, total = 50, 5000
+			mustUpdate(t, db, func(tx *Tx) error {
+				c := getOrCreate(t, tx, "accounts")
+				for i := 0; i < accounts; i++ {
+					if err := c.Put(testKey(i), []byte(strconv.Itoa(total/accounts))); err != nil {
+						return err
+					}
+				}
+				return getOrCreate(t, tx, "commits").Put([]byte("last"), []byte(strconv.FormatUint(tx.ID(), 10)))
+			})
+
+			done := make(chan struct{})
+			errs := make(chan error, 4)
+			for r := 0; r < cap(errs); r++ {
+				go func() {
+					reads := 0
+					for {
+						select {
+						case <-done:
+							if reads == 0 {
+								errs <- errors.New("no read transaction ran")
+								return
+							}
+							errs <- nil
+							return
+						default:
+						}
+						reads++
+						err := db.View(func(tx *Tx) error {
+							balances, err := readAll(tx, "accounts")
+							if err != nil {
+								return err
+							}
+							sum := 0
+							for _, balance := range balances {
+								n, _ := strconv.Atoi(balance)
+								sum += n
+							}
+							if len(balances) != accounts || sum != total {
+								return fmt.Errorf("txid %d has %d accounts holding %d", tx.ID(), len(balances), sum)
+							}
+							commits, err := readAll(tx, "commits")
+							if err != nil {
+								return err
+							}
+							if commits["last"] != strconv.FormatUint(tx.ID(), 10) {
+								return fmt.Errorf("txid %d sees the commit %s", tx.ID(), commits["last"])
+							}
+							return nil
+						})
+						if err != nil {
+							errs <- err
+							return
+						}
+					}
+				}()
+			}
+
+			rng := rand.New(rand.NewSource(1))
+			for i := 0; i < 300; i++ {
+				err := db.Update(func(tx *Tx) error {
+					c := getOrCreate(t, tx, "accounts")
+					from, to := testKey(rng.Intn(accounts)), testKey(rng.Intn(accounts))
+					balance, err := c.Get(from)
+					if err != nil {
+						return err
+					}
+					n, _ := strconv.Atoi(string(balance))
+					amount := rng.Intn(n + 1)
+					if err := c.Put(from, []byte(strconv.Itoa(n-amount))); err != nil {
+						return err
+					}
+					balance, err = c.Get(to)
+					if err != nil {
+						return err
+					}
+					n, _ = strconv.Atoi(string(balance))
+					if err := c.Put(to, []byte(strconv.Itoa(n+amount))); err != nil {
+						return err
+					}
+					// Values of every size split, merge and overflow the nodes of another collection
+					junk := getOrCreate(t, tx, "junk")
+					key := testKey(rng.Intn(100))
+					if rng.Intn(3) == 0 {
+						if err := junk.Remove(key); err != nil && !errors.Is(err, ErrKeyNotFound) {
+							return err
+						}
+					} else if err := junk.Put(key, bytes.Repeat([]byte("j"), rng.Intn(2000))); err != nil {
+						return err
+					}
+					return getOrCreate(t, tx, "commits").Put([]byte("last"), []byte(strconv.FormatUint(tx.ID(), 10)))
+				})
+				if err != nil {
+					t.Fatalf("Update: %v", err)
+				}
+			}
+			close(done)
+			for r := 0; r < cap(errs); r++ {
+				if err := <-errs; err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestPagesFreedUnderAReadTxAreReusedOnceItEnds(t *testing.T) {
+	const keys = 100
+	db := openTestDB(t, nil)
+	rewrite(t, db, keys, 0)
+	tx, err := db.ReadTx()
+	if err != nil {
+		t.Fatalf("ReadTx: %v", err)
+	}
+	start := db.maxPage
+	for round := 1; round <= 20; round++ {
+		rewrite(t, db, keys, round)
+	}
+	// None of the pages freed since the read transaction began were reused, so its snapshot is intact
+	grown := db.maxPage
+	if grown <= start {
+		t.Fatalf("the file didn't grow from %d pages while pages were held", start)
+	}
+	checkRound(t, tx, keys, 0)
+	tx.Rollback()
+
+	// The first commit releases them once it took its own pages, and the next ones reuse them
+	rewrite(t, db, keys, 21)
+	grown = db.maxPage
+	for round := 22; round <= 40; round++ {
+		rewrite(t, db, keys, round)
+	}
+	if db.maxPage != grown {
+		t.Errorf("the file grew from %d to %d pages after the read transaction ended", grown, db.maxPage)
+	}
+	if len(db.heldPages) != 0 {
+		t.Errorf("%d pages are still held", len(db.heldPages))
+	}
+	mustView(t, db, func(tx *Tx) error {
+		checkRound(t, tx, keys, 40)
+		return nil
+	})
+}
+
+func TestShortReadTxsDontHoldPagesBack(t *testing.T) {
+	const keys, rounds = 100, 100
+	grow := func(overlapping bool) pgnum {
+		db := openTestDB(t, nil)
+		rewrite(t, db, keys, 0)
+		var tx *Tx
+		for round := 1; round <= rounds; round++ {
+			// A read transaction runs during every commit, begun after the one before
+			next, err := db.ReadTx()
+			if err != nil {
+				t.Fatalf("ReadTx: %v", err)
+			}
+			if tx != nil {
+				checkRound(t, tx, keys, round-2)
+				tx.Rollback()
+			}
+			tx = next
+			if !overlapping {
+				tx.Rollback()
+				tx = nil
+			}
+			rewrite(t, db, keys, round)
+		}
+		if tx != nil {
+			tx.Rollback()
+		}
+		return db.maxPage
+	}
+
+	alone, overlapped := grow(false), grow(true)
+	// Every commit holds back the pages freed by the one before at most
+	if overlapped > 2*alone {
+		t.Errorf("the file has %d pages with overlapping read transactions, and %d without", overlapped, alone)
+	}
+}
+
+func TestReadTxBegunDuringACommit(t *testing.T) {
+	const keys = 100
+	var db *DB
+	var during *Tx
+	armed := false
+	options := testOptions()
+	// The latency function runs for every page the commit writes, so it can begin a read transaction once the commit
+	// released its freed pages, before its meta page is written
+	options.IOThrottle = &IOThrottle{Latency: func() time.Duration {
+		if armed && during == nil && len(db.unpublished) > 0 {
+			var err error
+			during, err = db.ReadTx()
+			if err != nil {
+				t.Errorf("ReadTx: %v", err)
+			}
+		}
+		return 0
+	}}
+	db = openTestDB(t, options)
+	rewrite(t, db, keys, 0)
+	id := db.txid
+	armed = true
+	rewrite(t, db, keys, 1)
+	if during == nil {
+		t.Fatal("no read transaction began during the commit")
+	}
+	defer during.Rollback()
+
+	// It reads the commit before, whose pages the next commits must not reuse
+	if during.ID() != id {
+		t.Errorf("the read transaction has the id %d, want %d", during.ID(), id)
+	}
+	for round := 2; round <= 10; round++ {
+		rewrite(t, db, keys, round)
+	}
+	checkRound(t, during, keys, 0)
+}
+
+func TestReadTxsOfSeveralCommits(t *testing.T) {
+	const keys = 100
+	db := openTestDB(t, nil)
+	rewrite(t, db, keys, 0)
+	var readers []*Tx
+	ended := map[*Tx]bool{}
+	end := func(tx *Tx) {
+		ended[tx] = true
+		tx.Rollback()
+	}
+	defer func() {
+		for _, tx := range readers {
+			if !ended[tx] {
+				tx.Rollback()
+			}
+		}
+	}()
+	for round := 1; round <= 3; round++ {
+		tx, err := db.ReadTx()
+		if err != nil {
+			t.Fatalf("ReadTx: %v", err)
+		}
+		readers = append(readers, tx)
+		rewrite(t, db, keys, round)
+	}
+	for i, tx := range readers {
+		checkRound(t, tx, keys, i)
+	}
+	// heldBy returns the pages held for the read transactions of commits before txid.
+	heldBy := func(txid uint64) int {
+		n := 0
+		for _, pageNum := range db.heldPages {
+			if db.freedBy[pageNum] > txid {
+				n++
+			}
+		}
+		return n
+	}
+
+	// The oldest read transaction holds back the pages freed since it began
+	end(readers[1])
+	rewrite(t, db, keys, 4)
+	held := len(db.heldPages)
+	if heldBy(readers[0].ID()) != held {
+		t.Errorf("%d of the %d held pages were freed before the oldest read transaction", held-heldBy(readers[0].ID()), held)
+	}
+	// Once it ends, only the pages freed after the last one began are held
+	end(readers[0])
+	rewrite(t, db, keys, 5)
+	if len(db.heldPages) >= held || heldBy(readers[2].ID()) != len(db.heldPages) {
+		t.Errorf("%d pages are held after the oldest read transaction ended, %d for the last one, were %d", len(db.heldPages),
+			heldBy(readers[2].ID()), held)
+	}
+	checkRound(t, readers[2], keys, 2)
+	end(readers[2])
+	rewrite(t, db, keys, 6)
+	if len(db.heldPages) != 0 || len(db.freedBy) != 0 {
+		t.Errorf("%d pages are still held, %d with the commit that freed them", len(db.heldPages), len(db.freedBy))
+	}
+}
+
+func TestSnapshotPinsItsCommitAcrossTransactions(t *testing.T) {
+	const keys = 100
+	db := openTestDB(t, nil)
+	rewrite(t, db, keys, 0)
+	snapshot, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	txid := snapshot.TxID()
+	for round := 1; round <= 10; round++ {
+		rewrite(t, db, keys, round)
+		// Every transaction of the snapshot reads its commit, not the last one
+		err = snapshot.View(func(tx *Tx) error {
+			if tx.ID() != txid {
+				t.Fatalf("the transaction reads commit %d, want %d", tx.ID(), txid)
+			}
+			checkRound(t, tx, keys, 0)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("View: %v", err)
+		}
+	}
+
+	// A transaction begun before the release keeps reading the commit
+	tx, err := snapshot.Tx()
+	if err != nil {
+		t.Fatalf("Tx: %v", err)
+	}
+	snapshot.Release()
+	snapshot.Release()
+	rewrite(t, db, keys, 11)
+	checkRound(t, tx, keys, 0)
+	tx.Rollback()
+	if _, err := snapshot.Tx(); !errors.Is(err, ErrSnapshotReleased) {
+		t.Fatalf("got %v, want ErrSnapshotReleased", err)
+	}
+
+	rewrite(t, db, keys, 12)
+	rewrite(t, db, keys, 13)
+	if len(db.heldPages) != 0 {
+		t.Errorf("%d pages are still held after the release", len(db.heldPages))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestCloseWaitsForSnapshots(t *testing.T) {
+	options := testOptions()
+	options.CloseTimeout = 10 * time.Millisecond
+	db := openTestDB(t, options)
+	putValue(t, db, "c", "k", "v")
+	snapshot, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	if err := db.Close(); !errors.Is(err, ErrCloseTimeout) {
+		t.Fatalf("got %v, want ErrCloseTimeout while the snapshot is held", err)
+	}
+	snapshot.Release()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestSnapshotOfAStandbyGoesStale(t *testing.T) {
+	dir := t.TempDir()
+	options := testOptions()
+	options.ShipDir = filepath.Join(dir, "segments")
+	if err := os.Mkdir(options.ShipDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	primary := openTestPath(t, filepath.Join(dir, "primary.db"), options)
+	putValue(t, primary, "c", "k", "v")
+	standby, err := OpenStandby(filepath.Join(dir, "standby.db"), options.ShipDir, time.Hour, testOptions())
+	if err != nil {
+		t.Fatalf("OpenStandby: %v", err)
+	}
+	defer standby.Close()
+
+	snapshot, err := standby.DB().Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	defer snapshot.Release()
+	putValue(t, primary, "c", "k", "v2")
+	// The segment is applied while the snapshot is held, since it has no transaction running
+	if err := standby.applyAll(); err != nil {
+		t.Fatalf("applyAll: %v", err)
+	}
+	if _, err := snapshot.Tx(); !errors.Is(err, ErrSnapshotStale) {
+		t.Fatalf("got %v, want ErrSnapshotStale", err)
+	}
+}
+
+// A read transaction begun while another runs doesn't wait for the standby to apply a segment, which waits for both.
+func TestNestedReadTxOnAStandbyApplyingASegment(t *testing.T) {
+	dir := t.TempDir()
+	options := testOptions()
+	options.ShipDir = filepath.Join(dir, "segments")
+	if err := os.Mkdir(options.ShipDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	primary := openTestPath(t, filepath.Join(dir, "primary.db"), options)
+	putValue(t, primary, "c", "k", "v")
+	standby, err := OpenStandby(filepath.Join(dir, "standby.db"), options.ShipDir, time.Hour, testOptions())
+	if err != nil {
+		t.Fatalf("OpenStandby: %v", err)
+	}
+	defer standby.Close()
+
+	outer, err := standby.DB().ReadTx()
+	if err != nil {
+		t.Fatalf("ReadTx: %v", err)
+	}
+	putValue(t, primary, "c", "k", "v2")
+	applied := make(chan error, 1)
+	go func() { applied <- standby.applyAll() }()
+	// Give the segment time to be waiting for the outer transaction
+	time.Sleep(5 * lockRetryInterval)
+
+	begun := make(chan error, 1)
+	go func() {
+		inner, err := standby.DB().ReadTx()
+		if err == nil {
+			inner.Rollback()
+		}
+		begun <- err
+	}()
+	select {
+	case err := <-begun:
+		if err != nil {
+			t.Fatalf("nested ReadTx: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the nested read transaction waits for the segment")
+	}
+	select {
+	case err := <-applied:
+		t.Fatalf("the segment was applied under a read transaction: %v", err)
+	default:
+	}
+
+	outer.Rollback()
+	if err := <-applied; err != nil {
+		t.Fatalf("applyAll: %v", err)
+	}
+	if got := getValue(t, standby.DB(), "c", "k"); got != "v2" {
+		t.Errorf("k on the standby: got %q, want v2", got)
+	}
+}
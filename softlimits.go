@@ -0,0 +1,150 @@
+package gopherdb
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LimitMetric is a measure of the file a SoftLimit watches.
+type LimitMetric int
+
+const (
+	// LimitFileSize is the size of the pages of the file in bytes, as of the last commit.
+	LimitFileSize LimitMetric = iota
+	// LimitFreePageRatio is the share of the pages of the file that are free, between 0 and 1, as of the last commit.
+	// A high ratio means the file could shrink, see DB.Compact.
+	LimitFreePageRatio
+	// LimitTxQueueDepth is the number of write transactions waiting for the one running to end.
+	LimitTxQueueDepth
+)
+
+func (m LimitMetric) String() string {
+	switch m {
+	case LimitFileSize:
+		return "file size"
+	case LimitFreePageRatio:
+		return "free page ratio"
+	case LimitTxQueueDepth:
+		return "write queue depth"
+	}
+	return fmt.Sprintf("LimitMetric(%d)", int(m))
+}
+
+// SoftLimit is a level of a metric the application wants to hear about before it turns into a problem, like a disk
+// quota or a queue of requests timing out, see Options.SoftLimits.
+type SoftLimit struct {
+	Metric LimitMetric
+	Level  float64
+}
+
+// SoftLimitEvent tells that a metric crossed the level of a soft limit: upwards, reaching it, when Reached is set,
+// and back below it otherwise.
+type SoftLimitEvent struct {
+	Limit   SoftLimit
+	Value   float64
+	Reached bool
+	// TxID is the last commit when the metric was measured.
+	TxID uint64
+	Time time.Time
+}
+
+// softLimits tracks which of the limits of Options.SoftLimits are reached, and holds the events waiting to be
+// delivered. Events are found while the locks of the file are held, so they're delivered later, by
+// deliverSoftLimits, which the goroutines crossing them call once they hold none, so the callback can run
+// transactions.
+type softLimits struct {
+	limits   []SoftLimit
+	callback func(SoftLimitEvent)
+
+	// mu guards the rest: waiting is the number of write transactions waiting for the lock, and delivering is set
+	// while a goroutine calls the callback, which then delivers the events found meanwhile too, so they stay in order.
+	mu         sync.Mutex
+	reached    []bool
+	pending    []SoftLimitEvent
+	waiting    int
+	delivering bool
+}
+
+// newSoftLimits returns the soft limits of the options, or nil if there's no limit or no callback to call.
+func newSoftLimits(limits []SoftLimit, callback func(SoftLimitEvent)) *softLimits {
+	if len(limits) == 0 || callback == nil {
+		return nil
+	}
+	return &softLimits{
+		limits:   append([]SoftLimit{}, limits...),
+		callback: callback,
+		reached:  make([]bool, len(limits)),
+	}
+}
+
+// observe records the value of the metric, and queues an event for every limit of the metric it crossed. It's called
+// holding mu.
+func (s *softLimits) observe(metric LimitMetric, value float64, txid uint64, now time.Time) {
+	for i, limit := range s.limits {
+		if limit.Metric != metric || s.reached[i] == (value >= limit.Level) {
+			continue
+		}
+		s.reached[i] = !s.reached[i]
+		s.pending = append(s.pending, SoftLimitEvent{Limit: limit, Value: value, Reached: s.reached[i], TxID: txid, Time: now})
+	}
+}
+
+// observeCommit records the metrics of the file after a commit. It's called by the commit, holding the write lock.
+func (d *dal) observeCommit() {
+	s := d.softLimits
+	if s == nil {
+		return
+	}
+	pages := float64(d.maxPage) + 1
+	now := d.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observe(LimitFileSize, pages*float64(d.pageSize), d.txid, now)
+	s.observe(LimitFreePageRatio, float64(len(d.releasedPages))/pages, d.txid, now)
+}
+
+// waitForWrite counts a write transaction waiting for the lock while it's waiting, or stops counting it once it's
+// done waiting.
+func (d *dal) waitForWrite(waiting bool) {
+	s := d.softLimits
+	if s == nil {
+		return
+	}
+	d.pinMu.Lock()
+	txid := d.committed.txid
+	d.pinMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if waiting {
+		s.waiting++
+	} else {
+		s.waiting--
+	}
+	s.observe(LimitTxQueueDepth, float64(s.waiting), txid, d.now())
+}
+
+// deliverSoftLimits calls the callback of Options.SoftLimits with the events found so far, in order. It must be called
+// holding no lock of the file.
+func (d *dal) deliverSoftLimits() {
+	s := d.softLimits
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.delivering {
+		return
+	}
+	s.delivering = true
+	for len(s.pending) > 0 {
+		events := s.pending
+		s.pending = nil
+		s.mu.Unlock()
+		for _, event := range events {
+			s.callback(event)
+		}
+		s.mu.Lock()
+	}
+	s.delivering = false
+}
@@ -0,0 +1,116 @@
+package gopherdb
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// softLimitRecorder collects the events of the soft limits.
+type softLimitRecorder struct {
+	mu     sync.Mutex
+	events []SoftLimitEvent
+}
+
+func (r *softLimitRecorder) record(event SoftLimitEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+// of returns the events of the metric, as reached or not, in order.
+func (r *softLimitRecorder) of(metric LimitMetric) []bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var reached []bool
+	for _, event := range r.events {
+		if event.Limit.Metric == metric {
+			reached = append(reached, event.Reached)
+		}
+	}
+	return reached
+}
+
+func TestSoftLimitsOfTheFile(t *testing.T) {
+	recorder := &softLimitRecorder{}
+	options := testOptions()
+	options.SoftLimits = []SoftLimit{{Metric: LimitFileSize, Level: 64 * 512}, {Metric: LimitFreePageRatio, Level: 0.3}}
+	var db *DB
+	options.OnSoftLimit = func(event SoftLimitEvent) {
+		recorder.record(event)
+		// The callback runs once the commit released the lock, so it can write
+		if event.Limit.Metric == LimitFileSize {
+			if err := db.Put([]byte("alerts"), []byte("size"), []byte("reached")); err != nil {
+				t.Errorf("Put from the callback: %v", err)
+			}
+		}
+	}
+	db = openTestDB(t, options)
+
+	var crossedAt uint64
+	for i := 0; len(recorder.of(LimitFileSize)) == 0; i++ {
+		if i == 1000 {
+			t.Fatal("the file never reached the size")
+		}
+		putValue(t, db, "c", string(testKey(i)), "value of the key")
+		crossedAt = db.txid
+	}
+	recorder.mu.Lock()
+	event := recorder.events[0]
+	recorder.mu.Unlock()
+	if event.Value < 64*512 || !event.Reached || event.TxID != crossedAt-1 {
+		t.Fatalf("got %+v, want the file size reached by the commit before the alert", event)
+	}
+	if got := getValue(t, db, "alerts", "size"); got != "reached" {
+		t.Fatalf("the callback's write is %q", got)
+	}
+
+	// Emptying the collection frees most pages, and filling it again takes them back
+	mustUpdate(t, db, func(tx *Tx) error {
+		return tx.DeleteCollection([]byte("c"), DeleteCascade)
+	})
+	for i := 0; i < 300; i++ {
+		putValue(t, db, "c", string(testKey(i)), "value of the key")
+	}
+	if got := recorder.of(LimitFreePageRatio); len(got) != 2 || !got[0] || got[1] {
+		t.Fatalf("got free page ratio events %v, want reached and back below", got)
+	}
+	if got := recorder.of(LimitFileSize); len(got) != 1 {
+		t.Fatalf("got file size events %v, want a single one", got)
+	}
+}
+
+func TestSoftLimitOfTheWriteQueue(t *testing.T) {
+	recorder := &softLimitRecorder{}
+	options := testOptions()
+	options.SoftLimits = []SoftLimit{{Metric: LimitTxQueueDepth, Level: 2}}
+	options.OnSoftLimit = recorder.record
+	db := openTestDB(t, options)
+
+	// Uncontended transactions never wait
+	putValue(t, db, "c", "k", "v")
+	tx, err := db.WriteTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			putValue(t, db, "c", "k", "v")
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(recorder.of(LimitTxQueueDepth)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the queue never reached its level")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	tx.Rollback()
+	wg.Wait()
+	if got := recorder.of(LimitTxQueueDepth); len(got) != 2 || !got[0] || got[1] {
+		t.Fatalf("got queue events %v, want reached and back below", got)
+	}
+}
@@ -0,0 +1,263 @@
+package gopherdb
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// accessCounters holds the read, write and miss counters of a single collection. The counters are updated with atomic
+// operations so they are cheap enough to be incremented on every Find, Put and Remove.
+type accessCounters struct {
+	reads  atomic.Uint64
+	writes atomic.Uint64
+	misses atomic.Uint64
+}
+
+// CollectionAccessStats is a point in time snapshot of the access counters of a collection. Reads counts Find calls,
+// Misses counts the Find calls that didn't find the key and Writes counts Put and Remove calls.
+type CollectionAccessStats struct {
+	Reads  uint64
+	Writes uint64
+	Misses uint64
+}
+
+// accessStats maps each collection name to its counters. The counters live on the db and not on the collection, since
+// a Collection is re-created by every transaction that accesses it.
+type accessStats struct {
+	mu          sync.Mutex
+	collections map[string]*accessCounters
+}
+
+func newAccessStats() *accessStats {
+	return &accessStats{
+		collections: map[string]*accessCounters{},
+	}
+}
+
+// countersFor returns the counters of the given collection, creating them on first access.
+func (s *accessStats) countersFor(name []byte) *accessCounters {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counters, ok := s.collections[string(name)]
+	if !ok {
+		counters = &accessCounters{}
+		s.collections[string(name)] = counters
+	}
+	return counters
+}
+
+func (s *accessStats) snapshot() map[string]CollectionAccessStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := make(map[string]CollectionAccessStats, len(s.collections))
+	for name, counters := range s.collections {
+		stats[name] = CollectionAccessStats{
+			Reads:  counters.reads.Load(),
+			Writes: counters.writes.Load(),
+			Misses: counters.misses.Load(),
+		}
+	}
+	return stats
+}
+
+// AccessStats returns the access counters of every collection that was accessed since the database was opened. The
+// counters are kept in memory only and start from zero on every Open.
+func (db *DB) AccessStats() map[string]CollectionAccessStats {
+	return db.accessStats.snapshot()
+}
+
+func (c *Collection) countRead(found bool) {
+	if c.counters == nil {
+		return
+	}
+	c.counters.reads.Add(1)
+	if !found {
+		c.counters.misses.Add(1)
+	}
+}
+
+func (c *Collection) countWrite() {
+	if c.counters == nil {
+		return
+	}
+	c.counters.writes.Add(1)
+}
+
+// FileStats describes the state of a database file, computed from its pages rather than from in-memory counters, so it
+// can be sampled by any process that can open the file.
+//
+// GarbageRatio is the share of the node pages of the collections that Collection.Compact would free, see
+// CollectionFileStats.GarbagePages.
+type FileStats struct {
+	SampledAt    time.Time             `json:"sampled_at"`
+	FileSize     int64                 `json:"file_size"`
+	PageSize     int                   `json:"page_size"`
+	Pages        uint64                `json:"pages"`
+	FreePages    int                   `json:"free_pages"`
+	TxID         uint64                `json:"txid"`
+	GarbageRatio float64               `json:"garbage_ratio"`
+	Collections  []CollectionFileStats `json:"collections"`
+}
+
+// CollectionFileStats describes the space used by a single collection. UsedBytes is the size of its nodes, the rest of
+// their pages being dead space: the room nodes are split with, and what removals and overwrites left until the nodes
+// get small enough to be merged. GarbagePages is the number of pages the dead space adds up to beyond the nodes filled
+// up to MaxFillPercent, which compaction packs the tree into.
+type CollectionFileStats struct {
+	Name          string `json:"name"`
+	Keys          uint64 `json:"keys"`
+	Pages         uint64 `json:"pages"`
+	OverflowPages uint64 `json:"overflow_pages"`
+	UsedBytes     uint64 `json:"used_bytes"`
+	GarbagePages  uint64 `json:"garbage_pages"`
+}
+
+// fileStats walks the root collection and every collection in it.
+func (tx *Tx) FileStats() (*FileStats, error) {
+	size, err := tx.db.file.Size()
+	if err != nil {
+		return nil, err
+	}
+	state := tx.fileState()
+	stats := &FileStats{
+		SampledAt: tx.db.now(),
+		FileSize:  size,
+		PageSize:  tx.db.pageSize,
+		Pages:     uint64(state.maxPage) + 1,
+		FreePages: state.freePages,
+		TxID:      state.txid,
+	}
+
+	collections, err := tx.allCollections()
+	if err != nil {
+		return nil, err
+	}
+
+	capacity := uint64(tx.overflowPageCapacity())
+	packed := uint64(tx.db.maxThreshold())
+	var pages, garbage uint64
+	for _, collection := range collections {
+		collectionStats := CollectionFileStats{Name: string(collection.name)}
+		err = tx.walk(collection.root, func(n *Node) error {
+			collectionStats.Pages++
+			collectionStats.UsedBytes += uint64(n.nodeSize())
+			for _, item := range n.items {
+				if item.collection {
+					continue
+				}
+				collectionStats.Keys++
+				if item.overflow {
+					length := deserializeOverflowRef(item.value).length
+					collectionStats.OverflowPages += (length + capacity - 1) / capacity
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		// A packed node is left with less room than an item, since the next item would overpopulate it
+		perPage := packed
+		if collectionStats.Keys > 0 && collectionStats.UsedBytes/collectionStats.Keys < packed {
+			perPage -= collectionStats.UsedBytes / collectionStats.Keys
+		}
+		if needed := (collectionStats.UsedBytes + perPage - 1) / perPage; collectionStats.Pages > needed {
+			collectionStats.GarbagePages = collectionStats.Pages - needed
+		}
+		pages += collectionStats.Pages
+		garbage += collectionStats.GarbagePages
+		stats.Collections = append(stats.Collections, collectionStats)
+	}
+	if pages > 0 {
+		stats.GarbageRatio = float64(garbage) / float64(pages)
+	}
+	return stats, nil
+}
+
+// CollectionStats describes the tree of a collection, see Collection.Stats. Depth is the number of levels of the tree,
+// one for a tree that is a single leaf. NodeBytes is the size of the nodes and OverflowBytes the size of the values
+// moved to overflow pages, so the collection holds NodeBytes+OverflowBytes bytes. FillFactor is the average share of
+// their page the nodes fill, which is between MinFillPercent and MaxFillPercent for a tree rebalanced by its writes,
+// except for the root, and close to MaxFillPercent once it's compacted.
+type CollectionStats struct {
+	Keys          uint64  `json:"keys"`
+	Depth         int     `json:"depth"`
+	LeafPages     uint64  `json:"leaf_pages"`
+	BranchPages   uint64  `json:"branch_pages"`
+	OverflowPages uint64  `json:"overflow_pages"`
+	NodeBytes     uint64  `json:"node_bytes"`
+	OverflowBytes uint64  `json:"overflow_bytes"`
+	FillFactor    float64 `json:"fill_factor"`
+}
+
+// Stats walks the tree of the collection and returns its statistics, to tune the fill percents and tell when to
+// compact. It reads every node of the collection, but not its overflow pages.
+func (c *Collection) Stats() (*CollectionStats, error) {
+	stats := &CollectionStats{}
+	capacity := uint64(c.tx.overflowPageCapacity())
+	var walk func(pageNum pgnum, depth int) error
+	walk = func(pageNum pgnum, depth int) error {
+		n, err := c.tx.getNode(pageNum)
+		if err != nil {
+			return err
+		}
+		if depth > stats.Depth {
+			stats.Depth = depth
+		}
+		if n.isLeaf() {
+			stats.LeafPages++
+		} else {
+			stats.BranchPages++
+		}
+		stats.NodeBytes += uint64(n.nodeSize())
+		for _, item := range n.items {
+			stats.Keys++
+			if item.overflow {
+				length := deserializeOverflowRef(item.value).length
+				stats.OverflowBytes += length
+				stats.OverflowPages += (length + capacity - 1) / capacity
+			}
+		}
+		for _, child := range n.childNodes {
+			err = walk(child, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := walk(c.root, 1)
+	if err != nil {
+		return nil, err
+	}
+	if pages := stats.LeafPages + stats.BranchPages; pages > 0 {
+		stats.FillFactor = float64(stats.NodeBytes) / float64(pages*uint64(c.tx.db.pageSize))
+	}
+	return stats, nil
+}
+
+// allCollections returns every collection of the root collection, sorted by name.
+func (tx *Tx) allCollections() ([]*Collection, error) {
+	var collections []*Collection
+	err := tx.walk(tx.root, func(n *Node) error {
+		for _, item := range n.items {
+			collection := newEmptyCollection()
+			collection.deserialize(item)
+			collection.tx = tx
+			collections = append(collections, collection)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(collections, func(i, j int) bool {
+		return bytes.Compare(collections[i].name, collections[j].name) < 0
+	})
+	return collections, nil
+}
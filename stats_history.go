@@ -0,0 +1,145 @@
+package gopherdb
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+// statsHistoryCollection is the collection the stats history is kept in when Options.StatsHistory is set.
+var statsHistoryCollection = []byte("__gopherdb_stats_history")
+
+// statsRecordSize is the size of a serialized StatsRecord: the txid, the time, the page counts, the latency and the
+// rebalance counters. Records written before the rebalance counters were added are statsRecordBaseSize long.
+const (
+	statsRecordBaseSize = txIDSize + 8 + 4*pageNumSize + 8
+	statsRecordSize     = statsRecordBaseSize + 5*8
+)
+
+// StatsRecord is a snapshot of the file taken by a commit, kept in the stats history. The pages are counted when the
+// commit begins, so they include the pages allocated by the transaction, but not the ones freed by it or the ones
+// written for the history itself.
+type StatsRecord struct {
+	TxID      uint64
+	Time      time.Time
+	Pages     uint64
+	FreePages uint64
+	// DirtyPages is the number of pages the commit wrote, and FreedPages the number of pages it freed.
+	DirtyPages uint64
+	FreedPages uint64
+	// CommitLatency is how long Commit took. It's only known once the commit is done, so it's recorded by the next
+	// commit of the same handle, and it stays zero for the last commit and for the last commit before the file was
+	// closed.
+	CommitLatency time.Duration
+	// Rebalance counts the rebalancing operations of the transaction.
+	Rebalance RebalanceStats
+}
+
+func serializeStatsRecord(record *StatsRecord) []byte {
+	buf := make([]byte, 0, statsRecordSize)
+	buf = binary.LittleEndian.AppendUint64(buf, record.TxID)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(record.Time.UnixNano()))
+	buf = binary.LittleEndian.AppendUint64(buf, record.Pages)
+	buf = binary.LittleEndian.AppendUint64(buf, record.FreePages)
+	buf = binary.LittleEndian.AppendUint64(buf, record.DirtyPages)
+	buf = binary.LittleEndian.AppendUint64(buf, record.FreedPages)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(record.CommitLatency))
+	buf = binary.LittleEndian.AppendUint64(buf, record.Rebalance.Splits)
+	buf = binary.LittleEndian.AppendUint64(buf, record.Rebalance.Merges)
+	buf = binary.LittleEndian.AppendUint64(buf, record.Rebalance.Rotations)
+	buf = binary.LittleEndian.AppendUint64(buf, record.Rebalance.RootSplits)
+	return binary.LittleEndian.AppendUint64(buf, record.Rebalance.RootCollapses)
+}
+
+func deserializeStatsRecord(value []byte) *StatsRecord {
+	record := &StatsRecord{
+		TxID:          binary.LittleEndian.Uint64(value),
+		Time:          time.Unix(0, int64(binary.LittleEndian.Uint64(value[8:]))),
+		Pages:         binary.LittleEndian.Uint64(value[16:]),
+		FreePages:     binary.LittleEndian.Uint64(value[24:]),
+		DirtyPages:    binary.LittleEndian.Uint64(value[32:]),
+		FreedPages:    binary.LittleEndian.Uint64(value[40:]),
+		CommitLatency: time.Duration(binary.LittleEndian.Uint64(value[48:])),
+	}
+	if len(value) >= statsRecordSize {
+		record.Rebalance = RebalanceStats{
+			Splits:        binary.LittleEndian.Uint64(value[56:]),
+			Merges:        binary.LittleEndian.Uint64(value[64:]),
+			Rotations:     binary.LittleEndian.Uint64(value[72:]),
+			RootSplits:    binary.LittleEndian.Uint64(value[80:]),
+			RootCollapses: binary.LittleEndian.Uint64(value[88:]),
+		}
+	}
+	return record
+}
+
+// statsSlot returns the key of the slot of the ring buffer the record of the transaction is kept in. The slots are
+// reused every Options.StatsHistory commits, which drops the oldest record.
+func (d *dal) statsSlot(txid uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, txid%uint64(d.statsHistory))
+}
+
+// recordStats puts the record of the committing transaction into the stats history, along with the latency of the
+// previous commit of the handle.
+func (tx *Tx) recordStats() (*StatsRecord, error) {
+	collection, err := tx.GetCollection(statsHistoryCollection)
+	if err != nil {
+		return nil, err
+	}
+	if collection == nil {
+		collection, err = tx.createCollection(statsHistoryCollection)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	record := &StatsRecord{
+		TxID:       tx.id,
+		Time:       tx.db.now(),
+		Pages:      uint64(tx.db.maxPage) + 1,
+		FreePages:  uint64(len(tx.db.releasedPages)),
+		DirtyPages: uint64(len(tx.dirtyNodes)),
+		FreedPages: uint64(len(tx.pagesToDelete)),
+		Rebalance:  tx.rebalance,
+	}
+	if last := tx.db.lastStats; last != nil && last.TxID == tx.id-1 {
+		err = collection.Put(tx.db.statsSlot(last.TxID), serializeStatsRecord(last))
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = collection.Put(tx.db.statsSlot(tx.id), serializeStatsRecord(record))
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// StatsHistory returns the records of the stats history, from the oldest to the latest commit. It's empty if the
+// history was never enabled.
+func (tx *Tx) StatsHistory() ([]*StatsRecord, error) {
+	collection, err := tx.GetCollection(statsHistoryCollection)
+	if err != nil || collection == nil {
+		return nil, err
+	}
+
+	var records []*StatsRecord
+	err = tx.rangeItems(collection.root, KeyRange{}, func(item *Item) (bool, error) {
+		// Records are stored in overflow pages when the inline threshold is below their size
+		item, err := collection.resolveItem(item)
+		if err != nil {
+			return false, err
+		}
+		if len(item.value) == statsRecordSize || len(item.value) == statsRecordBaseSize {
+			records = append(records, deserializeStatsRecord(item.value))
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].TxID < records[j].TxID
+	})
+	return records, nil
+}
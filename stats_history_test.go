@@ -0,0 +1,73 @@
+package gopherdb
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func statsHistory(t *testing.T, db *DB) []*StatsRecord {
+	t.Helper()
+	var records []*StatsRecord
+	mustView(t, db, func(tx *Tx) error {
+		var err error
+		records, err = tx.StatsHistory()
+		return err
+	})
+	return records
+}
+
+func TestStatsHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	options.StatsHistory = 3
+	db := openTestPath(t, path, options)
+	for i := 0; i < 5; i++ {
+		putValue(t, db, "c", string(testKey(i)), "value")
+	}
+
+	// The ring buffer keeps the last three commits, oldest first
+	records := statsHistory(t, db)
+	if len(records) != 3 {
+		t.Fatalf("the history has %d records, want 3", len(records))
+	}
+	for i, record := range records {
+		if i > 0 && record.TxID != records[i-1].TxID+1 {
+			t.Errorf("record %d is of txid %d, right after txid %d", i, record.TxID, records[i-1].TxID)
+		}
+		if record.Pages == 0 || record.DirtyPages == 0 || record.Time.IsZero() {
+			t.Errorf("record of txid %d: %+v", record.TxID, record)
+		}
+		// The latency of a commit is recorded by the next one
+		if last := i == len(records)-1; (record.CommitLatency == 0) != last {
+			t.Errorf("record of txid %d has a latency of %v", record.TxID, record.CommitLatency)
+		}
+	}
+	if latest := records[len(records)-1].TxID; latest != db.txid {
+		t.Errorf("the latest record is of txid %d, want the last commit %d", latest, db.txid)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	checkFile(t, path, options)
+
+	// The history is in the file, and isn't recorded by handles that don't enable it
+	db = openTestPath(t, path, testOptions())
+	putValue(t, db, "c", "k", "value")
+	if reopened := statsHistory(t, db); len(reopened) != 3 || reopened[2].TxID != records[2].TxID {
+		t.Errorf("after reopening, the history has %d records", len(reopened))
+	}
+}
+
+func TestStatsHistoryDisabled(t *testing.T) {
+	db := openTestDB(t, nil)
+	putValue(t, db, "c", "k", "value")
+	if records := statsHistory(t, db); len(records) != 0 {
+		t.Errorf("the history has %d records without being enabled", len(records))
+	}
+	mustView(t, db, func(tx *Tx) error {
+		if c, err := tx.GetCollection(statsHistoryCollection); err != nil || c != nil {
+			t.Errorf("the history collection was created without the history being enabled")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,173 @@
+package gopherdb
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestAccessStatsCountReadsWritesAndMisses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPath(t, path, nil)
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for _, key := range []string{"a", "b", "c"} {
+			if err := c.Put([]byte(key), []byte("v")); err != nil {
+				return err
+			}
+		}
+		return c.Remove([]byte("c"))
+	})
+	// The counters are kept by the database, so they add up across transactions and collection handles
+	mustView(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for _, key := range []string{"a", "b", "missing"} {
+			if _, err := c.Find([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	want := CollectionAccessStats{Reads: 3, Writes: 4, Misses: 1}
+	if got := db.AccessStats()["c"]; got != want {
+		t.Errorf("AccessStats: got %+v, want %+v", got, want)
+	}
+	if _, ok := db.AccessStats()["other"]; ok {
+		t.Error("AccessStats has counters for a collection that was never accessed")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	db = openTestPath(t, path, nil)
+	if got := db.AccessStats()["c"]; got != (CollectionAccessStats{}) {
+		t.Errorf("AccessStats after reopening: got %+v, want zero counters", got)
+	}
+}
+
+func TestFileStats(t *testing.T) {
+	options := testOptions()
+	db := openTestDB(t, options)
+	mustUpdate(t, db, func(tx *Tx) error {
+		for i := 0; i < 100; i++ {
+			if err := getOrCreate(t, tx, "b").Put(testKey(i), []byte("v")); err != nil {
+				return err
+			}
+		}
+		return getOrCreate(t, tx, "a").Put([]byte("big"), make([]byte, 2*options.pageSize))
+	})
+	mustView(t, db, func(tx *Tx) error {
+		stats, err := tx.FileStats()
+		if err != nil {
+			return err
+		}
+		if stats.PageSize != options.pageSize || stats.Pages != uint64(db.maxPage)+1 || stats.TxID != db.txid {
+			t.Errorf("FileStats: got %+v", stats)
+		}
+		if stats.FileSize != int64(stats.Pages)*int64(options.pageSize) {
+			t.Errorf("file size %d isn't %d pages of %d bytes", stats.FileSize, stats.Pages, options.pageSize)
+		}
+		if len(stats.Collections) != 2 {
+			t.Fatalf("FileStats has %d collections, want 2", len(stats.Collections))
+		}
+		// The collections are sorted by name
+		a, b := stats.Collections[0], stats.Collections[1]
+		capacity := uint64(tx.overflowPageCapacity())
+		if a.Name != "a" || a.Keys != 1 || a.Pages != 1 || a.OverflowPages != (uint64(2*options.pageSize)+capacity-1)/capacity {
+			t.Errorf("stats of a: got %+v", a)
+		}
+		if b.Name != "b" || b.Keys != 100 || b.Pages < 2 || b.OverflowPages != 0 {
+			t.Errorf("stats of b: got %+v", b)
+		}
+		return nil
+	})
+}
+
+func TestFileStatsGarbage(t *testing.T) {
+	db := openTestDB(t, nil)
+	garbage := func() (CollectionFileStats, float64) {
+		t.Helper()
+		var stats *FileStats
+		mustView(t, db, func(tx *Tx) error {
+			var err error
+			stats, err = tx.FileStats()
+			return err
+		})
+		return stats.Collections[0], stats.GarbageRatio
+	}
+	mustUpdate(t, db, func(tx *Tx) error {
+		for i := 0; i < 400; i++ {
+			if err := getOrCreate(t, tx, "c").Put(testKey(i), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	// Keys put in order leave every node but the last one half full after its split
+	c, ratio := garbage()
+	if c.UsedBytes == 0 || c.UsedBytes > c.Pages*uint64(db.pageSize) {
+		t.Errorf("%d pages use %d bytes", c.Pages, c.UsedBytes)
+	}
+	if c.GarbagePages < c.Pages/4 || ratio != float64(c.GarbagePages)/float64(c.Pages) {
+		t.Errorf("garbage of a tree of half full nodes: got %d of %d pages and a ratio of %.2f", c.GarbagePages, c.Pages, ratio)
+	}
+
+	mustUpdate(t, db, func(tx *Tx) error {
+		return getOrCreate(t, tx, "c").Compact()
+	})
+	compacted, ratio := garbage()
+	if compacted.Pages >= c.Pages || compacted.GarbagePages > 1 || ratio > 0.1 {
+		t.Errorf("garbage once compacted: got %d of %d pages and a ratio of %.2f", compacted.GarbagePages, compacted.Pages, ratio)
+	}
+}
+
+func collectionStats(t *testing.T, db *DB, name string) *CollectionStats {
+	t.Helper()
+	var stats *CollectionStats
+	mustView(t, db, func(tx *Tx) error {
+		var err error
+		stats, err = getOrCreate(t, tx, name).Stats()
+		return err
+	})
+	return stats
+}
+
+func TestCollectionStats(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustUpdate(t, db, func(tx *Tx) error {
+		getOrCreate(t, tx, "c")
+		return nil
+	})
+	if stats := collectionStats(t, db, "c"); stats.Keys != 0 || stats.Depth != 1 || stats.LeafPages != 1 || stats.BranchPages != 0 {
+		t.Fatalf("got %+v for an empty collection", stats)
+	}
+
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i := 0; i < 300; i++ {
+			if err := c.Put(testKey(i), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return c.Put([]byte("big"), make([]byte, 2000))
+	})
+	stats := collectionStats(t, db, "c")
+	if stats.Keys != 301 || stats.Depth < 2 || stats.BranchPages == 0 || stats.LeafPages <= stats.BranchPages {
+		t.Fatalf("got %+v for 301 keys", stats)
+	}
+	if stats.OverflowBytes != 2000 || stats.OverflowPages != 4 {
+		t.Fatalf("got %d overflow bytes in %d pages, want 2000 in 4", stats.OverflowBytes, stats.OverflowPages)
+	}
+	if stats.FillFactor < 0.3 || stats.FillFactor > 1 {
+		t.Fatalf("got a fill factor of %v", stats.FillFactor)
+	}
+
+	// Compaction packs the nodes
+	mustUpdate(t, db, func(tx *Tx) error {
+		return getOrCreate(t, tx, "c").Compact()
+	})
+	if compacted := collectionStats(t, db, "c"); compacted.Keys != 301 || compacted.FillFactor <= stats.FillFactor {
+		t.Fatalf("got %+v after compacting, had a fill factor of %v", compacted, stats.FillFactor)
+	}
+}
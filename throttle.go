@@ -0,0 +1,85 @@
+package gopherdb
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// IOThrottle slows down the page reads and writes of a database, to test how an application behaves when the file
+// sits on a slow volume, like a network disk. It's meant for tests: it only delays IO, it never fails it.
+type IOThrottle struct {
+	// BytesPerSecond caps the throughput of the reads and writes together. Every page waits until the pages before it
+	// had their share of the throughput, so bursts are smoothed out. Zero means no cap.
+	BytesPerSecond int64
+	// Latency returns the latency added to every page read and write, on top of the throughput cap. It's called for
+	// every page, so it can draw from a distribution, see FixedLatency, UniformLatency and NormalLatency. Nil means no
+	// latency.
+	Latency func() time.Duration
+}
+
+// FixedLatency returns a latency function always returning d.
+func FixedLatency(d time.Duration) func() time.Duration {
+	return func() time.Duration {
+		return d
+	}
+}
+
+// UniformLatency returns a latency function drawing uniformly between min and max.
+func UniformLatency(min time.Duration, max time.Duration) func() time.Duration {
+	return func() time.Duration {
+		if max <= min {
+			return min
+		}
+		return min + time.Duration(rand.Int63n(int64(max-min)))
+	}
+}
+
+// NormalLatency returns a latency function drawing from a normal distribution of the given mean and standard
+// deviation. Negative draws are zero.
+func NormalLatency(mean time.Duration, stddev time.Duration) func() time.Duration {
+	return func() time.Duration {
+		d := mean + time.Duration(rand.NormFloat64()*float64(stddev))
+		if d < 0 {
+			return 0
+		}
+		return d
+	}
+}
+
+// ioThrottle applies an IOThrottle. next is when the throughput cap lets the next page through.
+type ioThrottle struct {
+	config IOThrottle
+	mu     sync.Mutex
+	next   time.Time
+}
+
+func newIOThrottle(config *IOThrottle) *ioThrottle {
+	if config == nil || (config.BytesPerSecond <= 0 && config.Latency == nil) {
+		return nil
+	}
+	return &ioThrottle{config: *config}
+}
+
+// wait blocks for the time it takes to transfer size bytes.
+func (t *ioThrottle) wait(size int) {
+	if t == nil {
+		return
+	}
+	var delay time.Duration
+	if t.config.Latency != nil {
+		delay = t.config.Latency()
+	}
+	if t.config.BytesPerSecond > 0 {
+		now := time.Now()
+		t.mu.Lock()
+		if t.next.Before(now) {
+			t.next = now
+		}
+		t.next = t.next.Add(time.Duration(int64(size) * int64(time.Second) / t.config.BytesPerSecond))
+		transferred := t.next.Sub(now)
+		t.mu.Unlock()
+		delay += transferred
+	}
+	time.Sleep(delay)
+}
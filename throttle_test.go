@@ -0,0 +1,56 @@
+package gopherdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIOThrottleCapsThroughput(t *testing.T) {
+	throttle := newIOThrottle(&IOThrottle{BytesPerSecond: 100 * 1024})
+	start := time.Now()
+	// 20KB at 100KB/s, whatever the size of the bursts
+	for i := 0; i < 10; i++ {
+		throttle.wait(2048)
+	}
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Errorf("20KB went through in %v, want at least 200ms", elapsed)
+	}
+
+	// Time spent without IO isn't made up for by a later burst beyond the cap
+	time.Sleep(50 * time.Millisecond)
+	start = time.Now()
+	throttle.wait(10 * 1024)
+	if elapsed := time.Since(start); elapsed < 95*time.Millisecond {
+		t.Errorf("10KB after a pause went through in %v, want at least 100ms", elapsed)
+	}
+}
+
+func TestIOThrottleLatency(t *testing.T) {
+	if newIOThrottle(nil) != nil || newIOThrottle(&IOThrottle{}) != nil {
+		t.Error("a throttle that doesn't slow anything down was created")
+	}
+
+	for i := 0; i < 1000; i++ {
+		if d := NormalLatency(time.Millisecond, 5*time.Millisecond)(); d < 0 {
+			t.Fatalf("NormalLatency drew the negative latency %v", d)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		if d := UniformLatency(time.Millisecond, 3*time.Millisecond)(); d < time.Millisecond || d >= 3*time.Millisecond {
+			t.Fatalf("UniformLatency(1ms, 3ms) drew %v", d)
+		}
+	}
+	if d := UniformLatency(time.Millisecond, time.Millisecond)(); d != time.Millisecond {
+		t.Errorf("UniformLatency(1ms, 1ms) drew %v", d)
+	}
+
+	// Every page read and written by the database waits
+	options := testOptions()
+	options.IOThrottle = &IOThrottle{Latency: FixedLatency(5 * time.Millisecond)}
+	db := openTestDB(t, options)
+	start := time.Now()
+	putValue(t, db, "c", "k", "value")
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("a commit on the throttled database took %v, want at least 2 pages of 5ms", elapsed)
+	}
+}
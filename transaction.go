@@ -1,38 +1,100 @@
-package main
+package gopherdb
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Tx is a transaction. A read transaction, its collections and their items can be used by several goroutines at once,
+// for example to run the parts of a query in parallel; every goroutine needs its own cursors and value readers, and
+// the transaction must only be ended once they're all done. A write transaction must be used by one goroutine at a
+// time.
+type Tx struct {
+	// id is the id the transaction commits with for write transactions, and the id of the commit read transactions
+	// read, the last one when they began.
+	id uint64
+	// root is the root page of the root collection, saved to the meta page on Commit.
+	root pgnum
+	// collections holds the collections opened by the transaction, so every handle of a collection shares its root.
+	collections map[string]*Collection
 
-type tx struct {
 	dirtyNodes        map[pgnum]*Node
 	pagesToDelete     []pgnum
 	allocatedPageNums []pgnum
 	write             bool
 	db                *DB
+	// debug is set on the transactions of DebugTx, which hold no lock.
+	debug bool
+	// dryRun is set by DryRun, and filled by Commit.
+	dryRun *DryRunReport
+	// batchNodes caches the clean nodes read during Batch.
+	batchNodes map[pgnum]*Node
+	// pageWrites holds the pages written with WritePage, written on Commit. userPages holds the pages taken with
+	// AllocatePage, and committedPages the pages the committed trees use and freePages the free ones, read on the first
+	// WritePage or FreePage.
+	pageWrites     map[pgnum][]byte
+	userPages      map[pgnum]bool
+	committedPages map[pgnum]bool
+	freePages      map[pgnum]bool
+	// rebalance counts the rebalancing operations of the transaction.
+	rebalance RebalanceStats
+	// mu guards the state read transactions change as they read: collections, batchNodes and batches, the number of
+	// Batch calls running.
+	mu      sync.Mutex
+	batches int
+	// readPages holds the nodes read by a write transaction, which Commit visits to find the paths to the dirty nodes.
+	readPages map[pgnum]bool
+	// writes is what the transaction changed, recorded while optimistic transactions run, see OptimisticTx.
+	writes *writeSet
+	// watchEvents holds the changes to watched keys, delivered on Commit, see DB.Watch.
+	watchEvents []WatchEvent
+	// snapshot is the state of the file a read transaction reads, see fileState.
+	snapshot *fileState
+	// retries is the number of times DB.Update ran its function before, when it runs it again after ErrConflict.
+	retries int
 }
 
-
-
-
-func newTx(db *DB, write bool) *tx {
-	return &tx{
-		map[pgnum]*Node{},
-		make([]pgnum, 0),
-		make([]pgnum, 0),
-		write,
-		db,
+// newTx returns a transaction with the id on the trees of the root collection at root, see Tx.id.
+func newTx(db *DB, write bool, id uint64, root pgnum) *Tx {
+	if write {
+		db.counters.writeTxs.Add(1)
+	} else {
+		db.counters.readTxs.Add(1)
+	}
+	return &Tx{
+		id:                id,
+		root:              root,
+		collections:       map[string]*Collection{},
+		dirtyNodes:        map[pgnum]*Node{},
+		pagesToDelete:     make([]pgnum, 0),
+		allocatedPageNums: make([]pgnum, 0),
+		write:             write,
+		db:                db,
 	}
 }
 
+// ID returns the id of the transaction. Write transactions get the next id when they begin and make it the last
+// committed id on Commit, while read transactions see the id of the commit they read, the last one when they began.
+// Ids only grow, which makes them usable as fencing tokens and versions.
+func (tx *Tx) ID() uint64 {
+	return tx.id
+}
 
-func (tx *tx) getRootCollection() *Collection{
+func (tx *Tx) getRootCollection() *Collection{
 	rootCollection := newEmptyCollection() 
-	rootCollection.root = tx.db.root 
+	rootCollection.root = tx.root
 	rootCollection.tx = tx
 	return rootCollection
 }
-func (tx *tx) GetCollection(collectionName []byte) (*Collection,error){
-	rootCollection := tx.getRootCollection()
-	item,err := rootCollection.Find(collectionName)
+func (tx *Tx) GetCollection(collectionName []byte) (*Collection,error){
+	if collection := tx.openedCollection(collectionName); collection != nil {
+		return collection, nil
+	}
+	item,err := tx.findCollectionItem(collectionName)
 	if err!=nil{
-		return nil,err
+		return nil,addContext(err, DBError{Op: "open collection", Collection: string(collectionName)})
 	}
 	if item == nil{
 		return nil,nil
@@ -40,42 +102,245 @@ func (tx *tx) GetCollection(collectionName []byte) (*Collection,error){
 	collection := newEmptyCollection()
 	collection.deserialize(item)
 	collection.tx = tx
-	return collection,nil
+	collection.counters = tx.db.accessStats.countersFor(collection.name)
+	return tx.addCollection(collection),nil
 }
 
-func(tx *tx) CreateCollection(collectionName []byte) (*Collection,error){
-	if !tx.write{
-		return nil, errWriteInsideReadTxErr
+// openedCollection returns the collection if the transaction already opened it, or nil.
+func (tx *Tx) openedCollection(name []byte) *Collection {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.collections[string(name)]
+}
+
+// addCollection keeps the collection opened by the transaction. If another goroutine opened it first, its handle is
+// returned instead, so the handles keep sharing their root.
+func (tx *Tx) addCollection(collection *Collection) *Collection {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if opened, ok := tx.collections[string(collection.name)]; ok {
+		return opened
+	}
+	tx.collections[string(collection.name)] = collection
+	return collection
+}
+
+// CreateCollection creates an empty collection. It fails with ErrCollectionExists if there's one by that name already,
+// and with ErrInternalCollection if the name starts with "__gopherdb_", which the database keeps for its own
+// collections.
+func(tx *Tx) CreateCollection(collectionName []byte) (*Collection,error){
+	if isInternalCollection(collectionName) {
+		return nil, fmt.Errorf("%w: %q", ErrInternalCollection, collectionName)
+	}
+	return tx.createCollection(collectionName)
+}
+
+// createCollection creates an empty collection like CreateCollection, whatever its name, for the internal collections.
+func (tx *Tx) createCollection(collectionName []byte) (*Collection, error) {
+	if !tx.write {
+		return nil, ErrWriteInsideReadTx
 	}
-	newCollectionPage, err := tx.db.writeNode(NewEmptyNode())
-	if err!= nil {
+	existing, err := tx.GetCollection(collectionName)
+	if err != nil {
 		return nil, err
 	}
+	if existing != nil {
+		return nil, fmt.Errorf("%w: %q", ErrCollectionExists, collectionName)
+	}
+	newCollectionPage := tx.writeNode(tx.newNode([]*Item{}, []pgnum{}))
 	newCollection := newEmptyCollection()
 	newCollection.name = collectionName 
 	newCollection.root = newCollectionPage.pageNum
 	return tx._createCollection(newCollection)
 }
-func (tx *tx) _createCollection(collection *Collection) (*Collection,error){
+func (tx *Tx) _createCollection(collection *Collection) (*Collection,error){
 	collection.tx = tx 
+	collection.counters = tx.db.accessStats.countersFor(collection.name)
 	collectionBytes := collection.serialize() 
 	rootCollection := tx.getRootCollection()
 	err:= rootCollection.Put(collection.name,collectionBytes.value)
 	if err!=nil{
 		return nil,err
 	}
+	tx.mu.Lock()
+	tx.collections[string(collection.name)] = collection
+	tx.mu.Unlock()
+	tx.recordCollection(collection.name)
 	return collection,nil
 } 
 
-func (tx *tx) DeleteCollection(name []byte) error{
+// getOrCreateCollection returns the collection, creating it first if it doesn't exist. Internal collections are
+// created too, for the features keeping them and for the copies of files holding them.
+func (tx *Tx) getOrCreateCollection(name []byte) (*Collection, error) {
+	collection, err := tx.GetCollection(name)
+	if err != nil || collection != nil {
+		return collection, err
+	}
+	return tx.createCollection(name)
+}
+
+// DeleteMode selects what DeleteCollection does with a collection that still has keys.
+type DeleteMode int
+
+const (
+	// DeleteCascade deletes the collection with everything in it, freeing all of its pages.
+	DeleteCascade DeleteMode = iota
+	// DeleteIfEmpty deletes the collection only if it has no keys, and fails with ErrCollectionNotEmpty otherwise.
+	DeleteIfEmpty
+)
+
+// DeleteCollection deletes the collection and frees its pages, including the overflow pages of its values. Deleting a
+// collection that doesn't exist is a no-op. Handles of the collection must not be used afterwards. It fails with
+// ErrInternalCollection for the collections the database keeps for itself, see CreateCollection: the checkpoints of
+// Options.Checkpoints, for one, hold pages Open expects to find held.
+func (tx *Tx) DeleteCollection(name []byte, mode DeleteMode) error{
 	if !tx.write{
-		return errWriteInsideReadTxErr
+		return ErrWriteInsideReadTx
+	}
+	if isInternalCollection(name) {
+		return fmt.Errorf("%w: %q", ErrInternalCollection, name)
+	}
+	collection, err := tx.GetCollection(name)
+	if err != nil || collection == nil {
+		return err
 	}
+
+	root, err := tx.getNode(collection.root)
+	if err != nil {
+		return err
+	}
+	if mode == DeleteIfEmpty && len(root.items) > 0 {
+		return ErrCollectionNotEmpty
+	}
+	err = tx.freeTree(collection.root)
+	if err != nil {
+		return err
+	}
+
+	delete(tx.collections, string(name))
+	tx.recordCollection(name)
 	rootCollection := tx.getRootCollection()
 	return rootCollection.Remove(name)
 }
 
-func (tx *tx) newNode(items []*Item, childNodes []pgnum) *Node {
+// RenameCollection renames the collection old to new, rewriting its entry in the root collection without copying its
+// tree, so staging a collection and swapping it in costs the same whatever its size. It fails with
+// ErrCollectionNotFound if there's no collection old, with ErrCollectionExists if there's a collection new, and with
+// ErrInternalCollection if either name is one of the collections the database keeps for itself. The handles of the
+// collection opened by the transaction take the new name.
+//
+// Triggers, change hooks, views and key transforms are registered by name. The stored keys of the collection were
+// written through the key transform of the old name, so the rename fails with ErrKeyTransformMismatch unless the new
+// name has the same *KeyTransform, or neither has one. The triggers, change hooks and views follow the name: the
+// collection runs the ones of the new name from then on.
+//
+//	err = tx.RenameCollection([]byte("users"), []byte("users-old"))
+//	...
+//	err = tx.RenameCollection([]byte("users-staged"), []byte("users"))
+func (tx *Tx) RenameCollection(old []byte, new []byte) error {
+	if !tx.write {
+		return ErrWriteInsideReadTx
+	}
+	for _, name := range [][]byte{old, new} {
+		if isInternalCollection(name) {
+			return fmt.Errorf("%w: %q", ErrInternalCollection, name)
+		}
+	}
+	collection, err := tx.GetCollection(old)
+	if err != nil {
+		return err
+	}
+	if collection == nil {
+		return fmt.Errorf("%w: %q", ErrCollectionNotFound, old)
+	}
+	if bytes.Equal(old, new) {
+		return nil
+	}
+	if tx.db.triggers.keyTransform(old) != tx.db.triggers.keyTransform(new) {
+		return fmt.Errorf("%w: %q and %q", ErrKeyTransformMismatch, old, new)
+	}
+	existing, err := tx.GetCollection(new)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("%w: %q", ErrCollectionExists, new)
+	}
+
+	// The new entry goes first, so a name the root collection rejects changes nothing
+	rootCollection := tx.getRootCollection()
+	name := append([]byte{}, new...)
+	err = rootCollection.Put(name, collection.serialize().value)
+	if err != nil {
+		return err
+	}
+	err = rootCollection.Remove(old)
+	if err != nil {
+		return err
+	}
+
+	tx.mu.Lock()
+	collection.name = name
+	collection.counters = tx.db.accessStats.countersFor(collection.name)
+	delete(tx.collections, string(old))
+	tx.collections[string(new)] = collection
+	tx.mu.Unlock()
+	tx.recordCollection(old)
+	tx.recordCollection(new)
+	return nil
+}
+
+// ForEachCollection calls fn with the name of every collection, in order, until fn returns an error, which
+// ForEachCollection returns. It scans the root collection, skipping the collections the database keeps for itself, like
+// the ones of Options.Checkpoints, and the collections nested in others. The name is only valid until fn returns, and
+// fn must not create or delete collections.
+func (tx *Tx) ForEachCollection(fn func(name []byte) error) error {
+	return tx.rangeItems(tx.root, KeyRange{}, func(item *Item) (bool, error) {
+		if isInternalCollection(item.key) {
+			return true, nil
+		}
+		return true, fn(item.key)
+	})
+}
+
+// ListCollections returns the names of the collections, sorted, like ForEachCollection.
+func (tx *Tx) ListCollections() ([][]byte, error) {
+	names := [][]byte{}
+	err := tx.ForEachCollection(func(name []byte) error {
+		names = append(names, append([]byte{}, name...))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// freeTree frees every node of the tree and the overflow pages of its items on Commit.
+func (tx *Tx) freeTree(root pgnum) error {
+	return tx.walk(root, func(n *Node) error {
+		for _, item := range n.items {
+			if item.overflow {
+				err := tx.freeOverflow(deserializeOverflowRef(item.value))
+				if err != nil {
+					return err
+				}
+			}
+			if item.collection {
+				nested := newEmptyCollection()
+				nested.deserialize(item)
+				err := tx.freeTree(nested.root)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		tx.deleteNode(n)
+		return nil
+	})
+}
+
+func (tx *Tx) newNode(items []*Item, childNodes []pgnum) *Node {
 	node := NewEmptyNode()
 	node.items = items
 	node.childNodes = childNodes
@@ -86,68 +351,361 @@ func (tx *tx) newNode(items []*Item, childNodes []pgnum) *Node {
 	return node
 }
 
-func (tx *tx) getNode(pageNum pgnum) (*Node, error) {
+func (tx *Tx) getNode(pageNum pgnum) (*Node, error) {
+	if tx.write {
+		if tx.readPages == nil {
+			tx.readPages = map[pgnum]bool{}
+		}
+		tx.readPages[pageNum] = true
+	}
 	if node, ok := tx.dirtyNodes[pageNum]; ok {
 		return node, nil
 	}
+	tx.mu.Lock()
+	node, ok := tx.batchNodes[pageNum]
+	tx.mu.Unlock()
+	if ok {
+		return node, nil
+	}
 
 	node, err := tx.db.getNode(pageNum)
 	if err != nil {
 		return nil, err
 	}
-	node.tx = tx
+	tx.adoptNode(node)
 	return node, nil
 }
 
-func (tx *tx) writeNode(node *Node) *Node {
+// adoptNode makes a node read from the file a node of the transaction.
+func (tx *Tx) adoptNode(node *Node) {
+	node.tx = tx
+	tx.mu.Lock()
+	if tx.batchNodes != nil {
+		tx.batchNodes[node.pageNum] = node
+	}
+	tx.mu.Unlock()
+}
+
+// hasNode reports whether the transaction holds the node of the page already, so getNode doesn't read it.
+func (tx *Tx) hasNode(pageNum pgnum) bool {
+	if _, ok := tx.dirtyNodes[pageNum]; ok {
+		return true
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	_, ok := tx.batchNodes[pageNum]
+	return ok
+}
+
+// getSiblings returns the nodes of two pages like getNode, or nil for a zero page number. When the transaction holds
+// neither, they're read at the same time, so a rebalance choosing between the siblings of a node waits for a single
+// read from the storage rather than two in a row.
+func (tx *Tx) getSiblings(left pgnum, right pgnum) (*Node, *Node, error) {
+	if left == 0 || right == 0 || tx.hasNode(left) || tx.hasNode(right) {
+		var leftNode, rightNode *Node
+		var err error
+		if left != 0 {
+			leftNode, err = tx.getNode(left)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if right != 0 {
+			rightNode, err = tx.getNode(right)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return leftNode, rightNode, nil
+	}
+
+	var rightNode *Node
+	var rightErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rightNode, rightErr = tx.db.getNode(right)
+	}()
+	leftNode, err := tx.getNode(left)
+	<-done
+	if err != nil {
+		return nil, nil, err
+	}
+	if rightErr != nil {
+		return nil, nil, rightErr
+	}
+	if tx.write {
+		tx.readPages[right] = true
+	}
+	tx.adoptNode(rightNode)
+	return leftNode, rightNode, nil
+}
+
+// walk visits all the nodes of the tree starting at root in depth first order.
+func (tx *Tx) walk(root pgnum, fn func(n *Node) error) error {
+	node, err := tx.getNode(root)
+	if err != nil {
+		return err
+	}
+	err = fn(node)
+	if err != nil {
+		return err
+	}
+	for _, child := range node.childNodes {
+		err = tx.walk(child, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *Tx) writeNode(node *Node) *Node {
 	tx.dirtyNodes[node.pageNum] = node
 	node.tx = tx
 	return node
 }
 
-func (tx *tx) deleteNode(node *Node) {
+// deleteNode frees the page of the node on Commit. The node is dropped from the dirty nodes, since a page freed by the
+// transaction must not be written by it.
+func (tx *Tx) deleteNode(node *Node) {
+	delete(tx.dirtyNodes, node.pageNum)
+	delete(tx.batchNodes, node.pageNum)
 	tx.pagesToDelete = append(tx.pagesToDelete, node.pageNum)
 }
 
-func (tx *tx) Rollback() {
+func (tx *Tx) Rollback() {
+	if tx.debug {
+		return
+	}
 	if !tx.write {
-		tx.db.rwlock.RUnlock()
+		tx.db.endRead(tx.id)
 		return
 	}
 
 	tx.dirtyNodes = nil
 	tx.pagesToDelete = nil
+	tx.collections = nil
+	tx.pageWrites = nil
 	for _, pageNum := range tx.allocatedPageNums {
 		tx.db.freelist.releasePage(pageNum)
 	}
 	tx.allocatedPageNums = nil
-	tx.db.rwlock.Unlock()
+	tx.db.counters.rollbacks.Add(1)
+	tx.db.endTx(true)
+	tx.db.deliverSoftLimits()
 }
 
-func (tx *tx) Commit() error {
+// Commit writes the dirty nodes, frees the deleted pages and writes the freelist and the meta page. If a write fails,
+// the transaction ends like a rollback: the file keeps the root, the txid and the freelist of the previous commit, and
+// the pages the transaction wrote are free again.
+func (tx *Tx) Commit() error {
+	if tx.debug {
+		return nil
+	}
 	if !tx.write {
-		tx.db.rwlock.RUnlock()
+		tx.db.endRead(tx.id)
 		return nil
 	}
+	if tx.dryRun != nil {
+		return tx.commitDryRun()
+	}
+	start := tx.db.now()
+	began := time.Now()
+	var record *StatsRecord
+	if tx.db.statsHistory > 0 {
+		var err error
+		record, err = tx.recordStats()
+		if err != nil {
+			tx.Rollback()
+			return addContext(err, DBError{Op: "commit"})
+		}
+	}
+	var checkpoints *checkpointChanges
+	if len(tx.db.checkpointTiers) > 0 || len(tx.db.checkpoints) > 0 {
+		var err error
+		checkpoints, err = tx.updateCheckpoints(start)
+		if err != nil {
+			tx.Rollback()
+			return addContext(err, DBError{Op: "commit"})
+		}
+	}
+	err := tx.copyOnWrite()
+	if err != nil {
+		tx.Rollback()
+		return addContext(err, DBError{Op: "commit"})
+	}
+	// The events of the soft limits crossed by the commit are delivered once the lock is released
+	defer tx.db.deliverSoftLimits()
+	defer tx.db.endTx(true)
+	// Until the meta page is durable, a failed write puts back what the commit changed
+	saved := tx.db.saveCommitState()
+	fail := func(err error) error {
+		tx.db.restoreCommitState(saved)
+		tx.db.counters.rollbacks.Add(1)
+		for _, pageNum := range tx.allocatedPageNums {
+			tx.db.freelist.releasePage(pageNum)
+		}
+		tx.dirtyNodes = nil
+		tx.pagesToDelete = nil
+		tx.allocatedPageNums = nil
+		tx.collections = nil
+		tx.pageWrites = nil
+		tx.db.logger.Error("gopherdb: commit failed", "txid", tx.id, "err", err)
+		return internalError(err, DBError{Op: "commit"})
+	}
 
 	for _, node := range tx.dirtyNodes {
 		_, err := tx.db.writeNode(node)
 		if err != nil {
-			return err
+			return fail(err)
 		}
 	}
+	err = tx.writeUserPages()
+	if err != nil {
+		return fail(err)
+	}
 
-	for _, pageNum := range tx.pagesToDelete {
-		tx.db.deleteNode(pageNum)
+	// The freed pages go to the freelist written with the commit, but they're only reused once the commit is durable,
+	// since the freelist is put back if it fails
+	err = tx.db.persistFreelist(tx.id, tx.pagesToDelete)
+	if err != nil {
+		return fail(err)
 	}
-	_, err := tx.db.writeFreelist()
+	// The meta page is written once everything it points to is on disk, and the commit is done once it's on disk too.
+	// Until then, Open finds the other meta page, of the previous commit.
+	err = tx.db.syncCommit()
 	if err != nil {
-		return err
+		return fail(err)
+	}
+
+	meta := *tx.db.meta
+	meta.txid = tx.id
+	meta.root = tx.root
+	meta.clean = false
+	_, err = tx.db.writeMeta(&meta)
+	if err != nil {
+		return fail(err)
+	}
+	err = tx.db.commitPages()
+	if err != nil {
+		return fail(err)
+	}
+	*tx.db.meta = meta
+	// A segment that can't be shipped now is shipped with the next one
+	if err := tx.db.ship(); err != nil {
+		tx.db.logger.Warn("gopherdb: shipping the segment failed, it's shipped with the next commit", "txid", tx.id,
+			"err", err)
 	}
+	tx.db.rebalanceTotals.mu.Lock()
+	tx.db.rebalanceTotals.stats.add(tx.rebalance)
+	tx.db.rebalanceTotals.mu.Unlock()
+	tx.db.counters.commits.Add(1)
+	duration := time.Since(began)
+	tx.db.counters.commitLatency.observe(duration)
+	tx.db.logger.Debug("gopherdb: commit", "txid", tx.id, "dirty_pages", len(tx.dirtyNodes), "freed_pages",
+		len(tx.pagesToDelete), "splits", tx.rebalance.Splits, "merges", tx.rebalance.Merges, "rotations",
+		tx.rebalance.Rotations, "duration", duration)
+	tx.db.counters.pagesAllocated.Add(uint64(len(tx.allocatedPageNums)))
+	tx.db.counters.pagesFreed.Add(uint64(len(tx.pagesToDelete)))
+
+	if record != nil {
+		record.CommitLatency = tx.db.now().Sub(start)
+		tx.db.lastStats = record
+	}
+	if tx.writes != nil {
+		tx.writes.txid = tx.id
+		tx.db.optimistic.publish(tx.writes)
+	}
+	if len(tx.watchEvents) > 0 {
+		tx.db.watchers.deliver(tx.id, tx.watchEvents)
+	}
+	if checkpoints != nil {
+		tx.db.registerCheckpoints(checkpoints)
+	}
+	// The read transactions beginning from now on read the commit
+	tx.db.publishState()
+	tx.db.observeCommit()
 
 	tx.dirtyNodes = nil
 	tx.pagesToDelete = nil
 	tx.allocatedPageNums = nil
-	tx.db.rwlock.Unlock()
+	tx.collections = nil
+	return nil
+}
+
+// copyOnWrite moves the dirty nodes of pages the last commit uses to new pages, along with their ancestors up to the
+// root of the root collection, whose child pointers change. Commit then writes no page of the committed trees, which
+// stay as they were until the meta page of the commit is written. The old pages are freed by the commit.
+func (tx *Tx) copyOnWrite() error {
+	allocated := make(map[pgnum]bool, len(tx.allocatedPageNums))
+	for _, pageNum := range tx.allocatedPageNums {
+		allocated[pageNum] = true
+	}
+	// Only the nodes the transaction read can lead to a dirty node
+	visited := func(pageNum pgnum) bool {
+		_, dirty := tx.dirtyNodes[pageNum]
+		return dirty || tx.readPages[pageNum]
+	}
+
+	var relocate func(pageNum pgnum, collections bool) (pgnum, error)
+	relocate = func(pageNum pgnum, collections bool) (pgnum, error) {
+		node, err := tx.getNode(pageNum)
+		if err != nil {
+			return 0, err
+		}
+		_, changed := tx.dirtyNodes[pageNum]
+		for i, child := range node.childNodes {
+			if !visited(child) {
+				continue
+			}
+			moved, err := relocate(child, collections)
+			if err != nil {
+				return 0, err
+			}
+			if moved != child {
+				node.childNodes[i] = moved
+				changed = true
+			}
+		}
+		// The items of the root collection are the collections, pointing to the roots of their trees, and so are the
+		// items of nested collections in the other trees
+		for i, item := range node.items {
+			if !collections && !item.collection {
+				continue
+			}
+			collection := newEmptyCollection()
+			collection.deserialize(item)
+			if !visited(collection.root) {
+				continue
+			}
+			moved, err := relocate(collection.root, false)
+			if err != nil {
+				return 0, err
+			}
+			if moved != collection.root {
+				collection.root = moved
+				node.items[i] = collection.serialize()
+				node.items[i].collection = item.collection
+				changed = true
+			}
+		}
+
+		if !changed || allocated[pageNum] {
+			return pageNum, nil
+		}
+		delete(tx.dirtyNodes, pageNum)
+		tx.pagesToDelete = append(tx.pagesToDelete, pageNum)
+		node.pageNum = tx.db.getNextPage()
+		tx.allocatedPageNums = append(tx.allocatedPageNums, node.pageNum)
+		tx.writeNode(node)
+		return node.pageNum, nil
+	}
+
+	root, err := relocate(tx.root, true)
+	if err != nil {
+		return err
+	}
+	tx.root = root
 	return nil
 }
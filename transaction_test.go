@@ -0,0 +1,508 @@
+package gopherdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// checkFile fails the test if Doctor finds anything wrong with the pages of the closed file.
+func checkFile(t *testing.T, path string, options *Options) {
+	t.Helper()
+	findings, err := Doctor(path, options)
+	if err != nil {
+		t.Fatalf("Doctor: %v", err)
+	}
+	for _, finding := range findings {
+		if finding.Severity > SeverityInfo && finding.Check != "options" {
+			t.Errorf("Doctor: %s %s: %s", finding.Severity, finding.Check, finding.Message)
+		}
+	}
+}
+
+func sortedPages(pages []pgnum) []pgnum {
+	pages = append([]pgnum{}, pages...)
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+	return pages
+}
+
+func TestFailedCommitKeepsThePreviousCommit(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("WAL=%v", wal), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			options := testOptions()
+			options.WAL = wal
+			db := openTestPath(t, path, options)
+			mustUpdate(t, db, func(tx *Tx) error {
+				c := getOrCreate(t, tx, "c")
+				for i := 0; i < 200; i++ {
+					if err := c.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("old")); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			txid, root := db.txid, db.root
+			free, maxPage := append([]pgnum{}, db.releasedPages...), db.maxPage
+
+			tx, err := db.WriteTx()
+			if err != nil {
+				t.Fatalf("WriteTx: %v", err)
+			}
+			c, err := tx.GetCollection([]byte("c"))
+			if err != nil {
+				t.Fatalf("GetCollection: %v", err)
+			}
+			for i := 0; i < 200; i += 2 {
+				if err := c.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("new")); err != nil {
+					t.Fatalf("Put: %v", err)
+				}
+			}
+			for i := 1; i < 200; i += 4 {
+				if err := c.Remove([]byte(fmt.Sprintf("key%03d", i))); err != nil {
+					t.Fatalf("Remove: %v", err)
+				}
+			}
+
+			// The writes of the commit fail: in place without WAL mode, and when logged in WAL mode
+			broken, err := os.Open(path)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			defer broken.Close()
+			if wal {
+				working := db.wal
+				db.wal = broken
+				err = tx.Commit()
+				db.wal = working
+			} else {
+				working := db.file
+				db.file = &fileBackend{file: broken}
+				err = tx.Commit()
+				db.file = working
+			}
+			if err == nil {
+				t.Fatal("Commit with failing writes: got nil error")
+			}
+
+			if db.txid != txid || db.root != root {
+				t.Errorf("after the failed commit: txid %d and root %d, want %d and %d", db.txid, db.root, txid, root)
+			}
+			// The pages the transaction took are free again, along with the ones it grew the file by
+			want := append([]pgnum{}, free...)
+			for pageNum := maxPage + 1; pageNum <= db.maxPage; pageNum++ {
+				want = append(want, pageNum)
+			}
+			want = sortedPages(want)
+			got := sortedPages(db.releasedPages)
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("free pages after the failed commit: got %v, want %v", got, want)
+			}
+			if value := getValue(t, db, "c", "key000"); value != "old" {
+				t.Errorf("key000 after the failed commit: got %q, want old", value)
+			}
+
+			putValue(t, db, "c", "key000", "newer")
+			if err := db.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			checkFile(t, path, options)
+			db = openTestPath(t, path, options)
+			for i, want := range map[int]string{0: "newer", 1: "old", 2: "old"} {
+				if value := getValue(t, db, "c", fmt.Sprintf("key%03d", i)); value != want {
+					t.Errorf("key%03d after reopening: got %q, want %q", i, value, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRollbackUndoesTreeChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	db := openTestPath(t, path, options)
+	expected := map[string][]byte{}
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i := 0; i < 500; i += 2 {
+			if err := c.Put(testKey(i), []byte("old")); err != nil {
+				return err
+			}
+			expected[string(testKey(i))] = []byte("old")
+		}
+		return nil
+	})
+	before := readFile(t, path)
+
+	// The transaction splits nodes by filling the gaps and merges them by removing most of the old keys
+	tx, err := db.WriteTx()
+	if err != nil {
+		t.Fatalf("WriteTx: %v", err)
+	}
+	c, err := tx.GetCollection([]byte("c"))
+	if err != nil {
+		t.Fatalf("GetCollection: %v", err)
+	}
+	for i := 1; i < 500; i += 2 {
+		if err := c.Put(testKey(i), []byte("new")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	for i := 0; i < 400; i += 2 {
+		if err := c.Remove(testKey(i)); err != nil {
+			t.Fatalf("Remove: %v", err)
+		}
+	}
+	tx.Rollback()
+
+	if after := readFile(t, path); !bytes.Equal(after, before) {
+		t.Error("the rolled back transaction wrote to the file")
+	}
+	mustView(t, db, func(tx *Tx) error {
+		checkTree(t, getOrCreate(t, tx, "c"), expected)
+		return nil
+	})
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	checkFile(t, path, options)
+}
+
+func TestDeleteCollectionFreesItsPages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	db := openTestPath(t, path, options)
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		for i := 0; i < 300; i++ {
+			if err := c.Put(testKey(i), []byte("v")); err != nil {
+				return err
+			}
+		}
+		if err := c.Put([]byte("big"), make([]byte, 5*options.pageSize)); err != nil {
+			return err
+		}
+		getOrCreate(t, tx, "empty")
+		return nil
+	})
+	var used int
+	mustView(t, db, func(tx *Tx) error {
+		stats, err := tx.FileStats()
+		if err != nil {
+			return err
+		}
+		for _, collection := range stats.Collections {
+			used += int(collection.Pages + collection.OverflowPages)
+		}
+		return nil
+	})
+	free := len(db.releasedPages)
+
+	mustUpdate(t, db, func(tx *Tx) error {
+		if err := tx.DeleteCollection([]byte("c"), DeleteIfEmpty); !errors.Is(err, ErrCollectionNotEmpty) {
+			t.Errorf("DeleteIfEmpty of a collection with keys: got %v, want ErrCollectionNotEmpty", err)
+		}
+		if err := tx.DeleteCollection([]byte("missing"), DeleteCascade); err != nil {
+			t.Errorf("DeleteCollection of a missing collection: %v", err)
+		}
+		if err := tx.DeleteCollection([]byte("empty"), DeleteIfEmpty); err != nil {
+			return err
+		}
+		return tx.DeleteCollection([]byte("c"), DeleteCascade)
+	})
+	// Every node and overflow page of both collections is free, give or take the pages the root collection and the
+	// freelist moved to
+	if freed := len(db.releasedPages) - free; freed < used-4 {
+		t.Errorf("deleting the collections freed %d pages, want about the %d pages they used", freed, used)
+	}
+	mustView(t, db, func(tx *Tx) error {
+		for _, name := range []string{"c", "empty"} {
+			if c, err := tx.GetCollection([]byte(name)); err != nil || c != nil {
+				t.Errorf("GetCollection(%s) after deleting it: got %v, %v", name, c, err)
+			}
+		}
+		return nil
+	})
+	mustView(t, db, func(tx *Tx) error {
+		if err := tx.DeleteCollection([]byte("c"), DeleteCascade); !errors.Is(err, ErrWriteInsideReadTx) {
+			t.Errorf("DeleteCollection in a read transaction: got %v, want ErrWriteInsideReadTx", err)
+		}
+		return nil
+	})
+
+	putValue(t, db, "c", "k", "new")
+	if value := getValue(t, db, "c", "key000000"); value != "" {
+		t.Errorf("the recreated collection has the key of the deleted one: %q", value)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	checkFile(t, path, options)
+}
+
+func TestCreateCollectionKeepsAnExistingOne(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 100; i++ {
+		putValue(t, db, "c", string(testKey(i)), "value")
+	}
+	mustUpdate(t, db, func(tx *Tx) error {
+		if _, err := tx.CreateCollection([]byte("c")); !errors.Is(err, ErrCollectionExists) {
+			t.Errorf("CreateCollection of an existing collection: got %v, want ErrCollectionExists", err)
+		}
+		return nil
+	})
+	if value := getValue(t, db, "c", "key000099"); value != "value" {
+		t.Errorf("key000099 after CreateCollection: got %q, want value", value)
+	}
+	if violations := checkViolations(t, db); violations != nil {
+		t.Fatalf("Check: %v", violations)
+	}
+}
+
+func TestListCollections(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustView(t, db, func(tx *Tx) error {
+		names, err := tx.ListCollections()
+		if err != nil || names == nil || len(names) != 0 {
+			t.Errorf("ListCollections of an empty file: got %q, %v, want none", names, err)
+		}
+		return nil
+	})
+	mustUpdate(t, db, func(tx *Tx) error {
+		for _, name := range []string{"users", "orders", "events"} {
+			getOrCreate(t, tx, name)
+		}
+		if _, err := tx.getOrCreateCollection(checkpointsCollection); err != nil {
+			return err
+		}
+		_, err := getOrCreate(t, tx, "users").CreateCollection([]byte("alice"))
+		return err
+	})
+
+	mustView(t, db, func(tx *Tx) error {
+		names, err := tx.ListCollections()
+		if err != nil {
+			return err
+		}
+		if fmt.Sprintf("%s", names) != "[events orders users]" {
+			t.Errorf("ListCollections: got %s, want [events orders users]", names)
+		}
+
+		stop := errors.New("stop")
+		var seen []string
+		err = tx.ForEachCollection(func(name []byte) error {
+			seen = append(seen, string(name))
+			if len(seen) == 2 {
+				return stop
+			}
+			return nil
+		})
+		if !errors.Is(err, stop) || fmt.Sprint(seen) != "[events orders]" {
+			t.Errorf("ForEachCollection stopped by fn: got %v, %v, want [events orders], stop", seen, err)
+		}
+		return nil
+	})
+}
+
+func TestRenameCollection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPath(t, path, nil)
+	for i := 0; i < 300; i++ {
+		putValue(t, db, "users", string(testKey(i)), "old")
+		putValue(t, db, "users-staged", string(testKey(i)), "new")
+	}
+	var stagedRoot pgnum
+	mustView(t, db, func(tx *Tx) error {
+		stagedRoot = getOrCreate(t, tx, "users-staged").root
+		return nil
+	})
+
+	mustUpdate(t, db, func(tx *Tx) error {
+		if err := tx.RenameCollection([]byte("missing"), []byte("x")); !errors.Is(err, ErrCollectionNotFound) {
+			t.Errorf("RenameCollection of a missing collection: got %v, want ErrCollectionNotFound", err)
+		}
+		err := tx.RenameCollection([]byte("users-staged"), []byte("users"))
+		if !errors.Is(err, ErrCollectionExists) {
+			t.Errorf("RenameCollection over a collection: got %v, want ErrCollectionExists", err)
+		}
+
+		// The handle opened before the swap writes to the renamed collection
+		staged := getOrCreate(t, tx, "users-staged")
+		if err := tx.RenameCollection([]byte("users"), []byte("users-old")); err != nil {
+			return err
+		}
+		if err := tx.RenameCollection([]byte("users-staged"), []byte("users")); err != nil {
+			return err
+		}
+		if users := getOrCreate(t, tx, "users"); users != staged || users.root != stagedRoot {
+			t.Errorf("the renamed collection isn't the staged one with its tree, root %d", users.root)
+		}
+		if err := staged.Put([]byte("late"), []byte("new")); err != nil {
+			return err
+		}
+		return tx.DeleteCollection([]byte("users-old"), DeleteCascade)
+	})
+	mustView(t, db, func(tx *Tx) error {
+		if err := tx.RenameCollection([]byte("users"), []byte("x")); !errors.Is(err, ErrWriteInsideReadTx) {
+			t.Errorf("RenameCollection in a read transaction: got %v, want ErrWriteInsideReadTx", err)
+		}
+		return nil
+	})
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	db = openTestPath(t, path, nil)
+	mustView(t, db, func(tx *Tx) error {
+		names, err := tx.ListCollections()
+		if err != nil {
+			return err
+		}
+		if fmt.Sprintf("%s", names) != "[users]" {
+			t.Errorf("collections after the swap: got %s, want [users]", names)
+		}
+		return nil
+	})
+	for _, key := range []string{"key000000", "key000299", "late"} {
+		if value := getValue(t, db, "users", key); value != "new" {
+			t.Errorf("%s after the swap: got %q, want new", key, value)
+		}
+	}
+	if violations := checkViolations(t, db); violations != nil {
+		t.Fatalf("Check: %v", violations)
+	}
+}
+
+func TestInternalCollectionsCantBeCreatedOrDeleted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	options := testOptions()
+	options.Checkpoints = []CheckpointTier{{Every: time.Nanosecond, For: time.Hour}}
+	db := openTestPath(t, path, options)
+	putAll(t, db, 50, "v1")
+	putAll(t, db, 50, "v2")
+	if len(db.Checkpoints()) == 0 {
+		t.Fatal("no checkpoint was taken")
+	}
+
+	mustUpdate(t, db, func(tx *Tx) error {
+		for _, name := range [][]byte{checkpointsCollection, statsHistoryCollection, cronCollection, loadCollection} {
+			if err := tx.DeleteCollection(name, DeleteCascade); !errors.Is(err, ErrInternalCollection) {
+				t.Errorf("DeleteCollection(%s): got %v, want ErrInternalCollection", name, err)
+			}
+		}
+		if _, err := tx.CreateCollection([]byte("__gopherdb_mine")); !errors.Is(err, ErrInternalCollection) {
+			t.Errorf("CreateCollection of an internal name: got %v, want ErrInternalCollection", err)
+		}
+		return nil
+	})
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	db = openTestPath(t, path, options)
+	checkCheckpoint(t, db, 1, 50, "v1")
+}
+
+func TestRenameCollectionChecksNamesAndKeyTransforms(t *testing.T) {
+	db := openTestDB(t, nil)
+	transform := &KeyTransform{Transform: HashKeys(8)}
+	db.SetKeyTransform([]byte("hashed"), transform)
+	db.SetKeyTransform([]byte("hashed-staged"), transform)
+	db.BeforePut([]byte("audited"), func(tx *Tx, key []byte, value []byte) ([]byte, []byte, error) {
+		return key, append([]byte("audited:"), value...), nil
+	})
+	for _, name := range []string{"plain", "hashed-staged"} {
+		putValue(t, db, name, "k", "v")
+	}
+
+	mustUpdate(t, db, func(tx *Tx) error {
+		for _, names := range [][2]string{{string(checkpointsCollection), "x"}, {"plain", string(cronCollection)}} {
+			err := tx.RenameCollection([]byte(names[0]), []byte(names[1]))
+			if !errors.Is(err, ErrInternalCollection) {
+				t.Errorf("RenameCollection from %q to %q: got %v, want ErrInternalCollection", names[0], names[1], err)
+			}
+		}
+		err := tx.RenameCollection([]byte("plain"), []byte("hashed"))
+		if !errors.Is(err, ErrKeyTransformMismatch) {
+			t.Errorf("RenameCollection to a name with a key transform: got %v, want ErrKeyTransformMismatch", err)
+		}
+		if err := tx.RenameCollection([]byte("hashed-staged"), []byte("hashed")); err != nil {
+			return err
+		}
+		// The triggers follow the name
+		return tx.RenameCollection([]byte("plain"), []byte("audited"))
+	})
+	if value := getValue(t, db, "hashed", "k"); value != "v" {
+		t.Errorf("k in the renamed collection with the same key transform: got %q, want v", value)
+	}
+	putValue(t, db, "audited", "k2", "v")
+	if value := getValue(t, db, "audited", "k2"); value != "audited:v" {
+		t.Errorf("put to the renamed collection: got %q, want the value of the trigger of the new name", value)
+	}
+}
+
+func TestReadTxSharedByGoroutines(t *testing.T) {
+	db := openTestDB(t, nil)
+	mustUpdate(t, db, func(tx *Tx) error {
+		for _, name := range []string{"a", "b"} {
+			c := getOrCreate(t, tx, name)
+			for i := 0; i < 500; i++ {
+				if err := c.Put(testKey(i), bytes.Repeat([]byte(name), 1+i%300)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	tx, err := db.ReadTx()
+	if err != nil {
+		t.Fatalf("ReadTx: %v", err)
+	}
+	defer tx.Rollback()
+	shared, err := tx.GetCollection([]byte("a"))
+	if err != nil {
+		t.Fatalf("GetCollection: %v", err)
+	}
+	// Goroutines share the collection, open collections, run batches and use their own cursors at the same time
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		go func(g int) {
+			errs <- tx.Batch(func() error {
+				other, err := tx.GetCollection([]byte("b"))
+				if err != nil {
+					return err
+				}
+				for i := g; i < 500; i += 8 {
+					for _, c := range []*Collection{shared, other} {
+						value, err := c.Get(testKey(i))
+						if err != nil {
+							return err
+						}
+						if len(value) != 1+i%300 || value[0] != c.name[0] {
+							return fmt.Errorf("%s has a value of %d bytes in %s", testKey(i), len(value), c.name)
+						}
+					}
+				}
+				count := 0
+				cur := shared.Cursor()
+				for k, _ := cur.First(); k != nil; k, _ = cur.Next() {
+					count++
+				}
+				if count != 500 {
+					return fmt.Errorf("the cursor returned %d keys, want 500", count)
+				}
+				return cur.Err()
+			})
+		}(g)
+	}
+	for g := 0; g < 8; g++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package gopherdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// dumpKeySize is the number of bytes of the keys shown by the dumps of the trees, enough to tell the ranges of the
+// nodes apart without lines growing with the keys.
+const dumpKeySize = 24
+
+// treeDumpNode is a node of a tree as shown by DumpTree and DumpTreeDot. Nodes that couldn't be read only have an
+// error.
+type treeDumpNode struct {
+	page     pgnum
+	depth    int
+	leaf     bool
+	keys     int
+	first    []byte
+	last     []byte
+	fill     float64
+	under    bool
+	children []pgnum
+	err      error
+}
+
+// DumpTree writes the tree of the collection to w, a node per line indented by its depth, in depth first order: the
+// page of the node, whether it's a branch or a leaf, its keys and the range they span, and how full its page is. Nodes
+// under the minimum fill, which a remove merges or rotates into, are flagged, which shows how splits and merges shape
+// the tree. A nil collection dumps the root tree, whose keys are the names of the collections. The keys are shown as
+// Go strings, cut to their first bytes.
+//
+//	page 12  branch  2 keys  ["k0040" .. "k0081"]  41% full
+//	  page 7  leaf  20 keys  ["k0000" .. "k0039"]  88% full
+func (db *DB) DumpTree(collection []byte, w io.Writer) error {
+	nodes, err := db.dumpTree(collection)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	for _, node := range nodes {
+		indent := strings.Repeat("  ", node.depth)
+		if node.err != nil {
+			fmt.Fprintf(bw, "%spage %d  error: %v\n", indent, node.page, node.err)
+			continue
+		}
+		fmt.Fprintf(bw, "%spage %d  %s  %d keys  %s  %.0f%% full", indent, node.page, node.kind(), node.keys,
+			node.keyRange(), node.fill)
+		if node.under {
+			fmt.Fprint(bw, "  underfilled")
+		}
+		fmt.Fprintln(bw)
+	}
+	return bw.Flush()
+}
+
+// DumpTreeDot writes the tree of the collection to w like DumpTree, as a Graphviz graph, which dot lays out:
+//
+//	gopherdb tree --format=dot data.db users | dot -Tsvg > users.svg
+func (db *DB) DumpTreeDot(collection []byte, w io.Writer) error {
+	nodes, err := db.dumpTree(collection)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "digraph %q {\n\tnode [shape=box, fontname=monospace];\n", string(collection))
+	for _, node := range nodes {
+		var label string
+		if node.err != nil {
+			label = fmt.Sprintf("page %d\nerror: %v", node.page, node.err)
+		} else {
+			label = fmt.Sprintf("page %d %s\n%d keys %.0f%% full\n%s", node.page, node.kind(), node.keys, node.fill,
+				node.keyRange())
+		}
+		style := ""
+		if node.err != nil || node.under {
+			style = ", color=red"
+		}
+		fmt.Fprintf(bw, "\tp%d [label=%q%s];\n", node.page, label, style)
+		for _, child := range node.children {
+			fmt.Fprintf(bw, "\tp%d -> p%d;\n", node.page, child)
+		}
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+func (n *treeDumpNode) kind() string {
+	if n.leaf {
+		return "leaf"
+	}
+	return "branch"
+}
+
+func (n *treeDumpNode) keyRange() string {
+	if n.keys == 0 {
+		return "[]"
+	}
+	return fmt.Sprintf("[%s .. %s]", dumpKey(n.first), dumpKey(n.last))
+}
+
+func dumpKey(key []byte) string {
+	if len(key) > dumpKeySize {
+		return fmt.Sprintf("%q...", key[:dumpKeySize])
+	}
+	return fmt.Sprintf("%q", key)
+}
+
+// dumpTree returns the nodes of the tree of the collection, or of the root tree for a nil collection, in depth first
+// order, as read by a read transaction.
+func (db *DB) dumpTree(collection []byte) ([]treeDumpNode, error) {
+	var nodes []treeDumpNode
+	err := db.View(func(tx *Tx) error {
+		root := tx.root
+		if collection != nil {
+			c, err := tx.GetCollection(collection)
+			if err != nil {
+				return err
+			}
+			if c == nil {
+				return fmt.Errorf("%w: %q", ErrCollectionNotFound, collection)
+			}
+			root = c.root
+		}
+		tx.dumpTree(&nodes, root, 0, map[pgnum]bool{})
+		return nil
+	})
+	return nodes, err
+}
+
+// dumpTree adds the nodes of the tree to nodes. Like snapshotTree, it records the nodes it can't read rather than
+// failing, and doesn't visit a page twice.
+func (tx *Tx) dumpTree(nodes *[]treeDumpNode, pageNum pgnum, depth int, visited map[pgnum]bool) {
+	if visited[pageNum] {
+		*nodes = append(*nodes, treeDumpNode{page: pageNum, depth: depth, err: errors.New("page already visited")})
+		return
+	}
+	visited[pageNum] = true
+
+	node, err := tx.getNode(pageNum)
+	if err != nil {
+		*nodes = append(*nodes, treeDumpNode{page: pageNum, depth: depth, err: err})
+		return
+	}
+	dump := treeDumpNode{
+		page:     pageNum,
+		depth:    depth,
+		leaf:     node.isLeaf(),
+		keys:     len(node.items),
+		fill:     100 * float64(node.nodeSize()) / float64(tx.db.pageSize),
+		under:    depth > 0 && node.isUnderPopulated(),
+		children: append([]pgnum{}, node.childNodes...),
+	}
+	if len(node.items) > 0 {
+		// The keys may be in the mapped file, which the read transaction must not outlive
+		dump.first = append([]byte{}, node.items[0].key...)
+		dump.last = append([]byte{}, node.items[len(node.items)-1].key...)
+	}
+	*nodes = append(*nodes, dump)
+
+	for _, child := range node.childNodes {
+		tx.dumpTree(nodes, child, depth+1, visited)
+	}
+}
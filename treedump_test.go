@@ -0,0 +1,54 @@
+package gopherdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDumpTree(t *testing.T) {
+	db := openTestDB(t, nil)
+	for i := 0; i < 100; i++ {
+		putValue(t, db, "c", string(testKey(i)), "value")
+	}
+	stats := collectionStats(t, db, "c")
+	nodes := int(stats.LeafPages + stats.BranchPages)
+
+	var text bytes.Buffer
+	if err := db.DumpTree([]byte("c"), &text); err != nil {
+		t.Fatalf("DumpTree: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(text.String(), "\n"), "\n")
+	if len(lines) != nodes {
+		t.Fatalf("got %d lines for %d nodes:\n%s", len(lines), nodes, text.String())
+	}
+	if !strings.HasPrefix(lines[0], "page ") || !strings.Contains(lines[0], "branch") {
+		t.Fatalf("the first line isn't the root branch: %s", lines[0])
+	}
+	first := fmt.Sprintf("[%q .. ", testKey(0))
+	if !strings.HasPrefix(lines[1], "  page ") || !strings.Contains(lines[1], "leaf") || !strings.Contains(lines[1], first) {
+		t.Fatalf("the second line isn't the first leaf: %s", lines[1])
+	}
+	if !strings.Contains(lines[1], "% full") {
+		t.Fatalf("the fill of the leaf is missing: %s", lines[1])
+	}
+
+	var dot bytes.Buffer
+	if err := db.DumpTreeDot([]byte("c"), &dot); err != nil {
+		t.Fatalf("DumpTreeDot: %v", err)
+	}
+	if !strings.HasPrefix(dot.String(), `digraph "c" {`) || strings.Count(dot.String(), " -> ") != len(lines)-1 {
+		t.Fatalf("got the graph:\n%s", dot.String())
+	}
+
+	// The root tree holds the names of the collections
+	text.Reset()
+	if err := db.DumpTree(nil, &text); err != nil || !strings.Contains(text.String(), `["c" .. "c"]`) {
+		t.Fatalf("got %v and the root tree:\n%s", err, text.String())
+	}
+	if err := db.DumpTree([]byte("missing"), &text); !errors.Is(err, ErrCollectionNotFound) {
+		t.Fatalf("got %v, want ErrCollectionNotFound", err)
+	}
+}
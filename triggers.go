@@ -0,0 +1,121 @@
+package gopherdb
+
+import "sync"
+
+// BeforePutTrigger is called inside the transaction before a key is put into a collection. It returns the key and value
+// to put instead, which lets it normalize keys or stamp values, or an error to reject the put. The error is returned by
+// Put as it is.
+type BeforePutTrigger func(tx *Tx, key []byte, value []byte) ([]byte, []byte, error)
+
+// BeforeDeleteTrigger is called inside the transaction before a key is removed from a collection, whether or not the
+// key exists. It returns the key to remove instead, or an error to reject the removal.
+type BeforeDeleteTrigger func(tx *Tx, key []byte) ([]byte, error)
+
+// changeHook is called inside the transaction after a key of a collection changed, with the previous and the new value.
+// A nil value means the key didn't exist before, or was removed. Views are maintained with change hooks.
+type changeHook func(tx *Tx, key []byte, oldValue []byte, newValue []byte) error
+
+// triggers holds the triggers of every collection by name. They're registered on the database rather than stored in
+// the file, so they have to be registered again every time the database is opened.
+type triggers struct {
+	mu           sync.RWMutex
+	beforePut    map[string][]BeforePutTrigger
+	beforeDelete map[string][]BeforeDeleteTrigger
+	changes      map[string][]changeHook
+	// keyTransforms holds the key transform of the collections that have one, see SetKeyTransform.
+	keyTransforms map[string]*KeyTransform
+}
+
+func newTriggers() *triggers {
+	return &triggers{
+		beforePut:    map[string][]BeforePutTrigger{},
+		beforeDelete: map[string][]BeforeDeleteTrigger{},
+		changes:      map[string][]changeHook{},
+
+		keyTransforms: map[string]*KeyTransform{},
+	}
+}
+
+// BeforePut registers a trigger called before every Put, PutFrom and Merge of the collection. Triggers run in the order
+// they were registered, each one receiving the key and value returned by the previous one, and the first error stops
+// the put. A trigger writing to its own collection runs the triggers again, so it must not recurse forever.
+func (db *DB) BeforePut(collection []byte, trigger BeforePutTrigger) {
+	db.triggers.mu.Lock()
+	defer db.triggers.mu.Unlock()
+	db.triggers.beforePut[string(collection)] = append(db.triggers.beforePut[string(collection)], trigger)
+}
+
+// BeforeDelete registers a trigger called before every Remove of the collection, including removals done by Merge.
+// Triggers run in registration order like BeforePut triggers.
+func (db *DB) BeforeDelete(collection []byte, trigger BeforeDeleteTrigger) {
+	db.triggers.mu.Lock()
+	defer db.triggers.mu.Unlock()
+	db.triggers.beforeDelete[string(collection)] = append(db.triggers.beforeDelete[string(collection)], trigger)
+}
+
+func (t *triggers) onChange(collection []byte, hook changeHook) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.changes[string(collection)] = append(t.changes[string(collection)], hook)
+}
+
+// needsValue reports whether the collection has put triggers, change hooks or a key transform, which need the whole
+// value of a put.
+func (t *triggers) needsValue(collection []byte) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.beforePut[string(collection)]) > 0 || len(t.changes[string(collection)]) > 0 ||
+		t.keyTransforms[string(collection)] != nil
+}
+
+func (t *triggers) hasChangeHooks(collection []byte) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.changes[string(collection)]) > 0
+}
+
+// The triggers run without holding the lock, so they can register more triggers.
+
+func (t *triggers) runBeforePut(tx *Tx, collection []byte, key []byte, value []byte) ([]byte, []byte, error) {
+	t.mu.RLock()
+	triggers := t.beforePut[string(collection)]
+	t.mu.RUnlock()
+
+	var err error
+	for _, trigger := range triggers {
+		key, value, err = trigger(tx, key, value)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return key, value, nil
+}
+
+func (t *triggers) runBeforeDelete(tx *Tx, collection []byte, key []byte) ([]byte, error) {
+	t.mu.RLock()
+	triggers := t.beforeDelete[string(collection)]
+	t.mu.RUnlock()
+
+	var err error
+	for _, trigger := range triggers {
+		key, err = trigger(tx, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+func (t *triggers) runChangeHooks(tx *Tx, collection []byte, key []byte, oldValue []byte, newValue []byte) error {
+	t.mu.RLock()
+	hooks := t.changes[string(collection)]
+	t.mu.RUnlock()
+
+	for _, hook := range hooks {
+		err := hook(tx, key, oldValue, newValue)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package gopherdb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestBeforePutTriggersRunInOrder(t *testing.T) {
+	db := openTestDB(t, nil)
+	var order []string
+	db.BeforePut([]byte("c"), func(tx *Tx, key []byte, value []byte) ([]byte, []byte, error) {
+		order = append(order, "lower")
+		return bytes.ToLower(key), value, nil
+	})
+	db.BeforePut([]byte("c"), func(tx *Tx, key []byte, value []byte) ([]byte, []byte, error) {
+		order = append(order, "stamp")
+		// Receives the key returned by the first trigger
+		return key, append(append([]byte{}, value...), " @"+string(key)...), nil
+	})
+	db.BeforePut([]byte("other"), func(tx *Tx, key []byte, value []byte) ([]byte, []byte, error) {
+		t.Errorf("the trigger of another collection ran for %s", key)
+		return key, value, nil
+	})
+
+	putValue(t, db, "c", "KEY", "value")
+	if len(order) != 2 || order[0] != "lower" || order[1] != "stamp" {
+		t.Errorf("triggers ran in the order %v, want [lower stamp]", order)
+	}
+	if value := getValue(t, db, "c", "key"); value != "value @key" {
+		t.Errorf("the value of the normalized key: got %q, want %q", value, "value @key")
+	}
+	if value := getValue(t, db, "c", "KEY"); value != "" {
+		t.Errorf("the key before the trigger was put with %q", value)
+	}
+
+	// Merge puts through the triggers too
+	mustUpdate(t, db, func(tx *Tx) error {
+		return getOrCreate(t, tx, "c").Merge([]byte("MERGED"), func(current []byte) ([]byte, error) {
+			return []byte("merged"), nil
+		})
+	})
+	if value := getValue(t, db, "c", "merged"); value != "merged @merged" {
+		t.Errorf("the value put by Merge: got %q, want %q", value, "merged @merged")
+	}
+}
+
+func TestTriggersRejectOperations(t *testing.T) {
+	db := openTestDB(t, nil)
+	errRejected := errors.New("rejected")
+	secondRan := false
+	db.BeforePut([]byte("c"), func(tx *Tx, key []byte, value []byte) ([]byte, []byte, error) {
+		if len(value) == 0 {
+			return nil, nil, errRejected
+		}
+		return key, value, nil
+	})
+	db.BeforePut([]byte("c"), func(tx *Tx, key []byte, value []byte) ([]byte, []byte, error) {
+		secondRan = len(value) == 0
+		return key, value, nil
+	})
+	db.BeforeDelete([]byte("c"), func(tx *Tx, key []byte) ([]byte, error) {
+		if string(key) == "kept" {
+			return nil, errRejected
+		}
+		return key, nil
+	})
+	putValue(t, db, "c", "kept", "value")
+
+	err := db.Update(func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		if err := c.Put([]byte("empty"), nil); !errors.Is(err, errRejected) {
+			t.Errorf("Put rejected by a trigger: got %v, want the error of the trigger", err)
+		}
+		if err := c.Remove([]byte("kept")); !errors.Is(err, errRejected) {
+			t.Errorf("Remove rejected by a trigger: got %v, want the error of the trigger", err)
+		}
+		return c.Put([]byte("empty"), nil)
+	})
+	if !errors.Is(err, errRejected) {
+		t.Errorf("Update: got %v, want the error of the trigger", err)
+	}
+	if secondRan {
+		t.Error("the trigger after the one rejecting the put ran")
+	}
+	if value := getValue(t, db, "c", "kept"); value != "value" {
+		t.Errorf("the key whose removal was rejected: got %q, want value", value)
+	}
+}
+
+func TestBeforeDeleteTriggers(t *testing.T) {
+	db := openTestDB(t, nil)
+	var removed []string
+	db.BeforeDelete([]byte("c"), func(tx *Tx, key []byte) ([]byte, error) {
+		removed = append(removed, string(key))
+		return bytes.ToLower(key), nil
+	})
+	db.BeforeDelete([]byte("c"), func(tx *Tx, key []byte) ([]byte, error) {
+		// Triggers write in the transaction of the removal
+		return key, getOrCreate(t, tx, "log").Put(key, []byte("removed"))
+	})
+	putValue(t, db, "c", "a", "value")
+	putValue(t, db, "c", "b", "value")
+
+	mustUpdate(t, db, func(tx *Tx) error {
+		c := getOrCreate(t, tx, "c")
+		if err := c.Remove([]byte("A")); err != nil {
+			return err
+		}
+		// The triggers run for keys that don't exist too
+		if err := c.Remove([]byte("MISSING")); err != nil {
+			return err
+		}
+		// And for the removals done by Merge
+		return c.Merge([]byte("b"), func(current []byte) ([]byte, error) {
+			return nil, nil
+		})
+	})
+	if len(removed) != 3 || removed[0] != "A" || removed[1] != "MISSING" || removed[2] != "b" {
+		t.Errorf("the delete triggers ran for %v, want [A MISSING b]", removed)
+	}
+	for _, key := range []string{"a", "b"} {
+		if value := getValue(t, db, "c", key); value != "" {
+			t.Errorf("%s wasn't removed, it has %q", key, value)
+		}
+		if value := getValue(t, db, "log", key); value != "removed" {
+			t.Errorf("the trigger wrote %q for %s, want removed", value, key)
+		}
+	}
+	if value := getValue(t, db, "log", "missing"); value != "removed" {
+		t.Errorf("the trigger wrote %q for a missing key, want removed", value)
+	}
+}
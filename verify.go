@@ -0,0 +1,90 @@
+package gopherdb
+
+import (
+	"fmt"
+)
+
+// VerifyMode selects what Open checks of the file before returning, see Options.VerifyOnOpen.
+type VerifyMode int
+
+const (
+	// VerifyOff checks nothing more than what Open reads: the checksum of the meta page and the freelist.
+	VerifyOff VerifyMode = iota
+	// VerifyQuick also checks that the free pages are in range and free once, and reads the nodes of the root
+	// collection and the root node of every collection, which must match their checksums. It reads a few pages, so it
+	// suits every startup.
+	VerifyQuick
+	// VerifyFull reads every node and overflow page of every tree, and checks that no page is used twice or is also
+	// free, like the checks of Doctor. It reads the whole file.
+	VerifyFull
+)
+
+// verify runs the checks of the mode on the last commit, and returns ErrVerifyFailed with the first problem found.
+func (db *DB) verify(mode VerifyMode) error {
+	if mode == VerifyOff {
+		return nil
+	}
+	tx, err := db.ReadTx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	d := &doctor{}
+	if mode == VerifyFull {
+		d.checkFreelist(tx, d.checkTrees(tx))
+	} else {
+		d.checkRoots(tx)
+		d.checkFreelist(tx, nil)
+	}
+	for _, finding := range d.findings {
+		if finding.Severity == SeverityCritical {
+			return fmt.Errorf("%w: %s", ErrVerifyFailed, finding.Message)
+		}
+	}
+	return nil
+}
+
+// checkRoots reads the nodes of the root collection and the root node of every collection.
+func (d *doctor) checkRoots(tx *Tx) {
+	var broken []pgnum
+	seen := map[pgnum]bool{}
+	read := func(pageNum pgnum) *Node {
+		if seen[pageNum] || pageNum > tx.db.maxPage || tx.db.isReserved(pageNum) {
+			broken = append(broken, pageNum)
+			return nil
+		}
+		seen[pageNum] = true
+		p, err := tx.db.readPage(pageNum)
+		node := NewEmptyNode()
+		if err == nil {
+			err = node.deserialize(p.data)
+		}
+		if err != nil {
+			broken = append(broken, pageNum)
+			return nil
+		}
+		return node
+	}
+	var walk func(pageNum pgnum)
+	walk = func(pageNum pgnum) {
+		node := read(pageNum)
+		if node == nil {
+			return
+		}
+		for _, item := range node.items {
+			collection := newEmptyCollection()
+			collection.deserialize(item)
+			read(collection.root)
+		}
+		for _, child := range node.childNodes {
+			walk(child)
+		}
+	}
+	walk(tx.db.root)
+
+	if len(broken) > 0 {
+		d.add(SeverityCritical, "checksums", fmt.Sprintf("%d root pages fail their checksum, can't be read, are out of range or are used twice: %s", len(broken), listPages(broken)),
+			"restore the file from a backup, or export what's left with the export command")
+	}
+}
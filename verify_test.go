@@ -0,0 +1,92 @@
+package gopherdb
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// corruptPage flips a bit of the first occurrence of the bytes in the page of the file.
+func corruptPage(t *testing.T, path string, pageSize int, pageNum pgnum, in []byte) {
+	t.Helper()
+	data := readFile(t, path)
+	page := data[int(pageNum)*pageSize : int(pageNum+1)*pageSize]
+	i := bytes.Index(page, in)
+	if i < 0 {
+		t.Fatalf("%q isn't in page %d", in, pageNum)
+	}
+	page[i] ^= 1
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+// openVerified opens the file with the verify mode and closes it, returning the error of Open.
+func openVerified(t *testing.T, path string, mode VerifyMode) error {
+	t.Helper()
+	options := testOptions()
+	options.VerifyOnOpen = mode
+	db, err := Open(path, options)
+	if err != nil {
+		return err
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return nil
+}
+
+func TestVerifyOnOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPath(t, path, nil)
+	for i := 0; i < 100; i++ {
+		putValue(t, db, "c", string(testKey(i)), "value")
+	}
+	var root, leaf pgnum
+	var separator []byte
+	mustView(t, db, func(tx *Tx) error {
+		root = getOrCreate(t, tx, "c").root
+		node, err := tx.getNode(root)
+		if err != nil {
+			return err
+		}
+		leaf, separator = node.childNodes[0], node.items[0].key
+		return nil
+	})
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	for _, mode := range []VerifyMode{VerifyOff, VerifyQuick, VerifyFull} {
+		if err := openVerified(t, filepath.Join(t.TempDir(), "new.db"), mode); err != nil {
+			t.Errorf("Open of a new file with mode %d: %v", mode, err)
+		}
+	}
+	if err := openVerified(t, path, VerifyFull); err != nil {
+		t.Fatalf("Open of an intact file: %v", err)
+	}
+
+	// A broken leaf is only found by reading every node
+	path2 := filepath.Join(t.TempDir(), "leaf.db")
+	if err := os.WriteFile(path2, readFile(t, path), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	corruptPage(t, path2, testOptions().pageSize, leaf, []byte("value"))
+	if err := openVerified(t, path2, VerifyFull); !errors.Is(err, ErrVerifyFailed) {
+		t.Errorf("full Open of a file with a broken leaf: got %v, want ErrVerifyFailed", err)
+	}
+	// The failed Open left the file closed and unlocked
+	if err := openVerified(t, path2, VerifyQuick); err != nil {
+		t.Errorf("quick Open of a file with a broken leaf: %v", err)
+	}
+
+	// A broken root node fails the quick check too
+	corruptPage(t, path, testOptions().pageSize, root, separator)
+	if err := openVerified(t, path, VerifyQuick); !errors.Is(err, ErrVerifyFailed) {
+		t.Errorf("quick Open of a file with a broken root: got %v, want ErrVerifyFailed", err)
+	}
+	if err := openVerified(t, path, VerifyOff); err != nil {
+		t.Errorf("Open without checks of a file with a broken root: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package gopherdb
+
+// ViewEntry is a key and value of a view.
+type ViewEntry struct {
+	Key   []byte
+	Value []byte
+}
+
+// ViewMapper maps a key and value of the source collection to the entries it contributes to the view. It must be
+// deterministic, since the entries of the previous value are found by mapping it again, and the keys it returns must
+// not be returned for any other source key. Returning no entries leaves the source key out of the view.
+type ViewMapper func(key []byte, value []byte) []ViewEntry
+
+// View is a collection derived from a source collection through a mapper. Every change of the source collection is
+// applied to the view inside the same transaction, so the view always matches the committed source. Views are
+// defined on the database like triggers, so they have to be defined again every time the database is opened; changes
+// made while a view isn't defined are only picked up by Rebuild.
+type View struct {
+	name   []byte
+	source []byte
+	mapper ViewMapper
+}
+
+// DefineView defines the view stored in the collection name, derived from the source collection. The view collection is
+// created with the first change of the source. Call Rebuild to build it from a source that already has keys.
+func (db *DB) DefineView(name []byte, source []byte, mapper ViewMapper) *View {
+	v := &View{name: name, source: source, mapper: mapper}
+	db.triggers.onChange(source, v.apply)
+	return v
+}
+
+// apply replaces the entries of the old value of a source key with the entries of the new one.
+func (v *View) apply(tx *Tx, key []byte, oldValue []byte, newValue []byte) error {
+	collection, err := tx.getOrCreateCollection(v.name)
+	if err != nil {
+		return err
+	}
+
+	var newEntries []ViewEntry
+	if newValue != nil {
+		newEntries = v.mapper(key, newValue)
+	}
+	if oldValue != nil {
+		kept := make(map[string]bool, len(newEntries))
+		for _, entry := range newEntries {
+			kept[string(entry.Key)] = true
+		}
+		for _, entry := range v.mapper(key, oldValue) {
+			if kept[string(entry.Key)] {
+				continue
+			}
+			err = collection.Remove(entry.Key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, entry := range newEntries {
+		err = collection.Put(entry.Key, entry.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Collection returns the collection of the view, or nil if it wasn't built yet. It's meant for reading; writing to it
+// directly makes it diverge from the source until the next Rebuild.
+func (v *View) Collection(tx *Tx) (*Collection, error) {
+	return tx.GetCollection(v.name)
+}
+
+// Rebuild drops the view and builds it again by mapping every key of the source collection.
+func (v *View) Rebuild(tx *Tx) error {
+	if !tx.write {
+		return ErrWriteInsideReadTx
+	}
+	err := tx.DeleteCollection(v.name, DeleteCascade)
+	if err != nil {
+		return err
+	}
+	collection, err := tx.CreateCollection(v.name)
+	if err != nil {
+		return err
+	}
+	source, err := tx.GetCollection(v.source)
+	if err != nil || source == nil {
+		return err
+	}
+
+	var entries []ViewEntry
+	err = tx.rangeItems(source.root, KeyRange{}, func(item *Item) (bool, error) {
+		item, err := source.resolveItem(item)
+		if err != nil {
+			return false, err
+		}
+		entries = append(entries, v.mapper(item.key, item.value)...)
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = collection.Put(entry.Key, entry.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package gopherdb
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// cityView maps users to the city they live in, with one entry per user keyed by city and user.
+func cityView(key []byte, value []byte) []ViewEntry {
+	if len(value) == 0 {
+		return nil
+	}
+	return []ViewEntry{{Key: []byte(string(value) + "/" + string(key)), Value: key}}
+}
+
+// viewEntries returns the entries of the view as key=value strings in key order.
+func viewEntries(t *testing.T, db *DB, v *View) []string {
+	t.Helper()
+	var entries []string
+	mustView(t, db, func(tx *Tx) error {
+		c, err := v.Collection(tx)
+		if err != nil || c == nil {
+			return err
+		}
+		return c.Scan(nil, func(key, value []byte) error {
+			entries = append(entries, string(key)+"="+string(value))
+			return nil
+		})
+	})
+	return entries
+}
+
+func checkEntries(t *testing.T, entries []string, expected ...string) {
+	t.Helper()
+	if fmt.Sprint(entries) != fmt.Sprint(expected) {
+		t.Errorf("the view has %v, want %v", entries, expected)
+	}
+}
+
+func TestViewFollowsTheSource(t *testing.T) {
+	db := openTestDB(t, nil)
+	v := db.DefineView([]byte("by_city"), []byte("users"), cityView)
+
+	putValue(t, db, "users", "alice", "paris")
+	putValue(t, db, "users", "bob", "oslo")
+	putValue(t, db, "users", "carol", "paris")
+	checkEntries(t, viewEntries(t, db, v), "oslo/bob=bob", "paris/alice=alice", "paris/carol=carol")
+
+	// Changing the value moves the entry, putting the same value keeps it, and a value mapped to no entries drops it
+	putValue(t, db, "users", "alice", "oslo")
+	putValue(t, db, "users", "bob", "oslo")
+	putValue(t, db, "users", "carol", "")
+	checkEntries(t, viewEntries(t, db, v), "oslo/alice=alice", "oslo/bob=bob")
+
+	mustUpdate(t, db, func(tx *Tx) error {
+		return getOrCreate(t, tx, "users").Remove([]byte("bob"))
+	})
+	checkEntries(t, viewEntries(t, db, v), "oslo/alice=alice")
+
+	// Changes of a transaction that fails aren't applied to the view either
+	errFailed := errors.New("failed")
+	err := db.Update(func(tx *Tx) error {
+		if err := getOrCreate(t, tx, "users").Put([]byte("dave"), []byte("rome")); err != nil {
+			return err
+		}
+		return errFailed
+	})
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("Update: %v", err)
+	}
+	checkEntries(t, viewEntries(t, db, v), "oslo/alice=alice")
+}
+
+func TestViewRebuild(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openTestPath(t, path, nil)
+	for i := 0; i < 50; i++ {
+		putValue(t, db, "users", fmt.Sprintf("user%02d", i), fmt.Sprintf("city%d", i%3))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// A view defined over a source that already has keys is empty until it's rebuilt
+	db = openTestPath(t, path, nil)
+	v := db.DefineView([]byte("by_city"), []byte("users"), cityView)
+	if entries := viewEntries(t, db, v); len(entries) != 0 {
+		t.Errorf("the view has %d entries before being built", len(entries))
+	}
+	var expected []string
+	for city := 0; city < 3; city++ {
+		for i := city; i < 50; i += 3 {
+			expected = append(expected, fmt.Sprintf("city%d/user%02d=user%02d", city, i, i))
+		}
+	}
+	mustUpdate(t, db, v.Rebuild)
+	checkEntries(t, viewEntries(t, db, v), expected...)
+
+	// Rebuilding drops the entries written to the view directly
+	mustUpdate(t, db, func(tx *Tx) error {
+		return getOrCreate(t, tx, "by_city").Put([]byte("stray"), []byte("entry"))
+	})
+	mustUpdate(t, db, v.Rebuild)
+	checkEntries(t, viewEntries(t, db, v), expected...)
+
+	if err := db.View(v.Rebuild); !errors.Is(err, ErrWriteInsideReadTx) {
+		t.Errorf("Rebuild in a read transaction: got %v, want ErrWriteInsideReadTx", err)
+	}
+}
@@ -0,0 +1,314 @@
+package gopherdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	walMagic            uint32 = 0x57414c21
+	walRecordHeaderSize        = magicNumberSize + 4 + 4
+	walSuffix                  = "-wal"
+	// defaultWALCheckpointPages is the number of pages logged before a checkpoint when Options.WALCheckpointPages is
+	// zero.
+	defaultWALCheckpointPages = 1000
+)
+
+// In WAL mode, see Options.WAL, the pages written by a commit are kept in memory until the commit is done, and then
+// appended to the WAL as a single record: its header, the page numbers and contents, and a CRC-32C of all of it. Only
+// the WAL is synced, so a commit is one sequential write. Reads find the pages of the WAL in memory, and checkpoints
+// copy them to the file and empty the WAL. A record cut short by a crash doesn't match its checksum, so it's ignored
+// along with anything after it when the WAL is replayed.
+
+func walPath(path string) string {
+	return path + walSuffix
+}
+
+// replayWAL copies the complete records of the WAL of the file into it, empties the WAL and returns the number of
+// records. It runs before the meta pages are read, so a crash after a commit was logged but before it was checkpointed
+// loses nothing, whether the file is opened in WAL mode again or not. The WAL is kept open in WAL mode, and removed
+// otherwise.
+func (d *dal) replayWAL(path string) (int, error) {
+	flags := os.O_RDWR
+	if d.walEnabled {
+		flags |= os.O_CREATE
+	}
+	wal, err := os.OpenFile(walPath(path), flags, 0666)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	data, err := io.ReadAll(wal)
+	if err != nil {
+		_ = wal.Close()
+		return 0, err
+	}
+	records := d.walRecords(data)
+	for _, record := range records {
+		for pageNum, page := range record {
+			err = d.file.WritePage(uint64(pageNum), page)
+			if err != nil {
+				_ = wal.Close()
+				return 0, err
+			}
+		}
+	}
+	if len(data) > 0 {
+		err = d.file.Sync()
+		if err == nil {
+			err = wal.Truncate(0)
+		}
+		if err == nil {
+			err = wal.Sync()
+		}
+		if err != nil {
+			_ = wal.Close()
+			return 0, err
+		}
+	}
+	if !d.walEnabled {
+		err = wal.Close()
+		if err != nil {
+			return 0, err
+		}
+		return len(records), os.Remove(walPath(path))
+	}
+	d.useWAL(wal, path)
+	return len(records), nil
+}
+
+// loadWAL reads the complete records of the WAL of the file into memory, where reads find them, and returns the number
+// of records, without writing to the file or the WAL. It's replayWAL for Options.ReadOnly.
+func (d *dal) loadWAL(path string) (int, error) {
+	data, err := os.ReadFile(walPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	records := d.walRecords(data)
+	if len(records) == 0 {
+		return 0, nil
+	}
+	d.walPages = map[pgnum][]byte{}
+	for _, record := range records {
+		for pageNum, page := range record {
+			d.walPages[pageNum] = page
+		}
+	}
+	return len(records), nil
+}
+
+// createWAL starts the WAL of a new file, dropping the WAL of a file that was deleted. Without WAL mode, it only
+// removes that WAL.
+func (d *dal) createWAL(path string) error {
+	if !d.walEnabled {
+		err := os.Remove(walPath(path))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	wal, err := os.OpenFile(walPath(path), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	d.useWAL(wal, path)
+	return nil
+}
+
+func (d *dal) useWAL(wal *os.File, path string) {
+	d.wal = wal
+	d.walFilePath = walPath(path)
+	d.walPages = map[pgnum][]byte{}
+	d.walPending = map[pgnum][]byte{}
+}
+
+// walRecords returns the pages of every complete record of the WAL, in the order they were logged.
+func (d *dal) walRecords(data []byte) []map[pgnum][]byte {
+	var records []map[pgnum][]byte
+	for len(data) >= walRecordHeaderSize {
+		count := int(binary.LittleEndian.Uint32(data[magicNumberSize:]))
+		pageSize := int(binary.LittleEndian.Uint32(data[magicNumberSize+4:]))
+		if binary.LittleEndian.Uint32(data) != walMagic || pageSize != d.pageSize {
+			break
+		}
+		size := walRecordHeaderSize + count*(pageNumSize+pageSize) + checksumSize
+		if count <= 0 || size > len(data) {
+			break
+		}
+		end := size - checksumSize
+		if binary.LittleEndian.Uint32(data[end:]) != crc32.Checksum(data[:end], castagnoli) {
+			break
+		}
+		record := make(map[pgnum][]byte, count)
+		body := data[walRecordHeaderSize:end]
+		for i := 0; i < count; i++ {
+			entry := body[i*(pageNumSize+pageSize):]
+			record[pgnum(binary.LittleEndian.Uint64(entry))] = entry[pageNumSize : pageNumSize+pageSize]
+		}
+		records = append(records, record)
+		data = data[size:]
+	}
+	return records
+}
+
+// walPage returns the latest content of the page if it's in the WAL or written by the commit in progress.
+func (d *dal) walPage(pageNum pgnum) ([]byte, bool) {
+	d.walMu.RLock()
+	defer d.walMu.RUnlock()
+	if d.walPages == nil {
+		return nil, false
+	}
+	if data, ok := d.walPending[pageNum]; ok {
+		return data, true
+	}
+	data, ok := d.walPages[pageNum]
+	return data, ok
+}
+
+// commitPages makes the pages written by a commit durable: in WAL mode by logging them, and otherwise by syncing the
+// file, unless Options.NoSync is set.
+func (d *dal) commitPages() error {
+	if d.wal == nil {
+		return d.syncCommit()
+	}
+	if len(d.walPending) == 0 {
+		return nil
+	}
+
+	pageNums := make([]pgnum, 0, len(d.walPending))
+	for pageNum := range d.walPending {
+		pageNums = append(pageNums, pageNum)
+	}
+	sort.Slice(pageNums, func(i, j int) bool { return pageNums[i] < pageNums[j] })
+	buf := make([]byte, 0, walRecordHeaderSize+len(pageNums)*(pageNumSize+d.pageSize)+checksumSize)
+	buf = binary.LittleEndian.AppendUint32(buf, walMagic)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(pageNums)))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(d.pageSize))
+	for _, pageNum := range pageNums {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(pageNum))
+		buf = append(buf, d.walPending[pageNum]...)
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, castagnoli))
+
+	// A record that failed to be written is overwritten by the next one
+	d.throttle.wait(len(buf))
+	_, err := d.wal.WriteAt(buf, d.walSize)
+	if err == nil && !d.noSync {
+		err = d.wal.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	d.counters.bytesWritten.Add(uint64(len(buf)))
+	d.walSize += int64(len(buf))
+	d.walLogged += len(pageNums)
+	d.walMu.Lock()
+	for pageNum, data := range d.walPending {
+		d.walPages[pageNum] = data
+	}
+	d.walPending = map[pgnum][]byte{}
+	d.walMu.Unlock()
+
+	// The commit is done once it's logged, so a checkpoint that fails is only retried by the next commit
+	if d.walLogged >= d.walCheckpointPages {
+		_ = d.checkpointWAL()
+	}
+	return nil
+}
+
+// checkpointWAL copies the pages of the WAL to the file and empties the WAL. The WAL is only emptied once the file is
+// synced, so a crash in the middle leaves the WAL to be replayed again by Open.
+func (d *dal) checkpointWAL() error {
+	if d.wal == nil || len(d.walPages) == 0 {
+		return nil
+	}
+	for pageNum, data := range d.walPages {
+		d.throttle.wait(len(data))
+		err := d.file.WritePage(uint64(pageNum), data)
+		if err != nil {
+			return err
+		}
+		d.counters.bytesWritten.Add(uint64(len(data)))
+	}
+	err := d.file.Sync()
+	if err != nil {
+		return err
+	}
+	err = d.wal.Truncate(0)
+	if err != nil {
+		return err
+	}
+	err = d.wal.Sync()
+	if err != nil {
+		return err
+	}
+	d.walMu.Lock()
+	d.walPages = map[pgnum][]byte{}
+	d.walMu.Unlock()
+	d.walSize = 0
+	d.walLogged = 0
+	return nil
+}
+
+// closeWAL checkpoints the WAL and removes it, when the file is closed cleanly.
+func (d *dal) closeWAL() error {
+	if d.wal == nil {
+		return nil
+	}
+	err := d.checkpointWAL()
+	if err != nil {
+		return err
+	}
+	err = d.wal.Close()
+	d.wal = nil
+	if err != nil {
+		return err
+	}
+	err = os.Remove(d.walFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// pageReader reads the pages of the file as they are after the last commit, from the WAL in WAL mode.
+type pageReader struct {
+	d *dal
+}
+
+// ReadAt reads a page from the WAL, or from the file if it isn't there. Reads are of a single page.
+func (r pageReader) ReadAt(p []byte, off int64) (int, error) {
+	pageNum := pgnum(off / int64(r.d.pageSize))
+	if data, ok := r.d.walPage(pageNum); ok {
+		return copy(p, data), nil
+	}
+	err := r.d.file.ReadPage(uint64(pageNum), p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// CheckpointWAL copies the commits logged in the WAL to the file and empties the WAL, see Options.WAL. It waits for
+// the running write transaction to end. Without WAL mode it does nothing.
+func (db *DB) CheckpointWAL() error {
+	if db.readOnly.Load() {
+		return ErrWriteInsideReadTx
+	}
+	err := db.begin()
+	if err != nil {
+		return err
+	}
+	db.rwlock.Lock()
+	defer db.endTx(true)
+	return db.checkpointWAL()
+}
@@ -0,0 +1,238 @@
+package gopherdb
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// WatchEvent is a change to a watched key, delivered once the transaction making it committed.
+type WatchEvent struct {
+	Collection []byte
+	Key        []byte
+	// Value is the new value of the key, or nil if the key was removed.
+	Value []byte
+	TxID  uint64
+}
+
+// WatchPolicy selects what a subscription does with an event when its buffer is full.
+type WatchPolicy int
+
+const (
+	// WatchDrop drops the events arriving while the buffer is full. They're counted by Subscription.Dropped.
+	WatchDrop WatchPolicy = iota
+	// WatchCoalesce replaces the buffered event of a key with its latest one, so a slow reader only sees the last
+	// value of every key it got behind on. Events of other keys arriving while the buffer is full are dropped, like
+	// with WatchDrop.
+	WatchCoalesce
+)
+
+// WatchOptions configures a subscription. Buffer is the number of events kept for the reader; zero means 64.
+type WatchOptions struct {
+	Buffer int
+	Policy WatchPolicy
+}
+
+const defaultWatchBuffer = 64
+
+// Subscription delivers the changes of a range of keys of a collection, see DB.Watch.
+type Subscription struct {
+	w          *watchers
+	collection string
+	keys       KeyRange
+	buffer     int
+	policy     WatchPolicy
+	events     chan WatchEvent
+	dropped    atomic.Uint64
+
+	// pending holds the events waiting for the reader. It's only used by the dispatcher.
+	pending []WatchEvent
+}
+
+// Events returns the channel the events are delivered on, in commit order. It's closed once the subscription is.
+func (s *Subscription) Events() <-chan WatchEvent {
+	return s.events
+}
+
+// Dropped returns the number of events dropped because the buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close ends the subscription. The events still buffered are dropped, and the channel is closed shortly after.
+func (s *Subscription) Close() {
+	s.w.mu.Lock()
+	defer s.w.mu.Unlock()
+	if !s.w.subscriptions[s] {
+		return
+	}
+	delete(s.w.subscriptions, s)
+	s.w.closed = append(s.w.closed, s)
+	s.w.signal()
+}
+
+// add buffers the event for the reader, following the policy when the buffer is full.
+func (s *Subscription) add(event WatchEvent) {
+	// The event replacing a buffered one goes last, so the events stay in commit order
+	if s.policy == WatchCoalesce {
+		for i := range s.pending {
+			if string(s.pending[i].Key) == string(event.Key) {
+				s.pending = append(s.pending[:i], s.pending[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(s.pending) >= s.buffer {
+		s.dropped.Add(1)
+		return
+	}
+	s.pending = append(s.pending, event)
+}
+
+// watchers holds the subscriptions of a file, shared by its handles. Commits queue their events, and a single
+// dispatcher goroutine hands them to the subscriptions, so a slow reader never holds up a commit or the other readers.
+// The dispatcher runs while there are subscriptions.
+type watchers struct {
+	mu            sync.Mutex
+	subscriptions map[*Subscription]bool
+	// hooked holds the collections whose change hook is registered. Change hooks can't be removed, so the hook stays
+	// and does nothing once the collection has no subscription.
+	hooked map[string]bool
+	queue  [][]WatchEvent
+	closed []*Subscription
+	wake   chan struct{}
+	// running is set while the dispatcher runs.
+	running bool
+}
+
+func newWatchers() *watchers {
+	return &watchers{subscriptions: map[*Subscription]bool{}, hooked: map[string]bool{}, wake: make(chan struct{}, 1)}
+}
+
+// signal wakes the dispatcher up. It's called holding the lock.
+func (w *watchers) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Watch subscribes to the changes of the keys of the collection in the range, which are delivered on
+// Subscription.Events once the transactions making them commit. Keys are the ones Put and Remove take, before any key
+// transform. Every Put and Remove is an event, including the ones leaving the value as it was; DeleteCollection isn't.
+// Watching a collection makes its puts read the previous value, like views do. The subscription must be closed when
+// it's not needed anymore.
+func (db *DB) Watch(collection []byte, keys KeyRange, options *WatchOptions) *Subscription {
+	s := &Subscription{w: db.watchers, collection: string(collection), keys: keys, buffer: defaultWatchBuffer}
+	if options != nil {
+		s.policy = options.Policy
+		if options.Buffer > 0 {
+			s.buffer = options.Buffer
+		}
+	}
+	s.events = make(chan WatchEvent)
+
+	w := db.watchers
+	w.mu.Lock()
+	w.subscriptions[s] = true
+	hook := !w.hooked[s.collection]
+	w.hooked[s.collection] = true
+	if !w.running {
+		w.running = true
+		go w.dispatch()
+	}
+	w.mu.Unlock()
+	if hook {
+		db.triggers.onChange(collection, w.collectEvent(s.collection))
+	}
+	return s
+}
+
+// collectEvent returns the change hook of a watched collection, which keeps the changes of the transaction for Commit.
+func (w *watchers) collectEvent(collection string) changeHook {
+	return func(tx *Tx, key []byte, oldValue []byte, newValue []byte) error {
+		if !w.watching(collection, key) {
+			return nil
+		}
+		event := WatchEvent{Collection: []byte(collection), Key: append([]byte{}, key...)}
+		if newValue != nil {
+			event.Value = append([]byte{}, newValue...)
+		}
+		tx.watchEvents = append(tx.watchEvents, event)
+		return nil
+	}
+}
+
+func (w *watchers) watching(collection string, key []byte) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for s := range w.subscriptions {
+		if s.collection == collection && s.keys.contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver queues the events of a commit for the dispatcher.
+func (w *watchers) deliver(txid uint64, events []WatchEvent) {
+	for i := range events {
+		events[i].TxID = txid
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.running {
+		return
+	}
+	w.queue = append(w.queue, events)
+	w.signal()
+}
+
+// dispatch moves the queued events to the subscriptions they match, and sends the first pending event of every
+// subscription to whichever reader is ready, until there's no subscription left.
+func (w *watchers) dispatch() {
+	for {
+		w.mu.Lock()
+		queue, closed := w.queue, w.closed
+		w.queue, w.closed = nil, nil
+		subscriptions := make([]*Subscription, 0, len(w.subscriptions))
+		for s := range w.subscriptions {
+			subscriptions = append(subscriptions, s)
+		}
+		if len(subscriptions) == 0 {
+			w.running = false
+		}
+		w.mu.Unlock()
+
+		for _, s := range closed {
+			s.pending = nil
+			close(s.events)
+		}
+		if len(subscriptions) == 0 {
+			return
+		}
+		for _, events := range queue {
+			for _, event := range events {
+				for _, s := range subscriptions {
+					if s.collection == string(event.Collection) && s.keys.contains(event.Key) {
+						s.add(event)
+					}
+				}
+			}
+		}
+
+		cases := []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(w.wake)}}
+		var waiting []*Subscription
+		for _, s := range subscriptions {
+			if len(s.pending) > 0 {
+				cases = append(cases, reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(s.events), Send: reflect.ValueOf(s.pending[0])})
+				waiting = append(waiting, s)
+			}
+		}
+		chosen, _, _ := reflect.Select(cases)
+		if chosen > 0 {
+			s := waiting[chosen-1]
+			s.pending = s.pending[1:]
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package gopherdb
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// nextEvent returns the next event of the subscription, failing if none arrives in time.
+func nextEvent(t *testing.T, s *Subscription) WatchEvent {
+	t.Helper()
+	select {
+	case event, ok := <-s.Events():
+		if !ok {
+			t.Fatal("the subscription was closed")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event was delivered")
+	}
+	return WatchEvent{}
+}
+
+// noEvent fails if the subscription delivers an event.
+func noEvent(t *testing.T, s *Subscription) {
+	t.Helper()
+	select {
+	case event := <-s.Events():
+		t.Fatalf("unexpected event for %s", event.Key)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// waitDropped waits for the dispatcher to have dropped n events of the subscription.
+func waitDropped(t *testing.T, s *Subscription, n uint64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Dropped() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d events were dropped, want %d", s.Dropped(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func checkEvent(t *testing.T, event WatchEvent, key string, value string) {
+	t.Helper()
+	if string(event.Key) != key || string(event.Value) != value {
+		t.Errorf("got the event %s=%q, want %s=%q", event.Key, event.Value, key, value)
+	}
+}
+
+func TestWatchRange(t *testing.T) {
+	db := openTestDB(t, nil)
+	s := db.Watch([]byte("c"), KeyRange{Start: []byte("b"), End: []byte("d")}, nil)
+	defer s.Close()
+
+	putValue(t, db, "c", "a", "1")
+	putValue(t, db, "c", "b", "2")
+	putValue(t, db, "other", "c", "3")
+	putValue(t, db, "c", "d", "4")
+	putValue(t, db, "c", "c", "5")
+	event := nextEvent(t, s)
+	checkEvent(t, event, "b", "2")
+	if string(event.Collection) != "c" || event.TxID == 0 {
+		t.Errorf("the event has the collection %q and txid %d", event.Collection, event.TxID)
+	}
+	next := nextEvent(t, s)
+	checkEvent(t, next, "c", "5")
+	if next.TxID <= event.TxID {
+		t.Errorf("the events aren't in commit order: txid %d after %d", next.TxID, event.TxID)
+	}
+
+	// Removals have no value, and rolled back changes aren't delivered
+	mustUpdate(t, db, func(tx *Tx) error {
+		return getOrCreate(t, tx, "c").Remove([]byte("b"))
+	})
+	if event := nextEvent(t, s); string(event.Key) != "b" || event.Value != nil {
+		t.Errorf("got the event %s=%q for the removal of b", event.Key, event.Value)
+	}
+	errRollback := errors.New("rollback")
+	err := db.Update(func(tx *Tx) error {
+		if err := getOrCreate(t, tx, "c").Put([]byte("c"), []byte("6")); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatalf("Update returned %v", err)
+	}
+	noEvent(t, s)
+}
+
+func TestWatchSubscriptions(t *testing.T) {
+	db := openTestDB(t, nil)
+	all := db.Watch([]byte("c"), KeyRange{}, nil)
+	defer all.Close()
+	low := db.Watch([]byte("c"), KeyRange{End: []byte("m")}, nil)
+
+	putValue(t, db, "c", "a", "1")
+	putValue(t, db, "c", "z", "2")
+	checkEvent(t, nextEvent(t, all), "a", "1")
+	checkEvent(t, nextEvent(t, all), "z", "2")
+	checkEvent(t, nextEvent(t, low), "a", "1")
+	noEvent(t, low)
+
+	// Closing a subscription closes its channel and leaves the others alone
+	low.Close()
+	low.Close()
+	select {
+	case _, ok := <-low.Events():
+		if ok {
+			t.Error("an event was delivered after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the channel wasn't closed")
+	}
+	putValue(t, db, "c", "b", "3")
+	checkEvent(t, nextEvent(t, all), "b", "3")
+
+	// A reader that doesn't read holds up neither the commits nor the other readers
+	stuck := db.Watch([]byte("c"), KeyRange{}, &WatchOptions{Buffer: 1})
+	defer stuck.Close()
+	for _, key := range []string{"d", "e", "f"} {
+		putValue(t, db, "c", key, key)
+		checkEvent(t, nextEvent(t, all), key, key)
+	}
+	waitDropped(t, stuck, 2)
+	checkEvent(t, nextEvent(t, stuck), "d", "d")
+}
+
+func TestWatchDropsWhenTheBufferIsFull(t *testing.T) {
+	db := openTestDB(t, nil)
+	s := db.Watch([]byte("c"), KeyRange{}, &WatchOptions{Buffer: 2, Policy: WatchDrop})
+	defer s.Close()
+
+	for _, key := range []string{"a", "b", "a", "c", "d"} {
+		putValue(t, db, "c", key, key)
+	}
+	waitDropped(t, s, 3)
+	checkEvent(t, nextEvent(t, s), "a", "a")
+	checkEvent(t, nextEvent(t, s), "b", "b")
+	noEvent(t, s)
+	if s.Dropped() != 3 {
+		t.Errorf("%d events were dropped, want 3", s.Dropped())
+	}
+
+	// The buffer takes events again once read
+	putValue(t, db, "c", "e", "e")
+	checkEvent(t, nextEvent(t, s), "e", "e")
+}
+
+func TestWatchCoalescesTheEventsOfAKey(t *testing.T) {
+	db := openTestDB(t, nil)
+	s := db.Watch([]byte("c"), KeyRange{}, &WatchOptions{Buffer: 2, Policy: WatchCoalesce})
+	defer s.Close()
+
+	putValue(t, db, "c", "a", "1")
+	putValue(t, db, "c", "b", "1")
+	putValue(t, db, "c", "a", "2")
+	putValue(t, db, "c", "a", "3")
+	// Another key doesn't fit
+	putValue(t, db, "c", "c", "1")
+	waitDropped(t, s, 1)
+
+	// Nothing was read, so the replaced a=1 is gone and a goes last with its latest value
+	checkEvent(t, nextEvent(t, s), "b", "1")
+	checkEvent(t, nextEvent(t, s), "a", "3")
+	noEvent(t, s)
+	if s.Dropped() != 1 {
+		t.Errorf("%d events were dropped, want 1", s.Dropped())
+	}
+}